@@ -0,0 +1,3 @@
+module apigen
+
+go 1.21
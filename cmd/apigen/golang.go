@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strings"
+)
+
+// goInitialisms are written in capitals in Go names, as in DeviceID.
+var goInitialisms = map[string]bool{"id": true, "ul": true, "url": true, "api": true, "http": true, "json": true}
+
+// goName makes an exported Go name of a snake_case or camelCase name.
+func goName(name string) string {
+	var b strings.Builder
+	for _, word := range splitWords(name) {
+		if goInitialisms[strings.ToLower(word)] {
+			b.WriteString(strings.ToUpper(word))
+		} else {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// goArg makes an unexported Go name, as in deviceID.
+func goArg(name string) string {
+	words := splitWords(name)
+	first := strings.ToLower(words[0])
+	return first + goName(strings.Join(words[1:], "_"))
+}
+
+// splitWords splits snake_case and camelCase names into words.
+func splitWords(name string) []string {
+	var words []string
+	for _, part := range strings.Split(name, "_") {
+		start := 0
+		for i := 1; i < len(part); i++ {
+			if part[i] >= 'A' && part[i] <= 'Z' && part[i-1] >= 'a' && part[i-1] <= 'z' {
+				words = append(words, part[start:i])
+				start = i
+			}
+		}
+		if part != "" {
+			words = append(words, part[start:])
+		}
+	}
+	return words
+}
+
+func goType(t *TypeRef) string {
+	switch t.Kind {
+	case "string":
+		return "string"
+	case "integer":
+		return "int"
+	case "int64":
+		return "int64"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + goType(t.Elem)
+	case "map":
+		return "map[string]" + goType(t.Elem)
+	case "named":
+		return t.Name
+	}
+	return "interface{}"
+}
+
+// goFieldType is a field's type: a pointer if it may be null, or for an
+// object that may be left out.
+func goFieldType(t *TypeRef, required bool) string {
+	base := goType(t)
+	switch {
+	case t.Kind == "array" || t.Kind == "map" || t.Kind == "any":
+		return base
+	case t.Nullable, t.Kind == "named" && t.Object && !required:
+		return "*" + base
+	}
+	return base
+}
+
+// goComment writes text as a comment, wrapped, with the given indent.
+func goComment(b *bytes.Buffer, indent, text string) {
+	for _, line := range wrap(text, 76-len(indent)) {
+		fmt.Fprintf(b, "%s// %s\n", indent, line)
+	}
+}
+
+func wrap(text string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// sentence makes a summary such as "Returns a device." read as a comment on
+// name, as in "GetDevice returns a device."
+func sentence(name, summary string) string {
+	if summary == "" {
+		return name + " calls the API."
+	}
+	return name + " " + strings.ToLower(summary[:1]) + summary[1:]
+}
+
+// generateGo writes a Go package with the API's types and a client.
+func generateGo(api *API, pkg, source string) ([]byte, error) {
+	hasError := false
+	for _, t := range api.Types {
+		hasError = hasError || t.Name == "Error"
+	}
+	if !hasError {
+		return nil, fmt.Errorf("the API has no Error schema for its error responses")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by apigen from %s. DO NOT EDIT.\n\n", source)
+	goComment(&b, "", fmt.Sprintf("Package %s is a client of the %s. %s", pkg, strings.ToLower(api.Title[:1])+api.Title[1:], api.Description))
+	fmt.Fprintf(&b, "package %s\n\n", pkg)
+	b.WriteString(`import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+`)
+
+	for _, t := range api.Types {
+		if t.Description != "" {
+			goComment(&b, "", t.Description)
+		}
+		if t.Enum != nil {
+			fmt.Fprintf(&b, "type %s string\n\nconst (\n", t.Name)
+			for _, value := range t.Enum {
+				fmt.Fprintf(&b, "\t%s%s %s = %q\n", t.Name, goName(value), t.Name, value)
+			}
+			b.WriteString(")\n\n")
+			continue
+		}
+		fmt.Fprintf(&b, "type %s struct {\n", t.Name)
+		for _, f := range t.Fields {
+			if f.Description != "" {
+				goComment(&b, "\t", f.Description)
+			}
+			tag := f.Name
+			if !f.Required {
+				tag += ",omitempty"
+			}
+			fmt.Fprintf(&b, "\t%s %s `json:%q`\n", goName(f.Name), goFieldType(f.Type, f.Required), tag)
+		}
+		b.WriteString("}\n\n")
+	}
+
+	for _, op := range api.Operations {
+		if len(op.QueryParams) == 0 {
+			continue
+		}
+		name := goName(op.Name) + "Params"
+		goComment(&b, "", fmt.Sprintf("%s are the query parameters of %s; those left empty aren't sent.", name, goName(op.Name)))
+		fmt.Fprintf(&b, "type %s struct {\n", name)
+		for _, p := range op.QueryParams {
+			if p.Description != "" {
+				goComment(&b, "\t", p.Description)
+			}
+			fmt.Fprintf(&b, "\t%s %s\n", goName(p.Name), goType(p.Type))
+		}
+		b.WriteString("}\n\n")
+		fmt.Fprintf(&b, "func (p *%s) query() url.Values {\n\tquery := url.Values{}\n\tif p == nil {\n\t\treturn query\n\t}\n", name)
+		for _, p := range op.QueryParams {
+			field := "p." + goName(p.Name)
+			switch {
+			case p.Type.Kind == "array":
+				fmt.Fprintf(&b, "\tfor _, value := range %s {\n\t\tquery.Add(%q, fmt.Sprint(value))\n\t}\n", field, p.Name)
+			case p.Type.Kind == "map" && p.DeepObject:
+				fmt.Fprintf(&b, "\tfor key, value := range %s {\n\t\tquery.Set(%q+key+\"]\", fmt.Sprint(value))\n\t}\n", field, p.Name+"[")
+			case p.Type.Kind == "map":
+				return nil, fmt.Errorf("%s: map query parameters must have style deepObject", p.Name)
+			case p.Type.Kind == "boolean":
+				fmt.Fprintf(&b, "\tif %s {\n\t\tquery.Set(%q, \"true\")\n\t}\n", field, p.Name)
+			case p.Type.Kind == "string":
+				fmt.Fprintf(&b, "\tif %s != \"\" {\n\t\tquery.Set(%q, %s)\n\t}\n", field, p.Name, field)
+			default:
+				fmt.Fprintf(&b, "\tif %s != 0 {\n\t\tquery.Set(%q, fmt.Sprint(%s))\n\t}\n", field, p.Name, field)
+			}
+		}
+		b.WriteString("\treturn query\n}\n\n")
+	}
+
+	fmt.Fprintf(&b, `// Client calls the %s.
+type Client struct {
+	// BaseURL is where the API is served, including the version prefix,
+	// such as http://localhost:5001/v1.
+	BaseURL string
+	// HTTPClient makes the requests; http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// RequestEditors are applied to each request before it's sent, such as
+	// to set who it's made on behalf of.
+	RequestEditors []func(req *http.Request)
+}
+
+// NewClient returns a client of the API served at baseURL.
+func NewClient(baseURL string, editors ...func(req *http.Request)) *Client {
+	return &Client{BaseURL: baseURL, RequestEditors: editors}
+}
+
+// ResponseError is a response with a status other than 2xx.
+type ResponseError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *ResponseError) Error() string {
+	var body Error
+	if json.Unmarshal(e.Body, &body) == nil && body.Error != "" {
+		return fmt.Sprintf("%%d: %%s", e.StatusCode, body.Error)
+	}
+	return fmt.Sprintf("unexpected status %%d", e.StatusCode)
+}
+
+// do makes a request, decoding a successful response into out if given.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	target := c.BaseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	for _, edit := range c.RequestEditors {
+		edit(req)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &ResponseError{StatusCode: resp.StatusCode, Body: data}
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+`, strings.ToLower(api.Title[:1])+api.Title[1:])
+
+	for _, op := range api.Operations {
+		name := goName(op.Name)
+		args := []string{"ctx context.Context"}
+		for _, p := range op.PathParams {
+			args = append(args, goArg(p.Name)+" string")
+		}
+		query := "nil"
+		if len(op.QueryParams) > 0 {
+			args = append(args, "params *"+name+"Params")
+			query = "params.query()"
+		}
+		body, prelude := "nil", ""
+		if op.Body != nil {
+			bodyType := goType(op.Body)
+			body = "body"
+			if !op.BodyRequired && op.Body.Kind == "named" {
+				// A nil body is left out, rather than sent as null.
+				bodyType = "*" + bodyType
+				body = "payload"
+				prelude = "\tvar payload interface{}\n\tif body != nil {\n\t\tpayload = body\n\t}\n"
+			}
+			args = append(args, "body "+bodyType)
+		}
+
+		path := fmt.Sprintf("%q", op.Path)
+		for _, p := range op.PathParams {
+			path = strings.Replace(path, "{"+p.Name+"}", `" + url.PathEscape(`+goArg(p.Name)+`) + "`, 1)
+		}
+		path = strings.TrimSuffix(strings.TrimPrefix(path, `"" + `), ` + ""`)
+
+		goComment(&b, "", sentence(name, op.Summary))
+		method := "http.Method" + op.Method[:1] + strings.ToLower(op.Method[1:])
+		switch {
+		case op.Result == nil:
+			fmt.Fprintf(&b, "func (c *Client) %s(%s) error {\n%s", name, strings.Join(args, ", "), prelude)
+			fmt.Fprintf(&b, "\treturn c.do(ctx, %s, %s, %s, %s, nil)\n}\n\n", method, path, query, body)
+		case op.Result.Kind == "named":
+			fmt.Fprintf(&b, "func (c *Client) %s(%s) (*%s, error) {\n%s", name, strings.Join(args, ", "), goType(op.Result), prelude)
+			fmt.Fprintf(&b, "\tvar out %s\n", goType(op.Result))
+			fmt.Fprintf(&b, "\tif err := c.do(ctx, %s, %s, %s, %s, &out); err != nil {\n\t\treturn nil, err\n\t}\n\treturn &out, nil\n}\n\n", method, path, query, body)
+		default:
+			fmt.Fprintf(&b, "func (c *Client) %s(%s) (%s, error) {\n%s", name, strings.Join(args, ", "), goType(op.Result), prelude)
+			fmt.Fprintf(&b, "\tvar out %s\n", goType(op.Result))
+			fmt.Fprintf(&b, "\terr := c.do(ctx, %s, %s, %s, %s, &out)\n\treturn out, err\n}\n\n", method, path, query, body)
+		}
+	}
+
+	formatted, err := format.Source(b.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("formatting the generated Go: %w\n%s", err, b.String())
+	}
+	return formatted, nil
+}
@@ -0,0 +1,97 @@
+// Command apigen generates the clients of the services' APIs from their
+// OpenAPI specs in api/: Go packages for the services that call them and
+// TypeScript modules for the frontend. Regenerate them after changing a
+// spec with:
+//
+//	go -C cmd/apigen run .
+//
+// and check they are up to date with -check. Only the parts of OpenAPI the
+// specs use are supported: named object schemas (with allOf) and string
+// enums, JSON bodies, and path and query parameters.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// target is a spec and the clients generated from it, relative to the root
+// of the repository. The Go packages live in the services that use them, as
+// each service is built on its own.
+type target struct {
+	spec      string
+	goPackage string
+	goFile    string
+	tsFile    string
+}
+
+var targets = []target{
+	{
+		spec:      "api/device-service.json",
+		goPackage: "deviceapi",
+		goFile:    "services/workflow-service/deviceapi/client.gen.go",
+		tsFile:    "frontend/src/api/deviceService.ts",
+	},
+	{
+		spec:      "api/sample-service.json",
+		goPackage: "sampleapi",
+		goFile:    "services/workflow-service/sampleapi/client.gen.go",
+		tsFile:    "frontend/src/api/sampleService.ts",
+	},
+	{
+		spec:   "api/workflow-service.json",
+		tsFile: "frontend/src/api/workflowService.ts",
+	},
+}
+
+func main() {
+	log.SetFlags(0)
+	root := flag.String("root", "../..", "the root of the repository")
+	check := flag.Bool("check", false, "only check the generated clients are up to date")
+	flag.Parse()
+
+	all := specs{}
+	stale := 0
+	for _, t := range targets {
+		api, err := buildAPI(all, filepath.Join(*root, t.spec))
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		outputs := map[string]func() ([]byte, error){
+			t.tsFile: func() ([]byte, error) { return generateTypeScript(api, t.spec) },
+		}
+		if t.goFile != "" {
+			outputs[t.goFile] = func() ([]byte, error) { return generateGo(api, t.goPackage, t.spec) }
+		}
+		for file, generate := range outputs {
+			code, err := generate()
+			if err != nil {
+				log.Fatalf("❌ %s: %v", t.spec, err)
+			}
+			path := filepath.Join(*root, file)
+			existing, _ := os.ReadFile(path)
+			if bytes.Equal(existing, code) {
+				continue
+			}
+			if *check {
+				fmt.Printf("%s is out of date\n", file)
+				stale++
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			if err := os.WriteFile(path, code, 0o644); err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			fmt.Printf("✓ Generated %s\n", file)
+		}
+	}
+	if stale > 0 {
+		log.Fatalf("❌ %d generated client(s) are out of date; run go -C cmd/apigen run .", stale)
+	}
+}
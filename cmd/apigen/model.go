@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// API is a spec reduced to what the clients are generated from.
+type API struct {
+	File        string
+	Title       string
+	Description string
+	Types       []*Type
+	Operations  []*Op
+}
+
+// Type is a named schema: an object with fields, or a string enum.
+type Type struct {
+	Name        string
+	Description string
+	Enum        []string
+	Fields      []*Field
+}
+
+type Field struct {
+	Name        string
+	Description string
+	Type        *TypeRef
+	Required    bool
+}
+
+// TypeRef is the type of a field, parameter, body or result.
+type TypeRef struct {
+	// Kind is string, integer, int64, number, boolean, any, array, map or
+	// named.
+	Kind     string
+	Elem     *TypeRef
+	Name     string
+	Object   bool
+	Nullable bool
+}
+
+// Op is an API operation, made by one client method.
+type Op struct {
+	Name         string
+	Summary      string
+	Method       string
+	Path         string
+	PathParams   []*Param
+	QueryParams  []*Param
+	Body         *TypeRef
+	BodyRequired bool
+	Result       *TypeRef
+}
+
+type Param struct {
+	Name        string
+	Description string
+	Type        *TypeRef
+	DeepObject  bool
+}
+
+var methods = []string{"get", "post", "put", "patch", "delete"}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// builder turns a spec into an API, collecting the named schemas it uses
+// from it and the documents it refers to.
+type builder struct {
+	specs   specs
+	named   map[string]schemaRef
+	types   map[string]*Type
+	order   []string
+	pending []string
+}
+
+func buildAPI(all specs, file string) (*API, error) {
+	spec, err := all.load(file)
+	if err != nil {
+		return nil, err
+	}
+	b := &builder{specs: all, named: map[string]schemaRef{}, types: map[string]*Type{}}
+	api := &API{File: file, Title: spec.Info.Title, Description: spec.Info.Description}
+
+	for _, e := range spec.Components.Schemas {
+		if err := b.register(schemaRef{spec, e.Key, e.Value}); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range spec.Paths {
+		for _, method := range methods {
+			operation, ok := path.Value.get(method)
+			if !ok {
+				continue
+			}
+			op, err := b.op(spec, strings.ToUpper(method), path.Key, operation)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s: %w", strings.ToUpper(method), path.Key, err)
+			}
+			api.Operations = append(api.Operations, op)
+		}
+	}
+	for len(b.pending) > 0 {
+		name := b.pending[0]
+		b.pending = b.pending[1:]
+		t, err := b.build(b.named[name])
+		if err != nil {
+			return nil, fmt.Errorf("schema %s: %w", name, err)
+		}
+		b.types[name] = t
+	}
+	for _, name := range b.order {
+		api.Types = append(api.Types, b.types[name])
+	}
+	return api, nil
+}
+
+// register adds a named schema to those to generate. Names are shared by
+// every document, so two schemas can't have the same one.
+func (b *builder) register(ref schemaRef) error {
+	if existing, ok := b.named[ref.name]; ok {
+		if existing.spec != ref.spec {
+			return fmt.Errorf("schema %s is in both %s and %s", ref.name, existing.spec.file, ref.spec.file)
+		}
+		return nil
+	}
+	b.named[ref.name] = ref
+	b.order = append(b.order, ref.name)
+	b.pending = append(b.pending, ref.name)
+	return nil
+}
+
+func (b *builder) build(ref schemaRef) (*Type, error) {
+	t := &Type{Name: ref.name, Description: ref.schema.Description}
+	if len(ref.schema.Enum) > 0 {
+		if ref.schema.Type != "string" {
+			return nil, fmt.Errorf("only string enums are supported")
+		}
+		t.Enum = ref.schema.Enum
+		return t, nil
+	}
+	err := b.fields(ref.spec, ref.schema, t)
+	return t, err
+}
+
+// fields adds an object schema's properties to a type, merging those of
+// each schema in allOf.
+func (b *builder) fields(spec *Spec, schema *Schema, t *Type) error {
+	if schema.Ref != "" {
+		ref, err := b.specs.schema(spec, schema.Ref)
+		if err != nil {
+			return err
+		}
+		return b.fields(ref.spec, ref.schema, t)
+	}
+	for _, part := range schema.AllOf {
+		if err := b.fields(spec, part, t); err != nil {
+			return err
+		}
+	}
+	if len(schema.AllOf) == 0 && schema.Type != "object" {
+		return fmt.Errorf("named schemas must be objects or string enums")
+	}
+	for _, property := range schema.Properties {
+		typeRef, err := b.typeRef(spec, property.Value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", property.Key, err)
+		}
+		t.Fields = append(t.Fields, &Field{
+			Name:        property.Key,
+			Description: property.Value.Description,
+			Type:        typeRef,
+			Required:    schema.required(property.Key),
+		})
+	}
+	return nil
+}
+
+// typeRef is the type of an unnamed schema. Objects other than maps must be
+// named, so every struct and interface generated has a name.
+func (b *builder) typeRef(spec *Spec, schema *Schema) (*TypeRef, error) {
+	if schema.Ref != "" {
+		ref, err := b.specs.schema(spec, schema.Ref)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.register(ref); err != nil {
+			return nil, err
+		}
+		return &TypeRef{Kind: "named", Name: ref.name, Object: len(ref.schema.Enum) == 0, Nullable: schema.Nullable}, nil
+	}
+
+	t := &TypeRef{Kind: schema.Type, Nullable: schema.Nullable}
+	switch schema.Type {
+	case "string", "number", "boolean":
+	case "integer":
+		if schema.Format == "int64" {
+			t.Kind = "int64"
+		}
+	case "":
+		t.Kind = "any"
+	case "array":
+		if schema.Items == nil {
+			return nil, fmt.Errorf("array without items")
+		}
+		elem, err := b.typeRef(spec, schema.Items)
+		if err != nil {
+			return nil, err
+		}
+		t.Elem = elem
+	case "object":
+		if len(schema.Properties) > 0 {
+			return nil, fmt.Errorf("objects with properties must be named schemas")
+		}
+		t.Kind = "map"
+		t.Elem = &TypeRef{Kind: "any"}
+		if ap := schema.AdditionalProperties; ap != nil && ap.Schema != nil {
+			elem, err := b.typeRef(spec, ap.Schema)
+			if err != nil {
+				return nil, err
+			}
+			t.Elem = elem
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %q", schema.Type)
+	}
+	return t, nil
+}
+
+func (b *builder) op(spec *Spec, method, path string, operation *Operation) (*Op, error) {
+	if operation.OperationID == "" {
+		return nil, fmt.Errorf("no operationId")
+	}
+	op := &Op{Name: operation.OperationID, Summary: operation.Summary, Method: method, Path: path}
+
+	params := map[string]*Param{}
+	for _, p := range operation.Parameters {
+		paramSpec, param, err := b.specs.parameter(spec, p)
+		if err != nil {
+			return nil, err
+		}
+		if param.Schema == nil {
+			return nil, fmt.Errorf("parameter %s has no schema", param.Name)
+		}
+		typeRef, err := b.typeRef(paramSpec, param.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", param.Name, err)
+		}
+		converted := &Param{Name: param.Name, Description: param.Description, Type: typeRef, DeepObject: param.Style == "deepObject"}
+		switch param.In {
+		case "path":
+			params[param.Name] = converted
+		case "query":
+			op.QueryParams = append(op.QueryParams, converted)
+		default:
+			return nil, fmt.Errorf("parameter %s is in %s; only path and query parameters are supported", param.Name, param.In)
+		}
+	}
+	for _, match := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+		param, ok := params[match[1]]
+		if !ok {
+			return nil, fmt.Errorf("path parameter %s isn't declared", match[1])
+		}
+		op.PathParams = append(op.PathParams, param)
+	}
+
+	if body := operation.RequestBody; body != nil {
+		if body.Content.JSON == nil || body.Content.JSON.Schema == nil {
+			return nil, fmt.Errorf("only JSON request bodies are supported")
+		}
+		typeRef, err := b.typeRef(spec, body.Content.JSON.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("request body: %w", err)
+		}
+		op.Body = typeRef
+		op.BodyRequired = body.Required
+	}
+
+	// Every response is walked, so the schemas of error responses are
+	// generated too; the first success with a body is the result.
+	for _, r := range operation.Responses {
+		responseSpec, response, err := b.specs.response(spec, r.Value)
+		if err != nil {
+			return nil, err
+		}
+		if response.Content.JSON == nil || response.Content.JSON.Schema == nil {
+			continue
+		}
+		typeRef, err := b.typeRef(responseSpec, response.Content.JSON.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("response %s: %w", r.Key, err)
+		}
+		if strings.HasPrefix(r.Key, "2") && op.Result == nil {
+			op.Result = typeRef
+		}
+	}
+	return op, nil
+}
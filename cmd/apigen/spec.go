@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ordered is a JSON object that keeps its keys in the order written, so the
+// generated code follows the spec's order.
+type ordered[T any] []entry[T]
+
+type entry[T any] struct {
+	Key   string
+	Value T
+}
+
+func (o *ordered[T]) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("expected an object")
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		var value T
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+		*o = append(*o, entry[T]{Key: token.(string), Value: value})
+	}
+	return nil
+}
+
+func (o ordered[T]) get(key string) (T, bool) {
+	for _, e := range o {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// Schema is the part of an OpenAPI schema object the generator supports.
+type Schema struct {
+	Ref                  string                `json:"$ref"`
+	Type                 string                `json:"type"`
+	Format               string                `json:"format"`
+	Description          string                `json:"description"`
+	Properties           ordered[*Schema]      `json:"properties"`
+	Required             []string              `json:"required"`
+	Items                *Schema               `json:"items"`
+	AdditionalProperties *AdditionalProperties `json:"additionalProperties"`
+	AllOf                []*Schema             `json:"allOf"`
+	Enum                 []string              `json:"enum"`
+	Nullable             bool                  `json:"nullable"`
+}
+
+// AdditionalProperties is either true, for any values, or their schema.
+type AdditionalProperties struct {
+	Any    bool
+	Schema *Schema
+}
+
+func (a *AdditionalProperties) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &a.Any); err == nil {
+		return nil
+	}
+	return json.Unmarshal(data, &a.Schema)
+}
+
+func (s *Schema) required(name string) bool {
+	for _, r := range s.Required {
+		if r == name {
+			return true
+		}
+	}
+	return false
+}
+
+type Parameter struct {
+	Ref         string  `json:"$ref"`
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description"`
+	Required    bool    `json:"required"`
+	Style       string  `json:"style"`
+	Schema      *Schema `json:"schema"`
+}
+
+type MediaTypes struct {
+	JSON *struct {
+		Schema *Schema `json:"schema"`
+	} `json:"application/json"`
+}
+
+type RequestBody struct {
+	Required bool       `json:"required"`
+	Content  MediaTypes `json:"content"`
+}
+
+type Response struct {
+	Ref         string     `json:"$ref"`
+	Description string     `json:"description"`
+	Content     MediaTypes `json:"content"`
+}
+
+type Operation struct {
+	OperationID string             `json:"operationId"`
+	Summary     string             `json:"summary"`
+	Parameters  []*Parameter       `json:"parameters"`
+	RequestBody *RequestBody       `json:"requestBody"`
+	Responses   ordered[*Response] `json:"responses"`
+}
+
+type Spec struct {
+	Info struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	} `json:"info"`
+	Paths      ordered[ordered[*Operation]] `json:"paths"`
+	Components struct {
+		Schemas    ordered[*Schema]    `json:"schemas"`
+		Parameters ordered[*Parameter] `json:"parameters"`
+		Responses  ordered[*Response]  `json:"responses"`
+	} `json:"components"`
+
+	file string
+}
+
+// specs loads each document once, so refs between them resolve to the same
+// schemas.
+type specs map[string]*Spec
+
+func (s specs) load(file string) (*Spec, error) {
+	file = filepath.Clean(file)
+	if spec, ok := s[file]; ok {
+		return spec, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{file: file}
+	if err := json.Unmarshal(data, spec); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	s[file] = spec
+	return spec, nil
+}
+
+// resolve finds what a ref names: the document, the kind of component and
+// its name. Refs are to #/components/<kind>/<name>, in the same document or
+// another beside it.
+func (s specs) resolve(from *Spec, ref string) (*Spec, string, string, error) {
+	file, pointer, _ := strings.Cut(ref, "#")
+	spec := from
+	if file != "" {
+		var err error
+		if spec, err = s.load(filepath.Join(filepath.Dir(from.file), file)); err != nil {
+			return nil, "", "", err
+		}
+	}
+	parts := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	if len(parts) != 3 || parts[0] != "components" {
+		return nil, "", "", fmt.Errorf("%s: unsupported ref %q", from.file, ref)
+	}
+	return spec, parts[1], parts[2], nil
+}
+
+// schemaRef is a named schema and the document it's in.
+type schemaRef struct {
+	spec   *Spec
+	name   string
+	schema *Schema
+}
+
+func (s specs) schema(from *Spec, ref string) (schemaRef, error) {
+	spec, kind, name, err := s.resolve(from, ref)
+	if err != nil {
+		return schemaRef{}, err
+	}
+	schema, ok := spec.Components.Schemas.get(name)
+	if kind != "schemas" || !ok {
+		return schemaRef{}, fmt.Errorf("%s: no schema %q", from.file, ref)
+	}
+	return schemaRef{spec, name, schema}, nil
+}
+
+func (s specs) parameter(from *Spec, p *Parameter) (*Spec, *Parameter, error) {
+	if p.Ref == "" {
+		return from, p, nil
+	}
+	spec, kind, name, err := s.resolve(from, p.Ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	param, ok := spec.Components.Parameters.get(name)
+	if kind != "parameters" || !ok {
+		return nil, nil, fmt.Errorf("%s: no parameter %q", from.file, p.Ref)
+	}
+	return spec, param, nil
+}
+
+func (s specs) response(from *Spec, r *Response) (*Spec, *Response, error) {
+	if r.Ref == "" {
+		return from, r, nil
+	}
+	spec, kind, name, err := s.resolve(from, r.Ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, ok := spec.Components.Responses.get(name)
+	if kind != "responses" || !ok {
+		return nil, nil, fmt.Errorf("%s: no response %q", from.file, r.Ref)
+	}
+	return spec, response, nil
+}
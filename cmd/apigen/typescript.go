@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var tsIdentifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// tsArg makes a camelCase name, as in deviceId.
+func tsArg(name string) string {
+	words := splitWords(name)
+	arg := strings.ToLower(words[0])
+	for _, word := range words[1:] {
+		arg += strings.ToUpper(word[:1]) + strings.ToLower(word[1:])
+	}
+	return arg
+}
+
+func tsType(t *TypeRef) string {
+	var ts string
+	switch t.Kind {
+	case "string":
+		ts = "string"
+	case "integer", "int64", "number":
+		ts = "number"
+	case "boolean":
+		ts = "boolean"
+	case "array":
+		elem := tsType(t.Elem)
+		if strings.Contains(elem, " | ") {
+			elem = "(" + elem + ")"
+		}
+		ts = elem + "[]"
+	case "map":
+		ts = "Record<string, " + tsType(t.Elem) + ">"
+	case "named":
+		ts = t.Name
+	default:
+		ts = "unknown"
+	}
+	if t.Nullable {
+		ts += " | null"
+	}
+	return ts
+}
+
+func tsProperty(name string) string {
+	if tsIdentifier.MatchString(name) {
+		return name
+	}
+	return fmt.Sprintf("'%s'", name)
+}
+
+// tsComment writes text as a doc comment with the given indent.
+func tsComment(b *bytes.Buffer, indent, text string) {
+	lines := wrap(text, 74-len(indent))
+	if len(lines) == 1 {
+		fmt.Fprintf(b, "%s/** %s */\n", indent, lines[0])
+		return
+	}
+	fmt.Fprintf(b, "%s/**\n", indent)
+	for _, line := range lines {
+		fmt.Fprintf(b, "%s * %s\n", indent, line)
+	}
+	fmt.Fprintf(b, "%s */\n", indent)
+}
+
+// generateTypeScript writes a TypeScript module with the API's types and a
+// client class making the requests with axios.
+func generateTypeScript(api *API, source string) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated by apigen from %s. DO NOT EDIT.\n\n", source)
+	b.WriteString("import axios from 'axios';\nimport type { AxiosInstance } from 'axios';\n\n")
+
+	for _, t := range api.Types {
+		if t.Description != "" {
+			tsComment(&b, "", t.Description)
+		}
+		if t.Enum != nil {
+			values := make([]string, len(t.Enum))
+			for i, value := range t.Enum {
+				values[i] = fmt.Sprintf("'%s'", value)
+			}
+			fmt.Fprintf(&b, "export type %s = %s;\n\n", t.Name, strings.Join(values, " | "))
+			continue
+		}
+		fmt.Fprintf(&b, "export interface %s {\n", t.Name)
+		for _, f := range t.Fields {
+			if f.Description != "" {
+				tsComment(&b, "  ", f.Description)
+			}
+			optional := "?"
+			if f.Required {
+				optional = ""
+			}
+			fmt.Fprintf(&b, "  %s%s: %s;\n", tsProperty(f.Name), optional, tsType(f.Type))
+		}
+		b.WriteString("}\n\n")
+	}
+
+	for _, op := range api.Operations {
+		if len(op.QueryParams) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "export interface %sParams {\n", goName(op.Name))
+		for _, p := range op.QueryParams {
+			if p.Description != "" {
+				tsComment(&b, "  ", p.Description)
+			}
+			fmt.Fprintf(&b, "  %s?: %s;\n", tsProperty(p.Name), tsType(p.Type))
+		}
+		b.WriteString("}\n\n")
+	}
+
+	class := strings.ReplaceAll(goName(strings.ReplaceAll(api.Title, " ", "_")), "_", "") + "Client"
+	tsComment(&b, "", fmt.Sprintf("Calls the %s at baseURL, including the version prefix, such as http://localhost:8080/api/v1. Failed requests throw axios errors.", strings.ToLower(api.Title[:1])+api.Title[1:]))
+	fmt.Fprintf(&b, "export class %s {\n", class)
+	b.WriteString("  constructor(\n    readonly baseURL: string,\n    readonly http: AxiosInstance = axios,\n  ) {}\n")
+
+	for _, op := range api.Operations {
+		var args []string
+		for _, p := range op.PathParams {
+			args = append(args, tsArg(p.Name)+": string")
+		}
+		if len(op.QueryParams) > 0 {
+			args = append(args, fmt.Sprintf("params?: %sParams", goName(op.Name)))
+		}
+		if op.Body != nil {
+			optional := "?"
+			if op.BodyRequired {
+				optional = ""
+			}
+			args = append(args, fmt.Sprintf("body%s: %s", optional, tsType(op.Body)))
+		}
+
+		url := op.Path
+		for _, p := range op.PathParams {
+			url = strings.Replace(url, "{"+p.Name+"}", "${encodeURIComponent("+tsArg(p.Name)+")}", 1)
+		}
+		result := "void"
+		if op.Result != nil {
+			result = tsType(op.Result)
+		}
+
+		b.WriteString("\n")
+		if op.Summary != "" {
+			tsComment(&b, "  ", op.Summary)
+		}
+		fmt.Fprintf(&b, "  async %s(%s): Promise<%s> {\n", op.Name, strings.Join(args, ", "), result)
+		fmt.Fprintf(&b, "    const response = await this.http.request<%s>({\n", result)
+		fmt.Fprintf(&b, "      method: '%s',\n", op.Method)
+		fmt.Fprintf(&b, "      url: `${this.baseURL}%s`,\n", url)
+		if len(op.QueryParams) > 0 {
+			// Arrays are sent as repeated parameters, as in tag=a&tag=b.
+			b.WriteString("      params,\n      paramsSerializer: { indexes: null },\n")
+		}
+		if op.Body != nil {
+			b.WriteString("      data: body,\n")
+		}
+		b.WriteString("    });\n    return response.data;\n  }\n")
+	}
+	b.WriteString("}\n")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,451 @@
+// Command loadgen drives a mix of workflow creates, starts, step executions
+// and listings through the gateway from many concurrent clients, and
+// reports each operation's latency percentiles and error rate:
+//
+//	SESSION_TOKEN=<session token> go -C cmd/loadgen run . -workers 20 -duration 1m
+//
+// Creates, starts and step executions all rewrite the lab's workflows, so
+// at the end every workflow it created is read back: one missing, or not
+// in the status it was last moved to, or without the result of a step that
+// ran, is a write lost under concurrency.
+// Turn the gateway's rate limit off (RATE_LIMIT_PER_MINUTE=0) first, or
+// most requests are answered 429.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations, in the order they are reported.
+const (
+	opCreate  = "create"
+	opStart   = "start"
+	opExecute = "execute"
+	opList    = "list"
+)
+
+var operations = []string{opCreate, opStart, opExecute, opList}
+
+// A workflow is created on one of the devices with steps it can run.
+var devices = []struct {
+	id     string
+	steps  []string
+	params []map[string]interface{}
+}{
+	{"liquid-handler-1", []string{"aspirate", "dispense"}, []map[string]interface{}{{"well": "A1"}, {"well": "B1"}}},
+	{"incubator-1", []string{"heat", "shake"}, []map[string]interface{}{{"target_temperature": 37}, {"frequency": 300, "duration": 60}}},
+	{"plate-reader-1", []string{"absorbance", "fluorescence"}, []map[string]interface{}{{"wavelength": 450}, {"excitation": 485, "emission": 520}}},
+}
+
+var (
+	api    string
+	token  string
+	client = &http.Client{Timeout: 30 * time.Second}
+)
+
+// call makes an API call, returning the response code (0 if there was no
+// response) and decoding a 2xx response into out if given.
+func call(method, path string, body interface{}, out interface{}) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 && out != nil {
+		return resp.StatusCode, json.Unmarshal(data, out)
+	}
+	return resp.StatusCode, nil
+}
+
+// parseMix reads weights such as "create=4,start=3,execute=2,list=1".
+func parseMix(value string) (map[string]int, int, error) {
+	mix := map[string]int{}
+	total := 0
+	for _, pair := range strings.Split(value, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(weight)
+		if !ok || err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid mix entry %q; expected operation=weight", pair)
+		}
+		known := false
+		for _, op := range operations {
+			known = known || op == name
+		}
+		if !known {
+			return nil, 0, fmt.Errorf("unknown operation %q; expected one of %s", name, strings.Join(operations, ", "))
+		}
+		mix[name] = n
+		total += n
+	}
+	if total == 0 {
+		return nil, 0, fmt.Errorf("the mix has no operations")
+	}
+	return mix, total, nil
+}
+
+// pool holds the workflows created so far, by the status they were last
+// moved to, so starts and step executions have workflows to act on, and
+// the steps that ran on each.
+type pool struct {
+	mu      sync.Mutex
+	created []string
+	running []string
+	status  map[string]string
+	steps   map[string]map[int]bool
+}
+
+// take removes a random workflow from a list, or returns "" if it's empty.
+func (p *pool) take(list *[]string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(*list) == 0 {
+		return ""
+	}
+	i := rand.Intn(len(*list))
+	id := (*list)[i]
+	(*list)[i] = (*list)[len(*list)-1]
+	*list = (*list)[:len(*list)-1]
+	return id
+}
+
+func (p *pool) put(list *[]string, id, status string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if list != nil {
+		*list = append(*list, id)
+	}
+	p.status[id] = status
+}
+
+func (p *pool) ran(id string, step int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.steps[id] == nil {
+		p.steps[id] = map[int]bool{}
+	}
+	p.steps[id][step] = true
+}
+
+// sample is one timed call.
+type sample struct {
+	op      string
+	status  int
+	latency time.Duration
+}
+
+// Stats summarises one operation's calls.
+type Stats struct {
+	Operation string         `json:"operation"`
+	Requests  int            `json:"requests"`
+	Errors    int            `json:"errors"`
+	Rejected  int            `json:"rejected"`
+	ErrorRate float64        `json:"error_rate"`
+	PerSecond float64        `json:"per_second"`
+	P50MS     float64        `json:"p50_ms"`
+	P90MS     float64        `json:"p90_ms"`
+	P99MS     float64        `json:"p99_ms"`
+	MaxMS     float64        `json:"max_ms"`
+	Statuses  map[string]int `json:"statuses"`
+}
+
+// Report is what a run found, written with -out to keep as a baseline.
+type Report struct {
+	Gateway     string  `json:"gateway"`
+	Workers     int     `json:"workers"`
+	Mix         string  `json:"mix"`
+	StartedAt   string  `json:"started_at"`
+	DurationS   float64 `json:"duration_s"`
+	Operations  []Stats `json:"operations"`
+	Created     int     `json:"created"`
+	Missing     int     `json:"missing"`
+	WrongStatus int     `json:"wrong_status"`
+	LostResults int     `json:"lost_results"`
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+// summarise groups the calls by operation. Calls without a response or
+// answered 5xx are errors; 4xx answers, such as a start finding its device
+// busy, are rejections the services are expected to make under load.
+func summarise(samples []sample, elapsed time.Duration) []Stats {
+	latencies := map[string][]time.Duration{}
+	stats := map[string]*Stats{}
+	for _, s := range samples {
+		st := stats[s.op]
+		if st == nil {
+			st = &Stats{Operation: s.op, Statuses: map[string]int{}}
+			stats[s.op] = st
+		}
+		st.Requests++
+		switch {
+		case s.status == 0:
+			st.Errors++
+			st.Statuses["no response"]++
+		case s.status >= 500:
+			st.Errors++
+			st.Statuses[strconv.Itoa(s.status)]++
+		case s.status >= 400:
+			st.Rejected++
+			st.Statuses[strconv.Itoa(s.status)]++
+		default:
+			st.Statuses[strconv.Itoa(s.status)]++
+		}
+		latencies[s.op] = append(latencies[s.op], s.latency)
+	}
+
+	summary := []Stats{}
+	for _, op := range operations {
+		st := stats[op]
+		if st == nil {
+			continue
+		}
+		sorted := latencies[op]
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		st.ErrorRate = float64(st.Errors) / float64(st.Requests)
+		st.PerSecond = float64(st.Requests) / elapsed.Seconds()
+		st.P50MS = percentile(sorted, 0.50)
+		st.P90MS = percentile(sorted, 0.90)
+		st.P99MS = percentile(sorted, 0.99)
+		st.MaxMS = percentile(sorted, 1)
+		summary = append(summary, *st)
+	}
+	return summary
+}
+
+func main() {
+	log.SetFlags(0)
+	gateway := flag.String("gateway", os.Getenv("GATEWAY_URL"), "gateway URL (default $GATEWAY_URL or http://localhost:8080)")
+	workers := flag.Int("workers", 10, "concurrent clients")
+	duration := flag.Duration("duration", 30*time.Second, "how long to generate load")
+	mixFlag := flag.String("mix", "create=4,start=3,execute=2,list=1", "relative weights of the operations")
+	out := flag.String("out", "", "also write the report as JSON to this file")
+	flag.Parse()
+	if *gateway == "" {
+		*gateway = "http://localhost:8080"
+	}
+	api = strings.TrimSuffix(*gateway, "/") + "/api/v1"
+	if token = os.Getenv("SESSION_TOKEN"); token == "" {
+		log.Fatalf("❌ Set SESSION_TOKEN to a session token (POST %s/auth/login)", api)
+	}
+	if *workers <= 0 || *duration <= 0 {
+		log.Fatalf("❌ -workers and -duration must be positive")
+	}
+	mix, total, err := parseMix(*mixFlag)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	workflows := &pool{status: map[string]string{}, steps: map[string]map[int]bool{}}
+	run := time.Now().UTC().Format("20060102-150405")
+
+	// pick chooses an operation by weight; one without a workflow to act on
+	// becomes a create.
+	pick := func(r *rand.Rand) string {
+		n := r.Intn(total)
+		for _, op := range operations {
+			if n < mix[op] {
+				return op
+			}
+			n -= mix[op]
+		}
+		return opCreate
+	}
+
+	// do runs one operation, keeping the pool in step with the statuses
+	// the workflows were moved to.
+	do := func(r *rand.Rand, worker, n int) sample {
+		op := pick(r)
+		var id string
+		switch op {
+		case opStart:
+			if id = workflows.take(&workflows.created); id == "" {
+				op = opCreate
+			}
+		case opExecute:
+			if id = workflows.take(&workflows.running); id == "" {
+				op = opCreate
+			}
+		}
+
+		start := time.Now()
+		s := sample{op: op}
+		switch op {
+		case opCreate:
+			device := devices[r.Intn(len(devices))]
+			var created struct {
+				ID string `json:"id"`
+			}
+			s.status, _ = call(http.MethodPost, "/workflows", map[string]interface{}{
+				"name":        fmt.Sprintf("Load %s %d-%d", run, worker, n),
+				"device_id":   device.id,
+				"steps":       device.steps,
+				"step_params": device.params,
+				"tags":        []string{"loadgen"},
+			}, &created)
+			s.latency = time.Since(start)
+			if s.status == http.StatusCreated && created.ID != "" {
+				workflows.put(&workflows.created, created.ID, "created")
+			}
+		case opStart:
+			var started struct {
+				Status string `json:"status"`
+			}
+			s.status, _ = call(http.MethodPost, "/workflows/"+id+"/start", nil, &started)
+			s.latency = time.Since(start)
+			switch {
+			case s.status == http.StatusOK && started.Status == "running":
+				workflows.put(&workflows.running, id, "running")
+			case s.status >= 400 && s.status < 500:
+				// Its device is busy or it was started already; it's left
+				// as it is.
+			default:
+				// It may or may not have started, so its status isn't
+				// checked.
+				workflows.put(nil, id, "")
+			}
+		case opExecute:
+			step := r.Intn(2)
+			s.status, _ = call(http.MethodPost, "/workflows/"+id+"/execute-step", map[string]int{"step_index": step}, nil)
+			s.latency = time.Since(start)
+			if s.status == http.StatusOK {
+				workflows.ran(id, step)
+			}
+			workflows.put(&workflows.running, id, "running")
+		case opList:
+			s.status, _ = call(http.MethodGet, "/workflows", nil, nil)
+			s.latency = time.Since(start)
+		}
+		return s
+	}
+
+	fmt.Printf("Generating load on %s with %d workers for %s (%s)\n", api, *workers, *duration, *mixFlag)
+	var (
+		mu      sync.Mutex
+		samples []sample
+		wg      sync.WaitGroup
+	)
+	began := time.Now()
+	deadline := began.Add(*duration)
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(worker)))
+			var mine []sample
+			for n := 0; time.Now().Before(deadline); n++ {
+				mine = append(mine, do(r, worker, n))
+			}
+			mu.Lock()
+			samples = append(samples, mine...)
+			mu.Unlock()
+		}(w)
+	}
+	wg.Wait()
+	elapsed := time.Since(began)
+
+	report := Report{
+		Gateway:    *gateway,
+		Workers:    *workers,
+		Mix:        *mixFlag,
+		StartedAt:  began.UTC().Format(time.RFC3339),
+		DurationS:  elapsed.Seconds(),
+		Operations: summarise(samples, elapsed),
+		Created:    len(workflows.status),
+	}
+
+	// Read back every workflow created, to find writes that were lost.
+	for id, want := range workflows.status {
+		var workflow struct {
+			Status      string `json:"status"`
+			StepResults []struct {
+				StepIndex int `json:"step_index"`
+			} `json:"step_results"`
+		}
+		status, err := call(http.MethodGet, "/workflows/"+id, nil, &workflow)
+		switch {
+		case err != nil && status == 0:
+			log.Fatalf("❌ Reading back workflow %s failed: %v", id, err)
+		case status == http.StatusNotFound:
+			report.Missing++
+		case status != http.StatusOK:
+			log.Fatalf("❌ Reading back workflow %s failed: %d", id, status)
+		case want != "" && workflow.Status != want:
+			report.WrongStatus++
+		}
+		for _, result := range workflow.StepResults {
+			delete(workflows.steps[id], result.StepIndex)
+		}
+		report.LostResults += len(workflows.steps[id])
+	}
+
+	fmt.Printf("\n%-8s %8s %8s %8s %8s %9s %9s %9s %9s\n", "op", "requests", "req/s", "errors", "rejected", "p50 ms", "p90 ms", "p99 ms", "max ms")
+	for _, st := range report.Operations {
+		fmt.Printf("%-8s %8d %8.1f %7.2f%% %8d %9.1f %9.1f %9.1f %9.1f\n",
+			st.Operation, st.Requests, st.PerSecond, st.ErrorRate*100, st.Rejected, st.P50MS, st.P90MS, st.P99MS, st.MaxMS)
+	}
+	fmt.Println()
+	for _, st := range report.Operations {
+		codes := make([]string, 0, len(st.Statuses))
+		for code, n := range st.Statuses {
+			codes = append(codes, fmt.Sprintf("%s×%d", code, n))
+		}
+		sort.Strings(codes)
+		fmt.Printf("%-8s %s\n", st.Operation, strings.Join(codes, " "))
+	}
+	fmt.Printf("\nCreated %d workflow(s): %d missing, %d not in the status last set, %d step result(s) lost\n",
+		report.Created, report.Missing, report.WrongStatus, report.LostResults)
+
+	if *out != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*out, append(data, '\n'), 0o644); err != nil {
+			log.Fatalf("❌ Writing %s failed: %v", *out, err)
+		}
+		fmt.Printf("✓ Wrote the report to %s\n", *out)
+	}
+	if report.Missing > 0 || report.WrongStatus > 0 || report.LostResults > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,281 @@
+// Command seed loads a demo dataset through the gateway, as an admin, so a
+// new developer's or demo environment doesn't start empty:
+//
+//	SESSION_TOKEN=<admin session token> go -C cmd/seed run .
+//
+// It restores snapshots of the devices (with calibration, firmware,
+// inventory details and a reservation), three plates of samples and a
+// handful of workflows, one in each status, all dated relative to now.
+// Restores replace what they name, so an environment that already has
+// workflows or samples is left alone unless -force is given.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type object = map[string]interface{}
+
+var (
+	api   string
+	token string
+	now   = time.Now().UTC()
+)
+
+// at formats the time d from now.
+func at(d time.Duration) string {
+	return now.Add(d).Format(time.RFC3339)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// call makes an API call as the admin, decoding the response into out if
+// given, and fails unless it answers 200.
+func call(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// restore restores a snapshot of one service's data.
+func restore(name, path, service, key string, records []object) {
+	snapshot := object{"service": service, "version": 1, "created_at": at(0), key: records}
+	if err := call(http.MethodPost, path, snapshot, nil); err != nil {
+		log.Fatalf("❌ Seeding %s failed: %v", name, err)
+	}
+	fmt.Printf("✓ Seeded %d %s\n", len(records), name)
+}
+
+// samples makes a plate of eight samples in column 1, numbered from first.
+// A concentration of 0 leaves it untracked.
+func samples(plate string, first int, sampleType, label, project string, volume, concentration float64) []object {
+	plateSamples := make([]object, 0, 8)
+	for i, row := range "ABCDEFGH" {
+		barcode := fmt.Sprintf("DEMO-%04d", first+i)
+		plateSamples = append(plateSamples, object{
+			"barcode":    barcode,
+			"name":       fmt.Sprintf("%s %c1", label, row),
+			"type":       sampleType,
+			"location":   object{"plate": plate, "well": fmt.Sprintf("%c1", row)},
+			"volume_ul":  volume,
+			"metadata":   object{"donor_id": fmt.Sprintf("D-%03d", 100+i), "study": "demo"},
+			"project":    project,
+			"created_at": at(-72 * time.Hour),
+			"created_by": "demo",
+			"version":    1,
+		})
+		if concentration > 0 {
+			plateSamples[i]["concentration"] = concentration
+		}
+	}
+	return plateSamples
+}
+
+func barcodes(plateSamples []object, n int) []string {
+	list := make([]string, 0, n)
+	for _, sample := range plateSamples[:n] {
+		list = append(list, sample["barcode"].(string))
+	}
+	return list
+}
+
+func main() {
+	log.SetFlags(0)
+	gateway := flag.String("gateway", os.Getenv("GATEWAY_URL"), "gateway URL (default $GATEWAY_URL or http://localhost:8080)")
+	force := flag.Bool("force", false, "seed even if there are workflows or samples already")
+	flag.Parse()
+	if *gateway == "" {
+		*gateway = "http://localhost:8080"
+	}
+	api = strings.TrimSuffix(*gateway, "/") + "/api/v1"
+	if token = os.Getenv("SESSION_TOKEN"); token == "" {
+		log.Fatalf("❌ Set SESSION_TOKEN to the session token of an admin (POST %s/auth/login)", api)
+	}
+
+	if !*force {
+		var workflows []object
+		var found struct {
+			Total int `json:"total"`
+		}
+		if err := call(http.MethodGet, "/workflows", nil, &workflows); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if err := call(http.MethodGet, "/samples?status=all&limit=1", nil, &found); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		if len(workflows) > 0 || found.Total > 0 {
+			log.Fatalf("❌ There are %d workflow(s) and %d sample(s) already; use -force to seed anyway, replacing any with the demo IDs", len(workflows), found.Total)
+		}
+	}
+
+	// Samples: plasma, serum and DNA extracted from the plasma, with one
+	// sample used up, one archived and one about to expire.
+	plasma := samples("DEMO-PLATE-01", 1, "plasma", "Plasma", "demo-cohort", 200, 0)
+	serum := samples("DEMO-PLATE-02", 9, "serum", "Serum", "demo-cohort", 150, 0)
+	dna := samples("DEMO-PLATE-03", 17, "dna", "DNA", "demo-genomics", 50, 45.5)
+	for i, sample := range dna {
+		sample["parent_barcode"] = plasma[i]["barcode"]
+		sample["created_at"] = at(-48 * time.Hour)
+	}
+	plasma[2]["expires_at"] = at(48 * time.Hour)
+	plasma[7]["volume_ul"] = 0.0
+	plasma[7]["updated_at"] = at(-24 * time.Hour)
+	serum[7]["archived"] = true
+	serum[7]["archived_at"] = at(-24 * time.Hour)
+	serum[7]["updated_at"] = at(-24 * time.Hour)
+
+	// Workflows: one in each status. The running workflow holds the plate
+	// reader, the paused one a slot of the incubator, and the one not yet
+	// started has the liquid handler reserved for tomorrow.
+	pcrID, elisaID, heatID, qcID, cultureID := newID(), newID(), newID(), newID(), newID()
+	workflows := []object{
+		{
+			"id": pcrID, "name": "PCR Setup", "device_id": "liquid-handler-1",
+			"sample_barcodes": barcodes(dna, 4),
+			"steps":           []string{"aspirate", "dispense"},
+			"step_params":     []object{{"volume": 10, "well": "A1"}, {"volume": 10, "well": "B1"}},
+			"status":          "created", "created_at": at(-time.Hour), "created_by": "demo",
+			"tags": []string{"demo", "template"},
+		},
+		{
+			"id": elisaID, "name": "ELISA Readout", "device_id": "plate-reader-1",
+			"sample_barcodes": barcodes(serum, 4),
+			"steps":           []string{"absorbance"},
+			"step_params":     []object{{"wavelength": 450}},
+			"status":          "completed", "created_at": at(-27 * time.Hour), "created_by": "demo",
+			"started_at": at(-26 * time.Hour), "started_by": "demo",
+			"completed_at": at(-25 * time.Hour), "completed_by": "demo",
+			"step_results": []object{{
+				"step_index": 0, "step": "absorbance", "operation_id": newID(), "status": "completed",
+				"result":      object{"A1": 0.42, "B1": 0.38, "C1": 1.12, "D1": 0.95},
+				"executed_at": at(-25*time.Hour - 30*time.Minute), "executed_by": "demo",
+			}},
+			"tags": []string{"demo"},
+		},
+		{
+			"id": heatID, "name": "Heat Shock", "device_id": "incubator-1",
+			"sample_barcodes": barcodes(plasma, 2),
+			"steps":           []string{"heat", "shake"},
+			"step_params":     []object{{"target_temperature": 42}, {"frequency": 300, "duration": 600}},
+			"status":          "failed", "created_at": at(-6 * time.Hour), "created_by": "demo",
+			"started_at": at(-5 * time.Hour), "started_by": "demo",
+			"failed_at": at(-4*time.Hour - 50*time.Minute), "failed_by": "demo",
+			"failure_reason": "Incubator door sensor tripped",
+			"tags":           []string{"demo"},
+		},
+		{
+			"id": qcID, "name": "Absorbance QC", "device_id": "plate-reader-1",
+			"sample_barcodes": barcodes(plasma, 4),
+			"steps":           []string{"absorbance", "fluorescence"},
+			"step_params":     []object{{"wavelength": 280}, {"excitation": 485, "emission": 520}},
+			"status":          "running", "created_at": at(-20 * time.Minute), "created_by": "demo",
+			"started_at": at(-10 * time.Minute), "started_by": "demo",
+			"step_results": []object{{
+				"step_index": 0, "step": "absorbance", "operation_id": newID(), "status": "completed",
+				"result":      object{"A1": 1.81, "B1": 1.76, "C1": 1.93, "D1": 1.88},
+				"executed_at": at(-5 * time.Minute), "executed_by": "demo",
+			}},
+			"tags": []string{"demo"},
+		},
+		{
+			"id": cultureID, "name": "Overnight Culture", "device_id": "incubator-1",
+			"sample_barcodes": barcodes(serum, 2),
+			"steps":           []string{"heat", "shake"},
+			"step_params":     []object{{"target_temperature": 37}, {"frequency": 150, "duration": 3600}},
+			"status":          "paused", "created_at": at(-3 * time.Hour), "created_by": "demo",
+			"started_at": at(-2 * time.Hour), "started_by": "demo",
+			"tags": []string{"demo"},
+		},
+	}
+
+	calibration := func(daysAgo, interval int) json.RawMessage {
+		data, _ := json.Marshal(object{
+			"last_calibrated_at": at(-time.Duration(daysAgo) * 24 * time.Hour),
+			"interval_days":      interval,
+			"calibrated_by":      "demo",
+			"notes":              "Routine service",
+		})
+		return data
+	}
+	firmware := func(version string) json.RawMessage {
+		data, _ := json.Marshal(object{"firmware_version": version, "protocol_versions": []string{"1.0", "1.1"}, "reported_at": at(0)})
+		return data
+	}
+	metadata := func(vendor, model, serial string, tags ...string) json.RawMessage {
+		data, _ := json.Marshal(object{
+			"tags":     tags,
+			"metadata": object{"vendor": vendor, "model": model, "serial_number": serial, "location": "Lab 2.14"},
+		})
+		return data
+	}
+	// The plate reader is overdue for calibration, to show how that looks.
+	tomorrow := now.Truncate(24 * time.Hour).Add(33 * time.Hour)
+	devices := []object{
+		{
+			"id": "liquid-handler-1", "state": object{"status": "available"},
+			"calibration": calibration(30, 90), "firmware": firmware("2.4.1"),
+			"metadata": metadata("Tecan", "Fluent 780", "SN-LH-0001", "bsl2"),
+			"reservations": []object{{
+				"id": newID(), "device_id": "liquid-handler-1", "workflow_id": pcrID,
+				"start": tomorrow.Format(time.RFC3339), "end": tomorrow.Add(2 * time.Hour).Format(time.RFC3339),
+				"note": "PCR setup for the genomics panel", "created_at": at(-time.Hour), "status": "scheduled",
+			}},
+		},
+		{
+			"id": "incubator-1", "state": object{"status": "available"}, "slots": object{"1": cultureID},
+			"calibration": calibration(80, 90), "firmware": firmware("1.9.0"),
+			"metadata": metadata("Thermo Fisher", "Heracell VIOS 160i", "SN-IN-0001"), "reservations": []object{},
+		},
+		{
+			"id": "plate-reader-1", "state": object{"status": "busy", "workflow_id": qcID},
+			"calibration": calibration(200, 180), "firmware": firmware("3.0.2"),
+			"metadata": metadata("BMG Labtech", "CLARIOstar Plus", "SN-PR-0001"), "reservations": []object{},
+		},
+	}
+
+	// Devices and samples go first, as the workflow service checks the
+	// devices and samples its workflows refer to.
+	restore("devices", "/admin/snapshot", "device-service", "devices", devices)
+	restore("samples", "/samples/snapshot", "sample-service", "samples", append(append(plasma, serum...), dna...))
+	restore("workflows", "/workflows/snapshot", "workflow-service", "workflows", workflows)
+}
@@ -1,13 +1,54 @@
 import React, { useState, useEffect } from 'react';
-import axios from 'axios';
 import './App.css';
+import { DeviceServiceClient } from './api/deviceService';
+import { SampleServiceClient } from './api/sampleService';
+import { WorkflowServiceClient } from './api/workflowService';
 import DeviceList from './components/DeviceList';
 import WorkflowList from './components/WorkflowList';
 import CreateWorkflow from './components/CreateWorkflow';
 
-const WORKFLOW_API = process.env.REACT_APP_WORKFLOW_API || 'http://localhost:5003';
-const DEVICE_API = process.env.REACT_APP_DEVICE_API || 'http://localhost:5001';
-const SAMPLE_API = process.env.REACT_APP_SAMPLE_API || 'http://localhost:5002';
+// With REACT_APP_API_URL set, every request goes through the API gateway.
+const API_URL = process.env.REACT_APP_API_URL;
+const WORKFLOW_API = process.env.REACT_APP_WORKFLOW_API || API_URL || 'http://localhost:5003/v1';
+const DEVICE_API = process.env.REACT_APP_DEVICE_API || API_URL || 'http://localhost:5001/v1';
+const SAMPLE_API = process.env.REACT_APP_SAMPLE_API || API_URL || 'http://localhost:5002/v1';
+
+// The clients are generated from the OpenAPI specs in api/.
+const workflowApi = new WorkflowServiceClient(WORKFLOW_API);
+const deviceApi = new DeviceServiceClient(DEVICE_API);
+const sampleApi = new SampleServiceClient(SAMPLE_API);
+
+// What to do about the errors a user can act on, by error code.
+const ERROR_HINTS = {
+  device_unavailable: 'The device is in use; try again once it is released.',
+  device_reserved: 'The device is reserved for another workflow.',
+  calibration_overdue: 'The device needs calibrating before it can be booked.',
+  firmware_outdated: 'The device firmware needs updating for this workflow.',
+  consumable_exhausted: 'Refill the device before running the step.',
+  device_in_error: 'Clear the device error before running the step.',
+  upstream_unreachable: 'A lab service is down; try again shortly.',
+  quota_exceeded: 'Your team has used its workflow quota; wait for running workflows to finish or for tomorrow.',
+};
+
+// errorMessage describes a failed request, with the error of the service
+// behind it and what to do about it, where known.
+const errorMessage = (err) => {
+  const body = err.response?.data;
+  if (!body?.error) {
+    return err.message;
+  }
+  let message = body.error;
+  if (body.upstream?.error) {
+    message += `: ${body.upstream.error}`;
+  }
+  if (ERROR_HINTS[body.code]) {
+    message += `\n${ERROR_HINTS[body.code]}`;
+  }
+  if (body.upstream?.request_id) {
+    message += `\n(${body.upstream.service} request ${body.upstream.request_id})`;
+  }
+  return message;
+};
 
 function App() {
   const [devices, setDevices] = useState([]);
@@ -19,8 +60,8 @@ function App() {
 
   const fetchDevices = async () => {
     try {
-      const response = await axios.get(`${DEVICE_API}/devices`);
-      setDevices(response.data);
+      const response = await deviceApi.listDevices({ limit: 1000 });
+      setDevices(response.devices);
     } catch (err) {
       console.error('Error fetching devices:', err);
       setError('Failed to fetch devices');
@@ -29,8 +70,7 @@ function App() {
 
   const fetchWorkflows = async () => {
     try {
-      const response = await axios.get(`${WORKFLOW_API}/workflows`);
-      setWorkflows(response.data);
+      setWorkflows(await workflowApi.listWorkflows());
     } catch (err) {
       console.error('Error fetching workflows:', err);
       setError('Failed to fetch workflows');
@@ -39,8 +79,8 @@ function App() {
 
   const fetchSamples = async () => {
     try {
-      const response = await axios.get(`${SAMPLE_API}/samples`);
-      setSamples(response.data);
+      const response = await sampleApi.listSamples({ limit: 1000 });
+      setSamples(response.samples);
     } catch (err) {
       console.error('Error fetching samples:', err);
       setError('Failed to fetch samples');
@@ -60,34 +100,64 @@ function App() {
     return () => clearInterval(interval);
   }, []);
 
+  useEffect(() => {
+    // Apply device status transitions as they happen
+    const events = new EventSource(`${DEVICE_API}/devices/events`);
+    events.addEventListener('status', (e) => {
+      const event = JSON.parse(e.data);
+      setDevices((current) =>
+        current.map((device) =>
+          device.id === event.device_id
+            ? { ...device, status: event.status, workflow_id: event.workflow_id }
+            : device
+        )
+      );
+    });
+    return () => events.close();
+  }, []);
+
   const handleStartWorkflow = async (workflowId) => {
     try {
-      await axios.post(`${WORKFLOW_API}/workflows/${workflowId}/start`);
+      await workflowApi.startWorkflow(workflowId);
       await fetchData();
     } catch (err) {
       console.error('Error starting workflow:', err);
-      alert(`Failed to start workflow: ${err.response?.data?.error || err.message}`);
+      alert(`Failed to start workflow: ${errorMessage(err)}`);
+    }
+  };
+
+  const handleSimulateWorkflow = async (workflowId) => {
+    try {
+      const simulation = await workflowApi.startWorkflow(workflowId, { simulate: true });
+      const lines = simulation.run.steps.map(
+        (step) => `${step.step_index + 1}. ${step.operation}: ${step.error || `${step.duration_ms / 1000}s`}`
+      );
+      const verdict = simulation.ok ? 'Runs as defined' : `Problems:\n${simulation.issues.join('\n')}`;
+      alert(`${verdict}\nTakes ${simulation.run.total_duration_ms / 1000}s\n\n${lines.join('\n')}`);
+    } catch (err) {
+      console.error('Error simulating workflow:', err);
+      alert(`Failed to simulate workflow: ${errorMessage(err)}`);
     }
   };
 
   const handleCompleteWorkflow = async (workflowId) => {
     try {
-      await axios.post(`${WORKFLOW_API}/workflows/${workflowId}/complete`);
+      await workflowApi.completeWorkflow(workflowId);
       await fetchData();
     } catch (err) {
       console.error('Error completing workflow:', err);
-      alert(`Failed to complete workflow: ${err.response?.data?.error || err.message}`);
+      alert(`Failed to complete workflow: ${errorMessage(err)}`);
     }
   };
 
   const handleCreateWorkflow = async (workflowData) => {
     try {
-      await axios.post(`${WORKFLOW_API}/workflows`, workflowData);
+      await workflowApi.createWorkflow(workflowData);
       setShowCreateWorkflow(false);
       await fetchData();
     } catch (err) {
       console.error('Error creating workflow:', err);
-      alert(`Failed to create workflow: ${err.response?.data?.error || err.message}`);
+      alert(`Failed to create workflow: ${errorMessage(err)}`);
     }
   };
 
@@ -151,7 +221,9 @@ function App() {
           <WorkflowList
             workflows={workflows}
             onStart={handleStartWorkflow}
+            onSimulate={handleSimulateWorkflow}
             onComplete={handleCompleteWorkflow}
+            reportUrl={(id) => `${WORKFLOW_API}/workflows/${encodeURIComponent(id)}/report`}
           />
         </div>
       </div>
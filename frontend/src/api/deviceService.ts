@@ -0,0 +1,472 @@
+// Code generated by apigen from api/device-service.json. DO NOT EDIT.
+
+import axios from 'axios';
+import type { AxiosInstance } from 'axios';
+
+export interface DeletedDevice {
+  device_id: string;
+  name: string;
+  lab?: string;
+  deleted_at: string;
+  deleted_by?: string;
+  /** When the device will be purged; unset if deleted devices are kept. */
+  purge_after?: string;
+}
+
+export interface DeviceListResponse {
+  total: number;
+  limit: number;
+  offset: number;
+  devices: Device[];
+}
+
+export interface Device {
+  id: string;
+  name: string;
+  type: string;
+  /** available, busy, maintenance or error. */
+  status: string;
+  capabilities: string[];
+  /** How many workflows a multi-slot device holds at once. */
+  capacity?: number;
+  firmware?: FirmwareInfo;
+  tags?: string[];
+  metadata?: Record<string, string>;
+  consumables?: ConsumableLevel[];
+  warnings?: string[];
+  /** The workflow the device is booked for. */
+  workflow_id?: string;
+  booked_by?: string;
+  slots?: SlotState[];
+  error_state?: DeviceErrorState;
+  calibration?: Calibration;
+  lab?: string;
+}
+
+export interface FirmwareInfo {
+  firmware_version: string;
+  protocol_versions?: string[];
+  reported_at: string;
+}
+
+export interface ConsumableLevel {
+  name: string;
+  unit: string;
+  level: number;
+  capacity: number;
+  low_threshold: number;
+  low: boolean;
+}
+
+export interface SlotState {
+  slot: number;
+  status: string;
+  workflow_id?: string;
+  booked_by?: string;
+}
+
+export interface DeviceErrorState {
+  cause: string;
+  operation?: string;
+  workflow_id?: string;
+  estop?: boolean;
+  occurred_at: string;
+}
+
+export interface Calibration {
+  last_calibrated_at?: string;
+  interval_days?: number;
+  calibrated_by?: string;
+  notes?: string;
+  due_at?: string;
+  overdue: boolean;
+}
+
+export interface BookRequest {
+  workflow_id: string;
+  /** Refuse the booking if the device's firmware is older. */
+  min_firmware_version?: string;
+  /** Refuse the booking if the device doesn't speak this protocol version. */
+  protocol_version?: string;
+  /**
+   * Wait for a device in use rather than be refused, when the queueing
+   * feature flag is on. The workflow service is told when the booking is
+   * granted.
+   */
+  queue?: boolean;
+  /**
+   * The project a queued booking is granted for under round_robin and
+   * max_consecutive booking policies.
+   */
+  project?: string;
+  /**
+   * Under a priority booking policy, queued bookings with a higher priority
+   * are granted first.
+   */
+  priority?: number;
+}
+
+/** A booking waiting for its device. */
+export interface QueueResponse {
+  device_id: string;
+  workflow_id: string;
+  status: string;
+  /** The booking's place in the queue, from 1. */
+  position: number;
+  queued_at: string;
+}
+
+/**
+ * Sent to the workflow service's POST /workflows/{workflow_id}/booking when
+ * a queued booking is granted or refused.
+ */
+export interface BookingDecision {
+  device_id: string;
+  granted: boolean;
+  booking?: BookResponse;
+  /** Why the booking was refused. */
+  error?: string;
+}
+
+export interface BookResponse {
+  device_id: string;
+  status: string;
+  workflow_id: string;
+  booked_at: string;
+  booked_by?: string;
+  slot?: number;
+  /** The reservation the booking was made under, if any. */
+  reservation_id?: string;
+  warnings?: string[];
+}
+
+export interface ReleaseRequest {
+  workflow_id?: string;
+  slot?: number;
+}
+
+export interface ReleaseResponse {
+  device_id: string;
+  status: string;
+  released_at: string;
+  released_by?: string;
+}
+
+export interface ExecuteRequest {
+  workflow_id: string;
+  operation: string;
+  params?: Record<string, unknown>;
+}
+
+export interface SimulateRunRequest {
+  steps: SimulateStep[];
+}
+
+export interface SimulateStep {
+  operation: string;
+  params?: Record<string, unknown>;
+}
+
+/**
+ * A step as the virtual device ran it. A step it couldn't run has error set
+ * and takes no time.
+ */
+export interface SimulatedStep {
+  step_index: number;
+  operation: string;
+  /** When the step would start, from the start of the run. */
+  start_ms: number;
+  duration_ms: number;
+  /** How often the simulated device fails the operation. */
+  failure_rate?: number;
+  consumables?: Record<string, number>;
+  result?: Record<string, unknown>;
+  error?: string;
+  code?: string;
+}
+
+export interface SimulatedRun {
+  device_id: string;
+  /** Whether every step could run. */
+  ok: boolean;
+  total_duration_ms: number;
+  steps: SimulatedStep[];
+  consumables_used: Record<string, number>;
+  /** The device's consumable levels as the run would leave them. */
+  consumables_left: ConsumableLevel[];
+  warnings?: string[];
+}
+
+/**
+ * A span of time a device is, or is expected to be, held by a workflow.
+ * Estimated entries' times are guesses from the device's average booking;
+ * those without a start or end can't be estimated yet.
+ */
+export interface ScheduleEntry {
+  /** booking, queued or reservation. */
+  kind: string;
+  workflow_id: string;
+  slot?: number;
+  /** The queued workflow's place in the queue. */
+  position?: number;
+  reservation_id?: string;
+  status?: string;
+  start?: string;
+  end?: string;
+  estimated?: boolean;
+}
+
+export interface DeviceSchedule {
+  device_id: string;
+  status: string;
+  generated_at: string;
+  horizon: string;
+  /** How long the device's bookings took on average over the last week. */
+  avg_booking_ms: number;
+  /** Unset if it can't be estimated, or the device is in error. */
+  next_free_at?: string;
+  entries: ScheduleEntry[];
+}
+
+export interface ExecuteResponse {
+  device_id: string;
+  operation: string;
+  operation_id?: string;
+  status: string;
+  executed_at: string;
+  result?: Record<string, unknown>;
+  warnings?: string[];
+}
+
+export interface AbortRequest {
+  workflow_id: string;
+  reason?: string;
+}
+
+export interface AbortResponse {
+  device_id: string;
+  workflow_id: string;
+  operation: string;
+  aborted_at: string;
+  aborted_by?: string;
+}
+
+export interface OperationProgressResponse {
+  device_id: string;
+  operations: OperationProgress[];
+}
+
+/**
+ * How far a running operation has got. Drivers that can't tell report 0
+ * until the operation ends.
+ */
+export interface OperationProgress {
+  device_id: string;
+  workflow_id: string;
+  operation: string;
+  progress_percent: number;
+  cycles_completed: number;
+  cycles_total: number;
+  started_at: string;
+  updated_at: string;
+  lab?: string;
+}
+
+/**
+ * Every error response: a message, with a code to tell errors apart by where
+ * the service gives one, and details where the service has them, such as the
+ * response of a service it called. Errors passed on from a service called
+ * give its response under upstream.
+ */
+export interface Error {
+  error: string;
+  /**
+   * Why the request failed, such as device_unavailable; for an error passed
+   * on from another service, that service's code, or one from its status.
+   */
+  code?: string;
+  details?: Record<string, unknown>;
+  upstream?: UpstreamError;
+}
+
+/**
+ * The failed response of a service called to serve the request. status is 0
+ * if the service didn't respond.
+ */
+export interface UpstreamError {
+  /** The service called, such as device-service. */
+  service: string;
+  status: number;
+  code?: string;
+  error?: string;
+  /**
+   * The X-Request-ID the call was made with, to find it in the service's
+   * logs.
+   */
+  request_id?: string;
+}
+
+export interface ListDevicesParams {
+  type?: string;
+  status?: string;
+  /** Devices that can execute this operation. */
+  capability?: string;
+  /** Devices with every tag given. */
+  tag?: string[];
+  /** Devices with these metadata values, as metadata[key]=value. */
+  metadata?: Record<string, string>;
+  /**
+   * id (the default), name, type or status, prefixed with - for descending
+   * order.
+   */
+  sort?: string;
+  /** The most items to return. */
+  limit?: number;
+  /** How many items to skip. */
+  offset?: number;
+  /**
+   * With If-None-Match naming the current ETag, how many seconds to wait for
+   * the collection to change before answering 304; at most 60.
+   */
+  wait?: number;
+}
+
+export interface GetDeviceProgressParams {
+  /** Only this workflow's operation. */
+  workflow_id?: string;
+}
+
+export interface GetDeviceScheduleParams {
+  /**
+   * How far ahead to list reservations, as a Go duration; 24h by default, at
+   * most 720h.
+   */
+  horizon?: string;
+}
+
+/**
+ * Calls the device service at baseURL, including the version prefix, such as
+ * http://localhost:8080/api/v1. Failed requests throw axios errors.
+ */
+export class DeviceServiceClient {
+  constructor(
+    readonly baseURL: string,
+    readonly http: AxiosInstance = axios,
+  ) {}
+
+  /**
+   * Lists a page of the lab's devices, filtered by type, status, capability,
+   * tags and metadata.
+   */
+  async listDevices(params?: ListDevicesParams): Promise<DeviceListResponse> {
+    const response = await this.http.request<DeviceListResponse>({
+      method: 'GET',
+      url: `${this.baseURL}/devices`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+
+  /** Lists the lab's deleted devices, most recently deleted first. */
+  async listDeletedDevices(): Promise<DeletedDevice[]> {
+    const response = await this.http.request<DeletedDevice[]>({
+      method: 'GET',
+      url: `${this.baseURL}/devices/trash`,
+    });
+    return response.data;
+  }
+
+  /** Returns a device. */
+  async getDevice(deviceId: string): Promise<Device> {
+    const response = await this.http.request<Device>({
+      method: 'GET',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}`,
+    });
+    return response.data;
+  }
+
+  /** Books a device, or a slot of a multi-slot device, for a workflow. */
+  async bookDevice(deviceId: string, body: BookRequest): Promise<BookResponse> {
+    const response = await this.http.request<BookResponse>({
+      method: 'POST',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}/book`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /**
+   * Releases a device, or the slot a workflow holds, once the workflow is
+   * done with it.
+   */
+  async releaseDevice(deviceId: string, body?: ReleaseRequest): Promise<ReleaseResponse> {
+    const response = await this.http.request<ReleaseResponse>({
+      method: 'POST',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}/release`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /**
+   * Runs a step sequence on a virtual copy of the device, without booking
+   * it, and reports its timing and consumables.
+   */
+  async simulateRun(deviceId: string, body: SimulateRunRequest): Promise<SimulatedRun> {
+    const response = await this.http.request<SimulatedRun>({
+      method: 'POST',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}/simulate`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /** Runs an operation on a device booked by the workflow. */
+  async executeOperation(deviceId: string, body: ExecuteRequest): Promise<ExecuteResponse> {
+    const response = await this.http.request<ExecuteResponse>({
+      method: 'POST',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}/execute`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /** Aborts the operation a workflow is running on its device. */
+  async abortOperation(deviceId: string, body: AbortRequest): Promise<AbortResponse> {
+    const response = await this.http.request<AbortResponse>({
+      method: 'POST',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}/abort`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /**
+   * Returns the progress of the operations running on a device, oldest
+   * first.
+   */
+  async getDeviceProgress(deviceId: string, params?: GetDeviceProgressParams): Promise<OperationProgressResponse> {
+    const response = await this.http.request<OperationProgressResponse>({
+      method: 'GET',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}/progress`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+
+  /**
+   * Returns who holds a device now, who is queued for it and who reserved
+   * it, with when it is next free.
+   */
+  async getDeviceSchedule(deviceId: string, params?: GetDeviceScheduleParams): Promise<DeviceSchedule> {
+    const response = await this.http.request<DeviceSchedule>({
+      method: 'GET',
+      url: `${this.baseURL}/devices/${encodeURIComponent(deviceId)}/schedule`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+}
@@ -0,0 +1,337 @@
+// Code generated by apigen from api/sample-service.json. DO NOT EDIT.
+
+import axios from 'axios';
+import type { AxiosInstance } from 'axios';
+
+export interface Sample {
+  barcode: string;
+  name: string;
+  type: string;
+  location: Location;
+  created_at: string;
+  updated_at?: string;
+  archived?: boolean;
+  archived_at?: string;
+  /** Set while the sample is in the trash. */
+  deleted_at?: string;
+  deleted_by?: string;
+  /** The sample an aliquot was taken from. */
+  parent_barcode?: string;
+  /** The volume left in microlitres, if tracked. */
+  volume_ul?: number | null;
+  /** In ng/uL, if tracked. */
+  concentration?: number | null;
+  metadata?: Record<string, string>;
+  expires_at?: string;
+  expired?: boolean;
+  /** Created for a generated barcode before its tube was registered. */
+  placeholder?: boolean;
+  merged_into?: string;
+  merged_from?: string[];
+  pooled_from?: PoolSource[];
+  project?: string;
+  created_by?: string;
+  updated_by?: string;
+  lab?: string;
+  /** Counts the writes to the sample, for optimistic concurrency. */
+  version: number;
+  schema_version: number;
+}
+
+/** A plate well, or a position in a storage location such as a box. */
+export interface Location {
+  plate: string;
+  well: string;
+  storage?: string;
+  position?: string;
+}
+
+export interface PoolSource {
+  barcode: string;
+  proportion: number;
+  volume_ul?: number | null;
+}
+
+export interface SampleListResponse {
+  total: number;
+  limit: number;
+  offset: number;
+  samples: Sample[];
+}
+
+export interface TrashedSample {
+  barcode: string;
+  name: string;
+  type: string;
+  location: Location;
+  created_at: string;
+  updated_at?: string;
+  archived?: boolean;
+  archived_at?: string;
+  /** Set while the sample is in the trash. */
+  deleted_at?: string;
+  deleted_by?: string;
+  /** The sample an aliquot was taken from. */
+  parent_barcode?: string;
+  /** The volume left in microlitres, if tracked. */
+  volume_ul?: number | null;
+  /** In ng/uL, if tracked. */
+  concentration?: number | null;
+  metadata?: Record<string, string>;
+  expires_at?: string;
+  expired?: boolean;
+  /** Created for a generated barcode before its tube was registered. */
+  placeholder?: boolean;
+  merged_into?: string;
+  merged_from?: string[];
+  pooled_from?: PoolSource[];
+  project?: string;
+  created_by?: string;
+  updated_by?: string;
+  lab?: string;
+  /** Counts the writes to the sample, for optimistic concurrency. */
+  version: number;
+  schema_version: number;
+  /** When the sample will be purged; unset if deleted samples are kept. */
+  purge_after?: string;
+}
+
+export interface TrashListResponse {
+  total: number;
+  limit: number;
+  offset: number;
+  samples: TrashedSample[];
+}
+
+export interface CreateSampleRequest {
+  barcode: string;
+  name?: string;
+  type?: string;
+  location?: Location;
+  volume_ul?: number | null;
+  concentration?: number | null;
+  metadata?: Record<string, string>;
+  expires_at?: string;
+  project?: string;
+  /** Place the sample in a well that already holds another active sample. */
+  allow_pooling?: boolean;
+}
+
+export interface SampleConsumption {
+  barcode: string;
+  volume_ul: number;
+}
+
+export interface BulkConsumeRequest {
+  consumptions: SampleConsumption[];
+  workflow_id?: string;
+  /** The workflow step the draws are for. */
+  step_index?: number | null;
+  /** Only check the draws could be made. */
+  dry_run?: boolean;
+}
+
+export interface ConsumeResponse {
+  dry_run: boolean;
+  samples: Sample[];
+}
+
+export interface ConsumptionError {
+  barcode: string;
+  error: string;
+  requested_ul: number;
+  available_ul?: number | null;
+}
+
+export interface ConsumeRejected {
+  error: string;
+  errors: ConsumptionError[];
+}
+
+export interface ValidateRequest {
+  barcodes: string[];
+  include_samples?: boolean;
+  /** Samples reserved by this workflow count as available. */
+  workflow_id?: string;
+}
+
+/**
+ * Why a sample can't be used, if it can't; status is the most serious
+ * reason, or available.
+ */
+export interface ValidationResult {
+  barcode: string;
+  exists: boolean;
+  archived?: boolean;
+  placeholder?: boolean;
+  consumed?: boolean;
+  expired?: boolean;
+  reserved?: boolean;
+  reserved_by?: string;
+  available: boolean;
+  status: string;
+  sample?: Sample;
+}
+
+/**
+ * Every error response: a message, with a code to tell errors apart by where
+ * the service gives one, and details where the service has them, such as the
+ * response of a service it called. Errors passed on from a service called
+ * give its response under upstream.
+ */
+export interface Error {
+  error: string;
+  /**
+   * Why the request failed, such as device_unavailable; for an error passed
+   * on from another service, that service's code, or one from its status.
+   */
+  code?: string;
+  details?: Record<string, unknown>;
+  upstream?: UpstreamError;
+}
+
+/**
+ * The failed response of a service called to serve the request. status is 0
+ * if the service didn't respond.
+ */
+export interface UpstreamError {
+  /** The service called, such as device-service. */
+  service: string;
+  status: number;
+  code?: string;
+  error?: string;
+  /**
+   * The X-Request-ID the call was made with, to find it in the service's
+   * logs.
+   */
+  request_id?: string;
+}
+
+export interface ListSamplesParams {
+  type?: string;
+  plate?: string;
+  storage?: string;
+  /** active (the default), archived or all. */
+  status?: string;
+  /** Text to search barcodes, names and metadata for. */
+  q?: string;
+  project?: string;
+  created_after?: string;
+  /** Samples with these metadata values, as metadata[key]=value. */
+  metadata?: Record<string, string>;
+  /** The most items to return. */
+  limit?: number;
+  /** How many items to skip. */
+  offset?: number;
+  /**
+   * With If-None-Match naming the current ETag, how many seconds to wait for
+   * the collection to change before answering 304; at most 60.
+   */
+  wait?: number;
+}
+
+export interface ListDeletedSamplesParams {
+  /** The most items to return. */
+  limit?: number;
+  /** How many items to skip. */
+  offset?: number;
+}
+
+/**
+ * Calls the sample service at baseURL, including the version prefix, such as
+ * http://localhost:8080/api/v1. Failed requests throw axios errors.
+ */
+export class SampleServiceClient {
+  constructor(
+    readonly baseURL: string,
+    readonly http: AxiosInstance = axios,
+  ) {}
+
+  /**
+   * Lists a page of the samples that match the filters, active ones only
+   * unless status says otherwise.
+   */
+  async listSamples(params?: ListSamplesParams): Promise<SampleListResponse> {
+    const response = await this.http.request<SampleListResponse>({
+      method: 'GET',
+      url: `${this.baseURL}/samples`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+
+  /** Registers a sample. */
+  async createSample(body: CreateSampleRequest): Promise<Sample> {
+    const response = await this.http.request<Sample>({
+      method: 'POST',
+      url: `${this.baseURL}/samples`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /** Lists a page of the deleted samples, in barcode order. */
+  async listDeletedSamples(params?: ListDeletedSamplesParams): Promise<TrashListResponse> {
+    const response = await this.http.request<TrashListResponse>({
+      method: 'GET',
+      url: `${this.baseURL}/samples/trash`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+
+  /** Takes a sample out of the trash, back to its well or storage position. */
+  async restoreDeletedSample(barcode: string): Promise<Sample> {
+    const response = await this.http.request<Sample>({
+      method: 'POST',
+      url: `${this.baseURL}/samples/trash/${encodeURIComponent(barcode)}/restore`,
+    });
+    return response.data;
+  }
+
+  /** Returns a sample. */
+  async getSample(barcode: string): Promise<Sample> {
+    const response = await this.http.request<Sample>({
+      method: 'GET',
+      url: `${this.baseURL}/samples/${encodeURIComponent(barcode)}`,
+    });
+    return response.data;
+  }
+
+  /**
+   * Moves a sample to the trash; samples reserved by a workflow can't be
+   * deleted.
+   */
+  async deleteSample(barcode: string): Promise<TrashedSample> {
+    const response = await this.http.request<TrashedSample>({
+      method: 'DELETE',
+      url: `${this.baseURL}/samples/${encodeURIComponent(barcode)}`,
+    });
+    return response.data;
+  }
+
+  /**
+   * Draws volume from many samples at once, such as for a workflow step;
+   * either every draw is made or none is.
+   */
+  async consumeSamples(body: BulkConsumeRequest): Promise<ConsumeResponse> {
+    const response = await this.http.request<ConsumeResponse>({
+      method: 'POST',
+      url: `${this.baseURL}/samples/consume`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /** Reports whether each sample exists and is available to a workflow. */
+  async validateSamples(body: ValidateRequest): Promise<ValidationResult[]> {
+    const response = await this.http.request<ValidationResult[]>({
+      method: 'POST',
+      url: `${this.baseURL}/samples/validate`,
+      data: body,
+    });
+    return response.data;
+  }
+}
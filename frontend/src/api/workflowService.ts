@@ -0,0 +1,841 @@
+// Code generated by apigen from api/workflow-service.json. DO NOT EDIT.
+
+import axios from 'axios';
+import type { AxiosInstance } from 'axios';
+
+export type WorkflowStatus = 'created' | 'queued' | 'running' | 'completed' | 'paused' | 'failed';
+
+export interface Workflow {
+  id: string;
+  name: string;
+  device_id: string;
+  sample_barcodes: string[];
+  steps: string[];
+  /** Passed to the device with the step at the same index. */
+  step_params?: Record<string, unknown>[];
+  requirements?: Requirements;
+  status: WorkflowStatus;
+  created_at: string;
+  /** When the workflow started waiting for its device. */
+  queued_at?: string;
+  started_at?: string;
+  completed_at?: string;
+  failed_at?: string;
+  failure_reason?: string;
+  created_by?: string;
+  started_by?: string;
+  completed_by?: string;
+  failed_by?: string;
+  lab?: string;
+  tags?: string[];
+  project?: string;
+  priority?: number;
+  /** The scheduler leaves the workflow to be started by hand. */
+  manual_start?: boolean;
+  /** The scheduler may run the workflow on any device of its device's type. */
+  pool?: boolean;
+  /** The SHA-256 hex of the API key the workflow was created with. */
+  created_by_key?: string;
+  step_results?: StepResult[];
+  /** Set while the workflow is archived. */
+  archived_at?: string;
+  archived_by?: string;
+  /** Set while the workflow is in the trash. */
+  deleted_at?: string;
+  deleted_by?: string;
+  pauses?: Pause[];
+  running_step?: RunningStep;
+  schema_version: number;
+}
+
+export interface TrashedWorkflow {
+  id: string;
+  name: string;
+  device_id: string;
+  sample_barcodes: string[];
+  steps: string[];
+  /** Passed to the device with the step at the same index. */
+  step_params?: Record<string, unknown>[];
+  requirements?: Requirements;
+  status: WorkflowStatus;
+  created_at: string;
+  /** When the workflow started waiting for its device. */
+  queued_at?: string;
+  started_at?: string;
+  completed_at?: string;
+  failed_at?: string;
+  failure_reason?: string;
+  created_by?: string;
+  started_by?: string;
+  completed_by?: string;
+  failed_by?: string;
+  lab?: string;
+  tags?: string[];
+  project?: string;
+  priority?: number;
+  /** The scheduler leaves the workflow to be started by hand. */
+  manual_start?: boolean;
+  /** The scheduler may run the workflow on any device of its device's type. */
+  pool?: boolean;
+  /** The SHA-256 hex of the API key the workflow was created with. */
+  created_by_key?: string;
+  step_results?: StepResult[];
+  /** Set while the workflow is archived. */
+  archived_at?: string;
+  archived_by?: string;
+  /** Set while the workflow is in the trash. */
+  deleted_at?: string;
+  deleted_by?: string;
+  pauses?: Pause[];
+  running_step?: RunningStep;
+  schema_version: number;
+  /** When the workflow will be purged; unset if deleted workflows are kept. */
+  purge_after?: string;
+}
+
+/** Checked by the device service when the workflow books its device. */
+export interface Requirements {
+  min_firmware_version?: string;
+  protocol_version?: string;
+}
+
+/**
+ * A time the workflow was paused; resumed_at is missing while it is still
+ * paused.
+ */
+export interface Pause {
+  paused_at: string;
+  paused_by?: string;
+  reason?: string;
+  resumed_at?: string;
+  resumed_by?: string;
+}
+
+/**
+ * The step the device is running now, with how far it has got; only on a
+ * running workflow fetched by ID.
+ */
+export interface RunningStep {
+  step_index: number;
+  step: string;
+  started_at: string;
+  progress_percent: number;
+  cycles_completed?: number;
+  cycles_total?: number;
+  progress_updated_at?: string;
+}
+
+export interface StepResult {
+  step_index: number;
+  step: string;
+  operation_id?: string;
+  status: string;
+  result?: Record<string, unknown>;
+  /**
+   * When the step was sent to the device; missing on results saved before it
+   * was recorded.
+   */
+  started_at?: string;
+  executed_at: string;
+  executed_by?: string;
+}
+
+/** A span of a workflow's run, as a bar of a Gantt chart. */
+export interface TimelineInterval {
+  /** queued, step, idle or paused. */
+  kind: string;
+  label: string;
+  step_index?: number;
+  status?: string;
+  start: string;
+  end: string;
+  duration_ms: number;
+  /** Still going on; it ends now. */
+  open?: boolean;
+  /**
+   * A step saved before step starts were recorded, taken to start when the
+   * one before it ended.
+   */
+  approximate?: boolean;
+}
+
+export interface Timeline {
+  workflow_id: string;
+  status: WorkflowStatus;
+  start?: string;
+  end?: string;
+  duration_ms: number;
+  intervals: TimelineInterval[];
+}
+
+export interface DeviceCall {
+  method: string;
+  url: string;
+  /**
+   * The JSON sent, or the body as a string if it isn't JSON or was cut short
+   * at 16 KiB.
+   */
+  request_body?: unknown;
+  /** 0 if no response came back. */
+  status_code: number;
+  /**
+   * The JSON received, or the body as a string if it isn't JSON or was cut
+   * short at 16 KiB.
+   */
+  response_body?: unknown;
+  error?: string;
+  latency_ms: number;
+  idempotency_key?: string;
+  /** Which call with the same idempotency key this is, from 1. */
+  attempt: number;
+  actor?: string;
+  request_id?: string;
+  timestamp: string;
+}
+
+export interface DeviceCallList {
+  workflow_id: string;
+  count: number;
+  calls: DeviceCall[];
+}
+
+export interface CreateWorkflowRequest {
+  name: string;
+  device_id: string;
+  sample_barcodes?: string[];
+  steps?: string[];
+  step_params?: Record<string, unknown>[];
+  requirements?: Requirements;
+  tags?: string[];
+  /**
+   * What project quotas count the workflow against, and what its device's
+   * booking policy grants it for.
+   */
+  project?: string;
+  /**
+   * Under a priority booking policy, queued workflows with a higher priority
+   * get their device first, and the scheduler starts them first.
+   */
+  priority?: number;
+  /** Keeps the scheduler from starting the workflow. */
+  manual_start?: boolean;
+  /**
+   * Lets the scheduler run the workflow on any device of its device's type
+   * that offers its steps.
+   */
+  pool?: boolean;
+}
+
+export interface CancelStepRequest {
+  reason?: string;
+}
+
+export interface FailWorkflowRequest {
+  reason?: string;
+}
+
+export interface ExecuteStepRequest {
+  step_index?: number;
+  /**
+   * Names one attempt at the step: a retry with the same token gets the
+   * first attempt's result rather than running the step again.
+   */
+  attempt_token?: string;
+}
+
+export interface ExecuteStepResponse {
+  workflow_id: string;
+  step_index: number;
+  step: string;
+  result: ExecuteResponse;
+  /** The samples after the step drew from them. */
+  consumed?: Sample[];
+  /** Why the step's draws from the samples couldn't be recorded. */
+  consumption_error?: unknown;
+}
+
+export interface FullWorkflow {
+  workflow: Workflow;
+  device?: Device;
+  samples: ValidationResult[];
+  /** Why each part left out couldn't be fetched. */
+  errors?: Record<string, string>;
+}
+
+/**
+ * A workflow's run simulated on a virtual copy of its device. ok is whether
+ * every step could run and the samples hold the volume the run draws.
+ */
+export interface WorkflowSimulation {
+  workflow_id: string;
+  device_id: string;
+  simulated: boolean;
+  ok: boolean;
+  run: SimulatedRun;
+  /** What the run draws from each sample. */
+  sample_volume_ul?: number;
+  /** The sample service's check that the samples hold it. */
+  samples?: Record<string, unknown>;
+  issues: string[];
+}
+
+/**
+ * Every field is optional: the workflows default to the lab's created and
+ * queued ones, start_at to now.
+ */
+export interface EstimateRequest {
+  workflow_ids?: string[];
+  start_at?: string;
+  deadline?: string;
+  /**
+   * How long operations take, by operation, instead of their simulated
+   * durations.
+   */
+  durations_ms?: Record<string, number>;
+  /** When devices can be used, by device ID. */
+  devices?: Record<string, DeviceAvailability>;
+}
+
+export interface DeviceAvailability {
+  available_at?: string;
+  capacity?: number;
+  unavailable?: TimeWindow[];
+}
+
+export interface TimeWindow {
+  start: string;
+  end: string;
+}
+
+export interface EstimatedRun {
+  workflow_id: string;
+  name: string;
+  device_id: string;
+  slot?: number;
+  status: WorkflowStatus;
+  priority?: number;
+  start: string;
+  end: string;
+  duration_ms: number;
+  /** Whether the run ends after the deadline. */
+  late?: boolean;
+}
+
+export interface UnscheduledWorkflow {
+  workflow_id: string;
+  device_id?: string;
+  reason: string;
+}
+
+export interface ScheduleEstimate {
+  generated_at: string;
+  start_at: string;
+  deadline?: string;
+  /** When the last run ends. */
+  completes_at?: string;
+  /** Set with a deadline: whether every workflow is laid out and ends by it. */
+  fits_deadline?: boolean;
+  runs: EstimatedRun[];
+  late: string[];
+  unscheduled: UnscheduledWorkflow[];
+  issues: string[];
+}
+
+/**
+ * A workflow the scheduler started, or tried to. status is the start's
+ * response status.
+ */
+export interface Dispatch {
+  lab?: string;
+  workflow_id: string;
+  device_id: string;
+  /** Whether it was moved to another device of its pool. */
+  moved?: boolean;
+  status: number;
+  error?: string;
+}
+
+export interface SchedulerPass {
+  started_at: string;
+  finished_at: string;
+  dispatched: Dispatch[];
+}
+
+export interface SchedulerStatus {
+  /** Whether the scheduler runs and the lab has auto_dispatch on. */
+  enabled: boolean;
+  interval: string;
+  last_pass?: SchedulerPass;
+}
+
+/**
+ * Caps the workflows a lab, project or API key has running, queued or
+ * paused, and creates in a UTC day; 0 is no cap.
+ */
+export interface Quota {
+  scope: string;
+  /**
+   * The lab, project or API key hash, or * for every one without its own
+   * quota.
+   */
+  subject: string;
+  max_running?: number;
+  max_created_per_day?: number;
+  updated_at?: string;
+  updated_by?: string;
+}
+
+export interface QuotaError {
+  error: string;
+  code: string;
+  quota: Quota;
+  subject: string;
+  usage: number;
+}
+
+/**
+ * Every error response: a message, with a code to tell errors apart by where
+ * the service gives one, and details where the service has them, such as the
+ * response of a service it called. Errors passed on from a service called
+ * give its response under upstream.
+ */
+export interface Error {
+  error: string;
+  /**
+   * Why the request failed, such as device_unavailable; for an error passed
+   * on from another service, that service's code, or one from its status.
+   */
+  code?: string;
+  details?: Record<string, unknown>;
+  upstream?: UpstreamError;
+}
+
+export interface ExecuteResponse {
+  device_id: string;
+  operation: string;
+  operation_id?: string;
+  status: string;
+  executed_at: string;
+  result?: Record<string, unknown>;
+  warnings?: string[];
+}
+
+export interface Sample {
+  barcode: string;
+  name: string;
+  type: string;
+  location: Location;
+  created_at: string;
+  updated_at?: string;
+  archived?: boolean;
+  archived_at?: string;
+  /** Set while the sample is in the trash. */
+  deleted_at?: string;
+  deleted_by?: string;
+  /** The sample an aliquot was taken from. */
+  parent_barcode?: string;
+  /** The volume left in microlitres, if tracked. */
+  volume_ul?: number | null;
+  /** In ng/uL, if tracked. */
+  concentration?: number | null;
+  metadata?: Record<string, string>;
+  expires_at?: string;
+  expired?: boolean;
+  /** Created for a generated barcode before its tube was registered. */
+  placeholder?: boolean;
+  merged_into?: string;
+  merged_from?: string[];
+  pooled_from?: PoolSource[];
+  project?: string;
+  created_by?: string;
+  updated_by?: string;
+  lab?: string;
+  /** Counts the writes to the sample, for optimistic concurrency. */
+  version: number;
+  schema_version: number;
+}
+
+export interface Device {
+  id: string;
+  name: string;
+  type: string;
+  /** available, busy, maintenance or error. */
+  status: string;
+  capabilities: string[];
+  /** How many workflows a multi-slot device holds at once. */
+  capacity?: number;
+  firmware?: FirmwareInfo;
+  tags?: string[];
+  metadata?: Record<string, string>;
+  consumables?: ConsumableLevel[];
+  warnings?: string[];
+  /** The workflow the device is booked for. */
+  workflow_id?: string;
+  booked_by?: string;
+  slots?: SlotState[];
+  error_state?: DeviceErrorState;
+  calibration?: Calibration;
+  lab?: string;
+}
+
+/**
+ * Why a sample can't be used, if it can't; status is the most serious
+ * reason, or available.
+ */
+export interface ValidationResult {
+  barcode: string;
+  exists: boolean;
+  archived?: boolean;
+  placeholder?: boolean;
+  consumed?: boolean;
+  expired?: boolean;
+  reserved?: boolean;
+  reserved_by?: string;
+  available: boolean;
+  status: string;
+  sample?: Sample;
+}
+
+export interface SimulatedRun {
+  device_id: string;
+  /** Whether every step could run. */
+  ok: boolean;
+  total_duration_ms: number;
+  steps: SimulatedStep[];
+  consumables_used: Record<string, number>;
+  /** The device's consumable levels as the run would leave them. */
+  consumables_left: ConsumableLevel[];
+  warnings?: string[];
+}
+
+/**
+ * The failed response of a service called to serve the request. status is 0
+ * if the service didn't respond.
+ */
+export interface UpstreamError {
+  /** The service called, such as device-service. */
+  service: string;
+  status: number;
+  code?: string;
+  error?: string;
+  /**
+   * The X-Request-ID the call was made with, to find it in the service's
+   * logs.
+   */
+  request_id?: string;
+}
+
+/** A plate well, or a position in a storage location such as a box. */
+export interface Location {
+  plate: string;
+  well: string;
+  storage?: string;
+  position?: string;
+}
+
+export interface PoolSource {
+  barcode: string;
+  proportion: number;
+  volume_ul?: number | null;
+}
+
+export interface FirmwareInfo {
+  firmware_version: string;
+  protocol_versions?: string[];
+  reported_at: string;
+}
+
+export interface ConsumableLevel {
+  name: string;
+  unit: string;
+  level: number;
+  capacity: number;
+  low_threshold: number;
+  low: boolean;
+}
+
+export interface SlotState {
+  slot: number;
+  status: string;
+  workflow_id?: string;
+  booked_by?: string;
+}
+
+export interface DeviceErrorState {
+  cause: string;
+  operation?: string;
+  workflow_id?: string;
+  estop?: boolean;
+  occurred_at: string;
+}
+
+export interface Calibration {
+  last_calibrated_at?: string;
+  interval_days?: number;
+  calibrated_by?: string;
+  notes?: string;
+  due_at?: string;
+  overdue: boolean;
+}
+
+/**
+ * A step as the virtual device ran it. A step it couldn't run has error set
+ * and takes no time.
+ */
+export interface SimulatedStep {
+  step_index: number;
+  operation: string;
+  /** When the step would start, from the start of the run. */
+  start_ms: number;
+  duration_ms: number;
+  /** How often the simulated device fails the operation. */
+  failure_rate?: number;
+  consumables?: Record<string, number>;
+  result?: Record<string, unknown>;
+  error?: string;
+  code?: string;
+}
+
+export interface ListWorkflowsParams {
+  /**
+   * With If-None-Match naming the current ETag, how many seconds to wait for
+   * the collection to change before answering 304; at most 60.
+   */
+  wait?: number;
+}
+
+export interface ListWorkflowDeviceCallsParams {
+  /** Only calls that got no response or an error status. */
+  failed?: boolean;
+  limit?: number;
+}
+
+export interface StartWorkflowParams {
+  simulate?: boolean;
+}
+
+/**
+ * Calls the workflow service at baseURL, including the version prefix, such
+ * as http://localhost:8080/api/v1. Failed requests throw axios errors.
+ */
+export class WorkflowServiceClient {
+  constructor(
+    readonly baseURL: string,
+    readonly http: AxiosInstance = axios,
+  ) {}
+
+  /** Lists the lab's workflows, oldest first. */
+  async listWorkflows(params?: ListWorkflowsParams): Promise<Workflow[]> {
+    const response = await this.http.request<Workflow[]>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+
+  /** Creates a workflow, checking its device and samples exist. */
+  async createWorkflow(body: CreateWorkflowRequest): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /** Lists the lab's archived workflows, oldest first. */
+  async listArchivedWorkflows(): Promise<Workflow[]> {
+    const response = await this.http.request<Workflow[]>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows/archive`,
+    });
+    return response.data;
+  }
+
+  /** Lists the lab's deleted workflows, most recently deleted first. */
+  async listDeletedWorkflows(): Promise<TrashedWorkflow[]> {
+    const response = await this.http.request<TrashedWorkflow[]>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows/trash`,
+    });
+    return response.data;
+  }
+
+  /**
+   * Moves a deleted workflow back to the workflow list, or the archive if it
+   * was archived.
+   */
+  async restoreDeletedWorkflow(workflowId: string): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/trash/${encodeURIComponent(workflowId)}/restore`,
+    });
+    return response.data;
+  }
+
+  /** Returns a workflow, archived or not. */
+  async getWorkflow(workflowId: string): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}`,
+    });
+    return response.data;
+  }
+
+  /** Moves a created, completed or failed workflow to the trash. */
+  async deleteWorkflow(workflowId: string): Promise<TrashedWorkflow> {
+    const response = await this.http.request<TrashedWorkflow>({
+      method: 'DELETE',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}`,
+    });
+    return response.data;
+  }
+
+  /** Returns a workflow with its device and the availability of its samples. */
+  async getFullWorkflow(workflowId: string): Promise<FullWorkflow> {
+    const response = await this.http.request<FullWorkflow>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/full`,
+    });
+    return response.data;
+  }
+
+  /** Returns the saved result of a step of a workflow. */
+  async getStepResult(workflowId: string, stepIndex: string): Promise<StepResult> {
+    const response = await this.http.request<StepResult>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/steps/${encodeURIComponent(stepIndex)}/result`,
+    });
+    return response.data;
+  }
+
+  /** Returns a workflow's run as intervals for a Gantt chart. */
+  async getWorkflowTimeline(workflowId: string): Promise<Timeline> {
+    const response = await this.http.request<Timeline>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/timeline`,
+    });
+    return response.data;
+  }
+
+  /**
+   * Returns the calls made to the device service for a workflow, newest
+   * first.
+   */
+  async listWorkflowDeviceCalls(workflowId: string, params?: ListWorkflowDeviceCallsParams): Promise<DeviceCallList> {
+    const response = await this.http.request<DeviceCallList>({
+      method: 'GET',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/device-calls`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+
+  /** Starts a workflow, booking its device. */
+  async startWorkflow(workflowId: string, params?: StartWorkflowParams): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/start`,
+      params,
+      paramsSerializer: { indexes: null },
+    });
+    return response.data;
+  }
+
+  /** Completes a running workflow, releasing its device. */
+  async completeWorkflow(workflowId: string): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/complete`,
+    });
+    return response.data;
+  }
+
+  /** Marks a workflow failed. */
+  async failWorkflow(workflowId: string, body?: FailWorkflowRequest): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/fail`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /** Cancels the step a workflow's device is running and pauses the workflow. */
+  async cancelStep(workflowId: string, stepIndex: string, body?: CancelStepRequest): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/steps/${encodeURIComponent(stepIndex)}/cancel`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /** Sets a paused workflow running again. */
+  async resumeWorkflow(workflowId: string): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/resume`,
+    });
+    return response.data;
+  }
+
+  /**
+   * Moves a completed or failed workflow to the archive, out of the workflow
+   * list.
+   */
+  async archiveWorkflow(workflowId: string): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/archive`,
+    });
+    return response.data;
+  }
+
+  /** Moves an archived workflow back to the workflow list. */
+  async restoreWorkflow(workflowId: string): Promise<Workflow> {
+    const response = await this.http.request<Workflow>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/restore`,
+    });
+    return response.data;
+  }
+
+  /** Runs one of a running workflow's steps on its device. */
+  async executeStep(workflowId: string, body?: ExecuteStepRequest): Promise<ExecuteStepResponse> {
+    const response = await this.http.request<ExecuteStepResponse>({
+      method: 'POST',
+      url: `${this.baseURL}/workflows/${encodeURIComponent(workflowId)}/execute-step`,
+      data: body,
+    });
+    return response.data;
+  }
+
+  /**
+   * Returns whether the scheduler starts the lab's created workflows, and
+   * what its last pass started in the lab.
+   */
+  async getSchedulerStatus(): Promise<SchedulerStatus> {
+    const response = await this.http.request<SchedulerStatus>({
+      method: 'GET',
+      url: `${this.baseURL}/scheduler`,
+    });
+    return response.data;
+  }
+
+  /**
+   * Proposes a schedule for the lab's pending workflows, with when they
+   * would complete, without booking or starting anything.
+   */
+  async estimateSchedule(body?: EstimateRequest): Promise<ScheduleEstimate> {
+    const response = await this.http.request<ScheduleEstimate>({
+      method: 'POST',
+      url: `${this.baseURL}/scheduler/estimate`,
+      data: body,
+    });
+    return response.data;
+  }
+}
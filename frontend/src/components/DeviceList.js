@@ -27,6 +27,8 @@ function DeviceList({ devices }) {
         return '#4caf50';
       case 'busy':
         return '#ff9800';
+      case 'error':
+        return '#f44336';
       default:
         return '#999';
     }
@@ -54,6 +56,18 @@ function DeviceList({ devices }) {
               {device.workflow_id && (
                 <p><strong>Workflow:</strong> {device.workflow_id}</p>
               )}
+              {device.slots && (
+                <p>
+                  <strong>Slots:</strong>{' '}
+                  {device.slots.filter((slot) => slot.workflow_id).length}/{device.capacity} in use
+                </p>
+              )}
+              {device.warnings && device.warnings.map((warning) => (
+                <p key={warning} className="device-warning">{warning}</p>
+              ))}
+              {device.error_state && (
+                <p><strong>Error:</strong> {device.error_state.cause}</p>
+              )}
               {device.capabilities && (
                 <div className="capabilities">
                   <strong>Capabilities:</strong>
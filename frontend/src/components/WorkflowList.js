@@ -1,15 +1,19 @@
 import React from 'react';
 import './WorkflowList.css';
 
-function WorkflowList({ workflows, onStart, onComplete }) {
+function WorkflowList({ workflows, onStart, onSimulate, onComplete, reportUrl }) {
   const getStatusColor = (status) => {
     switch (status) {
       case 'created':
         return '#2196f3';
+      case 'queued':
+        return '#9c27b0';
       case 'running':
         return '#ff9800';
       case 'completed':
         return '#4caf50';
+      case 'failed':
+        return '#f44336';
       default:
         return '#999';
     }
@@ -60,6 +64,9 @@ function WorkflowList({ workflows, onStart, onComplete }) {
                   Completed: {new Date(workflow.completed_at).toLocaleString()}
                 </p>
               )}
+              {workflow.failure_reason && (
+                <p><strong>Failed:</strong> {workflow.failure_reason}</p>
+              )}
             </div>
 
             <div className="workflow-actions">
@@ -71,6 +78,14 @@ function WorkflowList({ workflows, onStart, onComplete }) {
                   Start Workflow
                 </button>
               )}
+              {workflow.status === 'created' && (
+                <button
+                  onClick={() => onSimulate(workflow.id)}
+                  className="simulate-btn"
+                >
+                  Simulate
+                </button>
+              )}
               {workflow.status === 'running' && (
                 <button
                   onClick={() => onComplete(workflow.id)}
@@ -79,6 +94,16 @@ function WorkflowList({ workflows, onStart, onComplete }) {
                   Complete Workflow
                 </button>
               )}
+              {(workflow.status === 'completed' || workflow.status === 'failed') && (
+                <>
+                  <a href={reportUrl(workflow.id)} target="_blank" rel="noreferrer" className="report-link">
+                    Run Report
+                  </a>
+                  <a href={`${reportUrl(workflow.id)}?format=pdf`} target="_blank" rel="noreferrer" className="report-link">
+                    PDF
+                  </a>
+                </>
+              )}
             </div>
           </div>
         ))
@@ -0,0 +1,213 @@
+package platform
+
+import (
+	"compress/gzip"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Responses to clients that accept gzip are compressed when they are text
+// (JSON, JSON Lines, CSV, HTML and the like) of at least GZIP_MIN_BYTES
+// (default 1024). GZIP_LEVEL sets the compression level, 1 (fastest) to 9
+// (smallest), default 6; 0 turns compression off. Event streams, and
+// responses already encoded or sent in ranges, are left alone. Streamed
+// responses, such as exports, are compressed as they are flushed.
+
+const defaultGzipMinBytes = 1024
+
+var (
+	gzipLevel    = gzip.DefaultCompression
+	gzipMinBytes = defaultGzipMinBytes
+	gzipWriters  sync.Pool
+)
+
+// ConfigureCompression reads GZIP_LEVEL and GZIP_MIN_BYTES.
+func ConfigureCompression() {
+	if value := os.Getenv("GZIP_LEVEL"); value != "" {
+		level, err := strconv.Atoi(value)
+		if err != nil || level < 0 || level > gzip.BestCompression {
+			log.Fatalf("Invalid GZIP_LEVEL %q", value)
+		}
+		gzipLevel = level
+	}
+	if value := os.Getenv("GZIP_MIN_BYTES"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid GZIP_MIN_BYTES %q", value)
+		}
+		gzipMinBytes = n
+	}
+	if gzipLevel == 0 {
+		log.Printf("Response compression off")
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = parsed
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// compressibleType reports whether responses of a content type are worth
+// compressing.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml", "application/javascript", "application/graphql-response+json":
+		return true
+	}
+	return false
+}
+
+// gzipResponse holds back the start of a response until there is enough of
+// it to decide whether to compress it.
+type gzipResponse struct {
+	gin.ResponseWriter
+	accepts bool
+	decided bool
+	pending []byte
+	gz      *gzip.Writer
+}
+
+// decide compresses the response from here on if it is worth it; flushing
+// means more is coming, so a short start doesn't rule it out.
+func (w *gzipResponse) decide(flushing bool) {
+	w.decided = true
+	header := w.Header()
+	status := w.ResponseWriter.Status()
+	compressible := compressibleType(header.Get("Content-Type"))
+	if compressible {
+		header.Add("Vary", "Accept-Encoding")
+	}
+	if !w.accepts || !compressible || w.ResponseWriter.Written() ||
+		header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" ||
+		status < http.StatusOK || status == http.StatusNoContent || status == http.StatusPartialContent || status == http.StatusNotModified ||
+		(!flushing && len(w.pending) < gzipMinBytes) {
+		return
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	// The compressed bytes differ from the uncompressed ones the ETag was
+	// worked out for.
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	if gz, ok := gzipWriters.Get().(*gzip.Writer); ok {
+		gz.Reset(w.ResponseWriter)
+		w.gz = gz
+	} else {
+		w.gz, _ = gzip.NewWriterLevel(w.ResponseWriter, gzipLevel)
+	}
+}
+
+func (w *gzipResponse) Write(data []byte) (int, error) {
+	if !w.decided {
+		w.pending = append(w.pending, data...)
+		if len(w.pending) < gzipMinBytes {
+			return len(data), nil
+		}
+		if err := w.writePending(false); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *gzipResponse) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// writePending decides, then writes what was held back.
+func (w *gzipResponse) writePending(flushing bool) error {
+	w.decide(flushing)
+	pending := w.pending
+	w.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(pending)
+	} else {
+		_, err = w.ResponseWriter.Write(pending)
+	}
+	return err
+}
+
+func (w *gzipResponse) Flush() {
+	if !w.decided {
+		w.writePending(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// finish writes what is still held back and ends the compressed stream.
+func (w *gzipResponse) finish() {
+	if !w.decided && len(w.pending) > 0 {
+		w.writePending(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+		gzipWriters.Put(w.gz)
+		w.gz = nil
+	}
+}
+
+// CompressResponses gzips responses for clients that accept it.
+func CompressResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if gzipLevel == 0 || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		w := &gzipResponse{ResponseWriter: c.Writer, accepts: acceptsGzip(c.GetHeader("Accept-Encoding"))}
+		c.Writer = w
+		defer func() {
+			w.finish()
+			c.Writer = w.ResponseWriter
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,55 @@
+package platform
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCompressResponses(t *testing.T) {
+	large := strings.Repeat("aspirate dispense ", 200)
+	router := gin.New()
+	router.Use(CompressResponses())
+	router.GET("/large", ConditionalGET(func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"steps": large}) }))
+	router.GET("/small", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"steps": "shake"}) })
+	get := func(path, acceptEncoding, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		r.Header.Set("If-None-Match", etag)
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/large", "br;q=1.0, gzip;q=0.8", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("got %d with headers %v, want a gzipped response", w.Code, w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("invalid gzip: %v", err)
+	}
+	var body struct{ Steps string }
+	if err := json.NewDecoder(gz).Decode(&body); err != nil || body.Steps != large {
+		t.Errorf("got %q, err %v after decompressing", body.Steps, err)
+	}
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, "W/") {
+		t.Errorf("got ETag %q for a compressed response, want a weak one", etag)
+	}
+	if w := get("/large", "gzip", etag); w.Code != http.StatusNotModified {
+		t.Errorf("got %d for the weak ETag, want 304", w.Code)
+	}
+
+	if w := get("/large", "gzip;q=0, identity", ""); w.Header().Get("Content-Encoding") != "" || !strings.Contains(w.Body.String(), large) {
+		t.Errorf("compressed a response for a client that refuses gzip")
+	}
+	if w := get("/small", "gzip", ""); w.Header().Get("Content-Encoding") != "" || w.Body.String() != `{"steps":"shake"}` {
+		t.Errorf("got %q with headers %v, want a small response sent as is", w.Body.String(), w.Header())
+	}
+}
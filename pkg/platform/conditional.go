@@ -0,0 +1,133 @@
+package platform
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Collection endpoints wrapped in ConditionalGET tag their response with an
+// ETag, a hash of the body, and answer 304 Not Modified when the client's
+// If-None-Match already names it. With ?wait=<seconds> as well, a request
+// whose collection hasn't changed is held open until it does, or until the
+// wait runs out, so clients without SSE can long-poll instead of
+// re-downloading the collection every second.
+
+const (
+	// maxLongPollWait caps ?wait=.
+	maxLongPollWait = 60 * time.Second
+	// longPollInterval is how often a held request checks for a change.
+	longPollInterval = time.Second
+)
+
+// bufferedResponse holds what a handler writes so its ETag can be worked
+// out before anything is sent.
+type bufferedResponse struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *bufferedResponse) WriteHeader(code int) { w.status = code }
+
+func (w *bufferedResponse) WriteHeaderNow() {}
+
+func (w *bufferedResponse) Write(data []byte) (int, error) { return w.body.Write(data) }
+
+func (w *bufferedResponse) WriteString(s string) (int, error) { return w.body.WriteString(s) }
+
+func (w *bufferedResponse) Status() int { return w.status }
+
+func (w *bufferedResponse) Size() int { return w.body.Len() }
+
+func (w *bufferedResponse) Written() bool { return w.body.Len() > 0 }
+
+// bodyETag is the entity tag of a response body.
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header names etag; weak
+// tags compare equal to strong ones, as RFC 9110 asks for GET.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// longPollWait reads ?wait=, in seconds.
+func longPollWait(c *gin.Context) (time.Duration, bool) {
+	value := c.Query("wait")
+	if value == "" {
+		return 0, true
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	wait := time.Duration(seconds) * time.Second
+	if wait > maxLongPollWait {
+		wait = maxLongPollWait
+	}
+	return wait, true
+}
+
+// ConditionalGET wraps a collection handler with ETags, If-None-Match and
+// ?wait= long-polling. Errors from the handler are passed on untouched.
+func ConditionalGET(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		wait, ok := longPollWait(c)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wait must be a number of seconds"})
+			return
+		}
+		deadline := time.Now().Add(wait)
+		writer := c.Writer
+		for {
+			buffered := &bufferedResponse{ResponseWriter: writer, status: http.StatusOK}
+			c.Writer = buffered
+			handler(c)
+			c.Writer = writer
+
+			if buffered.status != http.StatusOK {
+				c.Writer.WriteHeader(buffered.status)
+				c.Writer.Write(buffered.body.Bytes())
+				return
+			}
+			etag := bodyETag(buffered.body.Bytes())
+			c.Header("ETag", etag)
+			if !etagMatches(c.GetHeader("If-None-Match"), etag) {
+				c.Writer.WriteHeader(http.StatusOK)
+				c.Writer.Write(buffered.body.Bytes())
+				return
+			}
+
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				c.Header("Content-Type", "")
+				c.Status(http.StatusNotModified)
+				c.Writer.WriteHeaderNow()
+				return
+			}
+			if remaining > longPollInterval {
+				remaining = longPollInterval
+			}
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-time.After(remaining):
+			}
+		}
+	}
+}
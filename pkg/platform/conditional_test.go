@@ -0,0 +1,50 @@
+package platform
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConditionalGET(t *testing.T) {
+	var version atomic.Int32
+	router := gin.New()
+	router.GET("/workflows", ConditionalGET(func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"version": version.Load()})
+	}))
+	get := func(query, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/workflows"+query, nil)
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Body.String() != `{"version":0}` {
+		t.Fatalf("got %d %q with ETag %q", w.Code, w.Body.String(), etag)
+	}
+	if w := get("", "W/"+etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got %d %q for an unchanged collection, want 304", w.Code, w.Body.String())
+	}
+	if w := get("?wait=soon", etag); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an invalid wait, want 400", w.Code)
+	}
+
+	time.AfterFunc(200*time.Millisecond, func() { version.Store(1) })
+	started := time.Now()
+	w = get("?wait=5", etag)
+	if w.Code != http.StatusOK || w.Body.String() != `{"version":1}` || w.Header().Get("ETag") == etag {
+		t.Errorf("got %d %q after a long poll, want the changed collection", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("long poll took %v", elapsed)
+	}
+}
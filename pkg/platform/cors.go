@@ -0,0 +1,77 @@
+package platform
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/cors"
+)
+
+// defaultCORSOrigins are allowed when CORS_ALLOWED_ORIGINS isn't set: the
+// frontend as docker-compose serves it.
+var defaultCORSOrigins = []string{"http://localhost:3000"}
+
+const defaultCORSMaxAge = 12 * time.Hour
+
+// CORSConfig completes the service's CORS policy, its methods and headers,
+// from the environment:
+//
+//   - CORS_ALLOWED_ORIGINS: comma-separated origins allowed, such as
+//     https://lab.example.com (default http://localhost:3000), or * for
+//     any origin, which is for development only
+//   - CORS_ALLOWED_HEADERS: request headers allowed besides the service's
+//   - CORS_ALLOW_CREDENTIALS: true to allow cookies and credentials
+//   - CORS_MAX_AGE: how long browsers may cache a preflight response, as a
+//     Go duration (default 12h)
+func CORSConfig(config cors.Config) (cors.Config, error) {
+	origins := defaultCORSOrigins
+	if value := os.Getenv("CORS_ALLOWED_ORIGINS"); value != "" {
+		origins = SplitList(value)
+	}
+	config.AllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+	config.AllowHeaders = append(config.AllowHeaders, SplitList(os.Getenv("CORS_ALLOWED_HEADERS"))...)
+
+	config.MaxAge = defaultCORSMaxAge
+	if value := os.Getenv("CORS_MAX_AGE"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			return config, fmt.Errorf("CORS_MAX_AGE must be a duration such as 1h: %q", value)
+		}
+		config.MaxAge = maxAge
+	}
+
+	if len(origins) == 1 && origins[0] == "*" {
+		log.Println("CORS allows any origin; only use CORS_ALLOWED_ORIGINS=* in development")
+		if config.AllowCredentials {
+			// Browsers refuse credentials with a wildcard origin, so each
+			// origin is echoed back instead.
+			config.AllowOriginFunc = func(string) bool { return true }
+		} else {
+			config.AllowAllOrigins = true
+		}
+		return config, nil
+	}
+	for _, origin := range origins {
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || strings.Trim(parsed.Path, "/") != "" {
+			return config, fmt.Errorf("CORS_ALLOWED_ORIGINS must list origins such as https://lab.example.com, or be *: %q", origin)
+		}
+		config.AllowOrigins = append(config.AllowOrigins, strings.TrimSuffix(origin, "/"))
+	}
+	return config, nil
+}
+
+// SplitList splits a comma-separated setting, dropping empty items.
+func SplitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,211 @@
+package platform
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// DEBUG_EVENTS_PATTERN matches every service's event channel, as in
+// workflow:events, for the event tap.
+const DEBUG_EVENTS_PATTERN = "*:events"
+
+const (
+	defaultEventTapSize = 200
+	maxEventTapSize     = 10000
+)
+
+// redactedHeaders are logged as [redacted] by the verbose request log.
+var redactedHeaders = map[string]bool{"Authorization": true, "Cookie": true, "Set-Cookie": true, "X-Api-Key": true}
+
+var (
+	debugMode   bool
+	debugToken  string
+	eventTap    *EventTap
+	debugClient redis.UniversalClient
+)
+
+// TappedEvent is an event the tap saw on one of the event channels.
+type TappedEvent struct {
+	Channel    string          `json:"channel"`
+	ReceivedAt string          `json:"received_at"`
+	Event      json.RawMessage `json:"event"`
+}
+
+// EventTap keeps the last events published on the event channels in
+// memory, oldest first.
+type EventTap struct {
+	mu       sync.Mutex
+	events   []TappedEvent
+	capacity int
+	dropped  int
+}
+
+func (t *EventTap) add(event TappedEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.events) == t.capacity {
+		t.events = t.events[1:]
+		t.dropped++
+	}
+	t.events = append(t.events, event)
+}
+
+// recent returns up to limit of the latest events, on channel unless it is
+// empty, oldest first, and how many older events were dropped to make room.
+func (t *EventTap) recent(channel string, limit int) ([]TappedEvent, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events := []TappedEvent{}
+	for i := len(t.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if channel == "" || t.events[i].Channel == channel {
+			events = append(events, t.events[i])
+		}
+	}
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, t.dropped
+}
+
+// ConfigureDebug sets Gin's mode, release unless GIN_MODE says otherwise,
+// and turns on debug mode with DEBUG_MODE=true. Debug mode runs Gin in
+// debug mode, logs every request in detail and serves /debug, which needs
+// DEBUG_TOKEN as a bearer token. The event tap listens on client.
+func ConfigureDebug(client redis.UniversalClient) {
+	mode := gin.ReleaseMode
+	if value := os.Getenv("GIN_MODE"); value != "" {
+		if value != gin.DebugMode && value != gin.ReleaseMode && value != gin.TestMode {
+			log.Fatalf("Invalid GIN_MODE %q; use debug, release or test", value)
+		}
+		mode = value
+	}
+	debugMode = os.Getenv("DEBUG_MODE") == "true"
+	if !debugMode {
+		gin.SetMode(mode)
+		return
+	}
+
+	debugToken = os.Getenv("DEBUG_TOKEN")
+	if debugToken == "" {
+		log.Fatalf("DEBUG_MODE needs DEBUG_TOKEN to protect the debug endpoints")
+	}
+	gin.SetMode(gin.DebugMode)
+
+	size := defaultEventTapSize
+	if value := os.Getenv("DEBUG_EVENT_TAP_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxEventTapSize {
+			log.Fatalf("Invalid DEBUG_EVENT_TAP_SIZE %q; use 1 to %d", value, maxEventTapSize)
+		}
+		size = n
+	}
+	eventTap = &EventTap{capacity: size}
+	debugClient = client
+	go tapEvents()
+	log.Println("⚠️  Debug mode is on: requests are logged in detail and /debug is served; don't use it in production")
+}
+
+// tapEvents records the events published on every event channel.
+func tapEvents() {
+	pubsub := debugClient.PSubscribe(ctx, DEBUG_EVENTS_PATTERN)
+	defer pubsub.Close()
+	for msg := range pubsub.Channel() {
+		event := json.RawMessage(msg.Payload)
+		if !json.Valid(event) {
+			event, _ = json.Marshal(msg.Payload)
+		}
+		eventTap.add(TappedEvent{Channel: msg.Channel, ReceivedAt: time.Now().UTC().Format(time.RFC3339Nano), Event: event})
+	}
+}
+
+// RegisterDebug adds the verbose request log and the /debug routes in
+// debug mode. It is called before the API's middleware, so /debug only
+// goes through the token check.
+func RegisterDebug(router *gin.Engine) {
+	if !debugMode {
+		return
+	}
+	router.Use(verboseRequestLog())
+	debug := router.Group("/debug", requireDebugToken())
+	debug.GET("/pprof/*profile", pprofHandler)
+	debug.POST("/pprof/symbol", gin.WrapF(pprof.Symbol))
+	debug.GET("/events", eventTapHandler)
+}
+
+func requireDebugToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(debugToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "A valid debug token is required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// pprofHandler serves the runtime profiles, as net/http/pprof does at
+// /debug/pprof/.
+func pprofHandler(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// eventTapHandler returns the latest events the tap saw, oldest first:
+// ?channel= keeps one channel's and ?limit= (default 100) caps how many.
+func eventTapHandler(c *gin.Context) {
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+	events, dropped := eventTap.recent(c.Query("channel"), limit)
+	c.JSON(http.StatusOK, gin.H{"events": events, "capacity": eventTap.capacity, "dropped": dropped})
+}
+
+// verboseRequestLog logs each request with its query, headers (secrets
+// redacted), body sizes and any errors, after it is handled.
+func verboseRequestLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		headers := make([]string, 0, len(c.Request.Header))
+		for name, values := range c.Request.Header {
+			value := strings.Join(values, ", ")
+			if redactedHeaders[name] {
+				value = "[redacted]"
+			}
+			headers = append(headers, name+": "+value)
+		}
+		sort.Strings(headers)
+		log.Printf("[DEBUG] %s %s?%s -> %d in %s | from %s | request %d bytes, response %d bytes | headers: %s | errors: %s",
+			c.Request.Method, c.Request.URL.Path, c.Request.URL.RawQuery, c.Writer.Status(), time.Since(start),
+			c.ClientIP(), c.Request.ContentLength, c.Writer.Size(), strings.Join(headers, "; "), c.Errors.String())
+	}
+}
@@ -0,0 +1,5 @@
+// Package platform is the plumbing every service shares: connecting to
+// Redis and reporting on it, CORS, debug mode, feature flags, response
+// compression and conditional GETs. Each service's go.mod replaces it with
+// this directory.
+package platform
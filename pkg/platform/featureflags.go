@@ -0,0 +1,123 @@
+package platform
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Feature flags gate new behaviour so it can be rolled out gradually. They
+// are kept in the Redis hash feature_flags, shared by every service and
+// managed with the device service's /admin/feature-flags API; each
+// deployment has its own Redis, so flags are set per environment. A flag is
+// on for every lab or only for some. FEATURE_FLAGS (such as
+// "async_execution=true,queueing=false") overrides flags for this service
+// alone.
+const FEATURE_FLAGS_KEY = "feature_flags"
+
+// featureFlagRefresh is how long flags read from Redis are used before
+// being read again.
+const featureFlagRefresh = 10 * time.Second
+
+// FeatureFlag is on for every lab if Enabled, and otherwise only for the
+// labs listed, "" being the default lab.
+type FeatureFlag struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Enabled     bool     `json:"enabled"`
+	Labs        []string `json:"labs,omitempty"`
+	UpdatedAt   string   `json:"updated_at,omitempty"`
+	UpdatedBy   string   `json:"updated_by,omitempty"`
+}
+
+func (f FeatureFlag) enabledFor(lab string) bool {
+	if f.Enabled {
+		return true
+	}
+	for _, l := range f.Labs {
+		if l == lab {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// FeatureFlagOverrides are the FEATURE_FLAGS overrides.
+	FeatureFlagOverrides = map[string]bool{}
+
+	featureFlagsMu       sync.Mutex
+	featureFlags         map[string]FeatureFlag
+	featureFlagsLoadedAt time.Time
+)
+
+// ConfigureFeatureFlags reads the FEATURE_FLAGS overrides.
+func ConfigureFeatureFlags() {
+	value := strings.TrimSpace(os.Getenv("FEATURE_FLAGS"))
+	if value == "" {
+		return
+	}
+	for _, pair := range strings.Split(value, ",") {
+		name, setting, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		enabled, err := strconv.ParseBool(setting)
+		if !ok || name == "" || err != nil {
+			log.Fatalf("Invalid FEATURE_FLAGS entry %q; expected name=true or name=false", pair)
+		}
+		FeatureFlagOverrides[name] = enabled
+	}
+	log.Printf("Feature flag overrides: %v", FeatureFlagOverrides)
+}
+
+// LoadFeatureFlags reads every flag from Redis.
+func LoadFeatureFlags(client redis.UniversalClient) (map[string]FeatureFlag, error) {
+	values, err := client.HGetAll(ctx, FEATURE_FLAGS_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	flags := make(map[string]FeatureFlag, len(values))
+	for name, data := range values {
+		var flag FeatureFlag
+		if err := json.Unmarshal([]byte(data), &flag); err != nil {
+			log.Printf("Invalid feature flag %s: %v", name, err)
+			continue
+		}
+		flags[name] = flag
+	}
+	return flags, nil
+}
+
+// FeatureEnabled reports whether a flag is on for a lab, reading the flags
+// from client now and then. Unknown flags are off, and if the flags can't
+// be read the ones last read are used.
+func FeatureEnabled(client redis.UniversalClient, name, lab string) bool {
+	if enabled, ok := FeatureFlagOverrides[name]; ok {
+		return enabled
+	}
+
+	featureFlagsMu.Lock()
+	defer featureFlagsMu.Unlock()
+	if time.Since(featureFlagsLoadedAt) >= featureFlagRefresh {
+		flags, err := LoadFeatureFlags(client)
+		if err != nil {
+			log.Printf("Error reading feature flags: %v", err)
+		} else {
+			featureFlags = flags
+		}
+		featureFlagsLoadedAt = time.Now()
+	}
+	return featureFlags[name].enabledFor(lab)
+}
+
+// ForgetFeatureFlags makes the next check read the flags again, so changes
+// made to them take effect at once.
+func ForgetFeatureFlags() {
+	featureFlagsMu.Lock()
+	featureFlagsLoadedAt = time.Time{}
+	featureFlagsMu.Unlock()
+}
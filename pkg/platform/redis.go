@@ -0,0 +1,254 @@
+package platform
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultRedisConnectAttempts = 10
+	redisRetryBaseDelay         = 500 * time.Millisecond
+	redisRetryMaxDelay          = 10 * time.Second
+	redisCheckInterval          = 5 * time.Second
+	redisCheckTimeout           = 2 * time.Second
+)
+
+var ctx = context.Background()
+
+var (
+	// redisClient is the client waitForRedis was given, to check Redis
+	// with.
+	redisClient redis.UniversalClient
+	// redisUp is whether Redis answered the last check. While it is down
+	// the service stays up but reports itself degraded and not ready.
+	redisUp atomic.Bool
+)
+
+// NewRedisClient returns a client for the Redis deployment configured in
+// the environment. It doesn't connect; see WaitForRedis.
+//
+// REDIS_MODE is standalone (the default), sentinel or cluster. A standalone
+// Redis is at REDIS_URL, or the one address in REDIS_ADDRS. Sentinel mode
+// asks the sentinels in REDIS_ADDRS for the master named REDIS_MASTER_NAME
+// and follows failovers; cluster mode discovers the cluster from the nodes
+// in REDIS_ADDRS.
+func NewRedisClient() redis.UniversalClient {
+	tlsConfig, err := redisTLSConfig()
+	if err != nil {
+		log.Fatalf("Invalid Redis TLS configuration: %v", err)
+	}
+
+	mode := strings.ToLower(strings.TrimSpace(os.Getenv("REDIS_MODE")))
+	addrs := SplitList(os.Getenv("REDIS_ADDRS"))
+	if (mode == "" || mode == "standalone") && len(addrs) == 0 {
+		redisURL := os.Getenv("REDIS_URL")
+		if redisURL == "" {
+			redisURL = "redis://localhost:6379"
+		}
+
+		opt, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatalf("Failed to parse Redis URL: %v", err)
+		}
+		// A rediss:// URL turns TLS on by itself.
+		if tlsConfig != nil {
+			opt.TLSConfig = tlsConfig
+		}
+		return redis.NewClient(opt)
+	}
+
+	opts := &redis.UniversalOptions{
+		Addrs:            addrs,
+		Username:         os.Getenv("REDIS_USERNAME"),
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		SentinelUsername: os.Getenv("REDIS_SENTINEL_USERNAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		TLSConfig:        tlsConfig,
+	}
+	if value := os.Getenv("REDIS_DB"); value != "" {
+		if opts.DB, err = strconv.Atoi(value); err != nil || opts.DB < 0 {
+			log.Fatalf("Invalid REDIS_DB %q", value)
+		}
+	}
+	if len(addrs) == 0 {
+		log.Fatalf("REDIS_ADDRS is required with REDIS_MODE=%s", mode)
+	}
+
+	switch mode {
+	case "", "standalone":
+		if len(addrs) > 1 {
+			log.Fatalf("REDIS_ADDRS has %d addresses; a standalone Redis has one", len(addrs))
+		}
+		log.Printf("Using Redis at %s", addrs[0])
+		return redis.NewClient(opts.Simple())
+	case "sentinel":
+		if opts.MasterName == "" {
+			log.Fatalf("REDIS_MASTER_NAME is required with REDIS_MODE=sentinel")
+		}
+		log.Printf("Using Redis master %q from sentinels %s", opts.MasterName, strings.Join(addrs, ", "))
+		return redis.NewFailoverClient(opts.Failover())
+	case "cluster":
+		if opts.DB != 0 {
+			log.Fatalf("REDIS_DB must be 0 with REDIS_MODE=cluster")
+		}
+		log.Printf("Using Redis Cluster from %s", strings.Join(addrs, ", "))
+		return redis.NewClusterClient(opts.Cluster())
+	}
+	log.Fatalf("Invalid REDIS_MODE %q; use standalone, sentinel or cluster", mode)
+	return nil
+}
+
+// redisTLSConfig is the TLS to reach Redis with, nil unless REDIS_TLS=true
+// or a certificate is given. REDIS_TLS_CA_FILE adds a CA to trust, such as
+// a managed service's private one; REDIS_TLS_CERT_FILE and
+// REDIS_TLS_KEY_FILE are a client certificate, for Redis requiring one.
+func redisTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("REDIS_TLS_CA_FILE")
+	certFile, keyFile := os.Getenv("REDIS_TLS_CERT_FILE"), os.Getenv("REDIS_TLS_KEY_FILE")
+	if os.Getenv("REDIS_TLS") != "true" && caFile == "" && certFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         os.Getenv("REDIS_TLS_SERVER_NAME"),
+		InsecureSkipVerify: os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY") == "true",
+	}
+	if config.InsecureSkipVerify {
+		log.Println("⚠️  REDIS_TLS_INSECURE_SKIP_VERIFY is set; Redis's certificate isn't checked")
+	}
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// WaitForRedis pings the client's Redis with exponential backoff, up to
+// REDIS_CONNECT_ATTEMPTS times. If Redis still isn't up the service starts
+// anyway, degraded, rather than exiting. onReady, if given, is the startup
+// work that needs Redis: it runs once Redis first answers, now or later,
+// before the service reports ready. Redis is then checked in the
+// background, so losing and regaining it is logged and reported.
+func WaitForRedis(client redis.UniversalClient, onReady func()) {
+	redisClient = client
+	attempts := defaultRedisConnectAttempts
+	if value := os.Getenv("REDIS_CONNECT_ATTEMPTS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid REDIS_CONNECT_ATTEMPTS %q", value)
+		}
+		attempts = n
+	}
+
+	delay := redisRetryBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := pingRedis()
+		if err == nil {
+			log.Println("Connected to Redis successfully")
+			if onReady != nil {
+				onReady()
+			}
+			redisUp.Store(true)
+			go monitorRedis(nil)
+			return
+		}
+		if attempt == attempts {
+			log.Printf("⚠️  Redis is unreachable after %d attempts: %v; starting degraded until it is back", attempt, err)
+			go monitorRedis(onReady)
+			return
+		}
+		log.Printf("Redis is unreachable (attempt %d of %d): %v; retrying in %s", attempt, attempts, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > redisRetryMaxDelay {
+			delay = redisRetryMaxDelay
+		}
+	}
+}
+
+func pingRedis() error {
+	pingCtx, cancel := context.WithTimeout(ctx, redisCheckTimeout)
+	defer cancel()
+	return redisClient.Ping(pingCtx).Err()
+}
+
+// monitorRedis checks Redis every redisCheckInterval. The client reconnects
+// on its own; this tracks whether it can, for readiness. onReady, if given,
+// runs the first time Redis answers.
+func monitorRedis(onReady func()) {
+	ticker := time.NewTicker(redisCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		err := pingRedis()
+		up := err == nil
+		if up && onReady != nil {
+			log.Println("Connected to Redis successfully")
+			onReady()
+			onReady = nil
+		}
+		switch was := redisUp.Swap(up); {
+		case was && !up:
+			log.Printf("⚠️  Lost connection to Redis: %v", err)
+		case !was && up:
+			log.Println("Redis is reachable again")
+		}
+	}
+}
+
+// RedisUp reports whether Redis answered the last check.
+func RedisUp() bool {
+	return redisUp.Load()
+}
+
+// RedisStatus is reported by /health as "up" or "down".
+func RedisStatus() string {
+	if redisUp.Load() {
+		return "up"
+	}
+	return "down"
+}
+
+// RequireRedis answers 503 while Redis is down, rather than letting
+// requests fail against it one by one.
+func RequireRedis() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !redisUp.Load() {
+			c.Header("Retry-After", strconv.Itoa(int(redisCheckInterval.Seconds())))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable: Redis is down"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ReadyHandler serves /ready: 200 when the service can handle requests, 503
+// while Redis is down.
+func ReadyHandler(c *gin.Context) {
+	if !redisUp.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "redis": "down"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "redis": "up"})
+}
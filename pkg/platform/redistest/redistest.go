@@ -0,0 +1,728 @@
+// Package redistest serves an in-memory fake of Redis to the services'
+// tests.
+package redistest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Server is an in-memory Redis server, enough of one for handler tests:
+// strings, hashes, sets, sorted sets, lists, transactions and publishing,
+// over RESP2. Keys don't expire. Lua isn't run: tests give Go versions of
+// the scripts they reach with Script. As a cluster, it is a single node
+// serving every slot that, like Redis Cluster, refuses commands and
+// transactions over keys in more than one slot.
+//
+// Tests may read and set keys through the maps between requests.
+type Server struct {
+	mu      sync.Mutex
+	cluster bool
+	Strings map[string]string
+	Hashes  map[string]map[string]string
+	Sets    map[string]map[string]bool
+	ZSets   map[string]map[string]float64
+	Lists   map[string][]string
+	scripts map[string]func(keys, args []string) interface{}
+	// Published counts messages by channel.
+	Published map[string]int
+	addr      *net.TCPAddr
+}
+
+// fakeStatus is a simple string reply, such as OK.
+type fakeStatus string
+
+// Start serves a Server until the test ends.
+func Start(t testing.TB) *Server {
+	return start(t, false)
+}
+
+// StartCluster serves a Server as a Redis Cluster until the test ends.
+func StartCluster(t testing.TB) *Server {
+	return start(t, true)
+}
+
+func start(t testing.TB, cluster bool) *Server {
+	t.Helper()
+	r := &Server{
+		cluster:   cluster,
+		Strings:   map[string]string{},
+		Hashes:    map[string]map[string]string{},
+		Sets:      map[string]map[string]bool{},
+		ZSets:     map[string]map[string]float64{},
+		Lists:     map[string][]string{},
+		scripts:   map[string]func(keys, args []string) interface{}{},
+		Published: map[string]int{},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	r.addr = listener.Addr().(*net.TCPAddr)
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+// Client returns a new client of the server, a cluster client if it serves
+// as a cluster.
+func (r *Server) Client() redis.UniversalClient {
+	if r.cluster {
+		return redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{r.addr.String()}})
+	}
+	return redis.NewClient(&redis.Options{Addr: r.addr.String()})
+}
+
+// Script has calls to s run fn instead, with the store locked.
+func (r *Server) Script(s *redis.Script, fn func(keys, args []string) interface{}) {
+	r.scripts[s.Hash()] = fn
+}
+
+func (r *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		switch {
+		case name == "MULTI":
+			inMulti = true
+			queued = nil
+			writeReply(writer, fakeStatus("OK"))
+		case name == "EXEC" && r.cluster && !sameSlot(queuedKeys(queued)):
+			inMulti = false
+			writeReply(writer, fmt.Errorf("CROSSSLOT Keys in request don't hash to the same slot"))
+		case name == "EXEC":
+			replies := make([]interface{}, len(queued))
+			r.mu.Lock()
+			for i, command := range queued {
+				replies[i] = r.do(command)
+			}
+			r.mu.Unlock()
+			inMulti = false
+			writeReply(writer, replies)
+		case name == "DISCARD":
+			inMulti = false
+			writeReply(writer, fakeStatus("OK"))
+		case inMulti:
+			queued = append(queued, args)
+			writeReply(writer, fakeStatus("QUEUED"))
+		default:
+			r.mu.Lock()
+			reply := r.do(args)
+			r.mu.Unlock()
+			writeReply(writer, reply)
+		}
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case fakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", reply)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", reply)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", reply)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(reply), reply)
+	case []string:
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, s := range reply {
+			writeReply(w, s)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, item := range reply {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("redistest: can't reply with %T", reply))
+	}
+}
+
+// Exists reports whether key is set.
+func (r *Server) Exists(key string) bool {
+	_, inStrings := r.Strings[key]
+	return inStrings || r.Hashes[key] != nil || r.Sets[key] != nil || r.ZSets[key] != nil || r.Lists[key] != nil
+}
+
+func (r *Server) del(key string) int {
+	if !r.Exists(key) {
+		return 0
+	}
+	delete(r.Strings, key)
+	delete(r.Hashes, key)
+	delete(r.Sets, key)
+	delete(r.ZSets, key)
+	delete(r.Lists, key)
+	return 1
+}
+
+func (r *Server) keys() []string {
+	var keys []string
+	for key := range r.Strings {
+		keys = append(keys, key)
+	}
+	for key := range r.Hashes {
+		keys = append(keys, key)
+	}
+	for key := range r.Sets {
+		keys = append(keys, key)
+	}
+	for key := range r.ZSets {
+		keys = append(keys, key)
+	}
+	for key := range r.Lists {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedMembers is a sorted set's members, lowest score first.
+func (r *Server) sortedMembers(key string) []string {
+	zset := r.ZSets[key]
+	members := make([]string, 0, len(zset))
+	for member := range zset {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if zset[members[i]] != zset[members[j]] {
+			return zset[members[i]] < zset[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// indexRange turns Redis start and stop indexes, which count back from
+// the end when negative, into a slice range of n items.
+func indexRange(start, stop string, n int) (int, int) {
+	from, _ := strconv.Atoi(start)
+	to, _ := strconv.Atoi(stop)
+	if from < 0 {
+		from += n
+	}
+	if to < 0 {
+		to += n
+	}
+	from = max(from, 0)
+	to = min(to+1, n)
+	if from >= to {
+		return 0, 0
+	}
+	return from, to
+}
+
+func parseScore(s string) float64 {
+	switch strings.TrimPrefix(s, "(") {
+	case "-inf":
+		return -1e308
+	case "+inf", "inf":
+		return 1e308
+	}
+	score, _ := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+	return score
+}
+
+// commandKeys returns the keys a command names.
+func commandKeys(args []string) []string {
+	switch strings.ToUpper(args[0]) {
+	case "PING", "CLIENT", "CLUSTER", "SELECT", "UNWATCH", "PUBLISH", "KEYS", "SCAN", "MULTI", "EXEC", "DISCARD":
+		return nil
+	case "MGET", "DEL", "UNLINK", "EXISTS", "WATCH":
+		return args[1:]
+	case "MSET":
+		var keys []string
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "EVALSHA", "EVAL":
+		n, _ := strconv.Atoi(args[2])
+		return args[3 : 3+n]
+	}
+	return args[1:min(2, len(args))]
+}
+
+func queuedKeys(commands [][]string) []string {
+	var keys []string
+	for _, command := range commands {
+		keys = append(keys, commandKeys(command)...)
+	}
+	return keys
+}
+
+// keySlot is the Redis Cluster hash slot of a key: the CRC16 of its hash
+// tag, the part in the first {}, if it has one, or else the whole key.
+func keySlot(key string) int {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int(crc) % 16384
+}
+
+func sameSlot(keys []string) bool {
+	for _, key := range keys {
+		if keySlot(key) != keySlot(keys[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeDump is what DUMP returns, for RESTORE to read back.
+type fakeDump struct {
+	Strings *string
+	Hash    map[string]string
+	Set     map[string]bool
+	ZSet    map[string]float64
+	List    []string
+}
+
+// do runs a command with the store locked.
+func (r *Server) do(args []string) interface{} {
+	if r.cluster && !sameSlot(commandKeys(args)) {
+		return fmt.Errorf("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	switch name {
+	case "CLUSTER":
+		if !r.cluster || strings.ToUpper(args[0]) != "SLOTS" {
+			return fmt.Errorf("ERR This instance has cluster support disabled")
+		}
+		node := []interface{}{r.addr.IP.String(), r.addr.Port, "fake"}
+		return []interface{}{[]interface{}{0, 16383, node}}
+	case "DUMP":
+		if !r.Exists(args[0]) {
+			return nil
+		}
+		dump := fakeDump{Hash: r.Hashes[args[0]], Set: r.Sets[args[0]], ZSet: r.ZSets[args[0]], List: r.Lists[args[0]]}
+		if value, ok := r.Strings[args[0]]; ok {
+			dump.Strings = &value
+		}
+		data, _ := json.Marshal(dump)
+		return string(data)
+	case "RESTORE":
+		if r.Exists(args[0]) {
+			return fmt.Errorf("BUSYKEY Target key name already exists.")
+		}
+		var dump fakeDump
+		json.Unmarshal([]byte(args[2]), &dump)
+		switch {
+		case dump.Strings != nil:
+			r.Strings[args[0]] = *dump.Strings
+		case dump.Hash != nil:
+			r.Hashes[args[0]] = dump.Hash
+		case dump.Set != nil:
+			r.Sets[args[0]] = dump.Set
+		case dump.ZSet != nil:
+			r.ZSets[args[0]] = dump.ZSet
+		case dump.List != nil:
+			r.Lists[args[0]] = dump.List
+		}
+		return fakeStatus("OK")
+	case "PING":
+		return fakeStatus("PONG")
+	case "CLIENT", "SELECT", "WATCH", "UNWATCH":
+		return fakeStatus("OK")
+	case "PUBLISH":
+		r.Published[args[0]]++
+		return 0
+	case "EXISTS":
+		n := 0
+		for _, key := range args {
+			if r.Exists(key) {
+				n++
+			}
+		}
+		return n
+	case "DEL", "UNLINK":
+		n := 0
+		for _, key := range args {
+			n += r.del(key)
+		}
+		return n
+	case "EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT", "PERSIST":
+		if r.Exists(args[0]) {
+			return 1
+		}
+		return 0
+	case "TTL", "PTTL":
+		if r.Exists(args[0]) {
+			return -1
+		}
+		return -2
+	case "KEYS":
+		matched := []string{}
+		for _, key := range r.keys() {
+			if ok, _ := path.Match(args[0], key); ok {
+				matched = append(matched, key)
+			}
+		}
+		return matched
+	case "SCAN":
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		matched := []string{}
+		for _, key := range r.keys() {
+			if ok, _ := path.Match(pattern, key); ok {
+				matched = append(matched, key)
+			}
+		}
+		return []interface{}{"0", matched}
+
+	case "GET":
+		if value, ok := r.Strings[args[0]]; ok {
+			return value
+		}
+		return nil
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			if value, ok := r.Strings[key]; ok {
+				values[i] = value
+			}
+		}
+		return values
+	case "SET":
+		key, value := args[0], args[1]
+		for _, option := range args[2:] {
+			switch strings.ToUpper(option) {
+			case "NX":
+				if r.Exists(key) {
+					return nil
+				}
+			case "XX":
+				if !r.Exists(key) {
+					return nil
+				}
+			}
+		}
+		r.del(key)
+		r.Strings[key] = value
+		return fakeStatus("OK")
+	case "SETNX":
+		if r.Exists(args[0]) {
+			return 0
+		}
+		r.Strings[args[0]] = args[1]
+		return 1
+	case "MSET":
+		for i := 0; i+1 < len(args); i += 2 {
+			r.del(args[i])
+			r.Strings[args[i]] = args[i+1]
+		}
+		return fakeStatus("OK")
+	case "INCR", "INCRBY", "DECR", "DECRBY":
+		by := 1
+		if len(args) > 1 {
+			by, _ = strconv.Atoi(args[1])
+		}
+		if strings.HasPrefix(name, "DECR") {
+			by = -by
+		}
+		n, _ := strconv.Atoi(r.Strings[args[0]])
+		n += by
+		r.Strings[args[0]] = strconv.Itoa(n)
+		return n
+
+	case "HGET":
+		if value, ok := r.Hashes[args[0]][args[1]]; ok {
+			return value
+		}
+		return nil
+	case "HMGET":
+		values := make([]interface{}, len(args)-1)
+		for i, field := range args[1:] {
+			if value, ok := r.Hashes[args[0]][field]; ok {
+				values[i] = value
+			}
+		}
+		return values
+	case "HSET", "HMSET", "HSETNX":
+		hash := r.Hashes[args[0]]
+		if hash == nil {
+			hash = map[string]string{}
+			r.Hashes[args[0]] = hash
+		}
+		added := 0
+		for i := 1; i+1 < len(args); i += 2 {
+			if _, ok := hash[args[i]]; ok {
+				if name == "HSETNX" {
+					continue
+				}
+			} else {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		if name == "HMSET" {
+			return fakeStatus("OK")
+		}
+		return added
+	case "HDEL":
+		n := 0
+		for _, field := range args[1:] {
+			if _, ok := r.Hashes[args[0]][field]; ok {
+				delete(r.Hashes[args[0]], field)
+				n++
+			}
+		}
+		if len(r.Hashes[args[0]]) == 0 {
+			delete(r.Hashes, args[0])
+		}
+		return n
+	case "HGETALL":
+		fields := []string{}
+		for field, value := range r.Hashes[args[0]] {
+			fields = append(fields, field, value)
+		}
+		return fields
+	case "HKEYS", "HVALS":
+		items := []string{}
+		for field, value := range r.Hashes[args[0]] {
+			if name == "HKEYS" {
+				items = append(items, field)
+			} else {
+				items = append(items, value)
+			}
+		}
+		return items
+	case "HLEN":
+		return len(r.Hashes[args[0]])
+	case "HEXISTS":
+		if _, ok := r.Hashes[args[0]][args[1]]; ok {
+			return 1
+		}
+		return 0
+	case "HINCRBY":
+		by, _ := strconv.Atoi(args[2])
+		hash := r.Hashes[args[0]]
+		if hash == nil {
+			hash = map[string]string{}
+			r.Hashes[args[0]] = hash
+		}
+		n, _ := strconv.Atoi(hash[args[1]])
+		n += by
+		hash[args[1]] = strconv.Itoa(n)
+		return n
+
+	case "SADD":
+		set := r.Sets[args[0]]
+		if set == nil {
+			set = map[string]bool{}
+			r.Sets[args[0]] = set
+		}
+		added := 0
+		for _, member := range args[1:] {
+			if !set[member] {
+				set[member] = true
+				added++
+			}
+		}
+		return added
+	case "SREM":
+		n := 0
+		for _, member := range args[1:] {
+			if r.Sets[args[0]][member] {
+				delete(r.Sets[args[0]], member)
+				n++
+			}
+		}
+		if len(r.Sets[args[0]]) == 0 {
+			delete(r.Sets, args[0])
+		}
+		return n
+	case "SMEMBERS":
+		members := []string{}
+		for member := range r.Sets[args[0]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return members
+	case "SISMEMBER":
+		if r.Sets[args[0]][args[1]] {
+			return 1
+		}
+		return 0
+	case "SCARD":
+		return len(r.Sets[args[0]])
+
+	case "ZADD":
+		zset := r.ZSets[args[0]]
+		if zset == nil {
+			zset = map[string]float64{}
+			r.ZSets[args[0]] = zset
+		}
+		i := 1
+		for i < len(args) && strings.Trim(strings.ToUpper(args[i]), "NXGTLCH") == "" {
+			i++
+		}
+		added := 0
+		for ; i+1 < len(args); i += 2 {
+			if _, ok := zset[args[i+1]]; !ok {
+				added++
+			}
+			zset[args[i+1]] = parseScore(args[i])
+		}
+		return added
+	case "ZREM":
+		n := 0
+		for _, member := range args[1:] {
+			if _, ok := r.ZSets[args[0]][member]; ok {
+				delete(r.ZSets[args[0]], member)
+				n++
+			}
+		}
+		if len(r.ZSets[args[0]]) == 0 {
+			delete(r.ZSets, args[0])
+		}
+		return n
+	case "ZCARD":
+		return len(r.ZSets[args[0]])
+	case "ZSCORE":
+		if score, ok := r.ZSets[args[0]][args[1]]; ok {
+			return strconv.FormatFloat(score, 'f', -1, 64)
+		}
+		return nil
+	case "ZRANGE", "ZREVRANGE":
+		members := r.sortedMembers(args[0])
+		if name == "ZREVRANGE" {
+			for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+				members[i], members[j] = members[j], members[i]
+			}
+		}
+		from, to := indexRange(args[1], args[2], len(members))
+		return members[from:to]
+	case "ZRANGEBYSCORE":
+		lowest, highest := parseScore(args[1]), parseScore(args[2])
+		matched := []string{}
+		for _, member := range r.sortedMembers(args[0]) {
+			if score := r.ZSets[args[0]][member]; score >= lowest && score <= highest {
+				matched = append(matched, member)
+			}
+		}
+		return matched
+
+	case "LPUSH", "RPUSH":
+		for _, value := range args[1:] {
+			if name == "LPUSH" {
+				r.Lists[args[0]] = append([]string{value}, r.Lists[args[0]]...)
+			} else {
+				r.Lists[args[0]] = append(r.Lists[args[0]], value)
+			}
+		}
+		return len(r.Lists[args[0]])
+	case "LRANGE":
+		list := r.Lists[args[0]]
+		from, to := indexRange(args[1], args[2], len(list))
+		return append([]string{}, list[from:to]...)
+	case "LLEN":
+		return len(r.Lists[args[0]])
+	case "LTRIM":
+		list := r.Lists[args[0]]
+		from, to := indexRange(args[1], args[2], len(list))
+		r.Lists[args[0]] = append([]string{}, list[from:to]...)
+		if len(r.Lists[args[0]]) == 0 {
+			delete(r.Lists, args[0])
+		}
+		return fakeStatus("OK")
+
+	case "EVALSHA", "EVAL":
+		sha := args[0]
+		if name == "EVAL" {
+			sum := sha1.Sum([]byte(args[0]))
+			sha = hex.EncodeToString(sum[:])
+		}
+		fn, ok := r.scripts[sha]
+		if !ok {
+			return fmt.Errorf("NOSCRIPT No matching script")
+		}
+		numKeys, _ := strconv.Atoi(args[1])
+		return fn(args[2:2+numKeys], args[2+numKeys:])
+	}
+	return fmt.Errorf("ERR unknown command '%s'", strings.ToLower(name))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DEVICE_ABORT_CHANNEL carries requests to abort a workflow's operation to
+// every instance of the service, as the one running it may not be the one
+// asked to abort it.
+const DEVICE_ABORT_CHANNEL = "device:abort"
+
+const OperationAborted = "aborted"
+
+// abortMarkTTL is how long an abort request is remembered, for the call
+// running the operation to tell being aborted from failing.
+const abortMarkTTL = time.Minute
+
+type AbortRequest struct {
+	WorkflowID string `json:"workflow_id" binding:"required"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+type AbortResponse struct {
+	DeviceID   string `json:"device_id"`
+	WorkflowID string `json:"workflow_id"`
+	Operation  string `json:"operation"`
+	AbortedAt  string `json:"aborted_at"`
+	AbortedBy  string `json:"aborted_by,omitempty"`
+}
+
+// abortMessage asks the instance running a workflow's operation on a device
+// to abort it.
+type abortMessage struct {
+	DeviceID   string `json:"device_id"`
+	WorkflowID string `json:"workflow_id"`
+}
+
+// The operations this instance is running, by device and workflow, to abort
+// them with.
+var (
+	runningOperations   = map[abortMessage]context.CancelFunc{}
+	runningOperationsMu sync.Mutex
+)
+
+func abortMarkKey(deviceID, workflowID string) string {
+	return deviceKey(deviceID, "aborting:"+workflowID)
+}
+
+// abortable returns a context for running a workflow's operation on the
+// device under, which an abort request cancels, and a function to call when
+// the operation ends.
+func abortable(parent context.Context, deviceID, workflowID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	key := abortMessage{DeviceID: deviceID, WorkflowID: workflowID}
+	runningOperationsMu.Lock()
+	runningOperations[key] = cancel
+	runningOperationsMu.Unlock()
+	return ctx, func() {
+		runningOperationsMu.Lock()
+		delete(runningOperations, key)
+		runningOperationsMu.Unlock()
+		cancel()
+	}
+}
+
+// wasAborted reports whether the workflow's operation on the device was
+// asked to abort, and forgets the request.
+func wasAborted(deviceID, workflowID string) bool {
+	n, err := redisClient.Del(ctx, abortMarkKey(deviceID, workflowID)).Result()
+	if err != nil {
+		log.Printf("Error checking abort of workflow %s on device %s: %v", workflowID, deviceID, err)
+	}
+	return n > 0
+}
+
+// listenForAborts aborts the operations this instance is running when asked
+// to on DEVICE_ABORT_CHANNEL.
+func listenForAborts() {
+	pubsub := redisClient.Subscribe(ctx, DEVICE_ABORT_CHANNEL)
+	defer pubsub.Close()
+	for msg := range pubsub.Channel() {
+		var abort abortMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &abort); err != nil {
+			continue
+		}
+		runningOperationsMu.Lock()
+		cancel, ok := runningOperations[abort]
+		runningOperationsMu.Unlock()
+		if ok {
+			log.Printf("Aborting operation of workflow %s on device %s", abort.WorkflowID, abort.DeviceID)
+			cancel()
+		}
+	}
+}
+
+// abortOperationHandler aborts the operation a workflow is running on the
+// device. The device is told to stop, and the call executing the operation
+// fails with 409 without putting the device in error state. The simulator
+// stops only the workflow's operation, but other drivers stop everything a
+// device runs, so on their multi-slot devices only the call is cancelled,
+// leaving the other slots' operations running.
+func abortOperationHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req AbortRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workflow_id required"})
+		return
+	}
+
+	if !holdsDevice(deviceID, req.WorkflowID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Device not booked by this workflow"})
+		return
+	}
+
+	operations, err := getProgress(deviceID)
+	if err != nil {
+		log.Printf("Error reading progress of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to abort operation"})
+		return
+	}
+	var running *OperationProgress
+	for i := range operations {
+		if operations[i].WorkflowID == req.WorkflowID {
+			running = &operations[i]
+		}
+	}
+	if running == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workflow has no operation running on the device"})
+		return
+	}
+
+	log.Printf("Aborting operation '%s' of workflow %s on device %s: %s", running.Operation, req.WorkflowID, deviceID, req.Reason)
+
+	// Mark the abort first, so the operation failing isn't taken for the
+	// device failing, then stop the device and the call waiting on it,
+	// wherever it runs.
+	if err := redisClient.Set(ctx, abortMarkKey(deviceID, req.WorkflowID), requestActor(c), abortMarkTTL).Err(); err != nil {
+		log.Printf("Error marking abort of workflow %s on device %s: %v", req.WorkflowID, deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to abort operation"})
+		return
+	}
+	if !isMultiSlot(deviceID) || isSimulated(deviceID) {
+		abortCtx, cancel := context.WithTimeout(withWorkflow(c.Request.Context(), req.WorkflowID), 5*time.Second)
+		defer cancel()
+		if err := getDriver(deviceID).Abort(abortCtx); err != nil {
+			log.Printf("Error aborting device %s: %v", deviceID, err)
+			redisClient.Del(ctx, abortMarkKey(deviceID, req.WorkflowID))
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to abort operation on the device: " + err.Error()})
+			return
+		}
+	}
+	data, _ := json.Marshal(abortMessage{DeviceID: deviceID, WorkflowID: req.WorkflowID})
+	if err := redisClient.Publish(ctx, DEVICE_ABORT_CHANNEL, data).Err(); err != nil {
+		log.Printf("Error publishing abort of workflow %s on device %s: %v", req.WorkflowID, deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to abort operation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, AbortResponse{
+		DeviceID:   deviceID,
+		WorkflowID: req.WorkflowID,
+		Operation:  running.Operation,
+		AbortedAt:  time.Now().UTC().Format(time.RFC3339),
+		AbortedBy:  requestActor(c),
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// USER_ROLE_HEADER carries the signed in user's role. Only the gateway sets
+// it, from the user's verified session.
+const (
+	USER_ROLE_HEADER = "X-User-Role"
+	adminRole        = "admin"
+)
+
+var adminToken string
+
+// isAdmin reports whether a request carries the admin token as a bearer
+// token, or was made by a user the gateway signed in as an admin.
+func isAdmin(c *gin.Context) bool {
+	if strings.TrimSpace(c.GetHeader(USER_ROLE_HEADER)) == adminRole {
+		return true
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return ok && adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// requireAdmin rejects requests that aren't from an admin. Without
+// ADMIN_TOKEN only admins signed in at the gateway are let through.
+func requireAdmin() gin.HandlerFunc {
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Println("ADMIN_TOKEN not set; admin endpoints only accept signed in admins")
+	}
+
+	return func(c *gin.Context) {
+		if !isAdmin(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin authorization required"})
+			return
+		}
+	}
+}
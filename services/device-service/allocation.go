@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// A device's booking queue is granted by its allocation policy: in the
+// order bookings queued (fifo, the default), highest priority first
+// (priority), or to the project served least recently (round_robin).
+// max_consecutive caps how many bookings in a row one project gets while
+// another project waits, whatever the allocation. Policies are kept in the
+// hash devices:booking-policies, set for a device or for every device of a
+// type, its pool; a device's own policy beats its pool's. Each device's
+// grants are tracked under device:{<id>}:allocation.
+const (
+	BOOKING_POLICIES_KEY = "devices:booking-policies"
+
+	AllocationFIFO       = "fifo"
+	AllocationPriority   = "priority"
+	AllocationRoundRobin = "round_robin"
+
+	maxBookingPriority = 100
+)
+
+// BookingPolicy decides which queued booking a device grants next. Source
+// is where the policy applying to a device was set: device:<id>, type:<type>
+// or default.
+type BookingPolicy struct {
+	Allocation     string `json:"allocation"`
+	MaxConsecutive int    `json:"max_consecutive,omitempty"`
+	Source         string `json:"source,omitempty"`
+	UpdatedAt      string `json:"updated_at,omitempty"`
+	UpdatedBy      string `json:"updated_by,omitempty"`
+}
+
+// AllocationState is who a device was granted to: the project of its last
+// bookings and how many in a row it got, and when each project was last
+// served, numbered by grant.
+type AllocationState struct {
+	LastProject string           `json:"last_project,omitempty"`
+	Streak      int              `json:"streak,omitempty"`
+	Grants      int64            `json:"grants"`
+	Served      map[string]int64 `json:"served,omitempty"`
+}
+
+func allocationKey(deviceID string) string {
+	return deviceKey(deviceID, "allocation")
+}
+
+func (p BookingPolicy) validate() error {
+	switch p.Allocation {
+	case AllocationFIFO, AllocationPriority, AllocationRoundRobin:
+	default:
+		return fmt.Errorf("allocation must be fifo, priority or round_robin")
+	}
+	if p.MaxConsecutive < 0 {
+		return fmt.Errorf("max_consecutive must not be negative")
+	}
+	return nil
+}
+
+// granted records a booking granted to the project.
+func (s *AllocationState) granted(project string) {
+	s.Grants++
+	if s.Served == nil {
+		s.Served = map[string]int64{}
+	}
+	s.Served[project] = s.Grants
+	if project == s.LastProject {
+		s.Streak++
+	} else {
+		s.LastProject, s.Streak = project, 1
+	}
+}
+
+// next returns the index of the queued booking to grant next. Bookings
+// without a project count as a project of their own, and aren't capped by
+// max_consecutive.
+func (p BookingPolicy) next(queue []QueuedBooking, state AllocationState) int {
+	candidates := make([]int, 0, len(queue))
+	capped := p.MaxConsecutive > 0 && state.LastProject != "" && state.Streak >= p.MaxConsecutive
+	for i, queued := range queue {
+		if !capped || queued.Project != state.LastProject {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		// No other project is waiting, so the cap doesn't hold it back.
+		for i := range queue {
+			candidates = append(candidates, i)
+		}
+	}
+
+	best := candidates[0]
+	for _, i := range candidates[1:] {
+		switch p.Allocation {
+		case AllocationPriority:
+			if queue[i].Priority > queue[best].Priority {
+				best = i
+			}
+		case AllocationRoundRobin:
+			if state.Served[queue[i].Project] < state.Served[queue[best].Project] {
+				best = i
+			}
+		}
+	}
+	return best
+}
+
+// order returns the queue in the order it would be granted in, if nothing
+// else queued.
+func (p BookingPolicy) order(queue []QueuedBooking, state AllocationState) []QueuedBooking {
+	waiting := append([]QueuedBooking{}, queue...)
+	state.Served = copyServed(state.Served)
+	ordered := make([]QueuedBooking, 0, len(queue))
+	for len(waiting) > 0 {
+		i := p.next(waiting, state)
+		ordered = append(ordered, waiting[i])
+		state.granted(waiting[i].Project)
+		waiting = append(waiting[:i], waiting[i+1:]...)
+	}
+	return ordered
+}
+
+func copyServed(served map[string]int64) map[string]int64 {
+	copied := make(map[string]int64, len(served))
+	for project, grant := range served {
+		copied[project] = grant
+	}
+	return copied
+}
+
+func devicePolicyField(deviceID string) string {
+	return "device:" + deviceID
+}
+
+func poolPolicyField(deviceType string) string {
+	return "type:" + deviceType
+}
+
+// getBookingPolicies returns every policy set, by device:<id> or
+// type:<type>.
+func getBookingPolicies() (map[string]BookingPolicy, error) {
+	values, err := redisClient.HGetAll(ctx, BOOKING_POLICIES_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[string]BookingPolicy, len(values))
+	for field, data := range values {
+		var policy BookingPolicy
+		if err := json.Unmarshal([]byte(data), &policy); err != nil {
+			log.Printf("Invalid booking policy %s: %v", field, err)
+			continue
+		}
+		policy.Source = field
+		policies[field] = policy
+	}
+	return policies, nil
+}
+
+// getBookingPolicy returns the policy the device grants its queue by: its
+// own, its pool's, or fifo. If the policies can't be read, it is fifo.
+func getBookingPolicy(deviceID string) BookingPolicy {
+	fifo := BookingPolicy{Allocation: AllocationFIFO, Source: "default"}
+	values, err := redisClient.HMGet(ctx, BOOKING_POLICIES_KEY, devicePolicyField(deviceID), poolPolicyField(deviceFleet()[deviceID].Type)).Result()
+	if err != nil {
+		log.Printf("Error reading booking policy of device %s: %v", deviceID, err)
+		return fifo
+	}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var policy BookingPolicy
+		if err := json.Unmarshal([]byte(data), &policy); err != nil {
+			log.Printf("Invalid booking policy for device %s: %v", deviceID, err)
+			continue
+		}
+		policy.Source = devicePolicyField(deviceID)
+		if i == 1 {
+			policy.Source = poolPolicyField(deviceFleet()[deviceID].Type)
+		}
+		return policy
+	}
+	return fifo
+}
+
+func getAllocationState(deviceID string) AllocationState {
+	var state AllocationState
+	data, err := redisClient.Get(ctx, allocationKey(deviceID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading allocation of device %s: %v", deviceID, err)
+		}
+		return state
+	}
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		log.Printf("Invalid allocation state for device %s: %v", deviceID, err)
+	}
+	return state
+}
+
+// recordAllocation counts a booking of the device granted to the project.
+func recordAllocation(deviceID, project string) {
+	state := getAllocationState(deviceID)
+	state.granted(project)
+	data, _ := json.Marshal(state)
+	if err := redisClient.Set(ctx, allocationKey(deviceID), data, 0).Err(); err != nil {
+		log.Printf("Error saving allocation of device %s: %v", deviceID, err)
+	}
+}
+
+// bookingPolicyTarget returns the policy field the request names, a device
+// or a device type, responding with 404 if there's no such device or type.
+func bookingPolicyTarget(c *gin.Context) (string, bool) {
+	if deviceID := c.Param("device_id"); deviceID != "" {
+		if _, ok := deviceFleet()[deviceID]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return "", false
+		}
+		return devicePolicyField(deviceID), true
+	}
+	deviceType := c.Param("type")
+	for _, device := range deviceFleet() {
+		if device.Type == deviceType {
+			return poolPolicyField(deviceType), true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "No devices of type " + deviceType})
+	return "", false
+}
+
+// listBookingPoliciesHandler lists the policies set, by device and type.
+func listBookingPoliciesHandler(c *gin.Context) {
+	policies, err := getBookingPolicies()
+	if err != nil {
+		log.Printf("Error getting booking policies: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve booking policies"})
+		return
+	}
+	list := make([]BookingPolicy, 0, len(policies))
+	for _, policy := range policies {
+		list = append(list, policy)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Source < list[j].Source })
+	c.JSON(http.StatusOK, list)
+}
+
+// setBookingPolicyHandler sets the policy of a device or a device type.
+func setBookingPolicyHandler(c *gin.Context) {
+	field, ok := bookingPolicyTarget(c)
+	if !ok {
+		return
+	}
+	var policy BookingPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	policy.Allocation = strings.ToLower(strings.TrimSpace(policy.Allocation))
+	if err := policy.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	policy.Source = ""
+	policy.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	policy.UpdatedBy = requestActor(c)
+	data, _ := json.Marshal(policy)
+	if err := redisClient.HSet(ctx, BOOKING_POLICIES_KEY, field, data).Err(); err != nil {
+		log.Printf("Error saving booking policy %s: %v", field, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save booking policy"})
+		return
+	}
+	policy.Source = field
+
+	log.Printf("Booking policy %s set by %q: %s, max %d consecutive", field, policy.UpdatedBy, policy.Allocation, policy.MaxConsecutive)
+	c.JSON(http.StatusOK, policy)
+}
+
+// deleteBookingPolicyHandler removes the policy of a device, which falls
+// back to its pool's, or of a device type.
+func deleteBookingPolicyHandler(c *gin.Context) {
+	field, ok := bookingPolicyTarget(c)
+	if !ok {
+		return
+	}
+	removed, err := redisClient.HDel(ctx, BOOKING_POLICIES_KEY, field).Result()
+	if err != nil {
+		log.Printf("Error deleting booking policy %s: %v", field, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete booking policy"})
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Booking policy not found"})
+		return
+	}
+	log.Printf("Booking policy %s deleted by %q", field, requestActor(c))
+	c.JSON(http.StatusOK, gin.H{"source": field, "status": "deleted"})
+}
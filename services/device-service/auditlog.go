@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// With AUDIT_LOG=true every mutating API call (POST, PUT, PATCH or DELETE)
+// is recorded in an audit log: who made it, a SHA-256 hash of the request
+// body, and the response code and latency. The log is an append-only sorted
+// set of JSON entries under audit_log:device-service, scored by time in
+// milliseconds. Calls on the gRPC API are recorded too.
+const (
+	AUDIT_SERVICE          = "device-service"
+	AUDIT_LOG_KEY          = "audit_log:" + AUDIT_SERVICE
+	AUDIT_LOG_SEQUENCE_KEY = "audit_log_sequence:" + AUDIT_SERVICE
+)
+
+const (
+	defaultAuditLogLimit = 50
+	maxAuditLogLimit     = 500
+)
+
+// USER_ID_HEADER carries the signed in user's ID, set by the gateway with
+// ACTOR_HEADER.
+const USER_ID_HEADER = "X-User-ID"
+
+var auditLogEnabled bool
+
+// AuditLogEntry is one API call in the audit log.
+type AuditLogEntry struct {
+	ID         int64   `json:"id"`
+	Service    string  `json:"service"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Query      string  `json:"query,omitempty"`
+	Actor      string  `json:"actor,omitempty"`
+	UserID     string  `json:"user_id,omitempty"`
+	Lab        string  `json:"lab,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+	BodySHA256 string  `json:"body_sha256"`
+	Status     int     `json:"status"`
+	LatencyMS  float64 `json:"latency_ms"`
+	At         string  `json:"at"`
+}
+
+type AuditLogResponse struct {
+	Count   int             `json:"count"`
+	Entries []AuditLogEntry `json:"entries"`
+}
+
+// hashingBody hashes a request body as it is read.
+type hashingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	return n, err
+}
+
+// configureAuditLog turns the audit log on with AUDIT_LOG=true.
+func configureAuditLog() {
+	auditLogEnabled = os.Getenv("AUDIT_LOG") == "true"
+	if auditLogEnabled {
+		log.Printf("Recording mutating API calls in the audit log")
+	}
+}
+
+// auditLog records mutating calls in the audit log once they are answered.
+// Calls are answered whether or not they could be recorded.
+func auditLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			c.Next()
+			return
+		}
+		if !auditLogEnabled || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		body := &hashingBody{ReadCloser: c.Request.Body, hash: sha256.New()}
+		c.Request.Body = body
+		c.Next()
+		// Whatever the handler didn't read is hashed too, so the hash is of
+		// the whole body.
+		io.Copy(io.Discard, body)
+
+		entry := AuditLogEntry{
+			Service:    AUDIT_SERVICE,
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			Query:      c.Request.URL.RawQuery,
+			Actor:      requestActor(c),
+			UserID:     strings.TrimSpace(c.GetHeader(USER_ID_HEADER)),
+			Lab:        requestLab(c),
+			RequestID:  c.GetHeader("X-Request-ID"),
+			BodySHA256: hex.EncodeToString(body.hash.Sum(nil)),
+			Status:     c.Writer.Status(),
+			LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+			At:         start.UTC().Format(time.RFC3339Nano),
+		}
+		if err := recordAuditLogEntry(entry, start); err != nil {
+			log.Printf("Error recording audit log entry for %s %s: %v", entry.Method, entry.Path, err)
+		}
+	}
+}
+
+// auditedStream hashes the messages a gRPC stream receives.
+type auditedStream struct {
+	grpc.ServerStream
+	hash hash.Hash
+}
+
+func (s *auditedStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		hashMessage(s.hash, m)
+	}
+	return err
+}
+
+// hashMessage adds a gRPC request's deterministic protobuf encoding to h.
+func hashMessage(h hash.Hash, m interface{}) {
+	if msg, ok := m.(proto.Message); ok {
+		data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		h.Write(data)
+	}
+}
+
+// auditUnaryCall and auditStreamCall record gRPC calls in the audit log,
+// with GRPC as the method, the full method name as the path and the gRPC
+// status code as the status. Every call on the gRPC API changes a device.
+func auditUnaryCall(reqCtx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !auditLogEnabled {
+		return handler(reqCtx, req)
+	}
+	start := time.Now()
+	resp, err := handler(reqCtx, req)
+	h := sha256.New()
+	hashMessage(h, req)
+	recordGRPCCall(reqCtx, info.FullMethod, h, err, start)
+	return resp, err
+}
+
+func auditStreamCall(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !auditLogEnabled {
+		return handler(srv, stream)
+	}
+	start := time.Now()
+	audited := &auditedStream{ServerStream: stream, hash: sha256.New()}
+	err := handler(srv, audited)
+	recordGRPCCall(stream.Context(), info.FullMethod, audited.hash, err, start)
+	return err
+}
+
+func recordGRPCCall(reqCtx context.Context, method string, body hash.Hash, err error, start time.Time) {
+	md, _ := metadata.FromIncomingContext(reqCtx)
+	first := func(key string) string {
+		if values := md.Get(key); len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+	entry := AuditLogEntry{
+		Service:    AUDIT_SERVICE,
+		Method:     "GRPC",
+		Path:       method,
+		Actor:      grpcActor(reqCtx),
+		UserID:     first(strings.ToLower(USER_ID_HEADER)),
+		Lab:        grpcLab(reqCtx),
+		RequestID:  first("x-request-id"),
+		BodySHA256: hex.EncodeToString(body.Sum(nil)),
+		Status:     int(status.Code(err)),
+		LatencyMS:  float64(time.Since(start).Microseconds()) / 1000,
+		At:         start.UTC().Format(time.RFC3339Nano),
+	}
+	if err := recordAuditLogEntry(entry, start); err != nil {
+		log.Printf("Error recording audit log entry for %s: %v", method, err)
+	}
+}
+
+func recordAuditLogEntry(entry AuditLogEntry, at time.Time) error {
+	id, err := redisClient.Incr(ctx, AUDIT_LOG_SEQUENCE_KEY).Result()
+	if err != nil {
+		return err
+	}
+	entry.ID = id
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return redisClient.ZAdd(ctx, AUDIT_LOG_KEY, redis.Z{Score: float64(at.UnixMilli()), Member: data}).Err()
+}
+
+// auditLogHandler returns audit log entries, newest first. Filter with
+// actor, method, path (a prefix), status, from/to (RFC 3339) and limit.
+func auditLogHandler(c *gin.Context) {
+	byScore := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	for param, bound := range map[string]*string{"from": &byScore.Min, "to": &byScore.Max} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+				return
+			}
+			*bound = strconv.FormatInt(t.UnixMilli(), 10)
+		}
+	}
+
+	limit := defaultAuditLogLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxAuditLogLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditLogLimit)})
+			return
+		}
+		limit = n
+	}
+	status := 0
+	if value := c.Query("status"); value != "" {
+		var err error
+		if status, err = strconv.Atoi(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be a response code"})
+			return
+		}
+	}
+	actor := c.Query("actor")
+	method := strings.ToUpper(c.Query("method"))
+	// Paths match with or without the /v1 prefix.
+	path := strings.TrimPrefix(c.Query("path"), "/v"+API_VERSION)
+
+	entries := []AuditLogEntry{}
+	byScore.Count = maxAuditLogLimit
+	for len(entries) < limit {
+		members, err := redisClient.ZRevRangeByScore(ctx, AUDIT_LOG_KEY, byScore).Result()
+		if err != nil {
+			log.Printf("Error reading audit log: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve audit log"})
+			return
+		}
+		for _, member := range members {
+			var entry AuditLogEntry
+			if err := json.Unmarshal([]byte(member), &entry); err != nil {
+				log.Printf("Invalid audit log entry: %v", err)
+				continue
+			}
+			if (actor != "" && entry.Actor != actor) || (method != "" && entry.Method != method) ||
+				(status != 0 && entry.Status != status) ||
+				!strings.HasPrefix(strings.TrimPrefix(entry.Path, "/v"+API_VERSION), path) {
+				continue
+			}
+			entries = append(entries, entry)
+			if len(entries) == limit {
+				break
+			}
+		}
+		if len(members) < int(byScore.Count) {
+			break
+		}
+		byScore.Offset += byScore.Count
+	}
+
+	c.JSON(http.StatusOK, AuditLogResponse{Count: len(entries), Entries: entries})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QUEUEING_FLAG is the feature flag that lets bookings of a busy device
+// wait for it rather than be refused.
+const QUEUEING_FLAG = "queueing"
+
+// QueuedBooking is a booking waiting for its device, granted in turn as
+// the device is released.
+type QueuedBooking struct {
+	WorkflowID         string `json:"workflow_id"`
+	MinFirmwareVersion string `json:"min_firmware_version,omitempty"`
+	ProtocolVersion    string `json:"protocol_version,omitempty"`
+	Project            string `json:"project,omitempty"`
+	Priority           int    `json:"priority,omitempty"`
+	Actor              string `json:"actor,omitempty"`
+	QueuedAt           string `json:"queued_at"`
+}
+
+type QueueResponse struct {
+	DeviceID   string `json:"device_id"`
+	WorkflowID string `json:"workflow_id"`
+	Status     string `json:"status"`
+	Position   int    `json:"position"`
+	QueuedAt   string `json:"queued_at"`
+}
+
+// BookingDecision tells workflow-service how a queued booking ended: the
+// booking when granted, or why it was refused.
+type BookingDecision struct {
+	DeviceID string        `json:"device_id"`
+	Granted  bool          `json:"granted"`
+	Booking  *BookResponse `json:"booking,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// errWorkflowNotWaiting is returned when the workflow stopped waiting for
+// its booking, such as by being failed, so it no longer wants the device.
+var errWorkflowNotWaiting = errors.New("workflow is no longer waiting for the device")
+
+func bookingQueueKey(deviceID string) string {
+	return deviceKey(deviceID, "booking-queue")
+}
+
+func getBookingQueue(deviceID string) ([]QueuedBooking, error) {
+	values, err := redisClient.LRange(ctx, bookingQueueKey(deviceID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	queue := []QueuedBooking{}
+	for _, value := range values {
+		var queued QueuedBooking
+		if err := json.Unmarshal([]byte(value), &queued); err != nil {
+			log.Printf("Invalid queued booking for device %s: %v", deviceID, err)
+			continue
+		}
+		queue = append(queue, queued)
+	}
+	return queue, nil
+}
+
+// queueBooking adds the booking to the end of the device's queue, unless
+// the workflow is already waiting, and returns its place in the order the
+// queue would be granted in.
+func queueBooking(deviceID string, req BookRequest, actor string) (*QueueResponse, error) {
+	queue, err := getBookingQueue(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	for _, queued := range queue {
+		if queued.WorkflowID == req.WorkflowID {
+			return &QueueResponse{DeviceID: deviceID, WorkflowID: req.WorkflowID, Status: "queued", Position: grantPosition(deviceID, queue, req.WorkflowID), QueuedAt: queued.QueuedAt}, nil
+		}
+	}
+
+	queued := QueuedBooking{
+		WorkflowID:         req.WorkflowID,
+		MinFirmwareVersion: req.MinFirmwareVersion,
+		ProtocolVersion:    req.ProtocolVersion,
+		Project:            req.Project,
+		Priority:           req.Priority,
+		Actor:              actor,
+		QueuedAt:           time.Now().UTC().Format(time.RFC3339),
+	}
+	data, _ := json.Marshal(queued)
+	if err := redisClient.RPush(ctx, bookingQueueKey(deviceID), data).Err(); err != nil {
+		return nil, err
+	}
+	position := grantPosition(deviceID, append(queue, queued), req.WorkflowID)
+	log.Printf("Workflow %s queued for device %s at position %d", req.WorkflowID, deviceID, position)
+	return &QueueResponse{DeviceID: deviceID, WorkflowID: req.WorkflowID, Status: "queued", Position: position, QueuedAt: queued.QueuedAt}, nil
+}
+
+// grantPosition is where the workflow's booking comes in the order the
+// device's policy would grant the queue in.
+func grantPosition(deviceID string, queue []QueuedBooking, workflowID string) int {
+	for i, queued := range getBookingPolicy(deviceID).order(queue, getAllocationState(deviceID)) {
+		if queued.WorkflowID == workflowID {
+			return i + 1
+		}
+	}
+	return len(queue)
+}
+
+// grantQueuedBookings books the device for the workflows waiting for it, in
+// the order its allocation policy picks them, for as long as it has room,
+// and tells workflow-service of each. A booking that is refused for a
+// reason other than the device being in use, such as its firmware, is
+// dropped.
+func grantQueuedBookings(deviceID string) {
+	for {
+		values, err := redisClient.LRange(ctx, bookingQueueKey(deviceID), 0, -1).Result()
+		if err != nil {
+			log.Printf("Error reading booking queue of device %s: %v", deviceID, err)
+			return
+		}
+		queue := make([]QueuedBooking, 0, len(values))
+		entries := make([]string, 0, len(values))
+		for _, value := range values {
+			var queued QueuedBooking
+			if err := json.Unmarshal([]byte(value), &queued); err != nil {
+				log.Printf("Invalid queued booking for device %s: %v", deviceID, err)
+				redisClient.LRem(ctx, bookingQueueKey(deviceID), 1, value)
+				continue
+			}
+			queue = append(queue, queued)
+			entries = append(entries, value)
+		}
+		if len(queue) == 0 {
+			return
+		}
+
+		next := getBookingPolicy(deviceID).next(queue, getAllocationState(deviceID))
+		queued, data := queue[next], entries[next]
+		// Taking the booking out of the queue claims it; another replica
+		// granting the queue at the same time may have got there first.
+		removed, err := redisClient.LRem(ctx, bookingQueueKey(deviceID), 1, data).Result()
+		if err != nil {
+			log.Printf("Error updating booking queue of device %s: %v", deviceID, err)
+			return
+		}
+		if removed == 0 {
+			continue
+		}
+
+		resp, devErr := bookDevice(deviceID, BookRequest{
+			WorkflowID:         queued.WorkflowID,
+			MinFirmwareVersion: queued.MinFirmwareVersion,
+			ProtocolVersion:    queued.ProtocolVersion,
+			Project:            queued.Project,
+			Priority:           queued.Priority,
+		}, queued.Actor)
+		if devErr != nil && devErr.StatusCode == http.StatusConflict {
+			// Still in use, so it waits for the next release at the front,
+			// where it is picked first again unless the policy says otherwise
+			redisClient.LPush(ctx, bookingQueueKey(deviceID), data)
+			return
+		}
+
+		decision := BookingDecision{DeviceID: deviceID, Granted: devErr == nil, Booking: resp}
+		if devErr != nil {
+			decision.Error = devErr.Message
+			log.Printf("Queued booking of device %s for workflow %s refused: %s", deviceID, queued.WorkflowID, devErr.Message)
+		}
+		lab, _ := getDeviceLab(deviceID)
+		err = notifyBookingDecision(queued.WorkflowID, lab, queued.Actor, decision)
+		switch {
+		case errors.Is(err, errWorkflowNotWaiting) && decision.Granted:
+			// Releasing the device grants it to the next in the queue.
+			log.Printf("Workflow %s no longer waits for device %s; releasing it", queued.WorkflowID, deviceID)
+			releaseDevice(deviceID, queued.WorkflowID, resp.Slot, queued.Actor)
+			return
+		case err != nil:
+			log.Printf("Error notifying workflow service about booking of %s for %s: %v", deviceID, queued.WorkflowID, err)
+		}
+	}
+}
+
+// notifyBookingDecision tells workflow-service that the workflow's queued
+// booking was granted or refused.
+func notifyBookingDecision(workflowID, lab, actor string, decision BookingDecision) error {
+	if workflowAPIURL == "" {
+		return fmt.Errorf("WORKFLOW_API_URL not set")
+	}
+
+	body, _ := json.Marshal(decision)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/workflows/%s/booking", workflowAPIURL, workflowID), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// The workflow is started by whoever queued its booking.
+	if actor != "" {
+		req.Header.Set(ACTOR_HEADER, actor)
+	}
+	if lab != "" {
+		req.Header.Set(LAB_HEADER, lab)
+	}
+	client := &http.Client{Timeout: workflowNotifyTimeout, Transport: serviceTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusNotFound:
+		return errWorkflowNotWaiting
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("workflow service returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func bookingQueueHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	queue, err := getBookingQueue(deviceID)
+	if err != nil {
+		log.Printf("Error reading booking queue of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve booking queue"})
+		return
+	}
+	// The queue is listed in the order it would be granted in.
+	policy := getBookingPolicy(deviceID)
+	c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "policy": policy, "queue": policy.order(queue, getAllocationState(deviceID))})
+}
+
+// leaveBookingQueueHandler takes a workflow out of the device's queue.
+func leaveBookingQueueHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	queue, err := getBookingQueue(deviceID)
+	if err != nil {
+		log.Printf("Error reading booking queue of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update booking queue"})
+		return
+	}
+	for _, queued := range queue {
+		if queued.WorkflowID != c.Param("workflow_id") {
+			continue
+		}
+		data, _ := json.Marshal(queued)
+		if err := redisClient.LRem(ctx, bookingQueueKey(deviceID), 1, data).Err(); err != nil {
+			log.Printf("Error updating booking queue of device %s: %v", deviceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update booking queue"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"device_id": deviceID, "workflow_id": queued.WorkflowID, "status": "dequeued"})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Workflow is not queued for the device"})
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const BOOKING_SEQUENCE_KEY = "bookings:sequence"
+
+// ACTOR_HEADER names the user making a request. Only the gateway sets it,
+// from the user's verified session, dropping any the caller sent; the
+// service isn't published outside the deployment's network, so requests
+// reach it through the gateway or another service passing the user on.
+const ACTOR_HEADER = "X-User"
+
+const (
+	BookingActionBook         = "book"
+	BookingActionRelease      = "release"
+	BookingActionForceRelease = "force_release"
+
+	BookingOutcomeGranted  = "granted"
+	BookingOutcomeReleased = "released"
+	BookingOutcomeRejected = "rejected"
+)
+
+const (
+	defaultBookingHistoryLimit = 50
+	maxBookingHistoryLimit     = 500
+)
+
+// BookingEvent is one entry in a device's append-only booking history.
+type BookingEvent struct {
+	ID         int64  `json:"id"`
+	DeviceID   string `json:"device_id"`
+	Action     string `json:"action"`
+	WorkflowID string `json:"workflow_id,omitempty"`
+	Outcome    string `json:"outcome"`
+	StatusCode int    `json:"status_code"`
+	Reason     string `json:"reason,omitempty"`
+	Actor      string `json:"actor,omitempty"`
+	At         string `json:"at"`
+}
+
+type BookingHistoryResponse struct {
+	DeviceID string         `json:"device_id"`
+	Count    int            `json:"count"`
+	Bookings []BookingEvent `json:"bookings"`
+}
+
+func bookingHistoryKey(deviceID string) string {
+	return deviceKey(deviceID, "bookings")
+}
+
+// bookedByKey maps each workflow holding the device to the user who booked
+// it for them, where known.
+func bookedByKey(deviceID string) string {
+	return deviceKey(deviceID, "booked_by")
+}
+
+// requestActor returns the user a request was made by, if known.
+func requestActor(c *gin.Context) string {
+	return strings.TrimSpace(c.GetHeader(ACTOR_HEADER))
+}
+
+// recordBookingEvent appends the outcome of a book or release call made by
+// actor to the device's booking history.
+func recordBookingEvent(deviceID, action, workflowID, actor string, devErr *DeviceError) {
+	event := BookingEvent{
+		DeviceID:   deviceID,
+		Action:     action,
+		WorkflowID: workflowID,
+		StatusCode: http.StatusOK,
+		Actor:      actor,
+	}
+	switch {
+	case devErr != nil:
+		event.Outcome = BookingOutcomeRejected
+		event.StatusCode = devErr.StatusCode
+		event.Reason = devErr.Message
+	case action == BookingActionBook:
+		event.Outcome = BookingOutcomeGranted
+	default:
+		event.Outcome = BookingOutcomeReleased
+	}
+	appendBookingEvent(event)
+}
+
+func appendBookingEvent(event BookingEvent) {
+	now := time.Now().UTC()
+	event.At = now.Format(time.RFC3339Nano)
+
+	id, err := redisClient.Incr(ctx, BOOKING_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating booking event ID: %v", err)
+		return
+	}
+	event.ID = id
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding booking event: %v", err)
+		return
+	}
+	err = redisClient.ZAdd(ctx, bookingHistoryKey(event.DeviceID), redis.Z{
+		Score:  float64(now.UnixMilli()),
+		Member: data,
+	}).Err()
+	if err != nil {
+		log.Printf("Error recording booking event for device %s: %v", event.DeviceID, err)
+	}
+}
+
+func parseHistoryTime(value string) (string, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q", value)
+	}
+	return strconv.FormatInt(t.UnixMilli(), 10), nil
+}
+
+func bookingHistoryHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	rangeBy := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if from := c.Query("from"); from != "" {
+		score, err := parseHistoryTime(from)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rangeBy.Min = score
+	}
+	if to := c.Query("to"); to != "" {
+		score, err := parseHistoryTime(to)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rangeBy.Max = score
+	}
+
+	limit := defaultBookingHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxBookingHistoryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxBookingHistoryLimit)})
+			return
+		}
+		limit = n
+	}
+
+	workflowID := c.Query("workflow_id")
+	action := c.Query("action")
+	outcome := c.Query("outcome")
+
+	members, err := redisClient.ZRevRangeByScore(ctx, bookingHistoryKey(deviceID), rangeBy).Result()
+	if err != nil {
+		log.Printf("Error reading booking history for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve booking history"})
+		return
+	}
+
+	bookings := []BookingEvent{}
+	for _, member := range members {
+		var event BookingEvent
+		if err := json.Unmarshal([]byte(member), &event); err != nil {
+			continue
+		}
+		if workflowID != "" && event.WorkflowID != workflowID {
+			continue
+		}
+		if action != "" && event.Action != action {
+			continue
+		}
+		if outcome != "" && event.Outcome != outcome {
+			continue
+		}
+		bookings = append(bookings, event)
+		if len(bookings) == limit {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, BookingHistoryResponse{
+		DeviceID: deviceID,
+		Count:    len(bookings),
+		Bookings: bookings,
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Calibration enforcement modes, set with CALIBRATION_ENFORCEMENT.
+const (
+	CalibrationEnforcementOff   = "off"
+	CalibrationEnforcementWarn  = "warn"
+	CalibrationEnforcementBlock = "block"
+)
+
+const defaultCalibrationDueWithin = 7 * 24 * time.Hour
+
+var calibrationEnforcement = CalibrationEnforcementOff
+
+// Calibration is the calibration record of a device. DueAt and Overdue are
+// computed on read.
+type Calibration struct {
+	LastCalibratedAt string `json:"last_calibrated_at,omitempty"`
+	IntervalDays     int    `json:"interval_days,omitempty"`
+	CalibratedBy     string `json:"calibrated_by,omitempty"`
+	Notes            string `json:"notes,omitempty"`
+	DueAt            string `json:"due_at,omitempty"`
+	Overdue          bool   `json:"overdue"`
+}
+
+type RecordCalibrationRequest struct {
+	CalibratedAt string `json:"calibrated_at"`
+	IntervalDays *int   `json:"interval_days"`
+	CalibratedBy string `json:"calibrated_by"`
+	Notes        string `json:"notes"`
+}
+
+type CalibrationReportEntry struct {
+	DeviceID    string      `json:"device_id"`
+	Name        string      `json:"name"`
+	Calibration Calibration `json:"calibration"`
+}
+
+type CalibrationReport struct {
+	Enforcement string                   `json:"enforcement"`
+	DueWithin   string                   `json:"due_within"`
+	Overdue     []CalibrationReportEntry `json:"overdue"`
+	DueSoon     []CalibrationReportEntry `json:"due_soon"`
+	Untracked   []string                 `json:"untracked"`
+}
+
+func calibrationKey(deviceID string) string {
+	return deviceKey(deviceID, "calibration")
+}
+
+func loadCalibrationEnforcement() {
+	switch mode := os.Getenv("CALIBRATION_ENFORCEMENT"); mode {
+	case "":
+	case CalibrationEnforcementOff, CalibrationEnforcementWarn, CalibrationEnforcementBlock:
+		calibrationEnforcement = mode
+	default:
+		log.Fatalf("Invalid CALIBRATION_ENFORCEMENT %q", mode)
+	}
+}
+
+// dueAt returns when the device next needs calibrating, or the zero time if
+// the device has no calibration schedule.
+func (cal Calibration) dueAt() time.Time {
+	if cal.LastCalibratedAt == "" || cal.IntervalDays <= 0 {
+		return time.Time{}
+	}
+	last, err := time.Parse(time.RFC3339, cal.LastCalibratedAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return last.AddDate(0, 0, cal.IntervalDays)
+}
+
+func (cal *Calibration) computeDue(now time.Time) {
+	cal.DueAt = ""
+	cal.Overdue = false
+	if due := cal.dueAt(); !due.IsZero() {
+		cal.DueAt = due.Format(time.RFC3339)
+		cal.Overdue = now.After(due)
+	}
+}
+
+func getCalibration(deviceID string) *Calibration {
+	data, err := redisClient.Get(ctx, calibrationKey(deviceID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading calibration for device %s: %v", deviceID, err)
+		}
+		return nil
+	}
+	return parseCalibration(deviceID, data)
+}
+
+func parseCalibration(deviceID, data string) *Calibration {
+	var cal Calibration
+	if err := json.Unmarshal([]byte(data), &cal); err != nil {
+		log.Printf("Invalid calibration for device %s: %v", deviceID, err)
+		return nil
+	}
+	cal.computeDue(time.Now().UTC())
+	return &cal
+}
+
+func saveCalibration(deviceID string, cal Calibration) error {
+	cal.DueAt = ""
+	cal.Overdue = false
+	data, err := json.Marshal(cal)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, calibrationKey(deviceID), data, 0).Err()
+}
+
+// checkCalibration applies the enforcement mode to a booking. It returns an
+// error if the booking must be rejected, or a warning to pass on.
+func checkCalibration(deviceID string) (*DeviceError, string) {
+	if calibrationEnforcement == CalibrationEnforcementOff {
+		return nil, ""
+	}
+
+	cal := getCalibration(deviceID)
+	if cal == nil || !cal.Overdue {
+		return nil, ""
+	}
+
+	message := fmt.Sprintf("Device calibration was due at %s", cal.DueAt)
+	if calibrationEnforcement == CalibrationEnforcementBlock {
+		log.Printf("Rejecting booking of device %s: calibration overdue since %s", deviceID, cal.DueAt)
+		return &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeCalibrationOverdue, Message: message}, ""
+	}
+	log.Printf("Booking device %s with overdue calibration (due %s)", deviceID, cal.DueAt)
+	return nil, message
+}
+
+func getCalibrationHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	cal := getCalibration(deviceID)
+	if cal == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No calibration recorded"})
+		return
+	}
+	c.JSON(http.StatusOK, cal)
+}
+
+func recordCalibrationHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req RecordCalibrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	calibratedAt := time.Now().UTC()
+	if req.CalibratedAt != "" {
+		t, err := time.Parse(time.RFC3339, req.CalibratedAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "calibrated_at must be an RFC 3339 timestamp"})
+			return
+		}
+		calibratedAt = t.UTC()
+	}
+
+	cal := Calibration{}
+	if existing := getCalibration(deviceID); existing != nil {
+		cal.IntervalDays = existing.IntervalDays
+	}
+	if req.IntervalDays != nil {
+		if *req.IntervalDays < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "interval_days must not be negative"})
+			return
+		}
+		cal.IntervalDays = *req.IntervalDays
+	}
+	cal.LastCalibratedAt = calibratedAt.Format(time.RFC3339)
+	cal.CalibratedBy = req.CalibratedBy
+	cal.Notes = req.Notes
+
+	if err := saveCalibration(deviceID, cal); err != nil {
+		log.Printf("Error saving calibration for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record calibration"})
+		return
+	}
+
+	log.Printf("Recorded calibration of device %s at %s", deviceID, cal.LastCalibratedAt)
+	cal.computeDue(time.Now().UTC())
+	c.JSON(http.StatusOK, cal)
+}
+
+func calibrationReportHandler(c *gin.Context) {
+	within := defaultCalibrationDueWithin
+	if value := c.Query("within"); value != "" {
+		d, err := parseStatsWindow(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		within = d
+	}
+
+	deviceIDs, err := labDeviceIDs(requestLab(c))
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve calibration report"})
+		return
+	}
+
+	now := time.Now().UTC()
+	report := CalibrationReport{
+		Enforcement: calibrationEnforcement,
+		DueWithin:   within.String(),
+		Overdue:     []CalibrationReportEntry{},
+		DueSoon:     []CalibrationReportEntry{},
+		Untracked:   []string{},
+	}
+	for _, deviceID := range deviceIDs {
+		cal := getCalibration(deviceID)
+		if cal == nil || cal.DueAt == "" {
+			report.Untracked = append(report.Untracked, deviceID)
+			continue
+		}
+
+		entry := CalibrationReportEntry{DeviceID: deviceID, Name: deviceFleet()[deviceID].Name, Calibration: *cal}
+		if cal.Overdue {
+			report.Overdue = append(report.Overdue, entry)
+		} else if cal.dueAt().Before(now.Add(within)) {
+			report.DueSoon = append(report.DueSoon, entry)
+		}
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Capability parameter types.
+const (
+	ParamTypeNumber  = "number"
+	ParamTypeInteger = "integer"
+	ParamTypeString  = "string"
+)
+
+// CapabilityParameter describes one parameter of an operation, enough for a
+// workflow authoring tool to render and validate a form field.
+type CapabilityParameter struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Unit        string      `json:"unit,omitempty"`
+	Required    bool        `json:"required"`
+	Min         *float64    `json:"min,omitempty"`
+	Max         *float64    `json:"max,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// Capability describes an operation devices can execute.
+type Capability struct {
+	Operation           string                `json:"operation"`
+	Description         string                `json:"description"`
+	Parameters          []CapabilityParameter `json:"parameters"`
+	TypicalDurationMs   int                   `json:"typical_duration_ms"`
+	RequiredConsumables []string              `json:"required_consumables"`
+	Devices             []string              `json:"devices"`
+}
+
+func bound(v float64) *float64 {
+	return &v
+}
+
+// CAPABILITIES is the registry of operations, keyed by operation name.
+var CAPABILITIES = map[string]Capability{
+	"aspirate": {
+		Description: "Draw liquid from a well into the tip.",
+		Parameters: []CapabilityParameter{
+			{Name: "volume", Type: ParamTypeNumber, Unit: "uL", Required: true, Min: bound(0.5), Max: bound(1000)},
+			{Name: "well", Type: ParamTypeString, Required: true, Description: "Source well, e.g. A1"},
+		},
+		TypicalDurationMs:   4000,
+		RequiredConsumables: []string{"tips"},
+	},
+	"dispense": {
+		Description: "Dispense liquid from the tip into a well.",
+		Parameters: []CapabilityParameter{
+			{Name: "volume", Type: ParamTypeNumber, Unit: "uL", Required: true, Min: bound(0.5), Max: bound(1000)},
+			{Name: "well", Type: ParamTypeString, Required: true, Description: "Destination well, e.g. B1"},
+		},
+		TypicalDurationMs:   4000,
+		RequiredConsumables: []string{"tips", "reagent"},
+	},
+	"pipette": {
+		Description: "Transfer liquid from a source well to a destination well.",
+		Parameters: []CapabilityParameter{
+			{Name: "volume", Type: ParamTypeNumber, Unit: "uL", Required: true, Min: bound(0.5), Max: bound(1000)},
+			{Name: "source", Type: ParamTypeString, Required: true},
+			{Name: "destination", Type: ParamTypeString, Required: true},
+		},
+		TypicalDurationMs:   8000,
+		RequiredConsumables: []string{"tips"},
+	},
+	"heat": {
+		Description: "Heat the chamber to a target temperature.",
+		Parameters: []CapabilityParameter{
+			{Name: "target_temperature", Type: ParamTypeNumber, Unit: "C", Required: true, Min: bound(4), Max: bound(80)},
+			{Name: "hold_seconds", Type: ParamTypeInteger, Unit: "s", Min: bound(0), Default: 0},
+		},
+		TypicalDurationMs: 120000,
+	},
+	"cool": {
+		Description: "Cool the chamber to a target temperature.",
+		Parameters: []CapabilityParameter{
+			{Name: "target_temperature", Type: ParamTypeNumber, Unit: "C", Required: true, Min: bound(4), Max: bound(80)},
+			{Name: "hold_seconds", Type: ParamTypeInteger, Unit: "s", Min: bound(0), Default: 0},
+		},
+		TypicalDurationMs: 180000,
+	},
+	"shake": {
+		Description: "Shake the loaded plate.",
+		Parameters: []CapabilityParameter{
+			{Name: "frequency", Type: ParamTypeNumber, Unit: "rpm", Required: true, Min: bound(100), Max: bound(1500)},
+			{Name: "duration", Type: ParamTypeInteger, Unit: "s", Required: true, Min: bound(1)},
+		},
+		TypicalDurationMs: 60000,
+	},
+	"absorbance": {
+		Description: "Read absorbance of every well at one wavelength.",
+		Parameters: []CapabilityParameter{
+			{Name: "wavelength", Type: ParamTypeInteger, Unit: "nm", Required: true, Min: bound(230), Max: bound(1000)},
+		},
+		TypicalDurationMs:   30000,
+		RequiredConsumables: []string{"plate_seal"},
+	},
+	"fluorescence": {
+		Description: "Read fluorescence of every well.",
+		Parameters: []CapabilityParameter{
+			{Name: "excitation", Type: ParamTypeInteger, Unit: "nm", Required: true, Min: bound(230), Max: bound(1000)},
+			{Name: "emission", Type: ParamTypeInteger, Unit: "nm", Required: true, Min: bound(230), Max: bound(1000)},
+		},
+		TypicalDurationMs:   45000,
+		RequiredConsumables: []string{"plate_seal"},
+	},
+}
+
+// capabilityDevices returns which of the devices offer each operation.
+func capabilityDevices(deviceIDs []string) map[string][]string {
+	devices := map[string][]string{}
+	for _, deviceID := range deviceIDs {
+		for _, operation := range deviceFleet()[deviceID].Capabilities {
+			devices[operation] = append(devices[operation], deviceID)
+		}
+	}
+	return devices
+}
+
+func describeCapability(operation string, devices []string) Capability {
+	capability, ok := CAPABILITIES[operation]
+	if !ok {
+		capability.Description = "No metadata registered"
+	}
+	capability.Operation = operation
+	if capability.Parameters == nil {
+		capability.Parameters = []CapabilityParameter{}
+	}
+	if capability.RequiredConsumables == nil {
+		capability.RequiredConsumables = []string{}
+	}
+	capability.Devices = devices
+	if capability.Devices == nil {
+		capability.Devices = []string{}
+	}
+	return capability
+}
+
+func listCapabilitiesHandler(c *gin.Context) {
+	deviceIDs, err := labDeviceIDs(requestLab(c))
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve capabilities"})
+		return
+	}
+	devices := capabilityDevices(deviceIDs)
+
+	operations := make([]string, 0, len(CAPABILITIES))
+	for operation := range CAPABILITIES {
+		operations = append(operations, operation)
+	}
+	// Devices may advertise operations the registry doesn't describe yet.
+	for operation := range devices {
+		if _, ok := CAPABILITIES[operation]; !ok {
+			operations = append(operations, operation)
+		}
+	}
+	sort.Strings(operations)
+
+	capabilities := make([]Capability, 0, len(operations))
+	for _, operation := range operations {
+		capabilities = append(capabilities, describeCapability(operation, devices[operation]))
+	}
+	c.JSON(http.StatusOK, capabilities)
+}
+
+func getCapabilityHandler(c *gin.Context) {
+	operation := c.Param("operation")
+	deviceIDs, err := labDeviceIDs(requestLab(c))
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve capabilities"})
+		return
+	}
+	devices := capabilityDevices(deviceIDs)
+
+	if _, ok := CAPABILITIES[operation]; !ok && devices[operation] == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Capability not found"})
+		return
+	}
+	c.JSON(http.StatusOK, describeCapability(operation, devices[operation]))
+}
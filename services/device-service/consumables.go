@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// ConsumableSpec describes a consumable a device type holds.
+type ConsumableSpec struct {
+	Unit         string  `json:"unit"`
+	Capacity     float64 `json:"capacity"`
+	LowThreshold float64 `json:"low_threshold"`
+}
+
+// ConsumableLevel is the current level of one consumable on a device.
+type ConsumableLevel struct {
+	Name         string  `json:"name"`
+	Unit         string  `json:"unit"`
+	Level        float64 `json:"level"`
+	Capacity     float64 `json:"capacity"`
+	LowThreshold float64 `json:"low_threshold"`
+	Low          bool    `json:"low"`
+}
+
+type RefillRequest struct {
+	Level *float64 `json:"level"`
+}
+
+// CONSUMABLES lists the consumables held by each device type. Levels start
+// full and are refilled through the API.
+var CONSUMABLES = map[string]map[string]ConsumableSpec{
+	"liquid_handler": {
+		"tips":    {Unit: "tips", Capacity: 384, LowThreshold: 48},
+		"reagent": {Unit: "uL", Capacity: 500000, LowThreshold: 50000},
+	},
+	"plate_reader": {
+		"plate_seal": {Unit: "seals", Capacity: 100, LowThreshold: 10},
+	},
+}
+
+// consumeScript atomically checks and decrements consumable levels. KEYS[1]
+// is the levels hash; ARGV holds name, amount and capacity triples. Missing
+// levels count as full. It returns the name of the first consumable that
+// would run out, or an empty string once everything has been consumed.
+var consumeScript = redis.NewScript(`
+local levels = {}
+for i = 1, #ARGV, 3 do
+	local level = tonumber(redis.call("HGET", KEYS[1], ARGV[i]) or ARGV[i + 2])
+	if level < tonumber(ARGV[i + 1]) then
+		return ARGV[i]
+	end
+	levels[ARGV[i]] = level - tonumber(ARGV[i + 1])
+end
+for name, level in pairs(levels) do
+	redis.call("HSET", KEYS[1], name, tostring(level))
+end
+return ""
+`)
+
+func consumablesKey(deviceID string) string {
+	return deviceKey(deviceID, "consumables")
+}
+
+func deviceConsumables(deviceID string) map[string]ConsumableSpec {
+	return CONSUMABLES[deviceFleet()[deviceID].Type]
+}
+
+func paramNumber(params map[string]interface{}, name string) float64 {
+	switch v := params[name].(type) {
+	case float64:
+		return v
+	case string:
+		n, _ := strconv.ParseFloat(v, 64)
+		return n
+	}
+	return 0
+}
+
+// consumableUsage works out how much of each consumable an operation uses:
+// one tip or seal per operation, and the dispensed volume of reagent.
+func consumableUsage(deviceID, operation string, params map[string]interface{}) map[string]float64 {
+	specs := deviceConsumables(deviceID)
+	usage := map[string]float64{}
+	for _, name := range CAPABILITIES[operation].RequiredConsumables {
+		if _, ok := specs[name]; !ok {
+			continue
+		}
+		switch name {
+		case "reagent":
+			if volume := paramNumber(params, "volume"); volume > 0 {
+				usage[name] = volume
+			}
+		default:
+			usage[name] = 1
+		}
+	}
+	return usage
+}
+
+// consumeForOperation takes the operation's consumables from the device,
+// failing without consuming anything if any of them would run out.
+func consumeForOperation(deviceID, operation string, params map[string]interface{}) *DeviceError {
+	usage := consumableUsage(deviceID, operation, params)
+	if len(usage) == 0 {
+		return nil
+	}
+
+	specs := deviceConsumables(deviceID)
+	names := make([]string, 0, len(usage))
+	for name := range usage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	args := make([]interface{}, 0, len(names)*3)
+	for _, name := range names {
+		args = append(args, name, usage[name], specs[name].Capacity)
+	}
+
+	exhausted, err := consumeScript.Run(ctx, redisClient, []string{consumablesKey(deviceID)}, args...).Text()
+	if err != nil {
+		log.Printf("Error updating consumables of device %s: %v", deviceID, err)
+		return nil
+	}
+	if exhausted != "" {
+		log.Printf("Device %s does not have enough %s for %s", deviceID, exhausted, operation)
+		return &DeviceError{
+			StatusCode: http.StatusConflict,
+			Code:       ErrorCodeConsumableExhausted,
+			Message:    fmt.Sprintf("Device is out of %s", exhausted),
+		}
+	}
+	return nil
+}
+
+// consumableLevels merges stored levels with the device type's specs.
+func consumableLevels(deviceID string, stored map[string]string) []ConsumableLevel {
+	specs := deviceConsumables(deviceID)
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	levels := make([]ConsumableLevel, 0, len(names))
+	for _, name := range names {
+		spec := specs[name]
+		level := spec.Capacity
+		if value, ok := stored[name]; ok {
+			if n, err := strconv.ParseFloat(value, 64); err == nil {
+				level = n
+			}
+		}
+		levels = append(levels, ConsumableLevel{
+			Name:         name,
+			Unit:         spec.Unit,
+			Level:        level,
+			Capacity:     spec.Capacity,
+			LowThreshold: spec.LowThreshold,
+			Low:          level <= spec.LowThreshold,
+		})
+	}
+	return levels
+}
+
+func getConsumableLevels(deviceID string) ([]ConsumableLevel, error) {
+	stored, err := redisClient.HGetAll(ctx, consumablesKey(deviceID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return consumableLevels(deviceID, stored), nil
+}
+
+func consumableWarnings(levels []ConsumableLevel) []string {
+	var warnings []string
+	for _, level := range levels {
+		if level.Low {
+			warnings = append(warnings, fmt.Sprintf("%s low: %g %s remaining", level.Name, level.Level, level.Unit))
+		}
+	}
+	return warnings
+}
+
+func listConsumablesHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	levels, err := getConsumableLevels(deviceID)
+	if err != nil {
+		log.Printf("Error reading consumables of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve consumables"})
+		return
+	}
+	c.JSON(http.StatusOK, levels)
+}
+
+func refillConsumableHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	name := c.Param("consumable")
+	spec, ok := deviceConsumables(deviceID)[name]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Consumable not found"})
+		return
+	}
+
+	var req RefillRequest
+	c.ShouldBindJSON(&req)
+
+	level := spec.Capacity
+	if req.Level != nil {
+		if *req.Level < 0 || *req.Level > spec.Capacity {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("level must be between 0 and %g", spec.Capacity)})
+			return
+		}
+		level = *req.Level
+	}
+
+	if err := redisClient.HSet(ctx, consumablesKey(deviceID), name, level).Err(); err != nil {
+		log.Printf("Error refilling %s on device %s: %v", name, deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refill consumable"})
+		return
+	}
+
+	log.Printf("Refilled %s on device %s to %g %s", name, deviceID, level, spec.Unit)
+	levels, _ := getConsumableLevels(deviceID)
+	for _, l := range levels {
+		if l.Name == name {
+			c.JSON(http.StatusOK, l)
+			return
+		}
+	}
+}
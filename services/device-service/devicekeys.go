@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Each device's keys are device:{<id>}:<name>. The braces make the ID a
+// Redis Cluster hash tag, so all of a device's keys are in one hash slot,
+// and the scripts, MGETs and transactions over several of them work on a
+// cluster of any number of shards. Keys kept by earlier versions as
+// device:<id>:<name> are moved when the service starts.
+const legacyDeviceKeyPattern = "device:*"
+
+const migrateScanCount = 1000
+
+func deviceKey(deviceID, name string) string {
+	return "device:{" + deviceID + "}:" + name
+}
+
+// legacyDeviceKey returns the key a key kept by an earlier version is now
+// kept under, if it is one.
+func legacyDeviceKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "device:")
+	if !ok || strings.HasPrefix(rest, "{") {
+		return "", false
+	}
+	deviceID, name, ok := strings.Cut(rest, ":")
+	if !ok || !deviceIDPattern.MatchString(deviceID) || name == "" {
+		return "", false
+	}
+	return deviceKey(deviceID, name), true
+}
+
+// migrateDeviceKeys moves the device keys kept by earlier versions, on
+// every shard of a cluster. A key already kept under its new name is left
+// where it is, and logged.
+func migrateDeviceKeys() error {
+	moved := 0
+	migrate := func(ctx context.Context, node redis.UniversalClient) error {
+		iter := node.Scan(ctx, 0, legacyDeviceKeyPattern, migrateScanCount).Iterator()
+		for iter.Next(ctx) {
+			to, ok := legacyDeviceKey(iter.Val())
+			if !ok {
+				continue
+			}
+			if err := moveRedisKey(ctx, iter.Val(), to); err != nil {
+				return fmt.Errorf("moving %s to %s: %w", iter.Val(), to, err)
+			}
+			moved++
+		}
+		return iter.Err()
+	}
+
+	var err error
+	if cluster, ok := redisClient.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return migrate(ctx, node)
+		})
+	} else {
+		err = migrate(ctx, redisClient)
+	}
+	if moved > 0 {
+		log.Printf("Moved %d device keys to their per-device hash slots", moved)
+	}
+	return err
+}
+
+// moveRedisKey moves a key, with its expiry, to a name that may be in
+// another hash slot, which RENAME can't do on a cluster.
+func moveRedisKey(ctx context.Context, from, to string) error {
+	dump, err := redisClient.Dump(ctx, from).Result()
+	if err == redis.Nil {
+		// Moved by another replica meanwhile.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := redisClient.PTTL(ctx, from).Result()
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	if err := redisClient.Restore(ctx, to, ttl, dump).Err(); err != nil {
+		if strings.HasPrefix(err.Error(), "BUSYKEY") {
+			log.Printf("Not moving %s: %s already exists", from, to)
+			return nil
+		}
+		return err
+	}
+	return redisClient.Del(ctx, from).Err()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeviceKeysOnCluster(t *testing.T) {
+	r := startFakeRedisCluster(t)
+	r.Script(bookScript, func(keys, args []string) interface{} {
+		status, ok := r.Strings[keys[0]]
+		if !ok {
+			status = args[0]
+		}
+		if status != "available" {
+			return []interface{}{status, 0}
+		}
+		r.Strings[keys[0]] = "busy"
+		r.Strings[keys[1]] = args[1]
+		return []interface{}{status, 1}
+	})
+	deviceStore = &redisDeviceStore{client: redisClient}
+
+	if err := redisClient.MGet(ctx, "device:a:status", "device:b:status").Err(); err == nil || !strings.HasPrefix(err.Error(), "CROSSSLOT") {
+		t.Fatalf("MGET across slots: got %v, want CROSSSLOT", err)
+	}
+
+	r.Strings["device:plate-reader-1:status"] = "busy"
+	r.Strings["device:plate-reader-1:workflow"] = "wf-old"
+	r.Strings["device:{plate-reader-1}:lab"] = "lab-a"
+	r.Strings["device:plate-reader-1:lab"] = "lab-b"
+	if err := migrateDeviceKeys(); err != nil {
+		t.Fatalf("migrateDeviceKeys: %v", err)
+	}
+	if r.Strings[deviceKey("plate-reader-1", "status")] != "busy" || r.Exists("device:plate-reader-1:status") {
+		t.Errorf("status key not moved: %v", r.Strings)
+	}
+	if r.Strings[deviceKey("plate-reader-1", "lab")] != "lab-a" || !r.Exists("device:plate-reader-1:lab") {
+		t.Errorf("existing lab key overwritten: %v", r.Strings)
+	}
+
+	if _, err := deviceStore.Book("liquid-handler-1", "wf-1"); err != nil {
+		t.Fatalf("Book: %v", err)
+	}
+	if _, err := deviceStore.Book("liquid-handler-1", "wf-2"); err != ErrDeviceUnavailable {
+		t.Fatalf("second Book: got %v, want ErrDeviceUnavailable", err)
+	}
+	if err := deviceStore.SetState("incubator-1", DeviceState{Status: "maintenance"}); err != nil {
+		t.Fatalf("SetState: %v", err)
+	}
+
+	states, err := getDeviceStates(sortedDeviceIDs())
+	if err != nil {
+		t.Fatalf("getDeviceStates: %v", err)
+	}
+	want := map[string]DeviceState{
+		"liquid-handler-1": {Status: "busy", WorkflowID: "wf-1"},
+		"incubator-1":      {Status: "maintenance"},
+		"plate-reader-1":   {Status: "busy", WorkflowID: "wf-old"},
+	}
+	for deviceID, state := range want {
+		if states[deviceID] != state {
+			t.Errorf("%s: got %+v, want %+v", deviceID, states[deviceID], state)
+		}
+	}
+
+	devices, err := loadDevices(sortedDeviceIDs())
+	if err != nil {
+		t.Fatalf("loadDevices: %v", err)
+	}
+	if len(devices) != len(deviceFleet()) {
+		t.Errorf("loadDevices: got %d devices, want %d", len(devices), len(deviceFleet()))
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DriverSimulator = "simulator"
+	DriverHTTP      = "http"
+	DriverTCP       = "tcp"
+)
+
+const defaultDriverTimeout = 30 * time.Second
+
+// DeviceDriver executes operations on a single physical or simulated device.
+type DeviceDriver interface {
+	Execute(ctx context.Context, operation string, params map[string]interface{}) (*DriverResult, error)
+	Status(ctx context.Context) (string, error)
+	Abort(ctx context.Context) error
+}
+
+// DriverResult is the outcome of a successful operation.
+type DriverResult struct {
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// DriverError is returned by drivers when the device rejects or fails an
+// operation. StatusCode is the HTTP status reported to the caller.
+type DriverError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DriverError) Error() string {
+	return e.Message
+}
+
+// DriverConfig selects and configures the driver for a device type or a
+// single device.
+type DriverConfig struct {
+	Driver    string `json:"driver"`
+	URL       string `json:"url,omitempty"`
+	Address   string `json:"address,omitempty"`
+	TimeoutMs int    `json:"timeout_ms,omitempty"`
+}
+
+// DriversConfig maps device types to drivers, with per-device overrides.
+type DriversConfig struct {
+	Types   map[string]DriverConfig `json:"types"`
+	Devices map[string]DriverConfig `json:"devices"`
+}
+
+type DriverFactory func(deviceID string, config DriverConfig) (DeviceDriver, error)
+
+var (
+	driverFactories = map[string]DriverFactory{}
+	driversConfig   DriversConfig
+	driverConfigs   = map[string]DriverConfig{}
+	drivers         = map[string]DeviceDriver{}
+	driversMu       sync.RWMutex
+)
+
+func init() {
+	registerDriver(DriverSimulator, newSimulatorDriver)
+	registerDriver(DriverHTTP, newHTTPDriver)
+	registerDriver(DriverTCP, newTCPDriver)
+}
+
+// registerDriver makes a driver implementation available to the config.
+func registerDriver(name string, factory DriverFactory) {
+	driverFactories[name] = factory
+}
+
+func (cfg DriverConfig) timeout() time.Duration {
+	if cfg.TimeoutMs > 0 {
+		return time.Duration(cfg.TimeoutMs) * time.Millisecond
+	}
+	return defaultDriverTimeout
+}
+
+// expand substitutes the device ID into URL and address templates.
+func (cfg DriverConfig) expand(deviceID string) DriverConfig {
+	cfg.URL = strings.ReplaceAll(cfg.URL, "{device_id}", deviceID)
+	cfg.Address = strings.ReplaceAll(cfg.Address, "{device_id}", deviceID)
+	return cfg
+}
+
+// initializeDrivers creates a driver for every device, using the drivers
+// config file when one is set and the simulator otherwise.
+func initializeDrivers(path string) error {
+	var config DriversConfig
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+	}
+
+	driversMu.Lock()
+	driversConfig = config
+	driversMu.Unlock()
+	return updateDrivers()
+}
+
+// updateDrivers creates drivers for devices added to the fleet, and
+// replaces those whose driver config changed with their type.
+func updateDrivers() error {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	for deviceID, device := range deviceFleet() {
+		cfg := DriverConfig{Driver: DriverSimulator}
+		if typeConfig, ok := driversConfig.Types[device.Type]; ok {
+			cfg = typeConfig
+		}
+		if deviceConfig, ok := driversConfig.Devices[deviceID]; ok {
+			cfg = deviceConfig
+		}
+		cfg = cfg.expand(deviceID)
+		if current, ok := driverConfigs[deviceID]; ok && current == cfg {
+			continue
+		}
+
+		factory, ok := driverFactories[cfg.Driver]
+		if !ok {
+			return fmt.Errorf("device %s: unknown driver %q", deviceID, cfg.Driver)
+		}
+		driver, err := factory(deviceID, cfg)
+		if err != nil {
+			return fmt.Errorf("device %s: %w", deviceID, err)
+		}
+
+		drivers[deviceID] = driver
+		driverConfigs[deviceID] = cfg
+		if cfg.Driver != DriverSimulator {
+			log.Printf("Device %s using %s driver", deviceID, cfg.Driver)
+		}
+	}
+	return nil
+}
+
+func getDriver(deviceID string) DeviceDriver {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	return drivers[deviceID]
+}
+
+// isSimulated reports whether the device runs on the simulator.
+func isSimulated(deviceID string) bool {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	return driverConfigs[deviceID].Driver == DriverSimulator
+}
+
+type driverWorkflowKey struct{}
+
+// withWorkflow names the workflow a driver runs or aborts an operation for
+// under ctx, for drivers that run several workflows' operations at once.
+func withWorkflow(ctx context.Context, workflowID string) context.Context {
+	return context.WithValue(ctx, driverWorkflowKey{}, workflowID)
+}
+
+// driverWorkflow returns the workflow ctx names, if any.
+func driverWorkflow(ctx context.Context) (string, bool) {
+	workflowID, ok := ctx.Value(driverWorkflowKey{}).(string)
+	return workflowID, ok
+}
+
+// simulatorDriver runs operations according to the device's simulation
+// profile, as many at once as a multi-slot device's workflows run.
+type simulatorDriver struct {
+	deviceID string
+
+	mu sync.Mutex
+	// cancels stop the operations running, by the workflow running them.
+	cancels map[string]context.CancelFunc
+}
+
+func newSimulatorDriver(deviceID string, _ DriverConfig) (DeviceDriver, error) {
+	return &simulatorDriver{deviceID: deviceID, cancels: map[string]context.CancelFunc{}}, nil
+}
+
+func (d *simulatorDriver) Execute(ctx context.Context, operation string, params map[string]interface{}) (*DriverResult, error) {
+	workflowID, _ := driverWorkflow(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d.mu.Lock()
+	d.cancels[workflowID] = cancel
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.cancels, workflowID)
+		d.mu.Unlock()
+	}()
+
+	result := getSimulationProfile(d.deviceID).forOperation(operation).sample()
+	// Heating and cooling last at least until the chamber reaches its
+	// target and has held it.
+	var ramp *ThermalState
+	if operation == "heat" || operation == "cool" {
+		var err error
+		if ramp, err = startRamp(d.deviceID, operation, params); err != nil {
+			return nil, err
+		}
+		hold, _ := params["hold_seconds"].(float64)
+		result.Duration = max(result.Duration, ramp.rampDuration()+time.Duration(hold*float64(time.Second)))
+	}
+	// Report progress as the operation runs, a cycle at a time, or in
+	// steps if it has too many cycles to report each.
+	cycles := simulatedCycles(params)
+	steps := min(cycles, maxProgressUpdates)
+	for step := 1; step <= steps; step++ {
+		select {
+		case <-time.After(result.Duration / time.Duration(steps)):
+		case <-ctx.Done():
+			if ramp != nil {
+				stopRamp(d.deviceID, *ramp)
+			}
+			return nil, &DriverError{StatusCode: http.StatusConflict, Message: "Operation aborted"}
+		}
+		reportProgress(ctx, cycles*step/steps, cycles)
+	}
+
+	if result.ErrorCode != 0 {
+		if ramp != nil {
+			stopRamp(d.deviceID, *ramp)
+		}
+		return nil, &DriverError{StatusCode: result.ErrorCode, Message: "Simulated device failure"}
+	}
+	data := simulatedData(operation, params)
+	// Whatever a chamber does, it reports the temperature it is at.
+	if hasChamber(d.deviceID) {
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		state := getThermalState(d.deviceID)
+		data["temperature"], _ = state.temperatureAt(time.Now())
+		data["target_temperature"] = state.TargetC
+	}
+	return &DriverResult{Data: data}, nil
+}
+
+func (d *simulatorDriver) Status(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.cancels) > 0 {
+		return "executing", nil
+	}
+	return "idle", nil
+}
+
+// Abort stops the operation of the workflow ctx names, or every operation
+// if it names none.
+func (d *simulatorDriver) Abort(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if workflowID, ok := driverWorkflow(ctx); ok {
+		if cancel, ok := d.cancels[workflowID]; ok {
+			cancel()
+		}
+		return nil
+	}
+	for _, cancel := range d.cancels {
+		cancel()
+	}
+	return nil
+}
+
+// httpDriver talks to an instrument controller exposing a small REST API:
+// POST {url}/execute, GET {url}/status and POST {url}/abort.
+type httpDriver struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPDriver(deviceID string, cfg DriverConfig) (DeviceDriver, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("http driver requires a url")
+	}
+	return &httpDriver{
+		url:    strings.TrimSuffix(cfg.URL, "/"),
+		client: &http.Client{Timeout: cfg.timeout()},
+	}, nil
+}
+
+func (d *httpDriver) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, d.url+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errorResp struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &errorResp)
+		if errorResp.Error == "" {
+			errorResp.Error = fmt.Sprintf("device controller returned %d", resp.StatusCode)
+		}
+		return &DriverError{StatusCode: resp.StatusCode, Message: errorResp.Error}
+	}
+
+	if out != nil && len(data) > 0 {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+func (d *httpDriver) Execute(ctx context.Context, operation string, params map[string]interface{}) (*DriverResult, error) {
+	var result DriverResult
+	err := d.do(ctx, http.MethodPost, "/execute", gin.H{"operation": operation, "params": params}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (d *httpDriver) Status(ctx context.Context) (string, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := d.do(ctx, http.MethodGet, "/status", nil, &status); err != nil {
+		return "", err
+	}
+	return status.Status, nil
+}
+
+func (d *httpDriver) Abort(ctx context.Context) error {
+	return d.do(ctx, http.MethodPost, "/abort", nil, nil)
+}
+
+// tcpDriver talks to a serial-over-TCP bridge using newline-delimited JSON:
+// each command is one line and is answered by one line.
+type tcpDriver struct {
+	address string
+	timeout time.Duration
+}
+
+type tcpCommand struct {
+	Command   string                 `json:"command"`
+	Operation string                 `json:"operation,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+type tcpReply struct {
+	OK     bool                   `json:"ok"`
+	Error  string                 `json:"error,omitempty"`
+	Status string                 `json:"status,omitempty"`
+	Data   map[string]interface{} `json:"data,omitempty"`
+}
+
+func newTCPDriver(deviceID string, cfg DriverConfig) (DeviceDriver, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("tcp driver requires an address")
+	}
+	return &tcpDriver{address: cfg.Address, timeout: cfg.timeout()}, nil
+}
+
+func (d *tcpDriver) send(ctx context.Context, command tcpCommand) (*tcpReply, error) {
+	dialer := net.Dialer{Timeout: d.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(d.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	// Unblock the read if the caller gives up before the bridge answers.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	line, err := json.Marshal(command)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(line, '\n')); err != nil {
+		return nil, err
+	}
+
+	response, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	var reply tcpReply
+	if err := json.Unmarshal(response, &reply); err != nil {
+		return nil, fmt.Errorf("invalid reply from bridge: %w", err)
+	}
+	if !reply.OK {
+		return nil, &DriverError{StatusCode: http.StatusBadGateway, Message: reply.Error}
+	}
+	return &reply, nil
+}
+
+func (d *tcpDriver) Execute(ctx context.Context, operation string, params map[string]interface{}) (*DriverResult, error) {
+	reply, err := d.send(ctx, tcpCommand{Command: "execute", Operation: operation, Params: params})
+	if err != nil {
+		return nil, err
+	}
+	return &DriverResult{Data: reply.Data}, nil
+}
+
+func (d *tcpDriver) Status(ctx context.Context) (string, error) {
+	reply, err := d.send(ctx, tcpCommand{Command: "status"})
+	if err != nil {
+		return "", err
+	}
+	return reply.Status, nil
+}
+
+func (d *tcpDriver) Abort(ctx context.Context) error {
+	_, err := d.send(ctx, tcpCommand{Command: "abort"})
+	return err
+}
+
+type DriverInfo struct {
+	DeviceID string `json:"device_id"`
+	Driver   string `json:"driver"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+func listDriversHandler(c *gin.Context) {
+	deviceIDs := sortedDeviceIDs()
+
+	infos := make([]DriverInfo, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		driversMu.RLock()
+		info := DriverInfo{DeviceID: deviceID, Driver: driverConfigs[deviceID].Driver}
+		driversMu.RUnlock()
+
+		statusCtx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+		status, err := getDriver(deviceID).Status(statusCtx)
+		cancel()
+		if err != nil {
+			info.Status = "unreachable"
+			info.Error = err.Error()
+		} else {
+			info.Status = status
+		}
+		infos = append(infos, info)
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSimulatorDriverAbortsOneWorkflow(t *testing.T) {
+	startFakeRedis(t)
+	profile := SimulationProfile{Default: OperationProfile{Duration: DurationProfile{Distribution: DistributionFixed, MeanMs: 1000}}}
+	if err := saveSimulationProfile("incubator-1", profile); err != nil {
+		t.Fatal(err)
+	}
+	driver, _ := newSimulatorDriver("incubator-1", DriverConfig{})
+
+	results := map[string]chan error{"wf-1": make(chan error, 1), "wf-2": make(chan error, 1)}
+	for workflowID, result := range results {
+		go func(workflowID string, result chan error) {
+			_, err := driver.Execute(withWorkflow(context.Background(), workflowID), "shake", map[string]interface{}{"cycles": 1.0})
+			result <- err
+		}(workflowID, result)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := driver.Abort(withWorkflow(context.Background(), "wf-1")); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+	select {
+	case err := <-results["wf-1"]:
+		if driverErr, ok := err.(*DriverError); !ok || driverErr.Message != "Operation aborted" {
+			t.Errorf("wf-1: got %v, want aborted", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("wf-1 wasn't aborted")
+	}
+	if status, _ := driver.Status(context.Background()); status != "executing" {
+		t.Errorf("got status %q with wf-2 running, want executing", status)
+	}
+	if err := <-results["wf-2"]; err != nil {
+		t.Errorf("wf-2: %v", err)
+	}
+	if status, _ := driver.Status(context.Background()); status != "idle" {
+		t.Errorf("got status %q, want idle", status)
+	}
+}
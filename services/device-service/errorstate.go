@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const calibrationCheckOperation = "calibration_check"
+
+// DeviceErrorState records why a device entered the "error" status.
+type DeviceErrorState struct {
+	Cause      string `json:"cause"`
+	Operation  string `json:"operation,omitempty"`
+	WorkflowID string `json:"workflow_id,omitempty"`
+	Estop      bool   `json:"estop,omitempty"`
+	OccurredAt string `json:"occurred_at"`
+}
+
+type EstopRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ResetRequest struct {
+	CalibrationCheck *bool  `json:"calibration_check"`
+	Reason           string `json:"reason"`
+}
+
+type ResetResponse struct {
+	DeviceID         string `json:"device_id"`
+	Status           string `json:"status"`
+	CalibrationCheck bool   `json:"calibration_check"`
+	ResetAt          string `json:"reset_at"`
+}
+
+func errorStateKey(deviceID string) string {
+	return deviceKey(deviceID, "error")
+}
+
+func getDeviceErrorState(deviceID string) *DeviceErrorState {
+	data, err := redisClient.Get(ctx, errorStateKey(deviceID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading error state for device %s: %v", deviceID, err)
+		}
+		return nil
+	}
+	return parseDeviceErrorState(deviceID, data)
+}
+
+func parseDeviceErrorState(deviceID, data string) *DeviceErrorState {
+	var state DeviceErrorState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		log.Printf("Invalid error state for device %s: %v", deviceID, err)
+		return nil
+	}
+	return &state
+}
+
+// setDeviceError puts the device into the "error" status, keeping any
+// workflow booking so the owner can see what happened to its device.
+func setDeviceError(deviceID string, state DeviceErrorState) {
+	state.OccurredAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("Error encoding error state for device %s: %v", deviceID, err)
+		return
+	}
+	if err := redisClient.Set(ctx, errorStateKey(deviceID), data, 0).Err(); err != nil {
+		log.Printf("Error saving error state for device %s: %v", deviceID, err)
+	}
+
+	workflowID := getDeviceWorkflow(deviceID)
+	setDeviceStatus(deviceID, "error", &workflowID)
+	log.Printf("Device %s entered error state: %s", deviceID, state.Cause)
+}
+
+// clearDeviceError returns the device to the status implied by its booking.
+func clearDeviceError(deviceID string) string {
+	redisClient.Del(ctx, errorStateKey(deviceID))
+	return restoreBookedStatus(deviceID)
+}
+
+// resetRequiresCalibrationCheck reports the configured default for resets
+// that don't say whether to run a calibration check.
+func resetRequiresCalibrationCheck() bool {
+	required, _ := strconv.ParseBool(os.Getenv("RESET_REQUIRES_CALIBRATION_CHECK"))
+	return required
+}
+
+func estopHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req EstopRequest
+	c.ShouldBindJSON(&req)
+
+	log.Printf("Emergency stop requested for device %s", deviceID)
+
+	abortCtx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Second)
+	defer cancel()
+	if err := getDriver(deviceID).Abort(abortCtx); err != nil {
+		log.Printf("Error aborting device %s during emergency stop: %v", deviceID, err)
+	}
+
+	cause := "Emergency stop"
+	if req.Reason != "" {
+		cause = fmt.Sprintf("Emergency stop: %s", req.Reason)
+	}
+	workflowID := getDeviceWorkflow(deviceID)
+	setDeviceError(deviceID, DeviceErrorState{Cause: cause, WorkflowID: workflowID, Estop: true})
+
+	c.JSON(http.StatusOK, gin.H{
+		"device_id":   deviceID,
+		"status":      "error",
+		"error_state": getDeviceErrorState(deviceID),
+	})
+}
+
+func resetDeviceHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req ResetRequest
+	c.ShouldBindJSON(&req)
+
+	if status := getDeviceStatus(deviceID); status != "error" {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Device is not in error state (status: %s)", status)})
+		return
+	}
+
+	calibrationCheck := resetRequiresCalibrationCheck()
+	if req.CalibrationCheck != nil {
+		calibrationCheck = *req.CalibrationCheck
+	}
+
+	log.Printf("Resetting device %s (calibration check: %t, reason: %q)", deviceID, calibrationCheck, req.Reason)
+
+	if calibrationCheck {
+		_, err := getDriver(deviceID).Execute(c.Request.Context(), calibrationCheckOperation, nil)
+		if err != nil {
+			log.Printf("Calibration check failed on device %s: %v", deviceID, err)
+			setDeviceError(deviceID, DeviceErrorState{
+				Cause:     fmt.Sprintf("Calibration check failed: %v", err),
+				Operation: calibrationCheckOperation,
+			})
+			c.JSON(http.StatusConflict, gin.H{
+				"error":       "Calibration check failed; device remains in error state",
+				"error_state": getDeviceErrorState(deviceID),
+			})
+			return
+		}
+	}
+
+	status := clearDeviceError(deviceID)
+
+	log.Printf("Device %s reset to %s", deviceID, status)
+	go grantQueuedBookings(deviceID)
+	c.JSON(http.StatusOK, ResetResponse{
+		DeviceID:         deviceID,
+		Status:           status,
+		CalibrationCheck: calibrationCheck,
+		ResetAt:          time.Now().UTC().Format(time.RFC3339),
+	})
+}
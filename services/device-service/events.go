@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const DEVICE_EVENTS_CHANNEL = "device:events"
+
+const eventStreamKeepAlive = 15 * time.Second
+
+// DeviceEvent describes a device status transition. Transitions into the
+// "error" status carry the error state.
+type DeviceEvent struct {
+	DeviceID       string            `json:"device_id"`
+	Status         string            `json:"status"`
+	PreviousStatus string            `json:"previous_status"`
+	WorkflowID     string            `json:"workflow_id,omitempty"`
+	Error          *DeviceErrorState `json:"error,omitempty"`
+	Lab            string            `json:"lab,omitempty"`
+	Timestamp      string            `json:"timestamp"`
+}
+
+func publishDeviceEvent(event DeviceEvent) {
+	lab, err := getDeviceLab(event.DeviceID)
+	if err != nil {
+		log.Printf("Error getting lab of device %s: %v", event.DeviceID, err)
+	}
+	event.Lab = lab
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding device event: %v", err)
+		return
+	}
+	if err := redisClient.Publish(ctx, DEVICE_EVENTS_CHANNEL, data).Err(); err != nil {
+		log.Printf("Error publishing device event for %s: %v", event.DeviceID, err)
+	}
+}
+
+// deviceEventsHandler streams the status transitions of the lab's devices,
+// as "status" events, and the progress of their operations, as "progress"
+// events, to the client as server-sent events until the client disconnects.
+func deviceEventsHandler(c *gin.Context) {
+	lab := requestLab(c)
+	pubsub := redisClient.Subscribe(c.Request.Context(), DEVICE_EVENTS_CHANNEL, DEVICE_PROGRESS_CHANNEL)
+	defer pubsub.Close()
+
+	// Wait for the subscription to be confirmed so no events are missed
+	// between the response starting and the first receive.
+	if _, err := pubsub.Receive(c.Request.Context()); err != nil {
+		log.Printf("Error subscribing to device events: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe to device events"})
+		return
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	log.Printf("Device event stream opened by %s", c.ClientIP())
+
+	messages := pubsub.Channel()
+	keepAlive := time.NewTicker(eventStreamKeepAlive)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case msg, ok := <-messages:
+			if !ok {
+				return false
+			}
+			if msg.Channel == DEVICE_PROGRESS_CHANNEL {
+				var progress OperationProgress
+				if json.Unmarshal([]byte(msg.Payload), &progress) == nil && progress.Lab == lab {
+					c.SSEvent("progress", json.RawMessage(msg.Payload))
+				}
+				return true
+			}
+			var event DeviceEvent
+			if json.Unmarshal([]byte(msg.Payload), &event) == nil && event.Lab == lab {
+				c.SSEvent("status", json.RawMessage(msg.Payload))
+			}
+			return true
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return false
+			}
+			return true
+		}
+	})
+
+	log.Printf("Device event stream closed by %s", c.ClientIP())
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	FaultTypeFail  = "fail"
+	FaultTypeDelay = "delay"
+
+	FaultActionBook    = "book"
+	FaultActionRelease = "release"
+	FaultActionExecute = "execute"
+)
+
+const FAULT_SEQUENCE_KEY = "faults:sequence"
+
+// Fault is an injected failure or delay applied to matching device requests.
+// Remaining counts how many more requests it will affect; zero means it stays
+// active until cleared.
+type Fault struct {
+	ID         string `json:"id"`
+	Type       string `json:"type"`
+	Action     string `json:"action,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	DelayMs    int    `json:"delay_ms,omitempty"`
+	Remaining  int    `json:"remaining"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type InjectFaultRequest struct {
+	Type       string `json:"type" binding:"required"`
+	Action     string `json:"action"`
+	StatusCode int    `json:"status_code"`
+	DelayMs    int    `json:"delay_ms"`
+	Count      int    `json:"count"`
+}
+
+func faultsKey(deviceID string) string {
+	return deviceKey(deviceID, "faults")
+}
+
+func (req InjectFaultRequest) validate() error {
+	switch req.Type {
+	case FaultTypeFail:
+		if req.StatusCode != 0 && (req.StatusCode < 400 || req.StatusCode > 599) {
+			return fmt.Errorf("status_code must be an HTTP error status")
+		}
+	case FaultTypeDelay:
+		if req.DelayMs <= 0 {
+			return fmt.Errorf("delay_ms must be positive")
+		}
+	default:
+		return fmt.Errorf("type must be %q or %q", FaultTypeFail, FaultTypeDelay)
+	}
+
+	switch req.Action {
+	case "", FaultActionBook, FaultActionRelease, FaultActionExecute:
+	default:
+		return fmt.Errorf("unknown action %q", req.Action)
+	}
+
+	if req.Count < 0 {
+		return fmt.Errorf("count must not be negative")
+	}
+	return nil
+}
+
+// maxFaultUpdateAttempts bounds how often an update to a device's faults
+// is retried when another request changes them first.
+const maxFaultUpdateAttempts = 10
+
+var errFaultNotFound = errors.New("fault not found")
+
+// decodeFaults reads the faults from the result of getting a device's
+// faults key.
+func decodeFaults(cmd *redis.StringCmd) ([]Fault, error) {
+	data, err := cmd.Result()
+	if err == redis.Nil {
+		return []Fault{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var faults []Fault
+	if err := json.Unmarshal([]byte(data), &faults); err != nil {
+		return nil, err
+	}
+	return faults, nil
+}
+
+func getFaults(deviceID string) ([]Fault, error) {
+	return decodeFaults(redisClient.Get(ctx, faultsKey(deviceID)))
+}
+
+// updateFaults replaces a device's faults with the result of update. The
+// faults are watched while update runs, and the update retried if another
+// request changed them, so concurrent requests don't lose each other's
+// changes or consume a fault twice.
+func updateFaults(deviceID string, update func([]Fault) ([]Fault, error)) error {
+	key := faultsKey(deviceID)
+	var err error
+	for attempt := 0; attempt < maxFaultUpdateAttempts; attempt++ {
+		err = redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			faults, err := decodeFaults(tx.Get(ctx, key))
+			if err != nil {
+				return err
+			}
+			stored := len(faults)
+			if faults, err = update(faults); err != nil {
+				return err
+			}
+			if stored == 0 && len(faults) == 0 {
+				return nil
+			}
+			data, err := json.Marshal(faults)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if len(faults) == 0 {
+					pipe.Del(ctx, key)
+				} else {
+					pipe.Set(ctx, key, data, 0)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+// applyFaults consumes the faults matching the action, sleeping for any
+// injected delays. It returns the status code of the first matching failure,
+// or zero if the request should proceed normally.
+func applyFaults(deviceID, action string) int {
+	var delay time.Duration
+	var statusCode int
+	var triggered []Fault
+	err := updateFaults(deviceID, func(faults []Fault) ([]Fault, error) {
+		delay, statusCode, triggered = 0, 0, nil
+		remaining := make([]Fault, 0, len(faults))
+		for _, fault := range faults {
+			matches := fault.Action == "" || fault.Action == action
+			if !matches || (fault.Type == FaultTypeFail && statusCode != 0) {
+				remaining = append(remaining, fault)
+				continue
+			}
+
+			switch fault.Type {
+			case FaultTypeDelay:
+				delay += time.Duration(fault.DelayMs) * time.Millisecond
+			case FaultTypeFail:
+				statusCode = fault.StatusCode
+			}
+			triggered = append(triggered, fault)
+
+			if fault.Remaining == 1 {
+				continue
+			}
+			if fault.Remaining > 1 {
+				fault.Remaining--
+			}
+			remaining = append(remaining, fault)
+		}
+		return remaining, nil
+	})
+	if err != nil {
+		log.Printf("Error applying faults for device %s: %v", deviceID, err)
+		return 0
+	}
+	for _, fault := range triggered {
+		log.Printf("Injected fault %s (%s) triggered on device %s for %s", fault.ID, fault.Type, deviceID, action)
+	}
+
+	time.Sleep(delay)
+	return statusCode
+}
+
+func listFaultsHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	faults, err := getFaults(deviceID)
+	if err != nil {
+		log.Printf("Error reading faults for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve faults"})
+		return
+	}
+
+	c.JSON(http.StatusOK, faults)
+}
+
+func injectFaultHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req InjectFaultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type is required"})
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	seq, err := redisClient.Incr(ctx, FAULT_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating fault ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to inject fault"})
+		return
+	}
+
+	fault := Fault{
+		ID:         fmt.Sprintf("fault-%d", seq),
+		Type:       req.Type,
+		Action:     req.Action,
+		StatusCode: req.StatusCode,
+		DelayMs:    req.DelayMs,
+		Remaining:  req.Count,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if fault.Type == FaultTypeFail && fault.StatusCode == 0 {
+		fault.StatusCode = http.StatusInternalServerError
+	}
+
+	err = updateFaults(deviceID, func(faults []Fault) ([]Fault, error) {
+		return append(faults, fault), nil
+	})
+	if err != nil {
+		log.Printf("Error saving faults for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to inject fault"})
+		return
+	}
+
+	log.Printf("Injected fault %s (%s) on device %s", fault.ID, fault.Type, deviceID)
+	c.JSON(http.StatusCreated, fault)
+}
+
+func clearFaultsHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	if err := redisClient.Del(ctx, faultsKey(deviceID)).Err(); err != nil {
+		log.Printf("Error clearing faults for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear faults"})
+		return
+	}
+
+	log.Printf("Cleared faults on device %s", deviceID)
+	c.Status(http.StatusNoContent)
+}
+
+func deleteFaultHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	faultID := c.Param("fault_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	err := updateFaults(deviceID, func(faults []Fault) ([]Fault, error) {
+		remaining := make([]Fault, 0, len(faults))
+		for _, fault := range faults {
+			if fault.ID != faultID {
+				remaining = append(remaining, fault)
+			}
+		}
+		if len(remaining) == len(faults) {
+			return nil, errFaultNotFound
+		}
+		return remaining, nil
+	})
+	if err == errFaultNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fault not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving faults for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete fault"})
+		return
+	}
+
+	log.Printf("Deleted fault %s on device %s", faultID, deviceID)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"platform"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The feature flags every service checks (see package platform) are
+// managed here, with the /admin/feature-flags API.
+var featureFlagNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{0,62}$`)
+
+type SetFeatureFlagRequest struct {
+	Description string   `json:"description"`
+	Enabled     bool     `json:"enabled"`
+	Labs        []string `json:"labs"`
+}
+
+func listFeatureFlagsHandler(c *gin.Context) {
+	flags, err := platform.LoadFeatureFlags(redisClient)
+	if err != nil {
+		log.Printf("Error reading feature flags: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve feature flags"})
+		return
+	}
+	list := make([]platform.FeatureFlag, 0, len(flags))
+	for _, flag := range flags {
+		list = append(list, flag)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	c.JSON(http.StatusOK, gin.H{"flags": list})
+}
+
+// setFeatureFlagHandler creates or replaces a flag.
+func setFeatureFlagHandler(c *gin.Context) {
+	name := c.Param("name")
+	if !featureFlagNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Flag names are lowercase letters, digits and underscores"})
+		return
+	}
+	var req SetFeatureFlagRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	for _, lab := range req.Labs {
+		if lab != "" && !labPattern.MatchString(lab) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid lab %q", lab)})
+			return
+		}
+	}
+
+	flag := platform.FeatureFlag{
+		Name:        name,
+		Description: strings.TrimSpace(req.Description),
+		Enabled:     req.Enabled,
+		Labs:        req.Labs,
+		UpdatedAt:   time.Now().UTC().Format(time.RFC3339),
+		UpdatedBy:   requestActor(c),
+	}
+	data, err := json.Marshal(flag)
+	if err != nil {
+		log.Printf("Error encoding feature flag %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feature flag"})
+		return
+	}
+	if err := redisClient.HSet(ctx, platform.FEATURE_FLAGS_KEY, name, data).Err(); err != nil {
+		log.Printf("Error saving feature flag %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feature flag"})
+		return
+	}
+	platform.ForgetFeatureFlags()
+
+	log.Printf("Feature flag %s set by %q: enabled %t, labs %v", name, flag.UpdatedBy, flag.Enabled, flag.Labs)
+	c.JSON(http.StatusOK, flag)
+}
+
+func deleteFeatureFlagHandler(c *gin.Context) {
+	name := c.Param("name")
+	removed, err := redisClient.HDel(ctx, platform.FEATURE_FLAGS_KEY, name).Result()
+	if err != nil {
+		log.Printf("Error deleting feature flag %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete feature flag"})
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Feature flag not found"})
+		return
+	}
+	platform.ForgetFeatureFlags()
+
+	log.Printf("Feature flag %s deleted by %q", name, requestActor(c))
+	c.JSON(http.StatusOK, gin.H{"name": name, "status": "deleted"})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// FirmwareInfo is what a device last reported about its software.
+type FirmwareInfo struct {
+	FirmwareVersion  string   `json:"firmware_version"`
+	ProtocolVersions []string `json:"protocol_versions,omitempty"`
+	ReportedAt       string   `json:"reported_at"`
+}
+
+type HeartbeatRequest struct {
+	FirmwareVersion  string   `json:"firmware_version" binding:"required"`
+	ProtocolVersions []string `json:"protocol_versions"`
+}
+
+func firmwareKey(deviceID string) string {
+	return deviceKey(deviceID, "firmware")
+}
+
+func getFirmwareInfo(deviceID string) *FirmwareInfo {
+	data, err := redisClient.Get(ctx, firmwareKey(deviceID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading firmware of device %s: %v", deviceID, err)
+		}
+		return nil
+	}
+	return parseFirmwareInfo(deviceID, data)
+}
+
+func parseFirmwareInfo(deviceID, data string) *FirmwareInfo {
+	var info FirmwareInfo
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		log.Printf("Invalid firmware info for device %s: %v", deviceID, err)
+		return nil
+	}
+	return &info
+}
+
+func saveFirmwareInfo(deviceID string, info FirmwareInfo) error {
+	info.ReportedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, firmwareKey(deviceID), data, 0).Err()
+}
+
+// compareVersions compares dotted version strings such as "2.10.1" numerically
+// component by component, ignoring a leading "v". Non-numeric components
+// compare as strings.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		xn, xErr := strconv.Atoi(x)
+		yn, yErr := strconv.Atoi(y)
+		switch {
+		case xErr == nil && yErr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xErr != nil || yErr != nil) && x != y:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+// checkFirmware rejects a booking whose firmware or protocol requirements
+// the device doesn't meet. Devices that never reported their firmware fail
+// any requirement.
+func checkFirmware(deviceID string, req BookRequest) *DeviceError {
+	if req.MinFirmwareVersion == "" && req.ProtocolVersion == "" {
+		return nil
+	}
+
+	info := getFirmwareInfo(deviceID)
+	if info == nil {
+		log.Printf("Device %s has not reported its firmware version", deviceID)
+		return &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeFirmwareUnknown, Message: "Device firmware version is unknown"}
+	}
+
+	if req.MinFirmwareVersion != "" && compareVersions(info.FirmwareVersion, req.MinFirmwareVersion) < 0 {
+		log.Printf("Device %s firmware %s is older than required %s", deviceID, info.FirmwareVersion, req.MinFirmwareVersion)
+		return &DeviceError{
+			StatusCode: http.StatusConflict,
+			Code:       ErrorCodeFirmwareOutdated,
+			Message:    fmt.Sprintf("Device firmware %s is older than required %s", info.FirmwareVersion, req.MinFirmwareVersion),
+		}
+	}
+
+	if req.ProtocolVersion != "" {
+		for _, version := range info.ProtocolVersions {
+			if version == req.ProtocolVersion {
+				return nil
+			}
+		}
+		log.Printf("Device %s does not support protocol %s", deviceID, req.ProtocolVersion)
+		return &DeviceError{
+			StatusCode: http.StatusConflict,
+			Code:       ErrorCodeProtocolUnsupported,
+			Message:    fmt.Sprintf("Device does not support protocol version %s", req.ProtocolVersion),
+		}
+	}
+	return nil
+}
+
+// heartbeatHandler lets a device register or refresh its firmware and
+// supported protocol versions.
+func heartbeatHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req HeartbeatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "firmware_version required"})
+		return
+	}
+
+	previous := getFirmwareInfo(deviceID)
+	info := FirmwareInfo{FirmwareVersion: req.FirmwareVersion, ProtocolVersions: req.ProtocolVersions}
+	if err := saveFirmwareInfo(deviceID, info); err != nil {
+		log.Printf("Error saving firmware of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record heartbeat"})
+		return
+	}
+	if previous == nil || previous.FirmwareVersion != req.FirmwareVersion {
+		log.Printf("Device %s reported firmware %s", deviceID, req.FirmwareVersion)
+	}
+
+	c.JSON(http.StatusOK, getFirmwareInfo(deviceID))
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"platform"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// DEVICE_FLEET_KEY is a hash of the devices the service manages, by ID,
+// shared by every replica. It is seeded at startup from the fleet
+// definition in DEVICES_CONFIG_FILE (YAML or JSON), or with the simulated
+// defaultDevices if there is none and the fleet is empty, and added to with
+// POST /admin/devices/import. Devices are never removed from it; deleting
+// a device moves it to the trash instead.
+const DEVICE_FLEET_KEY = "devices:fleet"
+
+// fleetRefresh is how often the fleet is read again, so devices imported
+// through another replica are picked up.
+const fleetRefresh = 10 * time.Second
+
+var (
+	deviceIDPattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+	deviceTypePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_]{0,62}$`)
+)
+
+// fleet is the devices the service manages. It is replaced, never changed,
+// when the fleet is read again, so callers can range over it freely.
+var (
+	fleetMu sync.RWMutex
+	fleet   = defaultDevices
+)
+
+// fleetConfig is the fleet definition read from DEVICES_CONFIG_FILE.
+var fleetConfig *FleetDefinition
+
+// DeviceDefinition registers a device, or updates its name, type,
+// capabilities and capacity. The lab, tags and metadata are only given to
+// devices being registered; change them later with PATCH /devices/<id>.
+type DeviceDefinition struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	Capabilities []string          `json:"capabilities"`
+	Capacity     int               `json:"capacity,omitempty"`
+	Lab          string            `json:"lab,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// FleetDefinition is a devices config file, or an import request.
+type FleetDefinition struct {
+	Devices []DeviceDefinition `json:"devices"`
+}
+
+type FleetImportReport struct {
+	DryRun     bool     `json:"dry_run"`
+	Registered []string `json:"registered"`
+	Updated    []string `json:"updated"`
+	Unchanged  []string `json:"unchanged"`
+	// Skipped are deleted devices, which only restoring brings back.
+	Skipped []string `json:"skipped"`
+}
+
+// deviceFleet returns the devices the service manages, by ID.
+func deviceFleet() map[string]Device {
+	fleetMu.RLock()
+	defer fleetMu.RUnlock()
+	return fleet
+}
+
+func setDeviceFleet(devices map[string]Device) {
+	fleetMu.Lock()
+	fleet = devices
+	fleetMu.Unlock()
+}
+
+// device returns the fleet's record for the definition.
+func (d DeviceDefinition) device() Device {
+	return Device{
+		ID:           d.ID,
+		Name:         d.Name,
+		Type:         d.Type,
+		Status:       "available",
+		Capabilities: d.Capabilities,
+		Capacity:     d.Capacity,
+	}
+}
+
+func (d DeviceDefinition) validate() error {
+	if !deviceIDPattern.MatchString(d.ID) {
+		return fmt.Errorf("id must be lowercase letters, digits, dashes and underscores")
+	}
+	if strings.TrimSpace(d.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !deviceTypePattern.MatchString(d.Type) {
+		return fmt.Errorf("type must be lowercase letters, digits and underscores")
+	}
+	if len(d.Capabilities) == 0 {
+		return fmt.Errorf("capabilities are required")
+	}
+	for _, operation := range d.Capabilities {
+		if _, ok := CAPABILITIES[operation]; !ok {
+			return fmt.Errorf("unknown capability %q", operation)
+		}
+	}
+	if d.Capacity < 0 {
+		return fmt.Errorf("capacity must not be negative")
+	}
+	if d.Lab != "" && !labPattern.MatchString(d.Lab) {
+		return fmt.Errorf("lab must be lowercase letters, digits and dashes")
+	}
+	return nil
+}
+
+// parseFleetDefinition reads a fleet definition, as YAML if yamlFormat is
+// set and JSON otherwise, and checks every device in it.
+func parseFleetDefinition(data []byte, yamlFormat bool) (*FleetDefinition, error) {
+	if yamlFormat {
+		// Decode YAML generically and read it as JSON, so the JSON field
+		// names and checks apply to both.
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	var definition FleetDefinition
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&definition); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(definition.Devices))
+	for i, device := range definition.Devices {
+		if err := device.validate(); err != nil {
+			return nil, fmt.Errorf("device %d (%s): %w", i, device.ID, err)
+		}
+		if seen[device.ID] {
+			return nil, fmt.Errorf("device %s is defined more than once", device.ID)
+		}
+		seen[device.ID] = true
+		definition.Devices[i].Tags = normalizeTags(device.Tags)
+	}
+	return &definition, nil
+}
+
+// loadFleetConfig reads the fleet definition in DEVICES_CONFIG_FILE, if
+// set. Its devices make up the fleet until Redis is reached.
+func loadFleetConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(path[strings.LastIndex(path, ".")+1:])
+	definition, err := parseFleetDefinition(data, ext == "yaml" || ext == "yml")
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	devices := make(map[string]Device, len(definition.Devices))
+	for _, device := range definition.Devices {
+		devices[device.ID] = device.device()
+	}
+	setDeviceFleet(devices)
+	fleetConfig = definition
+	log.Printf("Loaded %d device(s) from %s", len(definition.Devices), path)
+	return nil
+}
+
+// getStoredFleet returns the devices in DEVICE_FLEET_KEY, by ID.
+func getStoredFleet() (map[string]Device, error) {
+	values, err := redisClient.HGetAll(ctx, DEVICE_FLEET_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]Device, len(values))
+	for deviceID, value := range values {
+		var device Device
+		if err := json.Unmarshal([]byte(value), &device); err != nil {
+			log.Printf("Invalid fleet entry for device %s: %v", deviceID, err)
+			continue
+		}
+		devices[deviceID] = device
+	}
+	return devices, nil
+}
+
+// reloadFleet reads the fleet again from Redis, and creates drivers for
+// devices new to it. An empty fleet leaves the current one in place.
+func reloadFleet() error {
+	devices, err := getStoredFleet()
+	if err != nil || len(devices) == 0 {
+		return err
+	}
+	setDeviceFleet(devices)
+	return updateDrivers()
+}
+
+// initializeFleet seeds the fleet in Redis, with the devices config if one
+// was given, or else the default devices if the fleet is empty, and reads
+// it.
+func initializeFleet() {
+	if fleetConfig != nil {
+		report, err := importDevices(fleetConfig.Devices, false)
+		if err != nil {
+			log.Printf("Error importing devices config: %v", err)
+		} else {
+			log.Printf("Devices config: %d registered, %d updated, %d skipped as deleted",
+				len(report.Registered), len(report.Updated), len(report.Skipped))
+		}
+	} else if n, err := redisClient.HLen(ctx, DEVICE_FLEET_KEY).Result(); err == nil && n == 0 {
+		_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, device := range defaultDevices {
+				if err := saveFleetDevice(pipe, device); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error saving default devices: %v", err)
+		}
+	}
+
+	devices, err := getStoredFleet()
+	if err != nil {
+		log.Printf("Error reading device fleet: %v", err)
+		return
+	}
+	if len(devices) > 0 {
+		setDeviceFleet(devices)
+	}
+}
+
+// refreshFleet reads the fleet again every fleetRefresh while Redis is up.
+func refreshFleet() {
+	ticker := time.NewTicker(fleetRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !platform.RedisUp() {
+			continue
+		}
+		if err := reloadFleet(); err != nil {
+			log.Printf("Error refreshing device fleet: %v", err)
+		}
+	}
+}
+
+func saveFleetDevice(cmd redis.Cmdable, device Device) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	return cmd.HSet(ctx, DEVICE_FLEET_KEY, device.ID, data).Err()
+}
+
+// FleetImportError is an import refused for one of its devices.
+type FleetImportError struct {
+	DeviceID string
+	Message  string
+}
+
+func (e *FleetImportError) Error() string {
+	return fmt.Sprintf("device %s: %s", e.DeviceID, e.Message)
+}
+
+// importDevices registers the devices not yet in the fleet and updates the
+// others, unless dryRun is set. Deleted devices are skipped. A device in
+// use can't change type or capacity; if one would, nothing is imported.
+func importDevices(definitions []DeviceDefinition, dryRun bool) (*FleetImportReport, error) {
+	stored, err := getStoredFleet()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := getDeletedDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FleetImportReport{DryRun: dryRun, Registered: []string{}, Updated: []string{}, Unchanged: []string{}, Skipped: []string{}}
+	var registered, updated []DeviceDefinition
+	for _, definition := range definitions {
+		existing, ok := stored[definition.ID]
+		switch {
+		case isDeleted(deleted, definition.ID):
+			report.Skipped = append(report.Skipped, definition.ID)
+		case !ok:
+			registered = append(registered, definition)
+			report.Registered = append(report.Registered, definition.ID)
+		case reflect.DeepEqual(existing, definition.device()):
+			report.Unchanged = append(report.Unchanged, definition.ID)
+		default:
+			if existing.Type != definition.Type || existing.Capacity != definition.Capacity {
+				current, err := loadDevice(definition.ID)
+				if err != nil {
+					return nil, err
+				}
+				if deviceInUse(current) {
+					return nil, &FleetImportError{DeviceID: definition.ID, Message: "is in use, so its type and capacity can't change"}
+				}
+			}
+			updated = append(updated, definition)
+			report.Updated = append(report.Updated, definition.ID)
+		}
+	}
+	if dryRun || len(registered)+len(updated) == 0 {
+		return report, nil
+	}
+
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, definition := range append(registered, updated...) {
+			if err := saveFleetDevice(pipe, definition.device()); err != nil {
+				return err
+			}
+		}
+		for _, definition := range registered {
+			if definition.Lab != "" {
+				pipe.Set(ctx, deviceLabKey(definition.ID), definition.Lab, 0)
+			}
+			if len(definition.Tags) > 0 || len(definition.Metadata) > 0 {
+				meta, err := json.Marshal(DeviceMetadata{Tags: definition.Tags, Metadata: definition.Metadata})
+				if err != nil {
+					return err
+				}
+				pipe.Set(ctx, metadataKey(definition.ID), meta, 0)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := reloadFleet(); err != nil {
+		log.Printf("Error reloading device fleet: %v", err)
+	}
+	if len(report.Registered) > 0 {
+		deviceLabs.invalidate(report.Registered...)
+	}
+	publishCacheInvalidation(cacheInvalidation{Cache: FLEET_CACHE})
+	initializeDevices()
+	return report, nil
+}
+
+func isDeleted(deleted map[string]DeletedDevice, deviceID string) bool {
+	_, ok := deleted[deviceID]
+	return ok
+}
+
+// deviceInUse reports whether a workflow holds the device, or any of its
+// slots.
+func deviceInUse(device Device) bool {
+	if device.WorkflowID != "" {
+		return true
+	}
+	for _, slot := range device.Slots {
+		if slot.WorkflowID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// importDevicesHandler registers or updates many devices at once from a
+// fleet definition, sent as JSON or, with a YAML content type, as YAML.
+func importDevicesHandler(c *gin.Context) {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	contentType := c.ContentType()
+	definition, err := parseFleetDefinition(data, strings.Contains(contentType, "yaml"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := importDevices(definition.Devices, c.Query("dry_run") == "true")
+	var importErr *FleetImportError
+	if errors.As(err, &importErr) {
+		c.JSON(http.StatusConflict, gin.H{"error": importErr.Error(), "device_id": importErr.DeviceID})
+		return
+	}
+	if err != nil {
+		log.Printf("Error importing devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to import devices"})
+		return
+	}
+
+	if !report.DryRun {
+		log.Printf("Imported devices: %d registered, %d updated, %d unchanged, %d skipped (by %s)",
+			len(report.Registered), len(report.Updated), len(report.Unchanged), len(report.Skipped), requestActor(c))
+	}
+	c.JSON(http.StatusOK, report)
+}
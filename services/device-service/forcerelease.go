@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const workflowNotifyTimeout = 5 * time.Second
+
+type ForceReleaseRequest struct {
+	Operator string `json:"operator" binding:"required"`
+	Reason   string `json:"reason" binding:"required"`
+}
+
+// WorkflowNotification reports whether an orphaned workflow was marked failed.
+type WorkflowNotification struct {
+	WorkflowID string `json:"workflow_id"`
+	Notified   bool   `json:"notified"`
+	Error      string `json:"error,omitempty"`
+}
+
+type ForceReleaseResponse struct {
+	DeviceID   string                 `json:"device_id"`
+	Status     string                 `json:"status"`
+	Released   []string               `json:"released_workflows"`
+	Operator   string                 `json:"operator"`
+	Reason     string                 `json:"reason"`
+	ReleasedAt string                 `json:"released_at"`
+	Workflows  []WorkflowNotification `json:"workflows"`
+}
+
+var workflowAPIURL = os.Getenv("WORKFLOW_API_URL")
+
+// bookedWorkflows returns every workflow currently holding the device.
+func bookedWorkflows(deviceID string) ([]string, error) {
+	if isMultiSlot(deviceID) {
+		holders, err := getSlotHolders(deviceID)
+		if err != nil {
+			return nil, err
+		}
+		workflows := []string{}
+		for _, slot := range sortedSlots(holders) {
+			workflows = append(workflows, holders[slot])
+		}
+		return workflows, nil
+	}
+
+	workflowID := getDeviceWorkflow(deviceID)
+	if workflowID == "" {
+		return []string{}, nil
+	}
+	return []string{workflowID}, nil
+}
+
+// notifyWorkflowFailed asks workflow-service to mark the workflow failed.
+func notifyWorkflowFailed(workflowID, lab, reason, operator string) error {
+	if workflowAPIURL == "" {
+		return fmt.Errorf("WORKFLOW_API_URL not set")
+	}
+
+	body, _ := json.Marshal(gin.H{"reason": reason})
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/workflows/%s/fail", workflowAPIURL, workflowID), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// The workflow is failed by the operator who released its device.
+	req.Header.Set(ACTOR_HEADER, operator)
+	// The workflow is in the device's lab.
+	if lab != "" {
+		req.Header.Set(LAB_HEADER, lab)
+	}
+	client := &http.Client{Timeout: workflowNotifyTimeout, Transport: serviceTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("workflow service returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// forceReleaseHandler frees a device regardless of which workflows hold it,
+// bypassing injected faults. The release is recorded in the booking history
+// with the operator and reason, and the orphaned workflows are failed.
+func forceReleaseHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req ForceReleaseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "operator and reason required"})
+		return
+	}
+
+	workflows, err := bookedWorkflows(deviceID)
+	var lab string
+	if err == nil {
+		lab, err = getDeviceLab(deviceID)
+	}
+	if err != nil {
+		log.Printf("Error reading bookings of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release device"})
+		return
+	}
+	if len(workflows) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Device is not booked"})
+		return
+	}
+
+	log.Printf("Force-releasing device %s from %s by %s: %s", deviceID, strings.Join(workflows, ","), req.Operator, req.Reason)
+
+	if isMultiSlot(deviceID) {
+		redisClient.Del(ctx, slotsKey(deviceID))
+	}
+	redisClient.Del(ctx, bookedByKey(deviceID))
+	status := getDeviceStatus(deviceID)
+	if status != "error" && status != "offline" {
+		status = "available"
+	}
+	setDeviceStatus(deviceID, status, nil)
+	now := time.Now().UTC()
+	recordRelease(deviceID, strings.Join(workflows, ","), now)
+	go grantQueuedBookings(deviceID)
+
+	reason := fmt.Sprintf("Device %s force-released by %s: %s", deviceID, req.Operator, req.Reason)
+	resp := ForceReleaseResponse{
+		DeviceID:   deviceID,
+		Status:     status,
+		Released:   workflows,
+		Operator:   req.Operator,
+		Reason:     req.Reason,
+		ReleasedAt: now.Format(time.RFC3339),
+		Workflows:  []WorkflowNotification{},
+	}
+	for _, workflowID := range workflows {
+		appendBookingEvent(BookingEvent{
+			DeviceID:   deviceID,
+			Action:     BookingActionForceRelease,
+			WorkflowID: workflowID,
+			Outcome:    BookingOutcomeReleased,
+			StatusCode: http.StatusOK,
+			Reason:     req.Reason,
+			Actor:      req.Operator,
+		})
+
+		notification := WorkflowNotification{WorkflowID: workflowID, Notified: true}
+		if err := notifyWorkflowFailed(workflowID, lab, reason, req.Operator); err != nil {
+			log.Printf("Error notifying workflow service about %s: %v", workflowID, err)
+			notification.Notified = false
+			notification.Error = err.Error()
+		}
+		resp.Workflows = append(resp.Workflows, notification)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"device-service/devicepb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// grpcProgressInterval is how often ExecuteOperation reports that an
+// operation is still running.
+const grpcProgressInterval = time.Second
+
+// deviceGRPCServer serves booking, release and execute to internal callers
+// such as workflow-service. It shares its logic with the REST handlers.
+type deviceGRPCServer struct {
+	devicepb.UnimplementedDeviceServiceServer
+}
+
+// grpcStatus maps a DeviceError onto the matching gRPC status code.
+func grpcStatus(devErr *DeviceError) error {
+	code := codes.Internal
+	switch devErr.StatusCode {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		code = codes.Unavailable
+	}
+	return status.Error(code, devErr.Message)
+}
+
+// grpcActor returns the user a call was made by, from the x-user metadata
+// that mirrors ACTOR_HEADER.
+func grpcActor(reqCtx context.Context) string {
+	md, _ := metadata.FromIncomingContext(reqCtx)
+	if values := md.Get(strings.ToLower(ACTOR_HEADER)); len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// grpcLab returns the lab a call was made in, from the x-lab metadata that
+// mirrors LAB_HEADER.
+func grpcLab(reqCtx context.Context) string {
+	md, _ := metadata.FromIncomingContext(reqCtx)
+	if values := md.Get(strings.ToLower(LAB_HEADER)); len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// checkGRPCDevice answers calls for an unknown device, a deleted one or
+// another lab's with NOT_FOUND.
+func checkGRPCDevice(reqCtx context.Context, deviceID string) error {
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		return status.Error(codes.NotFound, "Device not found")
+	}
+	deleted, err := deviceDeleted(deviceID)
+	if err != nil {
+		log.Printf("Error checking whether device %s is deleted: %v", deviceID, err)
+		return status.Error(codes.Internal, "Failed to retrieve device")
+	}
+	if deleted {
+		return status.Error(codes.NotFound, "Device not found")
+	}
+	lab, err := getDeviceLab(deviceID)
+	if err != nil {
+		log.Printf("Error getting lab of device %s: %v", deviceID, err)
+		return status.Error(codes.Internal, "Failed to retrieve device")
+	}
+	if lab != grpcLab(reqCtx) {
+		return status.Error(codes.NotFound, "Device not found")
+	}
+	return nil
+}
+
+func (s *deviceGRPCServer) BookDevice(reqCtx context.Context, req *devicepb.BookDeviceRequest) (*devicepb.BookDeviceResponse, error) {
+	if err := checkGRPCDevice(reqCtx, req.DeviceId); err != nil {
+		return nil, err
+	}
+	if req.WorkflowId == "" {
+		return nil, status.Error(codes.InvalidArgument, "workflow_id required")
+	}
+
+	resp, devErr := bookDevice(req.DeviceId, BookRequest{
+		WorkflowID:         req.WorkflowId,
+		MinFirmwareVersion: req.MinFirmwareVersion,
+		ProtocolVersion:    req.ProtocolVersion,
+	}, grpcActor(reqCtx))
+	if devErr != nil {
+		return nil, grpcStatus(devErr)
+	}
+	return &devicepb.BookDeviceResponse{
+		DeviceId:      resp.DeviceID,
+		Status:        resp.Status,
+		WorkflowId:    resp.WorkflowID,
+		BookedAt:      resp.BookedAt,
+		Slot:          int32(resp.Slot),
+		ReservationId: resp.ReservationID,
+		Warnings:      resp.Warnings,
+	}, nil
+}
+
+func (s *deviceGRPCServer) ReleaseDevice(reqCtx context.Context, req *devicepb.ReleaseDeviceRequest) (*devicepb.ReleaseDeviceResponse, error) {
+	if err := checkGRPCDevice(reqCtx, req.DeviceId); err != nil {
+		return nil, err
+	}
+
+	resp, devErr := releaseDevice(req.DeviceId, req.WorkflowId, int(req.Slot), grpcActor(reqCtx))
+	if devErr != nil {
+		return nil, grpcStatus(devErr)
+	}
+	return &devicepb.ReleaseDeviceResponse{
+		DeviceId:   resp.DeviceID,
+		Status:     resp.Status,
+		ReleasedAt: resp.ReleasedAt,
+	}, nil
+}
+
+// ExecuteOperation sends ACCEPTED, then RUNNING every second while the
+// device works, and finally COMPLETED with the result.
+func (s *deviceGRPCServer) ExecuteOperation(req *devicepb.ExecuteOperationRequest, stream devicepb.DeviceService_ExecuteOperationServer) error {
+	if err := checkGRPCDevice(stream.Context(), req.DeviceId); err != nil {
+		return err
+	}
+	if req.WorkflowId == "" || req.Operation == "" {
+		return status.Error(codes.InvalidArgument, "workflow_id and operation required")
+	}
+
+	startedAt := time.Now()
+	progress := func(state devicepb.ExecuteProgress_State) *devicepb.ExecuteProgress {
+		return &devicepb.ExecuteProgress{
+			State:     state,
+			DeviceId:  req.DeviceId,
+			Operation: req.Operation,
+			ElapsedMs: time.Since(startedAt).Milliseconds(),
+		}
+	}
+
+	if err := stream.Send(progress(devicepb.ExecuteProgress_STATE_ACCEPTED)); err != nil {
+		return err
+	}
+
+	type outcome struct {
+		resp   *ExecuteResponse
+		devErr *DeviceError
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		resp, devErr := executeOperation(stream.Context(), req.DeviceId, ExecuteRequest{
+			WorkflowID: req.WorkflowId,
+			Operation:  req.Operation,
+			Params:     req.Params.AsMap(),
+		})
+		done <- outcome{resp, devErr}
+	}()
+
+	ticker := time.NewTicker(grpcProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := stream.Send(progress(devicepb.ExecuteProgress_STATE_RUNNING)); err != nil {
+				return err
+			}
+		case result := <-done:
+			if result.devErr != nil {
+				return grpcStatus(result.devErr)
+			}
+
+			completed := progress(devicepb.ExecuteProgress_STATE_COMPLETED)
+			completed.OperationId = result.resp.OperationID
+			completed.Warnings = result.resp.Warnings
+			completed.ExecutedAt = result.resp.ExecutedAt
+			if result.resp.Result != nil {
+				data, err := structpb.NewStruct(result.resp.Result)
+				if err != nil {
+					log.Printf("Error encoding result of %s on device %s: %v", req.Operation, req.DeviceId, err)
+				} else {
+					completed.Result = data
+				}
+			}
+			return stream.Send(completed)
+		}
+	}
+}
+
+// startGRPCServer listens for internal gRPC callers in the background.
+func startGRPCServer(port string) error {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(auditUnaryCall), grpc.StreamInterceptor(auditStreamCall)}
+	// The gRPC API is served with the same TLS as the HTTP one.
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	devicepb.RegisterDeviceServiceServer(server, &deviceGRPCServer{})
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			log.Fatalf("gRPC server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Device Service gRPC API starting on port %s", port)
+	return nil
+}
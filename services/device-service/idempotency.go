@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IDEMPOTENCY_KEY_HEADER names an execute call, so a retry of one that
+// timed out gets the outcome of the first instead of running the operation
+// again. The workflow service sends one for each execute-step attempt.
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+// IDEMPOTENT_REPLAY_HEADER marks a response replayed from an earlier call
+// with the same key.
+const IDEMPOTENT_REPLAY_HEADER = "Idempotent-Replayed"
+
+// executionTTL is how long the outcome of a keyed execute call is kept for
+// retries.
+const executionTTL = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the keys accepted, as they are part of a
+// Redis key.
+const maxIdempotencyKeyLength = 255
+
+// StoredExecution is the outcome of a keyed execute call, or an empty
+// StatusCode while the operation is still running.
+type StoredExecution struct {
+	WorkflowID string          `json:"workflow_id"`
+	Operation  string          `json:"operation"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+func executionKey(deviceID, key string) string {
+	return deviceKey(deviceID, "execution:"+key)
+}
+
+// claimExecution records that the keyed call is running, unless a call
+// with the key was made before, in which case that call is returned.
+func claimExecution(deviceID, key string, req ExecuteRequest) (*StoredExecution, error) {
+	pending, _ := json.Marshal(StoredExecution{WorkflowID: req.WorkflowID, Operation: req.Operation})
+	claimed, err := redisClient.SetNX(ctx, executionKey(deviceID, key), pending, executionTTL).Result()
+	if err != nil || claimed {
+		return nil, err
+	}
+
+	data, err := redisClient.Get(ctx, executionKey(deviceID, key)).Result()
+	if err == redis.Nil {
+		// It expired in between, so claim it again.
+		return claimExecution(deviceID, key, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored StoredExecution
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// saveExecution keeps the outcome of a keyed call for its retries.
+func saveExecution(deviceID, key string, req ExecuteRequest, statusCode int, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	stored, _ := json.Marshal(StoredExecution{
+		WorkflowID: req.WorkflowID,
+		Operation:  req.Operation,
+		StatusCode: statusCode,
+		Body:       data,
+	})
+	return redisClient.Set(ctx, executionKey(deviceID, key), stored, executionTTL).Err()
+}
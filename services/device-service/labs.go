@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// LAB_HEADER names the lab a request is made in. The gateway sets it from
+// the user's session; requests without it are in the default lab.
+const LAB_HEADER = "X-Lab"
+
+// Each device belongs to one lab, named under device:{<id>}:lab. Devices
+// without one belong to the default lab. A lab only sees and uses its own
+// devices.
+const deviceLabKeyName = "lab"
+
+var labPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+func deviceLabKey(deviceID string) string {
+	return deviceKey(deviceID, deviceLabKeyName)
+}
+
+// requestLab returns the lab a request is made in, or "" for the default
+// lab.
+func requestLab(c *gin.Context) string {
+	return strings.TrimSpace(c.GetHeader(LAB_HEADER))
+}
+
+// deviceLabs caches the lab of each device, by device ID.
+var deviceLabs = newReadCache("device-labs")
+
+func getDeviceLab(deviceID string) (string, error) {
+	lab, err := deviceLabs.get(deviceID, func() (interface{}, error) {
+		lab, err := redisClient.Get(ctx, deviceLabKey(deviceID)).Result()
+		if err == redis.Nil {
+			return "", nil
+		}
+		return lab, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return lab.(string), nil
+}
+
+// getDeviceLabs returns the lab of each of the devices, by device ID.
+func getDeviceLabs(deviceIDs []string) (map[string]string, error) {
+	values, err := deviceLabs.getMany(deviceIDs, func(missing []string) (map[string]interface{}, error) {
+		values, err := mgetDeviceKeys(missing, deviceLabKeyName)
+		if err != nil {
+			return nil, err
+		}
+		labs := make(map[string]interface{}, len(missing))
+		for i, deviceID := range missing {
+			lab, _ := values[0][i].(string)
+			labs[deviceID] = lab
+		}
+		return labs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	labs := make(map[string]string, len(values))
+	for deviceID, lab := range values {
+		labs[deviceID] = lab.(string)
+	}
+	return labs, nil
+}
+
+// labDeviceIDs returns the IDs of the lab's devices, sorted, leaving out
+// deleted ones.
+func labDeviceIDs(lab string) ([]string, error) {
+	deviceIDs := sortedDeviceIDs()
+	labs, err := getDeviceLabs(deviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := deletedDeviceIDs()
+	if err != nil {
+		return nil, err
+	}
+	inLab := []string{}
+	for _, deviceID := range deviceIDs {
+		if labs[deviceID] == lab && !deleted[deviceID] {
+			inLab = append(inLab, deviceID)
+		}
+	}
+	return inLab, nil
+}
+
+// authorizeDevice rejects requests naming a malformed lab, and answers
+// requests for another lab's device, or a deleted one, as if it didn't
+// exist. Admins work with the devices of every lab.
+func authorizeDevice() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		lab := requestLab(c)
+		if lab != "" && !labPattern.MatchString(lab) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + LAB_HEADER + " header"})
+			return
+		}
+
+		deviceID := c.Param("device_id")
+		if _, ok := deviceFleet()[deviceID]; !ok {
+			c.Next()
+			return
+		}
+		deleted, err := deviceDeleted(deviceID)
+		if err != nil {
+			log.Printf("Error checking whether device %s is deleted: %v", deviceID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device"})
+			return
+		}
+		if deleted {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		if isAdmin(c) {
+			c.Next()
+			return
+		}
+		deviceLab, err := getDeviceLab(deviceID)
+		if err != nil {
+			log.Printf("Error getting lab of device %s: %v", deviceID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device"})
+			return
+		}
+		if deviceLab != lab {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		c.Next()
+	}
+}
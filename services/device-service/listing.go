@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDeviceLimit = 100
+	maxDeviceLimit     = 1000
+)
+
+// deviceSortFields are the fields GET /devices can be sorted by.
+var deviceSortFields = map[string]func(Device) string{
+	"id":     func(d Device) string { return d.ID },
+	"name":   func(d Device) string { return d.Name },
+	"type":   func(d Device) string { return d.Type },
+	"status": func(d Device) string { return d.Status },
+}
+
+type DeviceListResponse struct {
+	Devices []Device `json:"devices"`
+	Total   int      `json:"total"`
+	Limit   int      `json:"limit"`
+	Offset  int      `json:"offset"`
+}
+
+func paginationFromQuery(c *gin.Context) (int, int, error) {
+	limit := defaultDeviceLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxDeviceLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxDeviceLimit)
+		}
+		limit = n
+	}
+
+	offset := 0
+	if value := c.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// sortDevices orders devices by sort, a field name optionally prefixed
+// with "-" for descending order. Ties are broken by ID.
+func sortDevices(devices []Device, sortBy string) error {
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	descending := strings.HasPrefix(sortBy, "-")
+	key, ok := deviceSortFields[strings.TrimPrefix(sortBy, "-")]
+	if !ok {
+		return errors.New("sort must be id, name, type or status, prefixed with - for descending")
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		a, b := key(devices[i]), key(devices[j])
+		if a == b {
+			return devices[i].ID < devices[j].ID
+		}
+		return (a < b) != descending
+	})
+	return nil
+}
+
+func listDevicesHandler(c *gin.Context) {
+	limit, offset, err := paginationFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceIDs, err := labDeviceIDs(requestLab(c))
+	var devices []Device
+	if err == nil {
+		devices, err = loadDevices(deviceIDs)
+	}
+	if err != nil {
+		log.Printf("Error loading devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve devices"})
+		return
+	}
+
+	filter := deviceFilterFromQuery(c)
+	filtered := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		if filter.matches(device) {
+			filtered = append(filtered, device)
+		}
+	}
+	if err := sortDevices(filtered, c.Query("sort")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page := []Device{}
+	if offset < len(filtered) {
+		end := offset + limit
+		if end > len(filtered) {
+			end = len(filtered)
+		}
+		page = filtered[offset:end]
+	}
+	c.JSON(http.StatusOK, DeviceListResponse{Devices: page, Total: len(filtered), Limit: limit, Offset: offset})
+}
@@ -2,67 +2,103 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
+	"platform"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
 var (
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 	ctx         = context.Background()
 )
 
 type Device struct {
-	ID           string   `json:"id"`
-	Name         string   `json:"name"`
-	Type         string   `json:"type"`
-	Status       string   `json:"status"`
-	Capabilities []string `json:"capabilities"`
-	WorkflowID   string   `json:"workflow_id,omitempty"`
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	Status       string            `json:"status"`
+	Capabilities []string          `json:"capabilities"`
+	Capacity     int               `json:"capacity,omitempty"`
+	Firmware     *FirmwareInfo     `json:"firmware,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	Consumables  []ConsumableLevel `json:"consumables,omitempty"`
+	Warnings     []string          `json:"warnings,omitempty"`
+	WorkflowID   string            `json:"workflow_id,omitempty"`
+	BookedBy     string            `json:"booked_by,omitempty"`
+	Slots        []SlotState       `json:"slots,omitempty"`
+	Error        *DeviceErrorState `json:"error_state,omitempty"`
+	Calibration  *Calibration      `json:"calibration,omitempty"`
+	Lab          string            `json:"lab,omitempty"`
 }
 
 type BookRequest struct {
-	WorkflowID string `json:"workflow_id" binding:"required"`
+	WorkflowID         string `json:"workflow_id" binding:"required"`
+	MinFirmwareVersion string `json:"min_firmware_version"`
+	ProtocolVersion    string `json:"protocol_version"`
+	// Queue asks to wait for a device in use rather than be refused, when
+	// the queueing feature flag is on; workflow-service is told when the
+	// booking is granted.
+	Queue bool `json:"queue"`
+	// Project and Priority place a queued booking under the device's
+	// allocation policy; a higher priority is granted first.
+	Project  string `json:"project"`
+	Priority int    `json:"priority"`
 }
 
 type ReleaseRequest struct {
 	WorkflowID string `json:"workflow_id"`
+	Slot       int    `json:"slot"`
 }
 
 type ExecuteRequest struct {
-	WorkflowID string `json:"workflow_id" binding:"required"`
-	Operation  string `json:"operation" binding:"required"`
+	WorkflowID string                 `json:"workflow_id" binding:"required"`
+	Operation  string                 `json:"operation" binding:"required"`
+	Params     map[string]interface{} `json:"params,omitempty"`
 }
 
 type BookResponse struct {
-	DeviceID   string `json:"device_id"`
-	Status     string `json:"status"`
-	WorkflowID string `json:"workflow_id"`
-	BookedAt   string `json:"booked_at"`
+	DeviceID      string   `json:"device_id"`
+	Status        string   `json:"status"`
+	WorkflowID    string   `json:"workflow_id"`
+	BookedAt      string   `json:"booked_at"`
+	BookedBy      string   `json:"booked_by,omitempty"`
+	Slot          int      `json:"slot,omitempty"`
+	ReservationID string   `json:"reservation_id,omitempty"`
+	Warnings      []string `json:"warnings,omitempty"`
 }
 
 type ReleaseResponse struct {
 	DeviceID   string `json:"device_id"`
 	Status     string `json:"status"`
 	ReleasedAt string `json:"released_at"`
+	ReleasedBy string `json:"released_by,omitempty"`
 }
 
 type ExecuteResponse struct {
-	DeviceID   string `json:"device_id"`
-	Operation  string `json:"operation"`
-	Status     string `json:"status"`
-	ExecutedAt string `json:"executed_at"`
+	DeviceID    string                 `json:"device_id"`
+	Operation   string                 `json:"operation"`
+	OperationID string                 `json:"operation_id,omitempty"`
+	Status      string                 `json:"status"`
+	ExecutedAt  string                 `json:"executed_at"`
+	Result      map[string]interface{} `json:"result,omitempty"`
+	Warnings    []string               `json:"warnings,omitempty"`
 }
 
-// Simulated lab devices
-var DEVICES = map[string]Device{
+// defaultDevices are the simulated lab devices the fleet starts with when
+// no devices config is given.
+var defaultDevices = map[string]Device{
 	"liquid-handler-1": {
 		ID:           "liquid-handler-1",
 		Name:         "Liquid Handler Alpha",
@@ -76,6 +112,7 @@ var DEVICES = map[string]Device{
 		Type:         "incubator",
 		Status:       "available",
 		Capabilities: []string{"heat", "cool", "shake"},
+		Capacity:     4,
 	},
 	"plate-reader-1": {
 		ID:           "plate-reader-1",
@@ -87,76 +124,551 @@ var DEVICES = map[string]Device{
 }
 
 func getDeviceStatus(deviceID string) string {
-	cached, err := redisClient.Get(ctx, fmt.Sprintf("device:%s:status", deviceID)).Result()
-	if err == nil {
-		return cached
+	states, err := getDeviceStates([]string{deviceID})
+	if err != nil {
+		log.Printf("Error reading status of device %s: %v", deviceID, err)
+	}
+	if state, ok := states[deviceID]; ok {
+		return state.Status
 	}
-	if device, ok := DEVICES[deviceID]; ok {
+	if device, ok := deviceFleet()[deviceID]; ok {
 		return device.Status
 	}
 	return "unknown"
 }
 
+// getDeviceWorkflow returns the workflow holding a single-slot device, or
+// an empty string if it isn't booked.
+func getDeviceWorkflow(deviceID string) string {
+	states, err := deviceStore.GetStates([]string{deviceID})
+	if err != nil {
+		log.Printf("Error reading booking of device %s: %v", deviceID, err)
+	}
+	return states[deviceID].WorkflowID
+}
+
 func setDeviceStatus(deviceID, status string, workflowID *string) {
-	redisClient.Set(ctx, fmt.Sprintf("device:%s:status", deviceID), status, 0)
-	if workflowID != nil && *workflowID != "" {
-		redisClient.Set(ctx, fmt.Sprintf("device:%s:workflow", deviceID), *workflowID, 0)
-	} else {
-		redisClient.Del(ctx, fmt.Sprintf("device:%s:workflow", deviceID))
+	previousStatus := getDeviceStatus(deviceID)
+
+	state := DeviceState{Status: status}
+	if workflowID != nil {
+		state.WorkflowID = *workflowID
 	}
+	if err := deviceStore.SetState(deviceID, state); err != nil {
+		log.Printf("Error saving status of device %s: %v", deviceID, err)
+		return
+	}
+
+	if previousStatus != status {
+		event := DeviceEvent{
+			DeviceID:       deviceID,
+			Status:         status,
+			PreviousStatus: previousStatus,
+			WorkflowID:     state.WorkflowID,
+			Timestamp:      time.Now().UTC().Format(time.RFC3339),
+		}
+		if status == "error" {
+			event.Error = getDeviceErrorState(deviceID)
+		}
+		publishDeviceEvent(event)
+	}
+}
+
+// bookDeviceState marks a single-slot device busy for the workflow. The
+// store re-checks availability, so a booking that lost a race fails here.
+func bookDeviceState(deviceID, workflowID string) *DeviceError {
+	previousStatus, err := deviceStore.Book(deviceID, workflowID)
+	if errors.Is(err, ErrDeviceUnavailable) {
+		log.Printf("Device %s is not available (status: %s)", deviceID, previousStatus)
+		return &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeDeviceUnavailable, Message: "Device is not available"}
+	}
+	if err != nil {
+		log.Printf("Error booking device %s: %v", deviceID, err)
+		return &DeviceError{StatusCode: http.StatusInternalServerError, Code: ErrorCodeInternal, Message: "Failed to book device"}
+	}
+
+	if previousStatus != "busy" {
+		publishDeviceEvent(DeviceEvent{
+			DeviceID:       deviceID,
+			Status:         "busy",
+			PreviousStatus: previousStatus,
+			WorkflowID:     workflowID,
+			Timestamp:      time.Now().UTC().Format(time.RFC3339),
+		})
+	}
+	return nil
 }
 
+// healthHandler reports the service alive, and degraded while Redis is
+// down; /ready says whether it can take requests.
 func healthHandler(c *gin.Context) {
+	status := "healthy"
+	if !platform.RedisUp() {
+		status = "degraded"
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"status":  "healthy",
+		"status":  status,
 		"service": "device-service",
+		"redis":   platform.RedisStatus(),
 	})
 }
 
-func listDevicesHandler(c *gin.Context) {
-	// Get device IDs in sorted order for consistent ordering
-	deviceIDs := make([]string, 0, len(DEVICES))
-	for deviceID := range DEVICES {
+// DeviceState is the compact runtime state of a device.
+type DeviceState struct {
+	Status     string `json:"status"`
+	WorkflowID string `json:"workflow_id,omitempty"`
+}
+
+func sortedDeviceIDs() []string {
+	deviceIDs := make([]string, 0, len(deviceFleet()))
+	for deviceID := range deviceFleet() {
 		deviceIDs = append(deviceIDs, deviceID)
 	}
 	sort.Strings(deviceIDs)
+	return deviceIDs
+}
+
+// mgetDeviceKeys fetches the named keys of each device, with one MGET per
+// device, as only a device's own keys share a hash slot, all sent in one
+// pipeline. It returns the values grouped by name.
+func mgetDeviceKeys(deviceIDs []string, names ...string) ([][]interface{}, error) {
+	grouped := make([][]interface{}, len(names))
+	for i := range names {
+		grouped[i] = make([]interface{}, len(deviceIDs))
+	}
+	if len(deviceIDs) == 0 || len(names) == 0 {
+		return grouped, nil
+	}
+
+	pipe := redisClient.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(deviceIDs))
+	for i, deviceID := range deviceIDs {
+		keys := make([]string, len(names))
+		for j, name := range names {
+			keys[j] = deviceKey(deviceID, name)
+		}
+		cmds[i] = pipe.MGet(ctx, keys...)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		for j, value := range cmd.Val() {
+			grouped[j][i] = value
+		}
+	}
+	return grouped, nil
+}
+
+// getDeviceStates reads the status and booking of many devices at once.
+func getDeviceStates(deviceIDs []string) (map[string]DeviceState, error) {
+	stored, err := deviceStore.GetStates(deviceIDs)
+	if err != nil {
+		return nil, err
+	}
 
-	devices := []Device{}
+	states := make(map[string]DeviceState, len(deviceIDs))
 	for _, deviceID := range deviceIDs {
-		deviceInfo := DEVICES[deviceID]
-		device := deviceInfo
-		device.Status = getDeviceStatus(deviceID)
-		workflowID, err := redisClient.Get(ctx, fmt.Sprintf("device:%s:workflow", deviceID)).Result()
-		if err == nil {
-			device.WorkflowID = workflowID
+		state, ok := stored[deviceID]
+		if !ok {
+			state = DeviceState{Status: "unknown"}
+			if device, ok := deviceFleet()[deviceID]; ok {
+				state.Status = device.Status
+			}
+		}
+		states[deviceID] = state
+	}
+	return states, nil
+}
+
+// loadDevices returns the device definitions merged with their current
+// state, using batched reads regardless of fleet size.
+func loadDevices(deviceIDs []string) ([]Device, error) {
+	states, err := getDeviceStates(deviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	values, err := mgetDeviceKeys(deviceIDs, "error", "calibration", "firmware", "metadata", deviceLabKeyName)
+	if err != nil {
+		return nil, err
+	}
+
+	slotHolders := map[string]*redis.MapStringStringCmd{}
+	consumables := map[string]*redis.MapStringStringCmd{}
+	bookedBy := map[string]*redis.MapStringStringCmd{}
+	_, err = redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, deviceID := range deviceIDs {
+			bookedBy[deviceID] = pipe.HGetAll(ctx, bookedByKey(deviceID))
+			if isMultiSlot(deviceID) {
+				slotHolders[deviceID] = pipe.HGetAll(ctx, slotsKey(deviceID))
+			}
+			if deviceConsumables(deviceID) != nil {
+				consumables[deviceID] = pipe.HGetAll(ctx, consumablesKey(deviceID))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]Device, 0, len(deviceIDs))
+	for i, deviceID := range deviceIDs {
+		device := deviceFleet()[deviceID]
+		device.Status = states[deviceID].Status
+		device.WorkflowID = states[deviceID].WorkflowID
+		bookers := bookedBy[deviceID].Val()
+		device.BookedBy = bookers[device.WorkflowID]
+		if data, ok := values[0][i].(string); ok && device.Status == "error" {
+			device.Error = parseDeviceErrorState(deviceID, data)
+		}
+		if data, ok := values[1][i].(string); ok {
+			device.Calibration = parseCalibration(deviceID, data)
+		}
+		if data, ok := values[2][i].(string); ok {
+			device.Firmware = parseFirmwareInfo(deviceID, data)
+		}
+		if data, ok := values[3][i].(string); ok {
+			if meta := parseDeviceMetadata(deviceID, data); meta != nil {
+				device.Tags = meta.Tags
+				device.Metadata = meta.Metadata
+			}
+		}
+		if lab, ok := values[4][i].(string); ok {
+			device.Lab = lab
+		}
+		if slots, ok := slotHolders[deviceID]; ok {
+			device.Slots = slotStates(deviceID, parseSlotHolders(slots.Val()))
+			for i := range device.Slots {
+				device.Slots[i].BookedBy = bookers[device.Slots[i].WorkflowID]
+			}
+		}
+		if stored, ok := consumables[deviceID]; ok {
+			device.Consumables = consumableLevels(deviceID, stored.Val())
+			device.Warnings = consumableWarnings(device.Consumables)
 		}
 		devices = append(devices, device)
 	}
-	c.JSON(http.StatusOK, devices)
+	return devices, nil
+}
+
+func loadDevice(deviceID string) (Device, error) {
+	devices, err := loadDevices([]string{deviceID})
+	if err != nil {
+		return Device{}, err
+	}
+	return devices[0], nil
+}
+
+func deviceStatusesHandler(c *gin.Context) {
+	deviceIDs, err := labDeviceIDs(requestLab(c))
+	var states map[string]DeviceState
+	if err == nil {
+		states, err = getDeviceStates(deviceIDs)
+	}
+	if err != nil {
+		log.Printf("Error loading device states: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device status"})
+		return
+	}
+	c.JSON(http.StatusOK, states)
 }
 
 func getDeviceHandler(c *gin.Context) {
 	deviceID := c.Param("device_id")
-	deviceInfo, ok := DEVICES[deviceID]
-	if !ok {
+	if _, ok := deviceFleet()[deviceID]; !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
 	}
 
-	device := deviceInfo
-	device.Status = getDeviceStatus(deviceID)
-	workflowID, err := redisClient.Get(ctx, fmt.Sprintf("device:%s:workflow", deviceID)).Result()
-	if err == nil {
-		device.WorkflowID = workflowID
+	device, err := loadDevice(deviceID)
+	if err != nil {
+		log.Printf("Error loading device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device"})
+		return
 	}
 
 	c.JSON(http.StatusOK, device)
 }
 
+// Error codes of a DeviceError, reported as "code" beside "error" so
+// callers can tell failures apart without matching on messages.
+const (
+	ErrorCodeDeviceUnavailable   = "device_unavailable"
+	ErrorCodeSlotAlreadyHeld     = "slot_already_held"
+	ErrorCodeDeviceReserved      = "device_reserved"
+	ErrorCodeFirmwareUnknown     = "firmware_unknown"
+	ErrorCodeFirmwareOutdated    = "firmware_outdated"
+	ErrorCodeProtocolUnsupported = "protocol_unsupported"
+	ErrorCodeCalibrationOverdue  = "calibration_overdue"
+	ErrorCodeConsumableExhausted = "consumable_exhausted"
+	ErrorCodeBookedByAnother     = "booked_by_another_workflow"
+	ErrorCodeNotBooked           = "not_booked_by_workflow"
+	ErrorCodeDeviceInError       = "device_in_error"
+	ErrorCodeOperationAborted    = "operation_aborted"
+	ErrorCodeDriverError         = "driver_error"
+	ErrorCodeInjectedFault       = "injected_fault"
+	ErrorCodeInternal            = "internal_error"
+)
+
+// DeviceError is a failed device request, carrying the HTTP status to report.
+type DeviceError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *DeviceError) Error() string {
+	return e.Message
+}
+
+// body is the error's JSON response body.
+func (e *DeviceError) body() gin.H {
+	return gin.H{"error": e.Message, "code": e.Code}
+}
+
+// bookDevice books the device for a workflow on behalf of actor, who may
+// be unknown.
+func bookDevice(deviceID string, req BookRequest, actor string) (resp *BookResponse, devErr *DeviceError) {
+	workflowID := req.WorkflowID
+	defer func() {
+		recordBookingEvent(deviceID, BookingActionBook, workflowID, actor, devErr)
+		observeBooking(deviceID, devErr)
+	}()
+
+	log.Printf("Attempting to book device %s for workflow %s", deviceID, workflowID)
+
+	if code := applyFaults(deviceID, FaultActionBook); code != 0 {
+		log.Printf("Injected fault failed booking on device %s with %d", deviceID, code)
+		return nil, &DeviceError{StatusCode: code, Code: ErrorCodeInjectedFault, Message: "Injected device fault"}
+	}
+
+	currentStatus := getDeviceStatus(deviceID)
+
+	if currentStatus != "available" {
+		log.Printf("Device %s is not available (status: %s)", deviceID, currentStatus)
+		recordBookingConflict(deviceID, workflowID, time.Now().UTC())
+		return nil, &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeDeviceUnavailable, Message: "Device is not available"}
+	}
+
+	reservation, resErr, resWarning := checkReservation(deviceID, workflowID, time.Now().UTC())
+	if resErr != nil {
+		recordBookingConflict(deviceID, workflowID, time.Now().UTC())
+		return nil, resErr
+	}
+
+	if devErr := checkFirmware(deviceID, req); devErr != nil {
+		return nil, devErr
+	}
+
+	calErr, calWarning := checkCalibration(deviceID)
+	if calErr != nil {
+		return nil, calErr
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	status, slot := "busy", 0
+	if isMultiSlot(deviceID) {
+		slot, devErr = bookSlot(deviceID, workflowID)
+		if devErr != nil {
+			recordBookingConflict(deviceID, workflowID, time.Now().UTC())
+			return nil, devErr
+		}
+		status = getDeviceStatus(deviceID)
+		log.Printf("Workflow %s booked slot %d on device %s", workflowID, slot, deviceID)
+	} else if devErr = bookDeviceState(deviceID, workflowID); devErr != nil {
+		if devErr.StatusCode == http.StatusConflict {
+			recordBookingConflict(deviceID, workflowID, time.Now().UTC())
+		}
+		return nil, devErr
+	}
+	recordBooking(deviceID, workflowID, time.Now().UTC())
+	recordAllocation(deviceID, req.Project)
+	if actor != "" {
+		redisClient.HSet(ctx, bookedByKey(deviceID), workflowID, actor)
+	}
+	reservationID := ""
+	if reservation != nil {
+		claimReservation(*reservation, time.Now().UTC())
+		reservationID = reservation.ID
+	}
+
+	log.Printf("Device %s successfully booked by workflow %s", deviceID, workflowID)
+	resp = &BookResponse{
+		DeviceID:      deviceID,
+		Status:        status,
+		Slot:          slot,
+		WorkflowID:    workflowID,
+		BookedAt:      time.Now().UTC().Format(time.RFC3339),
+		BookedBy:      actor,
+		ReservationID: reservationID,
+	}
+	if resWarning != "" {
+		resp.Warnings = append(resp.Warnings, resWarning)
+	}
+	if calWarning != "" {
+		resp.Warnings = append(resp.Warnings, calWarning)
+	}
+	return resp, nil
+}
+
+// releaseDevice frees the device on behalf of actor. An empty workflowID
+// releases it regardless of which workflow holds it.
+func releaseDevice(deviceID, workflowID string, slot int, actor string) (resp *ReleaseResponse, devErr *DeviceError) {
+	releasedFrom := workflowID
+	defer func() {
+		recordBookingEvent(deviceID, BookingActionRelease, releasedFrom, actor, devErr)
+		if devErr == nil && releasedFrom != "" {
+			redisClient.HDel(ctx, bookedByKey(deviceID), strings.Split(releasedFrom, ",")...)
+		}
+		if devErr == nil {
+			go grantQueuedBookings(deviceID)
+		}
+		if resp != nil {
+			resp.ReleasedBy = actor
+		}
+	}()
+
+	log.Printf("Attempting to release device %s from workflow %s", deviceID, workflowID)
+
+	if code := applyFaults(deviceID, FaultActionRelease); code != 0 {
+		log.Printf("Injected fault failed release on device %s with %d", deviceID, code)
+		return nil, &DeviceError{StatusCode: code, Code: ErrorCodeInjectedFault, Message: "Injected device fault"}
+	}
+
+	if isMultiSlot(deviceID) {
+		var released []string
+		resp, released, devErr = releaseDeviceSlots(deviceID, workflowID, slot)
+		if releasedFrom == "" {
+			releasedFrom = strings.Join(released, ",")
+		}
+		return resp, devErr
+	}
+
+	currentWorkflow := getDeviceWorkflow(deviceID)
+	if releasedFrom == "" {
+		releasedFrom = currentWorkflow
+	}
+	if currentWorkflow != "" && currentWorkflow != workflowID && workflowID != "" {
+		log.Printf("Device %s is booked by another workflow", deviceID)
+		return nil, &DeviceError{StatusCode: http.StatusForbidden, Code: ErrorCodeBookedByAnother, Message: "Device is booked by another workflow"}
+	}
+
+	// A device in error or offline stays that way; releasing only drops
+	// the booking.
+	status := getDeviceStatus(deviceID)
+	if status != "error" && status != "offline" {
+		status = "available"
+	}
+	setDeviceStatus(deviceID, status, nil)
+	recordRelease(deviceID, currentWorkflow, time.Now().UTC())
+
+	log.Printf("Device %s released successfully", deviceID)
+	return &ReleaseResponse{
+		DeviceID:   deviceID,
+		Status:     status,
+		ReleasedAt: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+func executeOperation(reqCtx context.Context, deviceID string, req ExecuteRequest) (*ExecuteResponse, *DeviceError) {
+	log.Printf("Executing operation '%s' on device %s for workflow %s", req.Operation, deviceID, req.WorkflowID)
+
+	if code := applyFaults(deviceID, FaultActionExecute); code != 0 {
+		log.Printf("Injected fault failed execution on device %s with %d", deviceID, code)
+		return nil, &DeviceError{StatusCode: code, Code: ErrorCodeInjectedFault, Message: "Injected device fault"}
+	}
+
+	if !holdsDevice(deviceID, req.WorkflowID) {
+		log.Printf("Device %s not booked by workflow %s", deviceID, req.WorkflowID)
+		return nil, &DeviceError{StatusCode: http.StatusForbidden, Code: ErrorCodeNotBooked, Message: "Device not booked by this workflow"}
+	}
+
+	if status := getDeviceStatus(deviceID); status == "error" {
+		log.Printf("Device %s is in error state", deviceID)
+		return nil, &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeDeviceInError, Message: "Device is in error state"}
+	}
+
+	if devErr := consumeForOperation(deviceID, req.Operation, req.Params); devErr != nil {
+		return nil, devErr
+	}
+
+	startedAt := time.Now()
+	report, done := trackProgress(deviceID, req.WorkflowID, req.Operation)
+	opCtx, finished := abortable(withWorkflow(withProgress(reqCtx, report), req.WorkflowID), deviceID, req.WorkflowID)
+	operationsInFlight.WithLabelValues(deviceID).Inc()
+	result, err := getDriver(deviceID).Execute(opCtx, req.Operation, req.Params)
+	operationsInFlight.WithLabelValues(deviceID).Dec()
+	finished()
+	done()
+	// Checked either way, to forget an abort that came too late
+	aborted := wasAborted(deviceID, req.WorkflowID) && err != nil
+	duration := time.Since(startedAt)
+	recordOperation(deviceID, req.Operation, duration, err == nil, time.Now().UTC())
+	observeOperation(req.Operation, duration, err == nil)
+
+	record := OperationRecord{
+		DeviceID:   deviceID,
+		WorkflowID: req.WorkflowID,
+		Operation:  req.Operation,
+		Params:     req.Params,
+		Status:     OperationCompleted,
+		DurationMs: duration.Milliseconds(),
+	}
+	if aborted {
+		record.Status = OperationAborted
+		record.Error = "Operation aborted"
+	} else if err != nil {
+		record.Status = OperationFailed
+		record.Error = err.Error()
+	} else if result != nil {
+		record.Result = result.Data
+	}
+	operationID := recordOperationResult(record, startedAt)
+
+	if aborted {
+		log.Printf("Operation '%s' aborted on device %s after %v", req.Operation, deviceID, duration)
+		return nil, &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeOperationAborted, Message: "Operation aborted"}
+	}
+	if err != nil {
+		log.Printf("Operation '%s' failed on device %s after %v: %v", req.Operation, deviceID, duration, err)
+		if reqCtx.Err() == nil {
+			setDeviceError(deviceID, DeviceErrorState{
+				Cause:      err.Error(),
+				Operation:  req.Operation,
+				WorkflowID: req.WorkflowID,
+			})
+		}
+		var driverErr *DriverError
+		if errors.As(err, &driverErr) {
+			return nil, &DeviceError{StatusCode: driverErr.StatusCode, Code: ErrorCodeDriverError, Message: driverErr.Message}
+		}
+		return nil, &DeviceError{StatusCode: http.StatusBadGateway, Code: ErrorCodeDriverError, Message: fmt.Sprintf("Device driver error: %v", err)}
+	}
+
+	log.Printf("Operation '%s' completed on device %s", req.Operation, deviceID)
+	resp := &ExecuteResponse{
+		DeviceID:    deviceID,
+		Operation:   req.Operation,
+		OperationID: operationID,
+		Status:      "completed",
+		ExecutedAt:  time.Now().UTC().Format(time.RFC3339),
+		Result:      record.Result,
+	}
+	if deviceConsumables(deviceID) != nil {
+		if levels, err := getConsumableLevels(deviceID); err == nil {
+			resp.Warnings = consumableWarnings(levels)
+		}
+	}
+	return resp, nil
+}
+
 func bookDeviceHandler(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	if _, ok := DEVICES[deviceID]; !ok {
+	if _, ok := deviceFleet()[deviceID]; !ok {
 		log.Printf("Device not found: %s", deviceID)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
@@ -168,34 +680,36 @@ func bookDeviceHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "workflow_id required"})
 		return
 	}
-
-	log.Printf("Attempting to book device %s for workflow %s", deviceID, req.WorkflowID)
-
-	currentStatus := getDeviceStatus(deviceID)
-
-	if currentStatus != "available" {
-		log.Printf("Device %s is not available (status: %s)", deviceID, currentStatus)
-		c.JSON(http.StatusConflict, gin.H{"error": "Device is not available"})
+	if req.Priority < 0 || req.Priority > maxBookingPriority {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("priority must be between 0 and %d", maxBookingPriority)})
 		return
 	}
 
-	time.Sleep(100 * time.Millisecond)
-
-	setDeviceStatus(deviceID, "busy", &req.WorkflowID)
+	resp, devErr := bookDevice(deviceID, req, requestActor(c))
+	if devErr != nil && devErr.StatusCode == http.StatusConflict && req.Queue &&
+		platform.FeatureEnabled(redisClient, QUEUEING_FLAG, requestLab(c)) && getDeviceStatus(deviceID) == "busy" {
+		// Wait for the device to be released
+		queued, err := queueBooking(deviceID, req, requestActor(c))
+		if err != nil {
+			log.Printf("Error queueing booking of device %s: %v", deviceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue booking"})
+			return
+		}
+		c.JSON(http.StatusAccepted, queued)
+		return
+	}
+	if devErr != nil {
+		c.JSON(devErr.StatusCode, devErr.body())
+		return
+	}
 
-	log.Printf("Device %s successfully booked by workflow %s", deviceID, req.WorkflowID)
-	c.JSON(http.StatusOK, BookResponse{
-		DeviceID:   deviceID,
-		Status:     "busy",
-		WorkflowID: req.WorkflowID,
-		BookedAt:   time.Now().UTC().Format(time.RFC3339),
-	})
+	c.JSON(http.StatusOK, resp)
 }
 
 func releaseDeviceHandler(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	if _, ok := DEVICES[deviceID]; !ok {
+	if _, ok := deviceFleet()[deviceID]; !ok {
 		log.Printf("Device not found: %s", deviceID)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
@@ -207,29 +721,19 @@ func releaseDeviceHandler(c *gin.Context) {
 		req.WorkflowID = ""
 	}
 
-	log.Printf("Attempting to release device %s from workflow %s", deviceID, req.WorkflowID)
-
-	currentWorkflow, err := redisClient.Get(ctx, fmt.Sprintf("device:%s:workflow", deviceID)).Result()
-	if err == nil && currentWorkflow != req.WorkflowID && req.WorkflowID != "" {
-		log.Printf("Device %s is booked by another workflow", deviceID)
-		c.JSON(http.StatusForbidden, gin.H{"error": "Device is booked by another workflow"})
+	resp, devErr := releaseDevice(deviceID, req.WorkflowID, req.Slot, requestActor(c))
+	if devErr != nil {
+		c.JSON(devErr.StatusCode, devErr.body())
 		return
 	}
 
-	setDeviceStatus(deviceID, "available", nil)
-
-	log.Printf("Device %s released successfully", deviceID)
-	c.JSON(http.StatusOK, ReleaseResponse{
-		DeviceID:   deviceID,
-		Status:     "available",
-		ReleasedAt: time.Now().UTC().Format(time.RFC3339),
-	})
+	c.JSON(http.StatusOK, resp)
 }
 
 func executeOperationHandler(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	if _, ok := DEVICES[deviceID]; !ok {
+	if _, ok := deviceFleet()[deviceID]; !ok {
 		log.Printf("Device not found: %s", deviceID)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
@@ -242,31 +746,56 @@ func executeOperationHandler(c *gin.Context) {
 		return
 	}
 
-	log.Printf("Executing operation '%s' on device %s for workflow %s", req.Operation, deviceID, req.WorkflowID)
-
-	currentWorkflow, err := redisClient.Get(ctx, fmt.Sprintf("device:%s:workflow", deviceID)).Result()
-	if err != nil || currentWorkflow != req.WorkflowID {
-		log.Printf("Device %s not booked by workflow %s", deviceID, req.WorkflowID)
-		c.JSON(http.StatusForbidden, gin.H{"error": "Device not booked by this workflow"})
+	// A retry of a keyed call gets the first call's outcome
+	key := c.GetHeader(IDEMPOTENCY_KEY_HEADER)
+	if len(key) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be at most %d characters", IDEMPOTENCY_KEY_HEADER, maxIdempotencyKeyLength)})
 		return
 	}
+	if key != "" {
+		stored, err := claimExecution(deviceID, key, req)
+		if err != nil {
+			log.Printf("Error claiming execution %s on device %s: %v", key, deviceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check " + IDEMPOTENCY_KEY_HEADER})
+			return
+		}
+		switch {
+		case stored == nil:
+		case stored.WorkflowID != req.WorkflowID || stored.Operation != req.Operation:
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": IDEMPOTENCY_KEY_HEADER + " was used for another operation"})
+			return
+		case stored.StatusCode == 0:
+			c.JSON(http.StatusConflict, gin.H{"error": "Operation with this " + IDEMPOTENCY_KEY_HEADER + " is still running"})
+			return
+		default:
+			log.Printf("Replaying execution %s on device %s", key, deviceID)
+			c.Header(IDEMPOTENT_REPLAY_HEADER, "true")
+			c.Data(stored.StatusCode, "application/json; charset=utf-8", stored.Body)
+			return
+		}
+	}
 
-	// Simulate operation execution time
-	time.Sleep(500 * time.Millisecond)
+	resp, devErr := executeOperation(c.Request.Context(), deviceID, req)
+	status, body := http.StatusOK, interface{}(resp)
+	if devErr != nil {
+		status, body = devErr.StatusCode, devErr.body()
+	}
+	if key != "" {
+		if err := saveExecution(deviceID, key, req, status, body); err != nil {
+			log.Printf("Error saving execution %s on device %s: %v", key, deviceID, err)
+		}
+	}
 
-	log.Printf("Operation '%s' completed on device %s", req.Operation, deviceID)
-	c.JSON(http.StatusOK, ExecuteResponse{
-		DeviceID:   deviceID,
-		Operation:  req.Operation,
-		Status:     "completed",
-		ExecutedAt: time.Now().UTC().Format(time.RFC3339),
-	})
+	c.JSON(status, body)
 }
 
 func initializeDevices() {
-	for deviceID := range DEVICES {
-		exists, err := redisClient.Exists(ctx, fmt.Sprintf("device:%s:status", deviceID)).Result()
-		if err != nil || exists == 0 {
+	stored, err := deviceStore.GetStates(sortedDeviceIDs())
+	if err != nil {
+		log.Printf("Error reading device states: %v", err)
+	}
+	for deviceID := range deviceFleet() {
+		if _, ok := stored[deviceID]; err != nil || !ok {
 			setDeviceStatus(deviceID, "available", nil)
 		}
 	}
@@ -277,47 +806,101 @@ func main() {
 	log.SetOutput(os.Stdout)
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
-	// Connect to Redis
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379"
-	}
+	// Connect to Redis, retrying while it starts
+	redisClient = platform.NewRedisClient()
+	configureReadCache()
 
-	opt, err := redis.ParseURL(redisURL)
+	// Select where device state is persisted
+	var err error
+	deviceStore, err = newDeviceStore()
 	if err != nil {
-		log.Fatalf("Failed to parse Redis URL: %v", err)
+		log.Fatalf("Failed to open device store: %v", err)
 	}
+	defer deviceStore.Close()
 
-	redisClient = redis.NewClient(opt)
+	// Read the fleet definition, if given
+	if err := loadFleetConfig(os.Getenv("DEVICES_CONFIG_FILE")); err != nil {
+		log.Fatalf("Failed to load devices config: %v", err)
+	}
 
-	// Test Redis connection
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+	// Initialize devices once Redis is up
+	platform.WaitForRedis(redisClient, func() {
+		if err := migrateDeviceKeys(); err != nil {
+			log.Fatalf("Failed to move device keys: %v", err)
+		}
+		initializeFleet()
+		initializeDevices()
+		loadCalibrationEnforcement()
+	})
+
+	// Trim device histories and purge deleted devices in the background
+	startRetentionJanitor()
+	startTrashJanitor()
+	go refreshFleet()
+	go listenForAborts()
+	go listenForCacheInvalidations()
+
+	// Connect to the MQTT broker for physical devices
+	if brokerURL := os.Getenv("MQTT_BROKER_URL"); brokerURL != "" {
+		bridge, err = connectMQTTBridge(brokerURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to MQTT broker: %v", err)
+		}
 	}
 
-	log.Println("Connected to Redis successfully")
+	// Set up device drivers
+	if err := initializeDrivers(os.Getenv("DRIVERS_CONFIG_FILE")); err != nil {
+		log.Fatalf("Failed to initialize device drivers: %v", err)
+	}
 
-	// Initialize devices
-	initializeDevices()
+	// Load simulation profiles
+	if path := os.Getenv("SIMULATION_PROFILES_FILE"); path != "" {
+		if err := loadSimulationProfiles(path); err != nil {
+			log.Fatalf("Failed to load simulation profiles: %v", err)
+		}
+	}
+
+	configureServiceTLS()
+	configureAuditLog()
+	configureRequestLimits()
+	platform.ConfigureCompression()
+	platform.ConfigureFeatureFlags()
 
 	// Setup Gin
-	gin.SetMode(gin.ReleaseMode)
+	platform.ConfigureDebug(redisClient)
 	router := gin.Default()
+	platform.RegisterDebug(router)
 
 	// CORS configuration
-	router.Use(cors.New(cors.Config{
-		AllowAllOrigins: true,
-		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:    []string{"Origin", "Content-Type", "Accept"},
-	}))
+	corsPolicy, err := platform.CORSConfig(cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "If-None-Match", API_VERSION_HEADER},
+		ExposeHeaders: []string{API_VERSION_HEADER, "Deprecation", "Sunset", "Link", "ETag"},
+	})
+	if err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	router.Use(cors.New(corsPolicy))
+	router.Use(platform.CompressResponses())
+	router.Use(limitRequestBodies())
+	router.Use(auditLog())
 
 	// Routes
 	router.GET("/health", healthHandler)
-	router.GET("/devices", listDevicesHandler)
-	router.GET("/devices/:device_id", getDeviceHandler)
-	router.POST("/devices/:device_id/book", bookDeviceHandler)
-	router.POST("/devices/:device_id/release", releaseDeviceHandler)
-	router.POST("/devices/:device_id/execute", executeOperationHandler)
+	router.GET("/ready", platform.ReadyHandler)
+	router.GET("/metrics", metricsHandler())
+	registerRoutes(router.Group("/v1", platform.RequireRedis(), apiVersion()))
+	// The unversioned paths keep working until they are retired.
+	registerRoutes(router.Group("", platform.RequireRedis(), apiVersion(), deprecatedPath()))
+
+	// Start the gRPC API for internal callers
+	grpcPort := os.Getenv("GRPC_PORT")
+	if grpcPort == "" {
+		grpcPort = "50051"
+	}
+	if err := startGRPCServer(grpcPort); err != nil {
+		log.Fatalf("Failed to start gRPC server: %v", err)
+	}
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -326,7 +909,85 @@ func main() {
 	}
 
 	log.Printf("Device service starting on port %s", port)
-	if err := router.Run("0.0.0.0:" + port); err != nil {
+	if err := serve(router, "0.0.0.0:"+port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// registerRoutes adds the API's routes to a group, which is mounted both at
+// /v1 and, for older clients, at the root.
+func registerRoutes(api *gin.RouterGroup) {
+	api.Use(authorizeDevice())
+	api.GET("/capabilities", listCapabilitiesHandler)
+	api.GET("/capabilities/:operation", getCapabilityHandler)
+	api.GET("/devices", platform.ConditionalGET(listDevicesHandler))
+	api.GET("/devices/status", deviceStatusesHandler)
+	api.GET("/devices/events", deviceEventsHandler)
+	api.GET("/devices/stats", deviceStatsHandler)
+	api.GET("/devices/calibration", calibrationReportHandler)
+	api.GET("/devices/reservations", reservationCalendarHandler)
+	api.GET("/devices/trash", listDeletedDevicesHandler)
+	api.POST("/devices/trash/:deleted_device_id/restore", requireAdmin(), restoreDeletedDeviceHandler)
+	api.GET("/devices/:device_id", getDeviceHandler)
+	api.PATCH("/devices/:device_id", requireAdmin(), updateDeviceHandler)
+	api.DELETE("/devices/:device_id", requireAdmin(), deleteDeviceHandler)
+	api.GET("/devices/:device_id/telemetry", getTelemetryHandler)
+	api.GET("/devices/:device_id/calibration", getCalibrationHandler)
+	api.GET("/devices/:device_id/bookings", bookingHistoryHandler)
+	api.GET("/devices/:device_id/operations", operationHistoryHandler)
+	api.GET("/devices/:device_id/progress", deviceProgressHandler)
+	api.POST("/devices/:device_id/calibration", requireAdmin(), recordCalibrationHandler)
+	api.GET("/devices/:device_id/reservations", listReservationsHandler)
+	api.POST("/devices/:device_id/reservations", createReservationHandler)
+	api.DELETE("/devices/:device_id/reservations/:reservation_id", cancelReservationHandler)
+	api.GET("/devices/:device_id/consumables", listConsumablesHandler)
+	api.POST("/devices/:device_id/consumables/:consumable/refill", refillConsumableHandler)
+	api.POST("/devices/:device_id/heartbeat", heartbeatHandler)
+	api.POST("/devices/:device_id/book", bookDeviceHandler)
+	api.POST("/devices/:device_id/release", releaseDeviceHandler)
+	api.POST("/devices/:device_id/force-release", requireAdmin(), forceReleaseHandler)
+	api.POST("/devices/:device_id/execute", executeOperationHandler)
+	api.POST("/devices/:device_id/abort", abortOperationHandler)
+	api.POST("/devices/:device_id/simulate", simulateRunHandler)
+	api.GET("/devices/:device_id/queue", bookingQueueHandler)
+	api.GET("/devices/:device_id/schedule", deviceScheduleHandler)
+	api.DELETE("/devices/:device_id/queue/:workflow_id", leaveBookingQueueHandler)
+	api.POST("/devices/:device_id/estop", estopHandler)
+	api.POST("/devices/:device_id/reset", requireAdmin(), resetDeviceHandler)
+
+	// SiLA 2 adapter
+	api.GET("/sila/server", silaServerHandler)
+	api.GET("/sila/devices/:device_id/features", silaDeviceFeaturesHandler)
+	api.POST("/sila/devices/:device_id/features/:feature/commands/:command", silaCommandHandler)
+	api.GET("/sila/executions/:uuid", silaExecutionHandler)
+	api.GET("/sila/executions/:uuid/result", silaExecutionResultHandler)
+
+	// Admin routes
+	admin := api.Group("/admin", requireAdmin())
+	admin.GET("/drivers", listDriversHandler)
+	admin.POST("/devices/import", importDevicesHandler)
+	admin.GET("/audit-log", auditLogHandler)
+	admin.GET("/feature-flags", listFeatureFlagsHandler)
+	admin.PUT("/feature-flags/:name", setFeatureFlagHandler)
+	admin.DELETE("/feature-flags/:name", deleteFeatureFlagHandler)
+	admin.GET("/retention", retentionReportHandler)
+	admin.GET("/snapshot", getSnapshotHandler)
+	admin.POST("/snapshot", restoreSnapshotHandler)
+	admin.GET("/devices/:device_id/simulation", getSimulationProfileHandler)
+	admin.PUT("/devices/:device_id/simulation", setSimulationProfileHandler)
+	admin.DELETE("/devices/:device_id/simulation", resetSimulationProfileHandler)
+	admin.GET("/devices/:device_id/faults", listFaultsHandler)
+	admin.POST("/devices/:device_id/faults", injectFaultHandler)
+	admin.DELETE("/devices/:device_id/faults", clearFaultsHandler)
+	admin.DELETE("/devices/:device_id/faults/:fault_id", deleteFaultHandler)
+	admin.GET("/booking-policies", listBookingPoliciesHandler)
+	admin.PUT("/devices/:device_id/booking-policy", setBookingPolicyHandler)
+	admin.DELETE("/devices/:device_id/booking-policy", deleteBookingPolicyHandler)
+	admin.PUT("/device-types/:type/booking-policy", setBookingPolicyHandler)
+	admin.DELETE("/device-types/:type/booking-policy", deleteBookingPolicyHandler)
+	admin.GET("/storage/keys", listRedisKeysHandler)
+	admin.GET("/storage/keys/*key", getRedisKeyHandler)
+	admin.PUT("/storage/keys/*key", putRedisKeyHandler)
+	admin.DELETE("/storage/keys/*key", deleteRedisKeyHandler)
+	admin.GET("/storage/audit", storageAuditHandler)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceMetadata holds inventory information about a device: free-form tags
+// and key/value metadata such as serial number, vendor or purchase date.
+type DeviceMetadata struct {
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// UpdateDeviceRequest replaces the tags when given and merges the metadata;
+// a null metadata value removes that key. A lab moves the device to that
+// lab, or with "" back to the default lab.
+type UpdateDeviceRequest struct {
+	Tags     *[]string          `json:"tags"`
+	Metadata map[string]*string `json:"metadata"`
+	Lab      *string            `json:"lab"`
+}
+
+// DeviceFilter selects devices on GET /devices.
+type DeviceFilter struct {
+	Type       string
+	Status     string
+	Capability string
+	Tags       []string
+	Metadata   map[string]string
+}
+
+func metadataKey(deviceID string) string {
+	return deviceKey(deviceID, "metadata")
+}
+
+func parseDeviceMetadata(deviceID, data string) *DeviceMetadata {
+	var meta DeviceMetadata
+	if err := json.Unmarshal([]byte(data), &meta); err != nil {
+		log.Printf("Invalid metadata for device %s: %v", deviceID, err)
+		return nil
+	}
+	return &meta
+}
+
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func deviceFilterFromQuery(c *gin.Context) DeviceFilter {
+	return DeviceFilter{
+		Type:       c.Query("type"),
+		Status:     c.Query("status"),
+		Capability: c.Query("capability"),
+		Tags:       normalizeTags(c.QueryArray("tag")),
+		Metadata:   c.QueryMap("metadata"),
+	}
+}
+
+// matches reports whether the device has the requested type, status and
+// capability, and every requested tag and metadata value.
+func (f DeviceFilter) matches(device Device) bool {
+	if f.Type != "" && device.Type != f.Type {
+		return false
+	}
+	if f.Status != "" && device.Status != f.Status {
+		return false
+	}
+	if f.Capability != "" {
+		found := false
+		for _, capability := range device.Capabilities {
+			if capability == f.Capability {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, tag := range f.Tags {
+		found := false
+		for _, deviceTag := range device.Tags {
+			if deviceTag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range f.Metadata {
+		if device.Metadata[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func updateDeviceHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req UpdateDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Lab != nil && *req.Lab != "" && !labPattern.MatchString(*req.Lab) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "lab must be lowercase letters, digits and dashes"})
+		return
+	}
+
+	meta := DeviceMetadata{Tags: []string{}, Metadata: map[string]string{}}
+	data, err := redisClient.Get(ctx, metadataKey(deviceID)).Result()
+	if err == nil {
+		if existing := parseDeviceMetadata(deviceID, data); existing != nil {
+			meta = *existing
+		}
+	}
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]string{}
+	}
+
+	if req.Tags != nil {
+		meta.Tags = normalizeTags(*req.Tags)
+	}
+	for key, value := range req.Metadata {
+		if key == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "metadata keys must not be empty"})
+			return
+		}
+		if value == nil {
+			delete(meta.Metadata, key)
+		} else {
+			meta.Metadata[key] = *value
+		}
+	}
+
+	if req.Lab != nil && !moveDeviceToLab(c, deviceID, *req.Lab) {
+		return
+	}
+
+	encoded, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("Error encoding metadata for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
+		return
+	}
+	if err := redisClient.Set(ctx, metadataKey(deviceID), encoded, 0).Err(); err != nil {
+		log.Printf("Error saving metadata for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
+		return
+	}
+	log.Printf("Updated tags and metadata of device %s", deviceID)
+	device, err := loadDevice(deviceID)
+	if err != nil {
+		log.Printf("Error loading device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device"})
+		return
+	}
+	c.JSON(http.StatusOK, device)
+}
+
+// moveDeviceToLab hands the device over to another lab. A device in use
+// stays where it is, as its workflows couldn't release it from their lab.
+func moveDeviceToLab(c *gin.Context, deviceID, lab string) bool {
+	device, err := loadDevice(deviceID)
+	if err != nil {
+		log.Printf("Error loading device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
+		return false
+	}
+	if device.Lab == lab {
+		return true
+	}
+	inUse := device.WorkflowID != ""
+	for _, slot := range device.Slots {
+		inUse = inUse || slot.WorkflowID != ""
+	}
+	if inUse {
+		c.JSON(http.StatusConflict, gin.H{"error": "Device is in use; release it before moving it to another lab"})
+		return false
+	}
+
+	if lab == "" {
+		err = redisClient.Del(ctx, deviceLabKey(deviceID)).Err()
+	} else {
+		err = redisClient.Set(ctx, deviceLabKey(deviceID), lab, 0).Err()
+	}
+	if err != nil {
+		log.Printf("Error moving device %s to lab %q: %v", deviceID, lab, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device"})
+		return false
+	}
+	deviceLabs.invalidate(deviceID)
+	log.Printf("Moved device %s from lab %q to lab %q", deviceID, device.Lab, lab)
+	return true
+}
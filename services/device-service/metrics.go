@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Booking results reported in device_bookings_total.
+const (
+	BookingResultSuccess  = "success"
+	BookingResultConflict = "conflict"
+	BookingResultError    = "error"
+)
+
+// deviceStatuses are the statuses reported by the device_status gauge, so
+// each device exports a full set of series and alerts can match on == 1.
+var deviceStatuses = []string{"available", "busy", "error", "offline"}
+
+var (
+	bookingsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "device_bookings_total",
+		Help: "Booking attempts by device and result (success, conflict or error).",
+	}, []string{"device_id", "result"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "device_operation_duration_seconds",
+		Help:    "Duration of device operations by operation type and outcome.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"operation", "status"})
+
+	operationsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "device_operations_in_flight",
+		Help: "Operations currently executing on each device.",
+	}, []string{"device_id"})
+
+	deviceStatusDesc = prometheus.NewDesc(
+		"device_status",
+		"1 for the device's current status, 0 otherwise.",
+		[]string{"device_id", "status"}, nil)
+
+	reservationsPendingDesc = prometheus.NewDesc(
+		"device_reservations_pending",
+		"Scheduled or active reservations not yet claimed, per device.",
+		[]string{"device_id"}, nil)
+
+	slotsInUseDesc = prometheus.NewDesc(
+		"device_slots_in_use",
+		"Slots held by workflows on multi-slot devices.",
+		[]string{"device_id"}, nil)
+)
+
+// deviceStateCollector reads device state from the store at scrape time, so
+// every replica reports the same values.
+type deviceStateCollector struct{}
+
+func (deviceStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceStatusDesc
+	ch <- reservationsPendingDesc
+	ch <- slotsInUseDesc
+}
+
+func (deviceStateCollector) Collect(ch chan<- prometheus.Metric) {
+	deviceIDs := sortedDeviceIDs()
+	states, err := getDeviceStates(deviceIDs)
+	if err != nil {
+		log.Printf("Error reading device states for metrics: %v", err)
+	}
+
+	for _, deviceID := range deviceIDs {
+		if state, ok := states[deviceID]; ok {
+			for _, status := range deviceStatuses {
+				value := 0.0
+				if state.Status == status {
+					value = 1
+				}
+				ch <- prometheus.MustNewConstMetric(deviceStatusDesc, prometheus.GaugeValue, value, deviceID, status)
+			}
+		}
+
+		if reservations, err := getReservations(deviceID); err == nil {
+			pending := 0
+			for _, r := range reservations {
+				if r.Status == ReservationScheduled || r.Status == ReservationActive {
+					pending++
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(reservationsPendingDesc, prometheus.GaugeValue, float64(pending), deviceID)
+		}
+
+		if isMultiSlot(deviceID) {
+			if holders, err := getSlotHolders(deviceID); err == nil {
+				ch <- prometheus.MustNewConstMetric(slotsInUseDesc, prometheus.GaugeValue, float64(len(holders)), deviceID)
+			}
+		}
+	}
+}
+
+func init() {
+	prometheus.MustRegister(bookingsTotal, operationDuration, operationsInFlight, deviceStateCollector{})
+}
+
+// observeBooking counts a booking attempt by its result.
+func observeBooking(deviceID string, devErr *DeviceError) {
+	result := BookingResultSuccess
+	switch {
+	case devErr == nil:
+	case devErr.StatusCode == http.StatusConflict:
+		result = BookingResultConflict
+	default:
+		result = BookingResultError
+	}
+	bookingsTotal.WithLabelValues(deviceID, result).Inc()
+}
+
+func observeOperation(operation string, duration time.Duration, success bool) {
+	status := OperationCompleted
+	if !success {
+		status = OperationFailed
+	}
+	operationDuration.WithLabelValues(operation, status).Observe(duration.Seconds())
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const DriverMQTT = "mqtt"
+
+const (
+	mqttQoS            = 1
+	mqttConnectTimeout = 10 * time.Second
+)
+
+// Device states reported on devices/{id}/status.
+const (
+	MQTTStateIdle      = "idle"
+	MQTTStateRunning   = "running"
+	MQTTStateCompleted = "completed"
+	MQTTStateFailed    = "failed"
+	MQTTStateOffline   = "offline"
+	MQTTStateOnline    = "online"
+)
+
+// mqttCommand is published to devices/{id}/commands.
+type mqttCommand struct {
+	CommandID string                 `json:"command_id"`
+	Command   string                 `json:"command"`
+	Operation string                 `json:"operation,omitempty"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+// mqttStatus is consumed from devices/{id}/status. Messages carrying a
+// command_id report on that command; others report the device as a whole.
+type mqttStatus struct {
+	CommandID        string                 `json:"command_id,omitempty"`
+	State            string                 `json:"state"`
+	Error            string                 `json:"error,omitempty"`
+	Data             map[string]interface{} `json:"data,omitempty"`
+	FirmwareVersion  string                 `json:"firmware_version,omitempty"`
+	ProtocolVersions []string               `json:"protocol_versions,omitempty"`
+}
+
+// mqttBridge connects device-service to instruments over an MQTT broker.
+type mqttBridge struct {
+	client  mqtt.Client
+	nextID  atomic.Int64
+	mu      sync.Mutex
+	pending map[string]chan mqttStatus
+	states  map[string]string
+}
+
+var bridge *mqttBridge
+
+func telemetryKey(deviceID string) string {
+	return deviceKey(deviceID, "telemetry")
+}
+
+func init() {
+	registerDriver(DriverMQTT, newMQTTDriver)
+}
+
+// connectMQTTBridge connects to the broker and subscribes to device status
+// and telemetry topics, resubscribing after every reconnect.
+func connectMQTTBridge(brokerURL string) (*mqttBridge, error) {
+	b := &mqttBridge{
+		pending: map[string]chan mqttStatus{},
+		states:  map[string]string{},
+	}
+
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = "device-service"
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(brokerURL).
+		SetClientID(clientID).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT connection lost: %v", err)
+		})
+
+	b.client = mqtt.NewClient(opts)
+	token := b.client.Connect()
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return nil, fmt.Errorf("timed out connecting to %s", brokerURL)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *mqttBridge) onConnect(client mqtt.Client) {
+	log.Println("Connected to MQTT broker")
+	client.Subscribe("devices/+/status", mqttQoS, b.handleStatus)
+	client.Subscribe("devices/+/telemetry", mqttQoS, b.handleTelemetry)
+}
+
+// deviceFromTopic extracts the device ID from devices/{id}/... topics.
+func deviceFromTopic(topic string) (string, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) != 3 || parts[0] != "devices" {
+		return "", false
+	}
+	_, ok := deviceFleet()[parts[1]]
+	return parts[1], ok
+}
+
+// decodeMQTTObject decodes a payload that must be a JSON object. null,
+// arrays and bare values are refused rather than leaving v empty.
+func decodeMQTTObject(payload []byte, v interface{}) error {
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) == 0 || trimmed[0] != '{' {
+		return errors.New("payload is not a JSON object")
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func (b *mqttBridge) handleStatus(_ mqtt.Client, msg mqtt.Message) {
+	deviceID, ok := deviceFromTopic(msg.Topic())
+	if !ok {
+		return
+	}
+
+	var status mqttStatus
+	if err := decodeMQTTObject(msg.Payload(), &status); err != nil {
+		log.Printf("Invalid MQTT status from %s: %v", deviceID, err)
+		return
+	}
+
+	b.mu.Lock()
+	b.states[deviceID] = status.State
+	waiter, waiting := b.pending[status.CommandID]
+	b.mu.Unlock()
+
+	if waiting && (status.State == MQTTStateCompleted || status.State == MQTTStateFailed) {
+		select {
+		case waiter <- status:
+		default:
+		}
+		return
+	}
+
+	// Devices announce their firmware when they come online.
+	if status.FirmwareVersion != "" {
+		info := FirmwareInfo{FirmwareVersion: status.FirmwareVersion, ProtocolVersions: status.ProtocolVersions}
+		if err := saveFirmwareInfo(deviceID, info); err != nil {
+			log.Printf("Error saving firmware of device %s: %v", deviceID, err)
+		}
+	}
+
+	// Map connectivity onto the booking model: an offline device can't be
+	// booked, and coming back online restores the status implied by its
+	// booking.
+	switch status.State {
+	case MQTTStateOffline:
+		workflowID := getDeviceWorkflow(deviceID)
+		setDeviceStatus(deviceID, "offline", &workflowID)
+		log.Printf("Device %s reported offline over MQTT", deviceID)
+	case MQTTStateOnline, MQTTStateIdle:
+		if getDeviceStatus(deviceID) != "offline" {
+			return
+		}
+		restoreBookedStatus(deviceID)
+		log.Printf("Device %s back online over MQTT", deviceID)
+	}
+}
+
+func (b *mqttBridge) handleTelemetry(_ mqtt.Client, msg mqtt.Message) {
+	deviceID, ok := deviceFromTopic(msg.Topic())
+	if !ok {
+		return
+	}
+
+	var telemetry map[string]interface{}
+	if err := decodeMQTTObject(msg.Payload(), &telemetry); err != nil {
+		log.Printf("Invalid MQTT telemetry from %s: %v", deviceID, err)
+		return
+	}
+	telemetry["received_at"] = time.Now().UTC().Format(time.RFC3339)
+
+	data, _ := json.Marshal(telemetry)
+	if err := redisClient.Set(ctx, telemetryKey(deviceID), data, 0).Err(); err != nil {
+		log.Printf("Error saving telemetry for device %s: %v", deviceID, err)
+	}
+}
+
+func (b *mqttBridge) publish(deviceID string, command mqttCommand) error {
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	token := b.client.Publish(fmt.Sprintf("devices/%s/commands", deviceID), mqttQoS, false, payload)
+	if !token.WaitTimeout(mqttConnectTimeout) {
+		return fmt.Errorf("timed out publishing command to %s", deviceID)
+	}
+	return token.Error()
+}
+
+// mqttDriver sends commands over the bridge and waits for the matching
+// completed or failed status message.
+type mqttDriver struct {
+	deviceID string
+	timeout  time.Duration
+}
+
+func newMQTTDriver(deviceID string, cfg DriverConfig) (DeviceDriver, error) {
+	if bridge == nil {
+		return nil, fmt.Errorf("mqtt driver requires MQTT_BROKER_URL to be set")
+	}
+	return &mqttDriver{deviceID: deviceID, timeout: cfg.timeout()}, nil
+}
+
+func (d *mqttDriver) Execute(ctx context.Context, operation string, params map[string]interface{}) (*DriverResult, error) {
+	command := mqttCommand{
+		CommandID: fmt.Sprintf("%s-%d", d.deviceID, bridge.nextID.Add(1)),
+		Command:   "execute",
+		Operation: operation,
+		Params:    params,
+	}
+
+	waiter := make(chan mqttStatus, 1)
+	bridge.mu.Lock()
+	bridge.pending[command.CommandID] = waiter
+	bridge.mu.Unlock()
+	defer func() {
+		bridge.mu.Lock()
+		delete(bridge.pending, command.CommandID)
+		bridge.mu.Unlock()
+	}()
+
+	if err := bridge.publish(d.deviceID, command); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+
+	select {
+	case status := <-waiter:
+		if status.State == MQTTStateFailed {
+			return nil, &DriverError{StatusCode: http.StatusBadGateway, Message: status.Error}
+		}
+		return &DriverResult{Data: status.Data}, nil
+	case <-timer.C:
+		return nil, &DriverError{StatusCode: http.StatusGatewayTimeout, Message: "Timed out waiting for device"}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (d *mqttDriver) Status(ctx context.Context) (string, error) {
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	if state, ok := bridge.states[d.deviceID]; ok {
+		return state, nil
+	}
+	return "unknown", nil
+}
+
+func (d *mqttDriver) Abort(ctx context.Context) error {
+	return bridge.publish(d.deviceID, mqttCommand{
+		CommandID: fmt.Sprintf("%s-%d", d.deviceID, bridge.nextID.Add(1)),
+		Command:   "abort",
+	})
+}
+
+func getTelemetryHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	data, err := redisClient.Get(ctx, telemetryKey(deviceID)).Result()
+	if err == redis.Nil && hasChamber(deviceID) && isSimulated(deviceID) {
+		c.JSON(http.StatusOK, simulatedTelemetry(deviceID))
+		return
+	}
+	if err == redis.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No telemetry received"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading telemetry for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve telemetry"})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/json", []byte(data))
+}
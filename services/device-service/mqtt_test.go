@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestDecodeMQTTObject(t *testing.T) {
+	for payload, ok := range map[string]bool{
+		`{"state": "idle"}`:   true,
+		` {"temperature": 4}`: true,
+		`null`:                false,
+		`[{"state": "idle"}]`: false,
+		`"idle"`:              false,
+		``:                    false,
+		`{"state": `:          false,
+	} {
+		var telemetry map[string]interface{}
+		err := decodeMQTTObject([]byte(payload), &telemetry)
+		if (err == nil) != ok {
+			t.Errorf("decodeMQTTObject(%q) = %v, want ok %v", payload, err, ok)
+		}
+		if err == nil && telemetry == nil {
+			t.Errorf("decodeMQTTObject(%q) left a nil map", payload)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const OPERATION_SEQUENCE_KEY = "operations:sequence"
+
+const (
+	OperationCompleted = "completed"
+	OperationFailed    = "failed"
+)
+
+const (
+	defaultOperationHistoryLimit = 50
+	maxOperationHistoryLimit     = 500
+	// maxOperationHistory bounds the stored history per device, since
+	// results such as plate reads can be large.
+	maxOperationHistory = 1000
+)
+
+// OperationRecord is one entry in a device's operation history, including
+// the result data the device returned.
+type OperationRecord struct {
+	ID         string                 `json:"id"`
+	DeviceID   string                 `json:"device_id"`
+	WorkflowID string                 `json:"workflow_id"`
+	Operation  string                 `json:"operation"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	Result     map[string]interface{} `json:"result,omitempty"`
+	StartedAt  string                 `json:"started_at"`
+	DurationMs int64                  `json:"duration_ms"`
+}
+
+type OperationHistoryResponse struct {
+	DeviceID   string            `json:"device_id"`
+	Count      int               `json:"count"`
+	Operations []OperationRecord `json:"operations"`
+}
+
+func operationHistoryKey(deviceID string) string {
+	return deviceKey(deviceID, "operations")
+}
+
+// recordOperationResult appends an executed operation to the device's
+// history and returns its ID.
+func recordOperationResult(record OperationRecord, startedAt time.Time) string {
+	id, err := redisClient.Incr(ctx, OPERATION_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating operation ID: %v", err)
+		return ""
+	}
+	record.ID = fmt.Sprintf("op-%d", id)
+	record.StartedAt = startedAt.UTC().Format(time.RFC3339Nano)
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding operation record: %v", err)
+		return record.ID
+	}
+
+	key := operationHistoryKey(record.DeviceID)
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(startedAt.UnixMilli()), Member: data})
+		pipe.ZRemRangeByRank(ctx, key, 0, -maxOperationHistory-1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error recording operation for device %s: %v", record.DeviceID, err)
+	}
+	return record.ID
+}
+
+func operationHistoryHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	limit := defaultOperationHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxOperationHistoryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxOperationHistoryLimit)})
+			return
+		}
+		limit = n
+	}
+
+	workflowID := c.Query("workflow_id")
+	operation := c.Query("operation")
+	status := c.Query("status")
+
+	members, err := redisClient.ZRevRange(ctx, operationHistoryKey(deviceID), 0, -1).Result()
+	if err != nil {
+		log.Printf("Error reading operation history for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve operation history"})
+		return
+	}
+
+	operations := []OperationRecord{}
+	for _, member := range members {
+		var record OperationRecord
+		if err := json.Unmarshal([]byte(member), &record); err != nil {
+			continue
+		}
+		if workflowID != "" && record.WorkflowID != workflowID {
+			continue
+		}
+		if operation != "" && record.Operation != operation {
+			continue
+		}
+		if status != "" && record.Status != status {
+			continue
+		}
+		operations = append(operations, record)
+		if len(operations) == limit {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, OperationHistoryResponse{
+		DeviceID:   deviceID,
+		Count:      len(operations),
+		Operations: operations,
+	})
+}
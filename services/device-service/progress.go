@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DEVICE_PROGRESS_CHANNEL carries the progress of running operations, as
+// OperationProgress, for live progress bars.
+const DEVICE_PROGRESS_CHANNEL = "device:progress"
+
+// progressTTL bounds how long the progress of an operation outlives the
+// service running it, should it die mid-operation.
+const progressTTL = time.Hour
+
+// maxProgressUpdates caps how often one operation reports its progress.
+const maxProgressUpdates = 100
+
+// OperationProgress is how far a running operation has got. Drivers that
+// can't tell report 0 until the operation ends.
+type OperationProgress struct {
+	DeviceID        string `json:"device_id"`
+	WorkflowID      string `json:"workflow_id"`
+	Operation       string `json:"operation"`
+	ProgressPercent int    `json:"progress_percent"`
+	CyclesCompleted int    `json:"cycles_completed"`
+	CyclesTotal     int    `json:"cycles_total"`
+	StartedAt       string `json:"started_at"`
+	UpdatedAt       string `json:"updated_at"`
+	Lab             string `json:"lab,omitempty"`
+}
+
+type OperationProgressResponse struct {
+	DeviceID   string              `json:"device_id"`
+	Operations []OperationProgress `json:"operations"`
+}
+
+func progressKey(deviceID string) string {
+	return deviceKey(deviceID, "progress")
+}
+
+type progressReporterKey struct{}
+
+// progressReporter is how drivers report the progress of the operation
+// they run: completed of total cycles.
+type progressReporter func(completed, total int)
+
+// withProgress gives the drivers running an operation under ctx somewhere
+// to report its progress.
+func withProgress(ctx context.Context, report progressReporter) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, report)
+}
+
+// reportProgress reports the progress of the operation running under ctx,
+// if anything is listening.
+func reportProgress(ctx context.Context, completed, total int) {
+	if report, ok := ctx.Value(progressReporterKey{}).(progressReporter); ok {
+		report(completed, total)
+	}
+}
+
+// trackProgress records an operation as started, with no progress, and
+// returns the reporter its driver updates it with and a function to call
+// when it ends, which clears it.
+func trackProgress(deviceID, workflowID, operation string) (progressReporter, func()) {
+	lab, err := getDeviceLab(deviceID)
+	if err != nil {
+		log.Printf("Error getting lab of device %s: %v", deviceID, err)
+	}
+	progress := OperationProgress{
+		DeviceID:   deviceID,
+		WorkflowID: workflowID,
+		Operation:  operation,
+		StartedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+		Lab:        lab,
+	}
+	saveProgress(progress)
+
+	report := func(completed, total int) {
+		if total <= 0 || completed < 0 {
+			return
+		}
+		progress.CyclesCompleted, progress.CyclesTotal = min(completed, total), total
+		progress.ProgressPercent = progress.CyclesCompleted * 100 / total
+		saveProgress(progress)
+	}
+	done := func() {
+		if err := redisClient.HDel(ctx, progressKey(deviceID), workflowID).Err(); err != nil {
+			log.Printf("Error clearing progress of workflow %s on device %s: %v", workflowID, deviceID, err)
+		}
+	}
+	return report, done
+}
+
+// saveProgress stores an operation's progress and publishes it.
+func saveProgress(progress OperationProgress) {
+	progress.UpdatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(progress)
+	if err != nil {
+		log.Printf("Error encoding operation progress: %v", err)
+		return
+	}
+	key := progressKey(progress.DeviceID)
+	pipe := redisClient.TxPipeline()
+	pipe.HSet(ctx, key, progress.WorkflowID, data)
+	pipe.Expire(ctx, key, progressTTL)
+	pipe.Publish(ctx, DEVICE_PROGRESS_CHANNEL, data)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error saving progress of workflow %s on device %s: %v", progress.WorkflowID, progress.DeviceID, err)
+	}
+}
+
+// getProgress returns the progress of the operations running on the device,
+// by workflow ID.
+func getProgress(deviceID string) ([]OperationProgress, error) {
+	entries, err := redisClient.HGetAll(ctx, progressKey(deviceID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	operations := []OperationProgress{}
+	for _, data := range entries {
+		var progress OperationProgress
+		if json.Unmarshal([]byte(data), &progress) == nil {
+			operations = append(operations, progress)
+		}
+	}
+	sort.Slice(operations, func(i, j int) bool {
+		return operations[i].StartedAt < operations[j].StartedAt
+	})
+	return operations, nil
+}
+
+// simulatedCycles is how many cycles a simulated operation reports: its
+// cycles param if it has one, or maxProgressUpdates steps of progress.
+func simulatedCycles(params map[string]interface{}) int {
+	if cycles, ok := params["cycles"].(float64); ok && cycles >= 1 {
+		return int(cycles)
+	}
+	return maxProgressUpdates
+}
+
+// deviceProgressHandler returns the progress of the operations running on
+// the device, oldest first; ?workflow_id= keeps one workflow's.
+func deviceProgressHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	operations, err := getProgress(deviceID)
+	if err != nil {
+		log.Printf("Error reading progress of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve progress"})
+		return
+	}
+	if workflowID := c.Query("workflow_id"); workflowID != "" {
+		filtered := []OperationProgress{}
+		for _, progress := range operations {
+			if progress.WorkflowID == workflowID {
+				filtered = append(filtered, progress)
+			}
+		}
+		operations = filtered
+	}
+
+	c.JSON(http.StatusOK, OperationProgressResponse{DeviceID: deviceID, Operations: operations})
+}
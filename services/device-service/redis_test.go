@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"platform/redistest"
+)
+
+// startFakeRedis serves a fake Redis until the test ends and points
+// redisClient at it.
+func startFakeRedis(t *testing.T) *redistest.Server {
+	return useFakeRedis(t, redistest.Start(t))
+}
+
+// startFakeRedisCluster is startFakeRedis with a cluster client.
+func startFakeRedisCluster(t *testing.T) *redistest.Server {
+	return useFakeRedis(t, redistest.StartCluster(t))
+}
+
+func useFakeRedis(t *testing.T, r *redistest.Server) *redistest.Server {
+	previous := redisClient
+	redisClient = r.Client()
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = previous
+	})
+	return r
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"platform"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// The /admin/storage API lets admins look into the Redis keys this service
+// keeps, and fix corrupt ones, without a shell on the Redis host. Only the
+// service's own keys, those starting with one of redisKeyPrefixes, can be
+// read or changed. Every change is recorded, with the value it replaced,
+// in the list storage_audit:device-service, newest first; the audit logs
+// themselves can be read but not changed.
+const (
+	STORAGE_AUDIT_KEY = "storage_audit:" + AUDIT_SERVICE
+	maxStorageAudit   = 1000
+	defaultScanCount  = 100
+	maxScanCount      = 1000
+)
+
+// redisKeyPrefixes are the keys the service keeps, the feature flags it
+// manages among them.
+var redisKeyPrefixes = []string{
+	"device:",
+	"devices:",
+	"bookings:",
+	"faults:",
+	"operations:",
+	"reservations:",
+	"sila:",
+	"sila-lock:",
+	platform.FEATURE_FLAGS_KEY,
+	AUDIT_LOG_KEY,
+	AUDIT_LOG_SEQUENCE_KEY,
+	STORAGE_AUDIT_KEY,
+}
+
+// ownsRedisKey reports whether the key is one the service keeps.
+func ownsRedisKey(key string) bool {
+	for _, prefix := range redisKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedisKey is a key as listed, with its type and how long it has left if
+// it expires.
+type RedisKey struct {
+	Key        string `json:"key"`
+	Type       string `json:"type"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+}
+
+// RedisKeyList is a page of keys; cursor is "0" once every key has been
+// listed.
+type RedisKeyList struct {
+	Keys   []RedisKey `json:"keys"`
+	Cursor string     `json:"cursor"`
+}
+
+// RedisMember is a sorted set member with its score.
+type RedisMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// RedisRecord is a key's raw value: a string, a hash's fields, a list's
+// items, a set's members or a sorted set's members with their scores.
+// InvalidJSON lists what starts like JSON but doesn't parse, as corrupt
+// records do: "" for the string, or the hash fields or list indexes.
+type RedisRecord struct {
+	Key         string      `json:"key"`
+	Type        string      `json:"type"`
+	TTLSeconds  int64       `json:"ttl_seconds,omitempty"`
+	Value       interface{} `json:"value"`
+	InvalidJSON []string    `json:"invalid_json,omitempty"`
+}
+
+// RedisWrite replaces a key with a value of the type, or with field sets
+// one field of a hash to value, a string. TTLSeconds sets the key to
+// expire; otherwise a replaced key keeps the time it had left.
+type RedisWrite struct {
+	Type       string          `json:"type,omitempty"`
+	Field      string          `json:"field,omitempty"`
+	Value      json.RawMessage `json:"value" binding:"required"`
+	TTLSeconds int64           `json:"ttl_seconds,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+}
+
+// Actions in the storage audit.
+const (
+	StorageActionReplace     = "replace"
+	StorageActionDelete      = "delete"
+	StorageActionSetField    = "set_field"
+	StorageActionDeleteField = "delete_field"
+)
+
+// StorageAuditEntry is one change made through the /admin/storage API.
+// Previous is the record, or for a field its value, as it was.
+type StorageAuditEntry struct {
+	Action    string      `json:"action"`
+	Key       string      `json:"key"`
+	Field     string      `json:"field,omitempty"`
+	Previous  interface{} `json:"previous"`
+	Value     interface{} `json:"value,omitempty"`
+	Reason    string      `json:"reason,omitempty"`
+	Actor     string      `json:"actor,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	At        string      `json:"at"`
+}
+
+// looksInvalidJSON reports whether the value starts like a JSON object or
+// array but doesn't parse.
+func looksInvalidJSON(value string) bool {
+	trimmed := strings.TrimSpace(value)
+	return (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && !json.Valid([]byte(trimmed))
+}
+
+// readRedisRecord returns the key's record, or nil if there is no such key.
+func readRedisRecord(cmd redis.Cmdable, key string) (*RedisRecord, error) {
+	keyType, err := cmd.Type(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	record := &RedisRecord{Key: key, Type: keyType}
+	switch keyType {
+	case "none":
+		return nil, nil
+	case "string":
+		value, err := cmd.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		record.Value = value
+		if looksInvalidJSON(value) {
+			record.InvalidJSON = []string{""}
+		}
+	case "hash":
+		fields, err := cmd.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		record.Value = fields
+		for field, value := range fields {
+			if looksInvalidJSON(value) {
+				record.InvalidJSON = append(record.InvalidJSON, field)
+			}
+		}
+		sort.Strings(record.InvalidJSON)
+	case "list":
+		items, err := cmd.LRange(ctx, key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		record.Value = items
+		for i, item := range items {
+			if looksInvalidJSON(item) {
+				record.InvalidJSON = append(record.InvalidJSON, strconv.Itoa(i))
+			}
+		}
+	case "set":
+		members, err := cmd.SMembers(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(members)
+		record.Value = members
+	case "zset":
+		scored, err := cmd.ZRangeWithScores(ctx, key, 0, -1).Result()
+		if err != nil {
+			return nil, err
+		}
+		members := make([]RedisMember, len(scored))
+		for i, z := range scored {
+			members[i] = RedisMember{Member: fmt.Sprint(z.Member), Score: z.Score}
+		}
+		record.Value = members
+	default:
+		// Streams and other types are listed but not shown.
+	}
+
+	ttl, err := cmd.TTL(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		record.TTLSeconds = int64(ttl / time.Second)
+	}
+	return record, nil
+}
+
+// decodeRedisValue checks a value given for a key of the type: a string,
+// an object of string fields, an array of strings, or for a sorted set an
+// array of members with scores. Hashes, lists and sets can't be empty, as
+// Redis doesn't keep them.
+func decodeRedisValue(keyType string, raw json.RawMessage) (interface{}, error) {
+	var value interface{}
+	var length int
+	var err error
+	switch keyType {
+	case "string":
+		var s string
+		err = json.Unmarshal(raw, &s)
+		value, length = s, 1
+	case "hash":
+		var fields map[string]string
+		err = json.Unmarshal(raw, &fields)
+		value, length = fields, len(fields)
+	case "list", "set":
+		var items []string
+		err = json.Unmarshal(raw, &items)
+		value, length = items, len(items)
+	case "zset":
+		var members []RedisMember
+		err = json.Unmarshal(raw, &members)
+		value, length = members, len(members)
+	default:
+		return nil, fmt.Errorf("type must be string, hash, list, set or zset")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("value isn't a valid %s: %v", keyType, err)
+	}
+	if length == 0 {
+		return nil, fmt.Errorf("value must not be empty; delete the key instead")
+	}
+	return value, nil
+}
+
+// writeRedisValue queues writing the value, as decoded by
+// decodeRedisValue for a key of the type, to the key.
+func writeRedisValue(pipe redis.Pipeliner, key, keyType string, value interface{}) {
+	switch keyType {
+	case "string":
+		pipe.Set(ctx, key, value, 0)
+	case "hash":
+		pipe.HSet(ctx, key, value)
+	case "list":
+		pipe.RPush(ctx, key, value)
+	case "set":
+		pipe.SAdd(ctx, key, value)
+	case "zset":
+		members := make([]redis.Z, len(value.([]RedisMember)))
+		for i, m := range value.([]RedisMember) {
+			members[i] = redis.Z{Member: m.Member, Score: m.Score}
+		}
+		pipe.ZAdd(ctx, key, members...)
+	}
+}
+
+// storageKeyParam returns the key the request names, responding with 404
+// if it isn't one of the service's.
+func storageKeyParam(c *gin.Context) (string, bool) {
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	if key == "" || !ownsRedisKey(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not a " + AUDIT_SERVICE + " key"})
+		return "", false
+	}
+	return key, true
+}
+
+// listRedisKeysHandler lists a page of the service's keys, with prefix
+// narrowing them down. Pass the cursor returned to get the next page.
+func listRedisKeysHandler(c *gin.Context) {
+	cursor, err := strconv.ParseUint(c.DefaultQuery("cursor", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cursor must be one returned by a previous page"})
+		return
+	}
+	count := defaultScanCount
+	if value := c.Query("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxScanCount {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", maxScanCount)})
+			return
+		}
+		count = n
+	}
+	match := escapeRedisPattern(c.Query("prefix")) + "*"
+
+	keys, next, err := redisClient.Scan(ctx, cursor, match, int64(count)).Result()
+	if err != nil {
+		log.Printf("Error listing Redis keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list keys"})
+		return
+	}
+	owned := []string{}
+	for _, key := range keys {
+		if ownsRedisKey(key) {
+			owned = append(owned, key)
+		}
+	}
+	sort.Strings(owned)
+
+	pipe := redisClient.Pipeline()
+	types := make([]*redis.StatusCmd, len(owned))
+	ttls := make([]*redis.DurationCmd, len(owned))
+	for i, key := range owned {
+		types[i] = pipe.Type(ctx, key)
+		ttls[i] = pipe.TTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Printf("Error describing Redis keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list keys"})
+		return
+	}
+
+	list := RedisKeyList{Keys: []RedisKey{}, Cursor: strconv.FormatUint(next, 10)}
+	for i, key := range owned {
+		entry := RedisKey{Key: key, Type: types[i].Val()}
+		if entry.Type == "none" {
+			// Gone since it was scanned
+			continue
+		}
+		if ttl := ttls[i].Val(); ttl > 0 {
+			entry.TTLSeconds = int64(ttl / time.Second)
+		}
+		list.Keys = append(list.Keys, entry)
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// escapeRedisPattern escapes the characters SCAN's MATCH treats specially.
+func escapeRedisPattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+// getRedisKeyHandler shows a key's raw record, or with ?field= one field of
+// a hash.
+func getRedisKeyHandler(c *gin.Context) {
+	key, ok := storageKeyParam(c)
+	if !ok {
+		return
+	}
+	record, err := readRedisRecord(redisClient, key)
+	if err != nil {
+		log.Printf("Error reading Redis key %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read key"})
+		return
+	}
+	if record == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+
+	field, hasField := c.GetQuery("field")
+	if !hasField {
+		c.JSON(http.StatusOK, record)
+		return
+	}
+	fields, isHash := record.Value.(map[string]string)
+	if !isHash {
+		c.JSON(http.StatusConflict, gin.H{"error": "Key is a " + record.Type + ", not a hash"})
+		return
+	}
+	value, ok := fields[field]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Field not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": key, "field": field, "value": value, "invalid_json": looksInvalidJSON(value)})
+}
+
+// putRedisKeyHandler replaces a key, or sets one field of a hash.
+func putRedisKeyHandler(c *gin.Context) {
+	key, ok := storageKeyParam(c)
+	if !ok {
+		return
+	}
+	var req RedisWrite
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.TTLSeconds < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds must not be negative"})
+		return
+	}
+
+	entry := StorageAuditEntry{Action: StorageActionReplace, Key: key, Field: req.Field, Reason: req.Reason}
+	keyType := req.Type
+	if req.Field != "" {
+		entry.Action, keyType = StorageActionSetField, "string"
+	}
+	value, err := decodeRedisValue(keyType, req.Value)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entry.Value = value
+
+	changeRedisKey(c, entry, func(previous *RedisRecord, pipe redis.Pipeliner) error {
+		if req.Field != "" {
+			if previous != nil && previous.Type != "hash" {
+				return &storageError{http.StatusConflict, "Key is a " + previous.Type + ", not a hash"}
+			}
+			pipe.HSet(ctx, key, req.Field, value)
+			return nil
+		}
+		pipe.Del(ctx, key)
+		writeRedisValue(pipe, key, req.Type, value)
+		ttl := time.Duration(req.TTLSeconds) * time.Second
+		if ttl == 0 && previous != nil {
+			ttl = time.Duration(previous.TTLSeconds) * time.Second
+		}
+		if ttl > 0 {
+			pipe.Expire(ctx, key, ttl)
+		}
+		return nil
+	})
+}
+
+// deleteRedisKeyHandler deletes a key, or with ?field= one field of a
+// hash. ?reason= is kept in the storage audit.
+func deleteRedisKeyHandler(c *gin.Context) {
+	key, ok := storageKeyParam(c)
+	if !ok {
+		return
+	}
+	field, hasField := c.GetQuery("field")
+	entry := StorageAuditEntry{Action: StorageActionDelete, Key: key, Field: field, Reason: c.Query("reason")}
+	if hasField {
+		entry.Action = StorageActionDeleteField
+	}
+
+	changeRedisKey(c, entry, func(previous *RedisRecord, pipe redis.Pipeliner) error {
+		if previous == nil {
+			return &storageError{http.StatusNotFound, "Key not found"}
+		}
+		if !hasField {
+			pipe.Del(ctx, key)
+			return nil
+		}
+		if previous.Type != "hash" {
+			return &storageError{http.StatusConflict, "Key is a " + previous.Type + ", not a hash"}
+		}
+		if _, ok := previous.Value.(map[string]string)[field]; !ok {
+			return &storageError{http.StatusNotFound, "Field not found"}
+		}
+		pipe.HDel(ctx, key, field)
+		return nil
+	})
+}
+
+// storageError is a change refused, with the status to respond with.
+type storageError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *storageError) Error() string {
+	return e.Message
+}
+
+// changeRedisKey makes a change to a key in a transaction, then records the
+// entry in the storage audit. The audit is written apart from the change,
+// as device keys are in other hash slots on a cluster. change queues the
+// writes, given the key's record as it is; a key changed meanwhile gets 409.
+func changeRedisKey(c *gin.Context, entry StorageAuditEntry, change func(previous *RedisRecord, pipe redis.Pipeliner) error) {
+	if entry.Key == AUDIT_LOG_KEY || entry.Key == STORAGE_AUDIT_KEY {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Audit logs can't be changed"})
+		return
+	}
+	entry.Actor = requestActor(c)
+	entry.RequestID = c.GetHeader("X-Request-ID")
+	entry.At = time.Now().UTC().Format(time.RFC3339)
+
+	err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		previous, err := readRedisRecord(tx, entry.Key)
+		if err != nil {
+			return err
+		}
+		entry.Previous = previous
+		if entry.Field != "" && previous != nil {
+			if value, ok := previous.Value.(map[string]string)[entry.Field]; ok {
+				entry.Previous = value
+			} else {
+				entry.Previous = nil
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return change(previous, pipe)
+		})
+		return err
+	}, entry.Key)
+	if err == nil {
+		recordStorageAudit(entry)
+	}
+
+	var refused *storageError
+	switch {
+	case errors.As(err, &refused):
+		c.JSON(refused.StatusCode, gin.H{"error": refused.Message})
+	case err == redis.TxFailedErr:
+		c.JSON(http.StatusConflict, gin.H{"error": "Key changed while being written; read it again"})
+	case err != nil:
+		log.Printf("Error writing Redis key %s: %v", entry.Key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write key"})
+	default:
+		invalidateAllCaches()
+		log.Printf("Redis key %s: %s by %s (%s)", entry.Key, entry.Action, entry.Actor, entry.Reason)
+		c.JSON(http.StatusOK, entry)
+	}
+}
+
+func recordStorageAudit(entry StorageAuditEntry) {
+	data, err := json.Marshal(entry)
+	if err == nil {
+		_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LPush(ctx, STORAGE_AUDIT_KEY, data)
+			pipe.LTrim(ctx, STORAGE_AUDIT_KEY, 0, maxStorageAudit-1)
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("Error recording change to Redis key %s in the storage audit: %v", entry.Key, err)
+	}
+}
+
+// storageAuditHandler lists the changes made through the /admin/storage
+// API, newest first, those to one key with ?key=.
+func storageAuditHandler(c *gin.Context) {
+	limit := defaultAuditLogLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxStorageAudit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxStorageAudit)})
+			return
+		}
+		limit = n
+	}
+	key := c.Query("key")
+
+	values, err := redisClient.LRange(ctx, STORAGE_AUDIT_KEY, 0, -1).Result()
+	if err != nil {
+		log.Printf("Error reading storage audit: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve storage audit"})
+		return
+	}
+	entries := []StorageAuditEntry{}
+	for _, value := range values {
+		var entry StorageAuditEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			log.Printf("Invalid storage audit entry: %v", err)
+			continue
+		}
+		if key != "" && entry.Key != key {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) == limit {
+			break
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"count": len(entries), "entries": entries})
+}
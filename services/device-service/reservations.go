@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const RESERVATION_SEQUENCE_KEY = "reservations:sequence"
+
+// Reservation states, computed on read.
+const (
+	ReservationScheduled = "scheduled"
+	ReservationActive    = "active"
+	ReservationClaimed   = "claimed"
+	ReservationExpired   = "expired"
+)
+
+const (
+	// reservationEarlyClaim lets a workflow book its reserved device shortly
+	// before the window opens.
+	reservationEarlyClaim = 5 * time.Minute
+	// reservationWarnWithin is how far ahead walk-up bookings are warned
+	// about upcoming reservations held by other workflows.
+	reservationWarnWithin = time.Hour
+)
+
+// Reservation holds a device for a workflow over a future time window.
+type Reservation struct {
+	ID         string `json:"id"`
+	DeviceID   string `json:"device_id"`
+	WorkflowID string `json:"workflow_id"`
+	Start      string `json:"start"`
+	End        string `json:"end"`
+	Note       string `json:"note,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	ClaimedAt  string `json:"claimed_at,omitempty"`
+	Status     string `json:"status"`
+}
+
+type CreateReservationRequest struct {
+	WorkflowID string `json:"workflow_id" binding:"required"`
+	Start      string `json:"start" binding:"required"`
+	End        string `json:"end" binding:"required"`
+	Note       string `json:"note"`
+}
+
+var errReservationConflict = errors.New("reservation conflict")
+
+func reservationsKey(deviceID string) string {
+	return deviceKey(deviceID, "reservations")
+}
+
+func (r Reservation) window() (time.Time, time.Time) {
+	start, _ := time.Parse(time.RFC3339, r.Start)
+	end, _ := time.Parse(time.RFC3339, r.End)
+	return start, end
+}
+
+func (r Reservation) overlaps(start, end time.Time) bool {
+	rStart, rEnd := r.window()
+	return rStart.Before(end) && start.Before(rEnd)
+}
+
+func (r *Reservation) computeStatus(now time.Time) {
+	start, end := r.window()
+	switch {
+	case r.ClaimedAt != "":
+		r.Status = ReservationClaimed
+	case now.Before(start):
+		r.Status = ReservationScheduled
+	case now.Before(end):
+		r.Status = ReservationActive
+	default:
+		r.Status = ReservationExpired
+	}
+}
+
+// getReservations returns the device's reservations ordered by start time.
+func getReservations(deviceID string) ([]Reservation, error) {
+	values, err := redisClient.HVals(ctx, reservationsKey(deviceID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	reservations := make([]Reservation, 0, len(values))
+	for _, value := range values {
+		var r Reservation
+		if err := json.Unmarshal([]byte(value), &r); err != nil {
+			log.Printf("Invalid reservation for device %s: %v", deviceID, err)
+			continue
+		}
+		r.computeStatus(now)
+		reservations = append(reservations, r)
+	}
+	sort.Slice(reservations, func(i, j int) bool {
+		return reservations[i].Start < reservations[j].Start
+	})
+	return reservations, nil
+}
+
+func saveReservation(pipe redis.Pipeliner, r Reservation) error {
+	r.Status = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return pipe.HSet(ctx, reservationsKey(r.DeviceID), r.ID, data).Err()
+}
+
+// createReservation stores the reservation unless it overlaps an existing
+// one, in which case the conflicting reservation is returned.
+func createReservation(r Reservation) (*Reservation, error) {
+	start, end := r.window()
+	var conflict *Reservation
+
+	err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		existing, err := getReservations(r.DeviceID)
+		if err != nil {
+			return err
+		}
+		for _, other := range existing {
+			if other.overlaps(start, end) {
+				conflict = &other
+				return errReservationConflict
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return saveReservation(pipe, r)
+		})
+		return err
+	}, reservationsKey(r.DeviceID))
+
+	if err == errReservationConflict {
+		return conflict, err
+	}
+	return nil, err
+}
+
+// checkReservation checks a walk-up booking against the reservation
+// calendar. A workflow booking inside its own reservation gets it back, to
+// claim once the device is booked; any other workflow is turned away until
+// the reservation ends. The returned warning describes an upcoming
+// reservation held by someone else.
+func checkReservation(deviceID, workflowID string, now time.Time) (*Reservation, *DeviceError, string) {
+	reservations, err := getReservations(deviceID)
+	if err != nil {
+		log.Printf("Error reading reservations for device %s: %v", deviceID, err)
+		return nil, nil, ""
+	}
+
+	warning := ""
+	for _, r := range reservations {
+		start, end := r.window()
+		if !now.Before(end) {
+			continue
+		}
+		if now.Before(start.Add(-reservationEarlyClaim)) {
+			if warning == "" && r.WorkflowID != workflowID && start.Before(now.Add(reservationWarnWithin)) {
+				warning = fmt.Sprintf("Device is reserved by workflow %s from %s", r.WorkflowID, r.Start)
+			}
+			continue
+		}
+
+		if r.WorkflowID != workflowID {
+			log.Printf("Device %s is reserved by workflow %s until %s", deviceID, r.WorkflowID, r.End)
+			return nil, &DeviceError{
+				StatusCode: http.StatusConflict,
+				Code:       ErrorCodeDeviceReserved,
+				Message:    fmt.Sprintf("Device is reserved by another workflow until %s", r.End),
+			}, ""
+		}
+		return &r, nil, warning
+	}
+	return nil, nil, warning
+}
+
+// claimReservation marks a reservation claimed by the booking its workflow
+// has just made. Bookings that fail leave the reservation unclaimed.
+func claimReservation(r Reservation, now time.Time) {
+	if r.ClaimedAt != "" {
+		return
+	}
+	r.ClaimedAt = now.Format(time.RFC3339)
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return saveReservation(pipe, r)
+	})
+	if err != nil {
+		log.Printf("Error claiming reservation %s: %v", r.ID, err)
+		return
+	}
+	log.Printf("Workflow %s claimed reservation %s on device %s", r.WorkflowID, r.ID, r.DeviceID)
+}
+
+func parseReservationWindow(startValue, endValue string) (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339, startValue)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("start must be an RFC 3339 timestamp")
+	}
+	end, err := time.Parse(time.RFC3339, endValue)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("end must be an RFC 3339 timestamp")
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end must be after start")
+	}
+	if !end.After(time.Now()) {
+		return time.Time{}, time.Time{}, fmt.Errorf("reservation must end in the future")
+	}
+	return start.UTC(), end.UTC(), nil
+}
+
+// filterReservations keeps the reservations overlapping [from, to); either
+// bound may be empty.
+func filterReservations(reservations []Reservation, from, to string) ([]Reservation, error) {
+	start := time.Time{}
+	end := time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	if from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", from)
+		}
+		start = t
+	}
+	if to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", to)
+		}
+		end = t
+	}
+
+	filtered := []Reservation{}
+	for _, r := range reservations {
+		if r.overlaps(start, end) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered, nil
+}
+
+func listReservationsHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	reservations, err := getReservations(deviceID)
+	if err != nil {
+		log.Printf("Error reading reservations for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reservations"})
+		return
+	}
+	reservations, err = filterReservations(reservations, c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, reservations)
+}
+
+// reservationCalendarHandler lists reservations across the lab's devices.
+func reservationCalendarHandler(c *gin.Context) {
+	deviceIDs, err := labDeviceIDs(requestLab(c))
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reservations"})
+		return
+	}
+	calendar := map[string][]Reservation{}
+	for _, deviceID := range deviceIDs {
+		reservations, err := getReservations(deviceID)
+		if err != nil {
+			log.Printf("Error reading reservations for device %s: %v", deviceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reservations"})
+			return
+		}
+		reservations, err = filterReservations(reservations, c.Query("from"), c.Query("to"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		calendar[deviceID] = reservations
+	}
+
+	c.JSON(http.StatusOK, calendar)
+}
+
+func createReservationHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var req CreateReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	start, end, err := parseReservationWindow(req.Start, req.End)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	seq, err := redisClient.Incr(ctx, RESERVATION_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating reservation ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reservation"})
+		return
+	}
+
+	reservation := Reservation{
+		ID:         fmt.Sprintf("res-%d", seq),
+		DeviceID:   deviceID,
+		WorkflowID: req.WorkflowID,
+		Start:      start.Format(time.RFC3339),
+		End:        end.Format(time.RFC3339),
+		Note:       req.Note,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	conflict, err := createReservation(reservation)
+	if err == errReservationConflict {
+		log.Printf("Reservation of device %s for workflow %s conflicts with %s", deviceID, req.WorkflowID, conflict.ID)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    "Reservation overlaps an existing reservation",
+			"conflict": conflict,
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving reservation for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reservation"})
+		return
+	}
+
+	log.Printf("Reserved device %s for workflow %s from %s to %s", deviceID, req.WorkflowID, reservation.Start, reservation.End)
+	reservation.computeStatus(time.Now().UTC())
+	c.JSON(http.StatusCreated, reservation)
+}
+
+func cancelReservationHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	reservationID := c.Param("reservation_id")
+	removed, err := redisClient.HDel(ctx, reservationsKey(deviceID), reservationID).Result()
+	if err != nil {
+		log.Printf("Error cancelling reservation %s: %v", reservationID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel reservation"})
+		return
+	}
+	if removed == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return
+	}
+
+	log.Printf("Cancelled reservation %s on device %s", reservationID, deviceID)
+	c.JSON(http.StatusOK, gin.H{"id": reservationID, "status": "cancelled"})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Booking and operation history older than DEVICE_HISTORY_RETENTION (a
+// duration such as 720h) is deleted by a janitor running every
+// RETENTION_CHECK_INTERVAL. Devices tagged RETENTION_EXEMPT_TAG keep all
+// of theirs. With RETENTION_DRY_RUN=true the janitor only logs what it
+// would delete.
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionExemptTag = "retain"
+)
+
+var (
+	historyRetention   time.Duration
+	retentionDryRun    bool
+	retentionExemptTag = defaultRetentionExemptTag
+)
+
+// RetentionReport counts the history entries a cleanup deleted from each
+// device, or with DryRun would have.
+type RetentionReport struct {
+	DryRun    bool           `json:"dry_run"`
+	Retention string         `json:"retention"`
+	Cutoff    string         `json:"cutoff"`
+	Expired   map[string]int `json:"expired"`
+	Exempt    []string       `json:"exempt"`
+}
+
+func deviceExempt(deviceID string) bool {
+	data, err := redisClient.Get(ctx, metadataKey(deviceID)).Result()
+	if err != nil {
+		return false
+	}
+	meta := parseDeviceMetadata(deviceID, data)
+	if meta == nil {
+		return false
+	}
+	for _, tag := range meta.Tags {
+		if tag == retentionExemptTag {
+			return true
+		}
+	}
+	return false
+}
+
+// trimDeviceHistories deletes the history entries recorded before the
+// cutoff, unless dryRun is set.
+func trimDeviceHistories(cutoff time.Time, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{
+		DryRun:    dryRun,
+		Retention: historyRetention.String(),
+		Cutoff:    cutoff.Format(time.RFC3339),
+		Expired:   map[string]int{},
+		Exempt:    []string{},
+	}
+	// Scores are times in milliseconds; "(" excludes the cutoff itself.
+	max := "(" + strconv.FormatInt(cutoff.UnixMilli(), 10)
+	for _, deviceID := range sortedDeviceIDs() {
+		if deviceExempt(deviceID) {
+			report.Exempt = append(report.Exempt, deviceID)
+			continue
+		}
+		keys := []string{bookingHistoryKey(deviceID), operationHistoryKey(deviceID)}
+		var counts []*redis.IntCmd
+		_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				if dryRun {
+					counts = append(counts, pipe.ZCount(ctx, key, "-inf", max))
+				} else {
+					counts = append(counts, pipe.ZRemRangeByScore(ctx, key, "-inf", max))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		total := 0
+		for _, count := range counts {
+			total += int(count.Val())
+		}
+		if total > 0 {
+			report.Expired[deviceID] = total
+		}
+	}
+	return report, nil
+}
+
+// startRetentionJanitor trims device histories in the background if
+// DEVICE_HISTORY_RETENTION is set.
+func startRetentionJanitor() {
+	if tag := strings.ToLower(strings.TrimSpace(os.Getenv("RETENTION_EXEMPT_TAG"))); tag != "" {
+		retentionExemptTag = tag
+	}
+	retentionDryRun = os.Getenv("RETENTION_DRY_RUN") == "true"
+	value := os.Getenv("DEVICE_HISTORY_RETENTION")
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid DEVICE_HISTORY_RETENTION %q", value)
+	}
+	historyRetention = d
+	interval := defaultRetentionInterval
+	if value := os.Getenv("RETENTION_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RETENTION_CHECK_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report, err := trimDeviceHistories(time.Now().Add(-historyRetention), retentionDryRun)
+			switch {
+			case err != nil:
+				log.Printf("Error trimming device histories: %v", err)
+			case len(report.Expired) > 0:
+				verb := "Deleted"
+				if report.DryRun {
+					verb = "Retention dry run: would delete"
+				}
+				for deviceID, count := range report.Expired {
+					log.Printf("%s %d history entries of device %s recorded before %s", verb, count, deviceID, report.Cutoff)
+				}
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Deleting device history %s after it is recorded, checking every %s (dry run: %t)", historyRetention, interval, retentionDryRun)
+}
+
+// retentionReportHandler reports how much history the retention policy
+// would delete now, deleting nothing. ?older_than=<duration> tries another
+// retention.
+func retentionReportHandler(c *gin.Context) {
+	retention := historyRetention
+	if value := c.Query("older_than"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "older_than must be a positive duration such as 720h"})
+			return
+		}
+		retention = d
+	}
+	if retention == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "DEVICE_HISTORY_RETENTION is not set; give older_than"})
+		return
+	}
+
+	report, err := trimDeviceHistories(time.Now().Add(-retention), true)
+	if err != nil {
+		log.Printf("Error checking history retention: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check history retention"})
+		return
+	}
+	report.Retention = retention.String()
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of schedule entry.
+const (
+	ScheduleBooking     = "booking"
+	ScheduleQueued      = "queued"
+	ScheduleReservation = "reservation"
+)
+
+const (
+	defaultScheduleHorizon = 24 * time.Hour
+	maxScheduleHorizon     = 30 * 24 * time.Hour
+	// scheduleEstimateWindow is how far back bookings are averaged to
+	// estimate how long the current and queued ones will take.
+	scheduleEstimateWindow = 7 * 24 * time.Hour
+)
+
+// ScheduleEntry is a span of time a device is, or is expected to be, held
+// by a workflow. Estimated entries' times are guesses from the device's
+// average booking; entries without a start or end can't be estimated yet.
+type ScheduleEntry struct {
+	Kind          string `json:"kind"`
+	WorkflowID    string `json:"workflow_id"`
+	Slot          int    `json:"slot,omitempty"`
+	Position      int    `json:"position,omitempty"`
+	ReservationID string `json:"reservation_id,omitempty"`
+	Status        string `json:"status,omitempty"`
+	Start         string `json:"start,omitempty"`
+	End           string `json:"end,omitempty"`
+	Estimated     bool   `json:"estimated,omitempty"`
+}
+
+// DeviceSchedule is everything holding a device from now on, in one
+// timeline, and when it is next free.
+type DeviceSchedule struct {
+	DeviceID     string          `json:"device_id"`
+	Status       string          `json:"status"`
+	GeneratedAt  string          `json:"generated_at"`
+	Horizon      string          `json:"horizon"`
+	AvgBookingMS int64           `json:"avg_booking_ms"`
+	NextFreeAt   string          `json:"next_free_at,omitempty"`
+	Entries      []ScheduleEntry `json:"entries"`
+}
+
+// averageBooking is how long the device's bookings took on average over
+// scheduleEstimateWindow, zero if there were none.
+func averageBooking(deviceID string, now time.Time) (time.Duration, error) {
+	var totalMs, count int64
+	err := statsSamples(deviceID, "busy", now.Add(-scheduleEstimateWindow), now, func(data []byte) {
+		var interval busyInterval
+		if json.Unmarshal(data, &interval) != nil || interval.End < interval.Start {
+			return
+		}
+		totalMs += interval.End - interval.Start
+		count++
+	})
+	if err != nil || count == 0 {
+		return 0, err
+	}
+	return time.Duration(totalMs/count) * time.Millisecond, nil
+}
+
+func formatScheduleTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// buildSchedule lays out the device's bookings, then its queue in order,
+// each queued workflow taking the first slot expected to free up, then its
+// reservations starting within the horizon. A zero average leaves the
+// times it would estimate unknown, and so when the device is next free,
+// unless a slot is free now.
+func buildSchedule(schedule *DeviceSchedule, holders map[int]string, bookedAt time.Time, queue []QueuedBooking, reservations []Reservation, capacity int, avg time.Duration, now, until time.Time) {
+	// When each slot is expected to be free; the zero time is unknown.
+	freeAt := make([]time.Time, 0, capacity)
+	for slot := 1; slot <= capacity; slot++ {
+		workflowID, held := holders[slot]
+		if !held {
+			freeAt = append(freeAt, now)
+			continue
+		}
+		entry := ScheduleEntry{Kind: ScheduleBooking, WorkflowID: workflowID, Start: formatScheduleTime(bookedAt), Estimated: true}
+		if capacity > 1 {
+			entry.Slot = slot
+		}
+		var end time.Time
+		if avg > 0 {
+			end = now.Add(avg)
+			if !bookedAt.IsZero() {
+				end = bookedAt.Add(avg)
+				if end.Before(now) {
+					// Overdue; it could end any moment.
+					end = now
+				}
+			}
+		}
+		entry.End = formatScheduleTime(end)
+		schedule.Entries = append(schedule.Entries, entry)
+		freeAt = append(freeAt, end)
+	}
+
+	for i, queued := range queue {
+		entry := ScheduleEntry{Kind: ScheduleQueued, WorkflowID: queued.WorkflowID, Position: i + 1, Estimated: true}
+		next := earliestFree(freeAt)
+		if start := freeAt[next]; !start.IsZero() {
+			entry.Start = formatScheduleTime(start)
+			freeAt[next] = time.Time{}
+			if avg > 0 {
+				freeAt[next] = start.Add(avg)
+				entry.End = formatScheduleTime(freeAt[next])
+			}
+		}
+		schedule.Entries = append(schedule.Entries, entry)
+	}
+
+	var held [][2]time.Time
+	for _, r := range reservations {
+		start, end := r.window()
+		if r.Status == ReservationClaimed || r.Status == ReservationExpired || !start.Before(until) {
+			continue
+		}
+		schedule.Entries = append(schedule.Entries, ScheduleEntry{
+			Kind:          ScheduleReservation,
+			WorkflowID:    r.WorkflowID,
+			ReservationID: r.ID,
+			Status:        r.Status,
+			Start:         r.Start,
+			End:           r.End,
+		})
+		held = append(held, [2]time.Time{start, end})
+	}
+
+	// Next free is the first slot to free up, pushed past any reservation
+	// holding the device then.
+	if next := freeAt[earliestFree(freeAt)]; !next.IsZero() {
+		for moved := true; moved; {
+			moved = false
+			for _, window := range held {
+				if !next.Before(window[0]) && next.Before(window[1]) {
+					next, moved = window[1], true
+				}
+			}
+		}
+		schedule.NextFreeAt = formatScheduleTime(next)
+	}
+
+	// Entries with a start come in time order, those without after them.
+	sort.SliceStable(schedule.Entries, func(i, j int) bool {
+		a, b := schedule.Entries[i].Start, schedule.Entries[j].Start
+		return a != "" && (b == "" || a < b)
+	})
+}
+
+// earliestFree returns the slot expected to be free first, preferring
+// known times to unknown ones.
+func earliestFree(freeAt []time.Time) int {
+	best := 0
+	for i, t := range freeAt {
+		if !t.IsZero() && (freeAt[best].IsZero() || t.Before(freeAt[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+// deviceScheduleHandler returns the device's schedule: who holds it now,
+// who is queued for it and who reserved it within ?horizon= (a Go duration,
+// default 24h, at most 30 days), with when it is next free.
+func deviceScheduleHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	horizon := defaultScheduleHorizon
+	if value := c.Query("horizon"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 || d > maxScheduleHorizon {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "horizon must be a positive duration of at most 720h"})
+			return
+		}
+		horizon = d
+	}
+
+	now := time.Now().UTC()
+	schedule := DeviceSchedule{
+		DeviceID:    deviceID,
+		Status:      getDeviceStatus(deviceID),
+		GeneratedAt: formatScheduleTime(now),
+		Horizon:     horizon.String(),
+		Entries:     []ScheduleEntry{},
+	}
+
+	holders := map[int]string{}
+	if isMultiSlot(deviceID) {
+		var err error
+		if holders, err = getSlotHolders(deviceID); err != nil {
+			log.Printf("Error reading slots of device %s: %v", deviceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve schedule"})
+			return
+		}
+	} else if workflowID := getDeviceWorkflow(deviceID); workflowID != "" {
+		holders[1] = workflowID
+	}
+	var bookedAt time.Time
+	if ms, err := redisClient.Get(ctx, statsKey(deviceID, "booked_at")).Int64(); err == nil {
+		bookedAt = time.UnixMilli(ms).UTC()
+	}
+
+	queue, err := getBookingQueue(deviceID)
+	if err != nil {
+		log.Printf("Error reading booking queue of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve schedule"})
+		return
+	}
+	reservations, err := getReservations(deviceID)
+	if err != nil {
+		log.Printf("Error reading reservations of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve schedule"})
+		return
+	}
+	avg, err := averageBooking(deviceID, now)
+	if err != nil {
+		log.Printf("Error reading booking stats of device %s: %v", deviceID, err)
+	}
+	schedule.AvgBookingMS = avg.Milliseconds()
+
+	// The queue is laid out in the order the device's policy grants it.
+	queue = getBookingPolicy(deviceID).order(queue, getAllocationState(deviceID))
+	buildSchedule(&schedule, holders, bookedAt, queue, reservations, deviceCapacity(deviceID), avg, now, now.Add(horizon))
+	// A device in error isn't free until it is reset.
+	if schedule.Status == "error" {
+		schedule.NextFreeAt = ""
+	}
+	c.JSON(http.StatusOK, schedule)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// The SiLA adapter exposes devices to SiLA 2 clients through a JSON binding
+// of the SiLA feature model: each capability is grouped into a feature whose
+// commands map onto execute operations, and the core LockController feature
+// maps onto booking. Clients pass the lock identifier as SiLA metadata in
+// the X-SiLA-LockIdentifier header.
+
+const (
+	silaLockHeader       = "X-SiLA-LockIdentifier"
+	silaLockWorkflowPref = "sila-lock:"
+	silaExecutionTTL     = time.Hour
+)
+
+// SiLA command execution states.
+const (
+	SiLAStatusWaiting  = "waiting"
+	SiLAStatusRunning  = "running"
+	SiLAStatusFinished = "finishedSuccessfully"
+	SiLAStatusError    = "finishedWithError"
+)
+
+// SiLA error types.
+const (
+	SiLAValidationError         = "ValidationError"
+	SiLADefinedExecutionError   = "DefinedExecutionError"
+	SiLAUndefinedExecutionError = "UndefinedExecutionError"
+	SiLAFrameworkError          = "FrameworkError"
+)
+
+type SiLAParameter struct {
+	Identifier string `json:"identifier"`
+	DataType   string `json:"data_type"`
+}
+
+type SiLACommand struct {
+	Identifier string          `json:"identifier"`
+	Observable bool            `json:"observable"`
+	Parameters []SiLAParameter `json:"parameters,omitempty"`
+	Operation  string          `json:"-"`
+}
+
+type SiLAFeature struct {
+	Identifier               string        `json:"identifier"`
+	FullyQualifiedIdentifier string        `json:"fully_qualified_identifier"`
+	Description              string        `json:"description"`
+	Commands                 []SiLACommand `json:"commands"`
+}
+
+type SiLAError struct {
+	ErrorType  string `json:"error_type"`
+	Identifier string `json:"identifier,omitempty"`
+	Message    string `json:"message"`
+}
+
+type SiLACommandRequest struct {
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+// SiLAExecution tracks an observable command.
+type SiLAExecution struct {
+	CommandExecutionUUID string                 `json:"command_execution_uuid"`
+	DeviceID             string                 `json:"device_id"`
+	Feature              string                 `json:"feature"`
+	Command              string                 `json:"command"`
+	CommandStatus        string                 `json:"command_status"`
+	StartedAt            string                 `json:"started_at"`
+	FinishedAt           string                 `json:"finished_at,omitempty"`
+	Response             map[string]interface{} `json:"response,omitempty"`
+	Error                *SiLAError             `json:"error,omitempty"`
+}
+
+func silaFeatureID(name string) string {
+	return fmt.Sprintf("lab.automation/devices/%s/v1", name)
+}
+
+var lockControllerFeature = SiLAFeature{
+	Identifier:               "LockController",
+	FullyQualifiedIdentifier: "org.silastandard/core/LockController/v2",
+	Description:              "Locks the device for exclusive use; maps onto device booking.",
+	Commands: []SiLACommand{
+		{Identifier: "LockServer", Parameters: []SiLAParameter{{Identifier: "LockIdentifier", DataType: "String"}}},
+		{Identifier: "UnlockServer", Parameters: []SiLAParameter{{Identifier: "LockIdentifier", DataType: "String"}}},
+	},
+}
+
+// silaFeatures groups device operations into SiLA features.
+var silaFeatures = []SiLAFeature{
+	{
+		Identifier:  "LiquidHandlingService",
+		Description: "Aspirates, dispenses and pipettes liquid.",
+		Commands: []SiLACommand{
+			{Identifier: "Aspirate", Observable: true, Operation: "aspirate", Parameters: []SiLAParameter{{"Volume", "Real"}, {"Well", "String"}}},
+			{Identifier: "Dispense", Observable: true, Operation: "dispense", Parameters: []SiLAParameter{{"Volume", "Real"}, {"Well", "String"}}},
+			{Identifier: "Pipette", Observable: true, Operation: "pipette", Parameters: []SiLAParameter{{"Volume", "Real"}, {"Source", "String"}, {"Destination", "String"}}},
+		},
+	},
+	{
+		Identifier:  "TemperatureController",
+		Description: "Heats or cools the device to a target temperature.",
+		Commands: []SiLACommand{
+			{Identifier: "Heat", Observable: true, Operation: "heat", Parameters: []SiLAParameter{{"TargetTemperature", "Real"}}},
+			{Identifier: "Cool", Observable: true, Operation: "cool", Parameters: []SiLAParameter{{"TargetTemperature", "Real"}}},
+		},
+	},
+	{
+		Identifier:  "ShakingController",
+		Description: "Shakes the loaded plate.",
+		Commands: []SiLACommand{
+			{Identifier: "Shake", Observable: true, Operation: "shake", Parameters: []SiLAParameter{{"Frequency", "Real"}, {"Duration", "Integer"}}},
+		},
+	},
+	{
+		Identifier:  "PlateReaderService",
+		Description: "Takes absorbance and fluorescence readings.",
+		Commands: []SiLACommand{
+			{Identifier: "ReadAbsorbance", Observable: true, Operation: "absorbance", Parameters: []SiLAParameter{{"Wavelength", "Integer"}}},
+			{Identifier: "ReadFluorescence", Observable: true, Operation: "fluorescence", Parameters: []SiLAParameter{{"Excitation", "Integer"}, {"Emission", "Integer"}}},
+		},
+	},
+}
+
+func init() {
+	for i := range silaFeatures {
+		silaFeatures[i].FullyQualifiedIdentifier = silaFeatureID(silaFeatures[i].Identifier)
+	}
+}
+
+func silaExecutionKey(uuid string) string {
+	return fmt.Sprintf("sila:execution:%s", uuid)
+}
+
+func newCommandExecutionUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// deviceFeatures returns the features whose commands the device supports.
+func deviceFeatures(device Device) []SiLAFeature {
+	capabilities := map[string]bool{}
+	for _, capability := range device.Capabilities {
+		capabilities[capability] = true
+	}
+
+	features := []SiLAFeature{lockControllerFeature}
+	for _, feature := range silaFeatures {
+		supported := SiLAFeature{
+			Identifier:               feature.Identifier,
+			FullyQualifiedIdentifier: feature.FullyQualifiedIdentifier,
+			Description:              feature.Description,
+		}
+		for _, command := range feature.Commands {
+			if capabilities[command.Operation] {
+				supported.Commands = append(supported.Commands, command)
+			}
+		}
+		if len(supported.Commands) > 0 {
+			features = append(features, supported)
+		}
+	}
+	return features
+}
+
+func findSiLACommand(device Device, featureID, commandID string) (*SiLACommand, bool) {
+	for _, feature := range deviceFeatures(device) {
+		if feature.Identifier != featureID {
+			continue
+		}
+		for _, command := range feature.Commands {
+			if command.Identifier == commandID {
+				return &command, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func silaErrorFromDevice(err *DeviceError) SiLAError {
+	errorType := SiLADefinedExecutionError
+	if err.StatusCode >= http.StatusInternalServerError {
+		errorType = SiLAUndefinedExecutionError
+	}
+	return SiLAError{ErrorType: errorType, Message: err.Message}
+}
+
+func saveSiLAExecution(execution SiLAExecution) error {
+	data, err := json.Marshal(execution)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, silaExecutionKey(execution.CommandExecutionUUID), data, silaExecutionTTL).Err()
+}
+
+func getSiLAExecution(uuid string) (*SiLAExecution, error) {
+	data, err := redisClient.Get(ctx, silaExecutionKey(uuid)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var execution SiLAExecution
+	if err := json.Unmarshal([]byte(data), &execution); err != nil {
+		return nil, err
+	}
+	return &execution, nil
+}
+
+// runSiLAExecution executes the command in the background, recording its
+// progress for clients polling the execution.
+func runSiLAExecution(execution SiLAExecution, req ExecuteRequest) {
+	execution.CommandStatus = SiLAStatusRunning
+	if err := saveSiLAExecution(execution); err != nil {
+		log.Printf("Error saving SiLA execution %s: %v", execution.CommandExecutionUUID, err)
+	}
+
+	resp, devErr := executeOperation(context.Background(), execution.DeviceID, req)
+
+	execution.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	if devErr != nil {
+		silaErr := silaErrorFromDevice(devErr)
+		execution.CommandStatus = SiLAStatusError
+		execution.Error = &silaErr
+	} else {
+		execution.CommandStatus = SiLAStatusFinished
+		execution.Response = resp.Result
+	}
+	if err := saveSiLAExecution(execution); err != nil {
+		log.Printf("Error saving SiLA execution %s: %v", execution.CommandExecutionUUID, err)
+	}
+}
+
+func silaServerHandler(c *gin.Context) {
+	hostname, _ := os.Hostname()
+	c.JSON(http.StatusOK, gin.H{
+		"server_name":    "Lab Automation Device Service",
+		"server_type":    "DeviceService",
+		"server_uuid":    hostname,
+		"server_version": "1.0",
+		"implemented_features": []string{
+			"org.silastandard/core/SiLAService/v1",
+			lockControllerFeature.FullyQualifiedIdentifier,
+		},
+	})
+}
+
+func silaDeviceFeaturesHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	device, ok := deviceFleet()[deviceID]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, deviceFeatures(device))
+}
+
+func silaCommandHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	device, ok := deviceFleet()[deviceID]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	featureID := c.Param("feature")
+	commandID := c.Param("command")
+	command, ok := findSiLACommand(device, featureID, commandID)
+	if !ok {
+		c.JSON(http.StatusNotFound, SiLAError{
+			ErrorType:  SiLAFrameworkError,
+			Identifier: "CommandNotSupported",
+			Message:    fmt.Sprintf("Device does not implement %s/%s", featureID, commandID),
+		})
+		return
+	}
+
+	var req SiLACommandRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		req.Parameters = map[string]interface{}{}
+	}
+
+	if featureID == lockControllerFeature.Identifier {
+		silaLockCommand(c, deviceID, commandID, req.Parameters)
+		return
+	}
+
+	lockID := c.GetHeader(silaLockHeader)
+	if lockID == "" {
+		c.JSON(http.StatusBadRequest, SiLAError{
+			ErrorType:  SiLAFrameworkError,
+			Identifier: "InvalidMetadata",
+			Message:    "LockIdentifier metadata is required; lock the device first",
+		})
+		return
+	}
+
+	execReq := ExecuteRequest{
+		WorkflowID: silaLockWorkflowPref + lockID,
+		Operation:  command.Operation,
+		Params:     req.Parameters,
+	}
+
+	if !command.Observable {
+		resp, devErr := executeOperation(c.Request.Context(), deviceID, execReq)
+		if devErr != nil {
+			c.JSON(devErr.StatusCode, silaErrorFromDevice(devErr))
+			return
+		}
+		response := resp.Result
+		if response == nil {
+			response = map[string]interface{}{}
+		}
+		c.JSON(http.StatusOK, gin.H{"response": response})
+		return
+	}
+
+	execution := SiLAExecution{
+		CommandExecutionUUID: newCommandExecutionUUID(),
+		DeviceID:             deviceID,
+		Feature:              featureID,
+		Command:              commandID,
+		CommandStatus:        SiLAStatusWaiting,
+		StartedAt:            time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := saveSiLAExecution(execution); err != nil {
+		log.Printf("Error saving SiLA execution: %v", err)
+		c.JSON(http.StatusInternalServerError, SiLAError{ErrorType: SiLAUndefinedExecutionError, Message: "Failed to start command"})
+		return
+	}
+
+	log.Printf("SiLA command %s/%s started on device %s (%s)", featureID, commandID, deviceID, execution.CommandExecutionUUID)
+	go runSiLAExecution(execution, execReq)
+
+	c.JSON(http.StatusAccepted, gin.H{"command_execution_uuid": execution.CommandExecutionUUID})
+}
+
+// silaLockCommand implements LockController by booking or releasing the
+// device on behalf of the lock identifier.
+func silaLockCommand(c *gin.Context, deviceID, commandID string, params map[string]interface{}) {
+	lockID, _ := params["LockIdentifier"].(string)
+	if lockID == "" {
+		c.JSON(http.StatusBadRequest, SiLAError{
+			ErrorType:  SiLAValidationError,
+			Identifier: "LockIdentifier",
+			Message:    "LockIdentifier is required",
+		})
+		return
+	}
+
+	workflowID := silaLockWorkflowPref + lockID
+	var devErr *DeviceError
+	switch commandID {
+	case "LockServer":
+		_, devErr = bookDevice(deviceID, BookRequest{WorkflowID: workflowID}, requestActor(c))
+	case "UnlockServer":
+		_, devErr = releaseDevice(deviceID, workflowID, 0, requestActor(c))
+	}
+	if devErr != nil {
+		c.JSON(devErr.StatusCode, silaErrorFromDevice(devErr))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"response": gin.H{}})
+}
+
+func silaExecutionHandler(c *gin.Context) {
+	execution, err := getSiLAExecution(c.Param("uuid"))
+	if err != nil {
+		log.Printf("Error reading SiLA execution: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve command execution"})
+		return
+	}
+	if execution == nil {
+		c.JSON(http.StatusNotFound, SiLAError{
+			ErrorType:  SiLAFrameworkError,
+			Identifier: "InvalidCommandExecutionUUID",
+			Message:    "Command execution not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, execution)
+}
+
+func silaExecutionResultHandler(c *gin.Context) {
+	execution, err := getSiLAExecution(c.Param("uuid"))
+	if err != nil {
+		log.Printf("Error reading SiLA execution: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve command execution"})
+		return
+	}
+	if execution == nil {
+		c.JSON(http.StatusNotFound, SiLAError{
+			ErrorType:  SiLAFrameworkError,
+			Identifier: "InvalidCommandExecutionUUID",
+			Message:    "Command execution not found",
+		})
+		return
+	}
+
+	switch execution.CommandStatus {
+	case SiLAStatusFinished:
+		response := execution.Response
+		if response == nil {
+			response = map[string]interface{}{}
+		}
+		c.JSON(http.StatusOK, gin.H{"response": response})
+	case SiLAStatusError:
+		c.JSON(http.StatusOK, gin.H{"error": execution.Error})
+	default:
+		c.JSON(http.StatusConflict, SiLAError{
+			ErrorType:  SiLAFrameworkError,
+			Identifier: "CommandExecutionNotFinished",
+			Message:    "Command execution has not finished",
+		})
+	}
+}
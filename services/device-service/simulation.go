@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	DistributionFixed   = "fixed"
+	DistributionUniform = "uniform"
+	DistributionNormal  = "normal"
+)
+
+// DurationProfile describes how long a simulated operation takes.
+type DurationProfile struct {
+	Distribution string `json:"distribution"`
+	MeanMs       int    `json:"mean_ms"`
+	StdDevMs     int    `json:"stddev_ms,omitempty"`
+	MinMs        int    `json:"min_ms,omitempty"`
+	MaxMs        int    `json:"max_ms,omitempty"`
+}
+
+// OperationProfile describes the simulated behavior of a single operation.
+type OperationProfile struct {
+	Duration    DurationProfile `json:"duration"`
+	FailureRate float64         `json:"failure_rate"`
+	ErrorCodes  []int           `json:"error_codes,omitempty"`
+}
+
+// SimulationProfile holds the per-operation behavior of a simulated device.
+// Operations without an explicit entry fall back to Default.
+type SimulationProfile struct {
+	Default    OperationProfile            `json:"default"`
+	Operations map[string]OperationProfile `json:"operations,omitempty"`
+	// Thermal sets how devices that heat or cool change temperature.
+	Thermal *ThermalProfile `json:"thermal,omitempty"`
+}
+
+// SimulationResult is the outcome of a simulated operation.
+type SimulationResult struct {
+	Duration  time.Duration
+	ErrorCode int
+}
+
+var defaultSimulationProfile = SimulationProfile{
+	Default: OperationProfile{
+		Duration: DurationProfile{Distribution: DistributionFixed, MeanMs: 500},
+	},
+}
+
+func simulationKey(deviceID string) string {
+	return deviceKey(deviceID, "simulation")
+}
+
+func (p DurationProfile) validate() error {
+	switch p.Distribution {
+	case "", DistributionFixed, DistributionUniform, DistributionNormal:
+	default:
+		return fmt.Errorf("unknown distribution %q", p.Distribution)
+	}
+	if p.MeanMs < 0 || p.StdDevMs < 0 || p.MinMs < 0 || p.MaxMs < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	if p.MaxMs > 0 && p.MinMs > p.MaxMs {
+		return fmt.Errorf("min_ms must not exceed max_ms")
+	}
+	return nil
+}
+
+func (p OperationProfile) validate() error {
+	if err := p.Duration.validate(); err != nil {
+		return err
+	}
+	if p.FailureRate < 0 || p.FailureRate > 1 {
+		return fmt.Errorf("failure_rate must be between 0 and 1")
+	}
+	for _, code := range p.ErrorCodes {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("error code %d is not an HTTP error status", code)
+		}
+	}
+	return nil
+}
+
+func (p SimulationProfile) validate() error {
+	if err := p.Default.validate(); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for operation, profile := range p.Operations {
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("operation %q: %w", operation, err)
+		}
+	}
+	if err := p.Thermal.validate(); err != nil {
+		return fmt.Errorf("thermal: %w", err)
+	}
+	return nil
+}
+
+// forOperation returns the profile that applies to the given operation.
+func (p SimulationProfile) forOperation(operation string) OperationProfile {
+	if profile, ok := p.Operations[operation]; ok {
+		return profile
+	}
+	return p.Default
+}
+
+// sample draws a duration from the profile's distribution.
+func (p DurationProfile) sample() time.Duration {
+	ms := float64(p.MeanMs)
+	switch p.Distribution {
+	case DistributionUniform:
+		if p.MaxMs > p.MinMs {
+			ms = float64(p.MinMs) + rand.Float64()*float64(p.MaxMs-p.MinMs)
+		} else {
+			ms = float64(p.MinMs)
+		}
+	case DistributionNormal:
+		ms = rand.NormFloat64()*float64(p.StdDevMs) + float64(p.MeanMs)
+	}
+
+	if ms < float64(p.MinMs) {
+		ms = float64(p.MinMs)
+	}
+	if p.MaxMs > 0 && ms > float64(p.MaxMs) {
+		ms = float64(p.MaxMs)
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// sample decides the duration and outcome of a single operation run.
+func (p OperationProfile) sample() SimulationResult {
+	result := SimulationResult{Duration: p.Duration.sample()}
+	if p.FailureRate > 0 && rand.Float64() < p.FailureRate {
+		result.ErrorCode = http.StatusInternalServerError
+		if len(p.ErrorCodes) > 0 {
+			result.ErrorCode = p.ErrorCodes[rand.Intn(len(p.ErrorCodes))]
+		}
+	}
+	return result
+}
+
+// plateWells lists the wells of a 96-well plate, A1 to H12.
+func plateWells() []string {
+	wells := make([]string, 0, 96)
+	for _, row := range "ABCDEFGH" {
+		for col := 1; col <= 12; col++ {
+			wells = append(wells, fmt.Sprintf("%c%d", row, col))
+		}
+	}
+	return wells
+}
+
+// simulatedData generates plausible result data for an operation, such as a
+// well-to-value map for plate reader measurements.
+func simulatedData(operation string, params map[string]interface{}) map[string]interface{} {
+	switch operation {
+	case "absorbance":
+		wells := map[string]interface{}{}
+		for _, well := range plateWells() {
+			wells[well] = math.Round((0.05+rand.Float64()*2)*1000) / 1000
+		}
+		return map[string]interface{}{"wavelength": params["wavelength"], "unit": "OD", "wells": wells}
+	case "fluorescence":
+		wells := map[string]interface{}{}
+		for _, well := range plateWells() {
+			wells[well] = math.Round(100 + rand.Float64()*50000)
+		}
+		return map[string]interface{}{
+			"excitation": params["excitation"],
+			"emission":   params["emission"],
+			"unit":       "RFU",
+			"wells":      wells,
+		}
+	case "aspirate", "dispense", "pipette":
+		if volume, ok := params["volume"]; ok {
+			return map[string]interface{}{"volume": volume}
+		}
+	}
+	return nil
+}
+
+func getSimulationProfile(deviceID string) SimulationProfile {
+	data, err := redisClient.Get(ctx, simulationKey(deviceID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading simulation profile for device %s: %v", deviceID, err)
+		}
+		return defaultSimulationProfile
+	}
+
+	var profile SimulationProfile
+	if err := json.Unmarshal([]byte(data), &profile); err != nil {
+		log.Printf("Invalid simulation profile for device %s: %v", deviceID, err)
+		return defaultSimulationProfile
+	}
+	return profile
+}
+
+func saveSimulationProfile(deviceID string, profile SimulationProfile) error {
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, simulationKey(deviceID), data, 0).Err()
+}
+
+// loadSimulationProfiles reads a JSON file mapping device IDs to simulation
+// profiles and stores them, replacing any profiles set previously.
+func loadSimulationProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var profiles map[string]SimulationProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return err
+	}
+
+	for deviceID, profile := range profiles {
+		if _, ok := deviceFleet()[deviceID]; !ok {
+			log.Printf("Ignoring simulation profile for unknown device %s", deviceID)
+			continue
+		}
+		if err := profile.validate(); err != nil {
+			return fmt.Errorf("device %s: %w", deviceID, err)
+		}
+		if err := saveSimulationProfile(deviceID, profile); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Loaded simulation profiles for %d device(s) from %s", len(profiles), path)
+	return nil
+}
+
+func getSimulationProfileHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, getSimulationProfile(deviceID))
+}
+
+func setSimulationProfileHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	var profile SimulationProfile
+	if err := c.ShouldBindJSON(&profile); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := profile.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := saveSimulationProfile(deviceID, profile); err != nil {
+		log.Printf("Error saving simulation profile for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save simulation profile"})
+		return
+	}
+
+	log.Printf("Simulation profile updated for device %s", deviceID)
+	c.JSON(http.StatusOK, profile)
+}
+
+func resetSimulationProfileHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	if err := redisClient.Del(ctx, simulationKey(deviceID), thermalKey(deviceID)).Err(); err != nil {
+		log.Printf("Error resetting simulation profile for device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset simulation profile"})
+		return
+	}
+
+	log.Printf("Simulation profile reset for device %s", deviceID)
+	c.JSON(http.StatusOK, defaultSimulationProfile)
+}
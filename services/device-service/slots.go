@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Devices with a capacity above one hand out slots: each booking claims a
+// free slot instead of the whole device, and the device only reports "busy"
+// once every slot is taken. Slot holders are kept in a hash of slot number
+// to workflow ID.
+
+// SlotState is the occupancy of one slot of a multi-slot device.
+type SlotState struct {
+	Slot       int    `json:"slot"`
+	Status     string `json:"status"`
+	WorkflowID string `json:"workflow_id,omitempty"`
+	BookedBy   string `json:"booked_by,omitempty"`
+}
+
+// claimSlotScript claims the first free slot for a workflow. It returns the
+// slot number, the negated slot number if the workflow already holds one,
+// or zero if the device is full.
+var claimSlotScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+for i = 1, capacity do
+	if redis.call("HGET", KEYS[1], tostring(i)) == ARGV[2] then
+		return -i
+	end
+end
+for i = 1, capacity do
+	if redis.call("HSETNX", KEYS[1], tostring(i), ARGV[2]) == 1 then
+		return i
+	end
+end
+return 0
+`)
+
+func slotsKey(deviceID string) string {
+	return deviceKey(deviceID, "slots")
+}
+
+func deviceCapacity(deviceID string) int {
+	if capacity := deviceFleet()[deviceID].Capacity; capacity > 1 {
+		return capacity
+	}
+	return 1
+}
+
+func isMultiSlot(deviceID string) bool {
+	return deviceCapacity(deviceID) > 1
+}
+
+// getSlotHolders returns the workflow holding each occupied slot.
+func getSlotHolders(deviceID string) (map[int]string, error) {
+	values, err := redisClient.HGetAll(ctx, slotsKey(deviceID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseSlotHolders(values), nil
+}
+
+func parseSlotHolders(values map[string]string) map[int]string {
+	holders := make(map[int]string, len(values))
+	for field, workflowID := range values {
+		slot, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		holders[slot] = workflowID
+	}
+	return holders
+}
+
+func slotStates(deviceID string, holders map[int]string) []SlotState {
+	capacity := deviceCapacity(deviceID)
+	slots := make([]SlotState, 0, capacity)
+	for slot := 1; slot <= capacity; slot++ {
+		state := SlotState{Slot: slot, Status: "available"}
+		if workflowID, ok := holders[slot]; ok {
+			state.Status = "busy"
+			state.WorkflowID = workflowID
+		}
+		slots = append(slots, state)
+	}
+	return slots
+}
+
+// slotOccupancyStatus is the device status implied by its slot holders.
+func slotOccupancyStatus(deviceID string, holders map[int]string) string {
+	if len(holders) >= deviceCapacity(deviceID) {
+		return "busy"
+	}
+	return "available"
+}
+
+// bookSlot claims a free slot for the workflow and updates the device status.
+func bookSlot(deviceID, workflowID string) (int, *DeviceError) {
+	result, err := claimSlotScript.Run(ctx, redisClient, []string{slotsKey(deviceID)}, deviceCapacity(deviceID), workflowID).Int()
+	if err != nil {
+		log.Printf("Error claiming slot on device %s: %v", deviceID, err)
+		return 0, &DeviceError{StatusCode: http.StatusInternalServerError, Code: ErrorCodeInternal, Message: "Failed to book device"}
+	}
+	switch {
+	case result == 0:
+		log.Printf("Device %s has no free slots", deviceID)
+		return 0, &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeDeviceUnavailable, Message: "Device is not available"}
+	case result < 0:
+		log.Printf("Workflow %s already holds slot %d on device %s", workflowID, -result, deviceID)
+		return 0, &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeSlotAlreadyHeld, Message: fmt.Sprintf("Workflow already holds slot %d", -result)}
+	}
+
+	restoreBookedStatus(deviceID)
+	return result, nil
+}
+
+// releaseSlots frees the slots held by workflowID, or the given slot when
+// slot is non-zero. It returns the workflows that were released.
+func releaseSlots(deviceID, workflowID string, slot int) ([]string, *DeviceError) {
+	holders, err := getSlotHolders(deviceID)
+	if err != nil {
+		log.Printf("Error reading slots of device %s: %v", deviceID, err)
+		return nil, &DeviceError{StatusCode: http.StatusInternalServerError, Code: ErrorCodeInternal, Message: "Failed to release device"}
+	}
+
+	var fields []string
+	var released []string
+	for _, s := range sortedSlots(holders) {
+		holder := holders[s]
+		if slot != 0 && s != slot {
+			continue
+		}
+		if workflowID != "" && holder != workflowID {
+			if slot != 0 {
+				return nil, &DeviceError{StatusCode: http.StatusForbidden, Code: ErrorCodeBookedByAnother, Message: "Slot is booked by another workflow"}
+			}
+			continue
+		}
+		fields = append(fields, strconv.Itoa(s))
+		released = append(released, holder)
+	}
+
+	if len(fields) == 0 && workflowID != "" {
+		return nil, &DeviceError{StatusCode: http.StatusForbidden, Code: ErrorCodeNotBooked, Message: "Device is not booked by this workflow"}
+	}
+	if len(fields) > 0 {
+		if err := redisClient.HDel(ctx, slotsKey(deviceID), fields...).Err(); err != nil {
+			log.Printf("Error releasing slots of device %s: %v", deviceID, err)
+			return nil, &DeviceError{StatusCode: http.StatusInternalServerError, Code: ErrorCodeInternal, Message: "Failed to release device"}
+		}
+	}
+	return released, nil
+}
+
+func sortedSlots(holders map[int]string) []int {
+	slots := make([]int, 0, len(holders))
+	for slot := range holders {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// releaseDeviceSlots is releaseDevice for multi-slot devices. The device
+// stays in error or offline if it was; otherwise its status follows the
+// remaining slot holders.
+func releaseDeviceSlots(deviceID, workflowID string, slot int) (*ReleaseResponse, []string, *DeviceError) {
+	released, devErr := releaseSlots(deviceID, workflowID, slot)
+	if devErr != nil {
+		log.Printf("Failed to release device %s: %s", deviceID, devErr.Message)
+		return nil, nil, devErr
+	}
+
+	holders, err := getSlotHolders(deviceID)
+	if err != nil {
+		log.Printf("Error reading slots of device %s: %v", deviceID, err)
+	}
+	status := getDeviceStatus(deviceID)
+	if status != "error" && status != "offline" {
+		status = slotOccupancyStatus(deviceID, holders)
+	}
+	setDeviceStatus(deviceID, status, nil)
+	if len(holders) == 0 && len(released) > 0 {
+		recordRelease(deviceID, strings.Join(released, ","), time.Now().UTC())
+	}
+
+	log.Printf("Released %d slot(s) on device %s", len(released), deviceID)
+	return &ReleaseResponse{
+		DeviceID:   deviceID,
+		Status:     status,
+		ReleasedAt: time.Now().UTC().Format(time.RFC3339),
+	}, released, nil
+}
+
+// holdsDevice reports whether the workflow has booked the device or one of
+// its slots.
+func holdsDevice(deviceID, workflowID string) bool {
+	if isMultiSlot(deviceID) {
+		held, err := redisClient.HVals(ctx, slotsKey(deviceID)).Result()
+		if err != nil {
+			return false
+		}
+		for _, holder := range held {
+			if holder == workflowID {
+				return true
+			}
+		}
+		return false
+	}
+
+	currentWorkflow := getDeviceWorkflow(deviceID)
+	return currentWorkflow != "" && currentWorkflow == workflowID
+}
+
+// restoreBookedStatus sets the device status implied by its bookings, for
+// use when it leaves the error or offline status.
+func restoreBookedStatus(deviceID string) string {
+	if isMultiSlot(deviceID) {
+		holders, err := getSlotHolders(deviceID)
+		if err != nil {
+			log.Printf("Error reading slots of device %s: %v", deviceID, err)
+		}
+		status := slotOccupancyStatus(deviceID, holders)
+		setDeviceStatus(deviceID, status, nil)
+		return status
+	}
+
+	if workflowID := getDeviceWorkflow(deviceID); workflowID != "" {
+		setDeviceStatus(deviceID, "busy", &workflowID)
+		return "busy"
+	}
+	setDeviceStatus(deviceID, "available", nil)
+	return "available"
+}
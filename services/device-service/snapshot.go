@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// A snapshot is the service's state in one versioned JSON document, to be
+// restored into a fresh environment. Histories and statistics are left out.
+const (
+	SNAPSHOT_SERVICE = "device-service"
+	SNAPSHOT_VERSION = 1
+)
+
+// DeviceSnapshot holds the state of every device.
+type DeviceSnapshot struct {
+	Service   string                 `json:"service"`
+	Version   int                    `json:"version"`
+	CreatedAt string                 `json:"created_at"`
+	Devices   []DeviceSnapshotRecord `json:"devices"`
+}
+
+// DeviceSnapshotRecord is one device's status and booking, lab, settings
+// and reservations, and its trash entry if it was deleted. Settings are
+// kept as stored.
+type DeviceSnapshotRecord struct {
+	ID           string            `json:"id"`
+	State        DeviceState       `json:"state"`
+	Lab          string            `json:"lab,omitempty"`
+	Slots        map[string]string `json:"slots,omitempty"`
+	Calibration  json.RawMessage   `json:"calibration,omitempty"`
+	Firmware     json.RawMessage   `json:"firmware,omitempty"`
+	Metadata     json.RawMessage   `json:"metadata,omitempty"`
+	Reservations []Reservation     `json:"reservations"`
+	Deleted      *DeletedDevice    `json:"deleted,omitempty"`
+}
+
+func takeDeviceSnapshot() (*DeviceSnapshot, error) {
+	deviceIDs := sortedDeviceIDs()
+	states, err := getDeviceStates(deviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	values, err := mgetDeviceKeys(deviceIDs, deviceLabKeyName, "calibration", "firmware", "metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := getDeletedDevices()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &DeviceSnapshot{
+		Service:   SNAPSHOT_SERVICE,
+		Version:   SNAPSHOT_VERSION,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Devices:   make([]DeviceSnapshotRecord, 0, len(deviceIDs)),
+	}
+	for i, deviceID := range deviceIDs {
+		record := DeviceSnapshotRecord{ID: deviceID, State: states[deviceID]}
+		record.Lab, _ = values[0][i].(string)
+		for j, field := range []*json.RawMessage{&record.Calibration, &record.Firmware, &record.Metadata} {
+			if data, ok := values[j+1][i].(string); ok {
+				*field = json.RawMessage(data)
+			}
+		}
+		if isMultiSlot(deviceID) {
+			if record.Slots, err = redisClient.HGetAll(ctx, slotsKey(deviceID)).Result(); err != nil {
+				return nil, err
+			}
+		}
+		if record.Reservations, err = getReservations(deviceID); err != nil {
+			return nil, err
+		}
+		if device, ok := deleted[deviceID]; ok {
+			device.PurgeAfter = ""
+			record.Deleted = &device
+		}
+		snapshot.Devices = append(snapshot.Devices, record)
+	}
+	return snapshot, nil
+}
+
+// validate checks a snapshot can be restored here: it must be of this
+// service's devices, and what it holds must refer to them.
+func (snapshot DeviceSnapshot) validate() error {
+	if snapshot.Service != SNAPSHOT_SERVICE {
+		return fmt.Errorf("snapshot is of %q, not %s", snapshot.Service, SNAPSHOT_SERVICE)
+	}
+	if snapshot.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("snapshot version %d is not supported; expected %d", snapshot.Version, SNAPSHOT_VERSION)
+	}
+	seen := map[string]bool{}
+	for _, record := range snapshot.Devices {
+		if _, ok := deviceFleet()[record.ID]; !ok {
+			return fmt.Errorf("unknown device %s", record.ID)
+		}
+		if seen[record.ID] {
+			return fmt.Errorf("device %s appears twice", record.ID)
+		}
+		seen[record.ID] = true
+
+		known := false
+		for _, status := range deviceStatuses {
+			known = known || record.State.Status == status
+		}
+		if !known {
+			return fmt.Errorf("device %s has unknown status %q", record.ID, record.State.Status)
+		}
+		if record.State.Status == "busy" && record.State.WorkflowID == "" && !isMultiSlot(record.ID) {
+			return fmt.Errorf("device %s is busy without a workflow", record.ID)
+		}
+		if record.Lab != "" && !labPattern.MatchString(record.Lab) {
+			return fmt.Errorf("device %s has invalid lab %q", record.ID, record.Lab)
+		}
+		for slot := range record.Slots {
+			if n, err := strconv.Atoi(slot); err != nil || n < 1 || n > deviceCapacity(record.ID) {
+				return fmt.Errorf("device %s has no slot %s", record.ID, slot)
+			}
+		}
+		for _, r := range record.Reservations {
+			start, end := r.window()
+			if r.ID == "" || r.DeviceID != record.ID || r.WorkflowID == "" || !end.After(start) {
+				return fmt.Errorf("device %s has an invalid reservation %q", record.ID, r.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// restoreDeviceSnapshot replaces the state of the devices in the snapshot.
+func restoreDeviceSnapshot(snapshot DeviceSnapshot) error {
+	for _, record := range snapshot.Devices {
+		if err := deviceStore.SetState(record.ID, record.State); err != nil {
+			return err
+		}
+		_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			settings := map[string]string{
+				deviceLabKey(record.ID):   record.Lab,
+				calibrationKey(record.ID): string(record.Calibration),
+				firmwareKey(record.ID):    string(record.Firmware),
+				metadataKey(record.ID):    string(record.Metadata),
+			}
+			for key, value := range settings {
+				if value == "" {
+					pipe.Del(ctx, key)
+				} else {
+					pipe.Set(ctx, key, value, 0)
+				}
+			}
+			pipe.Del(ctx, slotsKey(record.ID), reservationsKey(record.ID))
+			for slot, workflowID := range record.Slots {
+				pipe.HSet(ctx, slotsKey(record.ID), slot, workflowID)
+			}
+			for _, r := range record.Reservations {
+				if err := saveReservation(pipe, r); err != nil {
+					return err
+				}
+			}
+			if record.Deleted != nil {
+				record.Deleted.DeviceID = record.ID
+				return saveDeletedDevice(pipe, *record.Deleted)
+			}
+			pipe.HDel(ctx, DEVICE_TRASH_KEY, record.ID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getSnapshotHandler returns the state of every device as a snapshot.
+func getSnapshotHandler(c *gin.Context) {
+	snapshot, err := takeDeviceSnapshot()
+	if err != nil {
+		log.Printf("Error taking snapshot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to take snapshot"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="devices-%s.json"`, time.Now().UTC().Format("20060102T150405Z")))
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// restoreSnapshotHandler restores a snapshot after checking the whole of
+// it, so a bad snapshot changes nothing.
+func restoreSnapshotHandler(c *gin.Context) {
+	var snapshot DeviceSnapshot
+	if err := c.ShouldBindJSON(&snapshot); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot: " + err.Error()})
+		return
+	}
+	if err := snapshot.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err := restoreDeviceSnapshot(snapshot)
+	// Even a restore that failed part way may have changed cached labs.
+	invalidateAllCaches()
+	if err != nil {
+		log.Printf("Error restoring snapshot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore snapshot"})
+		return
+	}
+
+	log.Printf("Restored snapshot of %d devices taken at %s", len(snapshot.Devices), snapshot.CreatedAt)
+	c.JSON(http.StatusOK, gin.H{"restored": len(snapshot.Devices)})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultStatsWindow = 24 * time.Hour
+	maxStatsWindow     = 90 * 24 * time.Hour
+	// Samples older than this are trimmed whenever new ones are recorded.
+	statsRetention = maxStatsWindow
+)
+
+type busyInterval struct {
+	WorkflowID string `json:"workflow_id"`
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
+}
+
+type operationSample struct {
+	Operation  string `json:"operation"`
+	DurationMs int64  `json:"duration_ms"`
+	Success    bool   `json:"success"`
+	At         int64  `json:"at"`
+}
+
+type bookingSample struct {
+	WorkflowID string `json:"workflow_id"`
+	At         int64  `json:"at"`
+}
+
+type waitSample struct {
+	WorkflowID string `json:"workflow_id"`
+	WaitMs     int64  `json:"wait_ms"`
+	At         int64  `json:"at"`
+}
+
+type OperationStats struct {
+	Count         int     `json:"count"`
+	Failed        int     `json:"failed"`
+	AvgDurationMs float64 `json:"avg_duration_ms"`
+}
+
+type DeviceStats struct {
+	DeviceID         string                    `json:"device_id"`
+	Utilization      float64                   `json:"utilization"`
+	BusySeconds      float64                   `json:"busy_seconds"`
+	AvailableSeconds float64                   `json:"available_seconds"`
+	BookingCount     int                       `json:"booking_count"`
+	ConflictCount    int                       `json:"conflict_count"`
+	AvgWaitMs        float64                   `json:"avg_wait_ms"`
+	MaxWaitMs        int64                     `json:"max_wait_ms"`
+	Operations       OperationStats            `json:"operations"`
+	ByOperation      map[string]OperationStats `json:"by_operation"`
+}
+
+type StatsResponse struct {
+	Window  string        `json:"window"`
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Devices []DeviceStats `json:"devices"`
+}
+
+func statsKey(deviceID, series string) string {
+	return deviceKey(deviceID, "stats:"+series)
+}
+
+// parseStatsWindow parses a Go duration, additionally accepting a whole
+// number of days such as "7d".
+func parseStatsWindow(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultStatsWindow, nil
+	}
+
+	var window time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q", value)
+		}
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q", value)
+		}
+		window = d
+	}
+
+	if window <= 0 || window > maxStatsWindow {
+		return 0, fmt.Errorf("window must be between 0 and %s", maxStatsWindow)
+	}
+	return window, nil
+}
+
+func addStatsSample(deviceID, series string, at time.Time, sample interface{}) {
+	data, err := json.Marshal(sample)
+	if err != nil {
+		log.Printf("Error encoding %s sample for device %s: %v", series, deviceID, err)
+		return
+	}
+
+	key := statsKey(deviceID, series)
+	pipe := redisClient.TxPipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(at.UnixMilli()), Member: data})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", strconv.FormatInt(at.Add(-statsRetention).UnixMilli(), 10))
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error recording %s sample for device %s: %v", series, deviceID, err)
+	}
+}
+
+func statsSamples(deviceID, series string, from, to time.Time, out func(data []byte)) error {
+	members, err := redisClient.ZRangeByScore(ctx, statsKey(deviceID, series), &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.UnixMilli(), 10),
+		Max: strconv.FormatInt(to.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		out([]byte(member))
+	}
+	return nil
+}
+
+// recordBooking notes the start of a busy interval and, if the workflow
+// previously failed to book the device, how long it waited. On multi-slot
+// devices the interval opens with the first slot booked.
+func recordBooking(deviceID, workflowID string, at time.Time) {
+	redisClient.SetNX(ctx, statsKey(deviceID, "booked_at"), at.UnixMilli(), 0)
+	addStatsSample(deviceID, "bookings", at, bookingSample{WorkflowID: workflowID, At: at.UnixMilli()})
+
+	firstAttempt, err := redisClient.HGet(ctx, statsKey(deviceID, "waiting"), workflowID).Int64()
+	if err == nil {
+		redisClient.HDel(ctx, statsKey(deviceID, "waiting"), workflowID)
+		addStatsSample(deviceID, "waits", at, waitSample{
+			WorkflowID: workflowID,
+			WaitMs:     at.UnixMilli() - firstAttempt,
+			At:         at.UnixMilli(),
+		})
+	}
+}
+
+// recordBookingConflict notes a rejected booking attempt so the eventual
+// wait time of the workflow can be measured.
+func recordBookingConflict(deviceID, workflowID string, at time.Time) {
+	addStatsSample(deviceID, "conflicts", at, bookingSample{WorkflowID: workflowID, At: at.UnixMilli()})
+	redisClient.HSetNX(ctx, statsKey(deviceID, "waiting"), workflowID, at.UnixMilli())
+}
+
+// recordRelease closes the busy interval opened by recordBooking.
+func recordRelease(deviceID, workflowID string, at time.Time) {
+	bookedAt, err := redisClient.GetDel(ctx, statsKey(deviceID, "booked_at")).Int64()
+	if err != nil {
+		return
+	}
+	addStatsSample(deviceID, "busy", at, busyInterval{
+		WorkflowID: workflowID,
+		Start:      bookedAt,
+		End:        at.UnixMilli(),
+	})
+}
+
+func recordOperation(deviceID, operation string, duration time.Duration, success bool, at time.Time) {
+	addStatsSample(deviceID, "operations", at, operationSample{
+		Operation:  operation,
+		DurationMs: duration.Milliseconds(),
+		Success:    success,
+		At:         at.UnixMilli(),
+	})
+}
+
+func computeDeviceStats(deviceID string, from, to time.Time) (DeviceStats, error) {
+	stats := DeviceStats{
+		DeviceID:    deviceID,
+		ByOperation: map[string]OperationStats{},
+	}
+	fromMs, toMs := from.UnixMilli(), to.UnixMilli()
+
+	// Busy intervals are keyed by their end, so anything ending inside the
+	// window contributes; the part before the window is clipped.
+	var busyMs int64
+	err := statsSamples(deviceID, "busy", from, to, func(data []byte) {
+		var interval busyInterval
+		if json.Unmarshal(data, &interval) != nil {
+			return
+		}
+		busyMs += interval.End - max(interval.Start, fromMs)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if bookedAt, err := redisClient.Get(ctx, statsKey(deviceID, "booked_at")).Int64(); err == nil {
+		busyMs += toMs - max(bookedAt, fromMs)
+	}
+
+	windowMs := toMs - fromMs
+	busyMs = min(busyMs, windowMs)
+	stats.BusySeconds = float64(busyMs) / 1000
+	stats.AvailableSeconds = float64(windowMs-busyMs) / 1000
+	if windowMs > 0 {
+		stats.Utilization = float64(busyMs) / float64(windowMs)
+	}
+
+	minScore, maxScore := strconv.FormatInt(fromMs, 10), strconv.FormatInt(toMs, 10)
+	bookings, err := redisClient.ZCount(ctx, statsKey(deviceID, "bookings"), minScore, maxScore).Result()
+	if err != nil {
+		return stats, err
+	}
+	conflicts, err := redisClient.ZCount(ctx, statsKey(deviceID, "conflicts"), minScore, maxScore).Result()
+	if err != nil {
+		return stats, err
+	}
+	stats.BookingCount = int(bookings)
+	stats.ConflictCount = int(conflicts)
+
+	var waits, totalWaitMs int64
+	err = statsSamples(deviceID, "waits", from, to, func(data []byte) {
+		var sample waitSample
+		if json.Unmarshal(data, &sample) != nil {
+			return
+		}
+		waits++
+		totalWaitMs += sample.WaitMs
+		stats.MaxWaitMs = max(stats.MaxWaitMs, sample.WaitMs)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if waits > 0 {
+		stats.AvgWaitMs = float64(totalWaitMs) / float64(waits)
+	}
+
+	totals := map[string]int64{}
+	var totalMs int64
+	err = statsSamples(deviceID, "operations", from, to, func(data []byte) {
+		var sample operationSample
+		if json.Unmarshal(data, &sample) != nil {
+			return
+		}
+		op := stats.ByOperation[sample.Operation]
+		op.Count++
+		stats.Operations.Count++
+		if !sample.Success {
+			op.Failed++
+			stats.Operations.Failed++
+		}
+		stats.ByOperation[sample.Operation] = op
+		totals[sample.Operation] += sample.DurationMs
+		totalMs += sample.DurationMs
+	})
+	if err != nil {
+		return stats, err
+	}
+	for name, op := range stats.ByOperation {
+		op.AvgDurationMs = float64(totals[name]) / float64(op.Count)
+		stats.ByOperation[name] = op
+	}
+	if stats.Operations.Count > 0 {
+		stats.Operations.AvgDurationMs = float64(totalMs) / float64(stats.Operations.Count)
+	}
+
+	return stats, nil
+}
+
+func deviceStatsHandler(c *gin.Context) {
+	window, err := parseStatsWindow(c.Query("window"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	deviceIDs, err := labDeviceIDs(requestLab(c))
+	if err != nil {
+		log.Printf("Error listing devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve stats"})
+		return
+	}
+	if deviceID := c.Query("device_id"); deviceID != "" {
+		inLab := false
+		for _, id := range deviceIDs {
+			inLab = inLab || id == deviceID
+		}
+		if !inLab {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+			return
+		}
+		deviceIDs = []string{deviceID}
+	}
+
+	to := time.Now().UTC()
+	from := to.Add(-window)
+
+	response := StatsResponse{
+		Window:  window.String(),
+		From:    from.Format(time.RFC3339),
+		To:      to.Format(time.RFC3339),
+		Devices: make([]DeviceStats, 0, len(deviceIDs)),
+	}
+	for _, deviceID := range deviceIDs {
+		stats, err := computeDeviceStats(deviceID, from, to)
+		if err != nil {
+			log.Printf("Error computing stats for device %s: %v", deviceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute device stats"})
+			return
+		}
+		response.Devices = append(response.Devices, stats)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
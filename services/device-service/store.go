@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrDeviceUnavailable is returned by DeviceStore.Book when the device is no
+// longer available.
+var ErrDeviceUnavailable = errors.New("device is not available")
+
+// DeviceStore persists the status of each device and the workflow holding
+// it. Slots, reservations and the other per-device records stay in Redis.
+type DeviceStore interface {
+	// GetStates returns the stored state of the given devices; devices
+	// with no stored state are left out.
+	GetStates(deviceIDs []string) (map[string]DeviceState, error)
+	// SetState replaces the device's status and booking.
+	SetState(deviceID string, state DeviceState) error
+	// Book marks an available device busy for the workflow and returns
+	// the status it had, or ErrDeviceUnavailable.
+	Book(deviceID, workflowID string) (string, error)
+	Close() error
+}
+
+var deviceStore DeviceStore
+
+// newDeviceStore selects the store named by DEVICE_STORE: "redis" (the
+// default) or "postgres", which connects to DATABASE_URL.
+func newDeviceStore() (DeviceStore, error) {
+	switch backend := os.Getenv("DEVICE_STORE"); backend {
+	case "", "redis":
+		return &redisDeviceStore{client: redisClient}, nil
+	case "postgres":
+		databaseURL := os.Getenv("DATABASE_URL")
+		if databaseURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL not set")
+		}
+		return newPostgresDeviceStore(databaseURL)
+	default:
+		return nil, fmt.Errorf("unknown device store %q", backend)
+	}
+}
+
+// redisDeviceStore keeps the status and booking workflow in the
+// device:{<id>}:status and device:{<id>}:workflow keys.
+type redisDeviceStore struct {
+	client redis.UniversalClient
+}
+
+func (s *redisDeviceStore) GetStates(deviceIDs []string) (map[string]DeviceState, error) {
+	values, err := mgetDeviceKeys(deviceIDs, "status", "workflow")
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]DeviceState, len(deviceIDs))
+	for i, deviceID := range deviceIDs {
+		status, ok := values[0][i].(string)
+		if !ok {
+			continue
+		}
+		state := DeviceState{Status: status}
+		if workflowID, ok := values[1][i].(string); ok {
+			state.WorkflowID = workflowID
+		}
+		states[deviceID] = state
+	}
+	return states, nil
+}
+
+func (s *redisDeviceStore) SetState(deviceID string, state DeviceState) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, deviceKey(deviceID, "status"), state.Status, 0)
+		if state.WorkflowID != "" {
+			pipe.Set(ctx, deviceKey(deviceID, "workflow"), state.WorkflowID, 0)
+		} else {
+			pipe.Del(ctx, deviceKey(deviceID, "workflow"))
+		}
+		return nil
+	})
+	return err
+}
+
+// bookScript marks a device busy for a workflow if it is available, in one
+// step so two bookings can't both see it available. KEYS are the status
+// and workflow keys; ARGV the status of a device with none stored and the
+// workflow. It returns the previous status and 1 if the device was booked.
+var bookScript = redis.NewScript(`
+local status = redis.call("GET", KEYS[1]) or ARGV[1]
+if status ~= "available" then
+	return {status, 0}
+end
+redis.call("SET", KEYS[1], "busy")
+redis.call("SET", KEYS[2], ARGV[2])
+return {status, 1}
+`)
+
+func (s *redisDeviceStore) Book(deviceID, workflowID string) (string, error) {
+	keys := []string{deviceKey(deviceID, "status"), deviceKey(deviceID, "workflow")}
+	result, err := bookScript.Run(ctx, s.client, keys, deviceFleet()[deviceID].Status, workflowID).Slice()
+	if err != nil {
+		return "", err
+	}
+	previous, _ := result[0].(string)
+	if booked, _ := result[1].(int64); booked != 1 {
+		return previous, ErrDeviceUnavailable
+	}
+	return previous, nil
+}
+
+func (s *redisDeviceStore) Close() error {
+	return nil
+}
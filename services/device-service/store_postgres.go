@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresSchema holds the current state of each device and an append-only
+// history of every change, written in the same transaction.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS device_state (
+	device_id   TEXT PRIMARY KEY,
+	status      TEXT NOT NULL,
+	workflow_id TEXT NOT NULL DEFAULT '',
+	updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS device_state_history (
+	id          BIGSERIAL PRIMARY KEY,
+	device_id   TEXT NOT NULL,
+	status      TEXT NOT NULL,
+	workflow_id TEXT NOT NULL DEFAULT '',
+	changed_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS device_state_history_device_idx
+	ON device_state_history (device_id, changed_at);
+`
+
+// postgresDeviceStore keeps device state in PostgreSQL. Booking locks the
+// device row, so two workflows can never both book the same device.
+type postgresDeviceStore struct {
+	db *sql.DB
+}
+
+func newPostgresDeviceStore(databaseURL string) (*postgresDeviceStore, error) {
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, postgresSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &postgresDeviceStore{db: db}, nil
+}
+
+func (s *postgresDeviceStore) GetStates(deviceIDs []string) (map[string]DeviceState, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT device_id, status, workflow_id FROM device_state WHERE device_id = ANY($1)`, deviceIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string]DeviceState, len(deviceIDs))
+	for rows.Next() {
+		var deviceID string
+		var state DeviceState
+		if err := rows.Scan(&deviceID, &state.Status, &state.WorkflowID); err != nil {
+			return nil, err
+		}
+		states[deviceID] = state
+	}
+	return states, rows.Err()
+}
+
+func (s *postgresDeviceStore) SetState(deviceID string, state DeviceState) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := writeDeviceState(tx, deviceID, state); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresDeviceStore) Book(deviceID, workflowID string) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// A device with no row yet gets one with its configured status, so
+	// there is always a row to lock and concurrent bookings queue on it.
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO device_state (device_id, status, workflow_id, updated_at)
+		VALUES ($1, $2, '', now())
+		ON CONFLICT (device_id) DO NOTHING`,
+		deviceID, deviceFleet()[deviceID].Status)
+	if err != nil {
+		return "", err
+	}
+	var status string
+	err = tx.QueryRowContext(ctx,
+		`SELECT status FROM device_state WHERE device_id = $1 FOR UPDATE`, deviceID).Scan(&status)
+	if err != nil {
+		return "", err
+	}
+	if status != "available" {
+		return status, ErrDeviceUnavailable
+	}
+
+	if err := writeDeviceState(tx, deviceID, DeviceState{Status: "busy", WorkflowID: workflowID}); err != nil {
+		return status, err
+	}
+	return status, tx.Commit()
+}
+
+func (s *postgresDeviceStore) Close() error {
+	return s.db.Close()
+}
+
+func writeDeviceState(tx *sql.Tx, deviceID string, state DeviceState) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO device_state (device_id, status, workflow_id, updated_at)
+		VALUES ($1, $2, $3, now())
+		ON CONFLICT (device_id) DO UPDATE
+		SET status = EXCLUDED.status, workflow_id = EXCLUDED.workflow_id, updated_at = EXCLUDED.updated_at`,
+		deviceID, state.Status, state.WorkflowID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO device_state_history (device_id, status, workflow_id) VALUES ($1, $2, $3)`,
+		deviceID, state.Status, state.WorkflowID)
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Simulated devices that can heat or cool have a chamber temperature, kept
+// under device:{<id>}:thermal so every replica sees the same one. heat and
+// cool set a target the chamber ramps to at the profile's rate, taking at
+// least as long as the ramp and hold_seconds; the chamber then holds the
+// target until the next one. Telemetry reports the temperature as it
+// ramps.
+const (
+	defaultAmbientTemperature = 22.0
+	defaultHeatRate           = 30.0 // C per minute
+	defaultCoolRate           = 15.0 // C per minute
+)
+
+// ThermalProfile sets how a simulated chamber's temperature changes.
+type ThermalProfile struct {
+	AmbientC        float64 `json:"ambient_c,omitempty"`
+	HeatRateCPerMin float64 `json:"heat_rate_c_per_min,omitempty"`
+	CoolRateCPerMin float64 `json:"cool_rate_c_per_min,omitempty"`
+}
+
+// ThermalState is a chamber ramping from StartC, at StartedAt, to TargetC
+// at RateCPerMin, or holding TargetC once it gets there.
+type ThermalState struct {
+	StartC      float64 `json:"start_c"`
+	TargetC     float64 `json:"target_c"`
+	RateCPerMin float64 `json:"rate_c_per_min"`
+	StartedAt   string  `json:"started_at"`
+}
+
+func thermalKey(deviceID string) string {
+	return deviceKey(deviceID, "thermal")
+}
+
+func (p *ThermalProfile) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.AmbientC < -20 || p.AmbientC > 100 {
+		return fmt.Errorf("ambient_c must be between -20 and 100")
+	}
+	if p.HeatRateCPerMin < 0 || p.CoolRateCPerMin < 0 {
+		return fmt.Errorf("ramp rates must not be negative")
+	}
+	return nil
+}
+
+// withDefaults fills in what the profile leaves out.
+func (p *ThermalProfile) withDefaults() ThermalProfile {
+	profile := ThermalProfile{AmbientC: defaultAmbientTemperature, HeatRateCPerMin: defaultHeatRate, CoolRateCPerMin: defaultCoolRate}
+	if p != nil {
+		if p.AmbientC != 0 {
+			profile.AmbientC = p.AmbientC
+		}
+		if p.HeatRateCPerMin > 0 {
+			profile.HeatRateCPerMin = p.HeatRateCPerMin
+		}
+		if p.CoolRateCPerMin > 0 {
+			profile.CoolRateCPerMin = p.CoolRateCPerMin
+		}
+	}
+	return profile
+}
+
+// hasChamber reports whether the device can heat or cool, and so has a
+// simulated temperature.
+func hasChamber(deviceID string) bool {
+	for _, operation := range deviceFleet()[deviceID].Capabilities {
+		if operation == "heat" || operation == "cool" {
+			return true
+		}
+	}
+	return false
+}
+
+// temperatureAt returns the chamber's temperature at the time, rounded to a
+// tenth of a degree, and whether it has reached its target.
+func (s ThermalState) temperatureAt(at time.Time) (float64, bool) {
+	started, err := time.Parse(time.RFC3339Nano, s.StartedAt)
+	if err != nil || s.RateCPerMin <= 0 {
+		return s.TargetC, true
+	}
+	change := s.RateCPerMin * at.Sub(started).Minutes()
+	if change < 0 {
+		change = 0
+	}
+	temperature, reached := s.TargetC, true
+	if s.TargetC > s.StartC && s.StartC+change < s.TargetC {
+		temperature, reached = s.StartC+change, false
+	} else if s.TargetC < s.StartC && s.StartC-change > s.TargetC {
+		temperature, reached = s.StartC-change, false
+	}
+	return math.Round(temperature*10) / 10, reached
+}
+
+// rampDuration is how long the chamber takes to reach its target.
+func (s ThermalState) rampDuration() time.Duration {
+	if s.RateCPerMin <= 0 {
+		return 0
+	}
+	return time.Duration(math.Abs(s.TargetC-s.StartC) / s.RateCPerMin * float64(time.Minute))
+}
+
+// getThermalState returns the device's chamber state; a chamber never
+// heated or cooled holds the ambient temperature.
+func getThermalState(deviceID string) ThermalState {
+	ambient := getSimulationProfile(deviceID).Thermal.withDefaults().AmbientC
+	idle := ThermalState{StartC: ambient, TargetC: ambient}
+
+	data, err := redisClient.Get(ctx, thermalKey(deviceID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading temperature of device %s: %v", deviceID, err)
+		}
+		return idle
+	}
+	var state ThermalState
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		log.Printf("Invalid thermal state for device %s: %v", deviceID, err)
+		return idle
+	}
+	return state
+}
+
+func saveThermalState(deviceID string, state ThermalState) {
+	data, _ := json.Marshal(state)
+	if err := redisClient.Set(ctx, thermalKey(deviceID), data, 0).Err(); err != nil {
+		log.Printf("Error saving temperature of device %s: %v", deviceID, err)
+	}
+}
+
+// startRamp sets the chamber ramping to the operation's target_temperature
+// from where it is now. heat can't lower the temperature, nor cool raise
+// it.
+func startRamp(deviceID, operation string, params map[string]interface{}) (*ThermalState, error) {
+	target, ok := params["target_temperature"].(float64)
+	if !ok {
+		return nil, &DriverError{StatusCode: http.StatusBadRequest, Message: "target_temperature is required"}
+	}
+
+	now := time.Now()
+	current, _ := getThermalState(deviceID).temperatureAt(now)
+	profile := getSimulationProfile(deviceID).Thermal.withDefaults()
+	rate := profile.HeatRateCPerMin
+	switch {
+	case operation == "heat" && target < current-0.5:
+		return nil, &DriverError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("Chamber is at %.1f C, above the target; cool it instead", current)}
+	case operation == "cool" && target > current+0.5:
+		return nil, &DriverError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("Chamber is at %.1f C, below the target; heat it instead", current)}
+	case operation == "cool":
+		rate = profile.CoolRateCPerMin
+	}
+
+	state := ThermalState{StartC: current, TargetC: target, RateCPerMin: rate, StartedAt: now.UTC().Format(time.RFC3339Nano)}
+	saveThermalState(deviceID, state)
+	return &state, nil
+}
+
+// stopRamp leaves the chamber at the temperature it had reached, as when
+// its operation is aborted.
+func stopRamp(deviceID string, state ThermalState) {
+	current, reached := state.temperatureAt(time.Now())
+	if reached {
+		return
+	}
+	saveThermalState(deviceID, ThermalState{StartC: current, TargetC: current, StartedAt: time.Now().UTC().Format(time.RFC3339Nano)})
+}
+
+// simulatedTelemetry is the telemetry of a simulated chamber, as of now.
+func simulatedTelemetry(deviceID string) map[string]interface{} {
+	state := getThermalState(deviceID)
+	temperature, reached := state.temperatureAt(time.Now())
+	return map[string]interface{}{
+		"temperature":        temperature,
+		"target_temperature": state.TargetC,
+		"ramping":            !reached,
+		"simulated":          true,
+		"received_at":        time.Now().UTC().Format(time.RFC3339),
+	}
+}
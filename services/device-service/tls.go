@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"platform"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultAutocertCacheDir = "autocert-cache"
+
+// serverTLSConfig is the TLS to serve with, nil to serve plain HTTP. The
+// certificate is TLS_CERT_FILE and TLS_KEY_FILE, or is obtained from Let's
+// Encrypt for the TLS_AUTOCERT_DOMAINS, cached in TLS_AUTOCERT_CACHE_DIR.
+// With TLS_CLIENT_CA_FILE, callers must present a certificate signed by one
+// of its CAs (mutual TLS).
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	domains := platform.SplitList(os.Getenv("TLS_AUTOCERT_DOMAINS"))
+	clientCAFile := os.Getenv("TLS_CLIENT_CA_FILE")
+
+	var config *tls.Config
+	switch {
+	case (certFile != "" || keyFile != "") && len(domains) > 0:
+		return nil, fmt.Errorf("set either TLS_CERT_FILE and TLS_KEY_FILE or TLS_AUTOCERT_DOMAINS, not both")
+	case certFile != "" || keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case len(domains) > 0:
+		cacheDir := os.Getenv("TLS_AUTOCERT_CACHE_DIR")
+		if cacheDir == "" {
+			cacheDir = defaultAutocertCacheDir
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      os.Getenv("TLS_AUTOCERT_EMAIL"),
+		}
+		config = manager.TLSConfig()
+	case clientCAFile != "":
+		return nil, fmt.Errorf("TLS_CLIENT_CA_FILE needs a certificate to serve with")
+	default:
+		return nil, nil
+	}
+	config.MinVersion = tls.VersionTLS12
+
+	if clientCAFile != "" {
+		pool, err := platform.LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// serve serves the router at addr, over HTTPS if TLS is configured.
+func serve(router *gin.Engine, addr string) error {
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+	server := &http.Server{Addr: addr, Handler: router, TLSConfig: tlsConfig}
+	if tlsConfig == nil {
+		return server.ListenAndServe()
+	}
+	if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		log.Println("Serving HTTPS, requiring client certificates")
+	} else {
+		log.Println("Serving HTTPS")
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// serviceTransport makes the calls to the other services. With
+// SERVICE_TLS_CA_FILE it trusts only those CAs for them, and with
+// SERVICE_TLS_CERT_FILE and SERVICE_TLS_KEY_FILE it presents that client
+// certificate, for services requiring mutual TLS.
+var serviceTransport http.RoundTripper = http.DefaultTransport
+
+func configureServiceTLS() {
+	caFile := os.Getenv("SERVICE_TLS_CA_FILE")
+	certFile, keyFile := os.Getenv("SERVICE_TLS_CERT_FILE"), os.Getenv("SERVICE_TLS_KEY_FILE")
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := platform.LoadCertPool(caFile)
+		if err != nil {
+			log.Fatalf("Invalid SERVICE_TLS_CA_FILE: %v", err)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("Invalid service client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+		log.Println("Calling other services with a client certificate")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	serviceTransport = transport
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// DEVICE_TRASH_KEY is a hash of the deleted devices, by ID. A deleted
+// device is left out of listings and answered as not found, but keeps its
+// settings and history, until it is restored or purged TRASH_RETENTION (a
+// duration such as 720h, the default) after it was deleted, by a janitor
+// running every RETENTION_CHECK_INTERVAL. Purging deletes the device's
+// settings, reservations and history; the device stays in the hash, with
+// purged_at set, so it doesn't reappear. TRASH_RETENTION=0 keeps deleted
+// devices until they are restored.
+const (
+	DEVICE_TRASH_KEY      = "devices:trash"
+	defaultTrashRetention = 30 * 24 * time.Hour
+)
+
+var trashRetention = defaultTrashRetention
+
+// DeletedDevice is a device in the trash.
+type DeletedDevice struct {
+	DeviceID   string `json:"device_id"`
+	Name       string `json:"name"`
+	Lab        string `json:"lab,omitempty"`
+	DeletedAt  string `json:"deleted_at"`
+	DeletedBy  string `json:"deleted_by,omitempty"`
+	PurgeAfter string `json:"purge_after,omitempty"`
+	PurgedAt   string `json:"purged_at,omitempty"`
+}
+
+// deletedDevices caches the IDs of the devices in the trash, and the purged
+// ones, under "".
+var deletedDevices = newReadCache("deleted-devices")
+
+// deletedDeviceIDs returns the IDs of the devices in the trash, and the
+// purged ones.
+func deletedDeviceIDs() (map[string]bool, error) {
+	deleted, err := deletedDevices.get("", func() (interface{}, error) {
+		deviceIDs, err := redisClient.HKeys(ctx, DEVICE_TRASH_KEY).Result()
+		if err != nil {
+			return nil, err
+		}
+		deleted := make(map[string]bool, len(deviceIDs))
+		for _, deviceID := range deviceIDs {
+			deleted[deviceID] = true
+		}
+		return deleted, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted.(map[string]bool), nil
+}
+
+// deviceDeleted reports whether the device is in the trash, or was purged.
+func deviceDeleted(deviceID string) (bool, error) {
+	deleted, err := deletedDeviceIDs()
+	return deleted[deviceID], err
+}
+
+// getDeletedDevices returns the devices in the trash, and the purged ones,
+// by ID.
+func getDeletedDevices() (map[string]DeletedDevice, error) {
+	values, err := redisClient.HGetAll(ctx, DEVICE_TRASH_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	deleted := make(map[string]DeletedDevice, len(values))
+	for deviceID, value := range values {
+		var device DeletedDevice
+		if err := json.Unmarshal([]byte(value), &device); err != nil {
+			log.Printf("Invalid trash entry for device %s: %v", deviceID, err)
+			device = DeletedDevice{DeviceID: deviceID}
+		}
+		deleted[deviceID] = device
+	}
+	return deleted, nil
+}
+
+func saveDeletedDevice(cmd redis.Cmdable, device DeletedDevice) error {
+	data, err := json.Marshal(device)
+	if err != nil {
+		return err
+	}
+	return cmd.HSet(ctx, DEVICE_TRASH_KEY, device.DeviceID, data).Err()
+}
+
+// withPurgeAfter sets when the device will be purged, if it will be.
+func (d DeletedDevice) withPurgeAfter() DeletedDevice {
+	deleted, err := time.Parse(time.RFC3339, d.DeletedAt)
+	if err == nil && trashRetention > 0 && d.PurgedAt == "" {
+		d.PurgeAfter = deleted.Add(trashRetention).Format(time.RFC3339)
+	}
+	return d
+}
+
+// deleteDeviceHandler moves an idle device to the trash. A device that is
+// booked, has workflows queued for it or has reservations to come can't
+// be deleted.
+func deleteDeviceHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+
+	if status := getDeviceStatus(deviceID); status != "available" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Device is " + status + "; only available devices can be deleted"})
+		return
+	}
+	queue, err := getBookingQueue(deviceID)
+	if err != nil {
+		log.Printf("Error getting booking queue of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete device"})
+		return
+	}
+	if len(queue) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workflows are queued for the device"})
+		return
+	}
+	reservations, err := getReservations(deviceID)
+	if err != nil {
+		log.Printf("Error getting reservations of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete device"})
+		return
+	}
+	for _, r := range reservations {
+		if r.Status == ReservationScheduled || r.Status == ReservationActive {
+			c.JSON(http.StatusConflict, gin.H{"error": "Device has reservations to come; cancel them first", "reservation_id": r.ID})
+			return
+		}
+	}
+
+	lab, err := getDeviceLab(deviceID)
+	if err != nil {
+		log.Printf("Error getting lab of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete device"})
+		return
+	}
+	deleted := DeletedDevice{
+		DeviceID:  deviceID,
+		Name:      deviceFleet()[deviceID].Name,
+		Lab:       lab,
+		DeletedAt: time.Now().UTC().Format(time.RFC3339),
+		DeletedBy: requestActor(c),
+	}
+	if err := saveDeletedDevice(redisClient, deleted); err != nil {
+		log.Printf("Error deleting device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete device"})
+		return
+	}
+	deletedDevices.invalidate()
+
+	// Bookings are refused once the device is in the trash; one made
+	// before it got there takes it back out.
+	if status := getDeviceStatus(deviceID); status != "available" {
+		redisClient.HDel(ctx, DEVICE_TRASH_KEY, deviceID)
+		deletedDevices.invalidate()
+		c.JSON(http.StatusConflict, gin.H{"error": "Device is " + status + "; only available devices can be deleted"})
+		return
+	}
+
+	log.Printf("Device %s moved to the trash", deviceID)
+	c.JSON(http.StatusOK, deleted.withPurgeAfter())
+}
+
+// listDeletedDevicesHandler lists the lab's devices in the trash, most
+// recently deleted first. Admins see every lab's.
+func listDeletedDevicesHandler(c *gin.Context) {
+	deleted, err := getDeletedDevices()
+	if err != nil {
+		log.Printf("Error getting deleted devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve deleted devices"})
+		return
+	}
+
+	devices := []DeletedDevice{}
+	for _, device := range deleted {
+		if device.PurgedAt == "" && (device.Lab == requestLab(c) || isAdmin(c)) {
+			devices = append(devices, device.withPurgeAfter())
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].DeletedAt != devices[j].DeletedAt {
+			return devices[i].DeletedAt > devices[j].DeletedAt
+		}
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+	c.JSON(http.StatusOK, devices)
+}
+
+// restoreDeletedDeviceHandler takes a device out of the trash, with the
+// settings and history it had. Purged devices can't be restored.
+func restoreDeletedDeviceHandler(c *gin.Context) {
+	deviceID := c.Param("deleted_device_id")
+
+	deleted, err := getDeletedDevices()
+	if err != nil {
+		log.Printf("Error getting deleted devices: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore device"})
+		return
+	}
+	device, ok := deleted[deviceID]
+	if !ok || device.PurgedAt != "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted device not found"})
+		return
+	}
+
+	if err := redisClient.HDel(ctx, DEVICE_TRASH_KEY, deviceID).Err(); err != nil {
+		log.Printf("Error restoring device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore device"})
+		return
+	}
+	deletedDevices.invalidate()
+
+	log.Printf("Device %s restored from the trash", deviceID)
+	restored, err := loadDevice(deviceID)
+	if err != nil {
+		log.Printf("Error loading device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device"})
+		return
+	}
+	c.JSON(http.StatusOK, restored)
+}
+
+// purgeDevice deletes a deleted device's settings, reservations and
+// history, and marks it purged.
+func purgeDevice(device DeletedDevice) error {
+	deviceID := device.DeviceID
+	device.PurgedAt = time.Now().UTC().Format(time.RFC3339)
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx,
+			deviceLabKey(deviceID), calibrationKey(deviceID), firmwareKey(deviceID), metadataKey(deviceID),
+			consumablesKey(deviceID), simulationKey(deviceID), faultsKey(deviceID), telemetryKey(deviceID),
+			errorStateKey(deviceID), reservationsKey(deviceID), bookingHistoryKey(deviceID), operationHistoryKey(deviceID),
+			thermalKey(deviceID), allocationKey(deviceID),
+		)
+		return saveDeletedDevice(pipe, device)
+	})
+	if err == nil {
+		deviceLabs.invalidate(deviceID)
+	}
+	return err
+}
+
+// purgeTrash purges the devices deleted before the cutoff, returning their
+// IDs.
+func purgeTrash(cutoff time.Time) ([]string, error) {
+	deleted, err := getDeletedDevices()
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	for deviceID, device := range deleted {
+		at, err := time.Parse(time.RFC3339, device.DeletedAt)
+		if device.PurgedAt != "" || err != nil || !at.Before(cutoff) {
+			continue
+		}
+		if err := purgeDevice(device); err != nil {
+			return purged, err
+		}
+		purged = append(purged, deviceID)
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
+
+// startTrashJanitor purges deleted devices in the background once
+// TRASH_RETENTION has passed.
+func startTrashJanitor() {
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid TRASH_RETENTION %q", value)
+		}
+		trashRetention = d
+	}
+	if trashRetention == 0 {
+		return
+	}
+	interval := defaultRetentionInterval
+	if value := os.Getenv("RETENTION_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RETENTION_CHECK_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purged, err := purgeTrash(time.Now().Add(-trashRetention))
+			if err != nil {
+				log.Printf("Error purging deleted devices: %v", err)
+			}
+			if len(purged) > 0 {
+				log.Printf("Purged %d device(s) deleted more than %s ago", len(purged), trashRetention)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Purging deleted devices %s after they are deleted, checking every %s", trashRetention, interval)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API_VERSION is the version of the API served under /v1. Clients may ask
+// for a version with the API-Version request header; every response says
+// which version served it.
+const (
+	API_VERSION        = "1"
+	API_VERSION_HEADER = "API-Version"
+)
+
+// legacySunset is when the unversioned paths may be removed, as an HTTP
+// date for the Sunset header.
+const legacySunset = "Fri, 01 Oct 2027 00:00:00 GMT"
+
+// apiVersion rejects requests for a version this service doesn't serve.
+func apiVersion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requested := strings.TrimPrefix(strings.TrimSpace(c.GetHeader(API_VERSION_HEADER)), "v")
+		if requested != "" && requested != API_VERSION {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":     "Unsupported API version " + requested,
+				"supported": []string{API_VERSION},
+			})
+			return
+		}
+		c.Header(API_VERSION_HEADER, API_VERSION)
+		c.Next()
+	}
+}
+
+// deprecatedPath marks responses to the unversioned paths as deprecated
+// (RFC 9745), with when they go away and the /v1 path to use instead.
+func deprecatedPath() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Deprecation", "true")
+		c.Header("Sunset", legacySunset)
+		c.Header("Link", "</v"+API_VERSION+c.Request.URL.Path+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A run can be simulated against a virtual copy of a device, to try out a
+// step sequence without booking or occupying the instrument. The virtual
+// driver starts from the device's consumable levels and chamber
+// temperature, keeps what the steps change in memory and takes no time:
+// each step gets the duration it is expected to take, from the device's
+// simulation profile for simulated devices and the operation's typical
+// duration for the others. Nothing the device has is changed.
+
+// SimulateRunRequest is the step sequence to simulate.
+type SimulateRunRequest struct {
+	Steps []SimulateStep `json:"steps" binding:"required"`
+}
+
+type SimulateStep struct {
+	Operation string                 `json:"operation"`
+	Params    map[string]interface{} `json:"params,omitempty"`
+}
+
+// SimulatedStep is a step as the virtual device ran it. StartMs is when it
+// would start, from the start of the run. A step the device couldn't run
+// has Error set and takes no time; the steps after it are still run.
+type SimulatedStep struct {
+	StepIndex   int                    `json:"step_index"`
+	Operation   string                 `json:"operation"`
+	StartMs     int64                  `json:"start_ms"`
+	DurationMs  int64                  `json:"duration_ms"`
+	FailureRate float64                `json:"failure_rate,omitempty"`
+	Consumables map[string]float64     `json:"consumables,omitempty"`
+	Result      map[string]interface{} `json:"result,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	Code        string                 `json:"code,omitempty"`
+}
+
+// SimulatedRun is the timing and resources of a simulated step sequence.
+type SimulatedRun struct {
+	DeviceID        string             `json:"device_id"`
+	OK              bool               `json:"ok"`
+	TotalDurationMs int64              `json:"total_duration_ms"`
+	Steps           []SimulatedStep    `json:"steps"`
+	ConsumablesUsed map[string]float64 `json:"consumables_used"`
+	// ConsumablesLeft are the device's levels as the run would leave them.
+	ConsumablesLeft []ConsumableLevel `json:"consumables_left"`
+	Warnings        []string          `json:"warnings,omitempty"`
+}
+
+// virtualDriver runs operations on an in-memory copy of a device.
+type virtualDriver struct {
+	deviceID    string
+	simulated   bool
+	profile     SimulationProfile
+	levels      map[string]float64
+	temperature float64
+	// last is the duration and consumables of the last operation run.
+	last     time.Duration
+	lastUsed map[string]float64
+}
+
+// newVirtualDriver copies the device's consumables and temperature as they
+// are now.
+func newVirtualDriver(deviceID string) (*virtualDriver, error) {
+	levels, err := getConsumableLevels(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	d := &virtualDriver{deviceID: deviceID, profile: getSimulationProfile(deviceID), levels: map[string]float64{}}
+	d.simulated = isSimulated(deviceID)
+	for _, level := range levels {
+		d.levels[level.Name] = level.Level
+	}
+	d.temperature, _ = getThermalState(deviceID).temperatureAt(time.Now())
+	return d, nil
+}
+
+// expected is the duration the profile's distribution centres on.
+func (p DurationProfile) expected() time.Duration {
+	ms := float64(p.MeanMs)
+	if p.Distribution == DistributionUniform {
+		ms = float64(p.MinMs+max(p.MaxMs, p.MinMs)) / 2
+	}
+	ms = math.Max(ms, float64(p.MinMs))
+	if p.MaxMs > 0 {
+		ms = math.Min(ms, float64(p.MaxMs))
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// checkParams checks an operation's params against its capability: the
+// required ones are given, and numbers are numbers within bounds.
+func (c Capability) checkParams(params map[string]interface{}) error {
+	for _, param := range c.Parameters {
+		value, ok := params[param.Name]
+		if !ok || value == nil {
+			if param.Required {
+				return fmt.Errorf("%s is required", param.Name)
+			}
+			continue
+		}
+		if param.Type == ParamTypeString {
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("%s must be a string", param.Name)
+			}
+			continue
+		}
+		n, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s must be a number", param.Name)
+		}
+		if param.Type == ParamTypeInteger && n != math.Trunc(n) {
+			return fmt.Errorf("%s must be a whole number", param.Name)
+		}
+		if param.Min != nil && n < *param.Min {
+			return fmt.Errorf("%s must be at least %g %s", param.Name, *param.Min, param.Unit)
+		}
+		if param.Max != nil && n > *param.Max {
+			return fmt.Errorf("%s must be at most %g %s", param.Name, *param.Max, param.Unit)
+		}
+	}
+	return nil
+}
+
+func (d *virtualDriver) Execute(_ context.Context, operation string, params map[string]interface{}) (*DriverResult, error) {
+	d.last, d.lastUsed = 0, nil
+	capable := false
+	for _, offered := range deviceFleet()[d.deviceID].Capabilities {
+		capable = capable || offered == operation
+	}
+	if !capable {
+		return nil, &DriverError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("Device can't run %s", operation)}
+	}
+	if err := CAPABILITIES[operation].checkParams(params); err != nil {
+		return nil, &DriverError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+
+	usage := consumableUsage(d.deviceID, operation, params)
+	for name, amount := range usage {
+		if d.levels[name] < amount {
+			return nil, &DeviceError{StatusCode: http.StatusConflict, Code: ErrorCodeConsumableExhausted, Message: fmt.Sprintf("Device is out of %s", name)}
+		}
+	}
+
+	duration := time.Duration(CAPABILITIES[operation].TypicalDurationMs) * time.Millisecond
+	if d.simulated {
+		duration = d.profile.forOperation(operation).Duration.expected()
+	}
+	if operation == "heat" || operation == "cool" {
+		target, _ := params["target_temperature"].(float64)
+		if (operation == "heat" && target < d.temperature-0.5) || (operation == "cool" && target > d.temperature+0.5) {
+			return nil, &DriverError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("Chamber would be at %.1f C; %s can't reach %.1f C", d.temperature, operation, target)}
+		}
+		thermal := d.profile.Thermal.withDefaults()
+		rate := thermal.HeatRateCPerMin
+		if operation == "cool" {
+			rate = thermal.CoolRateCPerMin
+		}
+		hold, _ := params["hold_seconds"].(float64)
+		ramp := ThermalState{StartC: d.temperature, TargetC: target, RateCPerMin: rate}.rampDuration()
+		duration = max(duration, ramp+time.Duration(hold*float64(time.Second)))
+		d.temperature = target
+	}
+
+	for name, amount := range usage {
+		d.levels[name] -= amount
+	}
+	d.last, d.lastUsed = duration, usage
+	return &DriverResult{Data: simulatedData(operation, params)}, nil
+}
+
+func (d *virtualDriver) Status(context.Context) (string, error) {
+	return "idle", nil
+}
+
+func (d *virtualDriver) Abort(context.Context) error {
+	return nil
+}
+
+// simulateRun runs the steps one after another on the virtual driver.
+func (d *virtualDriver) simulateRun(steps []SimulateStep) SimulatedRun {
+	run := SimulatedRun{DeviceID: d.deviceID, OK: true, Steps: []SimulatedStep{}, ConsumablesUsed: map[string]float64{}}
+	var elapsed time.Duration
+	for i, step := range steps {
+		simulated := SimulatedStep{StepIndex: i, Operation: step.Operation, StartMs: elapsed.Milliseconds()}
+		result, err := d.Execute(ctx, step.Operation, step.Params)
+		switch e := err.(type) {
+		case nil:
+			simulated.DurationMs = d.last.Milliseconds()
+			simulated.Consumables = d.lastUsed
+			simulated.Result = result.Data
+			if d.simulated {
+				simulated.FailureRate = d.profile.forOperation(step.Operation).FailureRate
+			}
+			for name, amount := range d.lastUsed {
+				run.ConsumablesUsed[name] += amount
+			}
+			elapsed += d.last
+		case *DeviceError:
+			simulated.Error, simulated.Code = e.Message, e.Code
+		default:
+			simulated.Error, simulated.Code = err.Error(), ErrorCodeDriverError
+		}
+		run.OK = run.OK && simulated.Error == ""
+		run.Steps = append(run.Steps, simulated)
+	}
+	run.TotalDurationMs = elapsed.Milliseconds()
+
+	stored := map[string]string{}
+	for name, level := range d.levels {
+		stored[name] = fmt.Sprint(level)
+	}
+	run.ConsumablesLeft = consumableLevels(d.deviceID, stored)
+	run.Warnings = consumableWarnings(run.ConsumablesLeft)
+	if status := getDeviceStatus(d.deviceID); status == "error" || status == "offline" {
+		run.Warnings = append(run.Warnings, "Device is "+status+" now")
+	}
+	return run
+}
+
+// simulateRunHandler simulates a step sequence on a virtual copy of the
+// device, leaving the device as it is.
+func simulateRunHandler(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	if _, ok := deviceFleet()[deviceID]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	var req SimulateRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "steps required"})
+		return
+	}
+
+	driver, err := newVirtualDriver(deviceID)
+	if err != nil {
+		log.Printf("Error reading consumables of device %s: %v", deviceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to simulate run"})
+		return
+	}
+	run := driver.simulateRun(req.Steps)
+	log.Printf("Simulated %d step(s) on device %s: %d ms, ok %t", len(req.Steps), deviceID, run.TotalDurationMs, run.OK)
+	c.JSON(http.StatusOK, run)
+}
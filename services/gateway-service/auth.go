@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// The gateway accepts the API keys issued by the sample service, which
+// maps each key's SHA-256 hash to its ID under apikeys:hash:<hash>, and
+// passes them on so the services can apply the key's own limits.
+const API_KEY_HASH_PREFIX = "apikeys:hash:"
+
+const API_KEY_HEADER = "X-API-Key"
+
+// clientContextKey holds who made the request, for rate limiting.
+const clientContextKey = "client"
+
+// With REQUIRE_API_KEY=true only requests with a valid key are forwarded.
+// SAMPLE_ADMIN_KEY is the sample service's admin key, accepted here too.
+var (
+	requireAPIKey bool
+	adminAPIKey   string
+)
+
+func configureAuth() {
+	requireAPIKey = os.Getenv("REQUIRE_API_KEY") == "true"
+	adminAPIKey = os.Getenv("SAMPLE_ADMIN_KEY")
+	if requireAPIKey && adminAPIKey == "" {
+		log.Println("REQUIRE_API_KEY is set without SAMPLE_ADMIN_KEY; API keys can't be managed")
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func requestAPIKey(c *gin.Context) string {
+	if key := strings.TrimSpace(c.GetHeader(API_KEY_HEADER)); key != "" {
+		return key
+	}
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ""
+}
+
+// validAPIKey reports whether a key is the admin key or one issued by the
+// sample service.
+func validAPIKey(key string) (bool, error) {
+	if adminAPIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminAPIKey)) == 1 {
+		return true, nil
+	}
+	err := redisClient.Get(ctx, API_KEY_HASH_PREFIX+hashAPIKey(key)).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// authenticate rejects requests with unknown API keys or sessions, and
+// requests with neither when keys are required, before they reach a
+// service. The client is identified by its user, its key, or else its
+// address.
+func authenticate(routes Routes) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Only the gateway says which user a request is from, and which
+		// lab it is made in, whichever route it is for.
+		c.Request.Header.Del(USER_HEADER)
+		c.Request.Header.Del(USER_ID_HEADER)
+		c.Request.Header.Del(USER_ROLE_HEADER)
+		c.Request.Header.Del(LAB_HEADER)
+
+		route := routes.match(c.Param("path"))
+		if route != nil && route.Public {
+			c.Set(clientContextKey, "ip:"+c.ClientIP())
+			c.Next()
+			return
+		}
+
+		var session *SessionClaims
+		if token := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")); isSessionToken(token) {
+			claims, err := parseSessionToken(token)
+			if err != nil {
+				if !isInvalidSession(err) {
+					log.Printf("Error checking session token: %v", err)
+					c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+					return
+				}
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+				return
+			}
+			session = claims
+			forwardUser(c, session)
+		}
+		if route != nil && route.Role != "" {
+			if session == nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Sign in to use this endpoint"})
+				return
+			}
+			if session.Role != route.Role {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This endpoint requires the " + route.Role + " role"})
+				return
+			}
+		}
+
+		key := requestAPIKey(c)
+		switch {
+		case key == "" && session != nil:
+			// A session stands in for a key.
+		case key == "" && requireAPIKey:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "An API key is required"})
+			return
+		case key == "":
+			c.Set(clientContextKey, "ip:"+c.ClientIP())
+		default:
+			valid, err := validAPIKey(key)
+			if err != nil {
+				log.Printf("Error looking up API key: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+				return
+			}
+			if !valid {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				return
+			}
+			c.Set(clientContextKey, "key:"+hashAPIKey(key))
+		}
+		if session != nil {
+			c.Set(clientContextKey, "user:"+session.Subject)
+		}
+		c.Next()
+	}
+}
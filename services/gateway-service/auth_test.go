@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// forwarded is what the service behind the gateway was sent.
+type forwarded struct {
+	Path          string
+	User          string
+	UserID        string
+	Role          string
+	Lab           string
+	Authorization string
+}
+
+// startAuthGateway serves the API through authenticate to a service that
+// echoes what it was sent, with a user-only route at /devices, an admin one
+// at /admin and a public one at /auth, and returns the gateway's URL.
+func startAuthGateway(t *testing.T) string {
+	t.Helper()
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(forwarded{
+			Path:          r.URL.Path,
+			User:          r.Header.Get(USER_HEADER),
+			UserID:        r.Header.Get(USER_ID_HEADER),
+			Role:          r.Header.Get(USER_ROLE_HEADER),
+			Lab:           r.Header.Get(LAB_HEADER),
+			Authorization: r.Header.Get("Authorization"),
+		})
+	}))
+	t.Cleanup(service.Close)
+
+	upstream := Upstream{Name: "device-service", URL: service.URL}
+	routes, err := newRoutes([]Route{
+		{Prefix: "devices", Upstream: upstream},
+		{Prefix: "admin", Upstream: upstream, Role: "admin"},
+		{Prefix: "auth", Upstream: upstream, Public: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.Any(API_PREFIX+"/*path", authenticate(routes), routes.proxy)
+	gateway := httptest.NewServer(router)
+	t.Cleanup(gateway.Close)
+	return gateway.URL
+}
+
+// configureTestAuth sets the gateway's auth settings until the test ends.
+func configureTestAuth(t *testing.T, requireKey bool, adminKey, secret string) {
+	t.Helper()
+	previousRequire, previousAdmin, previousSecret := requireAPIKey, adminAPIKey, jwtSecret
+	requireAPIKey, adminAPIKey, jwtSecret = requireKey, adminKey, []byte(secret)
+	t.Cleanup(func() {
+		requireAPIKey, adminAPIKey, jwtSecret = previousRequire, previousAdmin, previousSecret
+	})
+}
+
+// sessionToken signs a session token as the user service does.
+func sessionToken(t *testing.T, secret, sessionID, role string, expiresIn time.Duration) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, SessionClaims{
+		Username: "alice",
+		Role:     role,
+		Lab:      "lab-2",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    sessionTokenIssuer,
+			Subject:   "7",
+			ID:        sessionID,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
+		},
+	}).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// gatewayRequest gets a path below API_PREFIX, returning the response and,
+// if it got through, what the service was sent.
+func gatewayRequest(t *testing.T, gateway, path string, headers map[string]string) (*httptest.ResponseRecorder, forwarded) {
+	t.Helper()
+	r, _ := http.NewRequest(http.MethodGet, gateway+API_PREFIX+path, nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	w := httptest.NewRecorder()
+	w.Code = resp.StatusCode
+	io.Copy(w.Body, resp.Body)
+	var sent forwarded
+	if w.Code == http.StatusOK {
+		json.Unmarshal(w.Body.Bytes(), &sent)
+	}
+	return w, sent
+}
+
+func TestAuthenticateAPIKeys(t *testing.T) {
+	r := startFakeRedis(t)
+	configureTestAuth(t, true, "admin-key", "")
+	r.Strings[API_KEY_HASH_PREFIX+hashAPIKey("issued-key")] = "key-1"
+	gateway := startAuthGateway(t)
+
+	for _, test := range []struct {
+		name    string
+		path    string
+		headers map[string]string
+		want    int
+	}{
+		{"no key", "/devices", nil, http.StatusUnauthorized},
+		{"unknown key", "/devices", map[string]string{API_KEY_HEADER: "guessed"}, http.StatusUnauthorized},
+		{"admin key", "/devices", map[string]string{API_KEY_HEADER: "admin-key"}, http.StatusOK},
+		{"issued key", "/devices", map[string]string{API_KEY_HEADER: "issued-key"}, http.StatusOK},
+		{"issued key as bearer", "/devices", map[string]string{"Authorization": "Bearer issued-key"}, http.StatusOK},
+		{"public route", "/auth/login", nil, http.StatusOK},
+		{"role route with a key", "/admin/faults", map[string]string{API_KEY_HEADER: "admin-key"}, http.StatusUnauthorized},
+	} {
+		if w, _ := gatewayRequest(t, gateway, test.path, test.headers); w.Code != test.want {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, w.Body.String(), test.want)
+		}
+	}
+
+	configureTestAuth(t, false, "admin-key", "")
+	if w, _ := gatewayRequest(t, gateway, "/devices", nil); w.Code != http.StatusOK {
+		t.Errorf("no key with keys optional: got %d, want 200", w.Code)
+	}
+}
+
+func TestAuthenticateSessions(t *testing.T) {
+	const secret = "test-secret"
+	r := startFakeRedis(t)
+	configureTestAuth(t, true, "", secret)
+	r.Strings[SESSION_KEY_PREFIX+"s-user"] = "{}"
+	r.Strings[SESSION_KEY_PREFIX+"s-admin"] = "{}"
+	gateway := startAuthGateway(t)
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	user := sessionToken(t, secret, "s-user", "user", time.Hour)
+	w, sent := gatewayRequest(t, gateway, "/devices", map[string]string{
+		"Authorization":  "Bearer " + user,
+		USER_HEADER:      "mallory",
+		USER_ROLE_HEADER: "admin",
+	})
+	want := forwarded{Path: "/v1/devices", User: "alice", UserID: "7", Role: "user", Lab: "lab-2"}
+	if w.Code != http.StatusOK || sent != want {
+		t.Fatalf("got %d, sent %+v, want %+v", w.Code, sent, want)
+	}
+	if w, sent := gatewayRequest(t, gateway, "/auth/me", map[string]string{USER_HEADER: "mallory", LAB_HEADER: "lab-9"}); w.Code != http.StatusOK || sent.User != "" || sent.Lab != "" {
+		t.Errorf("public route: got %d, sent %+v, want the user headers dropped", w.Code, sent)
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"ended session", sessionToken(t, secret, "s-ended", "user", time.Hour), http.StatusUnauthorized},
+		{"expired", sessionToken(t, secret, "s-user", "user", -time.Minute), http.StatusUnauthorized},
+		{"wrong secret", sessionToken(t, "other-secret", "s-user", "user", time.Hour), http.StatusUnauthorized},
+	} {
+		if w, _ := gatewayRequest(t, gateway, "/devices", bearer(test.token)); w.Code != test.want {
+			t.Errorf("%s: got %d %s, want %d", test.name, w.Code, w.Body.String(), test.want)
+		}
+	}
+
+	if w, _ := gatewayRequest(t, gateway, "/admin/faults", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("admin route signed out: got %d, want 401", w.Code)
+	}
+	if w, _ := gatewayRequest(t, gateway, "/admin/faults", bearer(user)); w.Code != http.StatusForbidden {
+		t.Errorf("admin route as a user: got %d, want 403", w.Code)
+	}
+	admin := sessionToken(t, secret, "s-admin", "admin", time.Hour)
+	if w, sent := gatewayRequest(t, gateway, "/admin/faults", bearer(admin)); w.Code != http.StatusOK || sent.Role != "admin" {
+		t.Errorf("admin route as an admin: got %d, sent %+v", w.Code, sent)
+	}
+	if w, sent := gatewayRequest(t, gateway, "/admin/storage/device-service/keys", bearer(admin)); w.Code != http.StatusOK || sent.Path != "/v1/admin/storage/keys" {
+		t.Errorf("storage route as an admin: got %d, sent %+v", w.Code, sent)
+	}
+	if w, _ := gatewayRequest(t, gateway, "/admin/storage/device-service/keys", bearer(user)); w.Code != http.StatusForbidden {
+		t.Errorf("storage route as a user: got %d, want 403", w.Code)
+	}
+}
+
+func TestIsSessionToken(t *testing.T) {
+	configureTestAuth(t, false, "", "")
+	if isSessionToken("a.b.c") {
+		t.Error("took a token for a session without JWT_SECRET")
+	}
+	configureTestAuth(t, false, "", "secret")
+	if !isSessionToken("a.b.c") || isSessionToken("api-key") {
+		t.Error("didn't tell session tokens from API keys")
+	}
+}
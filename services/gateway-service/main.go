@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"platform"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisClient redis.UniversalClient
+	ctx         = context.Background()
+)
+
+// API_PREFIX is the path the gateway serves the other services under.
+const API_PREFIX = "/api/v1"
+
+const defaultRateLimit = 600
+
+// Upstream is one of the services behind the gateway.
+type Upstream struct {
+	Name string
+	URL  string
+}
+
+type UpstreamHealth struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	// Details is what the service's health check returned.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+var healthClient = &http.Client{Timeout: 3 * time.Second}
+
+// upstreamURL reads a service's URL from the environment.
+func upstreamURL(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// checkUpstream calls a service's health check, timing it.
+func checkUpstream(upstream Upstream) UpstreamHealth {
+	start := time.Now()
+	resp, err := healthClient.Get(upstream.URL + "/health")
+	latency := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		return UpstreamHealth{Status: "unreachable", LatencyMS: latency, Error: err.Error()}
+	}
+	defer resp.Body.Close()
+	var details map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&details)
+	if resp.StatusCode != http.StatusOK {
+		return UpstreamHealth{Status: "unhealthy", LatencyMS: latency, Error: resp.Status, Details: details}
+	}
+	// A service that lost Redis is up but can't serve requests.
+	if details["status"] == "degraded" {
+		return UpstreamHealth{Status: "degraded", LatencyMS: latency, Details: details}
+	}
+	return UpstreamHealth{Status: "healthy", LatencyMS: latency, Details: details}
+}
+
+// checkUpstreams checks every service in parallel.
+func checkUpstreams(upstreams []Upstream) []UpstreamHealth {
+	results := make([]UpstreamHealth, len(upstreams))
+	done := make(chan struct{})
+	for i, upstream := range upstreams {
+		go func(i int, upstream Upstream) {
+			results[i] = checkUpstream(upstream)
+			done <- struct{}{}
+		}(i, upstream)
+	}
+	for range upstreams {
+		<-done
+	}
+	return results
+}
+
+// healthHandler reports the gateway healthy when Redis is up and every
+// service behind it is healthy, checking them in parallel.
+func healthHandler(upstreams []Upstream) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		results := checkUpstreams(upstreams)
+
+		status := http.StatusOK
+		services := map[string]UpstreamHealth{}
+		for i, upstream := range upstreams {
+			services[upstream.Name] = results[i]
+			if results[i].Status != "healthy" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+		if !platform.RedisUp() {
+			status = http.StatusServiceUnavailable
+		}
+		health := "healthy"
+		if status != http.StatusOK {
+			health = "degraded"
+		}
+		c.JSON(status, gin.H{
+			"status":   health,
+			"service":  "gateway-service",
+			"redis":    platform.RedisStatus(),
+			"services": services,
+		})
+	}
+}
+
+func main() {
+	// Configure logging
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	workflows := Upstream{Name: "workflow-service", URL: upstreamURL("WORKFLOW_API_URL", "http://localhost:5003")}
+	devices := Upstream{Name: "device-service", URL: upstreamURL("DEVICE_API_URL", "http://localhost:5001")}
+	samples := Upstream{Name: "sample-service", URL: upstreamURL("SAMPLE_API_URL", "http://localhost:5002")}
+	notifications := Upstream{Name: "notification-service", URL: upstreamURL("NOTIFICATION_API_URL", "http://localhost:5004")}
+	users := Upstream{Name: "user-service", URL: upstreamURL("USER_API_URL", "http://localhost:5005")}
+	upstreams := []Upstream{workflows, devices, samples, notifications, users}
+
+	// The proxies and health checks reach the services with SERVICE_TLS_*.
+	configureServiceTLS()
+	healthClient.Transport = serviceTransport
+
+	routes, err := newRoutes([]Route{
+		{Prefix: "workflows", Upstream: workflows},
+		{Prefix: "scheduler", Upstream: workflows},
+		{Prefix: "devices", Upstream: devices},
+		{Prefix: "capabilities", Upstream: devices},
+		{Prefix: "sila", Upstream: devices},
+		{Prefix: "admin", Upstream: devices, Role: "admin"},
+		{Prefix: "samples", Upstream: samples},
+		{Prefix: "plates", Upstream: samples},
+		{Prefix: "storage-locations", Upstream: samples},
+		{Prefix: "sample-types", Upstream: samples},
+		{Prefix: "webhooks", Upstream: samples},
+		{Prefix: "api-keys", Upstream: samples},
+		{Prefix: "graphql", Upstream: samples},
+		{Prefix: "notifications", Upstream: notifications},
+		// The user service checks sessions itself.
+		{Prefix: "auth", Upstream: users, Public: true},
+		{Prefix: "me", Upstream: users, Public: true},
+		{Prefix: "users", Upstream: users, Public: true},
+	})
+	if err != nil {
+		log.Fatalf("Invalid service URL: %v", err)
+	}
+
+	rateLimit := defaultRateLimit
+	if value := os.Getenv("RATE_LIMIT_PER_MINUTE"); value != "" {
+		if rateLimit, err = strconv.Atoi(value); err != nil || rateLimit < 0 {
+			log.Fatalf("RATE_LIMIT_PER_MINUTE must be a non-negative number: %q", value)
+		}
+	}
+	configureAuth()
+	platform.ConfigureFeatureFlags()
+	configureSessions()
+
+	// Connect to Redis, retrying while it starts
+	redisClient = platform.NewRedisClient()
+	platform.WaitForRedis(redisClient, nil)
+
+	// Setup Gin
+	platform.ConfigureDebug(redisClient)
+	router := gin.New()
+	router.Use(requestID(), gin.LoggerWithFormatter(requestLog), gin.Recovery())
+	platform.RegisterDebug(router)
+
+	// CORS is answered here for every service, so the frontend needs only
+	// the gateway's origin.
+	corsPolicy, err := platform.CORSConfig(cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "Authorization", API_KEY_HEADER, REQUEST_ID_HEADER, "API-Version", "If-Match", "If-None-Match"},
+		ExposeHeaders: []string{REQUEST_ID_HEADER, "API-Version", "ETag", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining"},
+	})
+	if err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	router.Use(cors.New(corsPolicy))
+
+	// Routes
+	router.GET("/health", healthHandler(upstreams))
+	router.GET("/health/system", systemHealthHandler(upstreams))
+	router.GET("/ready", platform.ReadyHandler)
+	router.Any(API_PREFIX+"/*path", platform.RequireRedis(), authenticate(routes), rateLimited(rateLimit), routes.proxy)
+
+	// Start server
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	log.Printf("Gateway service starting on port %s, rate limit %d/min", port, rateLimit)
+	if err := serve(router, "0.0.0.0:"+port); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route sends requests for /api/v1/<prefix>/... to /v1/<prefix>/... on a
+// service. Public routes skip the gateway's API key check; routes with a
+// Role are only for users signed in with that role.
+type Route struct {
+	Prefix   string
+	Upstream Upstream
+	Public   bool
+	Role     string
+}
+
+// SERVICE_API_PREFIX is where the services serve the version of their API
+// the gateway exposes.
+const SERVICE_API_PREFIX = "/v1"
+
+// STORAGE_PATH is where admins inspect each service's Redis keys:
+// /api/v1/admin/storage/<service>/... goes to /v1/admin/storage/... on the
+// service named, as each service serves its own keys.
+const STORAGE_PATH = "/admin/storage/"
+
+type routeProxy struct {
+	Route
+	proxy *httputil.ReverseProxy
+}
+
+// Routes maps the first segment of a path to the service that serves it.
+type Routes map[string]*routeProxy
+
+func newRoutes(routes []Route) (Routes, error) {
+	proxies := map[string]*httputil.ReverseProxy{}
+	table := Routes{}
+	for _, route := range routes {
+		proxy, ok := proxies[route.Upstream.URL]
+		if !ok {
+			target, err := url.Parse(route.Upstream.URL)
+			if err != nil || target.Scheme == "" || target.Host == "" {
+				return nil, fmt.Errorf("%s: %q is not a URL", route.Upstream.Name, route.Upstream.URL)
+			}
+			proxy = newProxy(route.Upstream.Name, target)
+			proxies[route.Upstream.URL] = proxy
+		}
+		table[route.Prefix] = &routeProxy{Route: route, proxy: proxy}
+		storage := Route{Prefix: strings.TrimPrefix(STORAGE_PATH, "/") + route.Upstream.Name, Upstream: route.Upstream, Role: "admin"}
+		table[storage.Prefix] = &routeProxy{Route: storage, proxy: proxy}
+	}
+	return table, nil
+}
+
+// newProxy forwards requests to a service. Responses are flushed as they
+// arrive so event streams and long polls work through the gateway.
+func newProxy(name string, target *url.URL) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.FlushInterval = -1
+	proxy.Transport = serviceTransport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// The gateway answers CORS itself.
+		for header := range resp.Header {
+			if strings.HasPrefix(header, "Access-Control-") {
+				resp.Header.Del(header)
+			}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Error proxying %s %s to %s (request %s): %v", r.Method, r.URL.Path, name, r.Header.Get(REQUEST_ID_HEADER), err)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, `{"error":"%s is unavailable"}`, name)
+	}
+	return proxy
+}
+
+// match returns the route for a path below /api/v1.
+func (r Routes) match(path string) *routeProxy {
+	if rest, ok := strings.CutPrefix(path, STORAGE_PATH); ok {
+		service, _, _ := strings.Cut(rest, "/")
+		return r[strings.TrimPrefix(STORAGE_PATH, "/")+service]
+	}
+	prefix, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return r[prefix]
+}
+
+// servicePath is the path below SERVICE_API_PREFIX the route serves a path
+// at: the same one, but for the service's name in storage paths.
+func (r *routeProxy) servicePath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/"+r.Prefix); ok && strings.HasPrefix(path, STORAGE_PATH) {
+		return strings.TrimSuffix(STORAGE_PATH, "/") + rest
+	}
+	return path
+}
+
+// proxy forwards a request below /api/v1 to the same path below /v1 on the
+// service that serves it.
+func (r Routes) proxy(c *gin.Context) {
+	path := c.Param("path")
+	route := r.match(path)
+	if route == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	req := c.Request
+	req.URL.Path = SERVICE_API_PREFIX + route.servicePath(path)
+	req.URL.RawPath = ""
+	// CORS has been handled; without Origin the service won't answer it
+	// again.
+	req.Header.Del("Origin")
+	route.proxy.ServeHTTP(c.Writer, req)
+}
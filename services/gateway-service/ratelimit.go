@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Requests are counted per client and minute under
+// ratelimit:<client>:<minute>, so every gateway instance shares the limit.
+const RATE_LIMIT_KEY_PREFIX = "ratelimit:"
+
+// rateLimited answers 429 once a client has made limit requests in the
+// current minute; a limit of 0 turns limiting off. If Redis can't be
+// reached, requests are let through rather than failing.
+func rateLimited(limit int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limit == 0 {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		minute := now.Unix() / 60
+		key := fmt.Sprintf("%s%s:%d", RATE_LIMIT_KEY_PREFIX, c.GetString(clientContextKey), minute)
+		var incr *redis.IntCmd
+		_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			incr = pipe.Incr(ctx, key)
+			pipe.Expire(ctx, key, 2*time.Minute)
+			return nil
+		})
+		if err != nil {
+			log.Printf("Error counting requests for rate limit: %v", err)
+			c.Next()
+			return
+		}
+
+		count := incr.Val()
+		remaining := int64(limit) - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		c.Header("X-RateLimit-Limit", strconv.Itoa(limit))
+		c.Header("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+		if count > int64(limit) {
+			retryAfter := 60 - now.Unix()%60
+			c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			return
+		}
+		c.Next()
+	}
+}
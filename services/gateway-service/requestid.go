@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// REQUEST_ID_HEADER identifies a request in the gateway's and services'
+// logs. The caller's ID is kept; otherwise the gateway makes one.
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(REQUEST_ID_HEADER)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.New().String()
+		}
+		c.Request.Header.Set(REQUEST_ID_HEADER, id)
+		c.Header(REQUEST_ID_HEADER, id)
+		c.Next()
+	}
+}
+
+// requestLog is gin's request log line with the request ID.
+func requestLog(param gin.LogFormatterParams) string {
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v | %s\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency.Round(time.Microsecond),
+		param.ClientIP,
+		param.Method,
+		param.Path,
+		param.Request.Header.Get(REQUEST_ID_HEADER),
+		param.ErrorMessage,
+	)
+}
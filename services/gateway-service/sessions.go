@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The user service signs session tokens with JWT_SECRET and keeps each
+// session under session:<id> until it ends. Requests with a token are
+// passed on as its user: X-User carries the username, which the services
+// record as the actor, with X-User-ID and X-User-Role, and X-Lab the lab
+// the services keep the user's data in.
+const (
+	SESSION_KEY_PREFIX = "session:"
+	sessionTokenIssuer = "user-service"
+)
+
+const (
+	USER_HEADER      = "X-User"
+	USER_ID_HEADER   = "X-User-ID"
+	USER_ROLE_HEADER = "X-User-Role"
+	LAB_HEADER       = "X-Lab"
+)
+
+// Without JWT_SECRET, bearer tokens are all treated as API keys.
+var jwtSecret []byte
+
+var errSessionEnded = errors.New("session has ended")
+
+// SessionClaims are the claims of a session token.
+type SessionClaims struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Lab      string `json:"lab,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func configureSessions() {
+	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+}
+
+// isSessionToken tells session tokens, which are JWTs, from API keys.
+func isSessionToken(token string) bool {
+	return len(jwtSecret) > 0 && strings.Count(token, ".") == 2
+}
+
+// parseSessionToken checks a token's signature and expiry and that its
+// session hasn't ended.
+func parseSessionToken(token string) (*SessionClaims, error) {
+	var claims SessionClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithIssuer(sessionTokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	exists, err := redisClient.Exists(ctx, SESSION_KEY_PREFIX+claims.ID).Result()
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, errSessionEnded
+	}
+	return &claims, nil
+}
+
+// isInvalidSession reports whether an error from parseSessionToken is the
+// token's fault rather than the gateway's.
+func isInvalidSession(err error) bool {
+	return errors.Is(err, errSessionEnded) || errors.Is(err, jwt.ErrTokenMalformed) ||
+		errors.Is(err, jwt.ErrTokenSignatureInvalid) || errors.Is(err, jwt.ErrTokenExpired) ||
+		errors.Is(err, jwt.ErrTokenInvalidIssuer) || errors.Is(err, jwt.ErrTokenRequiredClaimMissing) ||
+		errors.Is(err, jwt.ErrTokenUnverifiable) || errors.Is(err, jwt.ErrTokenInvalidClaims)
+}
+
+// forwardUser passes the session's user on to the service in place of the
+// token, which the services don't accept, and of any user headers the
+// caller set.
+func forwardUser(c *gin.Context, claims *SessionClaims) {
+	c.Request.Header.Del("Authorization")
+	c.Request.Header.Set(USER_HEADER, claims.Username)
+	c.Request.Header.Set(USER_ID_HEADER, claims.Subject)
+	c.Request.Header.Set(USER_ROLE_HEADER, claims.Role)
+	if claims.Lab != "" {
+		c.Request.Header.Set(LAB_HEADER, claims.Lab)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ComponentHealth is one part of the system and how it is doing, with the
+// parts it depends on.
+type ComponentHealth struct {
+	Status     string                     `json:"status"`
+	LatencyMS  float64                    `json:"latency_ms"`
+	Error      string                     `json:"error,omitempty"`
+	Details    map[string]interface{}     `json:"details,omitempty"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
+}
+
+// SystemHealth is the root of the tree, the gateway.
+type SystemHealth struct {
+	ComponentHealth
+	Service   string `json:"service"`
+	CheckedAt string `json:"checked_at"`
+}
+
+// checkRedis pings Redis, timing it.
+func checkRedis() ComponentHealth {
+	start := time.Now()
+	err := redisClient.Ping(ctx).Err()
+	latency := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		return ComponentHealth{Status: "unreachable", LatencyMS: latency, Error: err.Error()}
+	}
+	return ComponentHealth{Status: "healthy", LatencyMS: latency}
+}
+
+// systemHealthHandler reports the health of the whole system as one tree:
+// the gateway, with Redis and every service behind it as its components,
+// each with how long its check took. It is healthy only when every
+// component is, and 503 otherwise.
+func systemHealthHandler(upstreams []Upstream) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		redisHealth := make(chan ComponentHealth, 1)
+		go func() { redisHealth <- checkRedis() }()
+		results := checkUpstreams(upstreams)
+
+		system := SystemHealth{
+			ComponentHealth: ComponentHealth{
+				Status:     "healthy",
+				Components: map[string]ComponentHealth{"redis": <-redisHealth},
+			},
+			Service: "gateway-service",
+		}
+		for i, upstream := range upstreams {
+			system.Components[upstream.Name] = ComponentHealth{
+				Status:    results[i].Status,
+				LatencyMS: results[i].LatencyMS,
+				Error:     results[i].Error,
+				Details:   results[i].Details,
+			}
+		}
+
+		status := http.StatusOK
+		for _, component := range system.Components {
+			if component.Status != "healthy" {
+				status = http.StatusServiceUnavailable
+				system.Status = "degraded"
+			}
+		}
+		system.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		system.CheckedAt = time.Now().UTC().Format(time.RFC3339)
+		c.JSON(status, system)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+
+	"platform"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisClient redis.UniversalClient
+	ctx         = context.Background()
+)
+
+// healthHandler reports the service alive, and degraded while Redis is
+// down; /ready says whether it can take requests.
+func healthHandler(c *gin.Context) {
+	status := "healthy"
+	if !platform.RedisUp() {
+		status = "degraded"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  status,
+		"service": "notification-service",
+		"redis":   platform.RedisStatus(),
+	})
+}
+
+func main() {
+	// Configure logging
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	// Email is optional; without an SMTP server only Slack subscriptions
+	// can be created.
+	smtpAddr = os.Getenv("SMTP_ADDR")
+	smtpFrom = os.Getenv("SMTP_FROM")
+	if smtpFrom == "" {
+		smtpFrom = "notifications@localhost"
+	}
+	smtpUsername = os.Getenv("SMTP_USERNAME")
+	smtpPassword = os.Getenv("SMTP_PASSWORD")
+
+	// Connect to Redis, retrying while it starts
+	redisClient = platform.NewRedisClient()
+	platform.WaitForRedis(redisClient, nil)
+
+	go listenForEvents()
+
+	configureAuditLog()
+	configureRequestLimits()
+	platform.ConfigureFeatureFlags()
+
+	// Setup Gin
+	platform.ConfigureDebug(redisClient)
+	router := gin.Default()
+	platform.RegisterDebug(router)
+
+	// CORS configuration
+	corsPolicy, err := platform.CORSConfig(cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", API_VERSION_HEADER},
+		ExposeHeaders: []string{API_VERSION_HEADER},
+	})
+	if err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	router.Use(cors.New(corsPolicy))
+	router.Use(limitRequestBodies())
+	router.Use(auditLog())
+
+	// Routes
+	router.GET("/health", healthHandler)
+	router.GET("/ready", platform.ReadyHandler)
+	registerRoutes(router.Group("/v1", platform.RequireRedis(), apiVersion()))
+
+	// Start server
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "5004"
+	}
+
+	log.Printf("Notification service starting on port %s", port)
+	if err := serve(router, "0.0.0.0:"+port); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// registerRoutes adds the API's routes to a group mounted at /v1. This
+// service has no unversioned paths to keep.
+func registerRoutes(api *gin.RouterGroup) {
+	api.GET("/notifications/audit-log", requireAdmin, auditLogHandler)
+
+	storage := api.Group("/admin/storage", requireAdmin)
+	storage.GET("/keys", listRedisKeysHandler)
+	storage.GET("/keys/*key", getRedisKeyHandler)
+	storage.PUT("/keys/*key", putRedisKeyHandler)
+	storage.DELETE("/keys/*key", deleteRedisKeyHandler)
+	storage.GET("/audit", storageAuditHandler)
+
+	subscriptions := api.Group("/notifications/subscriptions", requireUser)
+	subscriptions.GET("", listSubscriptionsHandler)
+	subscriptions.POST("", createSubscriptionHandler)
+	subscriptions.GET("/:subscription_id", getSubscriptionHandler)
+	subscriptions.PUT("/:subscription_id", updateSubscriptionHandler)
+	subscriptions.DELETE("/:subscription_id", deleteSubscriptionHandler)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The channels the workflow and device services publish their events on.
+const (
+	WORKFLOW_EVENTS_CHANNEL = "workflow:events"
+	DEVICE_EVENTS_CHANNEL   = "device:events"
+)
+
+// Events users can be notified of.
+const (
+	EventWorkflowCompleted = "workflow.completed"
+	EventWorkflowFailed    = "workflow.failed"
+	EventDeviceError       = "device.error"
+	EventDeviceEstop       = "device.estop"
+)
+
+var notificationEvents = []string{EventWorkflowCompleted, EventWorkflowFailed, EventDeviceError, EventDeviceEstop}
+
+const (
+	deliveryTimeout  = 5 * time.Second
+	deliveryAttempts = 3
+	deliveryBackoff  = 2 * time.Second
+)
+
+var slackClient = &http.Client{Timeout: deliveryTimeout}
+
+// Email is sent through the SMTP server at SMTP_ADDR (host:port) from
+// SMTP_FROM, logging in with SMTP_USERNAME and SMTP_PASSWORD if set.
+var (
+	smtpAddr     string
+	smtpFrom     string
+	smtpUsername string
+	smtpPassword string
+)
+
+// WorkflowEvent is a workflow status change published by the workflow
+// service.
+type WorkflowEvent struct {
+	Type       string `json:"type"`
+	WorkflowID string `json:"workflow_id"`
+	Name       string `json:"name"`
+	DeviceID   string `json:"device_id"`
+	Status     string `json:"status"`
+	Reason     string `json:"reason"`
+	Timestamp  string `json:"timestamp"`
+}
+
+// DeviceEvent is a device status transition published by the device
+// service.
+type DeviceEvent struct {
+	DeviceID       string `json:"device_id"`
+	Status         string `json:"status"`
+	PreviousStatus string `json:"previous_status"`
+	WorkflowID     string `json:"workflow_id"`
+	Error          *struct {
+		Cause string `json:"cause"`
+		Estop bool   `json:"estop"`
+	} `json:"error"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Notification is the message sent to subscribers for an event.
+type Notification struct {
+	Event      string
+	WorkflowID string
+	DeviceID   string
+	Subject    string
+	Text       string
+}
+
+// workflowNotification describes a workflow event users are told about;
+// ok is false for the others.
+func workflowNotification(event WorkflowEvent) (Notification, bool) {
+	notification := Notification{Event: event.Type, WorkflowID: event.WorkflowID, DeviceID: event.DeviceID}
+	switch event.Type {
+	case EventWorkflowCompleted:
+		notification.Subject = fmt.Sprintf("Workflow %s completed", event.Name)
+		notification.Text = fmt.Sprintf("Workflow %s (%s) completed on %s at %s.", event.Name, event.WorkflowID, event.DeviceID, event.Timestamp)
+	case EventWorkflowFailed:
+		notification.Subject = fmt.Sprintf("Workflow %s failed", event.Name)
+		notification.Text = fmt.Sprintf("Workflow %s (%s) failed on %s at %s.", event.Name, event.WorkflowID, event.DeviceID, event.Timestamp)
+		if event.Reason != "" {
+			notification.Text += " Reason: " + event.Reason
+		}
+	default:
+		return notification, false
+	}
+	return notification, true
+}
+
+// deviceNotification describes a device entering the error status, which
+// an emergency stop also does; ok is false for other transitions.
+func deviceNotification(event DeviceEvent) (Notification, bool) {
+	notification := Notification{Event: EventDeviceError, WorkflowID: event.WorkflowID, DeviceID: event.DeviceID}
+	if event.Status != "error" {
+		return notification, false
+	}
+	cause := "unknown cause"
+	if event.Error != nil {
+		cause = event.Error.Cause
+		if event.Error.Estop {
+			notification.Event = EventDeviceEstop
+		}
+	}
+	if notification.Event == EventDeviceEstop {
+		notification.Subject = fmt.Sprintf("Emergency stop on %s", event.DeviceID)
+	} else {
+		notification.Subject = fmt.Sprintf("Device %s is in error", event.DeviceID)
+	}
+	notification.Text = fmt.Sprintf("%s at %s: %s.", notification.Subject, event.Timestamp, cause)
+	if event.WorkflowID != "" {
+		notification.Text += fmt.Sprintf(" Workflow %s was using it.", event.WorkflowID)
+	}
+	return notification, true
+}
+
+// listenForEvents notifies subscribers of the workflow and device events
+// published in Redis, until the subscription is closed.
+func listenForEvents() {
+	pubsub := redisClient.Subscribe(ctx, WORKFLOW_EVENTS_CHANNEL, DEVICE_EVENTS_CHANNEL)
+	defer pubsub.Close()
+	log.Printf("Listening for events on %s and %s", WORKFLOW_EVENTS_CHANNEL, DEVICE_EVENTS_CHANNEL)
+
+	for msg := range pubsub.Channel() {
+		notification, ok := eventNotification(msg)
+		if ok {
+			notify(notification)
+		}
+	}
+}
+
+func eventNotification(msg *redis.Message) (Notification, bool) {
+	switch msg.Channel {
+	case WORKFLOW_EVENTS_CHANNEL:
+		var event WorkflowEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			log.Printf("Invalid workflow event: %v", err)
+			return Notification{}, false
+		}
+		return workflowNotification(event)
+	case DEVICE_EVENTS_CHANNEL:
+		var event DeviceEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			log.Printf("Invalid device event: %v", err)
+			return Notification{}, false
+		}
+		return deviceNotification(event)
+	}
+	return Notification{}, false
+}
+
+// notify sends a notification to every subscription that wants it.
+func notify(notification Notification) {
+	subscriptions, err := listSubscriptions()
+	if err != nil {
+		log.Printf("Error listing subscriptions for %s: %v", notification.Event, err)
+		return
+	}
+	for _, subscription := range subscriptions {
+		if subscription.wants(notification) {
+			go deliver(subscription, notification)
+		}
+	}
+}
+
+// deliver sends a notification on a subscription's channel, retrying
+// failures with a growing delay, and records the outcome.
+func deliver(subscription Subscription, notification Notification) {
+	delivery := Delivery{Event: notification.Event, WorkflowID: notification.WorkflowID, DeviceID: notification.DeviceID}
+	for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * deliveryBackoff)
+		}
+		delivery.Attempts = attempt
+		delivery.Error = ""
+
+		var err error
+		switch subscription.Channel {
+		case ChannelSlack:
+			err = sendSlack(subscription.Target, notification)
+		case ChannelEmail:
+			err = sendEmail(subscription.Target, notification)
+		default:
+			err = fmt.Errorf("unknown channel %s", subscription.Channel)
+		}
+		if err == nil {
+			break
+		}
+		delivery.Error = err.Error()
+	}
+
+	if delivery.Error != "" {
+		log.Printf("Error sending %s notification to subscription %d: %s", notification.Event, subscription.ID, delivery.Error)
+	} else {
+		log.Printf("Sent %s notification to %s subscription %d", notification.Event, subscription.Channel, subscription.ID)
+	}
+	delivery.At = time.Now().UTC().Format(time.RFC3339)
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return
+	}
+	// Only record deliveries to subscriptions that still exist.
+	if err := redisClient.SetXX(ctx, subscriptionDeliveryKey(subscription.ID), encoded, 0).Err(); err != nil && err != redis.Nil {
+		log.Printf("Error recording delivery to subscription %d: %v", subscription.ID, err)
+	}
+}
+
+// sendSlack posts a notification to a Slack incoming webhook.
+func sendSlack(webhookURL string, notification Notification) error {
+	// Subscriptions saved before targets were checked may point elsewhere.
+	if !validSlackWebhook(webhookURL) {
+		return fmt.Errorf("target is not a Slack incoming webhook URL")
+	}
+	body, err := json.Marshal(map[string]string{"text": fmt.Sprintf("*%s*\n%s", notification.Subject, notification.Text)})
+	if err != nil {
+		return err
+	}
+	resp, err := slackClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("slack returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// encodeHeader makes text, which may include workflow names, safe to use
+// as an email header value: line breaks, which would start new headers,
+// become spaces, and anything outside ASCII is encoded.
+func encodeHeader(text string) string {
+	text = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text)
+	return mime.QEncoding.Encode("utf-8", text)
+}
+
+// sendEmail sends a notification as a plain text email.
+func sendEmail(to string, notification Notification) error {
+	if smtpAddr == "" {
+		return fmt.Errorf("email notifications are not configured")
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", smtpFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", encodeHeader(notification.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(notification.Text + "\r\n")
+
+	var auth smtp.Auth
+	if smtpUsername != "" {
+		host, _, _ := strings.Cut(smtpAddr, ":")
+		auth = smtp.PlainAuth("", smtpUsername, smtpPassword, host)
+	}
+	return smtp.SendMail(smtpAddr, auth, smtpFrom, []string{to}, []byte(msg.String()))
+}
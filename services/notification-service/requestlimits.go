@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// Request bodies are limited to MAX_REQUEST_BYTES (default 1 MiB), or
+// MAX_BULK_REQUEST_BYTES (default 64 MiB) for the bulkRequestRoutes;
+// larger ones get 413. JSON bodies may nest objects and arrays at most
+// MAX_JSON_DEPTH (default 32) deep, or get 400 before any handler decodes
+// them. With STRICT_JSON=true, JSON bodies with fields the endpoint doesn't
+// take are rejected with 400 rather than the fields being ignored.
+
+const (
+	defaultMaxRequestBytes     = 1 << 20
+	defaultMaxBulkRequestBytes = 64 << 20
+	defaultMaxJSONDepth        = 32
+)
+
+var (
+	maxRequestBytes     int64 = defaultMaxRequestBytes
+	maxBulkRequestBytes int64 = defaultMaxBulkRequestBytes
+	maxJSONDepth              = defaultMaxJSONDepth
+)
+
+// bulkRequestRoutes take bodies up to MAX_BULK_REQUEST_BYTES, by method and
+// path without the version prefix.
+var bulkRequestRoutes = map[string]bool{
+	"PUT /admin/storage/keys/*key": true,
+}
+
+func configureRequestLimits() {
+	for name, limit := range map[string]*int64{"MAX_REQUEST_BYTES": &maxRequestBytes, "MAX_BULK_REQUEST_BYTES": &maxBulkRequestBytes} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 1 {
+				log.Fatalf("Invalid %s %q", name, value)
+			}
+			*limit = n
+		}
+	}
+	if value := os.Getenv("MAX_JSON_DEPTH"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			log.Fatalf("Invalid MAX_JSON_DEPTH %q", value)
+		}
+		maxJSONDepth = n
+	}
+	if os.Getenv("STRICT_JSON") == "true" {
+		binding.EnableDecoderDisallowUnknownFields = true
+		log.Printf("Rejecting unknown fields in JSON request bodies")
+	}
+}
+
+// requestBodyLimit is the most a request to the route may send.
+func requestBodyLimit(c *gin.Context) int64 {
+	if bulkRequestRoutes[c.Request.Method+" "+strings.TrimPrefix(c.FullPath(), "/v"+API_VERSION)] {
+		return maxBulkRequestBytes
+	}
+	return maxRequestBytes
+}
+
+// jsonTooDeep reports whether the JSON in data nests objects and arrays
+// more than depth deep. It doesn't check the JSON is valid; decoding does.
+func jsonTooDeep(data []byte, depth int) bool {
+	nesting := 0
+	inString, escaped := false, false
+	for _, b := range data {
+		switch {
+		case escaped:
+			escaped = false
+		case inString:
+			escaped = b == '\\'
+			inString = b != '"'
+		case b == '"':
+			inString = true
+		case b == '{' || b == '[':
+			nesting++
+			if nesting > depth {
+				return true
+			}
+		case b == '}' || b == ']':
+			nesting--
+		}
+	}
+	return false
+}
+
+// limitRequestBodies enforces the size limits and, for bodies that look
+// like JSON whatever their content type, the nesting limit. Bodies other
+// than file uploads are read up front to check them.
+func limitRequestBodies() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil || c.Request.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		limit := requestBodyLimit(c)
+		tooLarge := gin.H{"error": fmt.Sprintf("Request body must be at most %d bytes", limit)}
+		if c.Request.ContentLength > limit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		if strings.HasPrefix(c.ContentType(), "multipart/") {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, tooLarge)
+			return
+		case err != nil:
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && jsonTooDeep(trimmed, maxJSONDepth) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Request body nests more than %d levels deep", maxJSONDepth)})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
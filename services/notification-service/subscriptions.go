@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Subscriptions are stored under notification:subscription:<id>, with the
+// IDs in the sorted set notifications:subscriptions. The outcome of the
+// last delivery to each is kept under
+// notification:subscription:<id>:last_delivery, which exists (empty at
+// first) as long as the subscription does.
+const (
+	SUBSCRIPTION_KEY_PREFIX   = "notification:subscription:"
+	SUBSCRIPTIONS_KEY         = "notifications:subscriptions"
+	SUBSCRIPTION_SEQUENCE_KEY = "notifications:sequence"
+)
+
+// ACTOR_HEADER names the user making a request. Only the gateway sets it,
+// from the user's verified session, dropping any the caller sent; the
+// service isn't published outside the deployment's network, so requests
+// reach it through the gateway.
+const ACTOR_HEADER = "X-User"
+
+// SLACK_WEBHOOK_HOST is the only host Slack subscriptions may post to, so
+// a subscription can't point the service at anything else.
+const SLACK_WEBHOOK_HOST = "hooks.slack.com"
+
+// Channels notifications are sent on.
+const (
+	ChannelSlack = "slack"
+	ChannelEmail = "email"
+)
+
+// Subscription is one user's choice of events to be told about on one
+// channel: a Slack incoming webhook URL or an email address. An empty
+// Events list subscribes to every event, and an empty DeviceIDs list to
+// every device. Disabled subscriptions are kept but not sent to.
+type Subscription struct {
+	ID           int64     `json:"id"`
+	User         string    `json:"user"`
+	Channel      string    `json:"channel"`
+	Target       string    `json:"target"`
+	Events       []string  `json:"events"`
+	DeviceIDs    []string  `json:"device_ids"`
+	Enabled      bool      `json:"enabled"`
+	CreatedAt    string    `json:"created_at"`
+	UpdatedAt    string    `json:"updated_at,omitempty"`
+	LastDelivery *Delivery `json:"last_delivery,omitempty"`
+}
+
+// SubscriptionRequest is a subscription's preferences; its user is always
+// the one making the request.
+type SubscriptionRequest struct {
+	Channel   string   `json:"channel" binding:"required"`
+	Target    string   `json:"target" binding:"required"`
+	Events    []string `json:"events"`
+	DeviceIDs []string `json:"device_ids"`
+	Enabled   *bool    `json:"enabled"`
+}
+
+// Delivery is the outcome of sending one notification to a subscription.
+type Delivery struct {
+	Event      string `json:"event"`
+	WorkflowID string `json:"workflow_id,omitempty"`
+	DeviceID   string `json:"device_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Attempts   int    `json:"attempts"`
+	At         string `json:"at"`
+}
+
+func subscriptionKey(id int64) string {
+	return SUBSCRIPTION_KEY_PREFIX + strconv.FormatInt(id, 10)
+}
+
+func subscriptionDeliveryKey(id int64) string {
+	return subscriptionKey(id) + ":last_delivery"
+}
+
+// wants reports whether the subscription should be told about a
+// notification.
+func (s Subscription) wants(notification Notification) bool {
+	if !s.Enabled {
+		return false
+	}
+	if len(s.Events) > 0 && !contains(s.Events, notification.Event) {
+		return false
+	}
+	return len(s.DeviceIDs) == 0 || contains(s.DeviceIDs, notification.DeviceID)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// requireUser rejects requests not made by a signed in user, whose
+// subscriptions are the only ones they may see or change.
+func requireUser(c *gin.Context) {
+	if strings.TrimSpace(c.GetHeader(ACTOR_HEADER)) == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Sign in to manage subscriptions"})
+		return
+	}
+	c.Next()
+}
+
+func requestUser(c *gin.Context) string {
+	return strings.TrimSpace(c.GetHeader(ACTOR_HEADER))
+}
+
+// validSlackWebhook reports whether target is a Slack incoming webhook URL.
+func validSlackWebhook(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && u.Scheme == "https" && u.Host == SLACK_WEBHOOK_HOST && u.User == nil
+}
+
+// newSubscription checks a request and fills in a subscription for user
+// from it.
+func newSubscription(user string, req SubscriptionRequest) (Subscription, error) {
+	subscription := Subscription{
+		User:      user,
+		Channel:   req.Channel,
+		Target:    strings.TrimSpace(req.Target),
+		Events:    req.Events,
+		DeviceIDs: req.DeviceIDs,
+		Enabled:   req.Enabled == nil || *req.Enabled,
+	}
+	if subscription.User == "" {
+		return subscription, fmt.Errorf("user is required")
+	}
+	switch subscription.Channel {
+	case ChannelSlack:
+		if !validSlackWebhook(subscription.Target) {
+			return subscription, fmt.Errorf("target must be a Slack incoming webhook URL, https://%s/...", SLACK_WEBHOOK_HOST)
+		}
+	case ChannelEmail:
+		address, err := mail.ParseAddress(subscription.Target)
+		if err != nil {
+			return subscription, fmt.Errorf("target must be an email address")
+		}
+		if smtpAddr == "" {
+			return subscription, fmt.Errorf("email notifications are not configured")
+		}
+		subscription.Target = address.Address
+	default:
+		return subscription, fmt.Errorf("channel must be %s or %s", ChannelSlack, ChannelEmail)
+	}
+	for _, event := range subscription.Events {
+		if !contains(notificationEvents, event) {
+			return subscription, fmt.Errorf("unknown event %q; events are %v", event, notificationEvents)
+		}
+	}
+	if subscription.Events == nil {
+		subscription.Events = []string{}
+	}
+	if subscription.DeviceIDs == nil {
+		subscription.DeviceIDs = []string{}
+	}
+	return subscription, nil
+}
+
+func listSubscriptions() ([]Subscription, error) {
+	ids, err := redisClient.ZRange(ctx, SUBSCRIPTIONS_KEY, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []Subscription{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = SUBSCRIPTION_KEY_PREFIX + id
+	}
+	values, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]Subscription, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var subscription Subscription
+		if err := json.Unmarshal([]byte(data), &subscription); err != nil {
+			log.Printf("Error decoding subscription %s: %v", ids[i], err)
+			continue
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, nil
+}
+
+func getSubscription(id int64) (*Subscription, error) {
+	data, err := redisClient.Get(ctx, subscriptionKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var subscription Subscription
+	if err := json.Unmarshal([]byte(data), &subscription); err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// withLastDelivery adds the outcome of its last delivery to a
+// subscription.
+func withLastDelivery(subscription Subscription) Subscription {
+	data, err := redisClient.Get(ctx, subscriptionDeliveryKey(subscription.ID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error getting last delivery of subscription %d: %v", subscription.ID, err)
+		}
+		return subscription
+	}
+	var delivery Delivery
+	if err := json.Unmarshal([]byte(data), &delivery); err == nil && delivery.At != "" {
+		subscription.LastDelivery = &delivery
+	}
+	return subscription
+}
+
+func parseSubscriptionID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("subscription_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid subscription ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// getUserSubscription returns one of the requesting user's subscriptions,
+// writing the response if it can't.
+func getUserSubscription(c *gin.Context, id int64) (*Subscription, bool) {
+	subscription, err := getSubscription(id)
+	if err != nil {
+		log.Printf("Error getting subscription %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve subscription"})
+		return nil, false
+	}
+	// Other users' subscriptions are hidden rather than forbidden.
+	if subscription == nil || subscription.User != requestUser(c) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return nil, false
+	}
+	return subscription, true
+}
+
+// listSubscriptionsHandler returns the requesting user's subscriptions.
+func listSubscriptionsHandler(c *gin.Context) {
+	subscriptions, err := listSubscriptions()
+	if err != nil {
+		log.Printf("Error listing subscriptions: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve subscriptions"})
+		return
+	}
+	user := requestUser(c)
+	result := []Subscription{}
+	for _, subscription := range subscriptions {
+		if subscription.User == user {
+			result = append(result, withLastDelivery(subscription))
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func createSubscriptionHandler(c *gin.Context) {
+	var req SubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "channel and target are required"})
+		return
+	}
+	subscription, err := newSubscription(requestUser(c), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := redisClient.Incr(ctx, SUBSCRIPTION_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating subscription ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subscription"})
+		return
+	}
+	subscription.ID = id
+	subscription.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		log.Printf("Error encoding subscription: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subscription"})
+		return
+	}
+
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, subscriptionKey(id), data, 0)
+		pipe.Set(ctx, subscriptionDeliveryKey(id), "{}", 0)
+		pipe.ZAdd(ctx, SUBSCRIPTIONS_KEY, redis.Z{Score: float64(id), Member: id})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error saving subscription: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subscription"})
+		return
+	}
+
+	log.Printf("Subscription %d created for %s by %s", id, subscription.Channel, subscription.User)
+	c.JSON(http.StatusCreated, subscription)
+}
+
+func getSubscriptionHandler(c *gin.Context) {
+	id, ok := parseSubscriptionID(c)
+	if !ok {
+		return
+	}
+	subscription, ok := getUserSubscription(c, id)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, withLastDelivery(*subscription))
+}
+
+// updateSubscriptionHandler replaces a subscription's preferences.
+func updateSubscriptionHandler(c *gin.Context) {
+	id, ok := parseSubscriptionID(c)
+	if !ok {
+		return
+	}
+	var req SubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "channel and target are required"})
+		return
+	}
+	subscription, err := newSubscription(requestUser(c), req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stored, ok := getUserSubscription(c, id)
+	if !ok {
+		return
+	}
+	subscription.ID = id
+	subscription.CreatedAt = stored.CreatedAt
+	subscription.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		log.Printf("Error encoding subscription: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subscription"})
+		return
+	}
+	// Only update subscriptions that still exist.
+	if err := redisClient.SetXX(ctx, subscriptionKey(id), data, 0).Err(); err != nil {
+		if err == redis.Nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		log.Printf("Error saving subscription %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save subscription"})
+		return
+	}
+
+	log.Printf("Subscription %d updated", id)
+	c.JSON(http.StatusOK, withLastDelivery(subscription))
+}
+
+func deleteSubscriptionHandler(c *gin.Context) {
+	id, ok := parseSubscriptionID(c)
+	if !ok {
+		return
+	}
+	if _, ok := getUserSubscription(c, id); !ok {
+		return
+	}
+	var deleted *redis.IntCmd
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, subscriptionKey(id))
+		pipe.Del(ctx, subscriptionDeliveryKey(id))
+		pipe.ZRem(ctx, SUBSCRIPTIONS_KEY, id)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error deleting subscription %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete subscription"})
+		return
+	}
+	if deleted.Val() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+
+	log.Printf("Subscription %d deleted", id)
+	c.Status(http.StatusNoContent)
+}
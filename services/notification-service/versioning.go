@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// API_VERSION is the version of the API served under /v1. Clients may ask
+// for a version with the API-Version request header; every response says
+// which version served it.
+const (
+	API_VERSION        = "1"
+	API_VERSION_HEADER = "API-Version"
+)
+
+// apiVersion rejects requests for a version this service doesn't serve.
+func apiVersion() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requested := strings.TrimPrefix(strings.TrimSpace(c.GetHeader(API_VERSION_HEADER)), "v")
+		if requested != "" && requested != API_VERSION {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error":     "Unsupported API version " + requested,
+				"supported": []string{API_VERSION},
+			})
+			return
+		}
+		c.Header(API_VERSION_HEADER, API_VERSION)
+		c.Next()
+	}
+}
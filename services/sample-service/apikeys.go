@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// API keys are stored under apikey:<id>, with the IDs in the sorted set
+// apikeys:all and each key's SHA-256 hash mapped to its ID under
+// apikeys:hash:<hash>. The keys themselves are only returned when created.
+const (
+	API_KEY_PREFIX       = "apikey:"
+	API_KEYS_KEY         = "apikeys:all"
+	API_KEY_HASH_PREFIX  = "apikeys:hash:"
+	API_KEY_SEQUENCE_KEY = "apikeys:sequence"
+)
+
+// API_KEY_HEADER carries an API key; "Authorization: Bearer <key>" works
+// too.
+const API_KEY_HEADER = "X-API-Key"
+
+// accessContextKey holds the request's SampleAccess in the gin context.
+const accessContextKey = "sampleAccess"
+
+// apiKeyPrefix starts every generated key, so leaked keys are easy to spot.
+const apiKeyPrefix = "sk_"
+
+// USER_ID_HEADER and USER_ROLE_HEADER name the user a request is from. The
+// gateway sets them from the user's verified session and drops any the
+// caller sent.
+const (
+	USER_ID_HEADER   = "X-User-ID"
+	USER_ROLE_HEADER = "X-User-Role"
+)
+
+// Access control is configured at startup. Every request but the health
+// check needs a key or a signed in user, unless REQUIRE_API_KEY=false lets
+// requests with neither see every sample, for local development.
+// SAMPLE_ADMIN_KEY is a key with full access that can manage the other
+// keys.
+var (
+	requireAPIKey bool
+	adminAPIKey   string
+)
+
+// APIKey lets automation use the service on behalf of some projects. A key
+// sees and changes only the samples of its projects.
+type APIKey struct {
+	ID        int64    `json:"id"`
+	Name      string   `json:"name"`
+	Projects  []string `json:"projects"`
+	Lab       string   `json:"lab,omitempty"`
+	Key       string   `json:"key,omitempty"`
+	KeyHash   string   `json:"key_hash,omitempty"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type APIKeyRequest struct {
+	Name     string   `json:"name" binding:"required"`
+	Projects []string `json:"projects" binding:"required"`
+}
+
+// SampleAccess is what the caller of a request may do: work with every
+// project's samples, or only with some projects', in one lab. Admin callers
+// also manage the API keys.
+type SampleAccess struct {
+	All      bool
+	Projects []string
+	KeyID    int64
+	Lab      string
+	Admin    bool
+}
+
+func apiKeyKey(id int64) string {
+	return API_KEY_PREFIX + strconv.FormatInt(id, 10)
+}
+
+func apiKeyHashKey(hash string) string {
+	return API_KEY_HASH_PREFIX + hash
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func configureAccess() {
+	requireAPIKey = os.Getenv("REQUIRE_API_KEY") != "false"
+	adminAPIKey = os.Getenv("SAMPLE_ADMIN_KEY")
+	if !requireAPIKey {
+		log.Println("REQUIRE_API_KEY=false; requests without an API key can use every sample")
+	}
+	if adminAPIKey == "" {
+		log.Println("SAMPLE_ADMIN_KEY not set; API keys can only be managed by admin users")
+	}
+}
+
+// allows reports whether samples of the project are visible.
+func (a SampleAccess) allows(project string) bool {
+	if a.All {
+		return true
+	}
+	for _, allowed := range a.Projects {
+		if allowed == project {
+			return true
+		}
+	}
+	return false
+}
+
+func (a SampleAccess) allowsSample(sample Sample) bool {
+	return sample.Lab == a.Lab && a.allows(sample.Project)
+}
+
+// restrict narrows a list of projects to the ones visible, where nil means
+// every project.
+func (a SampleAccess) restrict(projects []string) []string {
+	if a.All {
+		return projects
+	}
+	if projects == nil {
+		return a.Projects
+	}
+	visible := []string{}
+	for _, project := range projects {
+		if a.allows(project) {
+			visible = append(visible, project)
+		}
+	}
+	return visible
+}
+
+// defaultProject is the project of a new sample that doesn't name one: the
+// key's project if it has just one.
+func (a SampleAccess) defaultProject(project string) (string, error) {
+	project = strings.TrimSpace(project)
+	if project == "" && !a.All {
+		if len(a.Projects) != 1 {
+			return "", fmt.Errorf("project is required; this API key can use %s", strings.Join(a.Projects, ", "))
+		}
+		project = a.Projects[0]
+	}
+	if !a.allows(project) {
+		return "", fmt.Errorf("this API key can't use project %s", project)
+	}
+	return project, nil
+}
+
+// requestAccess returns the access granted to the request by
+// authenticate.
+func requestAccess(c *gin.Context) SampleAccess {
+	if value, ok := c.Get(accessContextKey); ok {
+		return value.(SampleAccess)
+	}
+	return SampleAccess{}
+}
+
+func requestAPIKey(c *gin.Context) string {
+	if key := strings.TrimSpace(c.GetHeader(API_KEY_HEADER)); key != "" {
+		return key
+	}
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ""
+}
+
+// authenticate resolves the request's API key, or else its signed in
+// user, to the samples it can access. Unknown keys are rejected, as are
+// requests with neither when a key is required.
+func authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions || c.FullPath() == "/health" || c.FullPath() == "/ready" {
+			c.Next()
+			return
+		}
+
+		lab := requestLab(c)
+		if !validLab(lab) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + LAB_HEADER + " header"})
+			return
+		}
+
+		key := requestAPIKey(c)
+		userID := strings.TrimSpace(c.GetHeader(USER_ID_HEADER))
+		switch {
+		case key == "" && userID != "":
+			// Users aren't limited to projects; admins manage the keys.
+			c.Set(accessContextKey, SampleAccess{All: true, Lab: lab, Admin: c.GetHeader(USER_ROLE_HEADER) == "admin"})
+		case key == "" && requireAPIKey:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "An API key is required"})
+			return
+		case key == "":
+			c.Set(accessContextKey, SampleAccess{All: true, Lab: lab})
+		case adminAPIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminAPIKey)) == 1:
+			c.Set(accessContextKey, SampleAccess{All: true, Lab: lab, Admin: true})
+		default:
+			apiKey, err := findAPIKey(key)
+			if err != nil {
+				log.Printf("Error looking up API key: %v", err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+				return
+			}
+			if apiKey == nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+				return
+			}
+			// A key works in the lab it was issued in.
+			c.Set(accessContextKey, SampleAccess{Projects: apiKey.Projects, KeyID: apiKey.ID, Lab: apiKey.Lab})
+		}
+		c.Next()
+	}
+}
+
+// authorizeSample hides samples named in the URL from callers that can't
+// access them, answering as if they didn't exist.
+func authorizeSample() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		barcode := c.Param("barcode")
+		access := requestAccess(c)
+		if barcode == "" {
+			c.Next()
+			return
+		}
+		sample, err := getSample(barcode)
+		if err != nil {
+			log.Printf("Error getting sample %s: %v", barcode, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+			return
+		}
+		if sample != nil && !access.allowsSample(*sample) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireFullAccess rejects requests from project-scoped keys, for
+// endpoints that span every project.
+func requireFullAccess(c *gin.Context) bool {
+	if !requestAccess(c).All {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This API key is limited to its projects"})
+		return false
+	}
+	return true
+}
+
+// requireAdminAccess rejects requests that can't manage the API keys:
+// only the admin key and admin users can, never a request without either.
+func requireAdminAccess(c *gin.Context) bool {
+	if !requestAccess(c).Admin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys are managed with the admin key or by an admin"})
+		return false
+	}
+	return true
+}
+
+// requireServiceAdmin limits what works across every lab's samples, such
+// as snapshots, to the admin key and admins of the default lab.
+func requireServiceAdmin(c *gin.Context) bool {
+	if access := requestAccess(c); !access.Admin || access.Lab != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the admin key or an admin of the default lab can do this"})
+		return false
+	}
+	return true
+}
+
+// serviceAdminOnly is requireServiceAdmin for a group of routes.
+func serviceAdminOnly(c *gin.Context) {
+	if !requireServiceAdmin(c) {
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// requireSamplesAccess responds with 404 for the first of the barcodes
+// whose sample exists but can't be accessed, as if it didn't exist.
+func requireSamplesAccess(c *gin.Context, barcodes []string) bool {
+	access := requestAccess(c)
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		log.Printf("Error getting samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return false
+	}
+	for _, sample := range samples {
+		if !access.allowsSample(sample) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Sample %s not found", sample.Barcode)})
+			return false
+		}
+	}
+	return true
+}
+
+// visibleBarcodes returns the set of the barcodes whose samples the
+// request can access.
+func visibleBarcodes(c *gin.Context, barcodes []string) (map[string]bool, error) {
+	access := requestAccess(c)
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+	visible := map[string]bool{}
+	for _, sample := range samples {
+		if access.allowsSample(sample) {
+			visible[sample.Barcode] = true
+		}
+	}
+	return visible, nil
+}
+
+// visibleSamples drops the samples the request can't access.
+func visibleSamples(c *gin.Context, samples []Sample) []Sample {
+	access := requestAccess(c)
+	visible := make([]Sample, 0, len(samples))
+	for _, sample := range samples {
+		if access.allowsSample(sample) {
+			visible = append(visible, sample)
+		}
+	}
+	return visible
+}
+
+func findAPIKey(key string) (*APIKey, error) {
+	id, err := redisClient.Get(ctx, apiKeyHashKey(hashAPIKey(key))).Int64()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return getAPIKey(id)
+}
+
+func getAPIKey(id int64) (*APIKey, error) {
+	data, err := redisClient.Get(ctx, apiKeyKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var apiKey APIKey
+	if err := json.Unmarshal([]byte(data), &apiKey); err != nil {
+		return nil, err
+	}
+	return &apiKey, nil
+}
+
+func listAPIKeys() ([]APIKey, error) {
+	ids, err := redisClient.ZRange(ctx, API_KEYS_KEY, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []APIKey{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = API_KEY_PREFIX + id
+	}
+	values, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	apiKeys := make([]APIKey, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var apiKey APIKey
+		if err := json.Unmarshal([]byte(data), &apiKey); err != nil {
+			log.Printf("Error decoding API key %s: %v", ids[i], err)
+			continue
+		}
+		apiKey.KeyHash = ""
+		apiKeys = append(apiKeys, apiKey)
+	}
+	return apiKeys, nil
+}
+
+func listAPIKeysHandler(c *gin.Context) {
+	if !requireAdminAccess(c) {
+		return
+	}
+	apiKeys, err := listAPIKeys()
+	if err != nil {
+		log.Printf("Error listing API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+		return
+	}
+	lab := requestAccess(c).Lab
+	inLab := []APIKey{}
+	for _, apiKey := range apiKeys {
+		if apiKey.Lab == lab {
+			inLab = append(inLab, apiKey)
+		}
+	}
+	c.JSON(http.StatusOK, inLab)
+}
+
+// createAPIKeyHandler issues a key for some projects of the request's lab.
+// The key is only returned here.
+func createAPIKeyHandler(c *gin.Context) {
+	if !requireAdminAccess(c) {
+		return
+	}
+	var req APIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	projects := []string{}
+	seen := map[string]bool{}
+	for _, project := range req.Projects {
+		project = strings.TrimSpace(project)
+		if project == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "projects must not be empty"})
+			return
+		}
+		if !seen[project] {
+			seen[project] = true
+			projects = append(projects, project)
+		}
+	}
+	if len(projects) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at least one project is required"})
+		return
+	}
+	sort.Strings(projects)
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Printf("Error generating API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	id, err := redisClient.Incr(ctx, API_KEY_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating API key ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+	apiKey := APIKey{
+		ID:        id,
+		Name:      strings.TrimSpace(req.Name),
+		Projects:  projects,
+		Lab:       requestAccess(c).Lab,
+		KeyHash:   hashAPIKey(key),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := json.Marshal(apiKey)
+	if err == nil {
+		_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, apiKeyKey(id), data, 0)
+			pipe.Set(ctx, apiKeyHashKey(apiKey.KeyHash), id, 0)
+			pipe.ZAdd(ctx, API_KEYS_KEY, redis.Z{Score: float64(id), Member: id})
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("Error saving API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	log.Printf("Created API key %d (%s) for projects %s", id, apiKey.Name, strings.Join(projects, ", "))
+	apiKey.KeyHash = ""
+	apiKey.Key = key
+	c.JSON(http.StatusCreated, apiKey)
+}
+
+// deleteAPIKeyHandler revokes a key.
+func deleteAPIKeyHandler(c *gin.Context) {
+	if !requireAdminAccess(c) {
+		return
+	}
+	id, err := strconv.ParseInt(c.Param("key_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	apiKey, err := getAPIKey(id)
+	if err != nil {
+		log.Printf("Error getting API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API key"})
+		return
+	}
+	if apiKey == nil || apiKey.Lab != requestAccess(c).Lab {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, apiKeyKey(id), apiKeyHashKey(apiKey.KeyHash))
+		pipe.ZRem(ctx, API_KEYS_KEY, id)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error deleting API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete API key"})
+		return
+	}
+	log.Printf("Revoked API key %d", id)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/redis/go-redis/v9"
+)
+
+// Attachment records are stored under attachment:<id>, with the IDs of
+// each sample's attachments in the sorted set samples:attachments:<barcode>.
+// The files are kept in S3-compatible object storage under
+// samples/<barcode>/<id>/<filename>.
+const (
+	ATTACHMENT_KEY_PREFIX         = "attachment:"
+	SAMPLE_ATTACHMENTS_KEY_PREFIX = "samples:attachments:"
+	ATTACHMENT_SEQUENCE_KEY       = "attachments:sequence"
+)
+
+// maxAttachmentSize bounds a single uploaded file.
+const maxAttachmentSize = 100 << 20
+
+const defaultAttachmentBucket = "sample-attachments"
+
+// attachmentStorage is nil when no object storage is configured, which
+// disables attachments.
+var attachmentStorage *AttachmentStorage
+
+// AttachmentStorage is the bucket attachments are kept in. The bucket is
+// created on the first upload if it doesn't exist.
+type AttachmentStorage struct {
+	client *minio.Client
+	bucket string
+
+	mu          sync.Mutex
+	bucketReady bool
+}
+
+// Attachment is a file such as a chromatogram, consent form or image
+// attached to a sample.
+type Attachment struct {
+	ID          int64  `json:"id"`
+	Barcode     string `json:"barcode"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	Description string `json:"description,omitempty"`
+	UploadedBy  string `json:"uploaded_by,omitempty"`
+	UploadedAt  string `json:"uploaded_at"`
+	ObjectKey   string `json:"object_key"`
+}
+
+type AttachmentListResponse struct {
+	Barcode     string       `json:"barcode"`
+	Count       int          `json:"count"`
+	Attachments []Attachment `json:"attachments"`
+}
+
+func attachmentKey(id int64) string {
+	return ATTACHMENT_KEY_PREFIX + strconv.FormatInt(id, 10)
+}
+
+func sampleAttachmentsKey(barcode string) string {
+	return SAMPLE_ATTACHMENTS_KEY_PREFIX + barcode
+}
+
+// configureAttachmentStorage connects to the object storage at
+// ATTACHMENT_S3_URL (e.g. http://minio:9000) with ATTACHMENT_S3_ACCESS_KEY
+// and ATTACHMENT_S3_SECRET_KEY. ATTACHMENT_S3_BUCKET and
+// ATTACHMENT_S3_REGION are optional.
+func configureAttachmentStorage() {
+	value := os.Getenv("ATTACHMENT_S3_URL")
+	if value == "" {
+		log.Println("ATTACHMENT_S3_URL not set; attachments are disabled")
+		return
+	}
+	endpoint, err := url.Parse(value)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		log.Fatalf("Invalid ATTACHMENT_S3_URL %q", value)
+	}
+
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("ATTACHMENT_S3_ACCESS_KEY"), os.Getenv("ATTACHMENT_S3_SECRET_KEY"), ""),
+		Secure: endpoint.Scheme == "https",
+		Region: os.Getenv("ATTACHMENT_S3_REGION"),
+	})
+	if err != nil {
+		log.Fatalf("Failed to configure attachment storage: %v", err)
+	}
+	bucket := os.Getenv("ATTACHMENT_S3_BUCKET")
+	if bucket == "" {
+		bucket = defaultAttachmentBucket
+	}
+	attachmentStorage = &AttachmentStorage{client: client, bucket: bucket}
+	log.Printf("Storing attachments in bucket %s at %s", bucket, endpoint.Host)
+}
+
+// ensureBucket creates the bucket if it doesn't exist yet.
+func (s *AttachmentStorage) ensureBucket() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bucketReady {
+		return nil
+	}
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{}); err != nil {
+			return err
+		}
+		log.Printf("Created attachment bucket %s", s.bucket)
+	}
+	s.bucketReady = true
+	return nil
+}
+
+// attachmentFilename reduces an uploaded file's name to its base name.
+func attachmentFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+func getAttachment(id int64) (*Attachment, error) {
+	data, err := redisClient.Get(ctx, attachmentKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var attachment Attachment
+	if err := json.Unmarshal([]byte(data), &attachment); err != nil {
+		return nil, err
+	}
+	return &attachment, nil
+}
+
+// listAttachments returns a sample's attachments, oldest first.
+func listAttachments(barcode string) ([]Attachment, error) {
+	ids, err := redisClient.ZRange(ctx, sampleAttachmentsKey(barcode), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []Attachment{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = ATTACHMENT_KEY_PREFIX + id
+	}
+	values, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := make([]Attachment, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var attachment Attachment
+		if err := json.Unmarshal([]byte(data), &attachment); err != nil {
+			log.Printf("Error decoding attachment %s: %v", ids[i], err)
+			continue
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// requireAttachmentStorage responds with 503 if attachments are disabled.
+func requireAttachmentStorage(c *gin.Context) bool {
+	if attachmentStorage == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Attachment storage is not configured"})
+		return false
+	}
+	return true
+}
+
+// loadAttachedSample responds with 404 if the sample in the path doesn't
+// exist.
+func loadAttachedSample(c *gin.Context) (*Sample, bool) {
+	barcode := c.Param("barcode")
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return nil, false
+	}
+	if sample == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return nil, false
+	}
+	return sample, true
+}
+
+// loadAttachment responds with 404 unless the attachment in the path
+// belongs to the sample in the path.
+func loadAttachment(c *gin.Context) (*Attachment, bool) {
+	id, err := strconv.ParseInt(c.Param("attachment_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return nil, false
+	}
+	attachment, err := getAttachment(id)
+	if err != nil {
+		log.Printf("Error getting attachment %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve attachment"})
+		return nil, false
+	}
+	if attachment == nil || attachment.Barcode != c.Param("barcode") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return nil, false
+	}
+	return attachment, true
+}
+
+// uploadAttachmentHandler stores the multipart file field as an attachment
+// of the sample, with an optional description, and records it in the
+// sample's history.
+func uploadAttachmentHandler(c *gin.Context) {
+	if !requireAttachmentStorage(c) {
+		return
+	}
+	sample, ok := loadAttachedSample(c)
+	if !ok {
+		return
+	}
+
+	// Leave room for the rest of the form.
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+1<<20)
+	file, err := c.FormFile("file")
+	if err != nil {
+		if strings.Contains(err.Error(), "request body too large") {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("attachments are limited to %d MB", maxAttachmentSize>>20)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A file is required in the file field"})
+		return
+	}
+	if file.Size > maxAttachmentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("attachments are limited to %d MB", maxAttachmentSize>>20)})
+		return
+	}
+	filename := attachmentFilename(file.Filename)
+	if filename == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The file must have a name"})
+		return
+	}
+	contentType := file.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	upload, err := file.Open()
+	if err != nil {
+		log.Printf("Error opening attachment for sample %s: %v", sample.Barcode, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer upload.Close()
+
+	if err := attachmentStorage.ensureBucket(); err != nil {
+		log.Printf("Error preparing attachment bucket %s: %v", attachmentStorage.bucket, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Attachment storage is unavailable"})
+		return
+	}
+	id, err := redisClient.Incr(ctx, ATTACHMENT_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating attachment ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+
+	now := time.Now().UTC()
+	attachment := Attachment{
+		ID:          id,
+		Barcode:     sample.Barcode,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        file.Size,
+		Description: strings.TrimSpace(c.PostForm("description")),
+		UploadedBy:  requestActor(c),
+		UploadedAt:  now.Format(time.RFC3339),
+		ObjectKey:   fmt.Sprintf("samples/%s/%d/%s", sample.Barcode, id, filename),
+	}
+	hash := sha256.New()
+	_, err = attachmentStorage.client.PutObject(ctx, attachmentStorage.bucket, attachment.ObjectKey,
+		io.TeeReader(upload, hash), file.Size, minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		log.Printf("Error uploading attachment %d for sample %s: %v", id, sample.Barcode, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to store file"})
+		return
+	}
+	attachment.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	data, err := json.Marshal(attachment)
+	if err == nil {
+		_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, attachmentKey(id), data, 0)
+			pipe.ZAdd(ctx, sampleAttachmentsKey(sample.Barcode), redis.Z{Score: float64(now.UnixMilli()), Member: id})
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("Error saving attachment %d: %v", id, err)
+		if err := attachmentStorage.client.RemoveObject(ctx, attachmentStorage.bucket, attachment.ObjectKey, minio.RemoveObjectOptions{}); err != nil {
+			log.Printf("Error removing unsaved attachment %s: %v", attachment.ObjectKey, err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+
+	audit := SampleAudit{Action: SampleActionAttached, Actor: attachment.UploadedBy, Note: fmt.Sprintf("attachment %d: %s", id, filename)}
+	err = sampleStore.Update(func(tx SampleTx) error {
+		stored, err := tx.GetMany([]string{sample.Barcode})
+		if err != nil || len(stored) == 0 {
+			return err
+		}
+		tx.Put(SampleWrite{Sample: stored[0], Previous: &stored[0], Audit: audit, HistoryOnly: true})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error recording attachment %d in the history of sample %s: %v", id, sample.Barcode, err)
+	}
+
+	log.Printf("Attached %s (%d bytes) to sample %s as attachment %d", filename, file.Size, sample.Barcode, id)
+	c.JSON(http.StatusCreated, attachment)
+}
+
+func listAttachmentsHandler(c *gin.Context) {
+	sample, ok := loadAttachedSample(c)
+	if !ok {
+		return
+	}
+	attachments, err := listAttachments(sample.Barcode)
+	if err != nil {
+		log.Printf("Error listing attachments of sample %s: %v", sample.Barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve attachments"})
+		return
+	}
+	c.JSON(http.StatusOK, AttachmentListResponse{Barcode: sample.Barcode, Count: len(attachments), Attachments: attachments})
+}
+
+func getAttachmentHandler(c *gin.Context) {
+	attachment, ok := loadAttachment(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, attachment)
+}
+
+// downloadAttachmentHandler streams the attached file from object storage.
+func downloadAttachmentHandler(c *gin.Context) {
+	if !requireAttachmentStorage(c) {
+		return
+	}
+	attachment, ok := loadAttachment(c)
+	if !ok {
+		return
+	}
+
+	object, err := attachmentStorage.client.GetObject(ctx, attachmentStorage.bucket, attachment.ObjectKey, minio.GetObjectOptions{})
+	if err == nil {
+		// GetObject doesn't contact the server until the object is read.
+		_, err = object.Stat()
+	}
+	if err != nil {
+		log.Printf("Error fetching attachment %d: %v", attachment.ID, err)
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Attachment file is missing from storage"})
+			return
+		}
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to fetch file"})
+		return
+	}
+	defer object.Close()
+
+	c.DataFromReader(http.StatusOK, attachment.Size, attachment.ContentType, object, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", attachment.Filename),
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Each sample's chain of custody is kept by the sample store, written in
+// the same transaction as the change it records. In Redis it is an
+// append-only sorted set of JSON entries under samples:history:<barcode>,
+// scored by time in milliseconds.
+const (
+	SAMPLE_HISTORY_KEY_PREFIX   = "samples:history:"
+	SAMPLE_HISTORY_SEQUENCE_KEY = "samples:history_sequence"
+)
+
+// Actions recorded in the sample history.
+const (
+	SampleActionCreated         = "created"
+	SampleActionLocationChanged = "location_changed"
+	SampleActionUpdated         = "updated"
+	SampleActionArchived        = "archived"
+	SampleActionConsumed        = "consumed"
+	SampleActionImported        = "imported"
+	SampleActionTransferred     = "transferred"
+	SampleActionAliquoted       = "aliquoted"
+	SampleActionMerged          = "merged"
+	SampleActionAttached        = "attached"
+	SampleActionPooled          = "pooled"
+	SampleActionRestored        = "restored"
+	SampleActionDeleted         = "deleted"
+	SampleActionPurged          = "purged"
+	SampleActionMigrated        = "migrated"
+)
+
+// ACTOR_HEADER names the user making a request. Only the gateway sets it,
+// from the user's verified session, dropping any the caller sent; the
+// service isn't published outside the deployment's network, so requests
+// reach it through the gateway or another service passing the user on.
+const ACTOR_HEADER = "X-User"
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// SampleAudit describes who made a change and why. It is recorded with
+// every sample the change writes.
+type SampleAudit struct {
+	Action     string
+	WorkflowID string
+	Actor      string
+	TransferID int64
+	Note       string
+}
+
+// FieldChange is the value of a sample field before and after a change.
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// SampleHistoryEntry is one entry in a sample's chain of custody.
+type SampleHistoryEntry struct {
+	ID         int64                  `json:"id"`
+	Barcode    string                 `json:"barcode"`
+	Action     string                 `json:"action"`
+	Changes    map[string]FieldChange `json:"changes,omitempty"`
+	WorkflowID string                 `json:"workflow_id,omitempty"`
+	Actor      string                 `json:"actor,omitempty"`
+	TransferID int64                  `json:"transfer_id,omitempty"`
+	Note       string                 `json:"note,omitempty"`
+	At         string                 `json:"at"`
+}
+
+type SampleHistoryResponse struct {
+	Barcode string               `json:"barcode"`
+	Count   int                  `json:"count"`
+	History []SampleHistoryEntry `json:"history"`
+}
+
+func sampleHistoryKey(barcode string) string {
+	return SAMPLE_HISTORY_KEY_PREFIX + barcode
+}
+
+// requestActor returns the user a request was made by, if known.
+func requestActor(c *gin.Context) string {
+	return strings.TrimSpace(c.GetHeader(ACTOR_HEADER))
+}
+
+func measurementValue(value *float64) interface{} {
+	if value == nil {
+		return nil
+	}
+	return *value
+}
+
+// sampleChanges lists the fields that differ between the stored and the
+// new version of a sample; previous is nil for a new sample.
+func sampleChanges(previous *Sample, sample Sample) map[string]FieldChange {
+	if previous == nil {
+		previous = &Sample{}
+	}
+	fields := []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"name", previous.Name, sample.Name},
+		{"type", previous.Type, sample.Type},
+		{"project", previous.Project, sample.Project},
+		{"location", previous.Location, sample.Location},
+		{"volume_ul", measurementValue(previous.VolumeUL), measurementValue(sample.VolumeUL)},
+		{"concentration", measurementValue(previous.Concentration), measurementValue(sample.Concentration)},
+		{"archived", previous.Archived, sample.Archived},
+		{"deleted_at", previous.DeletedAt, sample.DeletedAt},
+		{"parent_barcode", previous.ParentBarcode, sample.ParentBarcode},
+		{"expires_at", previous.ExpiresAt, sample.ExpiresAt},
+		{"placeholder", previous.Placeholder, sample.Placeholder},
+		{"merged_into", previous.MergedInto, sample.MergedInto},
+		{"merged_from", strings.Join(previous.MergedFrom, ","), strings.Join(sample.MergedFrom, ",")},
+		{"pooled_from", poolBarcodes(previous.PooledFrom), poolBarcodes(sample.PooledFrom)},
+	}
+
+	changes := metadataChanges(previous.Metadata, sample.Metadata)
+	for _, field := range fields {
+		if field.from != field.to {
+			changes[field.name] = FieldChange{From: field.from, To: field.to}
+		}
+	}
+	return changes
+}
+
+// newSampleHistoryEntry describes the change made by a write.
+func newSampleHistoryEntry(id int64, write SampleWrite, at time.Time) SampleHistoryEntry {
+	return SampleHistoryEntry{
+		ID:         id,
+		Barcode:    write.Sample.Barcode,
+		Action:     write.Audit.Action,
+		Changes:    sampleChanges(write.Previous, write.Sample),
+		WorkflowID: write.Audit.WorkflowID,
+		Actor:      write.Audit.Actor,
+		TransferID: write.Audit.TransferID,
+		Note:       write.Audit.Note,
+		At:         at.Format(time.RFC3339Nano),
+	}
+}
+
+// readSampleHistory returns a sample's history entries between from and
+// to, either of which may be zero, newest first, with the histories of the
+// samples merged into it if includeMerged is set.
+func readSampleHistory(sample Sample, includeMerged bool, from, to time.Time) ([]SampleHistoryEntry, error) {
+	sources := []string{sample.Barcode}
+	if includeMerged {
+		sources = append(sources, sample.MergedFrom...)
+	}
+	entries := []SampleHistoryEntry{}
+	for _, source := range sources {
+		sourceEntries, err := sampleStore.History(source, from, to)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, sourceEntries...)
+	}
+	if len(sources) > 1 {
+		sort.SliceStable(entries, func(a, b int) bool {
+			atA, _ := time.Parse(time.RFC3339Nano, entries[a].At)
+			atB, _ := time.Parse(time.RFC3339Nano, entries[b].At)
+			if !atA.Equal(atB) {
+				return atA.After(atB)
+			}
+			return entries[a].ID > entries[b].ID
+		})
+	}
+	return entries, nil
+}
+
+// sampleHistoryHandler returns a sample's chain of custody, newest first.
+func sampleHistoryHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	var from, to time.Time
+	if value := c.Query("from"); value != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+
+	limit := defaultHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit)})
+			return
+		}
+		limit = n
+	}
+	action := c.Query("action")
+	workflowID := c.Query("workflow_id")
+
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if sample == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+
+	// include_merged=true adds the histories of duplicates merged into
+	// the sample.
+	entries, err := readSampleHistory(*sample, c.Query("include_merged") == "true", from, to)
+	if err != nil {
+		log.Printf("Error reading history for sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample history"})
+		return
+	}
+
+	history := []SampleHistoryEntry{}
+	for _, entry := range entries {
+		if action != "" && entry.Action != action {
+			continue
+		}
+		if workflowID != "" && entry.WorkflowID != workflowID {
+			continue
+		}
+		history = append(history, entry)
+		if len(history) == limit {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, SampleHistoryResponse{
+		Barcode: barcode,
+		Count:   len(history),
+		History: history,
+	})
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// BARCODE_RULES_KEY holds the barcode format rules as JSON. With no rules
+// any barcode is accepted.
+const BARCODE_RULES_KEY = "barcodes:rules"
+
+// Check digit schemes. Both are computed over the digits of the barcode,
+// ignoring prefixes and separators, with the last digit as the check digit.
+const (
+	CheckDigitLuhn = "luhn"
+	CheckDigitGS1  = "gs1"
+)
+
+// BarcodeRule is a barcode format. A rule with a type applies to samples of
+// that type; the rule without one applies to every other type.
+type BarcodeRule struct {
+	Type       string `json:"type,omitempty"`
+	Pattern    string `json:"pattern,omitempty"`
+	MinLength  int    `json:"min_length,omitempty"`
+	MaxLength  int    `json:"max_length,omitempty"`
+	CheckDigit string `json:"check_digit,omitempty"`
+}
+
+type BarcodeRules struct {
+	Rules []BarcodeRule `json:"rules"`
+}
+
+type ValidateFormatRequest struct {
+	Barcodes []string `json:"barcodes" binding:"required"`
+	Type     string   `json:"type"`
+}
+
+type BarcodeFormatResult struct {
+	Barcode string   `json:"barcode"`
+	Valid   bool     `json:"valid"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+type compiledBarcodeRule struct {
+	BarcodeRule
+	pattern *regexp.Regexp
+}
+
+// BarcodeValidator checks barcodes against the configured rules.
+type BarcodeValidator struct {
+	rules map[string]compiledBarcodeRule
+}
+
+// compileBarcodeRules checks the rules and compiles their patterns.
+func compileBarcodeRules(rules []BarcodeRule) (*BarcodeValidator, error) {
+	validator := &BarcodeValidator{rules: map[string]compiledBarcodeRule{}}
+	for _, rule := range rules {
+		if _, ok := validator.rules[rule.Type]; ok {
+			if rule.Type == "" {
+				return nil, fmt.Errorf("only one rule may apply to all types")
+			}
+			return nil, fmt.Errorf("type %s has more than one rule", rule.Type)
+		}
+		if rule.MinLength < 0 || rule.MaxLength < 0 || (rule.MaxLength > 0 && rule.MinLength > rule.MaxLength) {
+			return nil, fmt.Errorf("invalid length range %d-%d", rule.MinLength, rule.MaxLength)
+		}
+		switch rule.CheckDigit {
+		case "", CheckDigitLuhn, CheckDigitGS1:
+		default:
+			return nil, fmt.Errorf("check_digit must be %s or %s", CheckDigitLuhn, CheckDigitGS1)
+		}
+
+		compiled := compiledBarcodeRule{BarcodeRule: rule}
+		if rule.Pattern != "" {
+			// Patterns must match the whole barcode.
+			pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", rule.Pattern, err)
+			}
+			compiled.pattern = pattern
+		}
+		validator.rules[rule.Type] = compiled
+	}
+	return validator, nil
+}
+
+func getBarcodeRules() (BarcodeRules, error) {
+	rules := BarcodeRules{Rules: []BarcodeRule{}}
+	data, err := redisClient.Get(ctx, BARCODE_RULES_KEY).Result()
+	if err == redis.Nil {
+		return rules, nil
+	}
+	if err != nil {
+		return rules, err
+	}
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		return rules, err
+	}
+	return rules, nil
+}
+
+// loadBarcodeValidator reads the stored rules.
+func loadBarcodeValidator() (*BarcodeValidator, error) {
+	rules, err := getBarcodeRules()
+	if err != nil {
+		return nil, err
+	}
+	return compileBarcodeRules(rules.Rules)
+}
+
+// checkDigitValid verifies the last digit of the barcode's digits.
+func checkDigitValid(scheme string, digits []int) bool {
+	sum := 0
+	for i := len(digits) - 2; i >= 0; i-- {
+		d := digits[i]
+		// Positions are counted from the right, next to the check digit.
+		first := (len(digits)-2-i)%2 == 0
+		switch scheme {
+		case CheckDigitLuhn:
+			if first {
+				d *= 2
+				if d > 9 {
+					d -= 9
+				}
+			}
+		case CheckDigitGS1:
+			if first {
+				d *= 3
+			}
+		}
+		sum += d
+	}
+	return (10-sum%10)%10 == digits[len(digits)-1]
+}
+
+// Check returns the ways a barcode breaks the rule for the sample type, or
+// nil if it is valid.
+func (v *BarcodeValidator) Check(barcode, sampleType string) []string {
+	rule, ok := v.rules[sampleType]
+	if !ok {
+		rule, ok = v.rules[""]
+	}
+	if !ok {
+		return nil
+	}
+
+	problems := []string{}
+	for _, r := range barcode {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			problems = append(problems, "barcode contains whitespace or control characters")
+			break
+		}
+	}
+	length := len([]rune(barcode))
+	if rule.MinLength > 0 && length < rule.MinLength {
+		problems = append(problems, fmt.Sprintf("barcode is %d characters, at least %d required", length, rule.MinLength))
+	}
+	if rule.MaxLength > 0 && length > rule.MaxLength {
+		problems = append(problems, fmt.Sprintf("barcode is %d characters, at most %d allowed", length, rule.MaxLength))
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(barcode) {
+		problems = append(problems, fmt.Sprintf("barcode does not match the pattern %s", rule.Pattern))
+	}
+	if rule.CheckDigit != "" {
+		digits := []int{}
+		for _, r := range barcode {
+			if r >= '0' && r <= '9' {
+				digits = append(digits, int(r-'0'))
+			}
+		}
+		if len(digits) < 2 {
+			problems = append(problems, fmt.Sprintf("barcode needs at least 2 digits for a %s check digit", rule.CheckDigit))
+		} else if !checkDigitValid(rule.CheckDigit, digits) {
+			problems = append(problems, fmt.Sprintf("%s check digit is wrong", rule.CheckDigit))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// Validate returns a 400 SampleError if the barcode breaks its rule.
+func (v *BarcodeValidator) Validate(barcode, sampleType string) *SampleError {
+	problems := v.Check(barcode, sampleType)
+	if problems == nil {
+		return nil
+	}
+	return &SampleError{
+		StatusCode: http.StatusBadRequest,
+		Message:    fmt.Sprintf("invalid barcode %s: %s", barcode, strings.Join(problems, "; ")),
+	}
+}
+
+func getBarcodeRulesHandler(c *gin.Context) {
+	rules, err := getBarcodeRules()
+	if err != nil {
+		log.Printf("Error getting barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode rules"})
+		return
+	}
+	c.JSON(http.StatusOK, rules)
+}
+
+// setBarcodeRulesHandler replaces the barcode rules. Existing samples are
+// not checked against the new rules.
+func setBarcodeRulesHandler(c *gin.Context) {
+	if !requireDefaultLab(c) {
+		return
+	}
+	var rules BarcodeRules
+	if err := c.ShouldBindJSON(&rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rules array is required"})
+		return
+	}
+	if rules.Rules == nil {
+		rules.Rules = []BarcodeRule{}
+	}
+	if _, err := compileBarcodeRules(rules.Rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, err := json.Marshal(rules)
+	if err != nil {
+		log.Printf("Error encoding barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save barcode rules"})
+		return
+	}
+	if err := redisClient.Set(ctx, BARCODE_RULES_KEY, data, 0).Err(); err != nil {
+		log.Printf("Error saving barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save barcode rules"})
+		return
+	}
+
+	log.Printf("Barcode rules updated (%d rule(s))", len(rules.Rules))
+	c.JSON(http.StatusOK, rules)
+}
+
+// validateBarcodeFormatHandler checks barcodes against the rules without
+// looking them up, so scanners can catch typos before registering.
+func validateBarcodeFormatHandler(c *gin.Context) {
+	var req ValidateFormatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "barcodes array is required"})
+		return
+	}
+
+	validator, err := loadBarcodeValidator()
+	if err != nil {
+		log.Printf("Error loading barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode rules"})
+		return
+	}
+
+	results := make([]BarcodeFormatResult, len(req.Barcodes))
+	for i, barcode := range req.Barcodes {
+		problems := validator.Check(barcode, req.Type)
+		results[i] = BarcodeFormatResult{Barcode: barcode, Valid: problems == nil, Errors: problems}
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// Generated barcodes are numbered per prefix; BARCODE_SEQUENCES_KEY is a
+// hash of the last number issued for each prefix.
+const BARCODE_SEQUENCES_KEY = "barcodes:sequences"
+
+const (
+	defaultBarcodeDigits = 6
+	maxGeneratedBarcodes = 1000
+)
+
+// GenerateBarcodesRequest issues count barcodes made of the prefix and the
+// next numbers of its sequence, zero-padded to digits. With
+// create_placeholders the barcodes are reserved as placeholder samples of
+// the given type and name until their tubes are registered.
+type GenerateBarcodesRequest struct {
+	Prefix             string `json:"prefix" binding:"required"`
+	Count              int    `json:"count"`
+	Digits             int    `json:"digits"`
+	Type               string `json:"type"`
+	Name               string `json:"name"`
+	Project            string `json:"project"`
+	CreatePlaceholders bool   `json:"create_placeholders"`
+}
+
+type GenerateBarcodesResponse struct {
+	Prefix       string   `json:"prefix"`
+	Barcodes     []string `json:"barcodes"`
+	Placeholders bool     `json:"placeholders"`
+}
+
+// appendCheckDigit adds the check digit for the scheme to a barcode.
+func appendCheckDigit(scheme, barcode string) string {
+	digits := []int{}
+	for _, r := range barcode {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, int(r-'0'))
+		}
+	}
+	// Try each digit; exactly one is valid for either scheme.
+	digits = append(digits, 0)
+	for d := 0; d <= 9; d++ {
+		digits[len(digits)-1] = d
+		if checkDigitValid(scheme, digits) {
+			return fmt.Sprintf("%s%d", barcode, d)
+		}
+	}
+	return barcode
+}
+
+// generatedBarcode formats number n of a sequence, adding a check digit if
+// the barcode rule for the type requires one.
+func (v *BarcodeValidator) generatedBarcode(prefix string, digits int, n int64, sampleType string) string {
+	barcode := fmt.Sprintf("%s%0*d", prefix, digits, n)
+	rule, ok := v.rules[sampleType]
+	if !ok {
+		rule, ok = v.rules[""]
+	}
+	if ok && rule.CheckDigit != "" {
+		barcode = appendCheckDigit(rule.CheckDigit, barcode)
+	}
+	return barcode
+}
+
+// reserveBarcodes takes the next numbers of the prefix's sequence, skipping
+// any whose barcode is already used by a sample.
+func reserveBarcodes(validator *BarcodeValidator, req GenerateBarcodesRequest) ([]string, error) {
+	barcodes := []string{}
+	for attempt := 0; attempt < maxWriteAttempts && len(barcodes) < req.Count; attempt++ {
+		need := req.Count - len(barcodes)
+		last, err := redisClient.HIncrBy(ctx, BARCODE_SEQUENCES_KEY, req.Prefix, int64(need)).Result()
+		if err != nil {
+			return nil, err
+		}
+		candidates := make([]string, 0, need)
+		for n := last - int64(need) + 1; n <= last; n++ {
+			candidates = append(candidates, validator.generatedBarcode(req.Prefix, req.Digits, n, req.Type))
+		}
+		existing, err := getSampleMap(candidates)
+		if err != nil {
+			return nil, err
+		}
+		for _, barcode := range candidates {
+			if _, taken := existing[barcode]; !taken {
+				barcodes = append(barcodes, barcode)
+			}
+		}
+	}
+	if len(barcodes) < req.Count {
+		return nil, fmt.Errorf("sequence %s kept returning barcodes already in use", req.Prefix)
+	}
+	return barcodes, nil
+}
+
+// generateBarcodesHandler issues unique barcodes so labels can be printed
+// before tubes are registered.
+func generateBarcodesHandler(c *gin.Context) {
+	var req GenerateBarcodesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prefix is required"})
+		return
+	}
+	if req.Count == 0 {
+		req.Count = 1
+	}
+	if req.Count < 0 || req.Count > maxGeneratedBarcodes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("count must be between 1 and %d", maxGeneratedBarcodes)})
+		return
+	}
+	if req.Digits == 0 {
+		req.Digits = defaultBarcodeDigits
+	}
+	if req.Digits < 1 || req.Digits > 18 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "digits must be between 1 and 18"})
+		return
+	}
+	if strings.TrimSpace(req.Prefix) != req.Prefix || req.Prefix == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prefix must not be empty or start or end with whitespace"})
+		return
+	}
+
+	validator, err := loadBarcodeValidator()
+	if err != nil {
+		log.Printf("Error loading barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode rules"})
+		return
+	}
+
+	// Check the format before using up sequence numbers.
+	next, err := redisClient.HGet(ctx, BARCODE_SEQUENCES_KEY, req.Prefix).Int64()
+	if err != nil && err != redis.Nil {
+		log.Printf("Error reading barcode sequence %s: %v", req.Prefix, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate barcodes"})
+		return
+	}
+	sample := validator.generatedBarcode(req.Prefix, req.Digits, next+1, req.Type)
+	if barcodeErr := validator.Validate(sample, req.Type); barcodeErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "generated barcodes would break the barcode rules: " + barcodeErr.Message})
+		return
+	}
+	if req.CreatePlaceholders {
+		if typeErr := newSampleTypeValidator().CheckType(req.Type); typeErr != nil {
+			c.JSON(typeErr.StatusCode, gin.H{"error": typeErr.Message})
+			return
+		}
+		if req.Project, err = requestAccess(c).defaultProject(req.Project); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	barcodes, err := reserveBarcodes(validator, req)
+	if err != nil {
+		log.Printf("Error generating barcodes for %s: %v", req.Prefix, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate barcodes"})
+		return
+	}
+
+	if req.CreatePlaceholders {
+		now := time.Now().UTC().Format(time.RFC3339)
+		audit := SampleAudit{Action: SampleActionCreated, Actor: requestActor(c), Note: "placeholder"}
+		for _, barcode := range barcodes {
+			placeholder := Sample{
+				Barcode:     barcode,
+				Name:        req.Name,
+				Type:        req.Type,
+				Project:     req.Project,
+				Lab:         requestAccess(c).Lab,
+				CreatedAt:   now,
+				Placeholder: true,
+			}
+			if err := createSample(&placeholder, false, audit); err != nil {
+				log.Printf("Error saving placeholder sample %s: %v", barcode, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save placeholder samples", "barcodes": barcodes})
+				return
+			}
+		}
+	}
+
+	log.Printf("Generated %d barcode(s) with prefix %s", len(barcodes), req.Prefix)
+	c.JSON(http.StatusCreated, GenerateBarcodesResponse{
+		Prefix:       req.Prefix,
+		Barcodes:     barcodes,
+		Placeholders: req.CreatePlaceholders,
+	})
+}
+
+// listBarcodeSequencesHandler returns the last number issued per prefix.
+func listBarcodeSequencesHandler(c *gin.Context) {
+	values, err := redisClient.HGetAll(ctx, BARCODE_SEQUENCES_KEY).Result()
+	if err != nil {
+		log.Printf("Error reading barcode sequences: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode sequences"})
+		return
+	}
+	sequences := map[string]int64{}
+	for prefix, value := range values {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		sequences[prefix] = n
+	}
+	c.JSON(http.StatusOK, gin.H{"sequences": sequences})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Data read on most requests but rarely changed, such as the sample type
+// registry, is kept in process in a readCache, so requests don't each read
+// it from Redis. A replica that changes cached data drops it from its own
+// caches and publishes the change on CACHE_INVALIDATION_CHANNEL, so every
+// other replica drops it too. Entries expire after READ_CACHE_TTL
+// (default 1m; 0 turns caching off) in case a change is missed, such as
+// while a replica has lost Redis, and every cache is emptied when the
+// subscription is made again.
+const CACHE_INVALIDATION_CHANNEL = "samples:cache:invalidate"
+
+// allCaches in an invalidation means every cache.
+const allCaches = "*"
+
+const defaultReadCacheTTL = time.Minute
+
+var readCacheTTL = defaultReadCacheTTL
+
+var (
+	readCachesMu sync.Mutex
+	readCaches   = map[string]*readCache{}
+)
+
+// cacheInvalidation is a message on CACHE_INVALIDATION_CHANNEL. No keys
+// means every entry of the cache.
+type cacheInvalidation struct {
+	Cache string   `json:"cache"`
+	Keys  []string `json:"keys,omitempty"`
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// readCache holds values read from Redis, by key. Values are shared by
+// every caller, so they must not be changed.
+type readCache struct {
+	name string
+	mu   sync.Mutex
+	// generation is bumped by every drop, so a value read while its entry
+	// was being dropped isn't kept.
+	generation uint64
+	entries    map[string]cacheEntry
+}
+
+func newReadCache(name string) *readCache {
+	cache := &readCache{name: name, entries: map[string]cacheEntry{}}
+	readCachesMu.Lock()
+	readCaches[name] = cache
+	readCachesMu.Unlock()
+	return cache
+}
+
+func configureReadCache() {
+	if value := os.Getenv("READ_CACHE_TTL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid READ_CACHE_TTL %q", value)
+		}
+		readCacheTTL = d
+	}
+	if readCacheTTL == 0 {
+		log.Printf("Read cache off")
+	}
+}
+
+// get returns the cached value for key, or reads it with load and caches
+// it. Errors aren't cached.
+func (c *readCache) get(key string, load func() (interface{}, error)) (interface{}, error) {
+	if readCacheTTL == 0 {
+		return load()
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, nil
+	}
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.entries[key] = cacheEntry{value: value, expires: time.Now().Add(readCacheTTL)}
+	}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// drop forgets the keys, or every entry if none are given.
+func (c *readCache) drop(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if len(keys) == 0 {
+		c.entries = map[string]cacheEntry{}
+		return
+	}
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
+
+// invalidate drops the keys, or every entry, here and on every other
+// replica.
+func (c *readCache) invalidate(keys ...string) {
+	c.drop(keys...)
+	publishCacheInvalidation(cacheInvalidation{Cache: c.name, Keys: keys})
+}
+
+// invalidateAllCaches empties every cache, here and on every other
+// replica, for changes made to storage directly.
+func invalidateAllCaches() {
+	dropAllCaches()
+	publishCacheInvalidation(cacheInvalidation{Cache: allCaches})
+}
+
+func dropAllCaches() {
+	readCachesMu.Lock()
+	defer readCachesMu.Unlock()
+	for _, cache := range readCaches {
+		cache.drop()
+	}
+}
+
+func publishCacheInvalidation(message cacheInvalidation) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return
+	}
+	if err := redisClient.Publish(ctx, CACHE_INVALIDATION_CHANNEL, data).Err(); err != nil {
+		log.Printf("Error publishing invalidation of cache %s: %v", message.Cache, err)
+	}
+}
+
+// listenForCacheInvalidations drops what other replicas changed.
+func listenForCacheInvalidations() {
+	pubsub := redisClient.Subscribe(ctx, CACHE_INVALIDATION_CHANNEL)
+	defer pubsub.Close()
+	for msg := range pubsub.ChannelWithSubscriptions() {
+		var message cacheInvalidation
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// Changes made while unsubscribed were missed.
+			message.Cache = allCaches
+		case *redis.Message:
+			if err := json.Unmarshal([]byte(msg.Payload), &message); err != nil {
+				continue
+			}
+		}
+
+		if message.Cache == allCaches {
+			dropAllCaches()
+		} else {
+			readCachesMu.Lock()
+			cache := readCaches[message.Cache]
+			readCachesMu.Unlock()
+			if cache != nil {
+				cache.drop(message.Keys...)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import "fmt"
+
+// code128Patterns are the bar and space widths of each Code 128 symbol,
+// starting with a bar. 103-105 are the start codes and 106 is the stop.
+var code128Patterns = [107]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128StartB = 104
+	code128StartC = 105
+	code128CodeB  = 100
+	code128CodeC  = 99
+	code128Stop   = 106
+)
+
+// code128QuietZone is the blank margin, in modules, required on each side.
+const code128QuietZone = 10
+
+// code128Symbols encodes text as Code 128 symbol values including the
+// start, check and stop symbols. Runs of four or more digits use code set
+// C; everything else uses code set B, which covers printable ASCII.
+func code128Symbols(text string) ([]int, error) {
+	if text == "" {
+		return nil, fmt.Errorf("nothing to encode")
+	}
+	for _, r := range text {
+		if r < 32 || r > 126 {
+			return nil, fmt.Errorf("Code 128 labels support printable ASCII only, not %q", r)
+		}
+	}
+
+	digitRun := func(i int) int {
+		n := 0
+		for i+n < len(text) && text[i+n] >= '0' && text[i+n] <= '9' {
+			n++
+		}
+		return n
+	}
+
+	symbols := []int{}
+	set := 0
+	for i := 0; i < len(text); {
+		if run := digitRun(i); run >= 4 || (i == 0 && run == len(text) && run >= 2 && run%2 == 0) {
+			// Code set C packs digit pairs; an odd digit is left for B.
+			run -= run % 2
+			switch {
+			case len(symbols) == 0:
+				symbols = append(symbols, code128StartC)
+			case set != code128CodeC:
+				symbols = append(symbols, code128CodeC)
+			}
+			set = code128CodeC
+			for end := i + run; i < end; i += 2 {
+				symbols = append(symbols, int(text[i]-'0')*10+int(text[i+1]-'0'))
+			}
+			continue
+		}
+		switch {
+		case len(symbols) == 0:
+			symbols = append(symbols, code128StartB)
+		case set != code128CodeB:
+			symbols = append(symbols, code128CodeB)
+		}
+		set = code128CodeB
+		symbols = append(symbols, int(text[i])-32)
+		i++
+	}
+
+	check := symbols[0]
+	for i, symbol := range symbols[1:] {
+		check += (i + 1) * symbol
+	}
+	return append(symbols, check%103, code128Stop), nil
+}
+
+// code128Modules returns the barcode as one bool per module, true for bar,
+// without the quiet zones.
+func code128Modules(text string) ([]bool, error) {
+	symbols, err := code128Symbols(text)
+	if err != nil {
+		return nil, err
+	}
+	modules := []bool{}
+	for _, symbol := range symbols {
+		for i, width := range code128Patterns[symbol] {
+			for n := 0; n < int(width-'0'); n++ {
+				modules = append(modules, i%2 == 0)
+			}
+		}
+	}
+	return modules, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const SAMPLE_EVENTS_CHANNEL = "sample:events"
+
+// Sample event types.
+const (
+	SampleEventCreated  = "sample.created"
+	SampleEventMoved    = "sample.moved"
+	SampleEventConsumed = "sample.consumed"
+	SampleEventExpiring = "sample.expiring"
+	SampleEventExpired  = "sample.expired"
+)
+
+var sampleEventTypes = []string{
+	SampleEventCreated,
+	SampleEventMoved,
+	SampleEventConsumed,
+	SampleEventExpiring,
+	SampleEventExpired,
+}
+
+// SampleEvent is published on the sample events channel and sent to
+// webhooks. From is the previous location of a moved sample and
+// ConsumedUL the volume drawn from a consumed one.
+type SampleEvent struct {
+	Type       string    `json:"type"`
+	Barcode    string    `json:"barcode"`
+	Sample     *Sample   `json:"sample,omitempty"`
+	From       *Location `json:"from,omitempty"`
+	ConsumedUL *float64  `json:"consumed_ul,omitempty"`
+	WorkflowID string    `json:"workflow_id,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	Lab        string    `json:"lab,omitempty"`
+	Timestamp  string    `json:"timestamp"`
+}
+
+func publishSampleEvent(event SampleEvent) {
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	if event.Sample != nil {
+		event.Lab = event.Sample.Lab
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding sample event: %v", err)
+		return
+	}
+	if err := redisClient.Publish(ctx, SAMPLE_EVENTS_CHANNEL, data).Err(); err != nil {
+		log.Printf("Error publishing %s event for %s: %v", event.Type, event.Barcode, err)
+	}
+	go deliverWebhooks(event.Type, event.Barcode, event.Lab, data)
+}
+
+// publishSampleCreated announces new samples.
+func publishSampleCreated(samples []Sample, actor string) {
+	for i := range samples {
+		publishSampleEvent(SampleEvent{Type: SampleEventCreated, Barcode: samples[i].Barcode, Sample: &samples[i], Actor: actor})
+	}
+}
+
+// publishSampleMoved announces a sample's move, if its location changed.
+func publishSampleMoved(sample Sample, from Location, actor string) {
+	if sample.Location == from {
+		return
+	}
+	publishSampleEvent(SampleEvent{Type: SampleEventMoved, Barcode: sample.Barcode, Sample: &sample, From: &from, Actor: actor})
+}
+
+// publishSampleConsumed announces draws from samples, adding up draws from
+// the same sample.
+func publishSampleConsumed(samples []Sample, consumptions []SampleConsumption, audit SampleAudit) {
+	consumed := map[string]float64{}
+	for _, consumption := range consumptions {
+		consumed[consumption.Barcode] += consumption.VolumeUL
+	}
+	for i := range samples {
+		volume := consumed[samples[i].Barcode]
+		publishSampleEvent(SampleEvent{
+			Type:       SampleEventConsumed,
+			Barcode:    samples[i].Barcode,
+			Sample:     &samples[i],
+			ConsumedUL: &volume,
+			WorkflowID: audit.WorkflowID,
+			Actor:      audit.Actor,
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// SAMPLES_EXPIRES_KEY holds active samples with an expiry date, scored by
+// the expiry as a unix time, in the Redis sample store.
+const SAMPLES_EXPIRES_KEY = "samples:expires"
+
+// Expiry notices already sent are marked under
+// samples:expiry_notice:<barcode>:<event>:<expiry> so each is sent once,
+// even with several instances running.
+const EXPIRY_NOTICE_KEY_PREFIX = "samples:expiry_notice:"
+
+const (
+	defaultExpiryWarning       = 72 * time.Hour
+	defaultExpiryCheckInterval = time.Minute
+	// expiryNoticeRetention keeps notice markers for a while after expiry,
+	// long enough for the expired notice to be sent.
+	expiryNoticeRetention = 7 * 24 * time.Hour
+)
+
+// expiryWarning is how long before expiry the sample.expiring event is sent;
+// set with SAMPLE_EXPIRY_WARNING.
+var expiryWarning = defaultExpiryWarning
+
+type ExpiringSamplesResponse struct {
+	Within  string   `json:"within"`
+	Count   int      `json:"count"`
+	Samples []Sample `json:"samples"`
+}
+
+// parseExpiry validates an RFC 3339 expiry and returns it in UTC.
+func parseExpiry(value string) (string, error) {
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", errors.New("expires_at must be an RFC 3339 timestamp")
+	}
+	return expires.UTC().Format(time.RFC3339), nil
+}
+
+func (s Sample) expiresTime() (time.Time, bool) {
+	if s.ExpiresAt == "" {
+		return time.Time{}, false
+	}
+	expires, err := time.Parse(time.RFC3339, s.ExpiresAt)
+	return expires, err == nil
+}
+
+// refreshExpired sets the computed expired flag.
+func (s *Sample) refreshExpired(now time.Time) {
+	expires, ok := s.expiresTime()
+	s.Expired = ok && !now.Before(expires)
+}
+
+// indexExpiry queues the update of the expiry index for a written sample.
+func indexExpiry(pipe redis.Pipeliner, sample Sample) {
+	expires, ok := sample.expiresTime()
+	if !ok || sample.Archived || sample.deleted() {
+		pipe.ZRem(ctx, SAMPLES_EXPIRES_KEY, sample.Barcode)
+		return
+	}
+	pipe.ZAdd(ctx, SAMPLES_EXPIRES_KEY, redis.Z{Score: float64(expires.Unix()), Member: sample.Barcode})
+}
+
+// expiringSamplesHandler lists active samples expiring within a duration
+// (default 72h), soonest first. Already expired samples are included with
+// include_expired=true.
+func expiringSamplesHandler(c *gin.Context) {
+	within := defaultExpiryWarning
+	if value := c.Query("within"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "within must be a positive duration such as 72h"})
+			return
+		}
+		within = d
+	}
+
+	now := time.Now().UTC()
+	after := now
+	if c.Query("include_expired") == "true" {
+		after = time.Time{}
+	}
+	barcodes, err := sampleStore.Expiring(after, now.Add(within))
+	if err != nil {
+		log.Printf("Error getting expiring samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return
+	}
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		log.Printf("Error getting expiring samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return
+	}
+	samples = visibleSamples(c, samples)
+
+	c.JSON(http.StatusOK, ExpiringSamplesResponse{
+		Within:  within.String(),
+		Count:   len(samples),
+		Samples: samples,
+	})
+}
+
+// claimExpiryNotice marks a notice as sent, returning false if it already
+// was.
+func claimExpiryNotice(sample Sample, eventType string, expires time.Time) (bool, error) {
+	key := fmt.Sprintf("%s%s:%s:%d", EXPIRY_NOTICE_KEY_PREFIX, sample.Barcode, eventType, expires.Unix())
+	ttl := time.Until(expires) + expiryNoticeRetention
+	if ttl <= 0 {
+		ttl = time.Minute
+	}
+	return redisClient.SetNX(ctx, key, 1, ttl).Result()
+}
+
+// checkExpiringSamples publishes sample.expiring for samples within the
+// warning window and sample.expired once they pass their expiry.
+func checkExpiringSamples() error {
+	now := time.Now().UTC()
+	barcodes, err := sampleStore.Expiring(time.Time{}, now.Add(expiryWarning))
+	if err != nil {
+		return err
+	}
+
+	return eachSampleBatch(barcodes, func(samples []Sample) error {
+		for _, sample := range samples {
+			expires, ok := sample.expiresTime()
+			if !ok || sample.Archived {
+				continue
+			}
+			eventType := SampleEventExpiring
+			if sample.Expired {
+				eventType = SampleEventExpired
+			}
+
+			claimed, err := claimExpiryNotice(sample, eventType, expires)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
+			log.Printf("Sample %s %s (expires %s)", sample.Barcode, eventType, sample.ExpiresAt)
+			sample := sample
+			publishSampleEvent(SampleEvent{Type: eventType, Barcode: sample.Barcode, Sample: &sample})
+		}
+		return nil
+	})
+}
+
+// startExpiryMonitor checks for expiring samples in the background. The
+// interval is set with SAMPLE_EXPIRY_CHECK_INTERVAL.
+func startExpiryMonitor() {
+	if value := os.Getenv("SAMPLE_EXPIRY_WARNING"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid SAMPLE_EXPIRY_WARNING %q", value)
+		}
+		expiryWarning = d
+	}
+	interval := defaultExpiryCheckInterval
+	if value := os.Getenv("SAMPLE_EXPIRY_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid SAMPLE_EXPIRY_CHECK_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := checkExpiringSamples(); err != nil {
+				log.Printf("Error checking sample expiry: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Checking sample expiry every %s, warning %s ahead", interval, expiryWarning)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportColumns start with the import columns so an export can be edited
+// and imported again.
+var exportColumns = []string{"barcode", "name", "type", "plate", "well", "storage", "position", "volume_ul", "concentration", "expires_at", "project", "created_at", "updated_at", "archived", "archived_at", "parent_barcode"}
+
+func exportRow(sample Sample) []string {
+	archived := ""
+	if sample.Archived {
+		archived = "true"
+	}
+	return []string{
+		sample.Barcode,
+		sample.Name,
+		sample.Type,
+		sample.Location.Plate,
+		sample.Location.Well,
+		sample.Location.Storage,
+		sample.Location.Position,
+		formatMeasurement(sample.VolumeUL),
+		formatMeasurement(sample.Concentration),
+		sample.ExpiresAt,
+		sample.Project,
+		sample.CreatedAt,
+		sample.UpdatedAt,
+		archived,
+		sample.ArchivedAt,
+		sample.ParentBarcode,
+	}
+}
+
+// exportSamplesHandler streams the samples matching the list filters as a
+// CSV or Excel file.
+func exportSamplesHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
+		return
+	}
+
+	filter, err := sampleFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	barcodes, err := sampleStore.Barcodes(filter)
+	if err != nil {
+		log.Printf("Error finding samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return
+	}
+
+	filename := fmt.Sprintf("samples-%s.%s", time.Now().UTC().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		err = writeSamplesCSV(c.Writer, barcodes, filter)
+	} else {
+		c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		err = writeSamplesXLSX(c.Writer, barcodes, filter)
+	}
+	if err != nil {
+		// The headers are already sent, so the client sees a truncated file.
+		log.Printf("Error exporting samples: %v", err)
+		return
+	}
+	log.Printf("Exported samples as %s", format)
+}
+
+// eachSampleBatch loads the samples a batch at a time, so an export never
+// holds more than one batch in memory.
+func eachSampleBatch(barcodes []string, fn func([]Sample) error) error {
+	for start := 0; start < len(barcodes); start += sampleBatchSize {
+		end := start + sampleBatchSize
+		if end > len(barcodes) {
+			end = len(barcodes)
+		}
+		samples, err := getSamples(barcodes[start:end])
+		if err != nil {
+			return err
+		}
+		if err := fn(samples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSamplesCSV(w gin.ResponseWriter, barcodes []string, filter SampleFilter) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportColumns); err != nil {
+		return err
+	}
+	err := eachSampleBatch(barcodes, func(samples []Sample) error {
+		for _, sample := range samples {
+			if !filter.matches(sample) {
+				continue
+			}
+			if err := writer.Write(exportRow(sample)); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		w.Flush()
+		return writer.Error()
+	})
+	if err != nil {
+		return err
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// The fixed parts of a single-sheet workbook.
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Samples" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// writeSamplesXLSX writes a workbook directly into the response, one row at
+// a time, using inline strings so no shared string table has to be built
+// up front.
+func writeSamplesXLSX(w gin.ResponseWriter, barcodes []string, filter SampleFilter) error {
+	archive := zip.NewWriter(w)
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, part := range parts {
+		f, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+
+	sheet, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(sheet, xlsxSheetStart); err != nil {
+		return err
+	}
+	if err := writeXLSXRow(sheet, 1, exportColumns); err != nil {
+		return err
+	}
+	row := 1
+	err = eachSampleBatch(barcodes, func(samples []Sample) error {
+		for _, sample := range samples {
+			if !filter.matches(sample) {
+				continue
+			}
+			row++
+			if err := writeXLSXRow(sheet, row, exportRow(sample)); err != nil {
+				return err
+			}
+		}
+		if err := archive.Flush(); err != nil {
+			return err
+		}
+		w.Flush()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(sheet, xlsxSheetEnd); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func writeXLSXRow(w io.Writer, row int, values []string) error {
+	var b strings.Builder
+	b.WriteString(`<row r="` + strconv.Itoa(row) + `">`)
+	for i, value := range values {
+		b.WriteString(`<c r="` + xlsxColumn(i) + strconv.Itoa(row) + `" t="inlineStr"><is><t xml:space="preserve">`)
+		xml.EscapeText(&b, []byte(value))
+		b.WriteString(`</t></is></c>`)
+	}
+	b.WriteString(`</row>`)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// xlsxColumn returns the spreadsheet column letters for a zero-based index.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
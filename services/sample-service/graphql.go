@@ -0,0 +1,230 @@
+package main
+
+// Resolvers for schema.graphqls. gqlgen keeps the bodies of these methods
+// when it regenerates the server.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Resolver struct{}
+
+// errGraphQLInternal hides storage errors, which are logged, from clients.
+var errGraphQLInternal = errors.New("internal error; see the sample service logs")
+
+// Changes is the resolver for the changes field.
+func (r *historyEntryResolver) Changes(ctx context.Context, obj *SampleHistoryEntry) ([]SampleFieldChange, error) {
+	changes := make([]SampleFieldChange, 0, len(obj.Changes))
+	for field, change := range obj.Changes {
+		changes = append(changes, SampleFieldChange{Field: field, From: change.From, To: change.To})
+	}
+	sort.Slice(changes, func(a, b int) bool { return changes[a].Field < changes[b].Field })
+	return changes, nil
+}
+
+// Samples is the resolver for the samples field.
+func (r *plateResolver) Samples(ctx context.Context, obj *PlateResponse) ([]Sample, error) {
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Plate: obj.ID, Status: SampleStatusActive})
+	if err != nil {
+		log.Printf("Error listing samples on plate %s: %v", obj.ID, err)
+		return nil, errGraphQLInternal
+	}
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		log.Printf("Error getting samples on plate %s: %v", obj.ID, err)
+		return nil, errGraphQLInternal
+	}
+
+	wells := map[string]int{}
+	for i, well := range wellNames(PLATE_FORMATS[obj.Format]) {
+		wells[well] = i
+	}
+	sort.Slice(samples, func(a, b int) bool {
+		wellA, wellB := wells[samples[a].Location.Well], wells[samples[b].Location.Well]
+		if wellA != wellB {
+			return wellA < wellB
+		}
+		return samples[a].Barcode < samples[b].Barcode
+	})
+	return samples, nil
+}
+
+// Sample is the resolver for the sample field.
+func (r *queryResolver) Sample(ctx context.Context, barcode string) (*Sample, error) {
+	return resolveSample(barcode)
+}
+
+// Samples is the resolver for the samples field.
+func (r *queryResolver) Samples(ctx context.Context, typeArg *string, plate *string, storage *string, status *string, q *string, limit *int, offset *int) (*SampleListResponse, error) {
+	filter := SampleFilter{
+		Type:    stringArg(typeArg),
+		Plate:   stringArg(plate),
+		Storage: stringArg(storage),
+		Status:  stringArg(status),
+		Query:   strings.ToLower(strings.TrimSpace(stringArg(q))),
+		Lab:     new(string),
+	}
+	switch filter.Status {
+	case SampleStatusActive, SampleStatusArchived, "all":
+	default:
+		return nil, errors.New("status must be active, archived or all")
+	}
+
+	pageLimit, pageOffset := defaultSampleLimit, 0
+	if limit != nil {
+		pageLimit = *limit
+	}
+	if offset != nil {
+		pageOffset = *offset
+	}
+	if pageLimit <= 0 || pageLimit > maxSampleLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxSampleLimit)
+	}
+	if pageOffset < 0 {
+		return nil, errors.New("offset must be a non-negative integer")
+	}
+
+	samples, total, err := findSamples(filter, pageLimit, pageOffset)
+	if err != nil {
+		log.Printf("Error getting samples: %v", err)
+		return nil, errGraphQLInternal
+	}
+	return &SampleListResponse{Samples: samples, Total: total, Limit: pageLimit, Offset: pageOffset}, nil
+}
+
+// Plate is the resolver for the plate field.
+func (r *queryResolver) Plate(ctx context.Context, id string) (*PlateResponse, error) {
+	return resolvePlate(id)
+}
+
+// Plates is the resolver for the plates field.
+func (r *queryResolver) Plates(ctx context.Context) ([]PlateResponse, error) {
+	plateIDs, err := redisClient.ZRange(ctx, PLATES_ALL_KEY, 0, -1).Result()
+	if err != nil {
+		log.Printf("Error listing plates: %v", err)
+		return nil, errGraphQLInternal
+	}
+	plates := make([]PlateResponse, 0, len(plateIDs))
+	for _, plateID := range plateIDs {
+		plate, err := resolvePlate(plateID)
+		if err != nil {
+			return nil, err
+		}
+		if plate != nil {
+			plates = append(plates, *plate)
+		}
+	}
+	return plates, nil
+}
+
+// Metadata is the resolver for the metadata field.
+func (r *sampleResolver) Metadata(ctx context.Context, obj *Sample) (map[string]interface{}, error) {
+	metadata := make(map[string]interface{}, len(obj.Metadata))
+	for key, value := range obj.Metadata {
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// Plate is the resolver for the plate field.
+func (r *sampleResolver) Plate(ctx context.Context, obj *Sample) (*PlateResponse, error) {
+	if obj.Location.Plate == "" {
+		return nil, nil
+	}
+	return resolvePlate(obj.Location.Plate)
+}
+
+// Parent is the resolver for the parent field.
+func (r *sampleResolver) Parent(ctx context.Context, obj *Sample) (*Sample, error) {
+	if obj.ParentBarcode == "" {
+		return nil, nil
+	}
+	return resolveSample(obj.ParentBarcode)
+}
+
+// Children is the resolver for the children field.
+func (r *sampleResolver) Children(ctx context.Context, obj *Sample) ([]Sample, error) {
+	barcodes, err := sampleStore.Children(obj.Barcode)
+	if err != nil {
+		log.Printf("Error listing children of sample %s: %v", obj.Barcode, err)
+		return nil, errGraphQLInternal
+	}
+	return resolveSamples(barcodes)
+}
+
+// Ancestors is the resolver for the ancestors field.
+func (r *sampleResolver) Ancestors(ctx context.Context, obj *Sample) ([]Sample, error) {
+	ancestors, err := sampleAncestors(*obj)
+	if err != nil {
+		log.Printf("Error tracing ancestors of sample %s: %v", obj.Barcode, err)
+		return nil, errGraphQLInternal
+	}
+	return ancestors, nil
+}
+
+// MergedInto is the resolver for the mergedInto field.
+func (r *sampleResolver) MergedInto(ctx context.Context, obj *Sample) (*Sample, error) {
+	if obj.MergedInto == "" {
+		return nil, nil
+	}
+	return resolveSample(obj.MergedInto)
+}
+
+// MergedFrom is the resolver for the mergedFrom field.
+func (r *sampleResolver) MergedFrom(ctx context.Context, obj *Sample) ([]Sample, error) {
+	return resolveSamples(obj.MergedFrom)
+}
+
+// History is the resolver for the history field.
+func (r *sampleResolver) History(ctx context.Context, obj *Sample, action *string, workflowID *string, includeMerged *bool, limit *int) ([]SampleHistoryEntry, error) {
+	maxEntries := defaultHistoryLimit
+	if limit != nil {
+		maxEntries = *limit
+	}
+	if maxEntries <= 0 || maxEntries > maxHistoryLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+	}
+
+	entries, err := readSampleHistory(*obj, includeMerged != nil && *includeMerged, time.Time{}, time.Time{})
+	if err != nil {
+		log.Printf("Error reading history for sample %s: %v", obj.Barcode, err)
+		return nil, errGraphQLInternal
+	}
+	history := []SampleHistoryEntry{}
+	for _, entry := range entries {
+		if action != nil && entry.Action != *action {
+			continue
+		}
+		if workflowID != nil && entry.WorkflowID != *workflowID {
+			continue
+		}
+		history = append(history, entry)
+		if len(history) == maxEntries {
+			break
+		}
+	}
+	return history, nil
+}
+
+// HistoryEntry returns HistoryEntryResolver implementation.
+func (r *Resolver) HistoryEntry() HistoryEntryResolver { return &historyEntryResolver{r} }
+
+// Plate returns PlateResolver implementation.
+func (r *Resolver) Plate() PlateResolver { return &plateResolver{r} }
+
+// Query returns QueryResolver implementation.
+func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
+
+// Sample returns SampleResolver implementation.
+func (r *Resolver) Sample() SampleResolver { return &sampleResolver{r} }
+
+type historyEntryResolver struct{ *Resolver }
+type plateResolver struct{ *Resolver }
+type queryResolver struct{ *Resolver }
+type sampleResolver struct{ *Resolver }
@@ -0,0 +1,80 @@
+package main
+
+//go:generate go run github.com/99designs/gqlgen generate
+
+import (
+	"log"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/gin-gonic/gin"
+)
+
+// graphqlComplexityLimit bounds the fields a query may select, so deeply
+// nested lineage queries can't load the whole store.
+const graphqlComplexityLimit = 1000
+
+func resolveSample(barcode string) (*Sample, error) {
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		return nil, errGraphQLInternal
+	}
+	if sample != nil && sample.Lab != "" {
+		return nil, nil
+	}
+	return sample, nil
+}
+
+func resolveSamples(barcodes []string) ([]Sample, error) {
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		log.Printf("Error getting samples: %v", err)
+		return nil, errGraphQLInternal
+	}
+	return samples, nil
+}
+
+func resolvePlate(plateID string) (*PlateResponse, error) {
+	plate, err := getPlate(plateID)
+	if err != nil {
+		log.Printf("Error getting plate %s: %v", plateID, err)
+		return nil, errGraphQLInternal
+	}
+	if plate == nil || plate.Lab != "" {
+		return nil, nil
+	}
+	occupancy, err := plateOccupancy(plateID)
+	if err != nil {
+		log.Printf("Error reading occupancy of plate %s: %v", plateID, err)
+		return nil, errGraphQLInternal
+	}
+	response := plateResponse(*plate, occupancy)
+	return &response, nil
+}
+
+func stringArg(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// graphqlHandler serves queries over POST and GET. The resolvers don't
+// check projects or labs, so keys limited to some projects and other labs
+// can't use it.
+func graphqlHandler() gin.HandlerFunc {
+	server := handler.New(NewExecutableSchema(Config{Resolvers: &Resolver{}}))
+	server.AddTransport(transport.Options{})
+	server.AddTransport(transport.GET{})
+	server.AddTransport(transport.POST{})
+	server.Use(extension.Introspection{})
+	server.Use(extension.FixedComplexityLimit(graphqlComplexityLimit))
+	serve := gin.WrapH(server)
+	return func(c *gin.Context) {
+		if requireDefaultLab(c) {
+			serve(c)
+		}
+	}
+}
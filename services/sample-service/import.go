@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// How rows whose barcode already exists are handled on import.
+const (
+	DuplicateError  = "error"
+	DuplicateSkip   = "skip"
+	DuplicateUpdate = "update"
+)
+
+// Outcome of each imported row.
+const (
+	ImportRowCreated = "created"
+	ImportRowUpdated = "updated"
+	ImportRowSkipped = "skipped"
+	ImportRowInvalid = "invalid"
+)
+
+// maxImportRows bounds a single import file.
+const maxImportRows = 10000
+
+var importColumns = []string{"barcode", "name", "type", "plate", "well", "storage", "position", "volume_ul", "concentration", "expires_at", "project"}
+
+type ImportRowResult struct {
+	Row     int    `json:"row"`
+	Barcode string `json:"barcode,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ImportResponse struct {
+	Preview     bool              `json:"preview"`
+	Imported    bool              `json:"imported"`
+	OnDuplicate string            `json:"on_duplicate"`
+	TotalRows   int               `json:"total_rows"`
+	Created     int               `json:"created"`
+	Updated     int               `json:"updated"`
+	Skipped     int               `json:"skipped"`
+	Invalid     int               `json:"invalid"`
+	Rows        []ImportRowResult `json:"rows"`
+}
+
+// readImportHeader maps each known column to its index. The barcode column
+// is required; the rest are optional.
+func readImportHeader(header []string) (map[string]int, error) {
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for _, known := range importColumns {
+			if name == known {
+				columns[name] = i
+			}
+		}
+	}
+	if _, ok := columns["barcode"]; !ok {
+		return nil, errors.New("CSV must have a barcode column")
+	}
+	return columns, nil
+}
+
+func importField(record []string, columns map[string]int, name string) string {
+	i, ok := columns[name]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[i])
+}
+
+// importMeasurement parses an optional non-negative number column.
+func importMeasurement(record []string, columns map[string]int, name string) (*float64, error) {
+	value := importField(record, columns, name)
+	if value == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative number", name)
+	}
+	return &n, nil
+}
+
+// mergeImportedSample overwrites only the fields whose columns are in the
+// file, so a partial spreadsheet doesn't blank the rest of the sample.
+func mergeImportedSample(existing, imported Sample, columns map[string]int) Sample {
+	if _, ok := columns["name"]; ok {
+		existing.Name = imported.Name
+	}
+	if _, ok := columns["type"]; ok {
+		existing.Type = imported.Type
+	}
+	if _, ok := columns["plate"]; ok {
+		existing.Location.Plate = imported.Location.Plate
+	}
+	if _, ok := columns["well"]; ok {
+		existing.Location.Well = imported.Location.Well
+	}
+	if _, ok := columns["storage"]; ok {
+		existing.Location.Storage = imported.Location.Storage
+	}
+	if _, ok := columns["position"]; ok {
+		existing.Location.Position = imported.Location.Position
+	}
+	if _, ok := columns["volume_ul"]; ok {
+		existing.VolumeUL = imported.VolumeUL
+	}
+	if _, ok := columns["concentration"]; ok {
+		existing.Concentration = imported.Concentration
+	}
+	if _, ok := columns["expires_at"]; ok {
+		existing.ExpiresAt = imported.ExpiresAt
+	}
+	if _, ok := columns["project"]; ok {
+		existing.Project = imported.Project
+	}
+	return existing
+}
+
+// ImportConflictError reports samples created or changed by someone else
+// between validating an import and saving it.
+type ImportConflictError struct {
+	Barcodes []string
+}
+
+func (e *ImportConflictError) Error() string {
+	return fmt.Sprintf("%d sample(s) changed during the import: %s", len(e.Barcodes), strings.Join(e.Barcodes, ", "))
+}
+
+// saveImportedSamples writes the validated samples in one transaction, but
+// only if each is still at the version it was validated against; existing
+// holds the samples as they were read.
+func saveImportedSamples(changes []Sample, existing map[string]Sample, audit SampleAudit) error {
+	barcodes := make([]string, len(changes))
+	for i, sample := range changes {
+		barcodes[i] = sample.Barcode
+	}
+
+	return sampleStore.Update(func(tx SampleTx) error {
+		current, err := tx.GetMany(barcodes)
+		if err != nil {
+			return err
+		}
+		versions := make(map[string]int64, len(current))
+		for _, sample := range current {
+			versions[sample.Barcode] = sample.Version
+		}
+		conflict := &ImportConflictError{}
+		for _, sample := range changes {
+			version, found := versions[sample.Barcode]
+			previous, had := existing[sample.Barcode]
+			if found != had || version != previous.Version {
+				conflict.Barcodes = append(conflict.Barcodes, sample.Barcode)
+			}
+		}
+		if len(conflict.Barcodes) > 0 {
+			return conflict
+		}
+
+		for i := range changes {
+			sample := &changes[i]
+			var previous *Sample
+			if existing, ok := existing[sample.Barcode]; ok {
+				previous = &existing
+			}
+			sample.nextVersion(previous)
+			sample.attribute(previous, audit.Actor)
+			tx.Put(SampleWrite{Sample: *sample, Previous: previous, Audit: audit})
+		}
+		return nil
+	})
+}
+
+// importSamplesHandler loads samples from a CSV upload. Every row is
+// validated first and nothing is saved unless all rows are valid; with
+// preview=true the report is returned without saving anything. Rows may
+// only place samples in occupied wells with allow_pooling=true.
+func importSamplesHandler(c *gin.Context) {
+	preview := c.Query("preview") == "true"
+	allowPooling := c.Query("allow_pooling") == "true"
+	onDuplicate := c.DefaultQuery("on_duplicate", DuplicateError)
+	if onDuplicate != DuplicateError && onDuplicate != DuplicateSkip && onDuplicate != DuplicateUpdate {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "on_duplicate must be error, skip or update"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file is required in the file field"})
+		return
+	}
+	upload, err := file.Open()
+	if err != nil {
+		log.Printf("Error opening sample import: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read CSV file"})
+		return
+	}
+	defer upload.Close()
+
+	reader := csv.NewReader(upload)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV file is empty or malformed"})
+		return
+	}
+	columns, err := readImportHeader(header)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Read the whole file first so the existing samples it mentions can be
+	// loaded in one batch.
+	type importRecord struct {
+		row    int
+		fields []string
+		err    error
+	}
+	records := []importRecord{}
+	barcodes := []string{}
+	// Row numbers match the spreadsheet, counting the header as row 1.
+	for row := 2; ; row++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if len(records) == maxImportRows {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("CSV file has more than %d rows", maxImportRows)})
+			return
+		}
+		records = append(records, importRecord{row: row, fields: fields, err: err})
+		if err == nil {
+			if barcode := importField(fields, columns, "barcode"); barcode != "" {
+				barcodes = append(barcodes, barcode)
+			}
+		}
+	}
+
+	existingSamples, err := getSampleMap(barcodes)
+	if err != nil {
+		log.Printf("Error getting samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return
+	}
+
+	barcodeRules, err := loadBarcodeValidator()
+	if err != nil {
+		log.Printf("Error loading barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode rules"})
+		return
+	}
+	access := requestAccess(c)
+	locations := newLocationValidator(access.Lab)
+	types := newSampleTypeValidator()
+	resp := ImportResponse{Preview: preview, OnDuplicate: onDuplicate, TotalRows: len(records), Rows: []ImportRowResult{}}
+	changes := []Sample{}
+	seen := map[string]int{}
+	wellRows := map[string]int{}
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	for _, record := range records {
+		result := ImportRowResult{Row: record.row}
+		if record.err != nil {
+			result.Status = ImportRowInvalid
+			result.Error = fmt.Sprintf("malformed row: %v", record.err)
+			resp.Invalid++
+			resp.Rows = append(resp.Rows, result)
+			continue
+		}
+
+		barcode := importField(record.fields, columns, "barcode")
+		result.Barcode = barcode
+		sample := Sample{
+			Barcode: barcode,
+			Name:    importField(record.fields, columns, "name"),
+			Type:    importField(record.fields, columns, "type"),
+			Location: Location{
+				Plate:    importField(record.fields, columns, "plate"),
+				Well:     importField(record.fields, columns, "well"),
+				Storage:  importField(record.fields, columns, "storage"),
+				Position: importField(record.fields, columns, "position"),
+			},
+			Project:   importField(record.fields, columns, "project"),
+			Lab:       access.Lab,
+			CreatedAt: now,
+		}
+		var fieldErr error
+		if sample.VolumeUL, err = importMeasurement(record.fields, columns, "volume_ul"); err != nil {
+			fieldErr = err
+		}
+		if sample.Concentration, err = importMeasurement(record.fields, columns, "concentration"); err != nil && fieldErr == nil {
+			fieldErr = err
+		}
+		if expiresAt := importField(record.fields, columns, "expires_at"); expiresAt != "" {
+			if sample.ExpiresAt, err = parseExpiry(expiresAt); err != nil && fieldErr == nil {
+				fieldErr = err
+			}
+		}
+
+		existing, exists := existingSamples[barcode]
+		switch {
+		case barcode == "":
+			result.Status = ImportRowInvalid
+			result.Error = "barcode is required"
+		case seen[barcode] != 0:
+			result.Status = ImportRowInvalid
+			result.Error = fmt.Sprintf("duplicate of row %d", seen[barcode])
+		case fieldErr != nil:
+			result.Status = ImportRowInvalid
+			result.Error = fieldErr.Error()
+		case exists && !access.allowsSample(existing):
+			result.Status = ImportRowInvalid
+			result.Error = "sample already exists"
+		case !exists:
+			result.Status = ImportRowCreated
+			if barcodeErr := barcodeRules.Validate(barcode, sample.Type); barcodeErr != nil {
+				result.Status = ImportRowInvalid
+				result.Error = barcodeErr.Message
+			}
+		case onDuplicate == DuplicateSkip:
+			result.Status = ImportRowSkipped
+		case onDuplicate == DuplicateError:
+			result.Status = ImportRowInvalid
+			result.Error = "sample already exists"
+		case existing.Archived:
+			result.Status = ImportRowInvalid
+			result.Error = "sample is archived"
+		default:
+			result.Status = ImportRowUpdated
+			sample = mergeImportedSample(existing, sample, columns)
+			sample.UpdatedAt = now
+		}
+		// New samples without a project get the API key's, and neither new
+		// nor updated samples can be put in a project the key can't use.
+		switch result.Status {
+		case ImportRowCreated:
+			if sample.Project, err = access.defaultProject(sample.Project); err != nil {
+				result.Status = ImportRowInvalid
+				result.Error = err.Error()
+			}
+		case ImportRowUpdated:
+			if !access.allowsSample(sample) {
+				result.Status = ImportRowInvalid
+				result.Error = fmt.Sprintf("this API key can't use project %s", sample.Project)
+			}
+		}
+		if result.Status == ImportRowCreated || result.Status == ImportRowUpdated {
+			location, locErr := locations.Validate(sample.Location)
+			if locErr != nil {
+				result.Status = ImportRowInvalid
+				result.Error = locErr.Message
+			}
+			sample.Location = location
+		}
+		// Samples updated without changing type keep it even if the type's
+		// rules have changed since.
+		if result.Status == ImportRowCreated || result.Status == ImportRowUpdated && sample.Type != existing.Type {
+			if typeErr := types.Validate(sample); typeErr != nil {
+				result.Status = ImportRowInvalid
+				result.Error = typeErr.Message
+			}
+		}
+		if result.Status == ImportRowCreated {
+			types.ApplyDefaults(&sample)
+		}
+		if wellKey := sample.wellKey(); result.Status != ImportRowInvalid && wellKey != "" && !allowPooling {
+			occupant, err := wellOccupant(sampleStore, wellKey, barcode)
+			if err != nil {
+				log.Printf("Error checking well %s: %v", wellKey, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check well occupancy"})
+				return
+			}
+			switch {
+			case occupant != "" && (!exists || existing.wellKey() != wellKey):
+				result.Status = ImportRowInvalid
+				result.Error = fmt.Sprintf("%s is occupied by sample %s", sample.Location.describe(), occupant)
+			case wellRows[wellKey] != 0:
+				result.Status = ImportRowInvalid
+				result.Error = fmt.Sprintf("%s is also used by row %d", sample.Location.describe(), wellRows[wellKey])
+			default:
+				wellRows[wellKey] = record.row
+			}
+		}
+		if barcode != "" && seen[barcode] == 0 {
+			seen[barcode] = record.row
+		}
+
+		switch result.Status {
+		case ImportRowCreated:
+			resp.Created++
+			changes = append(changes, sample)
+		case ImportRowUpdated:
+			resp.Updated++
+			changes = append(changes, sample)
+		case ImportRowSkipped:
+			resp.Skipped++
+		case ImportRowInvalid:
+			resp.Invalid++
+		}
+		resp.Rows = append(resp.Rows, result)
+	}
+
+	if resp.Invalid > 0 {
+		log.Printf("Sample import rejected: %d of %d row(s) invalid", resp.Invalid, resp.TotalRows)
+		c.JSON(http.StatusUnprocessableEntity, resp)
+		return
+	}
+	if preview || resp.Created+resp.Updated == 0 {
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	audit := SampleAudit{Action: SampleActionImported, Actor: requestActor(c), Note: file.Filename}
+	if err := saveImportedSamples(changes, existingSamples, audit); err != nil {
+		var conflict *ImportConflictError
+		if errors.As(err, &conflict) {
+			log.Printf("Sample import rejected: %v", conflict)
+			c.JSON(http.StatusConflict, gin.H{
+				"error":               conflict.Error() + "; import the file again",
+				"conflicting_samples": conflict.Barcodes,
+			})
+			return
+		}
+		log.Printf("Error saving samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save samples"})
+		return
+	}
+	resp.Imported = true
+	for _, sample := range changes {
+		if previous, ok := existingSamples[sample.Barcode]; ok {
+			publishSampleMoved(sample, previous.Location, audit.Actor)
+		} else {
+			publishSampleCreated([]Sample{sample}, audit.Actor)
+		}
+	}
+
+	log.Printf("Imported samples: %d created, %d updated, %d skipped", resp.Created, resp.Updated, resp.Skipped)
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// LABEL_TEMPLATE_KEY holds the label template as JSON; the default is used
+// until one is saved.
+const LABEL_TEMPLATE_KEY = "labels:template"
+
+// Label symbologies.
+const (
+	SymbologyCode128    = "code128"
+	SymbologyDataMatrix = "datamatrix"
+)
+
+// labelMargin is the blank border of a label in dots.
+const labelMargin = 15
+
+// LabelTemplate lays out a label: the symbology, the size in printer dots
+// (203 dpi, so the default is 2 x 1 inches) and text lines printed with the
+// barcode. Lines are Go templates over LabelData, e.g. "{{.Name}}".
+type LabelTemplate struct {
+	Symbology string   `json:"symbology"`
+	Width     int      `json:"width"`
+	Height    int      `json:"height"`
+	Lines     []string `json:"lines"`
+}
+
+var defaultLabelTemplate = LabelTemplate{
+	Symbology: SymbologyCode128,
+	Width:     406,
+	Height:    203,
+	Lines:     []string{"{{.Name}}", "{{.Location}}"},
+}
+
+// LabelData is what label lines can show.
+type LabelData struct {
+	Barcode   string
+	Name      string
+	Type      string
+	Location  string
+	ExpiresAt string
+	Metadata  map[string]string
+}
+
+// label is a template ready to render for one sample.
+type label struct {
+	LabelTemplate
+	barcode string
+	lines   []string
+}
+
+// labelLocation is the short form of a location printed on labels.
+func labelLocation(location Location) string {
+	switch {
+	case location.Storage != "":
+		return fmt.Sprintf("%s #%s", location.Storage, location.Position)
+	case location.Plate != "":
+		return strings.TrimSpace(location.Plate + " " + location.Well)
+	}
+	return ""
+}
+
+// parseLabelLines compiles the line templates.
+func parseLabelLines(lines []string) ([]*template.Template, error) {
+	templates := make([]*template.Template, len(lines))
+	for i, line := range lines {
+		t, err := template.New(fmt.Sprintf("line%d", i+1)).Option("missingkey=zero").Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		templates[i] = t
+	}
+	return templates, nil
+}
+
+func validateLabelTemplate(t LabelTemplate) error {
+	if t.Symbology != SymbologyCode128 && t.Symbology != SymbologyDataMatrix {
+		return fmt.Errorf("symbology must be %s or %s", SymbologyCode128, SymbologyDataMatrix)
+	}
+	if t.Width < 100 || t.Width > 2400 || t.Height < 50 || t.Height > 2400 {
+		return fmt.Errorf("width must be 100-2400 and height 50-2400 dots")
+	}
+	_, err := parseLabelLines(t.Lines)
+	return err
+}
+
+func getLabelTemplate() (LabelTemplate, error) {
+	data, err := redisClient.Get(ctx, LABEL_TEMPLATE_KEY).Result()
+	if err == redis.Nil {
+		return defaultLabelTemplate, nil
+	}
+	if err != nil {
+		return LabelTemplate{}, err
+	}
+	var t LabelTemplate
+	if err := json.Unmarshal([]byte(data), &t); err != nil {
+		return LabelTemplate{}, err
+	}
+	return t, nil
+}
+
+// newLabel fills in the template's lines for a sample.
+func newLabel(t LabelTemplate, sample Sample) (*label, error) {
+	templates, err := parseLabelLines(t.Lines)
+	if err != nil {
+		return nil, err
+	}
+	data := LabelData{
+		Barcode:   sample.Barcode,
+		Name:      sample.Name,
+		Type:      sample.Type,
+		Location:  labelLocation(sample.Location),
+		ExpiresAt: sample.ExpiresAt,
+		Metadata:  sample.Metadata,
+	}
+
+	l := &label{LabelTemplate: t, barcode: sample.Barcode}
+	for _, t := range templates {
+		var line bytes.Buffer
+		if err := t.Execute(&line, data); err != nil {
+			return nil, err
+		}
+		if text := strings.TrimSpace(line.String()); text != "" {
+			l.lines = append(l.lines, text)
+		}
+	}
+	return l, nil
+}
+
+// zplField escapes field data for ^FH, which reads _XX as a hex byte.
+func zplField(value string) string {
+	return strings.NewReplacer("_", "_5F", "^", "_5E", "~", "_7E").Replace(value)
+}
+
+// zpl renders the label as ZPL II. The printer draws the barcode itself.
+func (l *label) zpl() (string, error) {
+	var b strings.Builder
+	b.WriteString("^XA\n^CI28\n")
+	fmt.Fprintf(&b, "^PW%d\n^LL%d\n", l.Width, l.Height)
+
+	textX, textY := labelMargin, labelMargin
+	switch l.Symbology {
+	case SymbologyCode128:
+		modules, err := code128Modules(l.barcode)
+		if err != nil {
+			return "", err
+		}
+		module := (l.Width - 2*labelMargin) / (len(modules) + 2*code128QuietZone)
+		if module < 1 {
+			return "", fmt.Errorf("barcode is too long for a %d-dot wide label", l.Width)
+		}
+		if module > 10 {
+			module = 10
+		}
+		barHeight := l.Height * 45 / 100
+		fmt.Fprintf(&b, "^BY%d\n^FO%d,%d^BCN,%d,N,N,N,A^FH^FD%s^FS\n", module, labelMargin+module*code128QuietZone, labelMargin, barHeight, zplField(l.barcode))
+		textY += barHeight + 10
+	case SymbologyDataMatrix:
+		size := l.Height - 2*labelMargin
+		// Barcodes of up to about 30 characters fit in 22 modules.
+		module := size / 22
+		if module < 2 {
+			module = 2
+		}
+		fmt.Fprintf(&b, "^FO%d,%d^BXN,%d,200^FH^FD%s^FS\n", labelMargin, labelMargin, module, zplField(l.barcode))
+		textX += size + 10
+	}
+
+	if len(l.lines) > 0 {
+		fontHeight := (l.Height - textY - labelMargin) / len(l.lines)
+		if fontHeight > 30 {
+			fontHeight = 30
+		}
+		for _, line := range l.lines {
+			fmt.Fprintf(&b, "^FO%d,%d^A0N,%d,%d^FH^FD%s^FS\n", textX, textY, fontHeight, fontHeight, zplField(line))
+			textY += fontHeight
+		}
+	}
+	b.WriteString("^XZ\n")
+	return b.String(), nil
+}
+
+// drawText draws a line of text with the label font, cut off at maxX.
+func drawText(img *image.Gray, text string, x, y, scale, maxX int) {
+	for _, r := range text {
+		if x+5*scale > maxX {
+			return
+		}
+		for row, bits := range labelGlyph(r) {
+			for column, bit := range bits {
+				if bit != '#' {
+					continue
+				}
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						img.SetGray(x+column*scale+dx, y+row*scale+dy, color.Gray{})
+					}
+				}
+			}
+		}
+		x += 6 * scale
+	}
+}
+
+// png renders the label as a PNG. Only Code 128 is drawn; DataMatrix labels
+// are printed from ZPL.
+func (l *label) png() ([]byte, error) {
+	if l.Symbology != SymbologyCode128 {
+		return nil, fmt.Errorf("%s labels are only available as ZPL", l.Symbology)
+	}
+	modules, err := code128Modules(l.barcode)
+	if err != nil {
+		return nil, err
+	}
+	module := (l.Width - 2*labelMargin) / (len(modules) + 2*code128QuietZone)
+	if module < 1 {
+		return nil, fmt.Errorf("barcode is too long for a %d-dot wide label", l.Width)
+	}
+
+	img := image.NewGray(image.Rect(0, 0, l.Width, l.Height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	barHeight := l.Height * 45 / 100
+	x := (l.Width - len(modules)*module) / 2
+	for _, bar := range modules {
+		if bar {
+			for dx := 0; dx < module; dx++ {
+				for y := labelMargin; y < labelMargin+barHeight; y++ {
+					img.SetGray(x+dx, y, color.Gray{})
+				}
+			}
+		}
+		x += module
+	}
+
+	y := labelMargin + barHeight + 10
+	scale := 2
+	if len(l.lines) > 0 && (l.Height-y-labelMargin)/len(l.lines) < 9*scale {
+		scale = 1
+	}
+	for _, line := range l.lines {
+		if y+7*scale > l.Height-labelMargin {
+			break
+		}
+		drawText(img, line, labelMargin, y, scale, l.Width-labelMargin)
+		y += 9 * scale
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sampleLabelHandler renders a sample's label as ZPL (default) or PNG.
+// symbology overrides the template's.
+func sampleLabelHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+	format := c.DefaultQuery("format", "zpl")
+	if format != "zpl" && format != "png" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zpl or png"})
+		return
+	}
+
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if sample == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+
+	t, err := getLabelTemplate()
+	if err != nil {
+		log.Printf("Error getting label template: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve label template"})
+		return
+	}
+	if symbology := c.Query("symbology"); symbology != "" {
+		if symbology != SymbologyCode128 && symbology != SymbologyDataMatrix {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("symbology must be %s or %s", SymbologyCode128, SymbologyDataMatrix)})
+			return
+		}
+		t.Symbology = symbology
+	}
+
+	l, err := newLabel(t, *sample)
+	if err != nil {
+		log.Printf("Error rendering label for %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render label"})
+		return
+	}
+
+	if format == "png" {
+		data, err := l.png()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Data(http.StatusOK, "image/png", data)
+		return
+	}
+	zpl, err := l.zpl()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", barcode+".zpl"))
+	c.Data(http.StatusOK, "application/zpl; charset=utf-8", []byte(zpl))
+}
+
+func getLabelTemplateHandler(c *gin.Context) {
+	t, err := getLabelTemplate()
+	if err != nil {
+		log.Printf("Error getting label template: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve label template"})
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// setLabelTemplateHandler replaces the label template; omitted fields keep
+// their defaults.
+func setLabelTemplateHandler(c *gin.Context) {
+	if !requireDefaultLab(c) {
+		return
+	}
+	t := defaultLabelTemplate
+	if err := c.ShouldBindJSON(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateLabelTemplate(t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		log.Printf("Error encoding label template: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save label template"})
+		return
+	}
+	if err := redisClient.Set(ctx, LABEL_TEMPLATE_KEY, data, 0).Err(); err != nil {
+		log.Printf("Error saving label template: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save label template"})
+		return
+	}
+
+	log.Printf("Label template updated (%s, %dx%d)", t.Symbology, t.Width, t.Height)
+	c.JSON(http.StatusOK, t)
+}
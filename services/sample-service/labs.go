@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LAB_HEADER names the lab a request is made in. The gateway sets it from
+// the user's session; API keys work in the lab they were issued in instead.
+// Requests without it are in the default lab, which the samples stored
+// before labs existed belong to.
+const LAB_HEADER = "X-Lab"
+
+// defaultLabName stands for the default lab where a lab needs a name, as
+// in the samples:lab:default index; no other lab can take it.
+const defaultLabName = "default"
+
+var labPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+func validLab(lab string) bool {
+	return lab == "" || (labPattern.MatchString(lab) && lab != defaultLabName)
+}
+
+// requestLab returns the lab a request is made in, or "" for the default
+// lab.
+func requestLab(c *gin.Context) string {
+	return strings.TrimSpace(c.GetHeader(LAB_HEADER))
+}
+
+// requireDefaultLab rejects requests from other labs, for the settings all
+// labs share.
+func requireDefaultLab(c *gin.Context) bool {
+	if !requireFullAccess(c) {
+		return false
+	}
+	if requestAccess(c).Lab != "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Shared settings are managed from the default lab"})
+		return false
+	}
+	return true
+}
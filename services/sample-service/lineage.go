@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxAliquots bounds the children created by a single aliquot request.
+const maxAliquots = 384
+
+// maxLineageDepth bounds how far lineage is followed in either direction.
+const maxLineageDepth = 32
+
+func childrenIndexKey(parent string) string {
+	return fmt.Sprintf("samples:children:%s", parent)
+}
+
+// AliquotSpec describes one child sample. Name and type default to the
+// parent's, and the parent's metadata is copied.
+type AliquotSpec struct {
+	Barcode  string   `json:"barcode"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Location Location `json:"location"`
+}
+
+type AliquotRequest struct {
+	Aliquots     []AliquotSpec `json:"aliquots" binding:"required"`
+	AllowPooling bool          `json:"allow_pooling"`
+}
+
+type AliquotResponse struct {
+	Parent   Sample   `json:"parent"`
+	Aliquots []Sample `json:"aliquots"`
+}
+
+// LineageNode is a sample with its descendants.
+type LineageNode struct {
+	Sample
+	Children []LineageNode `json:"children"`
+}
+
+// LineageResponse traces a sample back to its sources: ancestors lists the
+// parents first and the source samples last. Source is the first source;
+// pools can have several.
+type LineageResponse struct {
+	Barcode   string      `json:"barcode"`
+	Source    string      `json:"source"`
+	Sources   []string    `json:"sources"`
+	Ancestors []Sample    `json:"ancestors"`
+	Tree      LineageNode `json:"tree"`
+}
+
+// createAliquots stores the children of parent in one transaction, so the
+// parent, the children and their wells can't change before the write. The
+// parent's history records the aliquots taken.
+func createAliquots(parent Sample, children []Sample, allowPooling bool, actor string) error {
+	childBarcodes := make([]string, len(children))
+	wells := map[string]Sample{}
+	for i := range children {
+		children[i].nextVersion(nil)
+		children[i].attribute(nil, actor)
+	}
+	for i, child := range children {
+		childBarcodes[i] = child.Barcode
+		wellKey := child.wellKey()
+		if wellKey == "" || allowPooling {
+			continue
+		}
+		if other, ok := wells[wellKey]; ok {
+			return &WellConflictError{Location: child.Location, Barcode: other.Barcode}
+		}
+		wells[wellKey] = child
+	}
+	parentAudit := SampleAudit{Action: SampleActionAliquoted, Actor: actor, Note: "aliquots: " + strings.Join(childBarcodes, ", ")}
+	childAudit := SampleAudit{Action: SampleActionCreated, Actor: actor, Note: "aliquot of " + parent.Barcode}
+
+	return sampleStore.Update(func(tx SampleTx) error {
+		stored, err := tx.GetMany([]string{parent.Barcode})
+		if err != nil {
+			return err
+		}
+		if len(stored) == 0 || stored[0].Archived {
+			return &SampleError{StatusCode: http.StatusConflict, Message: "Parent sample is archived or was removed"}
+		}
+		existing, err := tx.GetMany(childBarcodes)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return &SampleError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("Sample %s already exists", existing[0].Barcode)}
+		}
+		for wellKey, child := range wells {
+			occupant, err := wellOccupant(tx, wellKey, child.Barcode)
+			if err != nil {
+				return err
+			}
+			if occupant != "" {
+				return &WellConflictError{Location: child.Location, Barcode: occupant}
+			}
+		}
+		for _, child := range children {
+			tx.Put(SampleWrite{Sample: child, Audit: childAudit})
+		}
+		tx.Put(SampleWrite{Sample: stored[0], Previous: &stored[0], Audit: parentAudit, HistoryOnly: true})
+		return nil
+	})
+}
+
+// aliquotSampleHandler derives child samples from a parent sample.
+func aliquotSampleHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	var req AliquotRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Aliquots) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "aliquots array is required"})
+		return
+	}
+	if len(req.Aliquots) > maxAliquots {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d aliquots can be created at once", maxAliquots)})
+		return
+	}
+
+	parent, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if parent == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+	if parent.Archived {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sample is archived"})
+		return
+	}
+
+	barcodes, err := loadBarcodeValidator()
+	if err != nil {
+		log.Printf("Error loading barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode rules"})
+		return
+	}
+	locations := newLocationValidator(requestAccess(c).Lab)
+	types := newSampleTypeValidator()
+	now := time.Now().UTC().Format(time.RFC3339)
+	children := make([]Sample, 0, len(req.Aliquots))
+	seen := map[string]bool{barcode: true}
+	for _, spec := range req.Aliquots {
+		if spec.Barcode == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "every aliquot needs a barcode"})
+			return
+		}
+		if seen[spec.Barcode] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("barcode %s is given more than once", spec.Barcode)})
+			return
+		}
+		seen[spec.Barcode] = true
+
+		location, locErr := locations.Validate(spec.Location)
+		if locErr != nil {
+			c.JSON(locErr.StatusCode, gin.H{"error": fmt.Sprintf("%s: %s", spec.Barcode, locErr.Message)})
+			return
+		}
+		childType := spec.Type
+		if childType == "" {
+			childType = parent.Type
+		}
+		if barcodeErr := barcodes.Validate(spec.Barcode, childType); barcodeErr != nil {
+			c.JSON(barcodeErr.StatusCode, gin.H{"error": barcodeErr.Message})
+			return
+		}
+		child := Sample{
+			Barcode:       spec.Barcode,
+			Name:          spec.Name,
+			Type:          spec.Type,
+			Location:      location,
+			ParentBarcode: parent.Barcode,
+			Project:       parent.Project,
+			Lab:           parent.Lab,
+			CreatedAt:     now,
+		}
+		if child.Name == "" {
+			child.Name = parent.Name
+		}
+		if child.Type == "" {
+			child.Type = parent.Type
+		}
+		child.Metadata = mergeMetadata(parent.Metadata, nil)
+		if typeErr := types.Validate(child); typeErr != nil {
+			c.JSON(typeErr.StatusCode, gin.H{"error": fmt.Sprintf("%s: %s", spec.Barcode, typeErr.Message)})
+			return
+		}
+		children = append(children, child)
+	}
+
+	if err := createAliquots(*parent, children, req.AllowPooling, requestActor(c)); err != nil {
+		if sampleErr, ok := err.(*SampleError); ok {
+			c.JSON(sampleErr.StatusCode, gin.H{"error": sampleErr.Message})
+			return
+		}
+		if respondWellConflict(c, err) {
+			return
+		}
+		log.Printf("Error creating aliquots of %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create aliquots"})
+		return
+	}
+
+	publishSampleCreated(children, requestActor(c))
+
+	log.Printf("Created %d aliquot(s) of sample %s", len(children), barcode)
+	c.JSON(http.StatusCreated, AliquotResponse{Parent: *parent, Aliquots: children})
+}
+
+// sampleAncestors follows parent and pool links from the sample one
+// generation at a time, nearest first.
+func sampleAncestors(sample Sample) ([]Sample, error) {
+	ancestors := []Sample{}
+	seen := map[string]bool{sample.Barcode: true}
+	generation := []Sample{sample}
+	for depth := 0; len(generation) > 0 && depth < maxLineageDepth; depth++ {
+		parents := []string{}
+		for _, member := range generation {
+			for _, parent := range member.parents() {
+				if !seen[parent] {
+					seen[parent] = true
+					parents = append(parents, parent)
+				}
+			}
+		}
+		stored, err := getSamples(parents)
+		if err != nil {
+			return nil, err
+		}
+		ancestors = append(ancestors, stored...)
+		generation = stored
+	}
+	return ancestors, nil
+}
+
+// lineageSources returns the samples a lineage starts from: the ancestors
+// with no parents of their own, or the sample itself if it has none.
+func lineageSources(sample Sample, ancestors []Sample) []string {
+	stored := map[string]bool{}
+	for _, ancestor := range ancestors {
+		stored[ancestor.Barcode] = true
+	}
+	sources := []string{}
+	for _, member := range append([]Sample{sample}, ancestors...) {
+		root := true
+		for _, parent := range member.parents() {
+			if stored[parent] {
+				root = false
+			}
+		}
+		if root && (member.Barcode != sample.Barcode || len(ancestors) == 0) {
+			sources = append(sources, member.Barcode)
+		}
+	}
+	if len(sources) == 0 {
+		sources = append(sources, sample.Barcode)
+	}
+	return sources
+}
+
+// visibleLineage drops the branches of a lineage tree below samples the
+// access doesn't allow.
+func visibleLineage(node LineageNode, access SampleAccess) LineageNode {
+	children := []LineageNode{}
+	for _, child := range node.Children {
+		if access.allowsSample(child.Sample) {
+			children = append(children, visibleLineage(child, access))
+		}
+	}
+	node.Children = children
+	return node
+}
+
+// sampleDescendants builds the tree below a sample one generation at a
+// time.
+func sampleDescendants(sample Sample) (LineageNode, error) {
+	root := LineageNode{Sample: sample, Children: []LineageNode{}}
+	generation := []*LineageNode{&root}
+	seen := map[string]bool{sample.Barcode: true}
+	for depth := 0; len(generation) > 0 && depth < maxLineageDepth; depth++ {
+		next := []*LineageNode{}
+		for _, node := range generation {
+			barcodes, err := sampleStore.Children(node.Barcode)
+			if err != nil {
+				return root, err
+			}
+			children, err := getSamples(barcodes)
+			if err != nil {
+				return root, err
+			}
+			for _, child := range children {
+				if seen[child.Barcode] {
+					continue
+				}
+				seen[child.Barcode] = true
+				node.Children = append(node.Children, LineageNode{Sample: child, Children: []LineageNode{}})
+			}
+			for i := range node.Children {
+				next = append(next, &node.Children[i])
+			}
+		}
+		generation = next
+	}
+	return root, nil
+}
+
+// sampleLineageHandler returns a sample's ancestors up to its source
+// sample and the tree of samples derived from it.
+func sampleLineageHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if sample == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+
+	ancestors, err := sampleAncestors(*sample)
+	if err != nil {
+		log.Printf("Error getting ancestors of %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve lineage"})
+		return
+	}
+	tree, err := sampleDescendants(*sample)
+	if err != nil {
+		log.Printf("Error getting descendants of %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve lineage"})
+		return
+	}
+
+	// Keys only see the relatives in their own projects.
+	ancestors = visibleSamples(c, ancestors)
+	tree = visibleLineage(tree, requestAccess(c))
+
+	sources := lineageSources(*sample, ancestors)
+	c.JSON(http.StatusOK, LineageResponse{
+		Barcode:   sample.Barcode,
+		Source:    sources[0],
+		Sources:   sources,
+		Ancestors: ancestors,
+		Tree:      tree,
+	})
+}
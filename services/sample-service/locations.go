@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// In Redis, the history entries that moved a sample onto or off a plate
+// are also kept in plates:movements:<plate>, scored by time in
+// milliseconds, so a plate's movements can be read without scanning every
+// sample's history.
+const PLATE_MOVEMENTS_KEY_PREFIX = "plates:movements:"
+
+// Directions of a plate movement.
+const (
+	MovementIn     = "in"
+	MovementOut    = "out"
+	MovementWithin = "within"
+)
+
+// LocationStay is a period a sample spent at one location. ArrivedAt is
+// empty if the sample was there before its history was recorded, and
+// LeftAt is empty for the current location.
+type LocationStay struct {
+	Location   Location `json:"location"`
+	ArrivedAt  string   `json:"arrived_at,omitempty"`
+	LeftAt     string   `json:"left_at,omitempty"`
+	Current    bool     `json:"current"`
+	Action     string   `json:"action,omitempty"`
+	WorkflowID string   `json:"workflow_id,omitempty"`
+	Actor      string   `json:"actor,omitempty"`
+	TransferID int64    `json:"transfer_id,omitempty"`
+	Note       string   `json:"note,omitempty"`
+}
+
+type SampleLocationsResponse struct {
+	Barcode   string         `json:"barcode"`
+	Count     int            `json:"count"`
+	Locations []LocationStay `json:"locations"`
+}
+
+// PlateMovement is a sample moved onto, off or within a plate.
+type PlateMovement struct {
+	Barcode    string   `json:"barcode"`
+	Direction  string   `json:"direction"`
+	From       Location `json:"from"`
+	To         Location `json:"to"`
+	At         string   `json:"at"`
+	Action     string   `json:"action"`
+	WorkflowID string   `json:"workflow_id,omitempty"`
+	Actor      string   `json:"actor,omitempty"`
+	TransferID int64    `json:"transfer_id,omitempty"`
+	Note       string   `json:"note,omitempty"`
+}
+
+type PlateMovementsResponse struct {
+	Plate       string          `json:"plate"`
+	From        string          `json:"from,omitempty"`
+	To          string          `json:"to,omitempty"`
+	Count       int             `json:"count"`
+	MovedIn     int             `json:"moved_in"`
+	MovedOut    int             `json:"moved_out"`
+	MovedWithin int             `json:"moved_within"`
+	Movements   []PlateMovement `json:"movements"`
+}
+
+func plateMovementsKey(plate string) string {
+	return PLATE_MOVEMENTS_KEY_PREFIX + plate
+}
+
+// movedPlates returns the plates a write moves a sample onto or off;
+// previous is nil for a new sample.
+func movedPlates(previous *Sample, sample Sample) []string {
+	var from Location
+	if previous != nil {
+		from = previous.Location
+	}
+	if from == sample.Location {
+		return nil
+	}
+	plates := []string{}
+	if from.Plate != "" {
+		plates = append(plates, from.Plate)
+	}
+	if sample.Location.Plate != "" && sample.Location.Plate != from.Plate {
+		plates = append(plates, sample.Location.Plate)
+	}
+	return plates
+}
+
+// locationChange returns the locations a history entry moved a sample
+// between, if it moved it.
+func locationChange(entry SampleHistoryEntry) (from, to Location, moved bool) {
+	change, ok := entry.Changes["location"]
+	if !ok {
+		return Location{}, Location{}, false
+	}
+	return changedLocation(change.From), changedLocation(change.To), true
+}
+
+// changedLocation decodes a location recorded in a history entry, which is
+// a Location when the entry was just made and a JSON object once read
+// back.
+func changedLocation(value interface{}) Location {
+	if location, ok := value.(Location); ok {
+		return location
+	}
+	var location Location
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = json.Unmarshal(data, &location)
+	}
+	if err != nil {
+		log.Printf("Invalid location in history: %v", err)
+	}
+	return location
+}
+
+// sampleLocations lists the locations a sample has occupied, oldest first,
+// from its history entries, which are newest first.
+func sampleLocations(sample Sample, entries []SampleHistoryEntry) []LocationStay {
+	stays := []LocationStay{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		from, to, moved := locationChange(entry)
+		if !moved {
+			continue
+		}
+		if len(stays) == 0 && from != (Location{}) {
+			stays = append(stays, LocationStay{Location: from})
+		}
+		if len(stays) > 0 {
+			stays[len(stays)-1].LeftAt = entry.At
+		}
+		stays = append(stays, LocationStay{
+			Location:   to,
+			ArrivedAt:  entry.At,
+			Action:     entry.Action,
+			WorkflowID: entry.WorkflowID,
+			Actor:      entry.Actor,
+			TransferID: entry.TransferID,
+			Note:       entry.Note,
+		})
+	}
+	// Samples that haven't moved since their history began are still
+	// where they were created.
+	if len(stays) == 0 && sample.Location != (Location{}) {
+		stays = append(stays, LocationStay{Location: sample.Location, ArrivedAt: sample.CreatedAt})
+	}
+	if len(stays) > 0 {
+		stays[len(stays)-1].Current = true
+	}
+	return stays
+}
+
+// plateMovement describes a history entry from the point of view of a
+// plate it moved a sample onto or off.
+func plateMovement(plate string, entry SampleHistoryEntry) (PlateMovement, bool) {
+	from, to, moved := locationChange(entry)
+	if !moved || (from.Plate != plate && to.Plate != plate) {
+		return PlateMovement{}, false
+	}
+	direction := MovementWithin
+	if from.Plate != plate {
+		direction = MovementIn
+	} else if to.Plate != plate {
+		direction = MovementOut
+	}
+	return PlateMovement{
+		Barcode:    entry.Barcode,
+		Direction:  direction,
+		From:       from,
+		To:         to,
+		At:         entry.At,
+		Action:     entry.Action,
+		WorkflowID: entry.WorkflowID,
+		Actor:      entry.Actor,
+		TransferID: entry.TransferID,
+		Note:       entry.Note,
+	}, true
+}
+
+// sampleLocationsHandler returns every location a sample has occupied,
+// oldest first, with who moved it there and when.
+func sampleLocationsHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if sample == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+
+	entries, err := sampleStore.History(barcode, time.Time{}, time.Time{})
+	if err != nil {
+		log.Printf("Error reading history for sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample locations"})
+		return
+	}
+	locations := sampleLocations(*sample, entries)
+	c.JSON(http.StatusOK, SampleLocationsResponse{Barcode: barcode, Count: len(locations), Locations: locations})
+}
+
+// plateMovementsHandler reports the samples moved onto, off and within a
+// plate between from and to (RFC 3339, both optional), oldest first.
+func plateMovementsHandler(c *gin.Context) {
+	plateID := c.Param("plate_id")
+
+	var from, to time.Time
+	if value := c.Query("from"); value != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must not be before from"})
+		return
+	}
+
+	plate, err := getPlate(plateID)
+	if err != nil {
+		log.Printf("Error getting plate %s: %v", plateID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve plate"})
+		return
+	}
+	if plate == nil || plate.Lab != requestAccess(c).Lab {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plate not found"})
+		return
+	}
+
+	entries, err := sampleStore.PlateMovements(plateID, from, to)
+	if err != nil {
+		log.Printf("Error reading movements of plate %s: %v", plateID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve plate movements"})
+		return
+	}
+
+	barcodes := make([]string, len(entries))
+	for i, entry := range entries {
+		barcodes[i] = entry.Barcode
+	}
+	visible, err := visibleBarcodes(c, barcodes)
+	if err != nil {
+		log.Printf("Error reading movements of plate %s: %v", plateID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve plate movements"})
+		return
+	}
+
+	response := PlateMovementsResponse{Plate: plateID, Movements: []PlateMovement{}}
+	if !from.IsZero() {
+		response.From = from.UTC().Format(time.RFC3339)
+	}
+	if !to.IsZero() {
+		response.To = to.UTC().Format(time.RFC3339)
+	}
+	for _, entry := range entries {
+		movement, ok := plateMovement(plateID, entry)
+		if !ok || (visible != nil && !visible[entry.Barcode]) {
+			continue
+		}
+		switch movement.Direction {
+		case MovementIn:
+			response.MovedIn++
+		case MovementOut:
+			response.MovedOut++
+		default:
+			response.MovedWithin++
+		}
+		response.Movements = append(response.Movements, movement)
+	}
+	response.Count = len(response.Movements)
+	c.JSON(http.StatusOK, response)
+}
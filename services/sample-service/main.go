@@ -2,88 +2,144 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"sort"
 	"time"
 
+	"platform"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/redis/go-redis/v9"
 )
 
 var (
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 	ctx         = context.Background()
 )
 
+// SAMPLES_KEY held every sample in one JSON document before samples moved
+// to per-sample keys; it is only read to migrate old data.
 const SAMPLES_KEY = "samples"
 
 type Sample struct {
-	Barcode   string   `json:"barcode"`
-	Name      string   `json:"name"`
-	Type      string   `json:"type"`
-	Location  Location `json:"location"`
-	CreatedAt string   `json:"created_at"`
-	UpdatedAt string   `json:"updated_at,omitempty"`
+	Barcode    string   `json:"barcode"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Location   Location `json:"location"`
+	CreatedAt  string   `json:"created_at"`
+	UpdatedAt  string   `json:"updated_at,omitempty"`
+	Archived   bool     `json:"archived,omitempty"`
+	ArchivedAt string   `json:"archived_at,omitempty"`
+	// DeletedAt and DeletedBy are set while the sample is in the trash.
+	DeletedAt string `json:"deleted_at,omitempty"`
+	DeletedBy string `json:"deleted_by,omitempty"`
+	// ParentBarcode links an aliquot to the sample it was taken from.
+	ParentBarcode string `json:"parent_barcode,omitempty"`
+	// VolumeUL is the volume left in microlitres and Concentration is in
+	// ng/uL; nil when not tracked.
+	VolumeUL      *float64 `json:"volume_ul,omitempty"`
+	Concentration *float64 `json:"concentration,omitempty"`
+	// Metadata holds custom fields such as patient ID or project code.
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	ExpiresAt string            `json:"expires_at,omitempty"`
+	// Expired is computed when the sample is read and never stored.
+	Expired bool `json:"expired,omitempty"`
+	// Placeholder marks a sample created for a generated barcode before
+	// its tube was registered.
+	Placeholder bool `json:"placeholder,omitempty"`
+	// MergedInto is set on a duplicate archived by merging it into another
+	// sample, and MergedFrom lists the duplicates merged into this one.
+	MergedInto string   `json:"merged_into,omitempty"`
+	MergedFrom []string `json:"merged_from,omitempty"`
+	// PooledFrom lists the samples combined to make a pooled sample, with
+	// the share of the pool each makes up.
+	PooledFrom []PoolSource `json:"pooled_from,omitempty"`
+	// Project owns the sample; API keys only see their projects' samples.
+	Project string `json:"project,omitempty"`
+	// CreatedBy and UpdatedBy are the users who created the sample and
+	// last changed it, where known.
+	CreatedBy string `json:"created_by,omitempty"`
+	UpdatedBy string `json:"updated_by,omitempty"`
+	// Lab is the lab the sample belongs to, or empty for the default lab.
+	Lab string `json:"lab,omitempty"`
+	// Version counts the writes to the sample, for optimistic concurrency.
+	Version int64 `json:"version"`
+	// SchemaVersion is the schema version the sample is stored at; older
+	// ones are upgraded as they are read.
+	SchemaVersion int `json:"schema_version"`
 }
 
+// A sample is either in a plate well or at a position in a storage
+// location, such as a box.
 type Location struct {
-	Plate string `json:"plate"`
-	Well  string `json:"well"`
+	Plate    string `json:"plate"`
+	Well     string `json:"well"`
+	Storage  string `json:"storage,omitempty"`
+	Position string `json:"position,omitempty"`
 }
 
+// AllowPooling on create and location updates permits placing a sample in
+// a well that already holds another active sample.
 type CreateSampleRequest struct {
-	Barcode  string   `json:"barcode" binding:"required"`
-	Name     string   `json:"name"`
-	Type     string   `json:"type"`
-	Location Location `json:"location"`
+	Barcode       string            `json:"barcode" binding:"required"`
+	Name          string            `json:"name"`
+	Type          string            `json:"type"`
+	Location      Location          `json:"location"`
+	VolumeUL      *float64          `json:"volume_ul"`
+	Concentration *float64          `json:"concentration"`
+	Metadata      map[string]string `json:"metadata"`
+	ExpiresAt     string            `json:"expires_at"`
+	Project       string            `json:"project"`
+	AllowPooling  bool              `json:"allow_pooling"`
 }
 
 type UpdateLocationRequest struct {
-	Location Location `json:"location" binding:"required"`
+	Location     Location `json:"location" binding:"required"`
+	AllowPooling bool     `json:"allow_pooling"`
+	Version      *int64   `json:"version"`
 }
 
-type ValidateRequest struct {
-	Barcodes []string `json:"barcodes" binding:"required"`
+// SampleError is a failed sample operation with the HTTP status to report.
+type SampleError struct {
+	StatusCode int
+	Message    string
 }
 
-type ValidationResult struct {
-	Barcode string `json:"barcode"`
-	Exists  bool   `json:"exists"`
+func (e *SampleError) Error() string {
+	return e.Message
 }
 
-func getAllSamples() (map[string]Sample, error) {
-	samplesData, err := redisClient.Get(ctx, SAMPLES_KEY).Result()
-	if err == redis.Nil {
-		return make(map[string]Sample), nil
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	var samples map[string]Sample
-	if err := json.Unmarshal([]byte(samplesData), &samples); err != nil {
-		return nil, err
-	}
-
-	return samples, nil
+// ValidateRequest checks barcodes, optionally returning the sample records.
+// With a workflow ID, samples reserved by that workflow count as available.
+type ValidateRequest struct {
+	Barcodes       []string `json:"barcodes" binding:"required"`
+	IncludeSamples bool     `json:"include_samples"`
+	WorkflowID     string   `json:"workflow_id"`
 }
 
-func saveSamples(samples map[string]Sample) error {
-	data, err := json.Marshal(samples)
-	if err != nil {
-		return err
-	}
-
-	return redisClient.Set(ctx, SAMPLES_KEY, data, 0).Err()
+// ValidationResult flags why a sample can't be used; Status is the most
+// serious reason, or "available".
+type ValidationResult struct {
+	Barcode     string  `json:"barcode"`
+	Exists      bool    `json:"exists"`
+	Archived    bool    `json:"archived,omitempty"`
+	Placeholder bool    `json:"placeholder,omitempty"`
+	Consumed    bool    `json:"consumed,omitempty"`
+	Expired     bool    `json:"expired,omitempty"`
+	Reserved    bool    `json:"reserved,omitempty"`
+	ReservedBy  string  `json:"reserved_by,omitempty"`
+	Available   bool    `json:"available"`
+	Status      string  `json:"status"`
+	Sample      *Sample `json:"sample,omitempty"`
 }
 
 func initializeSamples() error {
-	samples := map[string]Sample{
-		"SAMPLE001": {
+	samples := []Sample{
+		{
 			Barcode: "SAMPLE001",
 			Name:    "Blood Sample A",
 			Type:    "blood",
@@ -93,7 +149,7 @@ func initializeSamples() error {
 			},
 			CreatedAt: "2025-01-15T10:00:00Z",
 		},
-		"SAMPLE002": {
+		{
 			Barcode: "SAMPLE002",
 			Name:    "Tissue Sample B",
 			Type:    "tissue",
@@ -103,7 +159,7 @@ func initializeSamples() error {
 			},
 			CreatedAt: "2025-01-15T10:05:00Z",
 		},
-		"SAMPLE003": {
+		{
 			Barcode: "SAMPLE003",
 			Name:    "Saliva Sample C",
 			Type:    "saliva",
@@ -115,54 +171,45 @@ func initializeSamples() error {
 		},
 	}
 
-	return saveSamples(samples)
+	return sampleStore.Update(func(tx SampleTx) error {
+		for _, sample := range samples {
+			sample.nextVersion(nil)
+			tx.Put(SampleWrite{Sample: sample, Audit: SampleAudit{Action: SampleActionCreated}})
+		}
+		return nil
+	})
 }
 
+// healthHandler reports the service alive, and degraded while Redis is
+// down; /ready says whether it can take requests.
 func healthHandler(c *gin.Context) {
+	status := "healthy"
+	if !platform.RedisUp() {
+		status = "degraded"
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"status":  "healthy",
+		"status":  status,
 		"service": "sample-service",
+		"redis":   platform.RedisStatus(),
 	})
 }
 
-func listSamplesHandler(c *gin.Context) {
-	samples, err := getAllSamples()
-	if err != nil {
-		log.Printf("Error getting samples: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
-		return
-	}
-
-	// Convert map to array with consistent ordering
-	sampleList := make([]Sample, 0, len(samples))
-	for _, sample := range samples {
-		sampleList = append(sampleList, sample)
-	}
-
-	// Sort by barcode for consistent ordering
-	sort.Slice(sampleList, func(i, j int) bool {
-		return sampleList[i].Barcode < sampleList[j].Barcode
-	})
-
-	c.JSON(http.StatusOK, sampleList)
-}
-
 func getSampleHandler(c *gin.Context) {
 	barcode := c.Param("barcode")
 
-	samples, err := getAllSamples()
+	stored, err := getSample(barcode)
 	if err != nil {
-		log.Printf("Error getting samples: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
 		return
 	}
-
-	sample, ok := samples[barcode]
-	if !ok {
+	if stored == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
 		return
 	}
+	sample := *stored
 
+	c.Header("ETag", sampleETag(sample))
 	c.JSON(http.StatusOK, sample)
 }
 
@@ -174,36 +221,106 @@ func createSampleHandler(c *gin.Context) {
 		return
 	}
 
-	samples, err := getAllSamples()
+	if err := validateMeasurements(req.VolumeUL, req.Concentration); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateMetadata(req.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Metadata) == 0 {
+		req.Metadata = nil
+	}
+	if req.ExpiresAt != "" {
+		expiresAt, err := parseExpiry(req.ExpiresAt)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.ExpiresAt = expiresAt
+	}
+	project, err := requestAccess(c).defaultProject(req.Project)
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	barcodes, err := loadBarcodeValidator()
 	if err != nil {
-		log.Printf("Error getting samples: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		log.Printf("Error loading barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode rules"})
+		return
+	}
+	if barcodeErr := barcodes.Validate(req.Barcode, req.Type); barcodeErr != nil {
+		c.JSON(barcodeErr.StatusCode, gin.H{"error": barcodeErr.Message})
 		return
 	}
 
-	if _, exists := samples[req.Barcode]; exists {
-		log.Printf("Sample already exists: %s", req.Barcode)
-		c.JSON(http.StatusConflict, gin.H{"error": "Sample already exists"})
+	location, locErr := newLocationValidator(requestAccess(c).Lab).Validate(req.Location)
+	if locErr != nil {
+		c.JSON(locErr.StatusCode, gin.H{"error": locErr.Message})
 		return
 	}
 
 	log.Printf("Creating sample: %s", req.Barcode)
 
 	sample := Sample{
-		Barcode:   req.Barcode,
-		Name:      req.Name,
-		Type:      req.Type,
-		Location:  req.Location,
-		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Barcode:       req.Barcode,
+		Name:          req.Name,
+		Type:          req.Type,
+		Location:      location,
+		VolumeUL:      req.VolumeUL,
+		Concentration: req.Concentration,
+		Metadata:      req.Metadata,
+		ExpiresAt:     req.ExpiresAt,
+		Project:       project,
+		Lab:           requestAccess(c).Lab,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+	}
+	sample.refreshExpired(time.Now())
+
+	types := newSampleTypeValidator()
+	if typeErr := types.Validate(sample); typeErr != nil {
+		c.JSON(typeErr.StatusCode, gin.H{"error": typeErr.Message})
+		return
+	}
+	types.ApplyDefaults(&sample)
+
+	stored, err := getSample(req.Barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", req.Barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
 	}
 
-	samples[req.Barcode] = sample
-	if err := saveSamples(samples); err != nil {
-		log.Printf("Error saving samples: %v", err)
+	// Registering a tube whose barcode was generated replaces the
+	// placeholder.
+	audit := SampleAudit{Action: SampleActionCreated, Actor: requestActor(c)}
+	if stored != nil && stored.Placeholder && requestAccess(c).allowsSample(*stored) {
+		sample.CreatedAt = stored.CreatedAt
+		sample.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		audit.Note = "registered placeholder"
+		err = updateSample(&sample, *stored, req.AllowPooling, audit)
+	} else {
+		err = createSample(&sample, req.AllowPooling, audit)
+	}
+	if err != nil {
+		if err == errSampleExists {
+			log.Printf("Sample already exists: %s", req.Barcode)
+			c.JSON(http.StatusConflict, gin.H{"error": "Sample already exists"})
+			return
+		}
+		if respondWellConflict(c, err) || respondVersionConflict(c, err) {
+			return
+		}
+		log.Printf("Error saving sample %s: %v", req.Barcode, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sample"})
 		return
 	}
 
+	publishSampleCreated([]Sample{sample}, audit.Actor)
+
 	log.Printf("Sample %s created successfully", req.Barcode)
 	c.JSON(http.StatusCreated, sample)
 }
@@ -211,38 +328,138 @@ func createSampleHandler(c *gin.Context) {
 func updateSampleLocationHandler(c *gin.Context) {
 	barcode := c.Param("barcode")
 
-	samples, err := getAllSamples()
+	stored, err := getSample(barcode)
 	if err != nil {
-		log.Printf("Error getting samples: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
 		return
 	}
-
-	sample, ok := samples[barcode]
-	if !ok {
+	if stored == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
 		return
 	}
+	sample := *stored
+
+	if sample.Archived {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sample is archived"})
+		return
+	}
 
 	var req UpdateLocationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "location is required"})
 		return
 	}
+	if !checkSampleVersion(c, *stored, req.Version) {
+		return
+	}
 
-	sample.Location = req.Location
+	location, locErr := newLocationValidator(requestAccess(c).Lab).Validate(req.Location)
+	if locErr != nil {
+		c.JSON(locErr.StatusCode, gin.H{"error": locErr.Message})
+		return
+	}
+
+	sample.Location = location
 	sample.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	samples[barcode] = sample
 
-	if err := saveSamples(samples); err != nil {
-		log.Printf("Error saving samples: %v", err)
+	audit := SampleAudit{Action: SampleActionLocationChanged, Actor: requestActor(c)}
+	if err := updateSample(&sample, *stored, req.AllowPooling, audit); err != nil {
+		if respondWellConflict(c, err) || respondVersionConflict(c, err) {
+			return
+		}
+		log.Printf("Error saving sample %s: %v", barcode, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update sample"})
 		return
 	}
+	publishSampleMoved(sample, stored.Location, audit.Actor)
+
+	c.Header("ETag", sampleETag(sample))
+	c.JSON(http.StatusOK, sample)
+}
+
+// archiveSampleHandler archives a sample. Archived samples stay
+// retrievable by barcode for compliance but drop out of default listings;
+// deleting a sample moves it to the trash instead.
+func archiveSampleHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	stored, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if stored == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+	sample := *stored
+	if sample.Archived {
+		c.JSON(http.StatusOK, sample)
+		return
+	}
+	if !checkSampleVersion(c, sample, nil) {
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	sample.Archived = true
+	sample.ArchivedAt = now
+	sample.UpdatedAt = now
+
+	audit := SampleAudit{Action: SampleActionArchived, Actor: requestActor(c)}
+	if err := updateSample(&sample, *stored, false, audit); err != nil {
+		if respondVersionConflict(c, err) {
+			return
+		}
+		log.Printf("Error saving sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive sample"})
+		return
+	}
 
+	log.Printf("Sample %s archived", barcode)
 	c.JSON(http.StatusOK, sample)
 }
 
+// respondWellConflict reports a WellConflictError as 409 with the sample
+// already in the well or storage position.
+func respondWellConflict(c *gin.Context, err error) bool {
+	var conflict *WellConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	log.Printf("Rejected placement: %v", conflict)
+	body := gin.H{
+		"error":              conflict.Error(),
+		"conflicting_sample": conflict.Barcode,
+	}
+	if conflict.Location.Storage != "" {
+		body["storage"] = conflict.Location.Storage
+		body["position"] = conflict.Location.Position
+	} else {
+		body["plate"] = conflict.Location.Plate
+		body["well"] = conflict.Location.Well
+	}
+	c.JSON(http.StatusConflict, body)
+	return true
+}
+
+// respondVersionConflict reports a VersionConflictError as 409 with the
+// current version.
+func respondVersionConflict(c *gin.Context, err error) bool {
+	var conflict *VersionConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+	log.Printf("Rejected update: %v", conflict)
+	c.JSON(http.StatusConflict, gin.H{
+		"error":           conflict.Error(),
+		"current_version": conflict.Current,
+	})
+	return true
+}
+
 func validateSamplesHandler(c *gin.Context) {
 	var req ValidateRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -251,85 +468,129 @@ func validateSamplesHandler(c *gin.Context) {
 		return
 	}
 
+	if len(req.Barcodes) > maxReservationBarcodes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d samples can be validated at once", maxReservationBarcodes)})
+		return
+	}
+
+	if !requireSamplesAccess(c, req.Barcodes) {
+		return
+	}
+
 	log.Printf("Validating %d sample(s)", len(req.Barcodes))
 
-	samples, err := getAllSamples()
+	results, err := checkAvailability(redisClient, req.Barcodes, req.WorkflowID, req.IncludeSamples)
 	if err != nil {
 		log.Printf("Error getting samples: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
 		return
 	}
-
-	results := make([]ValidationResult, len(req.Barcodes))
-	for i, barcode := range req.Barcodes {
-		_, exists := samples[barcode]
-		results[i] = ValidationResult{
-			Barcode: barcode,
-			Exists:  exists,
-		}
-		if !exists {
-			log.Printf("Sample not found: %s", barcode)
+	for _, result := range results {
+		if !result.Exists {
+			log.Printf("Sample not found: %s", result.Barcode)
 		}
 	}
 
 	c.JSON(http.StatusOK, results)
 }
 
-func main() {
-	// Configure logging
-	log.SetOutput(os.Stdout)
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-
-	// Connect to Redis
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379"
-	}
-
-	opt, err := redis.ParseURL(redisURL)
+// prepareSamples opens the sample store, seeds and migrates the samples,
+// and starts the jobs that need them. It runs once Redis is up.
+func prepareSamples() {
+	// Select where samples are persisted
+	var err error
+	sampleStore, err = newSampleStore()
 	if err != nil {
-		log.Fatalf("Failed to parse Redis URL: %v", err)
-	}
-
-	redisClient = redis.NewClient(opt)
-
-	// Test Redis connection
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatalf("Failed to open sample store: %v", err)
 	}
 
-	log.Println("Connected to Redis successfully")
-
 	// Initialize sample data if not exists
-	existingSamples, err := getAllSamples()
+	existingSamples, err := sampleStore.Count(SampleFilter{Status: sampleStatusAny})
 	if err != nil {
 		log.Fatalf("Failed to check existing samples: %v", err)
 	}
-	if len(existingSamples) == 0 {
+	if existingSamples == 0 {
 		if err := initializeSamples(); err != nil {
 			log.Fatalf("Failed to initialize samples: %v", err)
 		}
 		log.Println("Initialized sample data")
 	}
 
+	// Register plates referenced by samples saved before plates existed
+	if err := registerSamplePlates(); err != nil {
+		log.Fatalf("Failed to register plates: %v", err)
+	}
+
+	// Register types used by samples saved before the type registry existed
+	if err := registerSampleTypes(); err != nil {
+		log.Fatalf("Failed to register sample types: %v", err)
+	}
+
+	// Publish expiry events in the background
+	startExpiryMonitor()
+
+	// Archive consumed samples and purge deleted ones in the background
+	startRetentionJanitor()
+	startTrashJanitor()
+}
+
+func main() {
+	// Configure logging
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	// Connect to Redis, retrying while it starts
+	redisClient = platform.NewRedisClient()
+	configureReadCache()
+
+	// Prepare the samples once Redis is up
+	platform.WaitForRedis(redisClient, prepareSamples)
+	go listenForCacheInvalidations()
+	defer func() {
+		if sampleStore != nil {
+			sampleStore.Close()
+		}
+	}()
+
+	loadStorageHierarchy()
+
+	// Attachments need object storage
+	configureAttachmentStorage()
+
+	// API keys limit automation to its projects' samples
+	configureAccess()
+
+	configureAuditLog()
+	configureRequestLimits()
+	platform.ConfigureCompression()
+	platform.ConfigureFeatureFlags()
+
 	// Setup Gin
-	gin.SetMode(gin.ReleaseMode)
+	platform.ConfigureDebug(redisClient)
 	router := gin.Default()
+	platform.RegisterDebug(router)
 
 	// CORS configuration
-	router.Use(cors.New(cors.Config{
-		AllowAllOrigins: true,
-		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:    []string{"Origin", "Content-Type", "Accept"},
-	}))
+	corsPolicy, err := platform.CORSConfig(cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "If-None-Match", "Authorization", API_KEY_HEADER, API_VERSION_HEADER},
+		ExposeHeaders: []string{API_VERSION_HEADER, "Deprecation", "Sunset", "Link", "ETag"},
+	})
+	if err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	router.Use(cors.New(corsPolicy))
+	router.Use(platform.CompressResponses())
+	router.Use(limitRequestBodies())
+	router.Use(auditLog())
+	router.Use(authenticate(), authorizeSample())
 
 	// Routes
 	router.GET("/health", healthHandler)
-	router.GET("/samples", listSamplesHandler)
-	router.GET("/samples/:barcode", getSampleHandler)
-	router.POST("/samples", createSampleHandler)
-	router.PUT("/samples/:barcode/location", updateSampleLocationHandler)
-	router.POST("/samples/validate", validateSamplesHandler)
+	router.GET("/ready", platform.ReadyHandler)
+	registerRoutes(router.Group("/v1", platform.RequireRedis(), apiVersion()))
+	// The unversioned paths keep working until they are retired.
+	registerRoutes(router.Group("", platform.RequireRedis(), apiVersion(), deprecatedPath()))
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -338,7 +599,90 @@ func main() {
 	}
 
 	log.Printf("Sample service starting on port %s", port)
-	if err := router.Run("0.0.0.0:" + port); err != nil {
+	if err := serve(router, "0.0.0.0:"+port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// registerRoutes adds the API's routes to a group, which is mounted both at
+// /v1 and, for older clients, at the root.
+func registerRoutes(api *gin.RouterGroup) {
+	api.GET("/samples", platform.ConditionalGET(listSamplesHandler))
+	api.GET("/samples/export", exportSamplesHandler)
+	api.GET("/samples/expiring", expiringSamplesHandler)
+	api.GET("/samples/duplicates", duplicateSamplesHandler)
+	api.GET("/samples/audit-log", auditLogHandler)
+	api.GET("/samples/retention", retentionReportHandler)
+	api.POST("/samples/migrate", migrateSamplesHandler)
+	api.GET("/samples/snapshot", getSnapshotHandler)
+	api.POST("/samples/snapshot", restoreSnapshotHandler)
+	api.POST("/samples/merge", mergeSamplesHandler)
+	api.POST("/samples/pool", poolSamplesHandler)
+	api.GET("/samples/:barcode", getSampleHandler)
+	api.POST("/samples", createSampleHandler)
+	api.PUT("/samples/:barcode/location", updateSampleLocationHandler)
+	api.PATCH("/samples/:barcode", updateSampleHandler)
+	api.DELETE("/samples/:barcode", deleteSampleHandler)
+	api.POST("/samples/:barcode/archive", archiveSampleHandler)
+	api.GET("/samples/trash", listDeletedSamplesHandler)
+	api.POST("/samples/trash/:barcode/restore", restoreDeletedSampleHandler)
+	api.POST("/samples/:barcode/aliquot", aliquotSampleHandler)
+	api.POST("/samples/:barcode/consume", consumeSampleHandler)
+	api.GET("/samples/:barcode/history", sampleHistoryHandler)
+	api.GET("/samples/:barcode/locations", sampleLocationsHandler)
+	api.GET("/samples/:barcode/results", listSampleResultsHandler)
+	api.POST("/samples/:barcode/results", recordSampleResultHandler)
+	api.POST("/samples/consume", bulkConsumeHandler)
+	api.GET("/samples/:barcode/lineage", sampleLineageHandler)
+	api.GET("/samples/:barcode/label", sampleLabelHandler)
+	api.GET("/samples/:barcode/attachments", listAttachmentsHandler)
+	api.POST("/samples/:barcode/attachments", uploadAttachmentHandler)
+	api.GET("/samples/:barcode/attachments/:attachment_id", getAttachmentHandler)
+	api.GET("/samples/:barcode/attachments/:attachment_id/download", downloadAttachmentHandler)
+	api.POST("/samples/validate", validateSamplesHandler)
+	api.POST("/samples/reservations", reserveSamplesHandler)
+	api.GET("/samples/reservations/:workflow_id", getReservationsHandler)
+	api.DELETE("/samples/reservations/:workflow_id", releaseSamplesHandler)
+	api.GET("/samples/barcodes/rules", getBarcodeRulesHandler)
+	api.PUT("/samples/barcodes/rules", setBarcodeRulesHandler)
+	api.POST("/samples/barcodes/validate-format", validateBarcodeFormatHandler)
+	api.POST("/samples/barcodes/generate", generateBarcodesHandler)
+	api.GET("/samples/barcodes/sequences", listBarcodeSequencesHandler)
+	api.GET("/samples/labels/template", getLabelTemplateHandler)
+	api.PUT("/samples/labels/template", setLabelTemplateHandler)
+	api.POST("/samples/import", importSamplesHandler)
+	api.POST("/samples/transfer", transferSamplesHandler)
+	api.GET("/samples/transfers", listTransfersHandler)
+	api.GET("/samples/transfers/:transfer_id", getTransferHandler)
+	api.GET("/plates", listPlatesHandler)
+	api.POST("/plates", createPlateHandler)
+	api.GET("/plates/:plate_id", getPlateHandler)
+	api.GET("/plates/:plate_id/wells", plateWellsHandler)
+	api.GET("/plates/:plate_id/map", plateMapHandler)
+	api.GET("/plates/:plate_id/movements", plateMovementsHandler)
+	api.GET("/storage-locations", listStorageLocationsHandler)
+	api.POST("/storage-locations", createStorageLocationHandler)
+	api.GET("/storage-locations/:storage_id", getStorageLocationHandler)
+	api.GET("/webhooks", listWebhooksHandler)
+	api.POST("/webhooks", createWebhookHandler)
+	api.GET("/webhooks/:webhook_id", getWebhookHandler)
+	api.DELETE("/webhooks/:webhook_id", deleteWebhookHandler)
+	api.GET("/api-keys", listAPIKeysHandler)
+	api.POST("/api-keys", createAPIKeyHandler)
+	api.DELETE("/api-keys/:key_id", deleteAPIKeyHandler)
+	graphql := graphqlHandler()
+	api.GET("/graphql", graphql)
+	api.POST("/graphql", graphql)
+	api.GET("/sample-types", listSampleTypesHandler)
+	api.POST("/sample-types", createSampleTypeHandler)
+	api.GET("/sample-types/:name", getSampleTypeHandler)
+	api.PUT("/sample-types/:name", updateSampleTypeHandler)
+	api.DELETE("/sample-types/:name", deleteSampleTypeHandler)
+
+	storage := api.Group("/admin/storage", serviceAdminOnly)
+	storage.GET("/keys", listRedisKeysHandler)
+	storage.GET("/keys/*key", getRedisKeyHandler)
+	storage.PUT("/keys/*key", putRedisKeyHandler)
+	storage.DELETE("/keys/*key", deleteRedisKeyHandler)
+	storage.GET("/audit", storageAuditHandler)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Reasons samples are reported as duplicates.
+const (
+	DuplicateReasonBarcode    = "barcode"
+	DuplicateReasonAttributes = "attributes"
+)
+
+// DuplicateGroup is a set of active samples that look like the same
+// sample: barcodes that differ only by case or whitespace, or, for samples
+// that aren't aliquots, the same name, type and metadata.
+type DuplicateGroup struct {
+	Reason  string   `json:"reason"`
+	Key     string   `json:"key"`
+	Samples []Sample `json:"samples"`
+}
+
+type DuplicatesResponse struct {
+	Count  int              `json:"count"`
+	Groups []DuplicateGroup `json:"groups"`
+}
+
+// MergeRequest merges the sources into the target.
+type MergeRequest struct {
+	Target  string   `json:"target" binding:"required"`
+	Sources []string `json:"sources" binding:"required"`
+	Note    string   `json:"note"`
+}
+
+// MergeConflict is a field the sources disagree with the target on; the
+// target's value is kept.
+type MergeConflict struct {
+	Source string      `json:"source"`
+	Field  string      `json:"field"`
+	Kept   interface{} `json:"kept"`
+	Lost   interface{} `json:"dropped"`
+}
+
+type MergeResponse struct {
+	Sample     Sample          `json:"sample"`
+	Merged     []string        `json:"merged"`
+	Reparented []string        `json:"reparented"`
+	Conflicts  []MergeConflict `json:"conflicts"`
+}
+
+// normalizedBarcode folds the differences typical of re-keyed barcodes.
+func normalizedBarcode(barcode string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(barcode), ""))
+}
+
+// attributesKey identifies samples with the same name, type and metadata,
+// or is empty for samples without a name.
+func attributesKey(sample Sample) string {
+	name := strings.ToLower(strings.Join(strings.Fields(sample.Name), " "))
+	if name == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(sample.Metadata))
+	for key := range sample.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := []string{name, strings.ToLower(strings.TrimSpace(sample.Type))}
+	for _, key := range keys {
+		parts = append(parts, key+"="+sample.Metadata[key])
+	}
+	return strings.Join(parts, "|")
+}
+
+// findDuplicates groups the active samples by each heuristic, keeping the
+// groups with more than one sample.
+func findDuplicates(reason string) ([]DuplicateGroup, error) {
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Status: SampleStatusActive})
+	if err != nil {
+		return nil, err
+	}
+
+	byBarcode := map[string][]Sample{}
+	byAttributes := map[string][]Sample{}
+	err = eachSampleBatch(barcodes, func(samples []Sample) error {
+		for _, sample := range samples {
+			if sample.Archived {
+				continue
+			}
+			key := normalizedBarcode(sample.Barcode)
+			byBarcode[key] = append(byBarcode[key], sample)
+			// Aliquots and pools share their parents' attributes by design.
+			if key := attributesKey(sample); key != "" && len(sample.parents()) == 0 {
+				byAttributes[key] = append(byAttributes[key], sample)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []DuplicateGroup{}
+	collect := func(reason string, index map[string][]Sample) {
+		keys := make([]string, 0, len(index))
+		for key, samples := range index {
+			if len(samples) > 1 {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			groups = append(groups, DuplicateGroup{Reason: reason, Key: key, Samples: index[key]})
+		}
+	}
+	if reason == "" || reason == DuplicateReasonBarcode {
+		collect(DuplicateReasonBarcode, byBarcode)
+	}
+	if reason == "" || reason == DuplicateReasonAttributes {
+		collect(DuplicateReasonAttributes, byAttributes)
+	}
+	return groups, nil
+}
+
+// mergeInto folds a source sample into the target: fields the target lacks
+// are taken from the source and metadata is combined, with the target
+// winning any disagreement.
+func mergeInto(target *Sample, source Sample) []MergeConflict {
+	conflicts := []MergeConflict{}
+	conflict := func(field string, kept, lost interface{}) {
+		conflicts = append(conflicts, MergeConflict{Source: source.Barcode, Field: field, Kept: kept, Lost: lost})
+	}
+
+	if target.Name == "" {
+		target.Name = source.Name
+	} else if source.Name != "" && source.Name != target.Name {
+		conflict("name", target.Name, source.Name)
+	}
+	if target.Type == "" {
+		target.Type = source.Type
+	} else if source.Type != "" && source.Type != target.Type {
+		conflict("type", target.Type, source.Type)
+	}
+	if target.Location == (Location{}) {
+		target.Location = source.Location
+	} else if source.Location != (Location{}) && source.Location != target.Location {
+		conflict("location", target.Location, source.Location)
+	}
+	if target.VolumeUL == nil {
+		target.VolumeUL = source.VolumeUL
+	} else if source.VolumeUL != nil && *source.VolumeUL != *target.VolumeUL {
+		conflict("volume_ul", *target.VolumeUL, *source.VolumeUL)
+	}
+	if target.Concentration == nil {
+		target.Concentration = source.Concentration
+	} else if source.Concentration != nil && *source.Concentration != *target.Concentration {
+		conflict("concentration", *target.Concentration, *source.Concentration)
+	}
+	if target.ExpiresAt == "" {
+		target.ExpiresAt = source.ExpiresAt
+	} else if source.ExpiresAt != "" && source.ExpiresAt != target.ExpiresAt {
+		conflict("expires_at", target.ExpiresAt, source.ExpiresAt)
+	}
+	if len(target.parents()) == 0 {
+		target.ParentBarcode = source.ParentBarcode
+		target.PooledFrom = source.PooledFrom
+	}
+
+	keys := make([]string, 0, len(source.Metadata))
+	for key := range source.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := source.Metadata[key]
+		existing, ok := target.Metadata[key]
+		switch {
+		case !ok:
+			if target.Metadata == nil {
+				target.Metadata = map[string]string{}
+			}
+			target.Metadata[key] = value
+		case existing != value:
+			conflict("metadata."+key, existing, value)
+		}
+	}
+	return conflicts
+}
+
+// mergeSamples merges the sources into the target in one transaction. The
+// sources are archived with merged_into set, keeping their own history, and
+// their aliquots are moved to the target.
+func mergeSamples(req MergeRequest, actor string) (*MergeResponse, error) {
+	barcodes := append([]string{req.Target}, req.Sources...)
+	merging := make(map[string]bool, len(barcodes))
+	for _, barcode := range barcodes {
+		merging[barcode] = true
+	}
+
+	var response *MergeResponse
+	err := sampleStore.Update(func(tx SampleTx) error {
+		stored, err := tx.GetMany(barcodes)
+		if err != nil {
+			return err
+		}
+		byBarcode := make(map[string]Sample, len(stored))
+		for _, sample := range stored {
+			byBarcode[sample.Barcode] = sample
+		}
+		for _, barcode := range barcodes {
+			sample, ok := byBarcode[barcode]
+			if !ok {
+				return &SampleError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("Sample %s not found", barcode)}
+			}
+			if sample.Archived {
+				return &SampleError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("Sample %s is archived", barcode)}
+			}
+			for _, parent := range sample.parents() {
+				if merging[parent] {
+					return &SampleError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("Sample %s is derived from %s and can't be merged with it", barcode, parent)}
+				}
+			}
+		}
+
+		// Aliquots and pools of the sources are derived from the target
+		// instead.
+		children := []string{}
+		for _, source := range req.Sources {
+			members, err := tx.Children(source)
+			if err != nil {
+				return err
+			}
+			children = append(children, members...)
+		}
+		sort.Strings(children)
+		childSamples, err := tx.GetMany(children)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		previousTarget := byBarcode[req.Target]
+		target := previousTarget
+		response = &MergeResponse{Merged: req.Sources, Reparented: []string{}, Conflicts: []MergeConflict{}}
+		sources := make([]Sample, len(req.Sources))
+		for i, barcode := range req.Sources {
+			response.Conflicts = append(response.Conflicts, mergeInto(&target, byBarcode[barcode])...)
+			source := byBarcode[barcode]
+			source.Archived = true
+			source.ArchivedAt = now
+			source.UpdatedAt = now
+			source.MergedInto = req.Target
+			source.Version++
+			source.UpdatedBy = actor
+			sources[i] = source
+		}
+		target.MergedFrom = append(append([]string{}, target.MergedFrom...), req.Sources...)
+		target.UpdatedAt = now
+		target.Version++
+		target.UpdatedBy = actor
+		target.refreshExpired(time.Now())
+		response.Sample = target
+
+		targetAudit := SampleAudit{Action: SampleActionMerged, Actor: actor, Note: "merged " + strings.Join(req.Sources, ", ")}
+		sourceAudit := SampleAudit{Action: SampleActionMerged, Actor: actor, Note: "merged into " + req.Target}
+		childAudit := SampleAudit{Action: SampleActionUpdated, Actor: actor, Note: "parent merged into " + req.Target}
+		if note := strings.TrimSpace(req.Note); note != "" {
+			targetAudit.Note += "; " + note
+			sourceAudit.Note += "; " + note
+		}
+
+		// Archive the sources first so the target can take a well one of
+		// them frees.
+		for _, source := range sources {
+			previous := byBarcode[source.Barcode]
+			tx.Put(SampleWrite{Sample: source, Previous: &previous, Audit: sourceAudit})
+		}
+		tx.Put(SampleWrite{Sample: target, Previous: &previousTarget, Audit: targetAudit})
+		for _, child := range childSamples {
+			previous := child
+			child.reparent(merging, req.Target)
+			child.UpdatedAt = now
+			child.nextVersion(&previous)
+			child.attribute(&previous, actor)
+			tx.Put(SampleWrite{Sample: child, Previous: &previous, Audit: childAudit})
+			response.Reparented = append(response.Reparented, child.Barcode)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// duplicateSamplesHandler lists groups of likely duplicate samples;
+// reason=barcode or attributes limits it to one heuristic.
+func duplicateSamplesHandler(c *gin.Context) {
+	reason := c.Query("reason")
+	if reason != "" && reason != DuplicateReasonBarcode && reason != DuplicateReasonAttributes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be barcode or attributes"})
+		return
+	}
+
+	groups, err := findDuplicates(reason)
+	if err != nil {
+		log.Printf("Error finding duplicate samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return
+	}
+	// Keys only see duplicates among their own projects' samples.
+	visible := []DuplicateGroup{}
+	for _, group := range groups {
+		group.Samples = visibleSamples(c, group.Samples)
+		if len(group.Samples) > 1 {
+			visible = append(visible, group)
+		}
+	}
+	groups = visible
+	c.JSON(http.StatusOK, DuplicatesResponse{Count: len(groups), Groups: groups})
+}
+
+func mergeSamplesHandler(c *gin.Context) {
+	var req MergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "target and sources are required"})
+		return
+	}
+	if len(req.Sources) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sources must not be empty"})
+		return
+	}
+	seen := map[string]bool{req.Target: true}
+	for _, source := range req.Sources {
+		if seen[source] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("sample %s is given more than once", source)})
+			return
+		}
+		seen[source] = true
+	}
+	if !requireSamplesAccess(c, append([]string{req.Target}, req.Sources...)) {
+		return
+	}
+
+	response, err := mergeSamples(req, requestActor(c))
+	if err != nil {
+		if sampleErr, ok := err.(*SampleError); ok {
+			c.JSON(sampleErr.StatusCode, gin.H{"error": sampleErr.Message})
+			return
+		}
+		log.Printf("Error merging samples into %s: %v", req.Target, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge samples"})
+		return
+	}
+
+	log.Printf("Merged %s into %s", strings.Join(req.Sources, ", "), req.Target)
+	c.JSON(http.StatusOK, response)
+}
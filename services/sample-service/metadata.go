@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxMetadataFields bounds the custom fields on one sample.
+const maxMetadataFields = 50
+
+// validateMetadata rejects empty keys and oversized metadata.
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataFields {
+		return fmt.Errorf("metadata may have at most %d fields", maxMetadataFields)
+	}
+	for key := range metadata {
+		if strings.TrimSpace(key) == "" {
+			return errors.New("metadata keys must not be empty")
+		}
+	}
+	return nil
+}
+
+// mergeMetadata applies a metadata patch to a copy of the stored metadata.
+func mergeMetadata(stored map[string]string, patch map[string]*string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range stored {
+		merged[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(merged, key)
+		} else {
+			merged[key] = *value
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// metadataChanges lists the metadata keys that differ, named metadata.<key>.
+func metadataChanges(previous, current map[string]string) map[string]FieldChange {
+	changes := map[string]FieldChange{}
+	for key, value := range current {
+		if old, ok := previous[key]; !ok || old != value {
+			var from interface{}
+			if ok {
+				from = old
+			}
+			changes["metadata."+key] = FieldChange{From: from, To: value}
+		}
+	}
+	for key, value := range previous {
+		if _, ok := current[key]; !ok {
+			changes["metadata."+key] = FieldChange{From: value, To: nil}
+		}
+	}
+	return changes
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Plates are stored under plate:<id>, with every plate ID in the sorted
+// set plates:all.
+const (
+	PLATE_KEY_PREFIX = "plate:"
+	PLATES_ALL_KEY   = "plates:all"
+)
+
+// defaultPlateFormat is used for plates registered from existing samples.
+const defaultPlateFormat = 96
+
+// PlateFormat is the well layout of a plate format.
+type PlateFormat struct {
+	Rows    int
+	Columns int
+}
+
+// PLATE_FORMATS lists the supported plate formats by well count.
+var PLATE_FORMATS = map[int]PlateFormat{
+	96:  {Rows: 8, Columns: 12},
+	384: {Rows: 16, Columns: 24},
+}
+
+type Plate struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Format    int    `json:"format"`
+	Lab       string `json:"lab,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+type CreatePlateRequest struct {
+	ID     string `json:"id" binding:"required"`
+	Name   string `json:"name"`
+	Format int    `json:"format" binding:"required"`
+}
+
+// PlateResponse is a plate with its occupancy.
+type PlateResponse struct {
+	ID            string `json:"id"`
+	Name          string `json:"name,omitempty"`
+	Format        int    `json:"format"`
+	Rows          int    `json:"rows"`
+	Columns       int    `json:"columns"`
+	CreatedAt     string `json:"created_at"`
+	OccupiedWells int    `json:"occupied_wells"`
+	FreeWells     int    `json:"free_wells"`
+}
+
+// WellState is one well of a plate and the active samples in it.
+type WellState struct {
+	Well     string   `json:"well"`
+	Row      string   `json:"row"`
+	Column   int      `json:"column"`
+	Occupied bool     `json:"occupied"`
+	Samples  []string `json:"samples"`
+}
+
+func plateKey(plateID string) string {
+	return PLATE_KEY_PREFIX + plateID
+}
+
+func rowName(row int) string {
+	return string(rune('A' + row))
+}
+
+// wellNames lists the wells of a format in row-major order (A1, A2, ...).
+func wellNames(format PlateFormat) []string {
+	wells := make([]string, 0, format.Rows*format.Columns)
+	for row := 0; row < format.Rows; row++ {
+		for column := 1; column <= format.Columns; column++ {
+			wells = append(wells, fmt.Sprintf("%s%d", rowName(row), column))
+		}
+	}
+	return wells
+}
+
+// normalizeWell checks a well name against the plate format and returns it
+// in canonical form, so "a01" becomes "A1".
+func normalizeWell(format PlateFormat, well string) (string, error) {
+	well = strings.ToUpper(strings.TrimSpace(well))
+	if len(well) < 2 {
+		return "", fmt.Errorf("invalid well %q", well)
+	}
+	row := int(well[0] - 'A')
+	column, err := strconv.Atoi(well[1:])
+	if row < 0 || row >= format.Rows || err != nil || column < 1 || column > format.Columns {
+		return "", fmt.Errorf("well %s is not on a %d-well plate", well, format.Rows*format.Columns)
+	}
+	return fmt.Sprintf("%s%d", rowName(row), column), nil
+}
+
+func getPlate(plateID string) (*Plate, error) {
+	data, err := redisClient.Get(ctx, plateKey(plateID)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var plate Plate
+	if err := json.Unmarshal([]byte(data), &plate); err != nil {
+		return nil, err
+	}
+	return &plate, nil
+}
+
+var errPlateExists = errors.New("plate already exists")
+
+func putPlate(pipe redis.Pipeliner, plate Plate) error {
+	data, err := json.Marshal(plate)
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, plateKey(plate.ID), data, 0)
+	pipe.ZAdd(ctx, PLATES_ALL_KEY, redis.Z{Score: 0, Member: plate.ID})
+	return nil
+}
+
+// createPlate stores a new plate, failing with errPlateExists if the ID is
+// taken.
+func createPlate(plate Plate) error {
+	key := plateKey(plate.ID)
+	err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errPlateExists
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return putPlate(pipe, plate)
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return errPlateExists
+	}
+	return err
+}
+
+// LocationValidator checks sample locations against the registered
+// plates and storage locations of a lab, caching those it has read.
+type LocationValidator struct {
+	lab     string
+	plates  map[string]*Plate
+	storage map[string]*StorageLocation
+}
+
+func newLocationValidator(lab string) *LocationValidator {
+	return &LocationValidator{lab: lab, plates: map[string]*Plate{}, storage: map[string]*StorageLocation{}}
+}
+
+// Validate returns the location with its well or position normalized. A
+// plate is required for a well, and the plate must exist and have that
+// well; storage placements are checked by validateStorage.
+func (v *LocationValidator) Validate(location Location) (Location, *SampleError) {
+	if strings.TrimSpace(location.Storage) != "" || strings.TrimSpace(location.Position) != "" {
+		return v.validateStorage(location)
+	}
+	location.Storage, location.Position = "", ""
+	location.Plate = strings.TrimSpace(location.Plate)
+	if location.Plate == "" {
+		if strings.TrimSpace(location.Well) != "" {
+			return location, &SampleError{StatusCode: http.StatusBadRequest, Message: "well given without a plate"}
+		}
+		return Location{}, nil
+	}
+
+	plate, ok := v.plates[location.Plate]
+	if !ok {
+		var err error
+		plate, err = getPlate(location.Plate)
+		if err != nil {
+			log.Printf("Error getting plate %s: %v", location.Plate, err)
+			return location, &SampleError{StatusCode: http.StatusInternalServerError, Message: "Failed to retrieve plate"}
+		}
+		v.plates[location.Plate] = plate
+	}
+	if plate == nil || plate.Lab != v.lab {
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("plate %s does not exist", location.Plate)}
+	}
+
+	if location.Well == "" {
+		return location, nil
+	}
+	well, err := normalizeWell(PLATE_FORMATS[plate.Format], location.Well)
+	if err != nil {
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	location.Well = well
+	return location, nil
+}
+
+// plateOccupancy maps each occupied well to the active samples in it.
+func plateOccupancy(plateID string) (map[string][]string, error) {
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Plate: plateID, Status: SampleStatusActive})
+	if err != nil {
+		return nil, err
+	}
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	occupancy := map[string][]string{}
+	for _, sample := range samples {
+		if sample.Archived || sample.Location.Plate != plateID || sample.Location.Well == "" {
+			continue
+		}
+		occupancy[sample.Location.Well] = append(occupancy[sample.Location.Well], sample.Barcode)
+	}
+	for _, wellSamples := range occupancy {
+		sort.Strings(wellSamples)
+	}
+	return occupancy, nil
+}
+
+func plateResponse(plate Plate, occupancy map[string][]string) PlateResponse {
+	format := PLATE_FORMATS[plate.Format]
+	return PlateResponse{
+		ID:            plate.ID,
+		Name:          plate.Name,
+		Format:        plate.Format,
+		Rows:          format.Rows,
+		Columns:       format.Columns,
+		CreatedAt:     plate.CreatedAt,
+		OccupiedWells: len(occupancy),
+		FreeWells:     plate.Format - len(occupancy),
+	}
+}
+
+// registerSamplePlates creates a plate record for every plate that samples
+// reference but that was never registered, as happens with samples saved
+// before plates existed.
+func registerSamplePlates() error {
+	plateIDs, err := sampleStore.Plates()
+	if err != nil {
+		return err
+	}
+	registered := 0
+	for _, plateID := range plateIDs {
+		plate, err := getPlate(plateID)
+		if err != nil {
+			return err
+		}
+		if plate != nil {
+			continue
+		}
+		_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return putPlate(pipe, Plate{
+				ID:        plateID,
+				Format:    defaultPlateFormat,
+				CreatedAt: time.Now().UTC().Format(time.RFC3339),
+			})
+		})
+		if err != nil {
+			return err
+		}
+		registered++
+	}
+	if registered > 0 {
+		log.Printf("Registered %d plate(s) referenced by existing samples", registered)
+	}
+	return nil
+}
+
+func createPlateHandler(c *gin.Context) {
+	var req CreatePlateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id and format are required"})
+		return
+	}
+	if _, ok := PLATE_FORMATS[req.Format]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be 96 or 384"})
+		return
+	}
+
+	plate := Plate{
+		ID:        strings.TrimSpace(req.ID),
+		Name:      req.Name,
+		Format:    req.Format,
+		Lab:       requestAccess(c).Lab,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if plate.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id and format are required"})
+		return
+	}
+	if err := createPlate(plate); err != nil {
+		if err == errPlateExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "Plate already exists"})
+			return
+		}
+		log.Printf("Error saving plate %s: %v", plate.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save plate"})
+		return
+	}
+
+	log.Printf("Plate %s created (%d-well)", plate.ID, plate.Format)
+	c.JSON(http.StatusCreated, plateResponse(plate, nil))
+}
+
+func listPlatesHandler(c *gin.Context) {
+	plateIDs, err := redisClient.ZRange(ctx, PLATES_ALL_KEY, 0, -1).Result()
+	if err != nil {
+		log.Printf("Error listing plates: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve plates"})
+		return
+	}
+
+	lab := requestAccess(c).Lab
+	plates := make([]PlateResponse, 0, len(plateIDs))
+	for _, plateID := range plateIDs {
+		plate, err := getPlate(plateID)
+		if err != nil || plate == nil || plate.Lab != lab {
+			continue
+		}
+		occupancy, err := plateOccupancy(plateID)
+		if err != nil {
+			log.Printf("Error reading occupancy of plate %s: %v", plateID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve plates"})
+			return
+		}
+		plates = append(plates, plateResponse(*plate, occupancy))
+	}
+	c.JSON(http.StatusOK, plates)
+}
+
+// loadPlate reads the plate named in the URL and its occupancy, writing an
+// error response if that fails.
+func loadPlate(c *gin.Context) (*Plate, map[string][]string, bool) {
+	plateID := c.Param("plate_id")
+	plate, err := getPlate(plateID)
+	if err != nil {
+		log.Printf("Error getting plate %s: %v", plateID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve plate"})
+		return nil, nil, false
+	}
+	if plate == nil || plate.Lab != requestAccess(c).Lab {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plate not found"})
+		return nil, nil, false
+	}
+
+	occupancy, err := plateOccupancy(plateID)
+	if err != nil {
+		log.Printf("Error reading occupancy of plate %s: %v", plateID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve plate"})
+		return nil, nil, false
+	}
+	return plate, occupancy, true
+}
+
+func getPlateHandler(c *gin.Context) {
+	plate, occupancy, ok := loadPlate(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, plateResponse(*plate, occupancy))
+}
+
+// plateWellsHandler lists every well of the plate with its samples; pass
+// occupied=true or false to see only occupied or free wells.
+func plateWellsHandler(c *gin.Context) {
+	plate, occupancy, ok := loadPlate(c)
+	if !ok {
+		return
+	}
+
+	filter := c.Query("occupied")
+	format := PLATE_FORMATS[plate.Format]
+	wells := []WellState{}
+	for i, well := range wellNames(format) {
+		samples := occupancy[well]
+		occupied := len(samples) > 0
+		if (filter == "true" && !occupied) || (filter == "false" && occupied) {
+			continue
+		}
+		if samples == nil {
+			samples = []string{}
+		}
+		wells = append(wells, WellState{
+			Well:     well,
+			Row:      rowName(i / format.Columns),
+			Column:   i%format.Columns + 1,
+			Occupied: occupied,
+			Samples:  samples,
+		})
+	}
+	c.JSON(http.StatusOK, wells)
+}
+
+// plateMapHandler returns the occupied wells mapped to their samples.
+func plateMapHandler(c *gin.Context) {
+	plate, occupancy, ok := loadPlate(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"plate": plate.ID,
+		"wells": occupancy,
+	})
+}
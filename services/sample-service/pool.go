@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPoolSources bounds the samples combined into one pool.
+const maxPoolSources = 384
+
+// proportionTolerance is how far the proportions of a pool may add up to
+// something other than 1, to allow for rounding.
+const proportionTolerance = 0.001
+
+// PoolSource is one sample pooled into another and the share of the pool
+// it makes up. VolumeUL, if set, is the volume drawn from it.
+type PoolSource struct {
+	Barcode    string   `json:"barcode"`
+	Proportion float64  `json:"proportion"`
+	VolumeUL   *float64 `json:"volume_ul,omitempty"`
+}
+
+// PoolRequest combines source samples into a new pooled sample. Name and
+// type default to a description of the pool and the sources' shared type.
+// Proportions may be left out if every source gives volume_ul, in which
+// case they are worked out from the volumes.
+type PoolRequest struct {
+	Barcode      string            `json:"barcode" binding:"required"`
+	Name         string            `json:"name"`
+	Type         string            `json:"type"`
+	Location     Location          `json:"location"`
+	Sources      []PoolSource      `json:"sources" binding:"required"`
+	Metadata     map[string]string `json:"metadata"`
+	Project      string            `json:"project"`
+	WorkflowID   string            `json:"workflow_id"`
+	Note         string            `json:"note"`
+	AllowPooling bool              `json:"allow_pooling"`
+}
+
+type PoolResponse struct {
+	Pool    Sample   `json:"pool"`
+	Sources []Sample `json:"sources"`
+}
+
+// parents lists the samples a sample was derived from: the sample it was
+// aliquoted from or the samples pooled into it.
+func (s Sample) parents() []string {
+	parents := []string{}
+	if s.ParentBarcode != "" {
+		parents = append(parents, s.ParentBarcode)
+	}
+	for _, source := range s.PooledFrom {
+		parents = append(parents, source.Barcode)
+	}
+	return parents
+}
+
+// reparent makes a sample derived from any of sources derived from target
+// instead. A pool that now has target as a source more than once keeps it
+// once, with the shares added up.
+func (s *Sample) reparent(sources map[string]bool, target string) {
+	if sources[s.ParentBarcode] {
+		s.ParentBarcode = target
+	}
+	if len(s.PooledFrom) == 0 {
+		return
+	}
+	pooled := make([]PoolSource, 0, len(s.PooledFrom))
+	targetIndex := -1
+	for _, source := range s.PooledFrom {
+		if sources[source.Barcode] || source.Barcode == target {
+			source.Barcode = target
+			if targetIndex >= 0 {
+				combined := &pooled[targetIndex]
+				combined.Proportion += source.Proportion
+				if combined.VolumeUL != nil && source.VolumeUL != nil {
+					volume := *combined.VolumeUL + *source.VolumeUL
+					combined.VolumeUL = &volume
+				}
+				continue
+			}
+			targetIndex = len(pooled)
+		}
+		pooled = append(pooled, source)
+	}
+	s.PooledFrom = pooled
+}
+
+func poolBarcodes(sources []PoolSource) string {
+	barcodes := make([]string, len(sources))
+	for i, source := range sources {
+		barcodes[i] = source.Barcode
+	}
+	return strings.Join(barcodes, ",")
+}
+
+// validatePoolSources checks the sources of a pool and fills in their
+// proportions from the volumes drawn if none are given.
+func validatePoolSources(pool string, sources []PoolSource) error {
+	if len(sources) < 2 {
+		return errors.New("a pool needs at least two sources")
+	}
+	if len(sources) > maxPoolSources {
+		return fmt.Errorf("at most %d samples can be pooled at once", maxPoolSources)
+	}
+
+	seen := map[string]bool{pool: true}
+	withProportion, withVolume := 0, 0
+	totalProportion, totalVolume := 0.0, 0.0
+	for _, source := range sources {
+		if source.Barcode == "" {
+			return errors.New("every source needs a barcode")
+		}
+		if seen[source.Barcode] {
+			return fmt.Errorf("barcode %s is given more than once", source.Barcode)
+		}
+		seen[source.Barcode] = true
+		if source.Proportion < 0 || math.IsNaN(source.Proportion) {
+			return fmt.Errorf("%s: proportion must not be negative", source.Barcode)
+		}
+		if source.Proportion > 0 {
+			withProportion++
+			totalProportion += source.Proportion
+		}
+		if source.VolumeUL != nil {
+			if *source.VolumeUL <= 0 {
+				return fmt.Errorf("%s: volume_ul must be a positive number", source.Barcode)
+			}
+			withVolume++
+			totalVolume += *source.VolumeUL
+		}
+	}
+
+	if withProportion == 0 && withVolume == len(sources) {
+		for i := range sources {
+			sources[i].Proportion = *sources[i].VolumeUL / totalVolume
+		}
+		return nil
+	}
+	if withProportion != len(sources) {
+		return errors.New("every source needs a proportion, unless every source gives volume_ul")
+	}
+	if math.Abs(totalProportion-1) > proportionTolerance {
+		return fmt.Errorf("proportions must add up to 1, not %g", totalProportion)
+	}
+	return nil
+}
+
+// sharedMetadata returns the metadata fields every sample has with the
+// same value.
+func sharedMetadata(samples []Sample) map[string]string {
+	if len(samples) == 0 {
+		return nil
+	}
+	shared := mergeMetadata(samples[0].Metadata, nil)
+	for _, sample := range samples[1:] {
+		for key, value := range shared {
+			if sample.Metadata[key] != value {
+				delete(shared, key)
+			}
+		}
+	}
+	if len(shared) == 0 {
+		return nil
+	}
+	return shared
+}
+
+// createPool stores a pool and draws the pooled volumes from its sources
+// in one transaction, so the sources, their volumes and the pool's well
+// can't change before the write. Each source's history records the pool it
+// went into. It returns the sources as written.
+func createPool(pool *Sample, allowPooling bool, audit SampleAudit) ([]Sample, error) {
+	barcodes := make([]string, len(pool.PooledFrom))
+	for i, source := range pool.PooledFrom {
+		barcodes[i] = source.Barcode
+	}
+
+	var updated []Sample
+	err := sampleStore.Update(func(tx SampleTx) error {
+		existing, err := tx.GetMany([]string{pool.Barcode})
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			return errSampleExists
+		}
+		stored, err := tx.GetMany(barcodes)
+		if err != nil {
+			return err
+		}
+		byBarcode := make(map[string]Sample, len(stored))
+		for _, sample := range stored {
+			byBarcode[sample.Barcode] = sample
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		rejected := []ConsumptionError{}
+		updated = make([]Sample, 0, len(barcodes))
+		for _, source := range pool.PooledFrom {
+			sample, ok := byBarcode[source.Barcode]
+			if !ok {
+				return &SampleError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("Sample %s not found", source.Barcode)}
+			}
+			if sample.Archived {
+				return &SampleError{StatusCode: http.StatusConflict, Message: fmt.Sprintf("Sample %s is archived", source.Barcode)}
+			}
+			if source.VolumeUL == nil {
+				updated = append(updated, sample)
+				continue
+			}
+			volume := *source.VolumeUL
+			switch {
+			case sample.VolumeUL == nil:
+				rejected = append(rejected, ConsumptionError{Barcode: source.Barcode, Error: "sample volume is not tracked", RequestedUL: volume})
+				continue
+			case *sample.VolumeUL-volume < -volumeTolerance:
+				rejected = append(rejected, ConsumptionError{Barcode: source.Barcode, Error: "insufficient volume", RequestedUL: volume, AvailableUL: sample.VolumeUL})
+				continue
+			}
+			remaining := math.Max(*sample.VolumeUL-volume, 0)
+			sample.VolumeUL = &remaining
+			sample.UpdatedAt = now
+			sample.Version++
+			sample.UpdatedBy = audit.Actor
+			updated = append(updated, sample)
+		}
+		if len(rejected) > 0 {
+			return &ConsumeRejectedError{Errors: rejected}
+		}
+
+		if wellKey := pool.wellKey(); wellKey != "" && !allowPooling {
+			occupant, err := wellOccupant(tx, wellKey, pool.Barcode)
+			if err != nil {
+				return err
+			}
+			if occupant != "" {
+				return &WellConflictError{Location: pool.Location, Barcode: occupant}
+			}
+		}
+
+		sourceAudit := audit
+		sourceAudit.Action = SampleActionPooled
+		sourceAudit.Note = "pooled into " + pool.Barcode
+		for i, source := range pool.PooledFrom {
+			previous := byBarcode[source.Barcode]
+			tx.Put(SampleWrite{Sample: updated[i], Previous: &previous, Audit: sourceAudit, HistoryOnly: source.VolumeUL == nil})
+		}
+		tx.Put(SampleWrite{Sample: *pool, Audit: audit})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// poolSamplesHandler creates a sample pooled from several others, with the
+// proportion each makes up.
+func poolSamplesHandler(c *gin.Context) {
+	var req PoolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validatePoolSources(req.Barcode, req.Sources); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	barcodes := make([]string, len(req.Sources))
+	for i, source := range req.Sources {
+		barcodes[i] = source.Barcode
+	}
+	sources, err := getSamples(barcodes)
+	if err != nil {
+		log.Printf("Error getting pool sources: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return
+	}
+	access := requestAccess(c)
+	found := map[string]bool{}
+	for _, source := range sources {
+		found[source.Barcode] = access.allowsSample(source)
+	}
+	for _, barcode := range barcodes {
+		if !found[barcode] {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Sample %s not found", barcode)})
+			return
+		}
+	}
+
+	// Pools of one type of sample are of that type.
+	poolType := req.Type
+	if poolType == "" {
+		for _, source := range sources {
+			if poolType != "" && source.Type != poolType {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "type is required when pooling samples of different types"})
+				return
+			}
+			poolType = source.Type
+		}
+	}
+	// Likewise pools of one project's samples belong to that project.
+	project := req.Project
+	if project == "" {
+		project = sources[0].Project
+		for _, source := range sources {
+			if source.Project != project {
+				project = ""
+			}
+		}
+	}
+	if project, err = access.defaultProject(project); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	location, locErr := newLocationValidator(requestAccess(c).Lab).Validate(req.Location)
+	if locErr != nil {
+		c.JSON(locErr.StatusCode, gin.H{"error": locErr.Message})
+		return
+	}
+	barcodeRules, err := loadBarcodeValidator()
+	if err != nil {
+		log.Printf("Error loading barcode rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve barcode rules"})
+		return
+	}
+	if barcodeErr := barcodeRules.Validate(req.Barcode, poolType); barcodeErr != nil {
+		c.JSON(barcodeErr.StatusCode, gin.H{"error": barcodeErr.Message})
+		return
+	}
+
+	pool := Sample{
+		Barcode:    req.Barcode,
+		Name:       req.Name,
+		Type:       poolType,
+		Project:    project,
+		Location:   location,
+		PooledFrom: req.Sources,
+		Lab:        requestAccess(c).Lab,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if pool.Name == "" {
+		pool.Name = fmt.Sprintf("Pool of %d samples", len(req.Sources))
+	}
+	metadata := map[string]*string{}
+	for key := range req.Metadata {
+		value := req.Metadata[key]
+		metadata[key] = &value
+	}
+	pool.Metadata = mergeMetadata(sharedMetadata(sources), metadata)
+	if err := validateMetadata(pool.Metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// A pool holds the volume drawn into it and expires with its first
+	// source to expire.
+	total := 0.0
+	for _, source := range req.Sources {
+		if source.VolumeUL == nil {
+			total = -1
+			break
+		}
+		total += *source.VolumeUL
+	}
+	if total >= 0 {
+		pool.VolumeUL = &total
+	}
+	var expires time.Time
+	for _, source := range sources {
+		if sourceExpires, ok := source.expiresTime(); ok && (expires.IsZero() || sourceExpires.Before(expires)) {
+			expires = sourceExpires
+			pool.ExpiresAt = source.ExpiresAt
+		}
+	}
+
+	types := newSampleTypeValidator()
+	if typeErr := types.Validate(pool); typeErr != nil {
+		c.JSON(typeErr.StatusCode, gin.H{"error": typeErr.Message})
+		return
+	}
+	types.ApplyDefaults(&pool)
+	pool.nextVersion(nil)
+	pool.refreshExpired(time.Now())
+
+	audit := SampleAudit{Action: SampleActionCreated, WorkflowID: req.WorkflowID, Actor: requestActor(c), Note: "pool of " + strings.Join(barcodes, ", ")}
+	pool.attribute(nil, audit.Actor)
+	if note := strings.TrimSpace(req.Note); note != "" {
+		audit.Note += "; " + note
+	}
+	updated, err := createPool(&pool, req.AllowPooling, audit)
+	if err != nil {
+		if err == errSampleExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "Sample already exists"})
+			return
+		}
+		var rejected *ConsumeRejectedError
+		if errors.As(err, &rejected) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough volume to pool", "errors": rejected.Errors})
+			return
+		}
+		if sampleErr, ok := err.(*SampleError); ok {
+			c.JSON(sampleErr.StatusCode, gin.H{"error": sampleErr.Message})
+			return
+		}
+		if respondWellConflict(c, err) {
+			return
+		}
+		log.Printf("Error creating pool %s: %v", req.Barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create pool"})
+		return
+	}
+
+	publishSampleCreated([]Sample{pool}, audit.Actor)
+	drawn := []Sample{}
+	consumptions := []SampleConsumption{}
+	for i, source := range req.Sources {
+		if source.VolumeUL != nil {
+			drawn = append(drawn, updated[i])
+			consumptions = append(consumptions, SampleConsumption{Barcode: source.Barcode, VolumeUL: *source.VolumeUL})
+		}
+	}
+	publishSampleConsumed(drawn, consumptions, audit)
+
+	log.Printf("Pooled %d sample(s) into %s", len(req.Sources), pool.Barcode)
+	c.JSON(http.StatusCreated, PoolResponse{Pool: pool, Sources: updated})
+}
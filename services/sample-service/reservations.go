@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// A sample reserved for a workflow is marked under
+// samples:reservation:<barcode> with the workflow ID, and the workflow's
+// reserved barcodes are kept in the set samples:reservations:<workflow_id>.
+const (
+	SAMPLE_RESERVATION_KEY_PREFIX    = "samples:reservation:"
+	WORKFLOW_RESERVATIONS_KEY_PREFIX = "samples:reservations:"
+)
+
+// maxReservationBarcodes bounds the samples reserved or validated at once.
+const maxReservationBarcodes = 1000
+
+// Sample availability, from the most to the least serious reason a sample
+// can't be used.
+const (
+	AvailabilityNotFound    = "not_found"
+	AvailabilityArchived    = "archived"
+	AvailabilityPlaceholder = "placeholder"
+	AvailabilityConsumed    = "consumed"
+	AvailabilityExpired     = "expired"
+	AvailabilityReserved    = "reserved"
+	AvailabilityAvailable   = "available"
+)
+
+type ReservationRequest struct {
+	WorkflowID string   `json:"workflow_id" binding:"required"`
+	Barcodes   []string `json:"barcodes" binding:"required"`
+}
+
+type ReservationResponse struct {
+	WorkflowID string   `json:"workflow_id"`
+	Barcodes   []string `json:"barcodes"`
+}
+
+// ReservationRejectedError is returned when any sample of a reservation
+// can't be reserved; nothing is reserved.
+type ReservationRejectedError struct {
+	Results []ValidationResult
+}
+
+func (e *ReservationRejectedError) Error() string {
+	return fmt.Sprintf("%d sample(s) are not available", len(e.Results))
+}
+
+func sampleReservationKey(barcode string) string {
+	return SAMPLE_RESERVATION_KEY_PREFIX + barcode
+}
+
+func workflowReservationsKey(workflowID string) string {
+	return WORKFLOW_RESERVATIONS_KEY_PREFIX + workflowID
+}
+
+// consumed reports whether a sample's tracked volume has been used up.
+func (s Sample) consumed() bool {
+	return s.VolumeUL != nil && *s.VolumeUL <= volumeTolerance
+}
+
+// sampleAvailability says whether a sample can be used by a workflow.
+// Samples reserved by the workflow itself are available to it; with no
+// workflow any reservation makes a sample unavailable.
+func sampleAvailability(barcode string, sample *Sample, reservedBy, workflowID string) ValidationResult {
+	result := ValidationResult{Barcode: barcode, Exists: sample != nil, ReservedBy: reservedBy}
+	if sample == nil {
+		result.Status = AvailabilityNotFound
+		return result
+	}
+	result.Archived = sample.Archived
+	result.Placeholder = sample.Placeholder
+	result.Consumed = sample.consumed()
+	result.Expired = sample.Expired
+	result.Reserved = reservedBy != "" && reservedBy != workflowID
+
+	switch {
+	case result.Archived:
+		result.Status = AvailabilityArchived
+	case result.Placeholder:
+		result.Status = AvailabilityPlaceholder
+	case result.Consumed:
+		result.Status = AvailabilityConsumed
+	case result.Expired:
+		result.Status = AvailabilityExpired
+	case result.Reserved:
+		result.Status = AvailabilityReserved
+	default:
+		result.Status = AvailabilityAvailable
+		result.Available = true
+	}
+	return result
+}
+
+// readReservations returns the workflow each of the barcodes is reserved
+// for, if any.
+func readReservations(cmd redis.Cmdable, barcodes []string) (map[string]string, error) {
+	reservations := map[string]string{}
+	if len(barcodes) == 0 {
+		return reservations, nil
+	}
+	keys := make([]string, len(barcodes))
+	for i, barcode := range barcodes {
+		keys[i] = sampleReservationKey(barcode)
+	}
+	values, err := cmd.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		if workflowID, ok := value.(string); ok {
+			reservations[barcodes[i]] = workflowID
+		}
+	}
+	return reservations, nil
+}
+
+// checkAvailability reports the availability of each barcode, in order,
+// with the sample records if includeSamples is set. Reservations are read
+// on cmd, e.g. inside a WATCH.
+func checkAvailability(cmd redis.Cmdable, barcodes []string, workflowID string, includeSamples bool) ([]ValidationResult, error) {
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+	byBarcode := make(map[string]*Sample, len(samples))
+	for i := range samples {
+		byBarcode[samples[i].Barcode] = &samples[i]
+	}
+	reservations, err := readReservations(cmd, barcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ValidationResult, len(barcodes))
+	for i, barcode := range barcodes {
+		results[i] = sampleAvailability(barcode, byBarcode[barcode], reservations[barcode], workflowID)
+		if includeSamples {
+			results[i].Sample = byBarcode[barcode]
+		}
+	}
+	return results, nil
+}
+
+// reserveSamples reserves every sample for the workflow if all of them are
+// available to it, watching their reservations so no other workflow can
+// take one before the write. The samples may be kept outside Redis, so only
+// the reservations are watched.
+func reserveSamples(workflowID string, barcodes []string) error {
+	keys := make([]string, len(barcodes))
+	for i, barcode := range barcodes {
+		keys[i] = sampleReservationKey(barcode)
+	}
+
+	reserve := func(tx *redis.Tx) error {
+		results, err := checkAvailability(tx, barcodes, workflowID, false)
+		if err != nil {
+			return err
+		}
+		rejected := []ValidationResult{}
+		for _, result := range results {
+			if !result.Available {
+				rejected = append(rejected, result)
+			}
+		}
+		if len(rejected) > 0 {
+			return &ReservationRejectedError{Results: rejected}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, barcode := range barcodes {
+				pipe.Set(ctx, sampleReservationKey(barcode), workflowID, 0)
+				pipe.SAdd(ctx, workflowReservationsKey(workflowID), barcode)
+			}
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		if err = redisClient.Watch(ctx, reserve, keys...); err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+// releaseSamples removes a workflow's reservations and returns the
+// barcodes released.
+func releaseSamples(workflowID string) ([]string, error) {
+	setKey := workflowReservationsKey(workflowID)
+	var released []string
+
+	release := func(tx *redis.Tx) error {
+		barcodes, err := tx.SMembers(ctx, setKey).Result()
+		if err != nil {
+			return err
+		}
+		reservations, err := readReservations(tx, barcodes)
+		if err != nil {
+			return err
+		}
+		released = []string{}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, barcode := range barcodes {
+				// Leave reservations since taken by another workflow.
+				if reservations[barcode] == workflowID {
+					pipe.Del(ctx, sampleReservationKey(barcode))
+					released = append(released, barcode)
+				}
+			}
+			pipe.Del(ctx, setKey)
+			return nil
+		})
+		return err
+	}
+
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		if err = redisClient.Watch(ctx, release, setKey); err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return released, nil
+}
+
+// reserveSamplesHandler reserves samples for a workflow. Either every
+// sample is reserved or, if any is unavailable, none is.
+func reserveSamplesHandler(c *gin.Context) {
+	var req ReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Barcodes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workflow_id and barcodes are required"})
+		return
+	}
+	if len(req.Barcodes) > maxReservationBarcodes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d samples can be reserved at once", maxReservationBarcodes)})
+		return
+	}
+	if !requireSamplesAccess(c, req.Barcodes) {
+		return
+	}
+
+	if err := reserveSamples(req.WorkflowID, req.Barcodes); err != nil {
+		var rejected *ReservationRejectedError
+		if errors.As(err, &rejected) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Samples are not available", "unavailable": rejected.Results})
+			return
+		}
+		log.Printf("Error reserving samples for workflow %s: %v", req.WorkflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve samples"})
+		return
+	}
+
+	log.Printf("Reserved %d sample(s) for workflow %s", len(req.Barcodes), req.WorkflowID)
+	c.JSON(http.StatusOK, ReservationResponse{WorkflowID: req.WorkflowID, Barcodes: req.Barcodes})
+}
+
+func getReservationsHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+	barcodes, err := redisClient.SMembers(ctx, workflowReservationsKey(workflowID)).Result()
+	if err != nil {
+		log.Printf("Error getting reservations of workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reservations"})
+		return
+	}
+	visible, err := visibleBarcodes(c, barcodes)
+	if err != nil {
+		log.Printf("Error getting reservations of workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve reservations"})
+		return
+	}
+	if visible != nil {
+		reserved := []string{}
+		for _, barcode := range barcodes {
+			if visible[barcode] {
+				reserved = append(reserved, barcode)
+			}
+		}
+		barcodes = reserved
+	}
+	c.JSON(http.StatusOK, ReservationResponse{WorkflowID: workflowID, Barcodes: barcodes})
+}
+
+// releaseSamplesHandler releases every sample reserved for a workflow,
+// answering 404 if the caller can't access any of them.
+func releaseSamplesHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+	barcodes, err := redisClient.SMembers(ctx, workflowReservationsKey(workflowID)).Result()
+	if err != nil {
+		log.Printf("Error getting reservations of workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release samples"})
+		return
+	}
+	if !requireSamplesAccess(c, barcodes) {
+		return
+	}
+	released, err := releaseSamples(workflowID)
+	if err != nil {
+		log.Printf("Error releasing samples of workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release samples"})
+		return
+	}
+
+	log.Printf("Released %d sample(s) of workflow %s", len(released), workflowID)
+	c.JSON(http.StatusOK, ReservationResponse{WorkflowID: workflowID, Barcodes: released})
+}
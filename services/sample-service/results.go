@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// QC results are stored under result:<id>, with the IDs of each sample's
+// results in the sorted set samples:results:<barcode>, scored by the time
+// they were measured in milliseconds.
+const (
+	RESULT_KEY_PREFIX         = "result:"
+	SAMPLE_RESULTS_KEY_PREFIX = "samples:results:"
+	RESULT_SEQUENCE_KEY       = "results:sequence"
+)
+
+const (
+	defaultResultLimit = 100
+	maxResultLimit     = 1000
+)
+
+// SampleResult is an assay or QC measurement of a sample, such as a
+// plate-reader absorbance, with the workflow step that produced it.
+// Passed is nil for measurements with no pass/fail criteria.
+type SampleResult struct {
+	ID         int64   `json:"id"`
+	Barcode    string  `json:"barcode"`
+	Name       string  `json:"name"`
+	Value      float64 `json:"value"`
+	Unit       string  `json:"unit,omitempty"`
+	Passed     *bool   `json:"passed,omitempty"`
+	WorkflowID string  `json:"workflow_id,omitempty"`
+	StepIndex  *int    `json:"step_index,omitempty"`
+	Note       string  `json:"note,omitempty"`
+	Actor      string  `json:"actor,omitempty"`
+	MeasuredAt string  `json:"measured_at"`
+	RecordedAt string  `json:"recorded_at"`
+}
+
+type SampleResultRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	Value      *float64 `json:"value"`
+	Unit       string   `json:"unit"`
+	Passed     *bool    `json:"passed"`
+	WorkflowID string   `json:"workflow_id"`
+	StepIndex  *int     `json:"step_index"`
+	Note       string   `json:"note"`
+	MeasuredAt string   `json:"measured_at"`
+}
+
+type SampleResultsResponse struct {
+	Barcode string         `json:"barcode"`
+	Count   int            `json:"count"`
+	Results []SampleResult `json:"results"`
+}
+
+func resultKey(id int64) string {
+	return RESULT_KEY_PREFIX + strconv.FormatInt(id, 10)
+}
+
+func sampleResultsKey(barcode string) string {
+	return SAMPLE_RESULTS_KEY_PREFIX + barcode
+}
+
+// newSampleResult checks a result request and fills in a result from it,
+// measured now unless measured_at is given.
+func newSampleResult(barcode string, req SampleResultRequest, now time.Time) (*SampleResult, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+	if req.Value == nil {
+		return nil, fmt.Errorf("value is required")
+	}
+	if math.IsNaN(*req.Value) || math.IsInf(*req.Value, 0) {
+		return nil, fmt.Errorf("value must be a finite number")
+	}
+	if req.StepIndex != nil && *req.StepIndex < 0 {
+		return nil, fmt.Errorf("step_index must not be negative")
+	}
+	measuredAt := now
+	if req.MeasuredAt != "" {
+		var err error
+		if measuredAt, err = time.Parse(time.RFC3339, req.MeasuredAt); err != nil {
+			return nil, fmt.Errorf("measured_at must be an RFC 3339 timestamp")
+		}
+	}
+	return &SampleResult{
+		Barcode:    barcode,
+		Name:       name,
+		Value:      *req.Value,
+		Unit:       strings.TrimSpace(req.Unit),
+		Passed:     req.Passed,
+		WorkflowID: req.WorkflowID,
+		StepIndex:  req.StepIndex,
+		Note:       req.Note,
+		MeasuredAt: measuredAt.UTC().Format(time.RFC3339Nano),
+		RecordedAt: now.Format(time.RFC3339Nano),
+	}, nil
+}
+
+func saveSampleResult(result *SampleResult) error {
+	id, err := redisClient.Incr(ctx, RESULT_SEQUENCE_KEY).Result()
+	if err != nil {
+		return err
+	}
+	result.ID = id
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	measuredAt, err := time.Parse(time.RFC3339Nano, result.MeasuredAt)
+	if err != nil {
+		return err
+	}
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, resultKey(id), data, 0)
+		pipe.ZAdd(ctx, sampleResultsKey(result.Barcode), redis.Z{Score: float64(measuredAt.UnixMilli()), Member: id})
+		return nil
+	})
+	return err
+}
+
+// listSampleResults returns a sample's results measured between from and
+// to, either of which may be zero, newest first.
+func listSampleResults(barcode string, from, to time.Time) ([]SampleResult, error) {
+	ids, err := redisClient.ZRevRangeByScore(ctx, sampleResultsKey(barcode), historyRange(from, to)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []SampleResult{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = RESULT_KEY_PREFIX + id
+	}
+	values, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SampleResult, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var result SampleResult
+		if err := json.Unmarshal([]byte(data), &result); err != nil {
+			log.Printf("Error decoding result %s: %v", ids[i], err)
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// recordSampleResultHandler records a measurement of an active sample.
+func recordSampleResultHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+	var req SampleResultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result, err := newSampleResult(barcode, req, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	result.Actor = requestActor(c)
+
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if sample == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+	if sample.Archived {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot record results for an archived sample"})
+		return
+	}
+
+	if err := saveSampleResult(result); err != nil {
+		log.Printf("Error saving result for sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save result"})
+		return
+	}
+	log.Printf("Recorded %s = %g %s for sample %s", result.Name, result.Value, result.Unit, barcode)
+	c.JSON(http.StatusCreated, result)
+}
+
+// listSampleResultsHandler returns a sample's results, newest first.
+// Filters: name, workflow_id, step_index, passed=true|false and from/to
+// (RFC 3339) on the time measured.
+func listSampleResultsHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	var from, to time.Time
+	if value := c.Query("from"); value != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	if value := c.Query("to"); value != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	var passed *bool
+	if value := c.Query("passed"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "passed must be true or false"})
+			return
+		}
+		passed = &parsed
+	}
+	stepIndex := -1
+	if value := c.Query("step_index"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "step_index must be a non-negative integer"})
+			return
+		}
+		stepIndex = n
+	}
+	limit := defaultResultLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxResultLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxResultLimit)})
+			return
+		}
+		limit = n
+	}
+	name := c.Query("name")
+	workflowID := c.Query("workflow_id")
+
+	sample, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if sample == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+
+	stored, err := listSampleResults(barcode, from, to)
+	if err != nil {
+		log.Printf("Error reading results for sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve results"})
+		return
+	}
+
+	results := []SampleResult{}
+	for _, result := range stored {
+		if name != "" && result.Name != name {
+			continue
+		}
+		if workflowID != "" && result.WorkflowID != workflowID {
+			continue
+		}
+		if stepIndex >= 0 && (result.StepIndex == nil || *result.StepIndex != stepIndex) {
+			continue
+		}
+		if passed != nil && (result.Passed == nil || *result.Passed != *passed) {
+			continue
+		}
+		results = append(results, result)
+		if len(results) == limit {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, SampleResultsResponse{Barcode: barcode, Count: len(results), Results: results})
+}
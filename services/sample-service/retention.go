@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Samples whose tracked volume is used up are archived SAMPLE_RETENTION (a
+// duration such as 720h) after they were last changed, by a janitor
+// running every RETENTION_CHECK_INTERVAL. Archived samples stay queryable
+// with their history; nothing is deleted. Samples with the
+// RETENTION_EXEMPT_TAG metadata key set to "true" are kept active. With
+// RETENTION_DRY_RUN=true the janitor only logs what it would archive.
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionExemptTag = "retain"
+)
+
+var (
+	sampleRetention    time.Duration
+	retentionDryRun    bool
+	retentionExemptTag = defaultRetentionExemptTag
+)
+
+// RetentionReport lists the samples a cleanup archived, or with DryRun
+// would have.
+type RetentionReport struct {
+	DryRun    bool     `json:"dry_run"`
+	Retention string   `json:"retention"`
+	Cutoff    string   `json:"cutoff"`
+	Expired   []string `json:"expired"`
+	Exempt    []string `json:"exempt"`
+}
+
+// retentionExpired reports whether a consumed sample was last changed
+// before the cutoff.
+func (s Sample) retentionExpired(cutoff time.Time) bool {
+	if s.Archived || !s.consumed() {
+		return false
+	}
+	changed := s.UpdatedAt
+	if changed == "" {
+		changed = s.CreatedAt
+	}
+	at, err := time.Parse(time.RFC3339, changed)
+	return err == nil && at.Before(cutoff)
+}
+
+// archiveConsumedSamples archives the consumed samples last changed before
+// the cutoff, unless dryRun is set. Samples changed meanwhile are left for
+// the next run.
+func archiveConsumedSamples(cutoff time.Time, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{
+		DryRun:    dryRun,
+		Retention: sampleRetention.String(),
+		Cutoff:    cutoff.Format(time.RFC3339),
+		Expired:   []string{},
+		Exempt:    []string{},
+	}
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Status: SampleStatusActive})
+	if err != nil {
+		return nil, err
+	}
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, stored := range samples {
+		if !stored.retentionExpired(cutoff) {
+			continue
+		}
+		if stored.Metadata[retentionExemptTag] == "true" {
+			report.Exempt = append(report.Exempt, stored.Barcode)
+			continue
+		}
+		if dryRun {
+			report.Expired = append(report.Expired, stored.Barcode)
+			continue
+		}
+
+		sample := stored
+		sample.Archived = true
+		sample.ArchivedAt = now
+		sample.UpdatedAt = now
+		audit := SampleAudit{
+			Action: SampleActionArchived,
+			Note:   "Consumed more than " + report.Retention + " ago",
+		}
+		if err := updateSample(&sample, stored, false, audit); err != nil {
+			var conflict *VersionConflictError
+			if !errors.As(err, &conflict) {
+				log.Printf("Error archiving sample %s: %v", stored.Barcode, err)
+			}
+			continue
+		}
+		report.Expired = append(report.Expired, stored.Barcode)
+	}
+	sort.Strings(report.Expired)
+	sort.Strings(report.Exempt)
+	return report, nil
+}
+
+// startRetentionJanitor archives consumed samples in the background if
+// SAMPLE_RETENTION is set.
+func startRetentionJanitor() {
+	if tag := strings.TrimSpace(os.Getenv("RETENTION_EXEMPT_TAG")); tag != "" {
+		retentionExemptTag = tag
+	}
+	retentionDryRun = os.Getenv("RETENTION_DRY_RUN") == "true"
+	value := os.Getenv("SAMPLE_RETENTION")
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid SAMPLE_RETENTION %q", value)
+	}
+	sampleRetention = d
+	interval := defaultRetentionInterval
+	if value := os.Getenv("RETENTION_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RETENTION_CHECK_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report, err := archiveConsumedSamples(time.Now().Add(-sampleRetention), retentionDryRun)
+			switch {
+			case err != nil:
+				log.Printf("Error archiving consumed samples: %v", err)
+			case report.DryRun && len(report.Expired) > 0:
+				log.Printf("Retention dry run: would archive %d consumed sample(s) last changed before %s: %s", len(report.Expired), report.Cutoff, strings.Join(report.Expired, ", "))
+			case len(report.Expired) > 0:
+				log.Printf("Archived %d consumed sample(s) last changed before %s", len(report.Expired), report.Cutoff)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Archiving consumed samples %s after their last change, checking every %s (dry run: %t)", sampleRetention, interval, retentionDryRun)
+}
+
+// retentionReportHandler reports which samples the retention policy would
+// archive now, changing nothing. ?older_than=<duration> tries another
+// retention.
+func retentionReportHandler(c *gin.Context) {
+	if !requireServiceAdmin(c) {
+		return
+	}
+	retention := sampleRetention
+	if value := c.Query("older_than"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "older_than must be a positive duration such as 720h"})
+			return
+		}
+		retention = d
+	}
+	if retention == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "SAMPLE_RETENTION is not set; give older_than"})
+		return
+	}
+
+	report, err := archiveConsumedSamples(time.Now().Add(-retention), true)
+	if err != nil {
+		log.Printf("Error checking sample retention: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check sample retention"})
+		return
+	}
+	report.Retention = retention.String()
+	c.JSON(http.StatusOK, report)
+}
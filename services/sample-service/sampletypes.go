@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Sample types are stored under sample-type:<name>, with every name in the
+// sorted set sample-types:all.
+const (
+	SAMPLE_TYPE_KEY_PREFIX = "sample-type:"
+	SAMPLE_TYPES_ALL_KEY   = "sample-types:all"
+)
+
+// StorageConditions are how samples of a type should be kept. A shelf life
+// sets the expiry of new samples that don't give one.
+type StorageConditions struct {
+	TemperatureC  *float64 `json:"temperature_c,omitempty"`
+	Condition     string   `json:"condition,omitempty"`
+	ShelfLifeDays int      `json:"shelf_life_days,omitempty"`
+}
+
+// SampleType is an allowed sample type. Samples of the type must have the
+// required metadata fields; handling lists rules for people working with
+// them, such as "biohazard" or "keep on ice".
+type SampleType struct {
+	Name             string            `json:"name"`
+	Description      string            `json:"description,omitempty"`
+	RequiredMetadata []string          `json:"required_metadata"`
+	Storage          StorageConditions `json:"storage"`
+	Handling         []string          `json:"handling"`
+	CreatedAt        string            `json:"created_at"`
+	UpdatedAt        string            `json:"updated_at,omitempty"`
+}
+
+type SampleTypeRequest struct {
+	Name             string            `json:"name"`
+	Description      string            `json:"description"`
+	RequiredMetadata []string          `json:"required_metadata"`
+	Storage          StorageConditions `json:"storage"`
+	Handling         []string          `json:"handling"`
+}
+
+func sampleTypeKey(name string) string {
+	return SAMPLE_TYPE_KEY_PREFIX + name
+}
+
+// sampleTypes caches the registry, by name, under "".
+var sampleTypes = newReadCache("sample-types")
+
+// sampleTypeRegistry returns every registered type, by name. The map is
+// shared, so it must not be changed.
+func sampleTypeRegistry() (map[string]SampleType, error) {
+	registry, err := sampleTypes.get("", func() (interface{}, error) {
+		names, err := redisClient.ZRange(ctx, SAMPLE_TYPES_ALL_KEY, 0, -1).Result()
+		if err != nil || len(names) == 0 {
+			return map[string]SampleType{}, err
+		}
+		keys := make([]string, len(names))
+		for i, name := range names {
+			keys[i] = sampleTypeKey(name)
+		}
+		values, err := redisClient.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		registry := make(map[string]SampleType, len(names))
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var sampleType SampleType
+			if err := json.Unmarshal([]byte(data), &sampleType); err != nil {
+				log.Printf("Invalid sample type %s: %v", names[i], err)
+				continue
+			}
+			registry[names[i]] = sampleType
+		}
+		return registry, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return registry.(map[string]SampleType), nil
+}
+
+func getSampleType(name string) (*SampleType, error) {
+	registry, err := sampleTypeRegistry()
+	if err != nil {
+		return nil, err
+	}
+	sampleType, ok := registry[name]
+	if !ok {
+		return nil, nil
+	}
+	return &sampleType, nil
+}
+
+func putSampleType(pipe redis.Pipeliner, sampleType SampleType) error {
+	data, err := json.Marshal(sampleType)
+	if err != nil {
+		return err
+	}
+	pipe.Set(ctx, sampleTypeKey(sampleType.Name), data, 0)
+	pipe.ZAdd(ctx, SAMPLE_TYPES_ALL_KEY, redis.Z{Score: 0, Member: sampleType.Name})
+	return nil
+}
+
+var errSampleTypeExists = errors.New("sample type already exists")
+
+// createSampleType stores a new type, failing with errSampleTypeExists if
+// the name is taken.
+func createSampleType(sampleType SampleType) error {
+	key := sampleTypeKey(sampleType.Name)
+	err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errSampleTypeExists
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return putSampleType(pipe, sampleType)
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return errSampleTypeExists
+	}
+	if err == nil {
+		sampleTypes.invalidate()
+	}
+	return err
+}
+
+// SampleTypeValidator checks samples against the type registry, caching
+// the types it has read.
+type SampleTypeValidator struct {
+	types map[string]*SampleType
+}
+
+func newSampleTypeValidator() *SampleTypeValidator {
+	return &SampleTypeValidator{types: map[string]*SampleType{}}
+}
+
+func (v *SampleTypeValidator) lookup(name string) (*SampleType, *SampleError) {
+	sampleType, ok := v.types[name]
+	if !ok {
+		var err error
+		sampleType, err = getSampleType(name)
+		if err != nil {
+			log.Printf("Error getting sample type %s: %v", name, err)
+			return nil, &SampleError{StatusCode: http.StatusInternalServerError, Message: "Failed to retrieve sample type"}
+		}
+		v.types[name] = sampleType
+	}
+	if sampleType == nil {
+		return nil, &SampleError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("sample type %s is not registered", name)}
+	}
+	return sampleType, nil
+}
+
+// CheckType checks that a type is registered; samples without a type are
+// allowed.
+func (v *SampleTypeValidator) CheckType(name string) *SampleError {
+	if name == "" {
+		return nil
+	}
+	_, err := v.lookup(name)
+	return err
+}
+
+// Validate checks a sample's type and required metadata.
+func (v *SampleTypeValidator) Validate(sample Sample) *SampleError {
+	if sample.Type == "" {
+		return nil
+	}
+	sampleType, err := v.lookup(sample.Type)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, field := range sampleType.RequiredMetadata {
+		if strings.TrimSpace(sample.Metadata[field]) == "" {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		return &SampleError{
+			StatusCode: http.StatusBadRequest,
+			Message:    fmt.Sprintf("%s samples require metadata %s", sample.Type, strings.Join(missing, ", ")),
+		}
+	}
+	return nil
+}
+
+// ApplyDefaults sets the expiry of a new sample from its type's shelf life
+// if none was given.
+func (v *SampleTypeValidator) ApplyDefaults(sample *Sample) {
+	if sample.Type == "" || sample.ExpiresAt != "" {
+		return
+	}
+	sampleType, err := v.lookup(sample.Type)
+	if err != nil || sampleType.Storage.ShelfLifeDays <= 0 {
+		return
+	}
+	created, parseErr := time.Parse(time.RFC3339, sample.CreatedAt)
+	if parseErr != nil {
+		created = time.Now().UTC()
+	}
+	sample.ExpiresAt = created.AddDate(0, 0, sampleType.Storage.ShelfLifeDays).UTC().Format(time.RFC3339)
+	sample.refreshExpired(time.Now())
+}
+
+// registerSampleTypes creates a registry entry for every type that samples
+// use but that was never registered, as happens with samples saved before
+// the registry existed.
+func registerSampleTypes() error {
+	names, err := sampleStore.Types()
+	if err != nil {
+		return err
+	}
+	registered := 0
+	for _, name := range names {
+		err := createSampleType(SampleType{
+			Name:             name,
+			RequiredMetadata: []string{},
+			Handling:         []string{},
+			CreatedAt:        time.Now().UTC().Format(time.RFC3339),
+		})
+		if err == errSampleTypeExists {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		registered++
+	}
+	if registered > 0 {
+		log.Printf("Registered %d sample type(s) used by existing samples", registered)
+	}
+	return nil
+}
+
+// sampleTypeFromRequest validates a request into a type.
+func sampleTypeFromRequest(req SampleTypeRequest) (SampleType, error) {
+	sampleType := SampleType{
+		Name:             strings.TrimSpace(req.Name),
+		Description:      req.Description,
+		RequiredMetadata: []string{},
+		Storage:          req.Storage,
+		Handling:         []string{},
+	}
+	if sampleType.Name == "" {
+		return sampleType, errors.New("name is required")
+	}
+	if len(sampleType.Name) > maxSampleTypeLength {
+		return sampleType, fmt.Errorf("name must be at most %d characters", maxSampleTypeLength)
+	}
+	if sampleType.Storage.ShelfLifeDays < 0 {
+		return sampleType, errors.New("shelf_life_days must not be negative")
+	}
+	seen := map[string]bool{}
+	for _, field := range req.RequiredMetadata {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			return sampleType, errors.New("required_metadata must not contain empty fields")
+		}
+		if !seen[field] {
+			seen[field] = true
+			sampleType.RequiredMetadata = append(sampleType.RequiredMetadata, field)
+		}
+	}
+	for _, rule := range req.Handling {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			sampleType.Handling = append(sampleType.Handling, rule)
+		}
+	}
+	return sampleType, nil
+}
+
+func listSampleTypesHandler(c *gin.Context) {
+	registry, err := sampleTypeRegistry()
+	if err != nil {
+		log.Printf("Error listing sample types: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample types"})
+		return
+	}
+
+	types := make([]SampleType, 0, len(registry))
+	for _, sampleType := range registry {
+		types = append(types, sampleType)
+	}
+	sort.Slice(types, func(a, b int) bool { return types[a].Name < types[b].Name })
+	c.JSON(http.StatusOK, types)
+}
+
+func createSampleTypeHandler(c *gin.Context) {
+	if !requireDefaultLab(c) {
+		return
+	}
+	var req SampleTypeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sampleType, err := sampleTypeFromRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sampleType.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if err := createSampleType(sampleType); err != nil {
+		if err == errSampleTypeExists {
+			c.JSON(http.StatusConflict, gin.H{"error": "Sample type already exists"})
+			return
+		}
+		log.Printf("Error saving sample type %s: %v", sampleType.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sample type"})
+		return
+	}
+
+	log.Printf("Sample type %s created", sampleType.Name)
+	c.JSON(http.StatusCreated, sampleType)
+}
+
+// loadSampleType reads the type named in the URL, writing an error response
+// if that fails.
+func loadSampleType(c *gin.Context) (*SampleType, bool) {
+	name := c.Param("name")
+	sampleType, err := getSampleType(name)
+	if err != nil {
+		log.Printf("Error getting sample type %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample type"})
+		return nil, false
+	}
+	if sampleType == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample type not found"})
+		return nil, false
+	}
+	return sampleType, true
+}
+
+func getSampleTypeHandler(c *gin.Context) {
+	sampleType, ok := loadSampleType(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sampleType)
+}
+
+// updateSampleTypeHandler replaces a type's definition. Existing samples
+// are not rechecked against new required metadata.
+func updateSampleTypeHandler(c *gin.Context) {
+	if !requireDefaultLab(c) {
+		return
+	}
+	stored, ok := loadSampleType(c)
+	if !ok {
+		return
+	}
+
+	var req SampleTypeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Name = stored.Name
+	sampleType, err := sampleTypeFromRequest(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sampleType.CreatedAt = stored.CreatedAt
+	sampleType.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		return putSampleType(pipe, sampleType)
+	})
+	if err != nil {
+		log.Printf("Error saving sample type %s: %v", sampleType.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sample type"})
+		return
+	}
+	sampleTypes.invalidate()
+
+	log.Printf("Sample type %s updated", sampleType.Name)
+	c.JSON(http.StatusOK, sampleType)
+}
+
+// deleteSampleTypeHandler removes a type no sample uses.
+func deleteSampleTypeHandler(c *gin.Context) {
+	if !requireDefaultLab(c) {
+		return
+	}
+	sampleType, ok := loadSampleType(c)
+	if !ok {
+		return
+	}
+
+	inUse, err := sampleStore.Count(SampleFilter{Type: sampleType.Name, Status: sampleStatusAny})
+	if err != nil {
+		log.Printf("Error counting samples of type %s: %v", sampleType.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete sample type"})
+		return
+	}
+	if inUse > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Sample type is used by %d sample(s)", inUse)})
+		return
+	}
+
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sampleTypeKey(sampleType.Name))
+		pipe.ZRem(ctx, SAMPLE_TYPES_ALL_KEY, sampleType.Name)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error deleting sample type %s: %v", sampleType.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete sample type"})
+		return
+	}
+	sampleTypes.invalidate()
+
+	log.Printf("Sample type %s deleted", sampleType.Name)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Samples are stored as JSON documents marked with the schema_version they
+// were written at; those written before versioning have none and are at
+// version 0. Older documents are upgraded by sampleRecordMigrations as they
+// are read, so the Sample struct only decodes the current layout, and every
+// write stores the current version. POST /samples/migrate rewrites the
+// samples still stored at an older version.
+//
+// Add a migration to the end when changing how samples are stored; never
+// edit one that has been released.
+var sampleRecordMigrations = []func(record map[string]interface{}) error{
+	// 1: documents are marked with their schema version; the layout is
+	// unchanged.
+	func(record map[string]interface{}) error { return nil },
+}
+
+// sampleSchemaVersion is the schema version samples are written at.
+var sampleSchemaVersion = len(sampleRecordMigrations)
+
+// upgradeRecord applies the migrations a stored JSON document needs and
+// returns it at the latest version, with the version it was stored at.
+func upgradeRecord(data []byte, migrations []func(record map[string]interface{}) error) ([]byte, int, error) {
+	var stored struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, 0, err
+	}
+	if stored.SchemaVersion == len(migrations) {
+		return data, stored.SchemaVersion, nil
+	}
+	if stored.SchemaVersion < 0 || stored.SchemaVersion > len(migrations) {
+		return nil, 0, fmt.Errorf("schema version %d is not supported; the latest is %d", stored.SchemaVersion, len(migrations))
+	}
+
+	// Numbers are kept as written, so large versions and counts survive.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var record map[string]interface{}
+	if err := decoder.Decode(&record); err != nil {
+		return nil, 0, err
+	}
+	for version := stored.SchemaVersion + 1; version <= len(migrations); version++ {
+		if err := migrations[version-1](record); err != nil {
+			return nil, 0, fmt.Errorf("schema migration %d: %w", version, err)
+		}
+	}
+	record["schema_version"] = len(migrations)
+	upgraded, err := json.Marshal(record)
+	if err != nil {
+		return nil, 0, err
+	}
+	return upgraded, stored.SchemaVersion, nil
+}
+
+// decodeSample reads a stored sample, upgrading it to the current schema.
+// Its SchemaVersion is left at the version it was stored at, so samples
+// still to be rewritten can be found.
+func decodeSample(data []byte) (Sample, error) {
+	var sample Sample
+	upgraded, version, err := upgradeRecord(data, sampleRecordMigrations)
+	if err != nil {
+		return sample, err
+	}
+	if err := json.Unmarshal(upgraded, &sample); err != nil {
+		return sample, err
+	}
+	sample.SchemaVersion = version
+	return sample, nil
+}
+
+// encodeSample returns a sample as it is stored, at the current schema
+// version and without the computed Expired flag.
+func encodeSample(sample Sample) ([]byte, error) {
+	sample.Expired = false
+	sample.SchemaVersion = sampleSchemaVersion
+	return json.Marshal(sample)
+}
+
+// MigrationReport lists the samples stored at an older schema version that
+// a migration rewrote, or would rewrite on a dry run.
+type MigrationReport struct {
+	DryRun        bool     `json:"dry_run"`
+	SchemaVersion int      `json:"schema_version"`
+	Migrated      []string `json:"migrated"`
+}
+
+// migrateSamples rewrites every sample stored at an older schema version,
+// recording it in the sample's history. A sample changed meanwhile has
+// already been written at the current version and is left alone.
+func migrateSamples(actor string, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{DryRun: dryRun, SchemaVersion: sampleSchemaVersion, Migrated: []string{}}
+	barcodes, err := sampleStore.Barcodes(SampleFilter{})
+	if err != nil {
+		return nil, err
+	}
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stored := range samples {
+		if stored.SchemaVersion >= sampleSchemaVersion {
+			continue
+		}
+		if dryRun {
+			report.Migrated = append(report.Migrated, stored.Barcode)
+			continue
+		}
+		sample := stored
+		audit := SampleAudit{
+			Action: SampleActionMigrated,
+			Actor:  actor,
+			Note:   fmt.Sprintf("Schema version %d to %d", stored.SchemaVersion, sampleSchemaVersion),
+		}
+		if err := updateSample(&sample, stored, true, audit); err != nil {
+			var conflict *VersionConflictError
+			if errors.As(err, &conflict) {
+				continue
+			}
+			return nil, err
+		}
+		report.Migrated = append(report.Migrated, stored.Barcode)
+	}
+	return report, nil
+}
+
+// migrateSamplesHandler rewrites the samples stored at an older schema
+// version; ?dry_run=true only lists them.
+func migrateSamplesHandler(c *gin.Context) {
+	if !requireServiceAdmin(c) {
+		return
+	}
+	report, err := migrateSamples(requestActor(c), c.Query("dry_run") == "true")
+	if err != nil {
+		log.Printf("Error migrating samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to migrate samples"})
+		return
+	}
+	if !report.DryRun {
+		log.Printf("Migrated %d sample(s) to schema version %d", len(report.Migrated), report.SchemaVersion)
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSampleLimit = 100
+	maxSampleLimit     = 1000
+)
+
+// SampleFilter selects samples for the list and export endpoints. Type,
+// plate, storage, status and created_after are answered by the sample
+// store's indexes; q and metadata are matched against the loaded samples.
+type SampleFilter struct {
+	Type         string
+	Plate        string
+	Storage      string
+	Status       string
+	CreatedAfter *time.Time
+	Query        string
+	Metadata     map[string]string
+	// Projects, unless nil, limits the samples to those of the projects.
+	Projects []string
+	// Lab, unless nil, limits the samples to those of the lab.
+	Lab *string
+}
+
+type SampleListResponse struct {
+	Samples []Sample `json:"samples"`
+	Total   int      `json:"total"`
+	Limit   int      `json:"limit"`
+	Offset  int      `json:"offset"`
+}
+
+// sampleFilterFromQuery reads the filter parameters. Archived samples are
+// hidden unless status=archived or all is given; include_archived=true is
+// kept as an alias for status=all.
+func sampleFilterFromQuery(c *gin.Context) (SampleFilter, error) {
+	filter := SampleFilter{
+		Type:     c.Query("type"),
+		Plate:    c.Query("plate"),
+		Storage:  c.Query("storage"),
+		Status:   c.Query("status"),
+		Query:    strings.ToLower(strings.TrimSpace(c.Query("q"))),
+		Metadata: c.QueryMap("metadata"),
+	}
+	if project := c.Query("project"); project != "" {
+		filter.Projects = []string{project}
+	}
+	access := requestAccess(c)
+	filter.Projects = access.restrict(filter.Projects)
+	filter.Lab = &access.Lab
+
+	switch filter.Status {
+	case "":
+		filter.Status = SampleStatusActive
+		if c.Query("include_archived") == "true" {
+			filter.Status = "all"
+		}
+	case SampleStatusActive, SampleStatusArchived, "all":
+	default:
+		return filter, errors.New("status must be active, archived or all")
+	}
+
+	if value := c.Query("created_after"); value != "" {
+		createdAfter, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("created_after must be an RFC 3339 timestamp")
+		}
+		filter.CreatedAfter = &createdAfter
+	}
+	return filter, nil
+}
+
+// indexKeys lists the Redis index sets a matching sample must be in.
+func (f SampleFilter) indexKeys() []string {
+	keys := []string{}
+	if f.Status != "all" && f.Status != sampleStatusAny {
+		keys = append(keys, statusIndexKey(f.Status))
+	}
+	if f.Type != "" {
+		keys = append(keys, typeIndexKey(f.Type))
+	}
+	if f.Plate != "" {
+		keys = append(keys, plateIndexKey(f.Plate))
+	}
+	if f.Storage != "" {
+		keys = append(keys, storageIndexKey(f.Storage))
+	}
+	if f.Lab != nil {
+		keys = append(keys, labIndexKey(*f.Lab))
+	}
+	return keys
+}
+
+// needsSamples reports whether the filter has parts that are matched
+// against the loaded samples rather than the indexes.
+func (f SampleFilter) needsSamples() bool {
+	return f.Query != "" || len(f.Metadata) > 0
+}
+
+// matches applies the parts of the filter not answered by the indexes.
+func (f SampleFilter) matches(sample Sample) bool {
+	for key, value := range f.Metadata {
+		if stored, ok := sample.Metadata[key]; !ok || stored != value {
+			return false
+		}
+	}
+	return f.Query == "" ||
+		strings.Contains(strings.ToLower(sample.Barcode), f.Query) ||
+		strings.Contains(strings.ToLower(sample.Name), f.Query)
+}
+
+// findSamples returns one page of matching samples and the total number of
+// matches. Without q or metadata filters only the requested page is loaded.
+func findSamples(filter SampleFilter, limit, offset int) ([]Sample, int, error) {
+	barcodes, err := sampleStore.Barcodes(filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !filter.needsSamples() {
+		total := len(barcodes)
+		if offset >= total {
+			return []Sample{}, total, nil
+		}
+		end := offset + limit
+		if end > total {
+			end = total
+		}
+		samples, err := getSamples(barcodes[offset:end])
+		return samples, total, err
+	}
+
+	page := []Sample{}
+	total := 0
+	err = eachSampleBatch(barcodes, func(samples []Sample) error {
+		for _, sample := range samples {
+			if !filter.matches(sample) {
+				continue
+			}
+			if total >= offset && len(page) < limit {
+				page = append(page, sample)
+			}
+			total++
+		}
+		return nil
+	})
+	return page, total, err
+}
+
+func paginationFromQuery(c *gin.Context) (int, int, error) {
+	limit := defaultSampleLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxSampleLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxSampleLimit)
+		}
+		limit = n
+	}
+
+	offset := 0
+	if value := c.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+func listSamplesHandler(c *gin.Context) {
+	filter, err := sampleFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, offset, err := paginationFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	samples, total, err := findSamples(filter, limit, offset)
+	if err != nil {
+		log.Printf("Error getting samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+		return
+	}
+
+	c.JSON(http.StatusOK, SampleListResponse{
+		Samples: samples,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
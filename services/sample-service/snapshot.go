@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A snapshot is every lab's samples, deleted ones included, in one
+// versioned JSON document, to be restored into a fresh environment.
+// Histories, results and attachments are left out; each restored sample's
+// history starts with a "restored" entry.
+const (
+	SNAPSHOT_SERVICE = "sample-service"
+	SNAPSHOT_VERSION = 1
+)
+
+type SampleSnapshot struct {
+	Service   string   `json:"service"`
+	Version   int      `json:"version"`
+	CreatedAt string   `json:"created_at"`
+	Samples   []Sample `json:"samples"`
+}
+
+// validate checks a snapshot holds well-formed samples of this service,
+// and that every sample they refer to is in the snapshot or already
+// stored.
+func (snapshot SampleSnapshot) validate() error {
+	if snapshot.Service != SNAPSHOT_SERVICE {
+		return fmt.Errorf("snapshot is of %q, not %s", snapshot.Service, SNAPSHOT_SERVICE)
+	}
+	if snapshot.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("snapshot version %d is not supported; expected %d", snapshot.Version, SNAPSHOT_VERSION)
+	}
+
+	barcodes := map[string]bool{}
+	for _, sample := range snapshot.Samples {
+		if sample.Barcode == "" {
+			return fmt.Errorf("a sample has no barcode")
+		}
+		if barcodes[sample.Barcode] {
+			return fmt.Errorf("sample %s appears twice", sample.Barcode)
+		}
+		barcodes[sample.Barcode] = true
+		if !validLab(sample.Lab) {
+			return fmt.Errorf("sample %s has invalid lab %q", sample.Barcode, sample.Lab)
+		}
+	}
+
+	var missing []string
+	for _, sample := range snapshot.Samples {
+		references := append(append([]string{sample.MergedInto}, sample.MergedFrom...), sample.parents()...)
+		for _, barcode := range references {
+			if barcode != "" && !barcodes[barcode] {
+				missing = append(missing, barcode)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	stored, err := getSamples(missing)
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for _, sample := range stored {
+		found[sample.Barcode] = true
+	}
+	for _, barcode := range missing {
+		if !found[barcode] {
+			return fmt.Errorf("sample %s is referred to but not in the snapshot", barcode)
+		}
+	}
+	return nil
+}
+
+// getSnapshotHandler returns every lab's samples as a snapshot.
+func getSnapshotHandler(c *gin.Context) {
+	if !requireServiceAdmin(c) {
+		return
+	}
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Status: sampleStatusAny})
+	if err != nil {
+		log.Printf("Error listing samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to take snapshot"})
+		return
+	}
+	samples, err := sampleStore.GetMany(barcodes)
+	if err != nil {
+		log.Printf("Error getting samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to take snapshot"})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="samples-%s.json"`, time.Now().UTC().Format("20060102T150405Z")))
+	c.JSON(http.StatusOK, SampleSnapshot{
+		Service:   SNAPSHOT_SERVICE,
+		Version:   SNAPSHOT_VERSION,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Samples:   samples,
+	})
+}
+
+// restoreSnapshotHandler writes a snapshot's samples in one transaction,
+// replacing stored samples with the same barcodes, after checking the
+// whole snapshot.
+func restoreSnapshotHandler(c *gin.Context) {
+	if !requireServiceAdmin(c) {
+		return
+	}
+	var snapshot SampleSnapshot
+	if err := c.ShouldBindJSON(&snapshot); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot: " + err.Error()})
+		return
+	}
+	if err := snapshot.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	barcodes := make([]string, len(snapshot.Samples))
+	for i, sample := range snapshot.Samples {
+		barcodes[i] = sample.Barcode
+	}
+	audit := SampleAudit{
+		Action: SampleActionRestored,
+		Actor:  requestActor(c),
+		Note:   "Restored from a snapshot taken at " + snapshot.CreatedAt,
+	}
+	err := sampleStore.Update(func(tx SampleTx) error {
+		stored, err := tx.GetMany(barcodes)
+		if err != nil {
+			return err
+		}
+		previous := make(map[string]Sample, len(stored))
+		for _, sample := range stored {
+			previous[sample.Barcode] = sample
+		}
+		for _, sample := range snapshot.Samples {
+			write := SampleWrite{Sample: sample, Audit: audit}
+			if stored, ok := previous[sample.Barcode]; ok {
+				write.Previous = &stored
+			}
+			tx.Put(write)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error restoring snapshot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore snapshot"})
+		return
+	}
+
+	// Restored samples may be on plates and of types not registered here.
+	if err := registerSamplePlates(); err != nil {
+		log.Printf("Error registering plates of restored samples: %v", err)
+	}
+	if err := registerSampleTypes(); err != nil {
+		log.Printf("Error registering types of restored samples: %v", err)
+	}
+
+	log.Printf("Restored snapshot of %d samples taken at %s", len(snapshot.Samples), snapshot.CreatedAt)
+	c.JSON(http.StatusOK, gin.H{"restored": len(snapshot.Samples)})
+}
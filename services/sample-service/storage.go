@@ -0,0 +1,441 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Storage locations are stored under storage:<id>, with every ID in the
+// sorted set storage:all and the children of each location in
+// storage:children:<id>.
+const (
+	STORAGE_KEY_PREFIX          = "storage:"
+	STORAGE_ALL_KEY             = "storage:all"
+	STORAGE_CHILDREN_KEY_PREFIX = "storage:children:"
+)
+
+// defaultStorageHierarchy lists the storage levels from the outside in.
+// Samples are placed at numbered positions in the innermost level.
+var defaultStorageHierarchy = []string{"freezer", "shelf", "rack", "box"}
+
+// storageHierarchy is the configured list of levels; set with
+// STORAGE_HIERARCHY as a comma-separated list.
+var storageHierarchy = defaultStorageHierarchy
+
+// StorageLocation is one level of the storage hierarchy. Capacity bounds
+// the number of child locations, or the number of sample positions for
+// the innermost level; 0 means unlimited and is not allowed for the
+// innermost level.
+type StorageLocation struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Kind      string `json:"kind"`
+	ParentID  string `json:"parent_id,omitempty"`
+	Capacity  int    `json:"capacity"`
+	Lab       string `json:"lab,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+type CreateStorageLocationRequest struct {
+	ID       string `json:"id" binding:"required"`
+	Name     string `json:"name"`
+	Kind     string `json:"kind" binding:"required"`
+	ParentID string `json:"parent_id"`
+	Capacity int    `json:"capacity"`
+}
+
+// StorageLocationResponse is a storage location with its path from the
+// outermost level, its children and, for the innermost level, the
+// positions holding samples.
+type StorageLocationResponse struct {
+	StorageLocation
+	Path      []string            `json:"path"`
+	Children  []string            `json:"children"`
+	Used      int                 `json:"used"`
+	Free      *int                `json:"free,omitempty"`
+	Positions map[string][]string `json:"positions,omitempty"`
+}
+
+func storageKey(id string) string {
+	return STORAGE_KEY_PREFIX + id
+}
+
+func storageChildrenKey(id string) string {
+	return STORAGE_CHILDREN_KEY_PREFIX + id
+}
+
+func storageIndexKey(storageID string) string {
+	return fmt.Sprintf("samples:storage:%s", storageID)
+}
+
+func positionIndexKey(storageID, position string) string {
+	return fmt.Sprintf("samples:position:%s:%s", storageID, position)
+}
+
+// loadStorageHierarchy reads STORAGE_HIERARCHY, if set.
+func loadStorageHierarchy() {
+	value := os.Getenv("STORAGE_HIERARCHY")
+	if value == "" {
+		return
+	}
+	levels := []string{}
+	seen := map[string]bool{}
+	for _, level := range strings.Split(value, ",") {
+		level = strings.ToLower(strings.TrimSpace(level))
+		if level == "" || seen[level] {
+			log.Fatalf("Invalid STORAGE_HIERARCHY %q", value)
+		}
+		seen[level] = true
+		levels = append(levels, level)
+	}
+	storageHierarchy = levels
+	log.Printf("Storage hierarchy: %s", strings.Join(storageHierarchy, " > "))
+}
+
+// storageLevel returns the depth of a kind in the hierarchy, or -1 if the
+// kind is not part of it.
+func storageLevel(kind string) int {
+	for i, level := range storageHierarchy {
+		if level == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l StorageLocation) holdsSamples() bool {
+	return storageLevel(l.Kind) == len(storageHierarchy)-1
+}
+
+// normalizePosition checks a position against the location's capacity and
+// returns it in canonical form, so "03" becomes "3".
+func (l StorageLocation) normalizePosition(position string) (string, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(position))
+	if err != nil || n < 1 || n > l.Capacity {
+		return "", fmt.Errorf("position %s is not in %s %s (positions 1-%d)", position, l.Kind, l.ID, l.Capacity)
+	}
+	return strconv.Itoa(n), nil
+}
+
+func getStorageLocation(id string) (*StorageLocation, error) {
+	data, err := redisClient.Get(ctx, storageKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var location StorageLocation
+	if err := json.Unmarshal([]byte(data), &location); err != nil {
+		return nil, err
+	}
+	return &location, nil
+}
+
+var errStorageLocationExists = errors.New("storage location already exists")
+
+// errParentFull is returned when the parent has no capacity left.
+var errParentFull = errors.New("parent storage location is full")
+
+// createStorageLocation stores a new location and links it to its parent,
+// failing if the ID is taken or the parent is full.
+func createStorageLocation(location StorageLocation, parent *StorageLocation) error {
+	key := storageKey(location.ID)
+	keys := []string{key}
+	if parent != nil {
+		keys = append(keys, storageChildrenKey(parent.ID))
+	}
+
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		err = redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			exists, err := tx.Exists(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			if exists > 0 {
+				return errStorageLocationExists
+			}
+			if parent != nil && parent.Capacity > 0 {
+				children, err := tx.SCard(ctx, storageChildrenKey(parent.ID)).Result()
+				if err != nil {
+					return err
+				}
+				if int(children) >= parent.Capacity {
+					return errParentFull
+				}
+			}
+
+			data, err := json.Marshal(location)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, data, 0)
+				pipe.ZAdd(ctx, STORAGE_ALL_KEY, redis.Z{Score: 0, Member: location.ID})
+				if parent != nil {
+					pipe.SAdd(ctx, storageChildrenKey(parent.ID), location.ID)
+				}
+				return nil
+			})
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+// storagePath lists the IDs from the outermost location down to id.
+func storagePath(location StorageLocation) ([]string, error) {
+	path := []string{location.ID}
+	for parentID := location.ParentID; parentID != "" && len(path) <= len(storageHierarchy); {
+		parent, err := getStorageLocation(parentID)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			break
+		}
+		path = append([]string{parent.ID}, path...)
+		parentID = parent.ParentID
+	}
+	return path, nil
+}
+
+// storagePositions maps each occupied position to the active samples in it.
+func storagePositions(storageID string) (map[string][]string, error) {
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Storage: storageID, Status: SampleStatusActive})
+	if err != nil {
+		return nil, err
+	}
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	positions := map[string][]string{}
+	for _, sample := range samples {
+		if sample.Archived || sample.Location.Storage != storageID || sample.Location.Position == "" {
+			continue
+		}
+		positions[sample.Location.Position] = append(positions[sample.Location.Position], sample.Barcode)
+	}
+	for _, positionSamples := range positions {
+		sort.Strings(positionSamples)
+	}
+	return positions, nil
+}
+
+func storageLocationResponse(location StorageLocation) (StorageLocationResponse, error) {
+	response := StorageLocationResponse{StorageLocation: location}
+
+	path, err := storagePath(location)
+	if err != nil {
+		return response, err
+	}
+	response.Path = path
+
+	children, err := redisClient.SMembers(ctx, storageChildrenKey(location.ID)).Result()
+	if err != nil {
+		return response, err
+	}
+	sort.Strings(children)
+	response.Children = children
+	response.Used = len(children)
+
+	if location.holdsSamples() {
+		positions, err := storagePositions(location.ID)
+		if err != nil {
+			return response, err
+		}
+		response.Positions = positions
+		response.Used = len(positions)
+	}
+	if location.Capacity > 0 {
+		free := location.Capacity - response.Used
+		response.Free = &free
+	}
+	return response, nil
+}
+
+// validateStorage checks a storage placement: the location must exist and
+// be of the innermost level, and the position must be within its capacity.
+func (v *LocationValidator) validateStorage(location Location) (Location, *SampleError) {
+	if location.Plate != "" || strings.TrimSpace(location.Well) != "" {
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: "a sample is either on a plate or in storage, not both"}
+	}
+	location.Storage = strings.TrimSpace(location.Storage)
+	if location.Storage == "" {
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: "position given without a storage location"}
+	}
+
+	storage, ok := v.storage[location.Storage]
+	if !ok {
+		var err error
+		storage, err = getStorageLocation(location.Storage)
+		if err != nil {
+			log.Printf("Error getting storage location %s: %v", location.Storage, err)
+			return location, &SampleError{StatusCode: http.StatusInternalServerError, Message: "Failed to retrieve storage location"}
+		}
+		v.storage[location.Storage] = storage
+	}
+	if storage == nil || storage.Lab != v.lab {
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("storage location %s does not exist", location.Storage)}
+	}
+	if !storage.holdsSamples() {
+		leaf := storageHierarchy[len(storageHierarchy)-1]
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("samples can only be stored in a %s, and %s is a %s", leaf, storage.ID, storage.Kind)}
+	}
+	if strings.TrimSpace(location.Position) == "" {
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: fmt.Sprintf("a position is required in %s %s", storage.Kind, storage.ID)}
+	}
+
+	position, err := storage.normalizePosition(location.Position)
+	if err != nil {
+		return location, &SampleError{StatusCode: http.StatusBadRequest, Message: err.Error()}
+	}
+	location.Position = position
+	return location, nil
+}
+
+func createStorageLocationHandler(c *gin.Context) {
+	var req CreateStorageLocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id and kind are required"})
+		return
+	}
+
+	location := StorageLocation{
+		ID:        strings.TrimSpace(req.ID),
+		Name:      req.Name,
+		Kind:      strings.ToLower(strings.TrimSpace(req.Kind)),
+		ParentID:  strings.TrimSpace(req.ParentID),
+		Capacity:  req.Capacity,
+		Lab:       requestAccess(c).Lab,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if location.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "id and kind are required"})
+		return
+	}
+	level := storageLevel(location.Kind)
+	if level < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("kind must be one of %s", strings.Join(storageHierarchy, ", "))})
+		return
+	}
+	if location.Capacity < 0 || (location.holdsSamples() && location.Capacity == 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("capacity must be positive for a %s", location.Kind)})
+		return
+	}
+
+	var parent *StorageLocation
+	if location.ParentID != "" {
+		var err error
+		parent, err = getStorageLocation(location.ParentID)
+		if err != nil {
+			log.Printf("Error getting storage location %s: %v", location.ParentID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve storage location"})
+			return
+		}
+		if parent == nil || parent.Lab != location.Lab {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("storage location %s does not exist", location.ParentID)})
+			return
+		}
+		if storageLevel(parent.Kind) >= level {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a %s cannot be placed in a %s", location.Kind, parent.Kind)})
+			return
+		}
+	}
+
+	if err := createStorageLocation(location, parent); err != nil {
+		switch err {
+		case errStorageLocationExists:
+			c.JSON(http.StatusConflict, gin.H{"error": "Storage location already exists"})
+		case errParentFull:
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%s %s is full (capacity %d)", parent.Kind, parent.ID, parent.Capacity)})
+		default:
+			log.Printf("Error saving storage location %s: %v", location.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save storage location"})
+		}
+		return
+	}
+
+	log.Printf("Storage location %s created (%s)", location.ID, location.Kind)
+	response, err := storageLocationResponse(location)
+	if err != nil {
+		log.Printf("Error reading storage location %s: %v", location.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve storage location"})
+		return
+	}
+	c.JSON(http.StatusCreated, response)
+}
+
+// listStorageLocationsHandler lists the storage locations, optionally only
+// those of one kind or with one parent; parent_id= (empty) lists the
+// outermost locations.
+func listStorageLocationsHandler(c *gin.Context) {
+	ids, err := redisClient.ZRange(ctx, STORAGE_ALL_KEY, 0, -1).Result()
+	if err != nil {
+		log.Printf("Error listing storage locations: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve storage locations"})
+		return
+	}
+
+	lab := requestAccess(c).Lab
+	kind := c.Query("kind")
+	parentID, filterParent := c.GetQuery("parent_id")
+	locations := []StorageLocation{}
+	for _, id := range ids {
+		location, err := getStorageLocation(id)
+		if err != nil || location == nil || location.Lab != lab {
+			continue
+		}
+		if kind != "" && location.Kind != kind {
+			continue
+		}
+		if filterParent && location.ParentID != parentID {
+			continue
+		}
+		locations = append(locations, *location)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"hierarchy": storageHierarchy,
+		"locations": locations,
+	})
+}
+
+func getStorageLocationHandler(c *gin.Context) {
+	id := c.Param("storage_id")
+	location, err := getStorageLocation(id)
+	if err != nil {
+		log.Printf("Error getting storage location %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve storage location"})
+		return
+	}
+	if location == nil || location.Lab != requestAccess(c).Lab {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Storage location not found"})
+		return
+	}
+
+	response, err := storageLocationResponse(*location)
+	if err != nil {
+		log.Printf("Error reading storage location %s: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve storage location"})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
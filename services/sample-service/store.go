@@ -0,0 +1,917 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// In Redis, samples are stored one per key under sample:<barcode>. samples:all holds
+// every barcode in a sorted set (all scores 0, so members sort by barcode),
+// and sets index the barcodes by plate, storage location, type, project,
+// lab and status, the active samples by plate well or storage position and
+// aliquots and pools by parent.
+const (
+	SAMPLE_KEY_PREFIX   = "sample:"
+	SAMPLES_ALL_KEY     = "samples:all"
+	SAMPLES_CREATED_KEY = "samples:created"
+)
+
+// Sample statuses used by the status index. A filter on status "all"
+// matches active and archived samples; "any" matches deleted ones too.
+const (
+	SampleStatusActive   = "active"
+	SampleStatusArchived = "archived"
+	SampleStatusDeleted  = "deleted"
+	sampleStatusAny      = "any"
+)
+
+// sampleBatchSize bounds the number of keys read with a single MGET.
+const sampleBatchSize = 500
+
+// maxWriteAttempts bounds retries of a sample write whose watched keys
+// changed before it committed.
+const maxWriteAttempts = 3
+
+// SAMPLES_INDEX_VERSION_KEY records which index layout the stored samples
+// were indexed with; older layouts are rebuilt on startup.
+const (
+	SAMPLES_INDEX_VERSION_KEY = "samples:index_version"
+	samplesIndexVersion       = 4
+)
+
+var errSampleExists = errors.New("sample already exists")
+
+// VersionConflictError reports an update based on a version of the sample
+// that is no longer current.
+type VersionConflictError struct {
+	Barcode  string
+	Expected int64
+	Current  int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("Sample %s was modified: version %d is current, not %d", e.Barcode, e.Current, e.Expected)
+}
+
+// WellConflictError reports a placement into a well or storage position
+// that already holds another active sample.
+type WellConflictError struct {
+	Location Location
+	Barcode  string
+}
+
+func (e *WellConflictError) Error() string {
+	place := e.Location.describe()
+	return fmt.Sprintf("%s%s is occupied by sample %s", strings.ToUpper(place[:1]), place[1:], e.Barcode)
+}
+
+// describe names the well or storage position of a location.
+func (l Location) describe() string {
+	if l.Storage != "" {
+		return fmt.Sprintf("position %s in %s", l.Position, l.Storage)
+	}
+	return fmt.Sprintf("well %s on plate %s", l.Well, l.Plate)
+}
+
+func sampleKey(barcode string) string {
+	return SAMPLE_KEY_PREFIX + barcode
+}
+
+func plateIndexKey(plate string) string {
+	return fmt.Sprintf("samples:plate:%s", plate)
+}
+
+func typeIndexKey(sampleType string) string {
+	return fmt.Sprintf("samples:type:%s", sampleType)
+}
+
+func projectIndexKey(project string) string {
+	return fmt.Sprintf("samples:project:%s", project)
+}
+
+// labIndexKey is the index set of a lab's samples, samples:lab:default for
+// the default lab's.
+func labIndexKey(lab string) string {
+	if lab == "" {
+		lab = defaultLabName
+	}
+	return fmt.Sprintf("samples:lab:%s", lab)
+}
+
+func statusIndexKey(status string) string {
+	return fmt.Sprintf("samples:status:%s", status)
+}
+
+func wellIndexKey(plate, well string) string {
+	return fmt.Sprintf("samples:well:%s:%s", plate, well)
+}
+
+// wellKey identifies the well or storage position an active sample
+// occupies, or is an empty string if it is in neither. It names the Redis
+// index of the samples sharing it.
+func (s Sample) wellKey() string {
+	if s.Archived || s.deleted() {
+		return ""
+	}
+	if s.Location.Storage != "" && s.Location.Position != "" {
+		return positionIndexKey(s.Location.Storage, s.Location.Position)
+	}
+	if s.Location.Plate == "" || s.Location.Well == "" {
+		return ""
+	}
+	return wellIndexKey(s.Location.Plate, s.Location.Well)
+}
+
+// deleted reports whether the sample is in the trash.
+func (s Sample) deleted() bool {
+	return s.DeletedAt != ""
+}
+
+func (s Sample) status() string {
+	if s.deleted() {
+		return SampleStatusDeleted
+	}
+	if s.Archived {
+		return SampleStatusArchived
+	}
+	return SampleStatusActive
+}
+
+// indexKeys lists the secondary index sets the sample belongs to.
+func (s Sample) indexKeys() []string {
+	keys := []string{statusIndexKey(s.status()), labIndexKey(s.Lab)}
+	if s.Location.Plate != "" {
+		keys = append(keys, plateIndexKey(s.Location.Plate))
+	}
+	if s.Location.Storage != "" {
+		keys = append(keys, storageIndexKey(s.Location.Storage))
+	}
+	if s.Type != "" {
+		keys = append(keys, typeIndexKey(s.Type))
+	}
+	if s.Project != "" {
+		keys = append(keys, projectIndexKey(s.Project))
+	}
+	if wellKey := s.wellKey(); wellKey != "" {
+		keys = append(keys, wellKey)
+	}
+	for _, parent := range s.parents() {
+		keys = append(keys, childrenIndexKey(parent))
+	}
+	return keys
+}
+
+// nextVersion numbers a sample about to replace previous, which is nil for
+// a new sample. It is written at the current schema version.
+func (s *Sample) nextVersion(previous *Sample) {
+	s.SchemaVersion = sampleSchemaVersion
+	if previous == nil {
+		s.Version = 1
+		return
+	}
+	s.Version = previous.Version + 1
+}
+
+func createdScore(s Sample) float64 {
+	created, err := time.Parse(time.RFC3339, s.CreatedAt)
+	if err != nil {
+		return 0
+	}
+	return float64(created.Unix())
+}
+
+// SampleReader reads stored samples, either directly from the store or
+// inside a SampleTx.
+type SampleReader interface {
+	// GetMany returns the given samples in order, leaving out any that
+	// don't exist.
+	GetMany(barcodes []string) ([]Sample, error)
+	// Occupants returns the active samples in the well or storage
+	// position with the given wellKey, sorted.
+	Occupants(wellKey string) ([]string, error)
+	// Children returns the aliquots and pools made from a sample, sorted.
+	Children(barcode string) ([]string, error)
+}
+
+// SampleWrite is a sample written by a SampleTx together with the history
+// entry recording the change. Previous is the stored version, or nil for a
+// new sample. A HistoryOnly write records the entry without writing the
+// sample, and a Purge write removes the stored sample, keeping its
+// history.
+type SampleWrite struct {
+	Sample      Sample
+	Previous    *Sample
+	Audit       SampleAudit
+	HistoryOnly bool
+	Purge       bool
+}
+
+// attribute records the user making a change to a sample, and for a new
+// sample its creator. previous is nil for a new sample.
+func (s *Sample) attribute(previous *Sample, actor string) {
+	s.UpdatedBy = actor
+	if previous == nil && s.CreatedBy == "" {
+		s.CreatedBy = actor
+	}
+}
+
+// attributeWrites attributes each written sample to the user in its audit,
+// for writers that didn't already.
+func attributeWrites(writes []SampleWrite) {
+	for i := range writes {
+		if !writes[i].HistoryOnly && !writes[i].Purge {
+			writes[i].Sample.attribute(writes[i].Previous, writes[i].Audit.Actor)
+		}
+	}
+}
+
+// SampleTx is a transaction over samples. Samples read through it can't
+// change before the transaction commits, and the queued writes are applied
+// together.
+type SampleTx interface {
+	SampleReader
+	Put(writes ...SampleWrite)
+}
+
+// SampleStore persists samples and their history. Plates, storage
+// locations, sample types, transfers, reservations and webhooks stay in
+// Redis whichever store is used.
+type SampleStore interface {
+	SampleReader
+	// Get returns a sample, or nil if it doesn't exist.
+	Get(barcode string) (*Sample, error)
+	// Barcodes returns the barcodes matching the indexed parts of the
+	// filter, sorted. The q and metadata filters are not applied.
+	Barcodes(filter SampleFilter) ([]string, error)
+	// Count returns the number of samples matching the indexed parts of
+	// the filter.
+	Count(filter SampleFilter) (int, error)
+	// Expiring returns the active samples expiring after after (if set)
+	// and no later than until, soonest first.
+	Expiring(after, until time.Time) ([]string, error)
+	// Plates and Types return the plates and types samples refer to.
+	Plates() ([]string, error)
+	Types() ([]string, error)
+	// History returns a sample's history entries recorded between from
+	// and to, either of which may be zero, newest first.
+	History(barcode string, from, to time.Time) ([]SampleHistoryEntry, error)
+	// PlateMovements returns the history entries that moved a sample onto,
+	// off or within a plate between from and to, either of which may be
+	// zero, oldest first.
+	PlateMovements(plate string, from, to time.Time) ([]SampleHistoryEntry, error)
+	// Update runs fn in a transaction and applies the writes it queues.
+	// fn is run again if the samples it read change before the commit,
+	// up to maxWriteAttempts times, so it must not have side effects.
+	Update(fn func(tx SampleTx) error) error
+	Close() error
+}
+
+var sampleStore SampleStore
+
+// newSampleStore selects the store named by SAMPLE_STORE: "redis" (the
+// default) or "postgres", which connects to DATABASE_URL.
+func newSampleStore() (SampleStore, error) {
+	switch backend := os.Getenv("SAMPLE_STORE"); backend {
+	case "", "redis":
+		return newRedisSampleStore(redisClient)
+	case "postgres":
+		databaseURL := os.Getenv("DATABASE_URL")
+		if databaseURL == "" {
+			return nil, fmt.Errorf("DATABASE_URL not set")
+		}
+		return newPostgresSampleStore(databaseURL)
+	default:
+		return nil, fmt.Errorf("unknown sample store %q", backend)
+	}
+}
+
+// getSample returns a sample, or nil if it doesn't exist or is in the
+// trash.
+func getSample(barcode string) (*Sample, error) {
+	sample, err := sampleStore.Get(barcode)
+	if err != nil || sample == nil || sample.deleted() {
+		return nil, err
+	}
+	return sample, nil
+}
+
+// getSamples loads the given barcodes, keeping their order and leaving out
+// any that don't exist or are in the trash.
+func getSamples(barcodes []string) ([]Sample, error) {
+	samples, err := sampleStore.GetMany(barcodes)
+	if err != nil {
+		return nil, err
+	}
+	kept := samples[:0]
+	for _, sample := range samples {
+		if !sample.deleted() {
+			kept = append(kept, sample)
+		}
+	}
+	return kept, nil
+}
+
+// getSampleMap loads the given barcodes keyed by barcode.
+func getSampleMap(barcodes []string) (map[string]Sample, error) {
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+	byBarcode := make(map[string]Sample, len(samples))
+	for _, sample := range samples {
+		byBarcode[sample.Barcode] = sample
+	}
+	return byBarcode, nil
+}
+
+// wellOccupant returns an active sample other than barcode in the well.
+func wellOccupant(reader SampleReader, wellKey, barcode string) (string, error) {
+	occupants, err := reader.Occupants(wellKey)
+	if err != nil {
+		return "", err
+	}
+	for _, occupant := range occupants {
+		if occupant != barcode {
+			return occupant, nil
+		}
+	}
+	return "", nil
+}
+
+// writeSample stores a sample and records the change in its history.
+// previous is the stored version, or nil to create the sample. A move into
+// an occupied well fails with a WellConflictError unless allowPooling is
+// set, and an update of a sample changed since previous was read fails
+// with a VersionConflictError. The sample's version and attribution are
+// set to the ones written.
+func writeSample(sample *Sample, previous *Sample, allowPooling bool, audit SampleAudit) error {
+	sample.nextVersion(previous)
+	sample.attribute(previous, audit.Actor)
+	wellKey := sample.wellKey()
+	checkWell := wellKey != "" && !allowPooling && (previous == nil || previous.wellKey() != wellKey)
+
+	return sampleStore.Update(func(tx SampleTx) error {
+		current, err := tx.GetMany([]string{sample.Barcode})
+		if err != nil {
+			return err
+		}
+		if previous == nil && len(current) > 0 {
+			return errSampleExists
+		}
+		if previous != nil && (len(current) == 0 || current[0].Version != previous.Version) {
+			conflict := &VersionConflictError{Barcode: sample.Barcode, Expected: previous.Version}
+			if len(current) > 0 {
+				conflict.Current = current[0].Version
+			}
+			return conflict
+		}
+		if checkWell {
+			occupant, err := wellOccupant(tx, wellKey, sample.Barcode)
+			if err != nil {
+				return err
+			}
+			if occupant != "" {
+				return &WellConflictError{Location: sample.Location, Barcode: occupant}
+			}
+		}
+		tx.Put(SampleWrite{Sample: *sample, Previous: previous, Audit: audit})
+		return nil
+	})
+}
+
+// createSample stores a new sample, failing with errSampleExists if the
+// barcode is taken.
+func createSample(sample *Sample, allowPooling bool, audit SampleAudit) error {
+	return writeSample(sample, nil, allowPooling, audit)
+}
+
+// updateSample replaces a stored sample.
+func updateSample(sample *Sample, previous Sample, allowPooling bool, audit SampleAudit) error {
+	return writeSample(sample, &previous, allowPooling, audit)
+}
+
+// redisSampleStore keeps samples in the keys and index sets described at
+// the top of this file.
+type redisSampleStore struct {
+	client redis.UniversalClient
+}
+
+// newRedisSampleStore migrates samples saved by earlier versions and
+// rebuilds indexes written with an older layout.
+func newRedisSampleStore(client redis.UniversalClient) (*redisSampleStore, error) {
+	store := &redisSampleStore{client: client}
+	if err := store.migrateLegacySamples(); err != nil {
+		return nil, fmt.Errorf("migrating samples: %w", err)
+	}
+	if err := store.reindexSamples(); err != nil {
+		return nil, fmt.Errorf("reindexing samples: %w", err)
+	}
+	return store, nil
+}
+
+func (s *redisSampleStore) Get(barcode string) (*Sample, error) {
+	samples, err := readSamples(s.client, []string{barcode})
+	if err != nil || len(samples) == 0 {
+		return nil, err
+	}
+	return &samples[0], nil
+}
+
+func (s *redisSampleStore) GetMany(barcodes []string) ([]Sample, error) {
+	return readSamples(s.client, barcodes)
+}
+
+func (s *redisSampleStore) Occupants(wellKey string) ([]string, error) {
+	return sortedMembers(s.client, wellKey)
+}
+
+func (s *redisSampleStore) Children(barcode string) ([]string, error) {
+	return sortedMembers(s.client, childrenIndexKey(barcode))
+}
+
+func (s *redisSampleStore) Barcodes(filter SampleFilter) ([]string, error) {
+	var barcodes []string
+	var err error
+	if keys := filter.indexKeys(); len(keys) > 0 {
+		barcodes, err = s.client.SInter(ctx, keys...).Result()
+		sort.Strings(barcodes)
+	} else {
+		barcodes, err = s.client.ZRange(ctx, SAMPLES_ALL_KEY, 0, -1).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Status == "all" {
+		deleted, err := s.client.SMembers(ctx, statusIndexKey(SampleStatusDeleted)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(deleted) > 0 {
+			inTrash := make(map[string]bool, len(deleted))
+			for _, barcode := range deleted {
+				inTrash[barcode] = true
+			}
+			kept := barcodes[:0]
+			for _, barcode := range barcodes {
+				if !inTrash[barcode] {
+					kept = append(kept, barcode)
+				}
+			}
+			barcodes = kept
+		}
+	}
+
+	if filter.Projects != nil {
+		inProjects := map[string]bool{}
+		for _, project := range filter.Projects {
+			members, err := s.client.SMembers(ctx, projectIndexKey(project)).Result()
+			if err != nil {
+				return nil, err
+			}
+			for _, barcode := range members {
+				inProjects[barcode] = true
+			}
+		}
+		matching := barcodes[:0]
+		for _, barcode := range barcodes {
+			if inProjects[barcode] {
+				matching = append(matching, barcode)
+			}
+		}
+		barcodes = matching
+	}
+
+	if filter.CreatedAfter != nil {
+		created, err := s.client.ZRangeByScore(ctx, SAMPLES_CREATED_KEY, &redis.ZRangeBy{
+			Min: fmt.Sprintf("(%d", filter.CreatedAfter.Unix()),
+			Max: "+inf",
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		after := make(map[string]bool, len(created))
+		for _, barcode := range created {
+			after[barcode] = true
+		}
+		matching := barcodes[:0]
+		for _, barcode := range barcodes {
+			if after[barcode] {
+				matching = append(matching, barcode)
+			}
+		}
+		barcodes = matching
+	}
+	return barcodes, nil
+}
+
+func (s *redisSampleStore) Count(filter SampleFilter) (int, error) {
+	keys := filter.indexKeys()
+	switch {
+	case filter.CreatedAfter != nil || filter.Projects != nil || filter.Status == "all" || len(keys) > 1:
+		barcodes, err := s.Barcodes(filter)
+		return len(barcodes), err
+	case len(keys) == 1:
+		n, err := s.client.SCard(ctx, keys[0]).Result()
+		return int(n), err
+	default:
+		n, err := s.client.ZCard(ctx, SAMPLES_ALL_KEY).Result()
+		return int(n), err
+	}
+}
+
+func (s *redisSampleStore) Expiring(after, until time.Time) ([]string, error) {
+	min := "-inf"
+	if !after.IsZero() {
+		min = fmt.Sprintf("(%d", after.Unix())
+	}
+	return s.client.ZRangeByScore(ctx, SAMPLES_EXPIRES_KEY, &redis.ZRangeBy{
+		Min: min,
+		Max: strconv.FormatInt(until.Unix(), 10),
+	}).Result()
+}
+
+func (s *redisSampleStore) Plates() ([]string, error) {
+	return s.indexedValues(plateIndexKey(""))
+}
+
+func (s *redisSampleStore) Types() ([]string, error) {
+	return s.indexedValues(typeIndexKey(""))
+}
+
+// indexedValues lists the values with an index set under the prefix.
+func (s *redisSampleStore) indexedValues(prefix string) ([]string, error) {
+	values := []string{}
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, prefix+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if value := strings.TrimPrefix(key, prefix); value != "" {
+				values = append(values, value)
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+func (s *redisSampleStore) History(barcode string, from, to time.Time) ([]SampleHistoryEntry, error) {
+	members, err := s.client.ZRevRangeByScore(ctx, sampleHistoryKey(barcode), historyRange(from, to)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistory(members), nil
+}
+
+func (s *redisSampleStore) PlateMovements(plate string, from, to time.Time) ([]SampleHistoryEntry, error) {
+	members, err := s.client.ZRangeByScore(ctx, plateMovementsKey(plate), historyRange(from, to)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeHistory(members), nil
+}
+
+// historyRange selects the history entries recorded between from and to,
+// either of which may be zero.
+func historyRange(from, to time.Time) *redis.ZRangeBy {
+	rangeBy := &redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if !from.IsZero() {
+		rangeBy.Min = strconv.FormatInt(from.UnixMilli(), 10)
+	}
+	if !to.IsZero() {
+		rangeBy.Max = strconv.FormatInt(to.UnixMilli(), 10)
+	}
+	return rangeBy
+}
+
+func decodeHistory(members []string) []SampleHistoryEntry {
+	entries := make([]SampleHistoryEntry, 0, len(members))
+	for _, member := range members {
+		var entry SampleHistoryEntry
+		if err := json.Unmarshal([]byte(member), &entry); err != nil {
+			log.Printf("Invalid history entry: %v", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// Update watches every key fn reads, so a write by anyone else to one of
+// them makes the transaction fail and fn run again.
+func (s *redisSampleStore) Update(fn func(tx SampleTx) error) error {
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			sampleTx := &redisSampleTx{tx: tx}
+			if err := fn(sampleTx); err != nil {
+				return err
+			}
+			return s.commit(tx, sampleTx.writes)
+		})
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *redisSampleStore) commit(tx *redis.Tx, writes []SampleWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	historyID, err := s.reserveHistoryIDs(len(writes))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, write := range writes {
+			switch {
+			case write.Purge:
+				removeSample(pipe, write.Sample)
+			case !write.HistoryOnly:
+				if err := putSample(pipe, write.Sample, write.Previous); err != nil {
+					return err
+				}
+			}
+			data, err := json.Marshal(newSampleHistoryEntry(historyID+int64(i), write, now))
+			if err != nil {
+				return err
+			}
+			pipe.ZAdd(ctx, sampleHistoryKey(write.Sample.Barcode), redis.Z{Score: float64(now.UnixMilli()), Member: data})
+			for _, plate := range movedPlates(write.Previous, write.Sample) {
+				pipe.ZAdd(ctx, plateMovementsKey(plate), redis.Z{Score: float64(now.UnixMilli()), Member: data})
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// reserveHistoryIDs allocates IDs for n history entries and returns the
+// first.
+func (s *redisSampleStore) reserveHistoryIDs(n int) (int64, error) {
+	last, err := s.client.IncrBy(ctx, SAMPLE_HISTORY_SEQUENCE_KEY, int64(n)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return last - int64(n) + 1, nil
+}
+
+func (s *redisSampleStore) Close() error {
+	return nil
+}
+
+// redisSampleTx watches each key before reading it.
+type redisSampleTx struct {
+	tx     *redis.Tx
+	writes []SampleWrite
+}
+
+func (t *redisSampleTx) GetMany(barcodes []string) ([]Sample, error) {
+	if len(barcodes) == 0 {
+		return []Sample{}, nil
+	}
+	keys := make([]string, len(barcodes))
+	for i, barcode := range barcodes {
+		keys[i] = sampleKey(barcode)
+	}
+	if err := t.tx.Watch(ctx, keys...).Err(); err != nil {
+		return nil, err
+	}
+	return readSamples(t.tx, barcodes)
+}
+
+func (t *redisSampleTx) Occupants(wellKey string) ([]string, error) {
+	if err := t.tx.Watch(ctx, wellKey).Err(); err != nil {
+		return nil, err
+	}
+	return sortedMembers(t.tx, wellKey)
+}
+
+func (t *redisSampleTx) Children(barcode string) ([]string, error) {
+	key := childrenIndexKey(barcode)
+	if err := t.tx.Watch(ctx, key).Err(); err != nil {
+		return nil, err
+	}
+	return sortedMembers(t.tx, key)
+}
+
+func (t *redisSampleTx) Put(writes ...SampleWrite) {
+	attributeWrites(writes)
+	t.writes = append(t.writes, writes...)
+}
+
+func sortedMembers(cmd redis.Cmdable, key string) ([]string, error) {
+	members, err := cmd.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// readSamples loads the given barcodes in batches, keeping their order and
+// leaving out any that don't exist.
+func readSamples(cmd redis.Cmdable, barcodes []string) ([]Sample, error) {
+	samples := make([]Sample, 0, len(barcodes))
+	now := time.Now()
+	for start := 0; start < len(barcodes); start += sampleBatchSize {
+		end := start + sampleBatchSize
+		if end > len(barcodes) {
+			end = len(barcodes)
+		}
+
+		keys := make([]string, 0, end-start)
+		for _, barcode := range barcodes[start:end] {
+			keys = append(keys, sampleKey(barcode))
+		}
+		values, err := cmd.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			sample, err := decodeSample([]byte(data))
+			if err != nil {
+				log.Printf("Invalid sample %s: %v", barcodes[start+i], err)
+				continue
+			}
+			sample.refreshExpired(now)
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+// putSample queues the write of a sample and moves it between indexes.
+// previous is the stored version, or nil for a new sample.
+func putSample(pipe redis.Pipeliner, sample Sample, previous *Sample) error {
+	data, err := encodeSample(sample)
+	if err != nil {
+		return err
+	}
+
+	if previous != nil {
+		for _, key := range previous.indexKeys() {
+			pipe.SRem(ctx, key, sample.Barcode)
+		}
+	}
+	pipe.Set(ctx, sampleKey(sample.Barcode), data, 0)
+	pipe.ZAdd(ctx, SAMPLES_ALL_KEY, redis.Z{Score: 0, Member: sample.Barcode})
+	pipe.ZAdd(ctx, SAMPLES_CREATED_KEY, redis.Z{Score: createdScore(sample), Member: sample.Barcode})
+	for _, key := range sample.indexKeys() {
+		pipe.SAdd(ctx, key, sample.Barcode)
+	}
+	indexExpiry(pipe, sample)
+	return nil
+}
+
+// removeSample queues the removal of a stored sample from its key and
+// indexes.
+func removeSample(pipe redis.Pipeliner, sample Sample) {
+	for _, key := range sample.indexKeys() {
+		pipe.SRem(ctx, key, sample.Barcode)
+	}
+	pipe.Del(ctx, sampleKey(sample.Barcode))
+	pipe.ZRem(ctx, SAMPLES_ALL_KEY, sample.Barcode)
+	pipe.ZRem(ctx, SAMPLES_CREATED_KEY, sample.Barcode)
+	pipe.ZRem(ctx, SAMPLES_EXPIRES_KEY, sample.Barcode)
+}
+
+// reindexSamples rebuilds the index sets of every sample, and the plate
+// movements recorded in their histories, when they were built with an
+// older layout.
+func (s *redisSampleStore) reindexSamples() error {
+	version, err := s.client.Get(ctx, SAMPLES_INDEX_VERSION_KEY).Int()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if version >= samplesIndexVersion {
+		return nil
+	}
+
+	barcodes, err := s.client.ZRange(ctx, SAMPLES_ALL_KEY, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(barcodes); start += sampleBatchSize {
+		end := start + sampleBatchSize
+		if end > len(barcodes) {
+			end = len(barcodes)
+		}
+		samples, err := readSamples(s.client, barcodes[start:end])
+		if err != nil {
+			return err
+		}
+		_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, sample := range samples {
+				if err := putSample(pipe, sample, &sample); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, barcode := range barcodes[start:end] {
+			if err := s.indexPlateMovements(barcode); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.client.Set(ctx, SAMPLES_INDEX_VERSION_KEY, samplesIndexVersion, 0).Err(); err != nil {
+		return err
+	}
+	log.Printf("Reindexed %d sample(s)", len(barcodes))
+	return nil
+}
+
+// indexPlateMovements adds the plate movements in a sample's history to
+// the movement index.
+func (s *redisSampleStore) indexPlateMovements(barcode string) error {
+	members, err := s.client.ZRangeWithScores(ctx, sampleHistoryKey(barcode), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, member := range members {
+			data, _ := member.Member.(string)
+			var entry SampleHistoryEntry
+			if err := json.Unmarshal([]byte(data), &entry); err != nil {
+				continue
+			}
+			from, to, moved := locationChange(entry)
+			if !moved {
+				continue
+			}
+			for _, plate := range movedPlates(&Sample{Location: from}, Sample{Location: to}) {
+				pipe.ZAdd(ctx, plateMovementsKey(plate), redis.Z{Score: member.Score, Member: data})
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// migrateLegacySamples moves samples from the single JSON document used
+// by earlier versions into per-sample keys.
+func (s *redisSampleStore) migrateLegacySamples() error {
+	data, err := s.client.Get(ctx, SAMPLES_KEY).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(data), &records); err != nil {
+		return err
+	}
+	samples := make([]Sample, 0, len(records))
+	for barcode, record := range records {
+		sample, err := decodeSample(record)
+		if err != nil {
+			return fmt.Errorf("sample %s: %w", barcode, err)
+		}
+		samples = append(samples, sample)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, sample := range samples {
+			sample.nextVersion(nil)
+			if err := putSample(pipe, sample, nil); err != nil {
+				return err
+			}
+		}
+		pipe.Del(ctx, SAMPLES_KEY)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %d sample(s) to per-sample keys", len(samples))
+	return nil
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// sampleMigrations are applied in order on startup and recorded in
+// sample_schema_migrations, so each runs once per database. Add new
+// migrations to the end; never edit one that has been released.
+var sampleMigrations = []string{
+	// 1: samples, with the fields they are looked up by as columns next to
+	// the full record, and the append-only history of every change.
+	`
+CREATE TABLE samples (
+	barcode        TEXT PRIMARY KEY,
+	data           JSONB NOT NULL,
+	name           TEXT NOT NULL,
+	type           TEXT NOT NULL,
+	plate          TEXT NOT NULL,
+	well           TEXT NOT NULL,
+	storage        TEXT NOT NULL,
+	position       TEXT NOT NULL,
+	well_key       TEXT NOT NULL,
+	parent_barcode TEXT NOT NULL,
+	archived       BOOLEAN NOT NULL,
+	expires_at     TIMESTAMPTZ,
+	created_at     TIMESTAMPTZ,
+	version        BIGINT NOT NULL
+);
+
+CREATE INDEX samples_type_idx ON samples (type);
+CREATE INDEX samples_plate_idx ON samples (plate, well);
+CREATE INDEX samples_storage_idx ON samples (storage, position);
+CREATE INDEX samples_well_key_idx ON samples (well_key);
+CREATE INDEX samples_parent_idx ON samples (parent_barcode);
+CREATE INDEX samples_expires_idx ON samples (expires_at) WHERE NOT archived;
+CREATE INDEX samples_created_idx ON samples (created_at);
+
+CREATE TABLE sample_history (
+	id          BIGSERIAL PRIMARY KEY,
+	barcode     TEXT NOT NULL,
+	action      TEXT NOT NULL,
+	changes     JSONB NOT NULL,
+	workflow_id TEXT NOT NULL,
+	actor       TEXT NOT NULL,
+	transfer_id BIGINT NOT NULL,
+	note        TEXT NOT NULL,
+	recorded_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX sample_history_barcode_idx ON sample_history (barcode, recorded_at);
+CREATE INDEX sample_history_workflow_idx ON sample_history (workflow_id);
+`,
+	// 2: the plates samples were moved from and to, for plate movement
+	// reports.
+	`
+CREATE INDEX sample_history_from_plate_idx ON sample_history ((changes->'location'->'from'->>'plate'), recorded_at);
+CREATE INDEX sample_history_to_plate_idx ON sample_history ((changes->'location'->'to'->>'plate'), recorded_at);
+`,
+	// 3: the sources of pooled samples.
+	`
+CREATE INDEX samples_pooled_from_idx ON samples USING GIN ((data->'pooled_from') jsonb_path_ops);
+`,
+	// 4: the projects samples belong to.
+	`
+CREATE INDEX samples_project_idx ON samples ((data->>'project'));
+`,
+	// 5: the labs samples belong to.
+	`
+CREATE INDEX samples_lab_idx ON samples ((coalesce(data->>'lab', '')));
+`,
+	// 6: samples in the trash.
+	`
+ALTER TABLE samples ADD COLUMN deleted BOOLEAN NOT NULL DEFAULT false;
+`,
+}
+
+// queryer is a *sql.DB or *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// postgresSampleStore keeps samples in PostgreSQL. Updates run at
+// serializable isolation and are retried when they conflict with another,
+// so the checks a transaction makes hold until it commits.
+type postgresSampleStore struct {
+	postgresSampleReader
+	db *sql.DB
+}
+
+func newPostgresSampleStore(databaseURL string) (*postgresSampleStore, error) {
+	db, err := sql.Open("pgx", databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSampleSchema(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating sample schema: %w", err)
+	}
+	return &postgresSampleStore{postgresSampleReader: postgresSampleReader{q: db}, db: db}, nil
+}
+
+// migrateSampleSchema applies the migrations not yet applied, holding a
+// lock so instances starting together don't both apply them.
+func migrateSampleSchema(db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('sample_schema_migrations'))`); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+CREATE TABLE IF NOT EXISTS sample_schema_migrations (
+	version    INTEGER PRIMARY KEY,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`)
+	if err != nil {
+		return err
+	}
+
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM sample_schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	for version := current + 1; version <= len(sampleMigrations); version++ {
+		if _, err := tx.ExecContext(ctx, sampleMigrations[version-1]); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO sample_schema_migrations (version) VALUES ($1)`, version); err != nil {
+			return err
+		}
+		log.Printf("Applied sample schema migration %d", version)
+	}
+	return tx.Commit()
+}
+
+func (s *postgresSampleStore) Get(barcode string) (*Sample, error) {
+	samples, err := s.GetMany([]string{barcode})
+	if err != nil || len(samples) == 0 {
+		return nil, err
+	}
+	return &samples[0], nil
+}
+
+// filterConditions turns the indexed parts of a filter into a WHERE clause.
+func filterConditions(filter SampleFilter) (string, []interface{}) {
+	conditions := []string{"true"}
+	args := []interface{}{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	switch filter.Status {
+	case SampleStatusActive:
+		conditions = append(conditions, "NOT archived AND NOT deleted")
+	case SampleStatusArchived:
+		conditions = append(conditions, "archived AND NOT deleted")
+	case SampleStatusDeleted:
+		conditions = append(conditions, "deleted")
+	case "all":
+		conditions = append(conditions, "NOT deleted")
+	}
+	if filter.Type != "" {
+		add("type = $%d", filter.Type)
+	}
+	if filter.Plate != "" {
+		add("plate = $%d", filter.Plate)
+	}
+	if filter.Storage != "" {
+		add("storage = $%d", filter.Storage)
+	}
+	if filter.CreatedAfter != nil {
+		add("created_at > $%d", *filter.CreatedAfter)
+	}
+	if filter.Projects != nil {
+		add("data->>'project' = ANY($%d)", filter.Projects)
+	}
+	if filter.Lab != nil {
+		add("coalesce(data->>'lab', '') = $%d", *filter.Lab)
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (s *postgresSampleStore) Barcodes(filter SampleFilter) ([]string, error) {
+	where, args := filterConditions(filter)
+	return queryStrings(s.db, `SELECT barcode FROM samples WHERE `+where+` ORDER BY barcode COLLATE "C"`, args...)
+}
+
+func (s *postgresSampleStore) Count(filter SampleFilter) (int, error) {
+	where, args := filterConditions(filter)
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT count(*) FROM samples WHERE `+where, args...).Scan(&count)
+	return count, err
+}
+
+func (s *postgresSampleStore) Expiring(after, until time.Time) ([]string, error) {
+	return queryStrings(s.db, `
+SELECT barcode FROM samples
+WHERE NOT archived AND NOT deleted AND expires_at <= $1 AND ($2::timestamptz IS NULL OR expires_at > $2)
+ORDER BY expires_at, barcode COLLATE "C"`, until, nullTime(after))
+}
+
+func (s *postgresSampleStore) Plates() ([]string, error) {
+	return s.distinct("plate")
+}
+
+func (s *postgresSampleStore) Types() ([]string, error) {
+	return s.distinct("type")
+}
+
+// distinct lists the values of a column samples have set.
+func (s *postgresSampleStore) distinct(column string) ([]string, error) {
+	values, err := queryStrings(s.db, fmt.Sprintf(`SELECT DISTINCT %[1]s FROM samples WHERE %[1]s <> ''`, column))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+func (s *postgresSampleStore) History(barcode string, from, to time.Time) ([]SampleHistoryEntry, error) {
+	return s.history(`
+SELECT id, barcode, action, changes, workflow_id, actor, transfer_id, note, recorded_at
+FROM sample_history
+WHERE barcode = $1
+	AND ($2::timestamptz IS NULL OR recorded_at >= $2)
+	AND ($3::timestamptz IS NULL OR recorded_at <= $3)
+ORDER BY recorded_at DESC, id DESC`, barcode, nullTime(from), nullTime(to))
+}
+
+func (s *postgresSampleStore) PlateMovements(plate string, from, to time.Time) ([]SampleHistoryEntry, error) {
+	return s.history(`
+SELECT id, barcode, action, changes, workflow_id, actor, transfer_id, note, recorded_at
+FROM sample_history
+WHERE (changes->'location'->'from'->>'plate' = $1 OR changes->'location'->'to'->>'plate' = $1)
+	AND ($2::timestamptz IS NULL OR recorded_at >= $2)
+	AND ($3::timestamptz IS NULL OR recorded_at <= $3)
+ORDER BY recorded_at, id`, plate, nullTime(from), nullTime(to))
+}
+
+// history runs a query selecting history entries.
+func (s *postgresSampleStore) history(query string, args ...interface{}) ([]SampleHistoryEntry, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []SampleHistoryEntry{}
+	for rows.Next() {
+		var entry SampleHistoryEntry
+		var changes []byte
+		var recordedAt time.Time
+		if err := rows.Scan(&entry.ID, &entry.Barcode, &entry.Action, &changes, &entry.WorkflowID, &entry.Actor, &entry.TransferID, &entry.Note, &recordedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+			log.Printf("Invalid history entry %d for sample %s: %v", entry.ID, entry.Barcode, err)
+		}
+		entry.At = recordedAt.UTC().Format(time.RFC3339Nano)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *postgresSampleStore) Update(fn func(tx SampleTx) error) error {
+	var err error
+	for attempt := 0; attempt < maxWriteAttempts; attempt++ {
+		if err = s.update(fn); !isSerializationFailure(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *postgresSampleStore) update(fn func(tx SampleTx) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sampleTx := &postgresSampleTx{postgresSampleReader: postgresSampleReader{q: tx}}
+	if err := fn(sampleTx); err != nil {
+		return err
+	}
+	if len(sampleTx.writes) == 0 {
+		return nil
+	}
+	if err := writeSamples(tx, sampleTx.writes); err != nil {
+		return err
+	}
+	if err := purgeSamples(tx, sampleTx.writes); err != nil {
+		return err
+	}
+	if err := writeSampleHistory(tx, sampleTx.writes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isSerializationFailure reports whether a transaction lost a conflict
+// with a concurrent one and can be retried.
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40001" || pgErr.Code == "40P01")
+}
+
+// writeSamples upserts the written samples with one statement.
+func writeSamples(tx *sql.Tx, writes []SampleWrite) error {
+	var barcodes, data, names, types, plates, wells, storages, positions, wellKeys, parents, expiresAt, createdAt []string
+	var archived, deleted []bool
+	var versions []int64
+	// A sample written twice keeps its last version.
+	last := map[string]int{}
+	for i, write := range writes {
+		if !write.HistoryOnly {
+			last[write.Sample.Barcode] = i
+		}
+	}
+	for i, write := range writes {
+		if write.HistoryOnly || write.Purge || last[write.Sample.Barcode] != i {
+			continue
+		}
+		sample := write.Sample
+		encoded, err := encodeSample(sample)
+		if err != nil {
+			return err
+		}
+		barcodes = append(barcodes, sample.Barcode)
+		data = append(data, string(encoded))
+		names = append(names, sample.Name)
+		types = append(types, sample.Type)
+		plates = append(plates, sample.Location.Plate)
+		wells = append(wells, sample.Location.Well)
+		storages = append(storages, sample.Location.Storage)
+		positions = append(positions, sample.Location.Position)
+		wellKeys = append(wellKeys, sample.wellKey())
+		parents = append(parents, sample.ParentBarcode)
+		archived = append(archived, sample.Archived)
+		deleted = append(deleted, sample.deleted())
+		expiresAt = append(expiresAt, timestampOrEmpty(sample.ExpiresAt))
+		createdAt = append(createdAt, timestampOrEmpty(sample.CreatedAt))
+		versions = append(versions, sample.Version)
+	}
+	if len(barcodes) == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+INSERT INTO samples (barcode, data, name, type, plate, well, storage, position, well_key, parent_barcode, archived, expires_at, created_at, version, deleted)
+SELECT barcode, data::jsonb, name, type, plate, well, storage, position, well_key, parent_barcode, archived,
+	NULLIF(expires_at, '')::timestamptz, NULLIF(created_at, '')::timestamptz, version, deleted
+FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[], $7::text[], $8::text[],
+	$9::text[], $10::text[], $11::boolean[], $12::text[], $13::text[], $14::bigint[], $15::boolean[])
+	AS t(barcode, data, name, type, plate, well, storage, position, well_key, parent_barcode, archived, expires_at, created_at, version, deleted)
+ON CONFLICT (barcode) DO UPDATE SET
+	data = EXCLUDED.data,
+	name = EXCLUDED.name,
+	type = EXCLUDED.type,
+	plate = EXCLUDED.plate,
+	well = EXCLUDED.well,
+	storage = EXCLUDED.storage,
+	position = EXCLUDED.position,
+	well_key = EXCLUDED.well_key,
+	parent_barcode = EXCLUDED.parent_barcode,
+	archived = EXCLUDED.archived,
+	expires_at = EXCLUDED.expires_at,
+	created_at = EXCLUDED.created_at,
+	version = EXCLUDED.version,
+	deleted = EXCLUDED.deleted`,
+		barcodes, data, names, types, plates, wells, storages, positions, wellKeys, parents, archived, expiresAt, createdAt, versions, deleted)
+	return err
+}
+
+// purgeSamples deletes the samples of the Purge writes; their history is
+// kept.
+func purgeSamples(tx *sql.Tx, writes []SampleWrite) error {
+	var barcodes []string
+	for _, write := range writes {
+		if write.Purge {
+			barcodes = append(barcodes, write.Sample.Barcode)
+		}
+	}
+	if len(barcodes) == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM samples WHERE barcode = ANY($1)`, barcodes)
+	return err
+}
+
+// writeSampleHistory records an entry for every write with one statement,
+// numbering them in the order they were queued.
+func writeSampleHistory(tx *sql.Tx, writes []SampleWrite) error {
+	now := time.Now().UTC()
+	var barcodes, actions, changes, workflowIDs, actors, notes []string
+	var transferIDs []int64
+	for _, write := range writes {
+		entry := newSampleHistoryEntry(0, write, now)
+		encoded, err := json.Marshal(entry.Changes)
+		if err != nil {
+			return err
+		}
+		barcodes = append(barcodes, entry.Barcode)
+		actions = append(actions, entry.Action)
+		changes = append(changes, string(encoded))
+		workflowIDs = append(workflowIDs, entry.WorkflowID)
+		actors = append(actors, entry.Actor)
+		transferIDs = append(transferIDs, entry.TransferID)
+		notes = append(notes, entry.Note)
+	}
+
+	_, err := tx.ExecContext(ctx, `
+INSERT INTO sample_history (barcode, action, changes, workflow_id, actor, transfer_id, note, recorded_at)
+SELECT barcode, action, changes::jsonb, workflow_id, actor, transfer_id, note, $8::timestamptz
+FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::bigint[], $7::text[])
+	WITH ORDINALITY AS t(barcode, action, changes, workflow_id, actor, transfer_id, note, n)
+ORDER BY n`,
+		barcodes, actions, changes, workflowIDs, actors, transferIDs, notes, now)
+	return err
+}
+
+func (s *postgresSampleStore) Close() error {
+	return s.db.Close()
+}
+
+// postgresSampleReader reads samples from the database or, inside a
+// transaction, from the transaction's snapshot.
+type postgresSampleReader struct {
+	q queryer
+}
+
+func (r postgresSampleReader) GetMany(barcodes []string) ([]Sample, error) {
+	if len(barcodes) == 0 {
+		return []Sample{}, nil
+	}
+	rows, err := r.q.QueryContext(ctx, `SELECT barcode, data FROM samples WHERE barcode = ANY($1)`, barcodes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	byBarcode := make(map[string]Sample, len(barcodes))
+	for rows.Next() {
+		var barcode string
+		var data []byte
+		if err := rows.Scan(&barcode, &data); err != nil {
+			return nil, err
+		}
+		sample, err := decodeSample(data)
+		if err != nil {
+			log.Printf("Invalid sample %s: %v", barcode, err)
+			continue
+		}
+		sample.refreshExpired(now)
+		byBarcode[barcode] = sample
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	samples := make([]Sample, 0, len(byBarcode))
+	for _, barcode := range barcodes {
+		if sample, ok := byBarcode[barcode]; ok {
+			samples = append(samples, sample)
+		}
+	}
+	return samples, nil
+}
+
+func (r postgresSampleReader) Occupants(wellKey string) ([]string, error) {
+	return queryStrings(r.q, `SELECT barcode FROM samples WHERE well_key = $1 ORDER BY barcode COLLATE "C"`, wellKey)
+}
+
+func (r postgresSampleReader) Children(barcode string) ([]string, error) {
+	return queryStrings(r.q, `
+SELECT barcode FROM samples
+WHERE parent_barcode = $1 OR data->'pooled_from' @> jsonb_build_array(jsonb_build_object('barcode', $1::text))
+ORDER BY barcode COLLATE "C"`, barcode)
+}
+
+// postgresSampleTx queues writes until the transaction commits.
+type postgresSampleTx struct {
+	postgresSampleReader
+	writes []SampleWrite
+}
+
+func (t *postgresSampleTx) Put(writes ...SampleWrite) {
+	attributeWrites(writes)
+	t.writes = append(t.writes, writes...)
+}
+
+func queryStrings(q queryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// nullTime passes a zero time as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// timestampOrEmpty normalizes an RFC 3339 timestamp for a timestamptz
+// column, or returns an empty string, stored as NULL, if it isn't one.
+func timestampOrEmpty(value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
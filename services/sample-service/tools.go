@@ -0,0 +1,7 @@
+//go:build tools
+
+// Package main tracks gqlgen, which generates the GraphQL server, as a
+// build-time dependency.
+package main
+
+import _ "github.com/99designs/gqlgen"
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Transfers are stored under transfer:<id>, with the IDs in the sorted set
+// samples:transfers scored by transfer time in milliseconds.
+const (
+	TRANSFER_KEY_PREFIX   = "transfer:"
+	TRANSFERS_KEY         = "samples:transfers"
+	TRANSFER_SEQUENCE_KEY = "transfers:sequence"
+)
+
+// maxTransferMoves bounds the samples moved by a single transfer.
+const maxTransferMoves = 1000
+
+const (
+	defaultTransferLimit = 50
+	maxTransferLimit     = 500
+)
+
+type TransferMove struct {
+	Barcode string `json:"barcode"`
+	ToPlate string `json:"to_plate"`
+	ToWell  string `json:"to_well"`
+}
+
+// TransferRequest moves the listed samples, or with from_plate and
+// to_plate every active sample on from_plate to the same well of to_plate.
+type TransferRequest struct {
+	Moves        []TransferMove `json:"moves"`
+	FromPlate    string         `json:"from_plate"`
+	ToPlate      string         `json:"to_plate"`
+	AllowPooling bool           `json:"allow_pooling"`
+	Note         string         `json:"note"`
+}
+
+// TransferredSample records where one sample of a transfer came from and
+// went to.
+type TransferredSample struct {
+	Barcode string   `json:"barcode"`
+	From    Location `json:"from"`
+	To      Location `json:"to"`
+}
+
+// TransferEvent is the audit record of one transfer.
+type TransferEvent struct {
+	ID            int64               `json:"id"`
+	FromPlate     string              `json:"from_plate,omitempty"`
+	ToPlate       string              `json:"to_plate,omitempty"`
+	AllowPooling  bool                `json:"allow_pooling,omitempty"`
+	Note          string              `json:"note,omitempty"`
+	Actor         string              `json:"actor,omitempty"`
+	Samples       []TransferredSample `json:"samples"`
+	TransferredAt string              `json:"transferred_at"`
+}
+
+type TransferListResponse struct {
+	Count     int             `json:"count"`
+	Transfers []TransferEvent `json:"transfers"`
+}
+
+// TransferMoveError explains why one move was rejected. Index is the
+// position of the move in the request, or in the plate's samples for a
+// plate mapping.
+type TransferMoveError struct {
+	Index             int    `json:"index"`
+	Barcode           string `json:"barcode,omitempty"`
+	Error             string `json:"error"`
+	ConflictingSample string `json:"conflicting_sample,omitempty"`
+}
+
+// TransferRejectedError is returned when any move of a transfer is
+// invalid; nothing is moved.
+type TransferRejectedError struct {
+	Errors []TransferMoveError
+}
+
+func (e *TransferRejectedError) Error() string {
+	return fmt.Sprintf("%d move(s) rejected", len(e.Errors))
+}
+
+func transferKey(id int64) string {
+	return TRANSFER_KEY_PREFIX + strconv.FormatInt(id, 10)
+}
+
+// plateMappingMoves lists a move to the same well of toPlate for every
+// active sample on fromPlate.
+func plateMappingMoves(fromPlate, toPlate string) ([]TransferMove, error) {
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Plate: fromPlate, Status: SampleStatusActive})
+	if err != nil {
+		return nil, err
+	}
+	samples, err := getSamples(barcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make([]TransferMove, 0, len(samples))
+	for _, sample := range samples {
+		moves = append(moves, TransferMove{Barcode: sample.Barcode, ToPlate: toPlate, ToWell: sample.Location.Well})
+	}
+	return moves, nil
+}
+
+// transferSamples applies the moves in one transaction, so the samples and
+// target wells can't change before the write. targets are the validated
+// destinations of the moves. The event is completed with the samples'
+// previous locations and stored with the moves; the moved samples are
+// returned.
+func transferSamples(moves []TransferMove, targets []Location, event *TransferEvent) ([]Sample, error) {
+	barcodes := make([]string, len(moves))
+	for i, move := range moves {
+		barcodes[i] = move.Barcode
+	}
+
+	id, err := redisClient.Incr(ctx, TRANSFER_SEQUENCE_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	event.ID = id
+	audit := SampleAudit{Action: SampleActionTransferred, Actor: event.Actor, TransferID: event.ID, Note: event.Note}
+
+	var updated []Sample
+	var now time.Time
+	err = sampleStore.Update(func(tx SampleTx) error {
+		stored, err := tx.GetMany(barcodes)
+		if err != nil {
+			return err
+		}
+		byBarcode := make(map[string]Sample, len(stored))
+		for _, sample := range stored {
+			byBarcode[sample.Barcode] = sample
+		}
+
+		now = time.Now().UTC()
+		rejected := []TransferMoveError{}
+		updated = make([]Sample, len(moves))
+		incoming := map[string][]int{}
+		for i, move := range moves {
+			sample, ok := byBarcode[move.Barcode]
+			switch {
+			case !ok:
+				rejected = append(rejected, TransferMoveError{Index: i, Barcode: move.Barcode, Error: "sample not found"})
+				continue
+			case sample.Archived:
+				rejected = append(rejected, TransferMoveError{Index: i, Barcode: move.Barcode, Error: "sample is archived"})
+				continue
+			}
+			sample.Location = targets[i]
+			sample.UpdatedAt = now.Format(time.RFC3339)
+			sample.Version++
+			sample.UpdatedBy = audit.Actor
+			updated[i] = sample
+			if wellKey := sample.wellKey(); wellKey != "" {
+				incoming[wellKey] = append(incoming[wellKey], i)
+			}
+		}
+
+		// Samples leaving a well free it, so wells are checked against the
+		// samples that stay plus the samples moving in.
+		if !event.AllowPooling {
+			moving := make(map[string]bool, len(moves))
+			for _, barcode := range barcodes {
+				moving[barcode] = true
+			}
+			for wellKey, indexes := range incoming {
+				occupants, err := tx.Occupants(wellKey)
+				if err != nil {
+					return err
+				}
+				staying := ""
+				for _, occupant := range occupants {
+					if !moving[occupant] {
+						staying = occupant
+						break
+					}
+				}
+				for n, i := range indexes {
+					occupant := staying
+					if occupant == "" && n > 0 {
+						occupant = moves[indexes[0]].Barcode
+					}
+					if occupant != "" {
+						target := targets[i]
+						rejected = append(rejected, TransferMoveError{
+							Index:             i,
+							Barcode:           moves[i].Barcode,
+							Error:             fmt.Sprintf("well %s on plate %s is occupied by sample %s", target.Well, target.Plate, occupant),
+							ConflictingSample: occupant,
+						})
+					}
+				}
+			}
+		}
+		if len(rejected) > 0 {
+			sort.Slice(rejected, func(a, b int) bool { return rejected[a].Index < rejected[b].Index })
+			return &TransferRejectedError{Errors: rejected}
+		}
+
+		event.Samples = make([]TransferredSample, len(moves))
+		for i, sample := range updated {
+			event.Samples[i] = TransferredSample{
+				Barcode: sample.Barcode,
+				From:    byBarcode[sample.Barcode].Location,
+				To:      sample.Location,
+			}
+		}
+		event.TransferredAt = now.Format(time.RFC3339)
+
+		for _, sample := range updated {
+			previous := byBarcode[sample.Barcode]
+			tx.Put(SampleWrite{Sample: sample, Previous: &previous, Audit: audit})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Transfers are kept in Redis whichever store holds the samples, so
+	// the record is written once the moves have been committed.
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, transferKey(event.ID), data, 0)
+		pipe.ZAdd(ctx, TRANSFERS_KEY, redis.Z{Score: float64(now.UnixMilli()), Member: event.ID})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// transferSamplesHandler moves many samples at once, e.g. for a plate
+// re-array. Either every move is applied or none is, and the transfer is
+// recorded as a single event.
+func transferSamplesHandler(c *gin.Context) {
+	var req TransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transfer request"})
+		return
+	}
+
+	moves := req.Moves
+	switch {
+	case req.FromPlate != "" || req.ToPlate != "":
+		if len(moves) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "give either moves or from_plate and to_plate"})
+			return
+		}
+		if req.FromPlate == "" || req.ToPlate == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from_plate and to_plate are both required"})
+			return
+		}
+		if req.FromPlate == req.ToPlate {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from_plate and to_plate must differ"})
+			return
+		}
+		var err error
+		moves, err = plateMappingMoves(req.FromPlate, req.ToPlate)
+		if err != nil {
+			log.Printf("Error getting samples on plate %s: %v", req.FromPlate, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve samples"})
+			return
+		}
+		if len(moves) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("plate %s has no active samples", req.FromPlate)})
+			return
+		}
+	case len(moves) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "moves or from_plate and to_plate are required"})
+		return
+	}
+	if len(moves) > maxTransferMoves {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a transfer can move at most %d samples", maxTransferMoves)})
+		return
+	}
+
+	locations := newLocationValidator(requestAccess(c).Lab)
+	targets := make([]Location, len(moves))
+	rejected := []TransferMoveError{}
+	seen := map[string]int{}
+	for i, move := range moves {
+		if move.Barcode == "" {
+			rejected = append(rejected, TransferMoveError{Index: i, Error: "barcode is required"})
+			continue
+		}
+		if first, ok := seen[move.Barcode]; ok {
+			rejected = append(rejected, TransferMoveError{Index: i, Barcode: move.Barcode, Error: fmt.Sprintf("sample is also moved by move %d", first)})
+			continue
+		}
+		seen[move.Barcode] = i
+
+		target, locErr := locations.Validate(Location{Plate: move.ToPlate, Well: move.ToWell})
+		if locErr != nil {
+			if locErr.StatusCode == http.StatusInternalServerError {
+				c.JSON(locErr.StatusCode, gin.H{"error": locErr.Message})
+				return
+			}
+			rejected = append(rejected, TransferMoveError{Index: i, Barcode: move.Barcode, Error: locErr.Message})
+			continue
+		}
+		targets[i] = target
+	}
+	if len(rejected) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Transfer rejected", "errors": rejected})
+		return
+	}
+	barcodes := make([]string, len(moves))
+	for i, move := range moves {
+		barcodes[i] = move.Barcode
+	}
+	if !requireSamplesAccess(c, barcodes) {
+		return
+	}
+
+	event := TransferEvent{
+		FromPlate:    req.FromPlate,
+		ToPlate:      req.ToPlate,
+		AllowPooling: req.AllowPooling,
+		Note:         req.Note,
+		Actor:        requestActor(c),
+	}
+	moved, err := transferSamples(moves, targets, &event)
+	if err != nil {
+		if rejection, ok := err.(*TransferRejectedError); ok {
+			log.Printf("Sample transfer rejected: %v", rejection)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Transfer rejected", "errors": rejection.Errors})
+			return
+		}
+		log.Printf("Error transferring samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer samples"})
+		return
+	}
+
+	for i, sample := range moved {
+		publishSampleMoved(sample, event.Samples[i].From, event.Actor)
+	}
+
+	log.Printf("Transfer %d moved %d sample(s)", event.ID, len(event.Samples))
+	c.JSON(http.StatusOK, event)
+}
+
+func getTransfer(id int64) (*TransferEvent, error) {
+	data, err := redisClient.Get(ctx, transferKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var event TransferEvent
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// listTransfersHandler returns the most recent transfers first.
+// visibleTransfer drops the samples of a transfer the request can't
+// access.
+func visibleTransfer(c *gin.Context, event *TransferEvent) error {
+	barcodes := make([]string, len(event.Samples))
+	for i, sample := range event.Samples {
+		barcodes[i] = sample.Barcode
+	}
+	visible, err := visibleBarcodes(c, barcodes)
+	if err != nil || visible == nil {
+		return err
+	}
+	samples := []TransferredSample{}
+	for _, sample := range event.Samples {
+		if visible[sample.Barcode] {
+			samples = append(samples, sample)
+		}
+	}
+	event.Samples = samples
+	return nil
+}
+
+func listTransfersHandler(c *gin.Context) {
+	limit := defaultTransferLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxTransferLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxTransferLimit)})
+			return
+		}
+		limit = n
+	}
+
+	ids, err := redisClient.ZRevRange(ctx, TRANSFERS_KEY, 0, int64(limit-1)).Result()
+	if err != nil {
+		log.Printf("Error listing transfers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfers"})
+		return
+	}
+
+	transfers := []TransferEvent{}
+	if len(ids) > 0 {
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = TRANSFER_KEY_PREFIX + id
+		}
+		values, err := redisClient.MGet(ctx, keys...).Result()
+		if err != nil {
+			log.Printf("Error listing transfers: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfers"})
+			return
+		}
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				continue
+			}
+			var event TransferEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				log.Printf("Invalid transfer %s: %v", ids[i], err)
+				continue
+			}
+			transfers = append(transfers, event)
+		}
+	}
+
+	if !requestAccess(c).All {
+		visible := []TransferEvent{}
+		for _, event := range transfers {
+			if err := visibleTransfer(c, &event); err != nil {
+				log.Printf("Error listing transfers: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfers"})
+				return
+			}
+			if len(event.Samples) > 0 {
+				visible = append(visible, event)
+			}
+		}
+		transfers = visible
+	}
+
+	c.JSON(http.StatusOK, TransferListResponse{Count: len(transfers), Transfers: transfers})
+}
+
+func getTransferHandler(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("transfer_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		return
+	}
+
+	event, err := getTransfer(id)
+	if err != nil {
+		log.Printf("Error getting transfer %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfer"})
+		return
+	}
+	if event == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		return
+	}
+	if err := visibleTransfer(c, event); err != nil {
+		log.Printf("Error getting transfer %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve transfer"})
+		return
+	}
+	if len(event.Samples) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transfer not found"})
+		return
+	}
+	c.JSON(http.StatusOK, event)
+}
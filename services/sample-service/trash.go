@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Deleting a sample moves it to the trash: it is given deleted_at, leaves
+// its well and every listing, and is answered as not found, until it is
+// restored or purged TRASH_RETENTION (a duration such as 720h, the
+// default) after it was deleted, by a janitor running every
+// RETENTION_CHECK_INTERVAL. Purging removes the sample but keeps its
+// history. TRASH_RETENTION=0 keeps deleted samples until they are
+// restored. Archiving, unlike deleting, keeps a sample findable for good.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+var trashRetention = defaultTrashRetention
+
+// TrashedSample is a deleted sample with when it will be purged.
+type TrashedSample struct {
+	Sample
+	PurgeAfter string `json:"purge_after,omitempty"`
+}
+
+type TrashListResponse struct {
+	Samples []TrashedSample `json:"samples"`
+	Total   int             `json:"total"`
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+}
+
+func trashed(sample Sample) TrashedSample {
+	deleted, err := time.Parse(time.RFC3339, sample.DeletedAt)
+	if err != nil || trashRetention == 0 {
+		return TrashedSample{Sample: sample}
+	}
+	return TrashedSample{Sample: sample, PurgeAfter: deleted.Add(trashRetention).Format(time.RFC3339)}
+}
+
+// deleteSampleHandler moves a sample to the trash. Samples reserved by a
+// workflow can't be deleted.
+func deleteSampleHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	stored, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if stored == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+	if !checkSampleVersion(c, *stored, nil) {
+		return
+	}
+
+	reservations, err := readReservations(redisClient, []string{barcode})
+	if err != nil {
+		log.Printf("Error getting reservation of sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete sample"})
+		return
+	}
+	if workflowID, ok := reservations[barcode]; ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sample is reserved by workflow " + workflowID, "reserved_by": workflowID})
+		return
+	}
+
+	sample := *stored
+	now := time.Now().UTC().Format(time.RFC3339)
+	sample.DeletedAt = now
+	sample.DeletedBy = requestActor(c)
+	sample.UpdatedAt = now
+
+	audit := SampleAudit{Action: SampleActionDeleted, Actor: requestActor(c)}
+	if err := updateSample(&sample, *stored, false, audit); err != nil {
+		if respondVersionConflict(c, err) {
+			return
+		}
+		log.Printf("Error saving sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete sample"})
+		return
+	}
+
+	log.Printf("Sample %s moved to the trash", barcode)
+	c.JSON(http.StatusOK, trashed(sample))
+}
+
+// listDeletedSamplesHandler lists a page of the deleted samples the
+// request can access, in barcode order.
+func listDeletedSamplesHandler(c *gin.Context) {
+	limit, offset, err := paginationFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	access := requestAccess(c)
+	filter := SampleFilter{Status: SampleStatusDeleted, Lab: &access.Lab, Projects: access.restrict(nil)}
+	barcodes, err := sampleStore.Barcodes(filter)
+	if err != nil {
+		log.Printf("Error getting deleted samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve deleted samples"})
+		return
+	}
+
+	response := TrashListResponse{Samples: []TrashedSample{}, Total: len(barcodes), Limit: limit, Offset: offset}
+	if offset < len(barcodes) {
+		end := offset + limit
+		if end > len(barcodes) {
+			end = len(barcodes)
+		}
+		samples, err := sampleStore.GetMany(barcodes[offset:end])
+		if err != nil {
+			log.Printf("Error getting deleted samples: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve deleted samples"})
+			return
+		}
+		for _, sample := range samples {
+			response.Samples = append(response.Samples, trashed(sample))
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// restoreDeletedSampleHandler takes a sample out of the trash. It goes back
+// to its well or storage position, unless another sample has taken it.
+func restoreDeletedSampleHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	stored, err := sampleStore.Get(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if stored == nil || !stored.deleted() || !requestAccess(c).allowsSample(*stored) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted sample not found"})
+		return
+	}
+
+	sample := *stored
+	sample.DeletedAt, sample.DeletedBy = "", ""
+	sample.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	audit := SampleAudit{Action: SampleActionRestored, Actor: requestActor(c), Note: "Restored from the trash"}
+	if err := updateSample(&sample, *stored, false, audit); err != nil {
+		if respondWellConflict(c, err) || respondVersionConflict(c, err) {
+			return
+		}
+		log.Printf("Error saving sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore sample"})
+		return
+	}
+
+	log.Printf("Sample %s restored from the trash", barcode)
+	c.Header("ETag", sampleETag(sample))
+	c.JSON(http.StatusOK, sample)
+}
+
+// purgeTrash removes the samples deleted before the cutoff, returning
+// their barcodes. Samples restored meanwhile are left alone.
+func purgeTrash(cutoff time.Time) ([]string, error) {
+	barcodes, err := sampleStore.Barcodes(SampleFilter{Status: SampleStatusDeleted})
+	if err != nil {
+		return nil, err
+	}
+	samples, err := sampleStore.GetMany(barcodes)
+	if err != nil {
+		return nil, err
+	}
+
+	purged := []string{}
+	for _, stored := range samples {
+		deleted, err := time.Parse(time.RFC3339, stored.DeletedAt)
+		if err != nil || !deleted.Before(cutoff) {
+			continue
+		}
+		err = sampleStore.Update(func(tx SampleTx) error {
+			current, err := tx.GetMany([]string{stored.Barcode})
+			if err != nil {
+				return err
+			}
+			if len(current) == 0 || current[0].Version != stored.Version {
+				return &VersionConflictError{Barcode: stored.Barcode, Expected: stored.Version}
+			}
+			tx.Put(SampleWrite{Sample: current[0], Previous: &current[0], Audit: SampleAudit{Action: SampleActionPurged}, Purge: true})
+			return nil
+		})
+		if err != nil {
+			var conflict *VersionConflictError
+			if !errors.As(err, &conflict) {
+				log.Printf("Error purging sample %s: %v", stored.Barcode, err)
+			}
+			continue
+		}
+		purged = append(purged, stored.Barcode)
+	}
+	return purged, nil
+}
+
+// startTrashJanitor purges deleted samples in the background once
+// TRASH_RETENTION has passed.
+func startTrashJanitor() {
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid TRASH_RETENTION %q", value)
+		}
+		trashRetention = d
+	}
+	if trashRetention == 0 {
+		return
+	}
+	interval := defaultRetentionInterval
+	if value := os.Getenv("RETENTION_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RETENTION_CHECK_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purged, err := purgeTrash(time.Now().Add(-trashRetention))
+			switch {
+			case err != nil:
+				log.Printf("Error purging deleted samples: %v", err)
+			case len(purged) > 0:
+				log.Printf("Purged %d sample(s) deleted more than %s ago", len(purged), trashRetention)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Purging deleted samples %s after they are deleted, checking every %s", trashRetention, interval)
+}
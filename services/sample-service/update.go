@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds on the free-text sample fields.
+const (
+	maxSampleNameLength = 200
+	maxSampleTypeLength = 100
+)
+
+// UpdateSampleRequest changes the fields given and leaves the rest. The
+// metadata is merged, with a null value removing that key, and an empty
+// expires_at clears the expiry. Version, like an If-Match header, makes the
+// update fail unless the sample is still at that version.
+type UpdateSampleRequest struct {
+	Name          *string            `json:"name"`
+	Type          *string            `json:"type"`
+	VolumeUL      *float64           `json:"volume_ul"`
+	Concentration *float64           `json:"concentration"`
+	Metadata      map[string]*string `json:"metadata"`
+	ExpiresAt     *string            `json:"expires_at"`
+	Project       *string            `json:"project"`
+	Version       *int64             `json:"version"`
+}
+
+var updatableSampleFields = map[string]bool{
+	"name":          true,
+	"type":          true,
+	"volume_ul":     true,
+	"concentration": true,
+	"metadata":      true,
+	"expires_at":    true,
+	"project":       true,
+	"version":       true,
+}
+
+// readOnlySampleFields explains why fields can't be changed with PATCH.
+var readOnlySampleFields = map[string]string{
+	"barcode":        "cannot be changed",
+	"location":       "use PUT /samples/:barcode/location",
+	"archived":       "use DELETE /samples/:barcode",
+	"archived_at":    "cannot be changed",
+	"parent_barcode": "cannot be changed",
+	"created_at":     "cannot be changed",
+	"updated_at":     "cannot be changed",
+	"placeholder":    "register the sample with POST /samples",
+	"expired":        "is computed from expires_at",
+}
+
+// sampleETag is the entity tag of a sample version.
+func sampleETag(sample Sample) string {
+	return fmt.Sprintf("%q", strconv.FormatInt(sample.Version, 10))
+}
+
+// ifMatchVersion reads the sample version from an If-Match header; "*" and
+// a missing header match any version.
+func ifMatchVersion(c *gin.Context) (*int64, error) {
+	value := strings.TrimSpace(c.GetHeader("If-Match"))
+	if value == "" || value == "*" {
+		return nil, nil
+	}
+	value = strings.Trim(strings.TrimPrefix(value, "W/"), `"`)
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("If-Match must be a sample version")
+	}
+	return &version, nil
+}
+
+// checkSampleVersion compares the version the client expects, from If-Match
+// or else the request body, with the stored sample, writing the error
+// response if the header is invalid or the versions differ.
+func checkSampleVersion(c *gin.Context, stored Sample, bodyVersion *int64) bool {
+	expected, err := ifMatchVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if expected == nil {
+		expected = bodyVersion
+	}
+	if expected != nil && *expected != stored.Version {
+		respondVersionConflict(c, &VersionConflictError{Barcode: stored.Barcode, Expected: *expected, Current: stored.Version})
+		return false
+	}
+	return true
+}
+
+// applySampleUpdate validates the request and applies it to the sample,
+// returning the problems by field.
+func applySampleUpdate(sample *Sample, req UpdateSampleRequest) map[string]string {
+	fields := map[string]string{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		switch {
+		case name == "":
+			fields["name"] = "must not be empty"
+		case len(name) > maxSampleNameLength:
+			fields["name"] = fmt.Sprintf("must be at most %d characters", maxSampleNameLength)
+		default:
+			sample.Name = name
+		}
+	}
+	if req.Type != nil {
+		sampleType := strings.TrimSpace(*req.Type)
+		switch {
+		case sampleType == "":
+			fields["type"] = "must not be empty"
+		case len(sampleType) > maxSampleTypeLength:
+			fields["type"] = fmt.Sprintf("must be at most %d characters", maxSampleTypeLength)
+		default:
+			sample.Type = sampleType
+		}
+	}
+	if req.VolumeUL != nil {
+		if err := validateMeasurements(req.VolumeUL, nil); err != nil {
+			fields["volume_ul"] = err.Error()
+		} else {
+			sample.VolumeUL = req.VolumeUL
+		}
+	}
+	if req.Concentration != nil {
+		if err := validateMeasurements(nil, req.Concentration); err != nil {
+			fields["concentration"] = err.Error()
+		} else {
+			sample.Concentration = req.Concentration
+		}
+	}
+	if req.Metadata != nil {
+		metadata := mergeMetadata(sample.Metadata, req.Metadata)
+		if err := validateMetadata(metadata); err != nil {
+			fields["metadata"] = err.Error()
+		} else {
+			sample.Metadata = metadata
+		}
+	}
+	if req.ExpiresAt != nil {
+		sample.ExpiresAt = ""
+		if *req.ExpiresAt != "" {
+			expiresAt, err := parseExpiry(*req.ExpiresAt)
+			if err != nil {
+				fields["expires_at"] = err.Error()
+			}
+			sample.ExpiresAt = expiresAt
+		}
+		sample.refreshExpired(time.Now())
+	}
+	if req.Project != nil {
+		sample.Project = strings.TrimSpace(*req.Project)
+	}
+	return fields
+}
+
+// updateSampleHandler changes any of the mutable sample fields. Problems
+// are reported together by field; the update is applied only if there are
+// none.
+func updateSampleHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be a JSON object"})
+		return
+	}
+	fields := map[string]string{}
+	for name := range raw {
+		if reason, ok := readOnlySampleFields[name]; ok {
+			fields[name] = reason
+		} else if !updatableSampleFields[name] {
+			fields[name] = "is not a sample field"
+		}
+	}
+	var req UpdateSampleRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stored, err := getSample(barcode)
+	if err != nil {
+		log.Printf("Error getting sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sample"})
+		return
+	}
+	if stored == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sample not found"})
+		return
+	}
+	if !checkSampleVersion(c, *stored, req.Version) {
+		return
+	}
+	sample := *stored
+	if sample.Archived {
+		c.JSON(http.StatusConflict, gin.H{"error": "Sample is archived"})
+		return
+	}
+
+	for name, problem := range applySampleUpdate(&sample, req) {
+		fields[name] = problem
+	}
+	if req.Project != nil && !requestAccess(c).allows(sample.Project) {
+		fields["project"] = "is not a project this API key can use"
+	}
+	if fields["type"] == "" && fields["metadata"] == "" && (req.Type != nil || req.Metadata != nil) {
+		if typeErr := newSampleTypeValidator().Validate(sample); typeErr != nil {
+			if typeErr.StatusCode != http.StatusBadRequest {
+				c.JSON(typeErr.StatusCode, gin.H{"error": typeErr.Message})
+				return
+			}
+			if req.Type != nil {
+				fields["type"] = typeErr.Message
+			} else {
+				fields["metadata"] = typeErr.Message
+			}
+		}
+	}
+	if len(fields) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sample fields", "fields": fields})
+		return
+	}
+	sample.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	audit := SampleAudit{Action: SampleActionUpdated, Actor: requestActor(c)}
+	if err := updateSample(&sample, *stored, false, audit); err != nil {
+		if respondVersionConflict(c, err) {
+			return
+		}
+		log.Printf("Error saving sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update sample"})
+		return
+	}
+
+	log.Printf("Updated sample %s (version %d)", barcode, sample.Version)
+	c.Header("ETag", sampleETag(sample))
+	c.JSON(http.StatusOK, sample)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// volumeTolerance absorbs floating point error when a draw empties a tube.
+const volumeTolerance = 1e-9
+
+// maxConsumptions bounds the samples drawn from by one bulk request.
+const maxConsumptions = 1000
+
+// SampleConsumption draws volume_ul microlitres from one sample.
+type SampleConsumption struct {
+	Barcode  string  `json:"barcode"`
+	VolumeUL float64 `json:"volume_ul"`
+}
+
+type ConsumeRequest struct {
+	VolumeUL   float64 `json:"volume_ul" binding:"required"`
+	WorkflowID string  `json:"workflow_id"`
+	DryRun     bool    `json:"dry_run"`
+}
+
+// BulkConsumeRequest draws from many samples at once, e.g. for a workflow
+// step; either every draw is applied or none is.
+type BulkConsumeRequest struct {
+	Consumptions []SampleConsumption `json:"consumptions" binding:"required"`
+	WorkflowID   string              `json:"workflow_id"`
+	StepIndex    *int                `json:"step_index,omitempty"`
+	DryRun       bool                `json:"dry_run"`
+}
+
+type ConsumeResponse struct {
+	DryRun  bool     `json:"dry_run"`
+	Samples []Sample `json:"samples"`
+}
+
+// ConsumptionError explains why a draw from one sample was rejected.
+type ConsumptionError struct {
+	Barcode     string   `json:"barcode"`
+	Error       string   `json:"error"`
+	RequestedUL float64  `json:"requested_ul"`
+	AvailableUL *float64 `json:"available_ul,omitempty"`
+}
+
+// ConsumeRejectedError is returned when any draw of a consumption is
+// invalid; nothing is consumed.
+type ConsumeRejectedError struct {
+	Errors []ConsumptionError
+}
+
+func (e *ConsumeRejectedError) Error() string {
+	return fmt.Sprintf("%d consumption(s) rejected", len(e.Errors))
+}
+
+// validateMeasurements rejects negative volumes and concentrations.
+func validateMeasurements(volumeUL, concentration *float64) error {
+	if volumeUL != nil && *volumeUL < 0 {
+		return errors.New("volume_ul must not be negative")
+	}
+	if concentration != nil && *concentration < 0 {
+		return errors.New("concentration must not be negative")
+	}
+	return nil
+}
+
+func formatMeasurement(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', -1, 64)
+}
+
+// consumeSamples subtracts the drawn volumes in one transaction, so
+// concurrent draws can't both succeed. Draws from the same sample are added
+// up. With dryRun the checks run but nothing is written; the returned
+// samples show the volumes left.
+func consumeSamples(consumptions []SampleConsumption, dryRun bool, audit SampleAudit) ([]Sample, error) {
+	barcodes := []string{}
+	requested := map[string]float64{}
+	for _, consumption := range consumptions {
+		if _, ok := requested[consumption.Barcode]; !ok {
+			barcodes = append(barcodes, consumption.Barcode)
+		}
+		requested[consumption.Barcode] += consumption.VolumeUL
+	}
+
+	var updated []Sample
+	err := sampleStore.Update(func(tx SampleTx) error {
+		stored, err := tx.GetMany(barcodes)
+		if err != nil {
+			return err
+		}
+		byBarcode := make(map[string]Sample, len(stored))
+		for _, sample := range stored {
+			byBarcode[sample.Barcode] = sample
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339)
+		rejected := []ConsumptionError{}
+		updated = make([]Sample, 0, len(barcodes))
+		for _, barcode := range barcodes {
+			volume := requested[barcode]
+			sample, ok := byBarcode[barcode]
+			switch {
+			case !ok:
+				rejected = append(rejected, ConsumptionError{Barcode: barcode, Error: "sample not found", RequestedUL: volume})
+				continue
+			case sample.Archived:
+				rejected = append(rejected, ConsumptionError{Barcode: barcode, Error: "sample is archived", RequestedUL: volume})
+				continue
+			case sample.VolumeUL == nil:
+				rejected = append(rejected, ConsumptionError{Barcode: barcode, Error: "sample volume is not tracked", RequestedUL: volume})
+				continue
+			case *sample.VolumeUL-volume < -volumeTolerance:
+				rejected = append(rejected, ConsumptionError{Barcode: barcode, Error: "insufficient volume", RequestedUL: volume, AvailableUL: sample.VolumeUL})
+				continue
+			}
+
+			remaining := *sample.VolumeUL - volume
+			if remaining < 0 {
+				remaining = 0
+			}
+			sample.VolumeUL = &remaining
+			sample.UpdatedAt = now
+			sample.Version++
+			sample.UpdatedBy = audit.Actor
+			updated = append(updated, sample)
+		}
+		if len(rejected) > 0 {
+			return &ConsumeRejectedError{Errors: rejected}
+		}
+		if dryRun {
+			return nil
+		}
+
+		for _, sample := range updated {
+			previous := byBarcode[sample.Barcode]
+			tx.Put(SampleWrite{Sample: sample, Previous: &previous, Audit: audit})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// consumeSampleHandler draws volume from one sample, rejecting draws of
+// more than is left.
+func consumeSampleHandler(c *gin.Context) {
+	barcode := c.Param("barcode")
+
+	var req ConsumeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.VolumeUL <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "volume_ul must be a positive number"})
+		return
+	}
+
+	audit := SampleAudit{Action: SampleActionConsumed, WorkflowID: req.WorkflowID, Actor: requestActor(c)}
+	samples, err := consumeSamples([]SampleConsumption{{Barcode: barcode, VolumeUL: req.VolumeUL}}, req.DryRun, audit)
+	if err != nil {
+		var rejected *ConsumeRejectedError
+		if errors.As(err, &rejected) {
+			rejection := rejected.Errors[0]
+			status := http.StatusConflict
+			if rejection.Error == "sample not found" {
+				status = http.StatusNotFound
+			}
+			body := gin.H{"error": rejection.Error, "requested_ul": rejection.RequestedUL}
+			if rejection.AvailableUL != nil {
+				body["available_ul"] = *rejection.AvailableUL
+			}
+			c.JSON(status, body)
+			return
+		}
+		log.Printf("Error consuming sample %s: %v", barcode, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to consume sample"})
+		return
+	}
+
+	if !req.DryRun {
+		publishSampleConsumed(samples, []SampleConsumption{{Barcode: barcode, VolumeUL: req.VolumeUL}}, audit)
+		log.Printf("Consumed %g uL of sample %s (workflow %q)", req.VolumeUL, barcode, req.WorkflowID)
+	}
+	c.JSON(http.StatusOK, samples[0])
+}
+
+// bulkConsumeHandler draws from many samples at once; used by the workflow
+// service when a step declares volume_ul.
+func bulkConsumeHandler(c *gin.Context) {
+	var req BulkConsumeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Consumptions) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "consumptions array is required"})
+		return
+	}
+	if len(req.Consumptions) > maxConsumptions {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d consumptions can be applied at once", maxConsumptions)})
+		return
+	}
+	for _, consumption := range req.Consumptions {
+		if consumption.Barcode == "" || consumption.VolumeUL <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "every consumption needs a barcode and a positive volume_ul"})
+			return
+		}
+	}
+	barcodes := make([]string, len(req.Consumptions))
+	for i, consumption := range req.Consumptions {
+		barcodes[i] = consumption.Barcode
+	}
+	if !requireSamplesAccess(c, barcodes) {
+		return
+	}
+
+	audit := SampleAudit{Action: SampleActionConsumed, WorkflowID: req.WorkflowID, Actor: requestActor(c)}
+	if req.StepIndex != nil {
+		audit.Note = fmt.Sprintf("step %d", *req.StepIndex)
+	}
+	samples, err := consumeSamples(req.Consumptions, req.DryRun, audit)
+	if err != nil {
+		var rejected *ConsumeRejectedError
+		if errors.As(err, &rejected) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Consumption rejected", "errors": rejected.Errors})
+			return
+		}
+		log.Printf("Error consuming samples: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to consume samples"})
+		return
+	}
+
+	if !req.DryRun {
+		publishSampleConsumed(samples, req.Consumptions, audit)
+		step := "-"
+		if req.StepIndex != nil {
+			step = strconv.Itoa(*req.StepIndex)
+		}
+		log.Printf("Consumed from %d sample(s) (workflow %q, step %s)", len(samples), req.WorkflowID, step)
+	}
+	c.JSON(http.StatusOK, ConsumeResponse{DryRun: req.DryRun, Samples: samples})
+}
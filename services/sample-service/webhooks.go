@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Webhooks are stored under webhook:<id>, with the IDs in the sorted set
+// webhooks:all. The outcome of the last delivery to each is kept under
+// webhook:<id>:last_delivery, which exists (empty at first) as long as the
+// webhook does.
+const (
+	WEBHOOK_KEY_PREFIX   = "webhook:"
+	WEBHOOKS_KEY         = "webhooks:all"
+	WEBHOOK_SEQUENCE_KEY = "webhooks:sequence"
+)
+
+// Webhook request headers. The signature is the hex HMAC-SHA256 of the body
+// with the webhook's secret.
+const (
+	WEBHOOK_EVENT_HEADER     = "X-Sample-Event"
+	WEBHOOK_ID_HEADER        = "X-Webhook-ID"
+	WEBHOOK_SIGNATURE_HEADER = "X-Webhook-Signature"
+)
+
+const (
+	webhookTimeout  = 5 * time.Second
+	webhookAttempts = 3
+	webhookBackoff  = 2 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// Webhook receives sample events as JSON POSTs. An empty Events list
+// subscribes to every event type. The secret is only returned when the
+// webhook is created.
+type Webhook struct {
+	ID           int64            `json:"id"`
+	URL          string           `json:"url"`
+	Events       []string         `json:"events"`
+	Secret       string           `json:"secret,omitempty"`
+	Lab          string           `json:"lab,omitempty"`
+	CreatedAt    string           `json:"created_at"`
+	LastDelivery *WebhookDelivery `json:"last_delivery,omitempty"`
+}
+
+type WebhookRequest struct {
+	URL    string   `json:"url" binding:"required"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// WebhookDelivery is the outcome of sending one event to a webhook.
+type WebhookDelivery struct {
+	Event      string `json:"event"`
+	Barcode    string `json:"barcode"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Attempts   int    `json:"attempts"`
+	At         string `json:"at"`
+}
+
+func webhookKey(id int64) string {
+	return WEBHOOK_KEY_PREFIX + strconv.FormatInt(id, 10)
+}
+
+func webhookDeliveryKey(id int64) string {
+	return webhookKey(id) + ":last_delivery"
+}
+
+func (w Webhook) subscribes(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range w.Events {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebhook(req WebhookRequest) error {
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	known := map[string]bool{}
+	for _, eventType := range sampleEventTypes {
+		known[eventType] = true
+	}
+	for _, eventType := range req.Events {
+		if !known[eventType] {
+			return fmt.Errorf("unknown event %q; events are %v", eventType, sampleEventTypes)
+		}
+	}
+	return nil
+}
+
+// listWebhooks returns every webhook, with its secret.
+func listWebhooks() ([]Webhook, error) {
+	ids, err := redisClient.ZRange(ctx, WEBHOOKS_KEY, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []Webhook{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = WEBHOOK_KEY_PREFIX + id
+	}
+	values, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]Webhook, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var webhook Webhook
+		if err := json.Unmarshal([]byte(data), &webhook); err != nil {
+			log.Printf("Error decoding webhook %s: %v", ids[i], err)
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+func getWebhook(id int64) (*Webhook, error) {
+	data, err := redisClient.Get(ctx, webhookKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var webhook Webhook
+	if err := json.Unmarshal([]byte(data), &webhook); err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// withLastDelivery returns the webhook as shown by the API: without its
+// secret and with the outcome of its last delivery.
+func withLastDelivery(webhook Webhook) Webhook {
+	webhook.Secret = ""
+	data, err := redisClient.Get(ctx, webhookDeliveryKey(webhook.ID)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error getting last delivery of webhook %d: %v", webhook.ID, err)
+		}
+		return webhook
+	}
+	var delivery WebhookDelivery
+	if err := json.Unmarshal([]byte(data), &delivery); err == nil && delivery.At != "" {
+		webhook.LastDelivery = &delivery
+	}
+	return webhook
+}
+
+// deliverWebhooks sends an encoded event to every webhook of the lab
+// subscribed to it.
+func deliverWebhooks(eventType, barcode, lab string, data []byte) {
+	webhooks, err := listWebhooks()
+	if err != nil {
+		log.Printf("Error listing webhooks for %s event: %v", eventType, err)
+		return
+	}
+	for _, webhook := range webhooks {
+		if webhook.Lab == lab && webhook.subscribes(eventType) {
+			go deliverWebhook(webhook, eventType, barcode, data)
+		}
+	}
+}
+
+// deliverWebhook POSTs an event to a webhook, retrying failed deliveries
+// with a growing delay, and records the outcome.
+func deliverWebhook(webhook Webhook, eventType, barcode string, data []byte) {
+	delivery := WebhookDelivery{Event: eventType, Barcode: barcode}
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * webhookBackoff)
+		}
+		delivery.Attempts = attempt
+		delivery.StatusCode, delivery.Error = 0, ""
+
+		req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(data))
+		if err != nil {
+			delivery.Error = err.Error()
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(WEBHOOK_EVENT_HEADER, eventType)
+		req.Header.Set(WEBHOOK_ID_HEADER, strconv.FormatInt(webhook.ID, 10))
+		if webhook.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(webhook.Secret))
+			mac.Write(data)
+			req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			delivery.Error = err.Error()
+			continue
+		}
+		resp.Body.Close()
+		delivery.StatusCode = resp.StatusCode
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			break
+		}
+		delivery.Error = fmt.Sprintf("webhook returned status %d", resp.StatusCode)
+	}
+
+	if delivery.Error != "" {
+		log.Printf("Error delivering %s event for %s to webhook %d: %s", eventType, barcode, webhook.ID, delivery.Error)
+	}
+	delivery.At = time.Now().UTC().Format(time.RFC3339)
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return
+	}
+	// Only record deliveries to webhooks that still exist.
+	if err := redisClient.SetXX(ctx, webhookDeliveryKey(webhook.ID), encoded, 0).Err(); err != nil && err != redis.Nil {
+		log.Printf("Error recording delivery to webhook %d: %v", webhook.ID, err)
+	}
+}
+
+func parseWebhookID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+func listWebhooksHandler(c *gin.Context) {
+	if !requireFullAccess(c) {
+		return
+	}
+	webhooks, err := listWebhooks()
+	if err != nil {
+		log.Printf("Error listing webhooks: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhooks"})
+		return
+	}
+	lab := requestAccess(c).Lab
+	inLab := []Webhook{}
+	for _, webhook := range webhooks {
+		if webhook.Lab == lab {
+			inLab = append(inLab, withLastDelivery(webhook))
+		}
+	}
+	c.JSON(http.StatusOK, inLab)
+}
+
+func createWebhookHandler(c *gin.Context) {
+	if !requireFullAccess(c) {
+		return
+	}
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "url is required"})
+		return
+	}
+	if err := validateWebhook(req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := redisClient.Incr(ctx, WEBHOOK_SEQUENCE_KEY).Result()
+	if err != nil {
+		log.Printf("Error allocating webhook ID: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save webhook"})
+		return
+	}
+	webhook := Webhook{
+		ID:        id,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    req.Secret,
+		Lab:       requestAccess(c).Lab,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		log.Printf("Error encoding webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save webhook"})
+		return
+	}
+
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, webhookKey(id), data, 0)
+		pipe.Set(ctx, webhookDeliveryKey(id), "{}", 0)
+		pipe.ZAdd(ctx, WEBHOOKS_KEY, redis.Z{Score: float64(id), Member: id})
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error saving webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save webhook"})
+		return
+	}
+
+	log.Printf("Webhook %d registered for %s", id, webhook.URL)
+	c.JSON(http.StatusCreated, webhook)
+}
+
+func getWebhookHandler(c *gin.Context) {
+	if !requireFullAccess(c) {
+		return
+	}
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	webhook, err := getWebhook(id)
+	if err != nil {
+		log.Printf("Error getting webhook %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook"})
+		return
+	}
+	if webhook == nil || webhook.Lab != requestAccess(c).Lab {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	c.JSON(http.StatusOK, withLastDelivery(*webhook))
+}
+
+func deleteWebhookHandler(c *gin.Context) {
+	if !requireFullAccess(c) {
+		return
+	}
+	id, ok := parseWebhookID(c)
+	if !ok {
+		return
+	}
+	webhook, err := getWebhook(id)
+	if err != nil {
+		log.Printf("Error getting webhook %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	if webhook == nil || webhook.Lab != requestAccess(c).Lab {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+	var deleted *redis.IntCmd
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, webhookKey(id))
+		pipe.Del(ctx, webhookDeliveryKey(id))
+		pipe.ZRem(ctx, WEBHOOKS_KEY, id)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error deleting webhook %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+	if deleted.Val() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	}
+
+	log.Printf("Webhook %d deleted", id)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"platform"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	redisClient redis.UniversalClient
+	ctx         = context.Background()
+)
+
+// healthHandler reports the service alive, and degraded while Redis is
+// down; /ready says whether it can take requests.
+func healthHandler(c *gin.Context) {
+	status := "healthy"
+	if !platform.RedisUp() {
+		status = "degraded"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  status,
+		"service": "user-service",
+		"redis":   platform.RedisStatus(),
+	})
+}
+
+func main() {
+	// Configure logging
+	log.SetOutput(os.Stdout)
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	// Get environment variables
+	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	if len(jwtSecret) == 0 {
+		log.Fatal("JWT_SECRET environment variable is required")
+	}
+	if ttl := os.Getenv("SESSION_TTL"); ttl != "" {
+		parsed, err := time.ParseDuration(ttl)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("Invalid SESSION_TTL %q", ttl)
+		}
+		sessionTTL = parsed
+	}
+
+	oidcConfig = OIDCConfig{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		AutoCreate:   os.Getenv("OIDC_AUTO_CREATE") != "false",
+		PostLoginURL: os.Getenv("OIDC_POST_LOGIN_URL"),
+	}
+
+	// Connect to Redis, retrying while it starts. The admin is created once
+	// it is up.
+	redisClient = platform.NewRedisClient()
+	adminUsername := os.Getenv("USER_ADMIN_USERNAME")
+	if adminUsername == "" {
+		adminUsername = "admin"
+	}
+	platform.WaitForRedis(redisClient, func() {
+		bootstrapAdmin(adminUsername, os.Getenv("USER_ADMIN_PASSWORD"))
+	})
+
+	configureAuditLog()
+	configureRequestLimits()
+	platform.ConfigureFeatureFlags()
+
+	// Setup Gin
+	platform.ConfigureDebug(redisClient)
+	router := gin.Default()
+	platform.RegisterDebug(router)
+
+	// CORS configuration
+	corsPolicy, err := platform.CORSConfig(cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "Authorization", API_VERSION_HEADER},
+		ExposeHeaders: []string{API_VERSION_HEADER},
+	})
+	if err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	router.Use(cors.New(corsPolicy))
+	router.Use(limitRequestBodies())
+	router.Use(auditLog())
+
+	// Routes
+	router.GET("/health", healthHandler)
+	router.GET("/ready", platform.ReadyHandler)
+	registerRoutes(router.Group("/v1", platform.RequireRedis(), apiVersion()))
+
+	// Start server
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "5005"
+	}
+
+	log.Printf("User service starting on port %s", port)
+	if err := serve(router, "0.0.0.0:"+port); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+}
+
+// registerRoutes adds the API's routes to a group mounted at /v1. This
+// service has no unversioned paths to keep.
+func registerRoutes(api *gin.RouterGroup) {
+	api.POST("/auth/login", loginHandler)
+	api.GET("/auth/oidc/login", oidcLoginHandler)
+	api.GET("/auth/oidc/callback", oidcCallbackHandler)
+
+	signedIn := api.Group("", authenticated())
+	signedIn.POST("/auth/logout", logoutHandler)
+	signedIn.GET("/me", meHandler)
+	signedIn.PATCH("/me", updateMeHandler)
+
+	admin := signedIn.Group("", adminOnly())
+	admin.GET("/users", listUsersHandler)
+	admin.POST("/users", createUserHandler)
+	admin.GET("/users/audit-log", auditLogHandler)
+	admin.GET("/users/:user_id", getUserHandler)
+	admin.PATCH("/users/:user_id", updateUserHandler)
+	admin.DELETE("/users/:user_id", deleteUserHandler)
+	admin.GET("/admin/storage/keys", listRedisKeysHandler)
+	admin.GET("/admin/storage/keys/*key", getRedisKeyHandler)
+	admin.PUT("/admin/storage/keys/*key", putRedisKeyHandler)
+	admin.DELETE("/admin/storage/keys/*key", deleteRedisKeyHandler)
+	admin.GET("/admin/storage/audit", storageAuditHandler)
+}
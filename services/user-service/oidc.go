@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// OIDC sign in is in flight under oidc:state:<state>, holding the nonce
+// the ID token must carry, for oidcStateTTL.
+const (
+	OIDC_STATE_KEY_PREFIX = "oidc:state:"
+	oidcStateTTL          = 10 * time.Minute
+)
+
+// SSO is configured with OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET
+// and OIDC_REDIRECT_URL (this service's /v1/auth/oidc/callback as the
+// provider reaches it). Users signing in for the first time are created
+// unless OIDC_AUTO_CREATE=false. With OIDC_POST_LOGIN_URL set, the
+// callback redirects there with the token in the URL fragment instead of
+// returning it.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	AutoCreate   bool
+	PostLoginURL string
+}
+
+var oidcConfig OIDCConfig
+
+// The provider's endpoints are discovered on first use, so the service
+// starts even while the provider is unreachable.
+var (
+	oidcMu       sync.Mutex
+	oidcProvider *oidc.Provider
+)
+
+// IDTokenClaims are the claims read from the provider's ID token.
+type IDTokenClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+func (cfg OIDCConfig) enabled() bool {
+	return cfg.Issuer != "" && cfg.ClientID != ""
+}
+
+func getOIDCProvider() (*oidc.Provider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcProvider == nil {
+		provider, err := oidc.NewProvider(ctx, oidcConfig.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		oidcProvider = provider
+	}
+	return oidcProvider, nil
+}
+
+func oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     oidcConfig.ClientID,
+		ClientSecret: oidcConfig.ClientSecret,
+		RedirectURL:  oidcConfig.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// oidcLoginHandler sends the browser to the provider to sign in.
+func oidcLoginHandler(c *gin.Context) {
+	if !oidcConfig.enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SSO is not configured"})
+		return
+	}
+	provider, err := getOIDCProvider()
+	if err != nil {
+		log.Printf("Error discovering OIDC provider %s: %v", oidcConfig.Issuer, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "SSO provider is unavailable"})
+		return
+	}
+
+	state, err := randomHex(16)
+	if err == nil {
+		var nonce string
+		nonce, err = randomHex(16)
+		if err == nil {
+			err = redisClient.Set(ctx, OIDC_STATE_KEY_PREFIX+state, nonce, oidcStateTTL).Err()
+		}
+		if err == nil {
+			c.Redirect(http.StatusFound, oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce)))
+			return
+		}
+	}
+	log.Printf("Error starting SSO sign in: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start sign in"})
+}
+
+// oidcCallbackHandler finishes signing in: it exchanges the code for an ID
+// token, finds or creates the user it names and starts their session.
+func oidcCallbackHandler(c *gin.Context) {
+	if !oidcConfig.enabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SSO is not configured"})
+		return
+	}
+	if errParam := c.Query("error"); errParam != "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in failed: " + errParam})
+		return
+	}
+
+	nonce, err := redisClient.GetDel(ctx, OIDC_STATE_KEY_PREFIX+c.Query("state")).Result()
+	if err == redis.Nil || c.Query("state") == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Sign in expired or was already used; try again"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking SSO state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+
+	provider, err := getOIDCProvider()
+	if err != nil {
+		log.Printf("Error discovering OIDC provider %s: %v", oidcConfig.Issuer, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "SSO provider is unavailable"})
+		return
+	}
+	oauthToken, err := oauth2Config(provider).Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		log.Printf("Error exchanging SSO code: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in failed"})
+		return
+	}
+	rawIDToken, ok := oauthToken.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in failed: no ID token"})
+		return
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oidcConfig.ClientID}).Verify(c.Request.Context(), rawIDToken)
+	if err != nil || idToken.Nonce != nonce {
+		log.Printf("Invalid SSO ID token: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in failed"})
+		return
+	}
+	var claims IDTokenClaims
+	if err := idToken.Claims(&claims); err != nil {
+		log.Printf("Error reading SSO ID token claims: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in failed"})
+		return
+	}
+
+	user, status, err := ssoUser(idToken.Subject, claims)
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			log.Printf("Error finding SSO user %s: %v", idToken.Subject, err)
+			err = fmt.Errorf("Failed to sign in")
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp, err := startSession(user, "oidc")
+	if err != nil {
+		log.Printf("Error starting session for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+	if oidcConfig.PostLoginURL != "" {
+		fragment := url.Values{"token": {resp.Token}, "expires_at": {resp.ExpiresAt}}
+		c.Redirect(http.StatusFound, oidcConfig.PostLoginURL+"#"+fragment.Encode())
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// ssoUser returns the user an OIDC subject signs in as. A new subject is
+// linked to the user with its username if that user has the same verified
+// email and no SSO yet, or else becomes a new user.
+func ssoUser(subject string, claims IDTokenClaims) (*User, int, error) {
+	user, err := findUser(oidcSubjectKey(subject))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if user != nil {
+		if user.Disabled {
+			return nil, http.StatusUnauthorized, fmt.Errorf("This user is disabled")
+		}
+		return user, http.StatusOK, nil
+	}
+
+	username := normalizeUsername(claims.PreferredUsername)
+	if username == "" {
+		username = normalizeUsername(claims.Email)
+	}
+	if !usernamePattern.MatchString(username) {
+		return nil, http.StatusForbidden, fmt.Errorf("No username could be made for this account; ask an admin to create one")
+	}
+
+	existing, err := findUser(usernameKey(username))
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if existing != nil {
+		if existing.OIDCSubject != "" || !claims.EmailVerified || !strings.EqualFold(existing.Email, claims.Email) {
+			return nil, http.StatusConflict, fmt.Errorf("Username %s is taken by another user", username)
+		}
+		if existing.Disabled {
+			return nil, http.StatusUnauthorized, fmt.Errorf("This user is disabled")
+		}
+		existing.OIDCSubject = subject
+		existing.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		if err := saveUser(*existing); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if err := redisClient.Set(ctx, oidcSubjectKey(subject), existing.ID, 0).Err(); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		log.Printf("Linked SSO subject %s to user %s (%d)", subject, existing.Username, existing.ID)
+		return existing, http.StatusOK, nil
+	}
+
+	if !oidcConfig.AutoCreate {
+		return nil, http.StatusForbidden, fmt.Errorf("No user for this account; ask an admin to create one")
+	}
+	newUser := User{Username: username, Name: claims.Name, Role: RoleUser, OIDCSubject: subject}
+	if claims.EmailVerified {
+		newUser.Email = claims.Email
+	}
+	created, err := createUser(newUser)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if created == nil {
+		return nil, http.StatusConflict, fmt.Errorf("Username %s is taken by another user", username)
+	}
+	log.Printf("Created user %s (%d) on first SSO sign in", created.Username, created.ID)
+	return created, http.StatusOK, nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Sessions are stored under session:<id> until they expire, with each
+// user's session IDs in the set user:<id>:sessions so they can all be
+// ended at once. The gateway reads session:<id> to check tokens too.
+const (
+	SESSION_KEY_PREFIX = "session:"
+	tokenIssuer        = "user-service"
+)
+
+// userContextKey holds the signed in User in the gin context, and
+// sessionContextKey the ID of their session.
+const (
+	userContextKey    = "user"
+	sessionContextKey = "session"
+)
+
+// Tokens are signed with JWT_SECRET, which the gateway shares, and last
+// SESSION_TTL.
+var (
+	jwtSecret  []byte
+	sessionTTL = 12 * time.Hour
+)
+
+// dummyHash is compared against when a username is unknown, so a login
+// takes as long whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+// Session is one sign in of a user, by password or SSO.
+type Session struct {
+	ID        string `json:"id"`
+	UserID    int64  `json:"user_id"`
+	Method    string `json:"method"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// Claims are carried in session tokens. The subject is the user ID and the
+// token ID the session ID.
+type Claims struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Lab      string `json:"lab,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type LoginRequest struct {
+	Username string `json:"username" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type LoginResponse struct {
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expires_at"`
+	User      User   `json:"user"`
+}
+
+func sessionKey(id string) string {
+	return SESSION_KEY_PREFIX + id
+}
+
+func userSessionsKey(userID int64) string {
+	return userKey(userID) + ":sessions"
+}
+
+// startSession records a session for the user and issues its token.
+func startSession(user *User, method string) (*LoginResponse, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(sessionTTL)
+	session := Session{
+		ID:        hex.EncodeToString(id),
+		UserID:    user.ID,
+		Method:    method,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
+		Username: user.Username,
+		Role:     user.Role,
+		Lab:      user.Lab,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			ID:        session.ID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}).SignedString(jwtSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	user.LastLoginAt = session.CreatedAt
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	userData, err := json.Marshal(user)
+	if err != nil {
+		return nil, err
+	}
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(session.ID), data, sessionTTL)
+		pipe.SAdd(ctx, userSessionsKey(user.ID), session.ID)
+		pipe.Expire(ctx, userSessionsKey(user.ID), sessionTTL)
+		pipe.Set(ctx, userKey(user.ID), userData, 0)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("User %s (%d) signed in with %s", user.Username, user.ID, method)
+	return &LoginResponse{Token: token, ExpiresAt: session.ExpiresAt, User: user.public()}, nil
+}
+
+// parseToken checks a token's signature and expiry and that its session
+// hasn't ended.
+func parseToken(token string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	exists, err := redisClient.Exists(ctx, sessionKey(claims.ID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, errSessionEnded
+	}
+	return &claims, nil
+}
+
+var errSessionEnded = errors.New("session has ended")
+
+// revokeUserSessions ends every session of a user.
+func revokeUserSessions(userID int64) {
+	ids, err := redisClient.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		log.Printf("Error listing sessions of user %d: %v", userID, err)
+		return
+	}
+	keys := []string{userSessionsKey(userID)}
+	for _, id := range ids {
+		keys = append(keys, sessionKey(id))
+	}
+	if err := redisClient.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Error ending sessions of user %d: %v", userID, err)
+	}
+}
+
+func bearerToken(c *gin.Context) string {
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ""
+}
+
+// authenticated requires a valid session token and loads its user, who
+// must still exist and be enabled.
+func authenticated() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Sign in required"})
+			return
+		}
+		claims, err := parseToken(token)
+		if err != nil {
+			if !errors.Is(err, errSessionEnded) && !errors.Is(err, jwt.ErrTokenMalformed) &&
+				!errors.Is(err, jwt.ErrTokenSignatureInvalid) && !errors.Is(err, jwt.ErrTokenExpired) {
+				log.Printf("Error checking session token: %v", err)
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+			return
+		}
+		userID, _ := strconv.ParseInt(claims.Subject, 10, 64)
+		user, err := getUser(userID)
+		if err != nil {
+			log.Printf("Error getting user %d: %v", userID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+			return
+		}
+		if user == nil || user.Disabled {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session"})
+			return
+		}
+		c.Set(userContextKey, user)
+		c.Set(sessionContextKey, claims.ID)
+		c.Next()
+	}
+}
+
+// adminOnly rejects signed in users who aren't admins.
+func adminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if currentUser(c).Role != RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin only"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// currentUser returns the user signed in for the request.
+func currentUser(c *gin.Context) *User {
+	if value, ok := c.Get(userContextKey); ok {
+		return value.(*User)
+	}
+	return &User{}
+}
+
+func loginHandler(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := findUser(usernameKey(normalizeUsername(req.Username)))
+	if err != nil {
+		log.Printf("Error looking up user %s: %v", req.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+	hash := dummyHash
+	if user != nil && user.PasswordHash != "" {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil || user == nil || user.PasswordHash == "" || user.Disabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		return
+	}
+
+	resp, err := startSession(user, "password")
+	if err != nil {
+		log.Printf("Error starting session for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func logoutHandler(c *gin.Context) {
+	sessionID := c.GetString(sessionContextKey)
+	user := currentUser(c)
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(sessionID))
+		pipe.SRem(ctx, userSessionsKey(user.ID), sessionID)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error ending session of user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign out"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func meHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, currentUser(c).public())
+}
+
+// updateMeHandler lets users change their own name, email and password.
+// Changing the password ends their other sessions.
+func updateMeHandler(c *gin.Context) {
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user := currentUser(c)
+	if status, err := applyUserUpdate(user, req, false); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveUser(*user); err != nil {
+		log.Printf("Error saving user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	if req.Password != nil {
+		sessionID := c.GetString(sessionContextKey)
+		ids, err := redisClient.SMembers(ctx, userSessionsKey(user.ID)).Result()
+		if err != nil {
+			log.Printf("Error listing sessions of user %d: %v", user.ID, err)
+		}
+		for _, id := range ids {
+			if id != sessionID {
+				redisClient.Del(ctx, sessionKey(id))
+				redisClient.SRem(ctx, userSessionsKey(user.ID), id)
+			}
+		}
+	}
+	c.JSON(http.StatusOK, user.public())
+}
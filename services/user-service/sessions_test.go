@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startUserService serves the API on a fake Redis, with admin signing in
+// with the password "admin-password".
+func startUserService(t *testing.T) *gin.Engine {
+	t.Helper()
+	startFakeRedis(t)
+	previous := jwtSecret
+	jwtSecret = []byte("test-secret")
+	t.Cleanup(func() { jwtSecret = previous })
+	bootstrapAdmin("Admin", "admin-password")
+
+	router := gin.New()
+	registerRoutes(router.Group("/v1"))
+	return router
+}
+
+// userRequest makes a request with a session token, if given, and decodes
+// the JSON response into out, if given.
+func userRequest(t *testing.T, router *gin.Engine, method, path, token string, body, out interface{}) int {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	router.ServeHTTP(w, r)
+	if out != nil && w.Code < 300 {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func login(t *testing.T, router *gin.Engine, username, password string) (string, int) {
+	t.Helper()
+	var resp LoginResponse
+	code := userRequest(t, router, http.MethodPost, "/v1/auth/login", "", LoginRequest{Username: username, Password: password}, &resp)
+	return resp.Token, code
+}
+
+func TestLogin(t *testing.T) {
+	router := startUserService(t)
+
+	if _, code := login(t, router, "admin", "wrong-password"); code != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %d, want 401", code)
+	}
+	if _, code := login(t, router, "nobody", "admin-password"); code != http.StatusUnauthorized {
+		t.Errorf("unknown user: got %d, want 401", code)
+	}
+	token, code := login(t, router, "admin", "admin-password")
+	if code != http.StatusOK || token == "" {
+		t.Fatalf("got %d, want a token", code)
+	}
+
+	var me User
+	if code := userRequest(t, router, http.MethodGet, "/v1/me", token, nil, &me); code != http.StatusOK || me.Username != "admin" || me.Role != RoleAdmin || me.PasswordHash != "" {
+		t.Errorf("got %d %+v, want the admin without a password hash", code, me)
+	}
+	if code := userRequest(t, router, http.MethodGet, "/v1/me", "", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("signed out: got %d, want 401", code)
+	}
+	if code := userRequest(t, router, http.MethodGet, "/v1/me", token+"x", nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("tampered token: got %d, want 401", code)
+	}
+
+	if code := userRequest(t, router, http.MethodPost, "/v1/auth/logout", token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("logout: got %d", code)
+	}
+	if code := userRequest(t, router, http.MethodGet, "/v1/me", token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("after logout: got %d, want 401", code)
+	}
+}
+
+func TestUserRoles(t *testing.T) {
+	router := startUserService(t)
+	admin, _ := login(t, router, "admin", "admin-password")
+
+	var alice User
+	create := CreateUserRequest{Username: "alice", Password: "alice-password", Lab: "lab-2"}
+	if code := userRequest(t, router, http.MethodPost, "/v1/users", admin, create, &alice); code != http.StatusCreated || alice.Role != RoleUser {
+		t.Fatalf("create: got %d %+v, want a user", code, alice)
+	}
+	if code := userRequest(t, router, http.MethodPost, "/v1/users", admin, create, nil); code != http.StatusConflict {
+		t.Errorf("create again: got %d, want 409", code)
+	}
+	token, code := login(t, router, "alice", "alice-password")
+	if code != http.StatusOK {
+		t.Fatalf("login: got %d", code)
+	}
+
+	if code := userRequest(t, router, http.MethodGet, "/v1/users", token, nil, nil); code != http.StatusForbidden {
+		t.Errorf("list users as a user: got %d, want 403", code)
+	}
+	if code := userRequest(t, router, http.MethodPatch, "/v1/me", token, map[string]string{"role": RoleAdmin}, nil); code != http.StatusForbidden {
+		t.Errorf("own role change: got %d, want 403", code)
+	}
+	var users []User
+	if code := userRequest(t, router, http.MethodGet, "/v1/users", admin, nil, &users); code != http.StatusOK || len(users) != 2 {
+		t.Errorf("list users as an admin: got %d %+v", code, users)
+	}
+
+	path := "/v1/users/" + strconv.FormatInt(alice.ID, 10)
+	if code := userRequest(t, router, http.MethodPatch, path, admin, map[string]bool{"disabled": true}, nil); code != http.StatusOK {
+		t.Fatalf("disable: got %d", code)
+	}
+	if code := userRequest(t, router, http.MethodGet, "/v1/me", token, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("disabled user's session: got %d, want 401", code)
+	}
+	if _, code := login(t, router, "alice", "alice-password"); code != http.StatusUnauthorized {
+		t.Errorf("disabled user's login: got %d, want 401", code)
+	}
+}
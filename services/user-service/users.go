@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users are stored under user:<id>, with the IDs in the sorted set
+// users:all. Usernames map to IDs under users:username:<username>, and
+// users who sign in with SSO have their OIDC subject mapped under
+// users:oidc:<subject>.
+const (
+	USER_KEY_PREFIX          = "user:"
+	USERS_KEY                = "users:all"
+	USER_SEQUENCE_KEY        = "users:sequence"
+	USERNAME_KEY_PREFIX      = "users:username:"
+	USER_OIDC_SUBJECT_PREFIX = "users:oidc:"
+)
+
+// Roles a user can have. Admins manage the other users.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+const minPasswordLength = 8
+
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._@-]{0,63}$`)
+
+// Each user works in one lab, which the gateway passes on to the services
+// from their session. Users without one are in the default lab, whose name
+// "default" no other lab can take.
+var labPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// User is a person who signs in with a password, SSO or both. The
+// password hash is stored with the user but never returned.
+type User struct {
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	Name         string `json:"name,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Role         string `json:"role"`
+	Disabled     bool   `json:"disabled"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	OIDCSubject  string `json:"oidc_subject,omitempty"`
+	Lab          string `json:"lab,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at,omitempty"`
+	LastLoginAt  string `json:"last_login_at,omitempty"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username" binding:"required"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+	Password string `json:"password"`
+	Lab      string `json:"lab"`
+}
+
+// UpdateUserRequest changes the fields given. Users may change their own
+// name, email and password; role, disabled and lab are for admins.
+type UpdateUserRequest struct {
+	Name            *string `json:"name"`
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"`
+	Role            *string `json:"role"`
+	Disabled        *bool   `json:"disabled"`
+	Lab             *string `json:"lab"`
+}
+
+func userKey(id int64) string {
+	return USER_KEY_PREFIX + strconv.FormatInt(id, 10)
+}
+
+func usernameKey(username string) string {
+	return USERNAME_KEY_PREFIX + username
+}
+
+func oidcSubjectKey(subject string) string {
+	return USER_OIDC_SUBJECT_PREFIX + subject
+}
+
+// public returns the user as shown in responses.
+func (u User) public() User {
+	u.PasswordHash = ""
+	return u
+}
+
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func validateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", fmt.Errorf("email must be an email address")
+	}
+	return address.Address, nil
+}
+
+func validateRole(role string) error {
+	if role != RoleAdmin && role != RoleUser {
+		return fmt.Errorf("role must be %s or %s", RoleAdmin, RoleUser)
+	}
+	return nil
+}
+
+func validateLab(lab string) error {
+	if lab != "" && (!labPattern.MatchString(lab) || lab == "default") {
+		return fmt.Errorf("lab must be lower case letters, digits and dashes, and not default")
+	}
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func getUser(id int64) (*User, error) {
+	data, err := redisClient.Get(ctx, userKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := json.Unmarshal([]byte(data), &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// findUser looks a user up through one of the index keys.
+func findUser(indexKey string) (*User, error) {
+	id, err := redisClient.Get(ctx, indexKey).Int64()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return getUser(id)
+}
+
+func saveUser(user User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, userKey(user.ID), data, 0).Err()
+}
+
+// createUser stores a new user, claiming its username first so two users
+// can't be created with the same one.
+func createUser(user User) (*User, error) {
+	id, err := redisClient.Incr(ctx, USER_SEQUENCE_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	claimed, err := redisClient.SetNX(ctx, usernameKey(user.Username), id, 0).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, nil
+	}
+
+	user.ID = id
+	user.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(user)
+	if err == nil {
+		_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, userKey(id), data, 0)
+			pipe.ZAdd(ctx, USERS_KEY, redis.Z{Score: float64(id), Member: id})
+			if user.OIDCSubject != "" {
+				pipe.Set(ctx, oidcSubjectKey(user.OIDCSubject), id, 0)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		redisClient.Del(ctx, usernameKey(user.Username))
+		return nil, err
+	}
+	return &user, nil
+}
+
+func listUsers() ([]User, error) {
+	ids, err := redisClient.ZRange(ctx, USERS_KEY, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []User{}, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = USER_KEY_PREFIX + id
+	}
+	values, err := redisClient.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, 0, len(values))
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var user User
+		if err := json.Unmarshal([]byte(data), &user); err != nil {
+			log.Printf("Error decoding user %s: %v", ids[i], err)
+			continue
+		}
+		users = append(users, user.public())
+	}
+	return users, nil
+}
+
+// bootstrapAdmin creates the first admin from USER_ADMIN_USERNAME and
+// USER_ADMIN_PASSWORD, so there is someone to create the other users.
+func bootstrapAdmin(username, password string) {
+	if password == "" {
+		return
+	}
+	username = normalizeUsername(username)
+	existing, err := findUser(usernameKey(username))
+	if err != nil {
+		log.Printf("Error looking up admin user %s: %v", username, err)
+		return
+	}
+	if existing != nil {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Can't create admin user %s: %v", username, err)
+		return
+	}
+	if _, err := createUser(User{Username: username, Role: RoleAdmin, PasswordHash: hash}); err != nil {
+		log.Printf("Error creating admin user %s: %v", username, err)
+		return
+	}
+	log.Printf("Created admin user %s", username)
+}
+
+func parseUserID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+func listUsersHandler(c *gin.Context) {
+	users, err := listUsers()
+	if err != nil {
+		log.Printf("Error listing users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve users"})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+func createUserHandler(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user := User{Username: normalizeUsername(req.Username), Name: strings.TrimSpace(req.Name), Role: req.Role, Lab: strings.TrimSpace(req.Lab)}
+	if !usernamePattern.MatchString(user.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username must be lower case letters, digits and . _ @ -"})
+		return
+	}
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	if err := validateRole(user.Role); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateLab(user.Lab); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email, err := validateEmail(req.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user.Email = email
+	// Users without a password can only sign in with SSO.
+	if req.Password != "" {
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user.PasswordHash = hash
+	}
+
+	created, err := createUser(user)
+	if err != nil {
+		log.Printf("Error creating user %s: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	if created == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Username %s is taken", user.Username)})
+		return
+	}
+
+	log.Printf("User %s (%d) created by %s", created.Username, created.ID, currentUser(c).Username)
+	c.JSON(http.StatusCreated, created.public())
+}
+
+func getUserHandler(c *gin.Context) {
+	id, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	user, err := getUser(id)
+	if err != nil {
+		log.Printf("Error getting user %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, user.public())
+}
+
+// applyUserUpdate changes a user as requested, by themselves or by an
+// admin. Users changing their own password must give the current one.
+func applyUserUpdate(user *User, req UpdateUserRequest, byAdmin bool) (int, error) {
+	if !byAdmin && (req.Role != nil || req.Disabled != nil || req.Lab != nil) {
+		return http.StatusForbidden, fmt.Errorf("only admins can change role, disabled or lab")
+	}
+	if req.Name != nil {
+		user.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Email != nil {
+		email, err := validateEmail(*req.Email)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		user.Email = email
+	}
+	if req.Role != nil {
+		if err := validateRole(*req.Role); err != nil {
+			return http.StatusBadRequest, err
+		}
+		user.Role = *req.Role
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+	if req.Lab != nil {
+		lab := strings.TrimSpace(*req.Lab)
+		if err := validateLab(lab); err != nil {
+			return http.StatusBadRequest, err
+		}
+		user.Lab = lab
+	}
+	if req.Password != nil {
+		if !byAdmin && user.PasswordHash != "" &&
+			bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)) != nil {
+			return http.StatusForbidden, fmt.Errorf("current_password is incorrect")
+		}
+		hash, err := hashPassword(*req.Password)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		user.PasswordHash = hash
+	}
+	user.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return http.StatusOK, nil
+}
+
+// updateUserHandler changes a user. Disabling a user, changing their
+// password or moving them to another lab ends their sessions.
+func updateUserHandler(c *gin.Context) {
+	id, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := getUser(id)
+	if err != nil {
+		log.Printf("Error getting user %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if status, err := applyUserUpdate(user, req, true); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := saveUser(*user); err != nil {
+		log.Printf("Error saving user %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	if user.Disabled || req.Password != nil || req.Lab != nil {
+		revokeUserSessions(id)
+	}
+
+	log.Printf("User %s (%d) updated by %s", user.Username, id, currentUser(c).Username)
+	c.JSON(http.StatusOK, user.public())
+}
+
+func deleteUserHandler(c *gin.Context) {
+	id, ok := parseUserID(c)
+	if !ok {
+		return
+	}
+	if id == currentUser(c).ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "You can't delete yourself"})
+		return
+	}
+	user, err := getUser(id)
+	if err != nil {
+		log.Printf("Error getting user %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		return
+	}
+	if user == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	revokeUserSessions(id)
+	_, err = redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, userKey(id), usernameKey(user.Username))
+		if user.OIDCSubject != "" {
+			pipe.Del(ctx, oidcSubjectKey(user.OIDCSubject))
+		}
+		pipe.ZRem(ctx, USERS_KEY, id)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error deleting user %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+
+	log.Printf("User %s (%d) deleted by %s", user.Username, id, currentUser(c).Username)
+	c.Status(http.StatusNoContent)
+}
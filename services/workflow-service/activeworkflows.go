@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"workflow-service/deviceapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// The workflows running on each device are indexed, workflow ID to lab, so
+// no more run on a device at once than it has slots, even if a booking
+// slipped through the device service. Device IDs are unique across labs.
+const ACTIVE_WORKFLOWS_KEY_FORMAT = "workflows:device:%s:active"
+
+// claimDeviceScript adds a workflow to a device's active workflows unless
+// the device already runs as many as its capacity. It returns 1 if the
+// workflow holds the device, and 0 otherwise.
+var claimDeviceScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	return 1
+end
+if redis.call("HLEN", KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+func activeWorkflowsKey(deviceID string) string {
+	return fmt.Sprintf(ACTIVE_WORKFLOWS_KEY_FORMAT, deviceID)
+}
+
+// deviceCapacity is how many workflows the device runs at once, one unless
+// it is a multi-slot device. If the device service can't say, it is one.
+// The call is recorded against the workflow claiming the device.
+func deviceCapacity(c *gin.Context, deviceID, workflowID string) int {
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, requestCaller(c).setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	device, err := client.GetDevice(deviceCallContext(c.Request.Context(), requestLab(c), workflowID), deviceID)
+	if err != nil {
+		log.Printf("Error getting capacity of device %s, taking it as 1: %v", deviceID, err)
+		return 1
+	}
+	return max(device.Capacity, 1)
+}
+
+// claimDevice makes the workflow one of those running on its device. If the
+// device already runs as many as it holds, it returns them instead, after
+// dropping any that are no longer running.
+func claimDevice(lab, deviceID, workflowID string, capacity int) ([]string, error) {
+	key := activeWorkflowsKey(deviceID)
+	for attempt := 0; attempt < 2; attempt++ {
+		claimed, err := claimDeviceScript.Run(ctx, redisClient, []string{key}, workflowID, lab, capacity).Int()
+		if err != nil {
+			return nil, err
+		}
+		if claimed == 1 {
+			return nil, nil
+		}
+
+		holders, err := redisClient.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		active := []string{}
+		stale := false
+		for holder, holderLab := range holders {
+			workflow, err := getWorkflow(holderLab, holder)
+			if err != nil {
+				return nil, err
+			}
+			if workflow == nil || (workflow.Status != StatusRunning && workflow.Status != StatusPaused) || workflow.DeviceID != deviceID {
+				log.Printf("Dropping workflow %s from the active workflows of device %s; it isn't running there", holder, deviceID)
+				redisClient.HDel(ctx, key, holder)
+				stale = true
+				continue
+			}
+			active = append(active, holder)
+		}
+		if !stale {
+			sort.Strings(active)
+			return active, nil
+		}
+	}
+	return nil, fmt.Errorf("active workflows of device %s keep changing", deviceID)
+}
+
+// releaseDeviceClaim takes a workflow off its device's active workflows.
+func releaseDeviceClaim(deviceID, workflowID string) {
+	if err := redisClient.HDel(ctx, activeWorkflowsKey(deviceID), workflowID).Err(); err != nil {
+		log.Printf("Error releasing device %s from workflow %s: %v", deviceID, workflowID, err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ACTOR_HEADER names the user making a request. Only the gateway sets it,
+// from the user's verified session, dropping any the caller sent; the
+// service isn't published outside the deployment's network, so requests
+// reach it through the gateway or another service passing the user on.
+const ACTOR_HEADER = "X-User"
+
+// requestActor returns the user a request was made by, if known.
+func requestActor(c *gin.Context) string {
+	return strings.TrimSpace(c.GetHeader(ACTOR_HEADER))
+}
+
+// USER_ID_HEADER and USER_ROLE_HEADER carry the signed in user, set by the
+// gateway with ACTOR_HEADER; the sample service accepts them in place of an
+// API key.
+const (
+	USER_ID_HEADER   = "X-User-ID"
+	USER_ROLE_HEADER = "X-User-Role"
+	API_KEY_HEADER   = "X-API-Key"
+)
+
+// REQUEST_ID_HEADER identifies a request in the services' logs. The gateway
+// sets it, and calls made for the request pass it on.
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+// sampleAPIKey, from SAMPLE_API_KEY, is the key the service uses with the
+// sample service on behalf of callers with neither a key nor a user, such
+// as when the gateway doesn't require keys.
+var sampleAPIKey string
+
+// Caller is who a request was made by: the user, if known, and their lab,
+// with the API key or user ID and role the sample service checks, and the
+// request's ID.
+type Caller struct {
+	Actor     string
+	Lab       string
+	APIKey    string
+	UserID    string
+	Role      string
+	RequestID string
+}
+
+func requestCaller(c *gin.Context) Caller {
+	return Caller{
+		Actor:     requestActor(c),
+		Lab:       requestLab(c),
+		APIKey:    requestAPIKey(c),
+		UserID:    strings.TrimSpace(c.GetHeader(USER_ID_HEADER)),
+		Role:      strings.TrimSpace(c.GetHeader(USER_ROLE_HEADER)),
+		RequestID: c.GetHeader(REQUEST_ID_HEADER),
+	}
+}
+
+// requestAPIKey returns the caller's API key, sent as X-API-Key or as a
+// bearer token.
+func requestAPIKey(c *gin.Context) string {
+	if key := strings.TrimSpace(c.GetHeader(API_KEY_HEADER)); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// setHeaders makes a request to another service on the caller's behalf,
+// falling back to sampleAPIKey for callers with neither a key nor a user.
+func (caller Caller) setHeaders(req *http.Request) {
+	headers := map[string]string{
+		ACTOR_HEADER:      caller.Actor,
+		LAB_HEADER:        caller.Lab,
+		API_KEY_HEADER:    caller.APIKey,
+		USER_ID_HEADER:    caller.UserID,
+		USER_ROLE_HEADER:  caller.Role,
+		REQUEST_ID_HEADER: caller.RequestID,
+	}
+	if caller.APIKey == "" && caller.UserID == "" {
+		headers[API_KEY_HEADER] = sampleAPIKey
+	}
+	for header, value := range headers {
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+}
+
+// requireAdmin rejects requests not made by a user the gateway signed in
+// as an admin.
+func requireAdmin(c *gin.Context) {
+	if requestCaller(c).Role != "admin" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+		return
+	}
+	c.Next()
+}
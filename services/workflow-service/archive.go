@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// ARCHIVE_KEY keeps each lab's archived workflows, finished workflows moved
+// out of the way of the active list without deleting them. Retention
+// leaves them alone.
+const ARCHIVE_KEY = "workflows:archive"
+
+// ArchiveRequest selects the finished workflows to archive in bulk. Every
+// filter given must match; with none, every finished workflow is archived.
+type ArchiveRequest struct {
+	// Status is completed or failed.
+	Status WorkflowStatus `json:"status"`
+	// FinishedBefore is an RFC 3339 time; OlderThan a duration, such as
+	// 720h, before now.
+	FinishedBefore string `json:"finished_before"`
+	OlderThan      string `json:"older_than"`
+	DeviceID       string `json:"device_id"`
+	Tag            string `json:"tag"`
+	DryRun         bool   `json:"dry_run"`
+}
+
+type ArchiveReport struct {
+	DryRun   bool     `json:"dry_run"`
+	Archived []string `json:"archived"`
+}
+
+func getArchivedWorkflows(lab string) (map[string]Workflow, error) {
+	return getStoredWorkflows(lab, ARCHIVE_KEY)
+}
+
+// getStoredWorkflows returns the lab's workflows stored under key.
+func getStoredWorkflows(lab, key string) (map[string]Workflow, error) {
+	data, err := redisClient.Get(ctx, labKey(lab, key)).Result()
+	if err == redis.Nil {
+		return make(map[string]Workflow), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeWorkflows([]byte(data))
+}
+
+func saveArchivedWorkflows(lab string, workflows map[string]Workflow) error {
+	return saveStoredWorkflows(lab, ARCHIVE_KEY, workflows)
+}
+
+func saveStoredWorkflows(lab, key string, workflows map[string]Workflow) error {
+	data, err := encodeWorkflows(workflows)
+	if err != nil {
+		return err
+	}
+	return redisClient.Set(ctx, labKey(lab, key), data, 0).Err()
+}
+
+func getArchivedWorkflow(lab, workflowID string) (*Workflow, error) {
+	workflows, err := getArchivedWorkflows(lab)
+	if err != nil {
+		return nil, err
+	}
+	workflow, ok := workflows[workflowID]
+	if !ok {
+		return nil, nil
+	}
+	return &workflow, nil
+}
+
+// moveWorkflows moves the workflows pick selects from a lab's active
+// workflows to its archive, or back with toArchive false, unless dryRun is
+// set. It returns the workflows moved, as they now are.
+func moveWorkflows(lab string, toArchive bool, pick func(Workflow) bool, actor string, dryRun bool) ([]Workflow, error) {
+	from, to := WORKFLOWS_KEY, ARCHIVE_KEY
+	if !toArchive {
+		from, to = ARCHIVE_KEY, WORKFLOWS_KEY
+	}
+
+	var moved []Workflow
+	err := rewriteWorkflows(lab, []string{from, to}, func(stored []map[string]Workflow) (bool, error) {
+		moved = nil
+		source, target := stored[0], stored[1]
+		now := time.Now().UTC().Format(time.RFC3339)
+		for id, workflow := range source {
+			if !pick(workflow) {
+				continue
+			}
+			delete(source, id)
+			if toArchive {
+				workflow.ArchivedAt, workflow.ArchivedBy = now, actor
+			} else {
+				workflow.ArchivedAt, workflow.ArchivedBy = "", ""
+			}
+			target[id] = workflow
+			moved = append(moved, workflow)
+		}
+		return !dryRun && len(moved) > 0, nil
+	})
+	sort.Slice(moved, func(i, j int) bool { return moved[i].ID < moved[j].ID })
+	return moved, err
+}
+
+// rewriteWorkflows reads the lab's workflows stored under each of keys,
+// such as WORKFLOWS_KEY and ARCHIVE_KEY, and lets fn change them, writing
+// them all back if it says it did. The keys are watched while they are
+// rewritten, so changes made meanwhile aren't lost; fn may be run again.
+func rewriteWorkflows(lab string, keys []string, fn func(stored []map[string]Workflow) (bool, error)) error {
+	labKeys := make([]string, len(keys))
+	for i, key := range keys {
+		labKeys[i] = labKey(lab, key)
+	}
+	return redisClient.Watch(ctx, func(tx *redis.Tx) error {
+		stored := make([]map[string]Workflow, len(labKeys))
+		for i, key := range labKeys {
+			workflows, err := readWorkflows(tx, key)
+			if err != nil {
+				return err
+			}
+			stored[i] = workflows
+		}
+		changed, err := fn(stored)
+		if err != nil || !changed {
+			return err
+		}
+
+		encoded := make([][]byte, len(stored))
+		for i, workflows := range stored {
+			if encoded[i], err = encodeWorkflows(workflows); err != nil {
+				return err
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range labKeys {
+				pipe.Set(ctx, key, encoded[i], 0)
+			}
+			return nil
+		})
+		return err
+	}, labKeys...)
+}
+
+// readWorkflows reads the workflows stored under key in a transaction.
+func readWorkflows(tx *redis.Tx, key string) (map[string]Workflow, error) {
+	data, err := tx.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return make(map[string]Workflow), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeWorkflows([]byte(data))
+}
+
+// finished reports whether the workflow is completed or failed, and so can
+// be archived.
+func (w Workflow) finished() bool {
+	return w.Status == StatusCompleted || w.Status == StatusFailed
+}
+
+func archiveWorkflowHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	if !workflow.finished() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only completed or failed workflows can be archived"})
+		return
+	}
+
+	moved, err := moveWorkflows(requestLab(c), true, func(w Workflow) bool {
+		return w.ID == workflowID && w.finished()
+	}, requestActor(c), false)
+	if err != nil {
+		log.Printf("Error archiving workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive workflow"})
+		return
+	}
+	if len(moved) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workflow changed while being archived; try again"})
+		return
+	}
+
+	log.Printf("Workflow %s archived", workflowID)
+	c.JSON(http.StatusOK, moved[0])
+}
+
+func restoreWorkflowHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	moved, err := moveWorkflows(requestLab(c), false, func(w Workflow) bool {
+		return w.ID == workflowID
+	}, requestActor(c), false)
+	if err != nil {
+		log.Printf("Error restoring workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore workflow"})
+		return
+	}
+	if len(moved) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Archived workflow not found"})
+		return
+	}
+
+	log.Printf("Workflow %s restored from the archive", workflowID)
+	c.JSON(http.StatusOK, moved[0])
+}
+
+// matcher returns the test of whether a workflow matches the request's
+// filters, as of now.
+func (req ArchiveRequest) matcher(now time.Time) (func(Workflow) bool, error) {
+	if req.Status != "" && req.Status != StatusCompleted && req.Status != StatusFailed {
+		return nil, fmt.Errorf("status must be completed or failed")
+	}
+	var before time.Time
+	if req.FinishedBefore != "" {
+		t, err := time.Parse(time.RFC3339, req.FinishedBefore)
+		if err != nil {
+			return nil, fmt.Errorf("finished_before must be an RFC 3339 time")
+		}
+		before = t
+	}
+	if req.OlderThan != "" {
+		d, err := time.ParseDuration(req.OlderThan)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("older_than must be a positive duration such as 720h")
+		}
+		if cutoff := now.Add(-d); before.IsZero() || cutoff.Before(before) {
+			before = cutoff
+		}
+	}
+	tag := normalizeTags([]string{req.Tag})
+
+	return func(w Workflow) bool {
+		finished, ok := w.finishedAt()
+		if !ok || (req.Status != "" && w.Status != req.Status) || (req.DeviceID != "" && w.DeviceID != req.DeviceID) {
+			return false
+		}
+		if !before.IsZero() && !finished.Before(before) {
+			return false
+		}
+		if len(tag) == 0 {
+			return true
+		}
+		for _, t := range w.Tags {
+			if t == tag[0] {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// bulkArchiveHandler archives the lab's finished workflows matching the
+// request's filters, or with dry_run says which it would.
+func bulkArchiveHandler(c *gin.Context) {
+	var req ArchiveRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	match, err := req.matcher(time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	moved, err := moveWorkflows(requestLab(c), true, match, requestActor(c), req.DryRun)
+	if err != nil {
+		log.Printf("Error archiving workflows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive workflows"})
+		return
+	}
+
+	report := ArchiveReport{DryRun: req.DryRun, Archived: []string{}}
+	for _, workflow := range moved {
+		report.Archived = append(report.Archived, workflow.ID)
+	}
+	if !req.DryRun {
+		log.Printf("Archived %d workflow(s)", len(report.Archived))
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// listArchivedWorkflowsHandler lists the lab's archived workflows in the
+// order they were created.
+func listArchivedWorkflowsHandler(c *gin.Context) {
+	workflows, err := getArchivedWorkflows(requestLab(c))
+	if err != nil {
+		log.Printf("Error getting archived workflows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve archived workflows"})
+		return
+	}
+
+	workflowList := make([]Workflow, 0, len(workflows))
+	for _, workflow := range workflows {
+		workflowList = append(workflowList, workflow)
+	}
+	sort.Slice(workflowList, func(i, j int) bool {
+		return workflowList[i].CreatedAt < workflowList[j].CreatedAt
+	})
+
+	c.JSON(http.StatusOK, workflowList)
+}
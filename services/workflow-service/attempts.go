@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IDEMPOTENCY_KEY_HEADER names a call to the device service's execute
+// endpoint, which runs the operation only once per key. Each execute-step
+// attempt token becomes one.
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+// IDEMPOTENT_REPLAY_HEADER marks an execute-step response replayed from an
+// earlier call with the same attempt token.
+const IDEMPOTENT_REPLAY_HEADER = "Idempotent-Replayed"
+
+// stepAttemptTTL is how long the outcome of an execute-step attempt is kept
+// for retries.
+const stepAttemptTTL = 24 * time.Hour
+
+// maxAttemptTokenLength bounds the tokens accepted, as they are part of
+// Redis keys here and in the device service.
+const maxAttemptTokenLength = 128
+
+// StepAttempt is the outcome of an execute-step attempt, or an empty
+// StatusCode while the step is still running.
+type StepAttempt struct {
+	StatusCode int             `json:"status_code,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+}
+
+func stepAttemptKey(lab, workflowID string, stepIndex int, token string) string {
+	return labKey(lab, fmt.Sprintf("workflow:%s:step:%d:attempt:%s", workflowID, stepIndex, token))
+}
+
+// deviceIdempotencyKey is the key the attempt executes the step's operation
+// on the device with, the same for every retry of it.
+func deviceIdempotencyKey(workflowID string, stepIndex int, token string) string {
+	return fmt.Sprintf("%s:%d:%s", workflowID, stepIndex, token)
+}
+
+// claimStepAttempt records that the attempt is running, unless it was made
+// before, in which case that attempt is returned.
+func claimStepAttempt(key string) (*StepAttempt, error) {
+	pending, _ := json.Marshal(StepAttempt{})
+	claimed, err := redisClient.SetNX(ctx, key, pending, stepAttemptTTL).Result()
+	if err != nil || claimed {
+		return nil, err
+	}
+
+	data, err := redisClient.Get(ctx, key).Result()
+	if err == redis.Nil {
+		// It expired in between, so claim it again.
+		return claimStepAttempt(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var attempt StepAttempt
+	if err := json.Unmarshal([]byte(data), &attempt); err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// finishStepAttempt keeps the attempt's result for its retries. Failed
+// attempts are forgotten instead, so a retry tries the step again; the
+// device service still runs its operation only once.
+func finishStepAttempt(key string, statusCode int, body interface{}) error {
+	if statusCode != http.StatusOK {
+		return redisClient.Del(ctx, key).Err()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	attempt, _ := json.Marshal(StepAttempt{StatusCode: statusCode, Body: data})
+	return redisClient.Set(ctx, key, attempt, stepAttemptTTL).Err()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Every call made to the device service on a workflow's behalf, such as
+// booking its device or running a step, is recorded under the workflow's
+// device-calls list, newest first, so a failed device interaction can be
+// looked into after the fact. Calls made only to show a workflow, such as
+// for its progress, aren't recorded.
+const (
+	maxDeviceCalls = 500
+	// maxRecordedBody bounds the part of a request or response body kept.
+	maxRecordedBody = 16 << 10
+)
+
+// DeviceCall is one call made to the device service. Attempt counts the
+// calls made with the same IdempotencyKey, so retries of a step show up as
+// attempts 2, 3 and so on. StatusCode is 0, and Error set, if no response
+// came back.
+type DeviceCall struct {
+	Method         string          `json:"method"`
+	URL            string          `json:"url"`
+	RequestBody    json.RawMessage `json:"request_body,omitempty"`
+	StatusCode     int             `json:"status_code"`
+	ResponseBody   json.RawMessage `json:"response_body,omitempty"`
+	Error          string          `json:"error,omitempty"`
+	LatencyMS      int64           `json:"latency_ms"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	Attempt        int             `json:"attempt"`
+	Actor          string          `json:"actor,omitempty"`
+	RequestID      string          `json:"request_id,omitempty"`
+	Timestamp      string          `json:"timestamp"`
+}
+
+type DeviceCallList struct {
+	WorkflowID string       `json:"workflow_id"`
+	Count      int          `json:"count"`
+	Calls      []DeviceCall `json:"calls"`
+}
+
+func deviceCallsKey(lab, workflowID string) string {
+	return labKey(lab, fmt.Sprintf("workflow:%s:device-calls", workflowID))
+}
+
+type deviceCallTarget struct {
+	lab, workflowID string
+}
+
+type deviceCallTargetKey struct{}
+
+// deviceCallContext has calls made with it to the device service recorded
+// against the workflow.
+func deviceCallContext(parent context.Context, lab, workflowID string) context.Context {
+	return context.WithValue(parent, deviceCallTargetKey{}, deviceCallTarget{lab: lab, workflowID: workflowID})
+}
+
+// recordingTransport records the calls to the device service made with a
+// deviceCallContext, passing every call on to next.
+type recordingTransport struct {
+	next http.RoundTripper
+}
+
+func (t recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, ok := req.Context().Value(deviceCallTargetKey{}).(deviceCallTarget)
+	if !ok || deviceAPIURL == "" || !strings.HasPrefix(req.URL.String(), deviceAPIURL) {
+		return t.next.RoundTrip(req)
+	}
+
+	call := DeviceCall{
+		Method:         req.Method,
+		URL:            req.URL.String(),
+		IdempotencyKey: req.Header.Get(IDEMPOTENCY_KEY_HEADER),
+		Actor:          req.Header.Get(ACTOR_HEADER),
+		RequestID:      req.Header.Get(REQUEST_ID_HEADER),
+		Timestamp:      time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if req.Body != nil && req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			data, _ := io.ReadAll(io.LimitReader(body, maxRecordedBody+1))
+			body.Close()
+			call.RequestBody = recordedBody(data)
+		}
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	call.LatencyMS = time.Since(start).Milliseconds()
+	if err != nil {
+		call.Error = err.Error()
+	} else {
+		// Keep the body for the caller, reading only as much as is kept.
+		data, readErr := io.ReadAll(io.LimitReader(resp.Body, maxRecordedBody+1))
+		resp.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), resp.Body), Closer: resp.Body}
+		call.StatusCode = resp.StatusCode
+		call.ResponseBody = recordedBody(data)
+		if readErr != nil {
+			call.Error = readErr.Error()
+		}
+	}
+	recordDeviceCall(target, call)
+	return resp, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// recordedBody keeps a JSON body as it is, and anything else, or a body cut
+// short at maxRecordedBody, as a string.
+func recordedBody(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) <= maxRecordedBody && json.Valid(data) {
+		return data
+	}
+	if len(data) > maxRecordedBody {
+		data = append(data[:maxRecordedBody:maxRecordedBody], "..."...)
+	}
+	encoded, _ := json.Marshal(string(data))
+	return encoded
+}
+
+// recordDeviceCall adds the call to the workflow's device calls, numbering
+// its attempt among those with the same idempotency key.
+func recordDeviceCall(target deviceCallTarget, call DeviceCall) {
+	key := deviceCallsKey(target.lab, target.workflowID)
+	call.Attempt = 1
+	if call.IdempotencyKey != "" {
+		previous, err := getDeviceCalls(key)
+		if err != nil {
+			log.Printf("Error reading device calls of workflow %s: %v", target.workflowID, err)
+		}
+		for _, p := range previous {
+			if p.IdempotencyKey == call.IdempotencyKey {
+				call.Attempt++
+			}
+		}
+	}
+
+	data, err := json.Marshal(call)
+	if err != nil {
+		log.Printf("Error encoding device call of workflow %s: %v", target.workflowID, err)
+		return
+	}
+	pipe := redisClient.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, maxDeviceCalls-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Error recording device call of workflow %s: %v", target.workflowID, err)
+	}
+}
+
+// getDeviceCalls returns the device calls stored under key, newest first.
+func getDeviceCalls(key string) ([]DeviceCall, error) {
+	values, err := redisClient.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	calls := make([]DeviceCall, 0, len(values))
+	for _, value := range values {
+		var call DeviceCall
+		if err := json.Unmarshal([]byte(value), &call); err != nil {
+			log.Printf("Invalid device call under %s: %v", key, err)
+			continue
+		}
+		calls = append(calls, call)
+	}
+	return calls, nil
+}
+
+// deviceCallsHandler lists the calls made to the device service for a
+// workflow, newest first. ?failed=true keeps those that got no response or
+// an error status.
+func deviceCallsHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxDeviceCalls {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxDeviceCalls)})
+			return
+		}
+		limit = n
+	}
+	failedOnly := c.Query("failed") == "true"
+
+	calls, err := getDeviceCalls(deviceCallsKey(requestLab(c), workflowID))
+	if err != nil {
+		log.Printf("Error reading device calls of workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve device calls"})
+		return
+	}
+	matched := []DeviceCall{}
+	for _, call := range calls {
+		if failedOnly && call.StatusCode > 0 && call.StatusCode < 400 && call.Error == "" {
+			continue
+		}
+		matched = append(matched, call)
+		if len(matched) == limit {
+			break
+		}
+	}
+	c.JSON(http.StatusOK, DeviceCallList{WorkflowID: workflowID, Count: len(matched), Calls: matched})
+}
+
+// forgetDeviceCalls deletes the device calls of workflows deleted for good.
+func forgetDeviceCalls(lab string, workflowIDs []string) {
+	if len(workflowIDs) == 0 {
+		return
+	}
+	keys := make([]string, len(workflowIDs))
+	for i, workflowID := range workflowIDs {
+		keys[i] = deviceCallsKey(lab, workflowID)
+	}
+	if err := redisClient.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Error deleting device calls: %v", err)
+	}
+}
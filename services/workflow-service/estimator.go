@@ -0,0 +1,479 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"workflow-service/deviceapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /scheduler/estimate answers what-if questions about the lab's
+// pending workflows, such as whether today's queue finishes by 6pm. It lays
+// the workflows out on their devices, queued ones first in the order they
+// queued, then created ones by priority and age, each on the device slot it
+// could start on soonest. A device is taken as free when its schedule says
+// its current bookings end, and held through its reservations for other
+// workflows; a workflow takes as long as its steps do on a virtual copy of
+// its device. The request can override any of these. Nothing is booked or
+// started.
+
+const (
+	// maxEstimateWorkflows caps the workflows one estimate lays out.
+	maxEstimateWorkflows = 200
+	// estimateHorizon is how far ahead reservations are looked at, unless
+	// the deadline is further.
+	estimateHorizon    = 24 * time.Hour
+	maxEstimateHorizon = 30 * 24 * time.Hour
+)
+
+// EstimateRequest is what to estimate. WorkflowIDs default to the lab's
+// created and queued workflows, StartAt to now. DurationsMs overrides how
+// long operations take, by operation; Devices overrides when devices are
+// free, by device ID.
+type EstimateRequest struct {
+	WorkflowIDs []string                      `json:"workflow_ids,omitempty"`
+	StartAt     string                        `json:"start_at,omitempty"`
+	Deadline    string                        `json:"deadline,omitempty"`
+	DurationsMs map[string]int64              `json:"durations_ms,omitempty"`
+	Devices     map[string]DeviceAvailability `json:"devices,omitempty"`
+}
+
+// DeviceAvailability is when a device can be used: not before AvailableAt,
+// by Capacity workflows at once, and not during the Unavailable windows,
+// such as maintenance.
+type DeviceAvailability struct {
+	AvailableAt string       `json:"available_at,omitempty"`
+	Capacity    int          `json:"capacity,omitempty"`
+	Unavailable []TimeWindow `json:"unavailable,omitempty"`
+}
+
+type TimeWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// EstimatedRun is when a workflow is expected to run. Late is set if it
+// ends after the deadline.
+type EstimatedRun struct {
+	WorkflowID string         `json:"workflow_id"`
+	Name       string         `json:"name"`
+	DeviceID   string         `json:"device_id"`
+	Slot       int            `json:"slot,omitempty"`
+	Status     WorkflowStatus `json:"status"`
+	Priority   int            `json:"priority,omitempty"`
+	Start      string         `json:"start"`
+	End        string         `json:"end"`
+	DurationMs int64          `json:"duration_ms"`
+	Late       bool           `json:"late,omitempty"`
+}
+
+// UnscheduledWorkflow is a workflow the estimate couldn't lay out, and why.
+type UnscheduledWorkflow struct {
+	WorkflowID string `json:"workflow_id"`
+	DeviceID   string `json:"device_id,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+// ScheduleEstimate is the proposed schedule, in start order. CompletesAt is
+// when the last run ends; FitsDeadline is set with a deadline, true if every
+// workflow could be laid out and ends by it.
+type ScheduleEstimate struct {
+	GeneratedAt  string                `json:"generated_at"`
+	StartAt      string                `json:"start_at"`
+	Deadline     string                `json:"deadline,omitempty"`
+	CompletesAt  string                `json:"completes_at,omitempty"`
+	FitsDeadline *bool                 `json:"fits_deadline,omitempty"`
+	Runs         []EstimatedRun        `json:"runs"`
+	Late         []string              `json:"late"`
+	Unscheduled  []UnscheduledWorkflow `json:"unscheduled"`
+	Issues       []string              `json:"issues"`
+}
+
+// estimateJob is a workflow to lay out and how long it takes.
+type estimateJob struct {
+	workflow Workflow
+	duration time.Duration
+}
+
+// deviceTimeline is when each of a device's slots is next free, and the
+// windows the device is held for a workflow, or for nothing if workflowID is
+// empty.
+type deviceTimeline struct {
+	freeAt []time.Time
+	held   []heldWindow
+}
+
+type heldWindow struct {
+	start, end time.Time
+	workflowID string
+}
+
+// earliestStart returns when a run of the workflow could start on the slot:
+// once the slot is free and not before start, past any window the device
+// is held for something else.
+func (d *deviceTimeline) earliestStart(slot int, workflowID string, start time.Time, duration time.Duration) time.Time {
+	at := start
+	if d.freeAt[slot].After(at) {
+		at = d.freeAt[slot]
+	}
+	for moved := true; moved; {
+		moved = false
+		for _, window := range d.held {
+			if window.workflowID != workflowID && at.Before(window.end) && window.start.Before(at.Add(max(duration, time.Millisecond))) {
+				at, moved = window.end, true
+			}
+		}
+	}
+	return at
+}
+
+// planSchedule lays the jobs out, in the order they would be started in,
+// each on the slot of its device where it could start soonest.
+func planSchedule(jobs []estimateJob, devices map[string]*deviceTimeline, start time.Time) []EstimatedRun {
+	jobs = append([]estimateJob{}, jobs...)
+	sort.SliceStable(jobs, func(i, j int) bool {
+		a, b := jobs[i].workflow, jobs[j].workflow
+		if (a.Status == StatusQueued) != (b.Status == StatusQueued) {
+			return a.Status == StatusQueued
+		}
+		if a.Status == StatusQueued {
+			return a.QueuedAt < b.QueuedAt
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.CreatedAt < b.CreatedAt
+	})
+
+	runs := make([]EstimatedRun, 0, len(jobs))
+	for _, job := range jobs {
+		device := devices[job.workflow.DeviceID]
+		best, bestAt := 0, time.Time{}
+		for slot := range device.freeAt {
+			at := device.earliestStart(slot, job.workflow.ID, start, job.duration)
+			if slot == 0 || at.Before(bestAt) {
+				best, bestAt = slot, at
+			}
+		}
+		end := bestAt.Add(job.duration)
+		device.freeAt[best] = end
+
+		run := EstimatedRun{
+			WorkflowID: job.workflow.ID,
+			Name:       job.workflow.Name,
+			DeviceID:   job.workflow.DeviceID,
+			Status:     job.workflow.Status,
+			Priority:   job.workflow.Priority,
+			Start:      bestAt.UTC().Format(time.RFC3339),
+			End:        end.UTC().Format(time.RFC3339),
+			DurationMs: job.duration.Milliseconds(),
+		}
+		if len(device.freeAt) > 1 {
+			run.Slot = best + 1
+		}
+		runs = append(runs, run)
+	}
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Start < runs[j].Start })
+	return runs
+}
+
+func parseEstimateTime(name, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return t, nil
+}
+
+// deviceTimelineFor builds the device's timeline from its schedule and the
+// request's overrides, returning why it can't be used if it can't.
+func deviceTimelineFor(c *gin.Context, client *deviceapi.Client, deviceID string, override DeviceAvailability, pending map[string]bool, start, until time.Time, estimate *ScheduleEstimate) (*deviceTimeline, string) {
+	horizon := max(until.Sub(time.Now()), estimateHorizon)
+	schedule, err := client.GetDeviceSchedule(c.Request.Context(), deviceID, &deviceapi.GetDeviceScheduleParams{Horizon: min(horizon, maxEstimateHorizon).Round(time.Hour).String()})
+	var respErr *deviceapi.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		return nil, "Device not found"
+	}
+	if err != nil {
+		log.Printf("Error getting schedule of device %s: %v", deviceID, err)
+		return nil, "Failed to get the device's schedule from the device service"
+	}
+	if override.AvailableAt == "" && (schedule.Status == "error" || schedule.Status == "offline" || schedule.Status == "maintenance") {
+		return nil, "Device is " + schedule.Status
+	}
+
+	capacity := override.Capacity
+	if capacity == 0 {
+		device, err := client.GetDevice(c.Request.Context(), deviceID)
+		if err != nil {
+			log.Printf("Error getting device %s: %v", deviceID, err)
+			return nil, "Failed to get the device from the device service"
+		}
+		capacity = max(device.Capacity, 1)
+	}
+
+	timeline := &deviceTimeline{freeAt: make([]time.Time, capacity)}
+	for i := range timeline.freeAt {
+		timeline.freeAt[i] = start
+	}
+	avg := time.Duration(schedule.AvgBookingMs) * time.Millisecond
+	for _, entry := range schedule.Entries {
+		switch entry.Kind {
+		case "booking":
+			slot := max(entry.Slot, 1) - 1
+			if slot >= capacity {
+				continue
+			}
+			end, err := time.Parse(time.RFC3339, entry.End)
+			if err != nil {
+				estimate.Issues = append(estimate.Issues, fmt.Sprintf("When workflow %s is done with device %s can't be estimated; taken as now", entry.WorkflowID, deviceID))
+				continue
+			}
+			if end.After(timeline.freeAt[slot]) {
+				timeline.freeAt[slot] = end
+			}
+		case "queued":
+			// Bookings queued for workflows left out of the estimate go
+			// first, taking the device's average booking.
+			if pending[entry.WorkflowID] {
+				continue
+			}
+			if avg == 0 {
+				estimate.Issues = append(estimate.Issues, fmt.Sprintf("How long workflow %s, queued for device %s, takes can't be estimated; left out", entry.WorkflowID, deviceID))
+				continue
+			}
+			slot := earliestSlot(timeline.freeAt)
+			timeline.freeAt[slot] = timeline.freeAt[slot].Add(avg)
+		case "reservation":
+			from, err1 := time.Parse(time.RFC3339, entry.Start)
+			to, err2 := time.Parse(time.RFC3339, entry.End)
+			if err1 == nil && err2 == nil {
+				timeline.held = append(timeline.held, heldWindow{start: from, end: to, workflowID: entry.WorkflowID})
+			}
+		}
+	}
+
+	if override.AvailableAt != "" {
+		available, _ := time.Parse(time.RFC3339, override.AvailableAt)
+		for i, free := range timeline.freeAt {
+			if available.After(free) {
+				timeline.freeAt[i] = available
+			}
+		}
+	}
+	for _, window := range override.Unavailable {
+		from, _ := time.Parse(time.RFC3339, window.Start)
+		to, _ := time.Parse(time.RFC3339, window.End)
+		timeline.held = append(timeline.held, heldWindow{start: from, end: to})
+	}
+	return timeline, ""
+}
+
+func earliestSlot(freeAt []time.Time) int {
+	best := 0
+	for i, t := range freeAt {
+		if t.Before(freeAt[best]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// workflowDuration is how long the workflow's steps take: the request's
+// duration for an operation if it gives one, otherwise the time the step
+// takes on a virtual copy of the device. Steps the virtual device couldn't
+// run are added to the estimate's issues.
+func workflowDuration(c *gin.Context, client *deviceapi.Client, workflow Workflow, durations map[string]int64, estimate *ScheduleEstimate) (time.Duration, string) {
+	simulate := false
+	for _, step := range workflow.Steps {
+		if _, ok := durations[step]; !ok {
+			simulate = true
+		}
+	}
+	var run *deviceapi.SimulatedRun
+	if simulate {
+		req := deviceapi.SimulateRunRequest{Steps: make([]deviceapi.SimulateStep, len(workflow.Steps))}
+		for i, step := range workflow.Steps {
+			req.Steps[i] = deviceapi.SimulateStep{Operation: step, Params: workflow.stepParams(i)}
+		}
+		var err error
+		if run, err = client.SimulateRun(c.Request.Context(), workflow.DeviceID, req); err != nil {
+			log.Printf("Error simulating workflow %s on device %s: %v", workflow.ID, workflow.DeviceID, err)
+			return 0, "Failed to simulate the workflow's steps on its device"
+		}
+	}
+
+	var total time.Duration
+	for i, step := range workflow.Steps {
+		if ms, ok := durations[step]; ok {
+			total += time.Duration(ms) * time.Millisecond
+			continue
+		}
+		if i < len(run.Steps) {
+			simulated := run.Steps[i]
+			if simulated.Error != "" {
+				estimate.Issues = append(estimate.Issues, fmt.Sprintf("Workflow %s: step %d (%s) would fail: %s", workflow.ID, i, step, simulated.Error))
+			}
+			total += time.Duration(simulated.DurationMs) * time.Millisecond
+		}
+	}
+	return total, ""
+}
+
+// estimateScheduleHandler proposes a schedule for the lab's pending
+// workflows, and when they would complete.
+func estimateScheduleHandler(c *gin.Context) {
+	var req EstimateRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	now := time.Now().UTC()
+	start := now
+	var deadline time.Time
+	var err error
+	if req.StartAt != "" {
+		if start, err = parseEstimateTime("start_at", req.StartAt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Deadline != "" {
+		if deadline, err = parseEstimateTime("deadline", req.Deadline); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	for operation, ms := range req.DurationsMs {
+		if ms < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("durations_ms.%s must not be negative", operation)})
+			return
+		}
+	}
+	for deviceID, override := range req.Devices {
+		if override.Capacity < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devices.%s.capacity must not be negative", deviceID)})
+			return
+		}
+		if override.AvailableAt != "" {
+			if _, err := parseEstimateTime(fmt.Sprintf("devices.%s.available_at", deviceID), override.AvailableAt); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		for _, window := range override.Unavailable {
+			from, err1 := time.Parse(time.RFC3339, window.Start)
+			to, err2 := time.Parse(time.RFC3339, window.End)
+			if err1 != nil || err2 != nil || !to.After(from) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("devices.%s.unavailable windows need an RFC 3339 start and a later end", deviceID)})
+				return
+			}
+		}
+	}
+
+	workflows, err := getAllWorkflows(requestLab(c))
+	if err != nil {
+		log.Printf("Error getting workflows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflows"})
+		return
+	}
+
+	estimate := ScheduleEstimate{
+		GeneratedAt: now.Format(time.RFC3339),
+		StartAt:     start.UTC().Format(time.RFC3339),
+		Runs:        []EstimatedRun{},
+		Late:        []string{},
+		Unscheduled: []UnscheduledWorkflow{},
+		Issues:      []string{},
+	}
+	if !deadline.IsZero() {
+		estimate.Deadline = deadline.UTC().Format(time.RFC3339)
+	}
+
+	var pending []Workflow
+	if len(req.WorkflowIDs) > 0 {
+		for _, id := range req.WorkflowIDs {
+			workflow, ok := workflows[id]
+			switch {
+			case !ok:
+				estimate.Unscheduled = append(estimate.Unscheduled, UnscheduledWorkflow{WorkflowID: id, Reason: "Workflow not found"})
+			case workflow.Status != StatusCreated && workflow.Status != StatusQueued:
+				estimate.Unscheduled = append(estimate.Unscheduled, UnscheduledWorkflow{WorkflowID: id, DeviceID: workflow.DeviceID, Reason: fmt.Sprintf("Workflow is %s", workflow.Status)})
+			default:
+				pending = append(pending, workflow)
+			}
+		}
+	} else {
+		for _, workflow := range workflows {
+			if workflow.Status == StatusCreated || workflow.Status == StatusQueued {
+				pending = append(pending, workflow)
+			}
+		}
+	}
+	if len(pending) > maxEstimateWorkflows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d workflows can be estimated at once", maxEstimateWorkflows)})
+		return
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+
+	isPending := make(map[string]bool, len(pending))
+	for _, workflow := range pending {
+		isPending[workflow.ID] = true
+	}
+	until := start.Add(estimateHorizon)
+	if deadline.After(until) {
+		until = deadline
+	}
+
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, requestCaller(c).setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	devices := map[string]*deviceTimeline{}
+	unusable := map[string]string{}
+	jobs := make([]estimateJob, 0, len(pending))
+	for _, workflow := range pending {
+		if _, ok := devices[workflow.DeviceID]; !ok && unusable[workflow.DeviceID] == "" {
+			timeline, reason := deviceTimelineFor(c, client, workflow.DeviceID, req.Devices[workflow.DeviceID], isPending, start, until, &estimate)
+			if timeline != nil {
+				devices[workflow.DeviceID] = timeline
+			} else {
+				unusable[workflow.DeviceID] = reason
+			}
+		}
+		if reason := unusable[workflow.DeviceID]; reason != "" {
+			estimate.Unscheduled = append(estimate.Unscheduled, UnscheduledWorkflow{WorkflowID: workflow.ID, DeviceID: workflow.DeviceID, Reason: reason})
+			continue
+		}
+		duration, reason := workflowDuration(c, client, workflow, req.DurationsMs, &estimate)
+		if reason != "" {
+			estimate.Unscheduled = append(estimate.Unscheduled, UnscheduledWorkflow{WorkflowID: workflow.ID, DeviceID: workflow.DeviceID, Reason: reason})
+			continue
+		}
+		jobs = append(jobs, estimateJob{workflow: workflow, duration: duration})
+	}
+
+	estimate.Runs = planSchedule(jobs, devices, start)
+	for i, run := range estimate.Runs {
+		if run.End > estimate.CompletesAt {
+			estimate.CompletesAt = run.End
+		}
+		if end, _ := time.Parse(time.RFC3339, run.End); !deadline.IsZero() && end.After(deadline) {
+			estimate.Runs[i].Late = true
+			estimate.Late = append(estimate.Late, run.WorkflowID)
+		}
+	}
+	if !deadline.IsZero() {
+		fits := len(estimate.Late) == 0 && len(estimate.Unscheduled) == 0
+		estimate.FitsDeadline = &fits
+	}
+
+	log.Printf("Estimated %d workflow(s) from %s: complete at %s, %d late, %d unscheduled", len(estimate.Runs), estimate.StartAt, estimate.CompletesAt, len(estimate.Late), len(estimate.Unscheduled))
+	c.JSON(http.StatusOK, estimate)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// WORKFLOW_EVENTS_CHANNEL is the Redis channel workflow status changes are
+// published on.
+const WORKFLOW_EVENTS_CHANNEL = "workflow:events"
+
+// Workflow event types.
+const (
+	WorkflowEventQueued    = "workflow.queued"
+	WorkflowEventStarted   = "workflow.started"
+	WorkflowEventCompleted = "workflow.completed"
+	WorkflowEventFailed    = "workflow.failed"
+	WorkflowEventPaused    = "workflow.paused"
+	WorkflowEventResumed   = "workflow.resumed"
+)
+
+// WorkflowEvent describes a workflow status change.
+type WorkflowEvent struct {
+	Type       string         `json:"type"`
+	WorkflowID string         `json:"workflow_id"`
+	Name       string         `json:"name"`
+	DeviceID   string         `json:"device_id"`
+	Status     WorkflowStatus `json:"status"`
+	Reason     string         `json:"reason,omitempty"`
+	Actor      string         `json:"actor,omitempty"`
+	Lab        string         `json:"lab,omitempty"`
+	Timestamp  string         `json:"timestamp"`
+}
+
+// publishWorkflowEvent announces a change to a workflow made by actor.
+func publishWorkflowEvent(eventType string, workflow *Workflow, actor string) {
+	if workflow == nil {
+		return
+	}
+	reason := workflow.FailureReason
+	if workflow.Status == StatusPaused && len(workflow.Pauses) > 0 {
+		reason = workflow.Pauses[len(workflow.Pauses)-1].Reason
+	}
+	data, err := json.Marshal(WorkflowEvent{
+		Type:       eventType,
+		WorkflowID: workflow.ID,
+		Name:       workflow.Name,
+		DeviceID:   workflow.DeviceID,
+		Status:     workflow.Status,
+		Reason:     reason,
+		Actor:      actor,
+		Lab:        workflow.Lab,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Printf("Error encoding workflow event: %v", err)
+		return
+	}
+	if err := redisClient.Publish(ctx, WORKFLOW_EVENTS_CHANNEL, data).Err(); err != nil {
+		log.Printf("Error publishing %s event for workflow %s: %v", eventType, workflow.ID, err)
+	}
+}
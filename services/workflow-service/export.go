@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /workflows/export streams the lab's workflows, or their step
+// executions, for loading into a data warehouse: as JSON Lines (the
+// default) or CSV, one record per line.
+
+const (
+	ExportWorkflows = "workflows"
+	ExportSteps     = "steps"
+	// exportFlushEvery is how many records are written between flushes.
+	exportFlushEvery = 100
+)
+
+var (
+	workflowExportColumns = []string{"id", "name", "lab", "project", "device_id", "status", "priority", "tags", "sample_barcodes", "steps", "steps_run", "created_at", "created_by", "queued_at", "started_at", "started_by", "completed_at", "completed_by", "failed_at", "failed_by", "failure_reason", "duration_ms", "archived_at"}
+	stepExportColumns     = []string{"workflow_id", "lab", "project", "device_id", "step_index", "step", "operation_id", "status", "started_at", "executed_at", "duration_ms", "executed_by", "params", "result"}
+)
+
+// ExportedStep is a step execution as exported, with its workflow's
+// identifying fields. DurationMs is unset for steps saved before their
+// start was recorded.
+type ExportedStep struct {
+	WorkflowID  string                 `json:"workflow_id"`
+	Lab         string                 `json:"lab,omitempty"`
+	Project     string                 `json:"project,omitempty"`
+	DeviceID    string                 `json:"device_id"`
+	StepIndex   int                    `json:"step_index"`
+	Step        string                 `json:"step"`
+	OperationID string                 `json:"operation_id,omitempty"`
+	Status      string                 `json:"status"`
+	StartedAt   string                 `json:"started_at,omitempty"`
+	ExecutedAt  string                 `json:"executed_at"`
+	DurationMs  *int64                 `json:"duration_ms,omitempty"`
+	ExecutedBy  string                 `json:"executed_by,omitempty"`
+	Params      map[string]interface{} `json:"params,omitempty"`
+	Result      map[string]interface{} `json:"result,omitempty"`
+}
+
+// ExportFilter picks the workflows to export; empty fields match every
+// workflow. Finished times only match completed and failed workflows.
+type ExportFilter struct {
+	Statuses        []WorkflowStatus
+	DeviceID        string
+	Project         string
+	Tag             string
+	CreatedAfter    time.Time
+	CreatedBefore   time.Time
+	FinishedAfter   time.Time
+	FinishedBefore  time.Time
+	IncludeArchived bool
+}
+
+// exportFilterFromQuery reads the filters from ?status= (comma-separated),
+// device_id, project, tag, created_after, created_before, finished_after,
+// finished_before and include_archived.
+func exportFilterFromQuery(c *gin.Context) (ExportFilter, error) {
+	filter := ExportFilter{
+		DeviceID:        c.Query("device_id"),
+		Project:         c.Query("project"),
+		IncludeArchived: c.Query("include_archived") == "true",
+	}
+	if tags := normalizeTags([]string{c.Query("tag")}); len(tags) > 0 {
+		filter.Tag = tags[0]
+	}
+	for _, status := range strings.Split(c.Query("status"), ",") {
+		switch status := WorkflowStatus(strings.TrimSpace(status)); status {
+		case "":
+		case StatusCreated, StatusQueued, StatusRunning, StatusCompleted, StatusPaused, StatusFailed:
+			filter.Statuses = append(filter.Statuses, status)
+		default:
+			return filter, fmt.Errorf("Unknown status %q", status)
+		}
+	}
+	times := []struct {
+		name string
+		t    *time.Time
+	}{
+		{"created_after", &filter.CreatedAfter},
+		{"created_before", &filter.CreatedBefore},
+		{"finished_after", &filter.FinishedAfter},
+		{"finished_before", &filter.FinishedBefore},
+	}
+	for _, param := range times {
+		if value := c.Query(param.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time", param.name)
+			}
+			*param.t = t
+		}
+	}
+	return filter, nil
+}
+
+func (f ExportFilter) matches(w Workflow) bool {
+	if len(f.Statuses) > 0 {
+		found := false
+		for _, status := range f.Statuses {
+			found = found || w.Status == status
+		}
+		if !found {
+			return false
+		}
+	}
+	if (f.DeviceID != "" && w.DeviceID != f.DeviceID) || (f.Project != "" && w.Project != f.Project) {
+		return false
+	}
+	if f.Tag != "" {
+		tagged := false
+		for _, tag := range w.Tags {
+			tagged = tagged || tag == f.Tag
+		}
+		if !tagged {
+			return false
+		}
+	}
+	created := parseTime(w.CreatedAt)
+	if (!f.CreatedAfter.IsZero() && !created.After(f.CreatedAfter)) || (!f.CreatedBefore.IsZero() && !created.Before(f.CreatedBefore)) {
+		return false
+	}
+	if !f.FinishedAfter.IsZero() || !f.FinishedBefore.IsZero() {
+		finished, ok := w.finishedAt()
+		if !ok || (!f.FinishedAfter.IsZero() && !finished.After(f.FinishedAfter)) || (!f.FinishedBefore.IsZero() && !finished.Before(f.FinishedBefore)) {
+			return false
+		}
+	}
+	return true
+}
+
+// exportedSteps returns the workflow's step executions, in step order.
+func exportedSteps(w Workflow) []ExportedStep {
+	steps := make([]ExportedStep, 0, len(w.StepResults))
+	for _, result := range w.StepResults {
+		step := ExportedStep{
+			WorkflowID:  w.ID,
+			Lab:         w.Lab,
+			Project:     w.Project,
+			DeviceID:    w.DeviceID,
+			StepIndex:   result.StepIndex,
+			Step:        result.Step,
+			OperationID: result.OperationID,
+			Status:      result.Status,
+			StartedAt:   result.StartedAt,
+			ExecutedAt:  result.ExecutedAt,
+			ExecutedBy:  result.ExecutedBy,
+			Params:      w.stepParams(result.StepIndex),
+			Result:      result.Result,
+		}
+		if start, end := parseTime(result.StartedAt), parseTime(result.ExecutedAt); !start.IsZero() && !end.IsZero() {
+			ms := end.Sub(start).Milliseconds()
+			step.DurationMs = &ms
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+func workflowExportRow(w Workflow) []string {
+	duration := ""
+	if finished, ok := w.finishedAt(); ok && w.StartedAt != "" {
+		duration = strconv.FormatInt(finished.Sub(parseTime(w.StartedAt)).Milliseconds(), 10)
+	}
+	return []string{
+		w.ID,
+		w.Name,
+		w.Lab,
+		w.Project,
+		w.DeviceID,
+		string(w.Status),
+		strconv.Itoa(w.Priority),
+		strings.Join(w.Tags, ";"),
+		strings.Join(w.SampleBarcodes, ";"),
+		strconv.Itoa(len(w.Steps)),
+		strconv.Itoa(len(w.StepResults)),
+		w.CreatedAt,
+		w.CreatedBy,
+		w.QueuedAt,
+		w.StartedAt,
+		w.StartedBy,
+		w.CompletedAt,
+		w.CompletedBy,
+		w.FailedAt,
+		w.FailedBy,
+		w.FailureReason,
+		duration,
+		w.ArchivedAt,
+	}
+}
+
+func stepExportRow(step ExportedStep) []string {
+	duration := ""
+	if step.DurationMs != nil {
+		duration = strconv.FormatInt(*step.DurationMs, 10)
+	}
+	return []string{
+		step.WorkflowID,
+		step.Lab,
+		step.Project,
+		step.DeviceID,
+		strconv.Itoa(step.StepIndex),
+		step.Step,
+		step.OperationID,
+		step.Status,
+		step.StartedAt,
+		step.ExecutedAt,
+		duration,
+		step.ExecutedBy,
+		compactJSON(step.Params),
+		compactJSON(step.Result),
+	}
+}
+
+// writeWorkflowExport writes the workflows, or their step executions, as
+// JSON Lines or CSV, calling flush every exportFlushEvery records.
+func writeWorkflowExport(w io.Writer, flush func(), workflows []Workflow, format, records string) (int, error) {
+	var csvWriter *csv.Writer
+	encoder := json.NewEncoder(w)
+	if format == "csv" {
+		csvWriter = csv.NewWriter(w)
+		columns := workflowExportColumns
+		if records == ExportSteps {
+			columns = stepExportColumns
+		}
+		if err := csvWriter.Write(columns); err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	write := func(record interface{}, row []string) error {
+		var err error
+		if csvWriter != nil {
+			err = csvWriter.Write(row)
+		} else {
+			err = encoder.Encode(record)
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		if count%exportFlushEvery == 0 {
+			if csvWriter != nil {
+				csvWriter.Flush()
+			}
+			flush()
+		}
+		return nil
+	}
+	for _, workflow := range workflows {
+		if records == ExportSteps {
+			for _, step := range exportedSteps(workflow) {
+				if err := write(step, stepExportRow(step)); err != nil {
+					return count, err
+				}
+			}
+			continue
+		}
+		workflow.RunningStep = nil
+		if err := write(workflow, workflowExportRow(workflow)); err != nil {
+			return count, err
+		}
+	}
+	if csvWriter != nil {
+		csvWriter.Flush()
+		return count, csvWriter.Error()
+	}
+	return count, nil
+}
+
+// exportWorkflowsHandler streams the lab's workflows matching the filters,
+// or with ?records=steps their step executions, as JSON Lines or CSV
+// (?format=csv), oldest first.
+func exportWorkflowsHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", "jsonl")
+	if format != "jsonl" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jsonl or csv"})
+		return
+	}
+	records := c.DefaultQuery("records", ExportWorkflows)
+	if records != ExportWorkflows && records != ExportSteps {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "records must be workflows or steps"})
+		return
+	}
+	filter, err := exportFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	lab := requestLab(c)
+	workflows, err := getAllWorkflows(lab)
+	if err != nil {
+		log.Printf("Error getting workflows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflows"})
+		return
+	}
+	if filter.IncludeArchived {
+		archived, err := getArchivedWorkflows(lab)
+		if err != nil {
+			log.Printf("Error getting archived workflows: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve archived workflows"})
+			return
+		}
+		for id, workflow := range archived {
+			workflows[id] = workflow
+		}
+	}
+
+	matched := make([]Workflow, 0, len(workflows))
+	for _, workflow := range workflows {
+		if filter.matches(workflow) {
+			matched = append(matched, workflow)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].CreatedAt != matched[j].CreatedAt {
+			return matched[i].CreatedAt < matched[j].CreatedAt
+		}
+		return matched[i].ID < matched[j].ID
+	})
+
+	name := "workflows"
+	if records == ExportSteps {
+		name = "workflow-steps"
+	}
+	filename := fmt.Sprintf("%s-%s.%s", name, time.Now().UTC().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+	count, err := writeWorkflowExport(c.Writer, c.Writer.Flush, matched, format, records)
+	if err != nil {
+		// The headers are already sent, so the client sees a truncated file.
+		log.Printf("Error exporting workflows: %v", err)
+		return
+	}
+	log.Printf("Exported %d %s as %s", count, records, format)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"workflow-service/sampleapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fullWorkflowTimeout bounds each of the calls made for a full workflow, so
+// a slow service delays the response by at most this much.
+const fullWorkflowTimeout = 3 * time.Second
+
+// forwardedHeaders are passed on from the caller, with the caller's user,
+// lab, API key and request ID.
+var forwardedHeaders = []string{"Authorization"}
+
+// FullWorkflow is a workflow with its device and the availability of its
+// samples, as served by the device and sample services. A part that
+// couldn't be fetched is left out and its error given under errors.
+type FullWorkflow struct {
+	Workflow *Workflow         `json:"workflow"`
+	Device   json.RawMessage   `json:"device,omitempty"`
+	Samples  []json.RawMessage `json:"samples"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// ServiceError is a non-200 response from another service.
+type ServiceError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ServiceError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
+
+// checkReferences makes sure a new workflow's device and samples exist in
+// the caller's lab; the device and sample services don't show a lab the
+// others' devices and samples. It returns the status to respond with if
+// not.
+func checkReferences(c *gin.Context, caller Caller, deviceID string, barcodes []string) (int, error) {
+	_, err := fetchJSONAs(c, caller, http.MethodGet, fmt.Sprintf("%s/v1/devices/%s", deviceAPIURL, deviceID), nil)
+	var serviceErr *ServiceError
+	if errors.As(err, &serviceErr) && serviceErr.StatusCode == http.StatusNotFound {
+		return http.StatusBadRequest, fmt.Errorf("Device %s not found", deviceID)
+	}
+	if err != nil {
+		log.Printf("Error checking device %s: %v", deviceID, err)
+		return http.StatusBadGateway, fmt.Errorf("Failed to check device %s", deviceID)
+	}
+
+	if len(barcodes) == 0 {
+		return http.StatusOK, nil
+	}
+	data, err := fetchJSONAs(c, caller, http.MethodPost, fmt.Sprintf("%s/v1/samples/validate", sampleAPIURL), sampleapi.ValidateRequest{Barcodes: barcodes})
+	if errors.As(err, &serviceErr) && serviceErr.StatusCode == http.StatusNotFound {
+		return http.StatusBadRequest, errors.New(serviceErr.Message)
+	}
+	var results []sampleapi.ValidationResult
+	if err == nil {
+		err = json.Unmarshal(data, &results)
+	}
+	if err != nil {
+		log.Printf("Error checking samples: %v", err)
+		return http.StatusBadGateway, fmt.Errorf("Failed to check samples")
+	}
+	var missing []string
+	for _, result := range results {
+		if !result.Exists {
+			missing = append(missing, result.Barcode)
+		}
+	}
+	if len(missing) > 0 {
+		return http.StatusBadRequest, fmt.Errorf("Samples not found: %s", strings.Join(missing, ", "))
+	}
+	return http.StatusOK, nil
+}
+
+// fetchJSON makes a request to another service with the caller's headers
+// and returns the body of a 200 response.
+func fetchJSON(c *gin.Context, method, url string, body interface{}) (json.RawMessage, error) {
+	return fetchJSONAs(c, requestCaller(c), method, url, body)
+}
+
+// fetchJSONAs is fetchJSON on behalf of the given caller.
+func fetchJSONAs(c *gin.Context, caller Caller, method, url string, body interface{}) (json.RawMessage, error) {
+	reqCtx, cancel := context.WithTimeout(c.Request.Context(), fullWorkflowTimeout)
+	defer cancel()
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(reqCtx, method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, header := range forwardedHeaders {
+		if value := c.GetHeader(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	caller.setHeaders(req)
+
+	resp, err := (&http.Client{Transport: serviceTransport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		json.Unmarshal(data, &errResp)
+		return nil, &ServiceError{StatusCode: resp.StatusCode, Message: errResp.Error}
+	}
+	return data, nil
+}
+
+// getFullWorkflowHandler returns a workflow with its device and samples,
+// fetched from the device and sample services at the same time. If either
+// fails, the rest is still returned with the failure under errors.
+func getFullWorkflowHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	full := FullWorkflow{Workflow: workflow, Samples: []json.RawMessage{}, Errors: map[string]string{}}
+
+	deviceDone := make(chan error, 1)
+	go func() {
+		device, err := fetchJSON(c, http.MethodGet, fmt.Sprintf("%s/v1/devices/%s", deviceAPIURL, workflow.DeviceID), nil)
+		full.Device = device
+		deviceDone <- err
+	}()
+
+	samplesDone := make(chan error, 1)
+	go func() {
+		if len(workflow.SampleBarcodes) == 0 {
+			samplesDone <- nil
+			return
+		}
+		req := sampleapi.ValidateRequest{Barcodes: workflow.SampleBarcodes, WorkflowID: workflow.ID, IncludeSamples: true}
+		data, err := fetchJSON(c, http.MethodPost, fmt.Sprintf("%s/v1/samples/validate", sampleAPIURL), req)
+		if err == nil {
+			err = json.Unmarshal(data, &full.Samples)
+		}
+		samplesDone <- err
+	}()
+
+	if err := <-deviceDone; err != nil {
+		log.Printf("Error getting device %s for workflow %s: %v", workflow.DeviceID, workflowID, err)
+		full.Errors["device"] = err.Error()
+	}
+	if err := <-samplesDone; err != nil {
+		log.Printf("Error getting samples for workflow %s: %v", workflowID, err)
+		full.Samples = []json.RawMessage{}
+		full.Errors["samples"] = err.Error()
+	}
+
+	c.JSON(http.StatusOK, full)
+}
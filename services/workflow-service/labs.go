@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LAB_HEADER names the lab a request is made in. The gateway sets it from
+// the user's session. Requests without it are in the default lab, whose
+// data is kept under the original keys; each other lab's keys start with
+// lab:<lab>:.
+const LAB_HEADER = "X-Lab"
+
+var labPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// requestLab returns the lab a request is made in, or "" for the default
+// lab.
+func requestLab(c *gin.Context) string {
+	return strings.TrimSpace(c.GetHeader(LAB_HEADER))
+}
+
+// labKey returns the Redis key the lab keeps under key.
+func labKey(lab, key string) string {
+	if lab == "" {
+		return key
+	}
+	return "lab:" + lab + ":" + key
+}
+
+// checkLab rejects requests naming a malformed lab, which could reach into
+// another lab's keys.
+func checkLab() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if lab := requestLab(c); lab != "" && !labPattern.MatchString(lab) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + LAB_HEADER + " header"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"sort"
+	"strconv"
 	"time"
 
+	"platform"
+	"workflow-service/deviceapi"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -19,55 +22,160 @@ import (
 )
 
 var (
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 	ctx         = context.Background()
 )
 
+// WORKFLOWS_KEY holds the default lab's workflows, and lab:<lab>:workflows
+// each other lab's.
 const WORKFLOWS_KEY = "workflows"
 
 type WorkflowStatus string
 
 const (
 	StatusCreated   WorkflowStatus = "created"
+	StatusQueued    WorkflowStatus = "queued"
 	StatusRunning   WorkflowStatus = "running"
 	StatusCompleted WorkflowStatus = "completed"
 	StatusPaused    WorkflowStatus = "paused"
+	StatusFailed    WorkflowStatus = "failed"
 )
 
 type Workflow struct {
-	ID             string         `json:"id"`
-	Name           string         `json:"name"`
-	DeviceID       string         `json:"device_id"`
-	SampleBarcodes []string       `json:"sample_barcodes"`
-	Steps          []string       `json:"steps"`
-	Status         WorkflowStatus `json:"status"`
-	CreatedAt      string         `json:"created_at"`
-	StartedAt      string         `json:"started_at,omitempty"`
-	CompletedAt    string         `json:"completed_at,omitempty"`
+	ID             string                   `json:"id"`
+	Name           string                   `json:"name"`
+	DeviceID       string                   `json:"device_id"`
+	SampleBarcodes []string                 `json:"sample_barcodes"`
+	Steps          []string                 `json:"steps"`
+	StepParams     []map[string]interface{} `json:"step_params,omitempty"`
+	Requirements   *Requirements            `json:"requirements,omitempty"`
+	Status         WorkflowStatus           `json:"status"`
+	CreatedAt      string                   `json:"created_at"`
+	QueuedAt       string                   `json:"queued_at,omitempty"`
+	StartedAt      string                   `json:"started_at,omitempty"`
+	CompletedAt    string                   `json:"completed_at,omitempty"`
+	FailedAt       string                   `json:"failed_at,omitempty"`
+	FailureReason  string                   `json:"failure_reason,omitempty"`
+	// The users who created, started, completed and failed the workflow,
+	// where known.
+	CreatedBy   string `json:"created_by,omitempty"`
+	StartedBy   string `json:"started_by,omitempty"`
+	CompletedBy string `json:"completed_by,omitempty"`
+	FailedBy    string `json:"failed_by,omitempty"`
+	// Lab is the lab the workflow belongs to, or empty for the default lab.
+	Lab string `json:"lab,omitempty"`
+	// Tags are free-form labels; RETENTION_EXEMPT_TAG keeps a finished
+	// workflow from being cleaned up.
+	Tags []string `json:"tags,omitempty"`
+	// Project and CreatedByKey, the SHA-256 hex of the API key the
+	// workflow was created with, are what project and API key quotas
+	// count the workflow against. Project and Priority are passed on when
+	// booking its device, for the device's booking policy.
+	Project      string `json:"project,omitempty"`
+	Priority     int    `json:"priority,omitempty"`
+	CreatedByKey string `json:"created_by_key,omitempty"`
+	// ManualStart keeps the scheduler from starting the workflow; Pool
+	// lets it run the workflow on any device of its device's type.
+	ManualStart bool `json:"manual_start,omitempty"`
+	Pool        bool `json:"pool,omitempty"`
+	// StepResults holds what the device returned for each step run, in step
+	// order; running a step again replaces its result.
+	StepResults []StepResult `json:"step_results,omitempty"`
+	// ArchivedAt and ArchivedBy are set while the workflow is archived.
+	ArchivedAt string `json:"archived_at,omitempty"`
+	ArchivedBy string `json:"archived_by,omitempty"`
+	// DeletedAt and DeletedBy are set while the workflow is in the trash.
+	DeletedAt string `json:"deleted_at,omitempty"`
+	DeletedBy string `json:"deleted_by,omitempty"`
+	// Pauses are the times the workflow was paused, oldest first; the last
+	// is still going on while the workflow is paused.
+	Pauses []Pause `json:"pauses,omitempty"`
+	// RunningStep is the step the device is running now, with its
+	// progress. It isn't stored; it is added when the workflow is fetched.
+	RunningStep *RunningStep `json:"running_step,omitempty"`
+	// SchemaVersion is the schema version the workflow is stored at; older
+	// ones are upgraded as they are read.
+	SchemaVersion int `json:"schema_version"`
+}
+
+// StepResult is the outcome of running one step on the workflow's device,
+// with the result data the device returned, such as a plate reader's
+// measurements.
+type StepResult struct {
+	StepIndex   int                    `json:"step_index"`
+	Step        string                 `json:"step"`
+	OperationID string                 `json:"operation_id,omitempty"`
+	Status      string                 `json:"status"`
+	Result      map[string]interface{} `json:"result,omitempty"`
+	// StartedAt is when the step was sent to the device; results saved
+	// before it was recorded don't have it.
+	StartedAt  string `json:"started_at,omitempty"`
+	ExecutedAt string `json:"executed_at"`
+	ExecutedBy string `json:"executed_by,omitempty"`
 }
 
+// setStepResult records a step's result, replacing any earlier one for the
+// same step.
+func (w *Workflow) setStepResult(result StepResult) {
+	for i, existing := range w.StepResults {
+		if existing.StepIndex == result.StepIndex {
+			w.StepResults[i] = result
+			return
+		}
+	}
+	w.StepResults = append(w.StepResults, result)
+	sort.SliceStable(w.StepResults, func(a, b int) bool {
+		return w.StepResults[a].StepIndex < w.StepResults[b].StepIndex
+	})
+}
+
+// stepResult returns the result of the step at index, or nil if it hasn't
+// run.
+func (w *Workflow) stepResult(index int) *StepResult {
+	for i := range w.StepResults {
+		if w.StepResults[i].StepIndex == index {
+			return &w.StepResults[i]
+		}
+	}
+	return nil
+}
+
+// maxPriority is the highest priority a workflow can be booked with, as
+// the device service allows.
+const maxPriority = 100
+
 type CreateWorkflowRequest struct {
 	Name           string   `json:"name" binding:"required"`
 	DeviceID       string   `json:"device_id" binding:"required"`
 	SampleBarcodes []string `json:"sample_barcodes"`
 	Steps          []string `json:"steps"`
+	// StepParams are passed to the device with the step at the same index.
+	StepParams   []map[string]interface{} `json:"step_params"`
+	Requirements *Requirements            `json:"requirements"`
+	Tags         []string                 `json:"tags"`
+	Project      string                   `json:"project"`
+	Priority     int                      `json:"priority"`
+	ManualStart  bool                     `json:"manual_start"`
+	Pool         bool                     `json:"pool"`
 }
 
-type ExecuteStepRequest struct {
-	StepIndex int `json:"step_index"`
+// Requirements are checked by the device service when the workflow books
+// its device.
+type Requirements struct {
+	MinFirmwareVersion string `json:"min_firmware_version,omitempty"`
+	ProtocolVersion    string `json:"protocol_version,omitempty"`
 }
 
-type BookDeviceRequest struct {
-	WorkflowID string `json:"workflow_id"`
+type FailWorkflowRequest struct {
+	Reason string `json:"reason"`
 }
 
-type ReleaseDeviceRequest struct {
-	WorkflowID string `json:"workflow_id"`
-}
-
-type ExecuteDeviceRequest struct {
-	WorkflowID string `json:"workflow_id"`
-	Operation  string `json:"operation"`
+type ExecuteStepRequest struct {
+	StepIndex int `json:"step_index"`
+	// AttemptToken, chosen by the client, names one attempt at the step: a
+	// retry with the same token gets the first attempt's result rather than
+	// running the step again.
+	AttemptToken string `json:"attempt_token"`
 }
 
 var (
@@ -75,8 +183,8 @@ var (
 	sampleAPIURL string
 )
 
-func getAllWorkflows() (map[string]Workflow, error) {
-	workflowsData, err := redisClient.Get(ctx, WORKFLOWS_KEY).Result()
+func getAllWorkflows(lab string) (map[string]Workflow, error) {
+	workflowsData, err := redisClient.Get(ctx, labKey(lab, WORKFLOWS_KEY)).Result()
 	if err == redis.Nil {
 		return make(map[string]Workflow), nil
 	}
@@ -84,25 +192,20 @@ func getAllWorkflows() (map[string]Workflow, error) {
 		return nil, err
 	}
 
-	var workflows map[string]Workflow
-	if err := json.Unmarshal([]byte(workflowsData), &workflows); err != nil {
-		return nil, err
-	}
-
-	return workflows, nil
+	return decodeWorkflows([]byte(workflowsData))
 }
 
-func saveWorkflows(workflows map[string]Workflow) error {
-	data, err := json.Marshal(workflows)
+func saveWorkflows(lab string, workflows map[string]Workflow) error {
+	data, err := encodeWorkflows(workflows)
 	if err != nil {
 		return err
 	}
 
-	return redisClient.Set(ctx, WORKFLOWS_KEY, data, 0).Err()
+	return redisClient.Set(ctx, labKey(lab, WORKFLOWS_KEY), data, 0).Err()
 }
 
-func getWorkflow(workflowID string) (*Workflow, error) {
-	workflows, err := getAllWorkflows()
+func getWorkflow(lab, workflowID string) (*Workflow, error) {
+	workflows, err := getAllWorkflows(lab)
 	if err != nil {
 		return nil, err
 	}
@@ -115,8 +218,8 @@ func getWorkflow(workflowID string) (*Workflow, error) {
 	return &workflow, nil
 }
 
-func updateWorkflow(workflowID string, updates map[string]interface{}) (*Workflow, error) {
-	workflows, err := getAllWorkflows()
+func updateWorkflow(lab, workflowID string, updates map[string]interface{}) (*Workflow, error) {
+	workflows, err := getAllWorkflows(lab)
 	if err != nil {
 		return nil, err
 	}
@@ -130,33 +233,73 @@ func updateWorkflow(workflowID string, updates map[string]interface{}) (*Workflo
 	if name, ok := updates["name"].(string); ok {
 		workflow.Name = name
 	}
+	if deviceID, ok := updates["device_id"].(string); ok {
+		workflow.DeviceID = deviceID
+	}
 	if status, ok := updates["status"].(WorkflowStatus); ok {
 		workflow.Status = status
 	}
+	if queuedAt, ok := updates["queued_at"].(string); ok {
+		workflow.QueuedAt = queuedAt
+	}
 	if startedAt, ok := updates["started_at"].(string); ok {
 		workflow.StartedAt = startedAt
 	}
 	if completedAt, ok := updates["completed_at"].(string); ok {
 		workflow.CompletedAt = completedAt
 	}
+	if failedAt, ok := updates["failed_at"].(string); ok {
+		workflow.FailedAt = failedAt
+	}
+	if reason, ok := updates["failure_reason"].(string); ok {
+		workflow.FailureReason = reason
+	}
+	if startedBy, ok := updates["started_by"].(string); ok {
+		workflow.StartedBy = startedBy
+	}
+	if completedBy, ok := updates["completed_by"].(string); ok {
+		workflow.CompletedBy = completedBy
+	}
+	if failedBy, ok := updates["failed_by"].(string); ok {
+		workflow.FailedBy = failedBy
+	}
+	if result, ok := updates["step_result"].(StepResult); ok {
+		workflow.setStepResult(result)
+	}
+	if pause, ok := updates["pause"].(Pause); ok {
+		workflow.Pauses = append(workflow.Pauses, pause)
+	}
+	if resumedAt, ok := updates["resumed_at"].(string); ok && len(workflow.Pauses) > 0 {
+		last := &workflow.Pauses[len(workflow.Pauses)-1]
+		last.ResumedAt = resumedAt
+		last.ResumedBy, _ = updates["resumed_by"].(string)
+	}
 
 	workflows[workflowID] = workflow
-	if err := saveWorkflows(workflows); err != nil {
+	if err := saveWorkflows(lab, workflows); err != nil {
 		return nil, err
 	}
 
+	workflow = workflows[workflowID]
 	return &workflow, nil
 }
 
+// healthHandler reports the service alive, and degraded while Redis is
+// down; /ready says whether it can take requests.
 func healthHandler(c *gin.Context) {
+	status := "healthy"
+	if !platform.RedisUp() {
+		status = "degraded"
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"status":  "healthy",
+		"status":  status,
 		"service": "workflow-service",
+		"redis":   platform.RedisStatus(),
 	})
 }
 
 func listWorkflowsHandler(c *gin.Context) {
-	workflows, err := getAllWorkflows()
+	workflows, err := getAllWorkflows(requestLab(c))
 	if err != nil {
 		log.Printf("Error getting workflows: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflows"})
@@ -180,21 +323,61 @@ func listWorkflowsHandler(c *gin.Context) {
 func getWorkflowHandler(c *gin.Context) {
 	workflowID := c.Param("workflow_id")
 
-	workflow, err := getWorkflow(workflowID)
+	workflow, err := getWorkflow(requestLab(c), workflowID)
 	if err != nil {
 		log.Printf("Error getting workflow: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
 		return
 	}
 
+	// Archived workflows are still found by ID
+	if workflow == nil {
+		workflow, err = getArchivedWorkflow(requestLab(c), workflowID)
+		if err != nil {
+			log.Printf("Error getting archived workflow: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+			return
+		}
+	}
+
 	if workflow == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
 		return
 	}
 
+	attachRunningStep(c, workflow)
 	c.JSON(http.StatusOK, workflow)
 }
 
+func getStepResultHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("step_index"))
+	if err != nil || index < 0 || index >= len(workflow.Steps) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid step index"})
+		return
+	}
+
+	result := workflow.stepResult(index)
+	if result == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Step has not run"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func createWorkflowHandler(c *gin.Context) {
 	var req CreateWorkflowRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -202,6 +385,25 @@ func createWorkflowHandler(c *gin.Context) {
 		return
 	}
 
+	if err := validateStepParams(req.Steps, req.StepParams); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Project != "" && !projectPattern.MatchString(req.Project) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "project must be up to 128 letters, digits, dots, dashes and underscores"})
+		return
+	}
+	if req.Priority < 0 || req.Priority > maxPriority {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("priority must be between 0 and %d", maxPriority)})
+		return
+	}
+
+	if status, err := checkReferences(c, requestCaller(c), req.DeviceID, req.SampleBarcodes); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
 	workflowID := uuid.New().String()
 
 	log.Printf("Creating workflow: %s (ID: %s) for device: %s", req.Name, workflowID, req.DeviceID)
@@ -212,20 +414,45 @@ func createWorkflowHandler(c *gin.Context) {
 		DeviceID:       req.DeviceID,
 		SampleBarcodes: req.SampleBarcodes,
 		Steps:          req.Steps,
+		StepParams:     req.StepParams,
+		Requirements:   req.Requirements,
+		Tags:           normalizeTags(req.Tags),
+		Project:        req.Project,
+		Priority:       req.Priority,
+		ManualStart:    req.ManualStart,
+		Pool:           req.Pool,
+		CreatedByKey:   hashAPIKey(requestAPIKey(c)),
 		Status:         StatusCreated,
 		CreatedAt:      time.Now().UTC().Format(time.RFC3339),
+		CreatedBy:      requestActor(c),
+		Lab:            requestLab(c),
+		SchemaVersion:  workflowSchemaVersion,
+	}
+
+	quotaKeys, err := takeCreateQuota(workflow)
+	if quotaErr, ok := err.(*QuotaError); ok {
+		log.Printf("Workflow %s refused: %v", workflowID, quotaErr)
+		quotaErr.respond(c)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking quotas: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workflow"})
+		return
 	}
 
-	workflows, err := getAllWorkflows()
+	workflows, err := getAllWorkflows(workflow.Lab)
 	if err != nil {
 		log.Printf("Error getting workflows: %v", err)
+		giveBackCreateQuota(quotaKeys)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workflow"})
 		return
 	}
 
 	workflows[workflowID] = workflow
-	if err := saveWorkflows(workflows); err != nil {
+	if err := saveWorkflows(workflow.Lab, workflows); err != nil {
 		log.Printf("Error saving workflows: %v", err)
+		giveBackCreateQuota(quotaKeys)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create workflow"})
 		return
 	}
@@ -239,7 +466,7 @@ func startWorkflowHandler(c *gin.Context) {
 
 	log.Printf("Starting workflow: %s", workflowID)
 
-	workflow, err := getWorkflow(workflowID)
+	workflow, err := getWorkflow(requestLab(c), workflowID)
 	if err != nil {
 		log.Printf("Error getting workflow: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
@@ -252,55 +479,104 @@ func startWorkflowHandler(c *gin.Context) {
 		return
 	}
 
+	if c.Query("simulate") == "true" {
+		simulateWorkflow(c, workflow)
+		return
+	}
+
 	if workflow.Status != StatusCreated {
 		log.Printf("Workflow %s already started or completed", workflowID)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Workflow already started or completed"})
 		return
 	}
 
-	deviceID := workflow.DeviceID
-	log.Printf("Booking device %s for workflow %s", deviceID, workflowID)
+	if err := checkRunningQuota(*workflow); err != nil {
+		if quotaErr, ok := err.(*QuotaError); ok {
+			log.Printf("Workflow %s refused: %v", workflowID, quotaErr)
+			quotaErr.respond(c)
+			return
+		}
+		log.Printf("Error checking quotas: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check quotas"})
+		return
+	}
 
-	bookURL := fmt.Sprintf("%s/device/%s/reserve", deviceAPIURL, deviceID)
-	bookReq := BookDeviceRequest{WorkflowID: workflowID}
-	bookBody, _ := json.Marshal(bookReq)
+	deviceID := workflow.DeviceID
+	// With queueing on, a busy device takes the booking to grant later
+	queue := platform.FeatureEnabled(redisClient, QUEUEING_FLAG, requestLab(c))
 
-	resp, err := http.Post(bookURL, "application/json", bytes.NewBuffer(bookBody))
+	// Claim the device before booking it, so two workflows can't both run
+	// on it even if the booking is bypassed. A workflow queued for the
+	// device claims it when its booking is granted instead.
+	active, err := claimDevice(requestLab(c), deviceID, workflowID, deviceCapacity(c, deviceID, workflowID))
 	if err != nil {
-		log.Printf("Error communicating with device service: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to communicate with device service: %v", err)})
+		log.Printf("Error claiming device %s for workflow %s: %v", deviceID, workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim device"})
+		return
+	}
+	claimed := active == nil
+	if !claimed && !queue {
+		log.Printf("Device %s is already running workflows %v", deviceID, active)
+		c.JSON(http.StatusConflict, gin.H{"error": "Device already has an active workflow", "active_workflows": active})
 		return
 	}
-	defer resp.Body.Close()
+	started := false
+	defer func() {
+		if claimed && !started {
+			releaseDeviceClaim(deviceID, workflowID)
+		}
+	}()
+
+	log.Printf("Booking device %s for workflow %s", deviceID, workflowID)
+
+	bookReq := deviceapi.BookRequest{WorkflowID: workflowID, Queue: queue, Project: workflow.Project, Priority: workflow.Priority}
+	if workflow.Requirements != nil {
+		bookReq.MinFirmwareVersion = workflow.Requirements.MinFirmwareVersion
+		bookReq.ProtocolVersion = workflow.Requirements.ProtocolVersion
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Failed to book device %s: %d - %s", deviceID, resp.StatusCode, string(body))
+	caller := requestCaller(c)
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, caller.setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	booking, err := client.BookDevice(deviceCallContext(ctx, requestLab(c), workflowID), deviceID, bookReq)
+	var respErr *deviceapi.ResponseError
+	if errors.As(err, &respErr) {
+		log.Printf("Failed to book device %s: %d - %s", deviceID, respErr.StatusCode, string(respErr.Body))
 
 		var errorResp map[string]interface{}
-		json.Unmarshal(body, &errorResp)
+		json.Unmarshal(respErr.Body, &errorResp)
 
-		c.JSON(resp.StatusCode, gin.H{
-			"error":   "Failed to book device",
-			"details": errorResp,
-		})
+		c.JSON(respErr.StatusCode, upstreamError("Failed to book device", deviceServiceName, respErr.StatusCode, errorResp, caller))
+		return
+	}
+	if err != nil {
+		log.Printf("Error communicating with device service: %v", err)
+		c.JSON(http.StatusInternalServerError, unreachableError(fmt.Sprintf("Failed to communicate with device service: %v", err), deviceServiceName, caller))
+		return
+	}
+
+	if booking.Status == BOOKING_QUEUED {
+		queueWorkflow(c, workflowID)
 		return
 	}
 
 	// Update workflow status
-	_, err = updateWorkflow(workflowID, map[string]interface{}{
+	_, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
 		"status":     StatusRunning,
 		"started_at": time.Now().UTC().Format(time.RFC3339),
+		"started_by": requestActor(c),
 	})
 	if err != nil {
 		log.Printf("Error updating workflow: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
 		return
 	}
+	started = true
 
 	// Get updated workflow
-	workflow, _ = getWorkflow(workflowID)
+	workflow, _ = getWorkflow(requestLab(c), workflowID)
 
+	publishWorkflowEvent(WorkflowEventStarted, workflow, workflow.StartedBy)
 	log.Printf("Workflow %s started successfully", workflowID)
 	c.JSON(http.StatusOK, workflow)
 }
@@ -310,7 +586,7 @@ func completeWorkflowHandler(c *gin.Context) {
 
 	log.Printf("Completing workflow: %s", workflowID)
 
-	workflow, err := getWorkflow(workflowID)
+	workflow, err := getWorkflow(requestLab(c), workflowID)
 	if err != nil {
 		log.Printf("Error getting workflow: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
@@ -332,54 +608,66 @@ func completeWorkflowHandler(c *gin.Context) {
 	deviceID := workflow.DeviceID
 	log.Printf("Releasing device %s from workflow %s", deviceID, workflowID)
 
-	releaseURL := fmt.Sprintf("%s/devices/%s/release", deviceAPIURL, deviceID)
-	releaseReq := ReleaseDeviceRequest{WorkflowID: workflowID}
-	releaseBody, _ := json.Marshal(releaseReq)
-
-	resp, err := http.Post(releaseURL, "application/json", bytes.NewBuffer(releaseBody))
-	if err != nil {
-		log.Printf("Error communicating with device service: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to communicate with device service: %v", err)})
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Failed to release device %s: %d", deviceID, resp.StatusCode)
+	caller := requestCaller(c)
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, caller.setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	_, err = client.ReleaseDevice(deviceCallContext(ctx, requestLab(c), workflowID), deviceID, &deviceapi.ReleaseRequest{WorkflowID: workflowID})
+	var respErr *deviceapi.ResponseError
+	if errors.As(err, &respErr) {
+		log.Printf("Failed to release device %s: %d", deviceID, respErr.StatusCode)
 
 		var errorResp map[string]interface{}
-		json.Unmarshal(body, &errorResp)
+		json.Unmarshal(respErr.Body, &errorResp)
 
-		c.JSON(resp.StatusCode, gin.H{
-			"error":   "Failed to release device",
-			"details": errorResp,
-		})
+		c.JSON(respErr.StatusCode, upstreamError("Failed to release device", deviceServiceName, respErr.StatusCode, errorResp, caller))
+		return
+	}
+	if err != nil {
+		log.Printf("Error communicating with device service: %v", err)
+		c.JSON(http.StatusInternalServerError, unreachableError(fmt.Sprintf("Failed to communicate with device service: %v", err), deviceServiceName, caller))
 		return
 	}
 
 	// Update workflow status
-	_, err = updateWorkflow(workflowID, map[string]interface{}{
+	_, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
 		"status":       StatusCompleted,
 		"completed_at": time.Now().UTC().Format(time.RFC3339),
+		"completed_by": requestActor(c),
 	})
 	if err != nil {
 		log.Printf("Error updating workflow: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
 		return
 	}
+	releaseDeviceClaim(deviceID, workflowID)
 
 	// Get updated workflow
-	workflow, _ = getWorkflow(workflowID)
+	workflow, _ = getWorkflow(requestLab(c), workflowID)
 
+	publishWorkflowEvent(WorkflowEventCompleted, workflow, workflow.CompletedBy)
 	log.Printf("Workflow %s completed successfully", workflowID)
 	c.JSON(http.StatusOK, workflow)
 }
 
-func executeStepHandler(c *gin.Context) {
+// failWorkflowHandler marks a workflow failed. The device service calls it
+// when a workflow's device booking is forcibly released.
+func failWorkflowHandler(c *gin.Context) {
 	workflowID := c.Param("workflow_id")
 
-	workflow, err := getWorkflow(workflowID)
+	// Failing a workflow is for operators: a signed in user, or the device
+	// service acting for the operator who force-released its device.
+	actor := requestActor(c)
+	if actor == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Sign in to fail a workflow"})
+		return
+	}
+
+	var req FailWorkflowRequest
+	c.ShouldBindJSON(&req)
+
+	log.Printf("Failing workflow %s for %s: %s", workflowID, actor, req.Reason)
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
 	if err != nil {
 		log.Printf("Error getting workflow: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
@@ -387,65 +675,206 @@ func executeStepHandler(c *gin.Context) {
 	}
 
 	if workflow == nil {
+		log.Printf("Workflow not found: %s", workflowID)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
 		return
 	}
 
-	if workflow.Status != StatusRunning {
+	// Completed and failed workflows are final.
+	if workflow.Status == StatusCompleted || workflow.Status == StatusFailed {
+		log.Printf("Workflow %s is already %s", workflowID, workflow.Status)
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Workflow is already %s", workflow.Status)})
+		return
+	}
+	if workflow.Status != StatusRunning && workflow.Status != StatusPaused && workflow.Status != StatusQueued {
+		log.Printf("Workflow %s is not running", workflowID)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Workflow is not running"})
 		return
 	}
 
+	workflow, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
+		"status":         StatusFailed,
+		"failed_at":      time.Now().UTC().Format(time.RFC3339),
+		"failure_reason": req.Reason,
+		"failed_by":      actor,
+	})
+	if err != nil {
+		log.Printf("Error updating workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
+		return
+	}
+	releaseDeviceClaim(workflow.DeviceID, workflowID)
+
+	publishWorkflowEvent(WorkflowEventFailed, workflow, workflow.FailedBy)
+	log.Printf("Workflow %s marked failed", workflowID)
+	c.JSON(http.StatusOK, workflow)
+}
+
+func executeStepHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
 	var req ExecuteStepRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		req.StepIndex = 0
 	}
 
+	if req.AttemptToken == "" {
+		status, response := executeStep(c, workflow, req)
+		c.JSON(status, response)
+		return
+	}
+	if len(req.AttemptToken) > maxAttemptTokenLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("attempt_token must be at most %d characters", maxAttemptTokenLength)})
+		return
+	}
+
+	// A retried attempt gets the result of the first
+	key := stepAttemptKey(requestLab(c), workflowID, req.StepIndex, req.AttemptToken)
+	attempt, err := claimStepAttempt(key)
+	if err != nil {
+		log.Printf("Error claiming attempt %s of workflow %s step %d: %v", req.AttemptToken, workflowID, req.StepIndex, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check attempt_token"})
+		return
+	}
+	if attempt != nil {
+		if attempt.StatusCode == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Step attempt is still running"})
+			return
+		}
+		log.Printf("Replaying attempt %s of workflow %s step %d", req.AttemptToken, workflowID, req.StepIndex)
+		c.Header(IDEMPOTENT_REPLAY_HEADER, "true")
+		c.Data(attempt.StatusCode, "application/json; charset=utf-8", attempt.Body)
+		return
+	}
+
+	status, response := executeStep(c, workflow, req)
+	if err := finishStepAttempt(key, status, response); err != nil {
+		log.Printf("Error saving attempt %s of workflow %s step %d: %v", req.AttemptToken, workflowID, req.StepIndex, err)
+	}
+	c.JSON(status, response)
+}
+
+// executeStep runs a step of a running workflow on its device, drawing the
+// step's volume from the samples, and returns the response status and body.
+func executeStep(c *gin.Context, workflow *Workflow, req ExecuteStepRequest) (int, gin.H) {
+	workflowID := workflow.ID
+
+	if workflow.Status != StatusRunning {
+		return http.StatusBadRequest, gin.H{"error": "Workflow is not running"}
+	}
+
 	steps := workflow.Steps
 	if req.StepIndex >= len(steps) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid step index"})
-		return
+		return http.StatusBadRequest, gin.H{"error": "Invalid step index"}
 	}
 
 	step := steps[req.StepIndex]
 	deviceID := workflow.DeviceID
+	params := workflow.stepParams(req.StepIndex)
+
+	// Check the samples hold enough for the step before running it
+	volume, err := stepVolume(params)
+	if err != nil {
+		return http.StatusBadRequest, gin.H{"error": err.Error()}
+	}
+	consumes := volume > 0 && len(workflow.SampleBarcodes) > 0
+	if consumes {
+		status, details, err := consumeSampleVolume(workflow, req.StepIndex, volume, true, requestCaller(c))
+		if err != nil {
+			return http.StatusInternalServerError, unreachableError(fmt.Sprintf("Failed to communicate with sample service: %v", err), sampleServiceName, requestCaller(c))
+		}
+		if status != http.StatusOK {
+			log.Printf("Step %d of workflow %s needs %g uL per sample: %d - %v", req.StepIndex, workflowID, volume, status, details)
+			return status, upstreamError("Insufficient sample volume for step", sampleServiceName, status, details, requestCaller(c))
+		}
+	}
 
-	executeURL := fmt.Sprintf("%s/devices/%s/execute", deviceAPIURL, deviceID)
-	executeReq := ExecuteDeviceRequest{
+	executeReq := deviceapi.ExecuteRequest{
 		WorkflowID: workflowID,
 		Operation:  step,
+		Params:     params,
 	}
-	executeBody, _ := json.Marshal(executeReq)
 
-	resp, err := http.Post(executeURL, "application/json", bytes.NewBuffer(executeBody))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to communicate with device service: %v", err)})
-		return
+	caller := requestCaller(c)
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, caller.setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	// Each attempt runs the operation once, however often it's retried
+	if req.AttemptToken != "" {
+		idempotencyKey := deviceIdempotencyKey(workflowID, req.StepIndex, req.AttemptToken)
+		client.RequestEditors = append(client.RequestEditors, func(r *http.Request) {
+			r.Header.Set(IDEMPOTENCY_KEY_HEADER, idempotencyKey)
+		})
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
+	startedAt := time.Now().UTC().Format(time.RFC3339)
+	markStepRunning(requestLab(c), workflowID, RunningStep{StepIndex: req.StepIndex, Step: step, StartedAt: startedAt})
+	executed, err := client.ExecuteOperation(deviceCallContext(ctx, requestLab(c), workflowID), deviceID, executeReq)
+	clearRunningStep(requestLab(c), workflowID)
+	var respErr *deviceapi.ResponseError
+	if errors.As(err, &respErr) {
 		var errorResp map[string]interface{}
-		json.Unmarshal(body, &errorResp)
+		json.Unmarshal(respErr.Body, &errorResp)
 
-		c.JSON(resp.StatusCode, gin.H{
-			"error":   "Failed to execute step",
-			"details": errorResp,
-		})
-		return
+		return respErr.StatusCode, upstreamError("Failed to execute step", deviceServiceName, respErr.StatusCode, errorResp, caller)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, unreachableError(fmt.Sprintf("Failed to communicate with device service: %v", err), deviceServiceName, caller)
+	}
+
+	// Keep the step's result with the workflow, so it outlives this response.
+	if executed.ExecutedAt == "" {
+		executed.ExecutedAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	_, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
+		"step_result": StepResult{
+			StepIndex:   req.StepIndex,
+			Step:        step,
+			OperationID: executed.OperationID,
+			Status:      executed.Status,
+			Result:      executed.Result,
+			StartedAt:   startedAt,
+			ExecutedAt:  executed.ExecutedAt,
+			ExecutedBy:  requestActor(c),
+		},
+	})
+	if err != nil {
+		log.Printf("Error saving result of step %d of workflow %s: %v", req.StepIndex, workflowID, err)
 	}
 
-	var result map[string]interface{}
-	body, _ := io.ReadAll(resp.Body)
-	json.Unmarshal(body, &result)
-
-	c.JSON(http.StatusOK, gin.H{
+	response := gin.H{
 		"workflow_id": workflowID,
 		"step_index":  req.StepIndex,
 		"step":        step,
-		"result":      result,
-	})
+		"result":      executed,
+	}
+
+	// The step ran, so record what it drew from the samples
+	if consumes {
+		status, details, err := consumeSampleVolume(workflow, req.StepIndex, volume, false, requestCaller(c))
+		switch {
+		case err != nil:
+			log.Printf("Error consuming samples for workflow %s step %d: %v", workflowID, req.StepIndex, err)
+			response["consumption_error"] = err.Error()
+		case status != http.StatusOK:
+			log.Printf("Failed to consume samples for workflow %s step %d: %d - %v", workflowID, req.StepIndex, status, details)
+			response["consumption_error"] = details
+		default:
+			response["consumed"] = details["samples"]
+		}
+	}
+
+	return http.StatusOK, response
 }
 
 func main() {
@@ -463,46 +892,50 @@ func main() {
 	if sampleAPIURL == "" {
 		sampleAPIURL = "http://localhost:5002"
 	}
+	sampleAPIKey = os.Getenv("SAMPLE_API_KEY")
 
-	// Connect to Redis
-	redisURL := os.Getenv("REDIS_URL")
-	if redisURL == "" {
-		redisURL = "redis://localhost:6379"
-	}
-
-	opt, err := redis.ParseURL(redisURL)
-	if err != nil {
-		log.Fatalf("Failed to parse Redis URL: %v", err)
-	}
-
-	redisClient = redis.NewClient(opt)
-
-	// Test Redis connection
-	if err := redisClient.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
-	}
+	// Connect to Redis, retrying while it starts
+	redisClient = platform.NewRedisClient()
+	platform.WaitForRedis(redisClient, nil)
 
-	log.Println("Connected to Redis successfully")
+	// Clean up finished workflows in the background
+	startRetentionJanitor()
+	startTrashJanitor()
+	configureServiceTLS()
+	serviceTransport = recordingTransport{next: serviceTransport}
+	configureAuditLog()
+	configureRequestLimits()
+	platform.ConfigureCompression()
+	platform.ConfigureFeatureFlags()
 
 	// Setup Gin
-	gin.SetMode(gin.ReleaseMode)
+	platform.ConfigureDebug(redisClient)
 	router := gin.Default()
+	platform.RegisterDebug(router)
 
 	// CORS configuration
-	router.Use(cors.New(cors.Config{
-		AllowAllOrigins: true,
-		AllowMethods:    []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:    []string{"Origin", "Content-Type", "Accept"},
-	}))
+	corsPolicy, err := platform.CORSConfig(cors.Config{
+		AllowMethods:  []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Type", "Accept", "If-None-Match", API_VERSION_HEADER},
+		ExposeHeaders: []string{API_VERSION_HEADER, "Deprecation", "Sunset", "Link", "ETag"},
+	})
+	if err != nil {
+		log.Fatalf("Invalid CORS configuration: %v", err)
+	}
+	router.Use(cors.New(corsPolicy))
+	router.Use(platform.CompressResponses())
+	router.Use(limitRequestBodies())
+	router.Use(auditLog())
 
 	// Routes
 	router.GET("/health", healthHandler)
-	router.GET("/workflows", listWorkflowsHandler)
-	router.GET("/workflows/:workflow_id", getWorkflowHandler)
-	router.POST("/workflows", createWorkflowHandler)
-	router.POST("/workflows/:workflow_id/start", startWorkflowHandler)
-	router.POST("/workflows/:workflow_id/complete", completeWorkflowHandler)
-	router.POST("/workflows/:workflow_id/execute-step", executeStepHandler)
+	router.GET("/ready", platform.ReadyHandler)
+	registerRoutes(router.Group("/v1", platform.RequireRedis(), apiVersion()))
+	// The unversioned paths keep working until they are retired.
+	registerRoutes(router.Group("", platform.RequireRedis(), apiVersion(), deprecatedPath()))
+
+	// Start created workflows as their devices come free
+	startScheduler(router)
 
 	// Start server
 	port := os.Getenv("PORT")
@@ -511,7 +944,53 @@ func main() {
 	}
 
 	log.Printf("Workflow service starting on port %s", port)
-	if err := router.Run("0.0.0.0:" + port); err != nil {
+	if err := serve(router, "0.0.0.0:"+port); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// registerRoutes adds the API's routes to a group, which is mounted both at
+// /v1 and, for older clients, at the root.
+func registerRoutes(api *gin.RouterGroup) {
+	api.Use(checkLab())
+	api.GET("/workflows", platform.ConditionalGET(listWorkflowsHandler))
+	api.GET("/workflows/:workflow_id", getWorkflowHandler)
+	api.GET("/workflows/:workflow_id/full", getFullWorkflowHandler)
+	api.GET("/workflows/:workflow_id/steps/:step_index/result", getStepResultHandler)
+	api.GET("/workflows/:workflow_id/timeline", getWorkflowTimelineHandler)
+	api.GET("/workflows/:workflow_id/report", runReportHandler)
+	api.GET("/workflows/:workflow_id/device-calls", deviceCallsHandler)
+	api.POST("/workflows", createWorkflowHandler)
+	api.GET("/workflows/export", exportWorkflowsHandler)
+	api.GET("/workflows/archive", listArchivedWorkflowsHandler)
+	api.POST("/workflows/archive", requireAdmin, bulkArchiveHandler)
+	api.GET("/workflows/trash", listTrashHandler)
+	api.POST("/workflows/trash/:workflow_id/restore", restoreFromTrashHandler)
+	api.GET("/workflows/audit-log", requireAdmin, auditLogHandler)
+	api.GET("/workflows/retention", requireAdmin, retentionReportHandler)
+	api.POST("/workflows/migrate", requireAdmin, migrateWorkflowsHandler)
+	api.GET("/workflows/snapshot", requireAdmin, getSnapshotHandler)
+	api.POST("/workflows/snapshot", requireAdmin, restoreSnapshotHandler)
+	api.GET("/workflows/quotas", requireAdmin, listQuotasHandler)
+	api.PUT("/workflows/quotas/:scope/:subject", requireAdmin, setQuotaHandler)
+	api.DELETE("/workflows/quotas/:scope/:subject", requireAdmin, deleteQuotaHandler)
+	api.GET("/scheduler", schedulerStatusHandler)
+	api.POST("/scheduler/estimate", estimateScheduleHandler)
+	api.POST("/workflows/:workflow_id/start", startWorkflowHandler)
+	api.POST("/workflows/:workflow_id/complete", completeWorkflowHandler)
+	api.POST("/workflows/:workflow_id/fail", failWorkflowHandler)
+	api.POST("/workflows/:workflow_id/booking", bookingDecisionHandler)
+	api.POST("/workflows/:workflow_id/execute-step", executeStepHandler)
+	api.POST("/workflows/:workflow_id/steps/:step_index/cancel", cancelStepHandler)
+	api.POST("/workflows/:workflow_id/resume", resumeWorkflowHandler)
+	api.POST("/workflows/:workflow_id/archive", archiveWorkflowHandler)
+	api.POST("/workflows/:workflow_id/restore", restoreWorkflowHandler)
+	api.DELETE("/workflows/:workflow_id", deleteWorkflowHandler)
+
+	storage := api.Group("/admin/storage", requireAdmin)
+	storage.GET("/keys", listRedisKeysHandler)
+	storage.GET("/keys/*key", getRedisKeyHandler)
+	storage.PUT("/keys/*key", putRedisKeyHandler)
+	storage.DELETE("/keys/*key", deleteRedisKeyHandler)
+	storage.GET("/audit", storageAuditHandler)
+}
@@ -0,0 +1,880 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"platform"
+	"platform/redistest"
+	"workflow-service/deviceapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+func TestSetStepResult(t *testing.T) {
+	var workflow Workflow
+	workflow.setStepResult(StepResult{StepIndex: 2, Step: "read", Status: "completed"})
+	workflow.setStepResult(StepResult{StepIndex: 0, Step: "aspirate", Status: "completed"})
+	workflow.setStepResult(StepResult{
+		StepIndex: 2,
+		Step:      "read",
+		Status:    "completed",
+		Result:    map[string]interface{}{"A1": 0.42},
+	})
+
+	if len(workflow.StepResults) != 2 {
+		t.Fatalf("got %d step results, want 2", len(workflow.StepResults))
+	}
+	if workflow.StepResults[0].StepIndex != 0 || workflow.StepResults[1].StepIndex != 2 {
+		t.Errorf("step results not in step order: %+v", workflow.StepResults)
+	}
+	if got := workflow.StepResults[1].Result["A1"]; got != 0.42 {
+		t.Errorf("running step 2 again left result %v, want 0.42", got)
+	}
+}
+
+func TestStepResult(t *testing.T) {
+	var workflow Workflow
+	workflow.setStepResult(StepResult{StepIndex: 1, Step: "read", Status: "completed"})
+
+	if result := workflow.stepResult(1); result == nil || result.Step != "read" {
+		t.Errorf("got %+v for step 1, want its result", result)
+	}
+	if result := workflow.stepResult(0); result != nil {
+		t.Errorf("got %+v for step 0, which hasn't run", result)
+	}
+}
+
+func TestStepResultsReturnedWithWorkflow(t *testing.T) {
+	var workflow Workflow
+	workflow.setStepResult(StepResult{
+		StepIndex:   0,
+		Step:        "read",
+		OperationID: "op-1",
+		Status:      "completed",
+		Result:      map[string]interface{}{"A1": 0.42},
+	})
+
+	data, err := json.Marshal(workflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Workflow
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.StepResults) != 1 || decoded.StepResults[0].OperationID != "op-1" || decoded.StepResults[0].Result["A1"] != 0.42 {
+		t.Errorf("step results did not survive storage: %s", data)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	workflow := Workflow{
+		ID:        "wf-1",
+		DeviceID:  "liquid-handler-1",
+		Status:    StatusRunning,
+		QueuedAt:  "2024-01-01T10:00:00Z",
+		StartedAt: "2024-01-01T10:05:00Z",
+	}
+	workflow.setStepResult(StepResult{StepIndex: 0, Step: "aspirate", Status: "completed", StartedAt: "2024-01-01T10:05:00Z", ExecutedAt: "2024-01-01T10:06:00Z"})
+	// Saved before step starts were recorded
+	workflow.setStepResult(StepResult{StepIndex: 1, Step: "dispense", Status: "completed", ExecutedAt: "2024-01-01T10:08:00Z"})
+	workflow.setStepResult(StepResult{StepIndex: 2, Step: "mix", Status: "completed", StartedAt: "2024-01-01T10:10:00Z", ExecutedAt: "2024-01-01T10:11:00Z"})
+
+	timeline := workflow.timeline(parseTime("2024-01-01T10:15:00Z"))
+	want := []struct {
+		kind, start, end string
+		open             bool
+	}{
+		{IntervalQueued, "2024-01-01T10:00:00Z", "2024-01-01T10:05:00Z", false},
+		{IntervalStep, "2024-01-01T10:05:00Z", "2024-01-01T10:06:00Z", false},
+		{IntervalStep, "2024-01-01T10:06:00Z", "2024-01-01T10:08:00Z", false},
+		{IntervalIdle, "2024-01-01T10:08:00Z", "2024-01-01T10:10:00Z", false},
+		{IntervalStep, "2024-01-01T10:10:00Z", "2024-01-01T10:11:00Z", false},
+		{IntervalIdle, "2024-01-01T10:11:00Z", "2024-01-01T10:15:00Z", true},
+	}
+	if len(timeline.Intervals) != len(want) {
+		t.Fatalf("got %d intervals, want %d: %+v", len(timeline.Intervals), len(want), timeline.Intervals)
+	}
+	for i, w := range want {
+		got := timeline.Intervals[i]
+		if got.Kind != w.kind || got.Start != w.start || got.End != w.end || got.Open != w.open {
+			t.Errorf("interval %d is %+v, want %+v", i, got, w)
+		}
+	}
+	if !timeline.Intervals[2].Approximate {
+		t.Error("the step without a start should be approximate")
+	}
+	if timeline.DurationMS != 15*60*1000 {
+		t.Errorf("got a duration of %dms, want 15 minutes", timeline.DurationMS)
+	}
+}
+
+func TestTimelineLeavesPausesOutOfIdle(t *testing.T) {
+	workflow := Workflow{
+		ID:        "wf-1",
+		DeviceID:  "liquid-handler-1",
+		Status:    StatusPaused,
+		StartedAt: "2024-01-01T10:00:00Z",
+		Pauses: []Pause{
+			{PausedAt: "2024-01-01T10:02:00Z", ResumedAt: "2024-01-01T10:03:00Z", Reason: "Step 0 (aspirate) cancelled"},
+			{PausedAt: "2024-01-01T10:06:00Z"},
+		},
+	}
+	workflow.setStepResult(StepResult{StepIndex: 0, Step: "aspirate", Status: StepCancelled, StartedAt: "2024-01-01T10:01:00Z", ExecutedAt: "2024-01-01T10:02:00Z"})
+	workflow.setStepResult(StepResult{StepIndex: 0, Step: "aspirate", Status: "completed", StartedAt: "2024-01-01T10:04:00Z", ExecutedAt: "2024-01-01T10:05:00Z"})
+
+	timeline := workflow.timeline(parseTime("2024-01-01T10:10:00Z"))
+	want := []struct {
+		kind, start, end string
+		open             bool
+	}{
+		{IntervalIdle, "2024-01-01T10:00:00Z", "2024-01-01T10:02:00Z", false},
+		{IntervalPaused, "2024-01-01T10:02:00Z", "2024-01-01T10:03:00Z", false},
+		{IntervalIdle, "2024-01-01T10:03:00Z", "2024-01-01T10:04:00Z", false},
+		{IntervalStep, "2024-01-01T10:04:00Z", "2024-01-01T10:05:00Z", false},
+		{IntervalIdle, "2024-01-01T10:05:00Z", "2024-01-01T10:06:00Z", false},
+		{IntervalPaused, "2024-01-01T10:06:00Z", "2024-01-01T10:10:00Z", true},
+	}
+	if len(timeline.Intervals) != len(want) {
+		t.Fatalf("got %d intervals, want %d: %+v", len(timeline.Intervals), len(want), timeline.Intervals)
+	}
+	for i, w := range want {
+		got := timeline.Intervals[i]
+		if got.Kind != w.kind || got.Start != w.start || got.End != w.end || got.Open != w.open {
+			t.Errorf("interval %d is %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestArchiveMatcher(t *testing.T) {
+	now := parseTime("2024-02-01T00:00:00Z")
+	old := Workflow{ID: "old", DeviceID: "plate-reader-1", Status: StatusCompleted, CompletedAt: "2024-01-01T00:00:00Z", Tags: []string{"validation-run"}}
+	recent := Workflow{ID: "recent", DeviceID: "liquid-handler-1", Status: StatusFailed, FailedAt: "2024-01-31T00:00:00Z"}
+	running := Workflow{ID: "running", DeviceID: "liquid-handler-1", Status: StatusRunning}
+
+	tests := []struct {
+		name string
+		req  ArchiveRequest
+		want []string
+	}{
+		{"every finished workflow", ArchiveRequest{}, []string{"old", "recent"}},
+		{"older than", ArchiveRequest{OlderThan: "168h"}, []string{"old"}},
+		{"finished before", ArchiveRequest{FinishedBefore: "2024-02-01T00:00:00Z"}, []string{"old", "recent"}},
+		{"status", ArchiveRequest{Status: StatusFailed}, []string{"recent"}},
+		{"device", ArchiveRequest{DeviceID: "plate-reader-1"}, []string{"old"}},
+		{"tag", ArchiveRequest{Tag: " Validation-Run "}, []string{"old"}},
+	}
+	for _, tt := range tests {
+		match, err := tt.req.matcher(now)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := []string{}
+		for _, w := range []Workflow{old, recent, running} {
+			if match(w) {
+				got = append(got, w.ID)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: matched %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := (ArchiveRequest{Status: StatusRunning}).matcher(now); err == nil {
+		t.Error("archiving running workflows should be refused")
+	}
+}
+
+func TestTrashedWorkflow(t *testing.T) {
+	for status, want := range map[WorkflowStatus]bool{
+		StatusCreated: true, StatusQueued: false, StatusRunning: false, StatusPaused: false, StatusCompleted: true, StatusFailed: true,
+	} {
+		if got := (Workflow{Status: status}).deletable(); got != want {
+			t.Errorf("%s workflow deletable: got %v, want %v", status, got, want)
+		}
+	}
+
+	workflow := Workflow{ID: "wf-1", DeletedAt: "2024-01-01T00:00:00Z"}
+	if got := workflow.purgeAfter(); got != "2024-01-31T00:00:00Z" {
+		t.Errorf("got purge_after %q, want 30 days after deletion", got)
+	}
+	defer func(retention time.Duration) { trashRetention = retention }(trashRetention)
+	trashRetention = 0
+	if got := workflow.purgeAfter(); got != "" {
+		t.Errorf("got purge_after %q with TRASH_RETENTION=0, want none", got)
+	}
+}
+
+func TestRecordedBody(t *testing.T) {
+	if got := string(recordedBody([]byte(`{"workflow_id":"wf-1"}`))); got != `{"workflow_id":"wf-1"}` {
+		t.Errorf("JSON body recorded as %s", got)
+	}
+	if got := string(recordedBody([]byte("Bad Gateway"))); got != `"Bad Gateway"` {
+		t.Errorf("text body recorded as %s", got)
+	}
+	if got := recordedBody(nil); got != nil {
+		t.Errorf("empty body recorded as %s", got)
+	}
+
+	long := []byte(`"` + strings.Repeat("x", maxRecordedBody) + `"`)
+	var text string
+	if err := json.Unmarshal(recordedBody(long), &text); err != nil {
+		t.Fatalf("long body isn't recorded as a string: %v", err)
+	}
+	if len(text) != maxRecordedBody+3 || !strings.HasSuffix(text, "...") {
+		t.Errorf("long body recorded with %d characters, want it cut at %d", len(text), maxRecordedBody)
+	}
+}
+
+func TestUpstreamError(t *testing.T) {
+	caller := Caller{RequestID: "req-1"}
+	details := map[string]interface{}{"error": "Device is not available", "code": "device_unavailable"}
+	body := upstreamError("Failed to book device", deviceServiceName, 409, details, caller)
+	want := UpstreamError{Service: deviceServiceName, Status: 409, Code: "device_unavailable", Error: "Device is not available", RequestID: "req-1"}
+	if body["code"] != "device_unavailable" || body["upstream"] != want {
+		t.Errorf("got code %v and upstream %+v, want the device service's", body["code"], body["upstream"])
+	}
+
+	body = upstreamError("Failed to execute step", deviceServiceName, 502, nil, caller)
+	if body["code"] != "upstream_error" {
+		t.Errorf("got code %v for an error without one, want upstream_error", body["code"])
+	}
+}
+
+func TestOwnsRedisKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"workflows":                              true,
+		"lab:lab-2:workflows":                    true,
+		"lab:lab-2:workflow:wf-1:running-step":   true,
+		"workflows:device:plate-reader-1:active": true,
+		"storage_audit:workflow-service":         true,
+		"sample:S1":                              false,
+		"lab:Bad Lab:workflows":                  false,
+		"device:plate-reader-1:status":           false,
+	} {
+		if got := ownsRedisKey(key); got != want {
+			t.Errorf("ownsRedisKey(%q) = %v, want %v", key, got, want)
+		}
+	}
+
+	if _, err := decodeRedisValue("hash", json.RawMessage(`{}`)); err == nil {
+		t.Error("empty hash accepted")
+	}
+	if _, err := decodeRedisValue("list", json.RawMessage(`"x"`)); err == nil {
+		t.Error("string accepted as a list")
+	}
+}
+
+func TestApplicableQuotas(t *testing.T) {
+	key := hashAPIKey("key-1")
+	quotas := map[string]Quota{
+		"lab:default":                {Scope: QuotaScopeLab, Subject: "default", MaxRunning: 5},
+		"project:*":                  {Scope: QuotaScopeProject, Subject: "*", MaxRunning: 2},
+		"project:pcr":                {Scope: QuotaScopeProject, Subject: "pcr", MaxCreatedPerDay: 10},
+		QuotaScopeAPIKey + ":" + key: {Scope: QuotaScopeAPIKey, Subject: key, MaxRunning: 1},
+	}
+
+	applied, counted := applicableQuotas(quotas, Workflow{Project: "pcr", CreatedByKey: key}.quotaSubjects())
+	if len(applied) != 3 || applied[1].Subject != "pcr" || counted[2].subject != key {
+		t.Errorf("got %+v for a workflow with its own quotas", applied)
+	}
+	applied, counted = applicableQuotas(quotas, Workflow{Lab: "lab-2", Project: "elisa"}.quotaSubjects())
+	if len(applied) != 1 || applied[0].Subject != "*" || counted[0].subject != "elisa" {
+		t.Errorf("got %+v, want the project * quota counted for elisa", applied)
+	}
+	if !counted[0].counts(Workflow{Project: "elisa"}) || counted[0].counts(Workflow{Project: "pcr"}) {
+		t.Error("project quota counts other projects' workflows")
+	}
+
+	for _, s := range []struct {
+		scope, subject string
+		want           bool
+	}{
+		{QuotaScopeLab, "default", true},
+		{QuotaScopeLab, "Bad Lab", false},
+		{QuotaScopeProject, "*", true},
+		{QuotaScopeAPIKey, key, true},
+		{QuotaScopeAPIKey, "key-1", false},
+		{"team", "a", false},
+	} {
+		if got := validQuotaSubject(s.scope, s.subject); got != s.want {
+			t.Errorf("validQuotaSubject(%q, %q) = %v, want %v", s.scope, s.subject, got, s.want)
+		}
+	}
+}
+
+func TestSimulateWorkflow(t *testing.T) {
+	var got struct {
+		Steps []struct {
+			Operation string                 `json:"operation"`
+			Params    map[string]interface{} `json:"params"`
+		} `json:"steps"`
+	}
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v"+API_VERSION+"/devices/liquid-handler-1/simulate" {
+			t.Errorf("simulated at %s", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"device_id": "liquid-handler-1", "ok": false, "total_duration_ms": 2000, "consumables_used": {}, "consumables_left": [],
+			"steps": [{"step_index": 0, "operation": "aspirate", "start_ms": 0, "duration_ms": 2000},
+				{"step_index": 1, "operation": "shake", "start_ms": 2000, "duration_ms": 0, "error": "Device can't run shake"}]}`))
+	}))
+	defer device.Close()
+	deviceAPIURL = device.URL
+	defer func() { deviceAPIURL = "" }()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/workflows/wf-1/start?simulate=true", nil)
+	simulateWorkflow(c, &Workflow{
+		ID:         "wf-1",
+		DeviceID:   "liquid-handler-1",
+		Steps:      []string{"aspirate", "shake"},
+		StepParams: []map[string]interface{}{{"volume": 10.0, "well": "A1"}},
+	})
+
+	var simulation WorkflowSimulation
+	json.Unmarshal(w.Body.Bytes(), &simulation)
+	if w.Code != http.StatusOK || simulation.OK || !simulation.Simulated {
+		t.Fatalf("got %d %s, want a simulation that isn't ok", w.Code, w.Body.String())
+	}
+	if len(got.Steps) != 2 || got.Steps[0].Params["well"] != "A1" || got.Steps[1].Operation != "shake" {
+		t.Errorf("device got steps %+v", got.Steps)
+	}
+	if len(simulation.Issues) != 1 || !strings.Contains(simulation.Issues[0], "Step 1 (shake)") {
+		t.Errorf("got issues %v, want the shake step's", simulation.Issues)
+	}
+}
+
+func TestPlanSchedule(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse(time.RFC3339, "2024-01-01T"+clock+":00Z")
+		return t
+	}
+	devices := map[string]*deviceTimeline{
+		// Booked until 09:30, and reserved for another workflow 10:00-11:00.
+		"liquid-handler-1": {freeAt: []time.Time{at("09:30")}, held: []heldWindow{{start: at("10:00"), end: at("11:00"), workflowID: "wf-other"}}},
+		"incubator-1":      {freeAt: []time.Time{at("09:00"), at("09:00")}},
+	}
+	jobs := []estimateJob{
+		{workflow: Workflow{ID: "old", DeviceID: "liquid-handler-1", Status: StatusCreated, CreatedAt: "2024-01-01T08:00:00Z"}, duration: 30 * time.Minute},
+		{workflow: Workflow{ID: "urgent", DeviceID: "liquid-handler-1", Status: StatusCreated, Priority: 50, CreatedAt: "2024-01-01T08:30:00Z"}, duration: 45 * time.Minute},
+		{workflow: Workflow{ID: "queued", DeviceID: "liquid-handler-1", Status: StatusQueued, QueuedAt: "2024-01-01T08:45:00Z"}, duration: 20 * time.Minute},
+		{workflow: Workflow{ID: "incubate-1", DeviceID: "incubator-1", Status: StatusCreated, CreatedAt: "2024-01-01T08:00:00Z"}, duration: time.Hour},
+		{workflow: Workflow{ID: "incubate-2", DeviceID: "incubator-1", Status: StatusCreated, CreatedAt: "2024-01-01T08:10:00Z"}, duration: time.Hour},
+	}
+
+	runs := planSchedule(jobs, devices, at("09:00"))
+	got := map[string]EstimatedRun{}
+	for _, run := range runs {
+		got[run.WorkflowID] = run
+	}
+	want := map[string][2]string{
+		"queued": {"09:30", "09:50"},
+		// Too long to fit before the reservation.
+		"urgent":     {"11:00", "11:45"},
+		"old":        {"11:45", "12:15"},
+		"incubate-1": {"09:00", "10:00"},
+		"incubate-2": {"09:00", "10:00"},
+	}
+	for id, times := range want {
+		if run := got[id]; run.Start != at(times[0]).Format(time.RFC3339) || run.End != at(times[1]).Format(time.RFC3339) {
+			t.Errorf("%s runs %s to %s, want %s to %s", id, run.Start, run.End, times[0], times[1])
+		}
+	}
+	if got["incubate-1"].Slot == got["incubate-2"].Slot {
+		t.Errorf("both incubations on slot %d", got["incubate-1"].Slot)
+	}
+	for i := 1; i < len(runs); i++ {
+		if runs[i].Start < runs[i-1].Start {
+			t.Errorf("runs not in start order: %+v", runs)
+		}
+	}
+}
+
+func TestPlanDispatch(t *testing.T) {
+	now := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	devices := map[string]*schedulerDevice{
+		"liquid-handler-1": {ID: "liquid-handler-1", Type: "liquid_handler", Capabilities: []string{"aspirate", "dispense"}},
+		"liquid-handler-2": {ID: "liquid-handler-2", Type: "liquid_handler", Capabilities: []string{"aspirate", "dispense"}, Free: 1},
+		"liquid-handler-3": {ID: "liquid-handler-3", Type: "liquid_handler", Capabilities: []string{"aspirate"}, Free: 1},
+		// Reserved by another workflow from 09:10, within its average booking.
+		"incubator-1": {ID: "incubator-1", Type: "incubator", Free: 1, AvgBooking: 30 * time.Minute,
+			Reservations: []heldWindow{{start: now.Add(10 * time.Minute), end: now.Add(time.Hour), workflowID: "wf-other"}}},
+		"incubator-2": {ID: "incubator-2", Type: "incubator", Free: 1, AvgBooking: 30 * time.Minute,
+			Reservations: []heldWindow{{start: now.Add(2 * time.Hour), end: now.Add(3 * time.Hour), workflowID: "reserved"}}},
+	}
+	workflows := []Workflow{
+		{ID: "low", DeviceID: "liquid-handler-2", CreatedAt: "2024-01-01T07:00:00Z"},
+		// Its device is busy, and liquid-handler-3 can't dispense.
+		{ID: "pooled", DeviceID: "liquid-handler-1", Pool: true, Priority: 10, Steps: []string{"aspirate", "dispense"}, CreatedAt: "2024-01-01T08:00:00Z"},
+		{ID: "incubate", DeviceID: "incubator-1", CreatedAt: "2024-01-01T08:00:00Z"},
+		{ID: "reserved", DeviceID: "incubator-2", Priority: 50, CreatedAt: "2024-01-01T08:00:00Z"},
+		{ID: "walk-up", DeviceID: "incubator-2", CreatedAt: "2024-01-01T08:30:00Z"},
+	}
+
+	got := map[string]string{}
+	for _, target := range planDispatch(workflows, devices, now) {
+		got[target.workflow.ID] = target.deviceID
+	}
+	want := map[string]string{"pooled": "liquid-handler-2", "walk-up": "incubator-2"}
+	if len(got) != len(want) {
+		t.Fatalf("dispatched %v, want %v", got, want)
+	}
+	for id, deviceID := range want {
+		if got[id] != deviceID {
+			t.Errorf("%s dispatched to %q, want %q", id, got[id], deviceID)
+		}
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	workflow := &Workflow{
+		ID:          "wf-1",
+		Name:        "PCR <Setup>",
+		DeviceID:    "liquid-handler-1",
+		Steps:       []string{"aspirate", "dispense", "shake"},
+		StepParams:  []map[string]interface{}{{"volume_ul": 10.0}},
+		Status:      StatusCompleted,
+		CreatedAt:   "2024-01-01T09:00:00Z",
+		CreatedBy:   "alice",
+		StartedAt:   "2024-01-01T10:00:00Z",
+		StartedBy:   "scheduler",
+		CompletedAt: "2024-01-01T10:30:00Z",
+		Pauses:      []Pause{{PausedAt: "2024-01-01T10:05:00Z", PausedBy: "bob", Reason: "Tip jammed", ResumedAt: "2024-01-01T10:10:00Z"}},
+	}
+	workflow.setStepResult(StepResult{StepIndex: 0, Step: "aspirate", Status: "completed", StartedAt: "2024-01-01T10:00:00Z", ExecutedAt: "2024-01-01T10:02:00Z"})
+	workflow.setStepResult(StepResult{StepIndex: 1, Step: "dispense", Status: "cancelled", ExecutedAt: "2024-01-01T10:05:00Z", Result: map[string]interface{}{"A1": 0.42}})
+
+	report := newRunReport(workflow, nil, nil, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC))
+	deviations := strings.Join(report.Deviations, "\n")
+	for _, want := range []string{"Step 1 (dispense) was cancelled", "Step 1 (dispense): start not recorded", "Step 2 (shake) did not run", "Tip jammed"} {
+		if !strings.Contains(deviations, want) {
+			t.Errorf("deviations %q don't mention %q", deviations, want)
+		}
+	}
+	if report.Steps[0].Duration != "2m0s" || report.Steps[0].Params != `{"volume_ul":10}` {
+		t.Errorf("got step 0 %+v", report.Steps[0])
+	}
+
+	page, err := report.html()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(page), "PCR &lt;Setup&gt;") || !strings.Contains(string(page), `{&#34;A1&#34;:0.42}`) {
+		t.Errorf("HTML report doesn't show the escaped name and step result:\n%s", page)
+	}
+
+	pdf := string(report.pdf())
+	if !strings.HasPrefix(pdf, "%PDF-1.4\n") || !strings.HasSuffix(pdf, "%%EOF\n") {
+		t.Fatalf("not a PDF: %q", pdf)
+	}
+	// The cross-reference table must point at each object.
+	xref := strings.Index(pdf, "xref\n")
+	for i, line := range strings.Split(pdf[xref:], "\n")[3:] {
+		if !strings.HasSuffix(line, " n ") {
+			break
+		}
+		var offset int
+		fmt.Sscanf(line, "%d", &offset)
+		if !strings.HasPrefix(pdf[offset:], fmt.Sprintf("%d 0 obj", i+1)) {
+			t.Errorf("xref entry %d points at %q", i+1, pdf[offset:offset+10])
+		}
+	}
+	if !strings.Contains(pdf, `(Run report: PCR <Setup>)`) {
+		t.Errorf("PDF doesn't show the workflow's name")
+	}
+}
+
+func TestWriteWorkflowExport(t *testing.T) {
+	done := Workflow{
+		ID:          "wf-1",
+		Name:        "PCR, plate 1",
+		DeviceID:    "liquid-handler-1",
+		Steps:       []string{"aspirate", "dispense"},
+		StepParams:  []map[string]interface{}{{"volume_ul": 10.0}},
+		Status:      StatusCompleted,
+		Tags:        []string{"nightly", "pcr"},
+		CreatedAt:   "2024-01-01T09:00:00Z",
+		StartedAt:   "2024-01-01T10:00:00Z",
+		CompletedAt: "2024-01-01T10:30:00Z",
+	}
+	done.setStepResult(StepResult{StepIndex: 0, Step: "aspirate", Status: "completed", StartedAt: "2024-01-01T10:00:00Z", ExecutedAt: "2024-01-01T10:00:05Z"})
+	done.setStepResult(StepResult{StepIndex: 1, Step: "dispense", Status: "completed", ExecutedAt: "2024-01-01T10:01:00Z", Result: map[string]interface{}{"A1": 0.42}})
+	created := Workflow{ID: "wf-2", Name: "Later", DeviceID: "incubator-1", Status: StatusCreated, CreatedAt: "2024-01-02T09:00:00Z"}
+
+	finishedAfter, _ := time.Parse(time.RFC3339, "2024-01-01T00:00:00Z")
+	filter := ExportFilter{FinishedAfter: finishedAfter, Tag: "pcr"}
+	if !filter.matches(done) || filter.matches(created) {
+		t.Errorf("finished_after and tag matched the wrong workflows")
+	}
+
+	var out strings.Builder
+	count, err := writeWorkflowExport(&out, func() {}, []Workflow{done, created}, "csv", ExportWorkflows)
+	if err != nil || count != 2 {
+		t.Fatalf("wrote %d workflows, err %v", count, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id,name,") || !strings.HasPrefix(lines[1], `wf-1,"PCR, plate 1",`) || !strings.Contains(lines[1], ",nightly;pcr,") || !strings.Contains(lines[1], ",1800000,") {
+		t.Errorf("got CSV:\n%s", out.String())
+	}
+
+	out.Reset()
+	count, err = writeWorkflowExport(&out, func() {}, []Workflow{done, created}, "jsonl", ExportSteps)
+	if err != nil || count != 2 {
+		t.Fatalf("wrote %d steps, err %v", count, err)
+	}
+	var steps []ExportedStep
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var step ExportedStep
+		if err := json.Unmarshal([]byte(line), &step); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		steps = append(steps, step)
+	}
+	if steps[0].WorkflowID != "wf-1" || steps[0].DurationMs == nil || *steps[0].DurationMs != 5000 || steps[0].Params["volume_ul"] != 10.0 {
+		t.Errorf("got first step %+v", steps[0])
+	}
+	if steps[1].DurationMs != nil || steps[1].Result["A1"] != 0.42 {
+		t.Errorf("got second step %+v", steps[1])
+	}
+}
+
+func TestLimitRequestBodies(t *testing.T) {
+	defer func(limit, bulkLimit int64) { maxRequestBytes, maxBulkRequestBytes = limit, bulkLimit }(maxRequestBytes, maxBulkRequestBytes)
+	maxRequestBytes, maxBulkRequestBytes = 100, 256
+	defer func() { binding.EnableDecoderDisallowUnknownFields = false }()
+
+	router := gin.New()
+	router.Use(limitRequestBodies())
+	bind := func(c *gin.Context) {
+		var req FailWorkflowRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, req)
+	}
+	router.POST("/v1/workflows/:workflow_id/fail", bind)
+	router.POST("/v1/workflows/snapshot", bind)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := post("/v1/workflows/wf-1/fail", `{"reason": "refill tips"}`); w.Code != http.StatusOK {
+		t.Errorf("got %d %s for a small body", w.Code, w.Body.String())
+	}
+	large := `{"reason": "` + strings.Repeat("x", 100) + `"}`
+	if w := post("/v1/workflows/wf-1/fail", large); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %d for a body over the limit, want 413", w.Code)
+	}
+	if w := post("/v1/workflows/snapshot", large); w.Code != http.StatusOK {
+		t.Errorf("got %d %s for a bulk route under its limit", w.Code, w.Body.String())
+	}
+	deep := strings.Repeat("[", 40) + strings.Repeat("]", 40)
+	if w := post("/v1/workflows/wf-1/fail", deep); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "levels deep") {
+		t.Errorf("got %d %s for deeply nested JSON, want 400", w.Code, w.Body.String())
+	}
+	if w := post("/v1/workflows/wf-1/fail", `{"reason": "[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[["}`); w.Code != http.StatusOK {
+		t.Errorf("got %d %s for brackets inside a string", w.Code, w.Body.String())
+	}
+
+	binding.EnableDecoderDisallowUnknownFields = true
+	if w := post("/v1/workflows/wf-1/fail", `{"reason": "x", "resaon": "y"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for an unknown field with strict JSON, want 400", w.Code)
+	}
+}
+
+// startWorkflowRedis serves a fake Redis holding workflows, running the
+// device claim script.
+func startWorkflowRedis(t *testing.T, workflows ...Workflow) *redistest.Server {
+	r := startFakeRedis(t)
+	r.Script(claimDeviceScript, func(keys, args []string) interface{} {
+		if _, ok := r.Hashes[keys[0]][args[0]]; ok {
+			return 1
+		}
+		if capacity, _ := strconv.Atoi(args[2]); len(r.Hashes[keys[0]]) >= capacity {
+			return 0
+		}
+		if r.Hashes[keys[0]] == nil {
+			r.Hashes[keys[0]] = map[string]string{}
+		}
+		r.Hashes[keys[0]][args[0]] = args[1]
+		return 1
+	})
+	stored := map[string]Workflow{}
+	for _, workflow := range workflows {
+		stored[workflow.ID] = workflow
+	}
+	if err := saveWorkflows("", stored); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// deviceCall is a call a fake device service got.
+type deviceCall struct {
+	Method, Path string
+	Body         map[string]interface{}
+}
+
+// startDeviceService serves a fake device service until the test ends,
+// answering calls with respond and recording them. Devices have one slot.
+func startDeviceService(t *testing.T, respond func(call deviceCall) (int, string)) *[]deviceCall {
+	var mu sync.Mutex
+	calls := &[]deviceCall{}
+	device := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := deviceCall{Method: r.Method, Path: r.URL.Path}
+		json.NewDecoder(r.Body).Decode(&call.Body)
+		mu.Lock()
+		*calls = append(*calls, call)
+		mu.Unlock()
+		status, body := http.StatusOK, `{"capacity": 1}`
+		if r.Method != http.MethodGet {
+			status, body = respond(call)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	deviceAPIURL = device.URL
+	t.Cleanup(func() {
+		device.Close()
+		deviceAPIURL = ""
+	})
+	return calls
+}
+
+func testRouter() *gin.Engine {
+	router := gin.New()
+	registerRoutes(router.Group("/v" + API_VERSION))
+	return router
+}
+
+// postWorkflow POSTs body to a workflow's action as the operator alice.
+func postWorkflow(router http.Handler, workflowID, action, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/v"+API_VERSION+"/workflows/"+workflowID+"/"+action, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ACTOR_HEADER, "alice")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestStartExecuteAndCompleteWorkflow(t *testing.T) {
+	startWorkflowRedis(t, Workflow{ID: "wf-1", DeviceID: "liquid-handler-1", Steps: []string{"aspirate"}, Status: StatusCreated})
+	calls := startDeviceService(t, func(call deviceCall) (int, string) {
+		switch call.Path {
+		case "/v1/devices/liquid-handler-1/book":
+			return http.StatusOK, `{"device_id": "liquid-handler-1", "status": "busy", "workflow_id": "wf-1"}`
+		case "/v1/devices/liquid-handler-1/execute":
+			return http.StatusOK, `{"device_id": "liquid-handler-1", "operation": "aspirate", "operation_id": "op-1", "status": "completed", "result": {"volume": 10}}`
+		case "/v1/devices/liquid-handler-1/release":
+			return http.StatusOK, `{"device_id": "liquid-handler-1", "status": "available"}`
+		}
+		return http.StatusNotFound, `{"error": "Not found"}`
+	})
+	router := testRouter()
+
+	w := postWorkflow(router, "wf-1", "start", "")
+	var workflow Workflow
+	json.Unmarshal(w.Body.Bytes(), &workflow)
+	if w.Code != http.StatusOK || workflow.Status != StatusRunning || workflow.StartedBy != "alice" {
+		t.Fatalf("start got %d %s, want the workflow running", w.Code, w.Body.String())
+	}
+
+	w = postWorkflow(router, "wf-1", "execute-step", `{"step_index": 0, "attempt_token": "try-1"}`)
+	var executed struct {
+		Result deviceapi.ExecuteResponse `json:"result"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &executed)
+	if w.Code != http.StatusOK || executed.Result.OperationID != "op-1" || executed.Result.Result["volume"] != 10.0 {
+		t.Fatalf("execute-step got %d %s, want op-1's result", w.Code, w.Body.String())
+	}
+
+	w = postWorkflow(router, "wf-1", "complete", "")
+	json.Unmarshal(w.Body.Bytes(), &workflow)
+	if w.Code != http.StatusOK || workflow.Status != StatusCompleted || len(workflow.StepResults) != 1 {
+		t.Fatalf("complete got %d %s, want the workflow completed with its step result", w.Code, w.Body.String())
+	}
+
+	var posted []deviceCall
+	for _, call := range *calls {
+		if call.Method == http.MethodPost {
+			posted = append(posted, call)
+		}
+	}
+	want := []string{"/v1/devices/liquid-handler-1/book", "/v1/devices/liquid-handler-1/execute", "/v1/devices/liquid-handler-1/release"}
+	if len(posted) != len(want) {
+		t.Fatalf("device service got %+v, want calls to %v", posted, want)
+	}
+	for i, call := range posted {
+		if call.Path != want[i] || call.Body["workflow_id"] != "wf-1" {
+			t.Errorf("call %d went to %s with %v, want %s for wf-1", i, call.Path, call.Body, want[i])
+		}
+	}
+}
+
+func TestStartWorkflowPassesOnBookingRefusal(t *testing.T) {
+	startWorkflowRedis(t, Workflow{ID: "wf-1", DeviceID: "liquid-handler-1", Status: StatusCreated})
+	startDeviceService(t, func(call deviceCall) (int, string) {
+		return http.StatusConflict, `{"error": "Device is not available", "code": "device_unavailable"}`
+	})
+
+	w := postWorkflow(testRouter(), "wf-1", "start", "")
+	var body struct {
+		Code     string        `json:"code"`
+		Upstream UpstreamError `json:"upstream"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusConflict || body.Code != "device_unavailable" || body.Upstream.Status != http.StatusConflict {
+		t.Fatalf("got %d %s, want the device service's 409", w.Code, w.Body.String())
+	}
+	workflow, _ := getWorkflow("", "wf-1")
+	if workflow.Status != StatusCreated {
+		t.Errorf("workflow is %s, want it still created", workflow.Status)
+	}
+}
+
+func TestStartWorkflowQueuesForBusyDevice(t *testing.T) {
+	platform.FeatureFlagOverrides[QUEUEING_FLAG] = true
+	defer delete(platform.FeatureFlagOverrides, QUEUEING_FLAG)
+	r := startWorkflowRedis(t,
+		Workflow{ID: "wf-running", DeviceID: "liquid-handler-1", Status: StatusRunning},
+		Workflow{ID: "wf-1", DeviceID: "liquid-handler-1", Status: StatusCreated, Project: "assays", Priority: 5},
+	)
+	r.Hashes[activeWorkflowsKey("liquid-handler-1")] = map[string]string{"wf-running": ""}
+	calls := startDeviceService(t, func(call deviceCall) (int, string) {
+		return http.StatusAccepted, `{"device_id": "liquid-handler-1", "workflow_id": "wf-1", "status": "queued", "position": 1}`
+	})
+	router := testRouter()
+
+	w := postWorkflow(router, "wf-1", "start", "")
+	var workflow Workflow
+	json.Unmarshal(w.Body.Bytes(), &workflow)
+	if w.Code != http.StatusAccepted || workflow.Status != StatusQueued || workflow.QueuedAt == "" {
+		t.Fatalf("start got %d %s, want the workflow queued", w.Code, w.Body.String())
+	}
+	book := (*calls)[len(*calls)-1]
+	if book.Path != "/v1/devices/liquid-handler-1/book" || book.Body["queue"] != true || book.Body["project"] != "assays" || book.Body["priority"] != 5.0 {
+		t.Errorf("booked at %s with %v, want a queued booking for project assays at priority 5", book.Path, book.Body)
+	}
+
+	// The running workflow finishes and the device service grants wf-1 the
+	// device.
+	releaseDeviceClaim("liquid-handler-1", "wf-running")
+	w = postWorkflow(router, "wf-1", "booking", `{"device_id": "liquid-handler-1", "granted": true}`)
+	json.Unmarshal(w.Body.Bytes(), &workflow)
+	if w.Code != http.StatusOK || workflow.Status != StatusRunning {
+		t.Fatalf("booking got %d %s, want the workflow running", w.Code, w.Body.String())
+	}
+	if _, ok := r.Hashes[activeWorkflowsKey("liquid-handler-1")]["wf-1"]; !ok {
+		t.Errorf("wf-1 doesn't hold the device")
+	}
+}
+
+func TestStartWorkflowRefusedByDevice(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		requirements *Requirements
+		code         string
+	}{
+		{"firmware", &Requirements{MinFirmwareVersion: "2.0.0", ProtocolVersion: "v2"}, "firmware_outdated"},
+		{"reservation", nil, "device_reserved"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			r := startWorkflowRedis(t, Workflow{ID: "wf-1", DeviceID: "liquid-handler-1", Status: StatusCreated, Requirements: test.requirements})
+			calls := startDeviceService(t, func(call deviceCall) (int, string) {
+				return http.StatusConflict, `{"error": "Refused", "code": "` + test.code + `"}`
+			})
+
+			w := postWorkflow(testRouter(), "wf-1", "start", "")
+			var body struct {
+				Code string `json:"code"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if w.Code != http.StatusConflict || body.Code != test.code {
+				t.Fatalf("got %d %s, want 409 %s", w.Code, w.Body.String(), test.code)
+			}
+			if test.requirements != nil {
+				book := (*calls)[len(*calls)-1]
+				if book.Body["min_firmware_version"] != "2.0.0" || book.Body["protocol_version"] != "v2" {
+					t.Errorf("booked with %v, want the workflow's requirements", book.Body)
+				}
+			}
+			if active := r.Hashes[activeWorkflowsKey("liquid-handler-1")]; len(active) != 0 {
+				t.Errorf("device still claimed by %v", active)
+			}
+			if workflow, _ := getWorkflow("", "wf-1"); workflow.Status != StatusCreated {
+				t.Errorf("workflow is %s, want it still created", workflow.Status)
+			}
+		})
+	}
+}
+
+func TestStartWorkflowOverQuota(t *testing.T) {
+	r := startWorkflowRedis(t,
+		Workflow{ID: "wf-running", DeviceID: "incubator-1", Status: StatusRunning, Project: "assays"},
+		Workflow{ID: "wf-1", DeviceID: "liquid-handler-1", Status: StatusCreated, Project: "assays"},
+	)
+	r.Hashes[QUOTAS_KEY] = map[string]string{"project:assays": `{"scope": "project", "subject": "assays", "max_running": 1}`}
+	calls := startDeviceService(t, func(call deviceCall) (int, string) {
+		return http.StatusOK, `{"device_id": "liquid-handler-1", "status": "busy", "workflow_id": "wf-1"}`
+	})
+
+	w := postWorkflow(testRouter(), "wf-1", "start", "")
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusTooManyRequests || body.Code != ErrorCodeQuotaExceeded {
+		t.Fatalf("got %d %s, want 429 %s", w.Code, w.Body.String(), ErrorCodeQuotaExceeded)
+	}
+	if len(*calls) != 0 {
+		t.Errorf("device service called %+v over quota", *calls)
+	}
+}
+
+func TestDispatchToPoolPeer(t *testing.T) {
+	workflow := Workflow{ID: "wf-1", DeviceID: "liquid-handler-1", Pool: true, Status: StatusCreated}
+	startWorkflowRedis(t, workflow, Workflow{ID: "wf-2", DeviceID: "liquid-handler-1", Pool: true, Status: StatusCreated})
+	calls := startDeviceService(t, func(call deviceCall) (int, string) {
+		if call.Body["workflow_id"] == "wf-2" {
+			return http.StatusConflict, `{"error": "Device is not available", "code": "device_unavailable"}`
+		}
+		return http.StatusOK, `{"device_id": "liquid-handler-2", "status": "busy", "workflow_id": "wf-1"}`
+	})
+	router := testRouter()
+
+	result := dispatch(router, "", dispatchTarget{workflow: workflow, deviceID: "liquid-handler-2"})
+	if result.Status != http.StatusOK || !result.Moved {
+		t.Fatalf("dispatch got %+v, want wf-1 moved and started", result)
+	}
+	if book := (*calls)[len(*calls)-1]; book.Path != "/v1/devices/liquid-handler-2/book" {
+		t.Errorf("booked at %s, want liquid-handler-2", book.Path)
+	}
+	if moved, _ := getWorkflow("", "wf-1"); moved.DeviceID != "liquid-handler-2" || moved.Status != StatusRunning {
+		t.Errorf("wf-1 is %s on %s, want running on liquid-handler-2", moved.Status, moved.DeviceID)
+	}
+
+	// A workflow that can't start on the peer is left on its own device.
+	result = dispatch(router, "", dispatchTarget{workflow: Workflow{ID: "wf-2", DeviceID: "liquid-handler-1", Pool: true}, deviceID: "liquid-handler-2"})
+	if result.Status != http.StatusConflict {
+		t.Fatalf("dispatch got %+v, want 409", result)
+	}
+	if left, _ := getWorkflow("", "wf-2"); left.DeviceID != "liquid-handler-1" || left.Status != StatusCreated {
+		t.Errorf("wf-2 is %s on %s, want created on liquid-handler-1", left.Status, left.DeviceID)
+	}
+}
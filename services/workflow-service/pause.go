@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"workflow-service/deviceapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StepCancelled is the status of a step whose operation was cancelled while
+// the device ran it.
+const StepCancelled = "cancelled"
+
+// Pause is a time a workflow was paused, waiting for an operator to resume
+// or fail it. ResumedAt is empty while it is still paused.
+type Pause struct {
+	PausedAt  string `json:"paused_at"`
+	PausedBy  string `json:"paused_by,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	ResumedAt string `json:"resumed_at,omitempty"`
+	ResumedBy string `json:"resumed_by,omitempty"`
+}
+
+type CancelStepRequest struct {
+	Reason string `json:"reason"`
+}
+
+// cancelStepHandler cancels the step a workflow's device is running: the
+// device service aborts the operation, the step is saved as cancelled and
+// the workflow is paused until an operator resumes or fails it. The call
+// running the step fails with 409.
+func cancelStepHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("step_index"))
+	if err != nil || index < 0 || index >= len(workflow.Steps) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid step index"})
+		return
+	}
+
+	var req CancelStepRequest
+	c.ShouldBindJSON(&req)
+
+	if workflow.Status != StatusRunning {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workflow is not running"})
+		return
+	}
+	attachRunningStep(c, workflow)
+	if workflow.RunningStep == nil || workflow.RunningStep.StepIndex != index {
+		c.JSON(http.StatusConflict, gin.H{"error": "Step is not running"})
+		return
+	}
+	running := workflow.RunningStep
+
+	log.Printf("Cancelling step %d of workflow %s: %s", index, workflowID, req.Reason)
+
+	caller := requestCaller(c)
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, caller.setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	_, err = client.AbortOperation(deviceCallContext(c.Request.Context(), requestLab(c), workflowID), workflow.DeviceID, deviceapi.AbortRequest{WorkflowID: workflowID, Reason: req.Reason})
+	var respErr *deviceapi.ResponseError
+	if errors.As(err, &respErr) {
+		var details map[string]interface{}
+		json.Unmarshal(respErr.Body, &details)
+		log.Printf("Failed to abort step %d of workflow %s on device %s: %v", index, workflowID, workflow.DeviceID, err)
+		c.JSON(respErr.StatusCode, upstreamError("Failed to cancel step", deviceServiceName, respErr.StatusCode, details, caller))
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, unreachableError(fmt.Sprintf("Failed to communicate with device service: %v", err), deviceServiceName, caller))
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	reason := fmt.Sprintf("Step %d (%s) cancelled", index, running.Step)
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+	workflow, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
+		"status": StatusPaused,
+		"step_result": StepResult{
+			StepIndex:  index,
+			Step:       running.Step,
+			Status:     StepCancelled,
+			StartedAt:  running.StartedAt,
+			ExecutedAt: now,
+			ExecutedBy: requestActor(c),
+		},
+		"pause": Pause{PausedAt: now, PausedBy: requestActor(c), Reason: reason},
+	})
+	if err != nil {
+		log.Printf("Error updating workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
+		return
+	}
+	clearRunningStep(requestLab(c), workflowID)
+
+	publishWorkflowEvent(WorkflowEventPaused, workflow, requestActor(c))
+	log.Printf("Workflow %s paused: %s", workflowID, reason)
+	c.JSON(http.StatusOK, workflow)
+}
+
+// resumeWorkflowHandler sets a paused workflow running again, so its steps
+// can be run, or it can be completed.
+func resumeWorkflowHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	if workflow.Status != StatusPaused {
+		c.JSON(http.StatusConflict, gin.H{"error": "Workflow is not paused"})
+		return
+	}
+
+	workflow, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
+		"status":     StatusRunning,
+		"resumed_at": time.Now().UTC().Format(time.RFC3339),
+		"resumed_by": requestActor(c),
+	})
+	if err != nil {
+		log.Printf("Error updating workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
+		return
+	}
+
+	publishWorkflowEvent(WorkflowEventResumed, workflow, requestActor(c))
+	log.Printf("Workflow %s resumed", workflowID)
+	c.JSON(http.StatusOK, workflow)
+}
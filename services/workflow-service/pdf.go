@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfDocument lays text out on A4 pages of a PDF, in Helvetica, wrapping
+// long lines and starting a new page when one is full. It is only what run
+// reports need: lines of text, no images or tables.
+type pdfDocument struct {
+	title string
+	pages []*bytes.Buffer
+	// y is where the next line's baseline goes on the last page.
+	y float64
+}
+
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+	pdfMargin     = 50.0
+	// pdfCharWidth is Helvetica's average character width, as a fraction
+	// of the font size, for wrapping lines.
+	pdfCharWidth = 0.5
+)
+
+func newPDFDocument(title string) *pdfDocument {
+	return &pdfDocument{title: title}
+}
+
+// pdfString escapes text for a PDF string in WinAnsiEncoding, replacing
+// characters it can't encode.
+func pdfString(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString("    ")
+		case r < 32 || r > 255:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
+
+// wrapText breaks text into lines of at most width characters, at spaces
+// where it can.
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for len(word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, word[:width])
+				word = word[width:]
+			}
+			switch {
+			case line == "":
+				line = word
+			case len(line)+1+len(word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// text adds a paragraph in the given font size, indented by indent points.
+func (d *pdfDocument) text(text string, size, indent float64, bold bool) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	width := int((pdfPageWidth - 2*pdfMargin - indent) / (size * pdfCharWidth))
+	for _, line := range wrapText(text, width) {
+		if len(d.pages) == 0 || d.y-size*1.3 < pdfMargin {
+			d.pages = append(d.pages, &bytes.Buffer{})
+			d.y = pdfPageHeight - pdfMargin
+		}
+		d.y -= size * 1.3
+		fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %g Tf %g %g Td (%s) Tj ET\n", font, size, pdfMargin+indent, d.y, pdfString(line))
+	}
+}
+
+// gap leaves space between paragraphs.
+func (d *pdfDocument) gap(points float64) {
+	d.y -= points
+}
+
+// bytes writes the document out: the catalog, the page tree, the two fonts
+// and the document info, then each page with its content stream, and the
+// cross-reference table.
+func (d *pdfDocument) bytes() []byte {
+	if len(d.pages) == 0 {
+		d.text("", 10, 0, false)
+	}
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title (%s) /Producer (workflow-service) >>", pdfString(d.title)))
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pdfPageWidth, pdfPageHeight, 7+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"workflow-service/deviceapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// runningStepTTL bounds how long a step is taken to be running, should the
+// service die while the device runs it.
+const runningStepTTL = time.Hour
+
+// RunningStep is the step a workflow's device is running now, with how far
+// the device says it has got.
+type RunningStep struct {
+	StepIndex         int    `json:"step_index"`
+	Step              string `json:"step"`
+	StartedAt         string `json:"started_at"`
+	ProgressPercent   int    `json:"progress_percent"`
+	CyclesCompleted   int    `json:"cycles_completed,omitempty"`
+	CyclesTotal       int    `json:"cycles_total,omitempty"`
+	ProgressUpdatedAt string `json:"progress_updated_at,omitempty"`
+}
+
+func runningStepKey(lab, workflowID string) string {
+	return labKey(lab, fmt.Sprintf("workflow:%s:running-step", workflowID))
+}
+
+// markStepRunning records the step as the one the workflow's device is
+// running, until clearRunningStep.
+func markStepRunning(lab, workflowID string, step RunningStep) {
+	data, _ := json.Marshal(step)
+	if err := redisClient.Set(ctx, runningStepKey(lab, workflowID), data, runningStepTTL).Err(); err != nil {
+		log.Printf("Error marking step %d of workflow %s running: %v", step.StepIndex, workflowID, err)
+	}
+}
+
+func clearRunningStep(lab, workflowID string) {
+	if err := redisClient.Del(ctx, runningStepKey(lab, workflowID)).Err(); err != nil {
+		log.Printf("Error clearing running step of workflow %s: %v", workflowID, err)
+	}
+}
+
+// attachRunningStep sets the workflow's running step, if its device is
+// running one, with the progress the device service reports for it. If the
+// device service can't say, the step is shown without progress.
+func attachRunningStep(c *gin.Context, workflow *Workflow) {
+	if workflow.Status != StatusRunning {
+		return
+	}
+	data, err := redisClient.Get(ctx, runningStepKey(workflow.Lab, workflow.ID)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			log.Printf("Error reading running step of workflow %s: %v", workflow.ID, err)
+		}
+		return
+	}
+	var step RunningStep
+	if err := json.Unmarshal(data, &step); err != nil {
+		log.Printf("Invalid running step of workflow %s: %v", workflow.ID, err)
+		return
+	}
+
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, requestCaller(c).setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	progress, err := client.GetDeviceProgress(c.Request.Context(), workflow.DeviceID, &deviceapi.GetDeviceProgressParams{WorkflowID: workflow.ID})
+	if err != nil {
+		log.Printf("Error getting progress of workflow %s on device %s: %v", workflow.ID, workflow.DeviceID, err)
+	} else if len(progress.Operations) > 0 {
+		operation := progress.Operations[0]
+		step.ProgressPercent = operation.ProgressPercent
+		step.CyclesCompleted, step.CyclesTotal = operation.CyclesCompleted, operation.CyclesTotal
+		step.ProgressUpdatedAt = operation.UpdatedAt
+	}
+	workflow.RunningStep = &step
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"workflow-service/deviceapi"
+)
+
+// QUEUEING_FLAG is the feature flag that lets a workflow started while its
+// device is busy wait for it, queued, rather than fail to start.
+const QUEUEING_FLAG = "queueing"
+
+// BOOKING_QUEUED is the status of a booking the device service queued,
+// answering 202, rather than granted.
+const BOOKING_QUEUED = "queued"
+
+// queueWorkflow marks a workflow queued for its device, which the device
+// service accepted a booking for; it starts when the device service grants
+// the booking.
+func queueWorkflow(c *gin.Context, workflowID string) {
+	workflow, err := updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
+		"status":     StatusQueued,
+		"queued_at":  time.Now().UTC().Format(time.RFC3339),
+		"started_by": requestActor(c),
+	})
+	if err != nil {
+		log.Printf("Error updating workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
+		return
+	}
+
+	publishWorkflowEvent(WorkflowEventQueued, workflow, workflow.StartedBy)
+	log.Printf("Workflow %s queued for device %s", workflowID, workflow.DeviceID)
+	c.JSON(http.StatusAccepted, workflow)
+}
+
+// bookingDecisionHandler is called by the device service when the queued
+// booking of a workflow's device is granted, starting the workflow, or
+// refused, failing it. Workflows no longer queued, or granted a device
+// already running other workflows, get 409, so the device service releases
+// the device again.
+func bookingDecisionHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	var req deviceapi.BookingDecision
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	if workflow.Status != StatusQueued || req.DeviceID != workflow.DeviceID {
+		log.Printf("Workflow %s is not waiting for device %s (status: %s)", workflowID, req.DeviceID, workflow.Status)
+		c.JSON(http.StatusConflict, gin.H{"error": "Workflow is not waiting for the device"})
+		return
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	failureReason := ""
+	if !req.Granted {
+		failureReason = fmt.Sprintf("Booking of device %s refused: %s", req.DeviceID, req.Error)
+	} else {
+		active, err := claimDevice(requestLab(c), req.DeviceID, workflowID, deviceCapacity(c, req.DeviceID, workflowID))
+		if err != nil {
+			log.Printf("Error claiming device %s for workflow %s: %v", req.DeviceID, workflowID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to claim device"})
+			return
+		}
+		if active != nil {
+			failureReason = fmt.Sprintf("Device %s was granted while already running workflows %v", req.DeviceID, active)
+		}
+	}
+	if failureReason != "" {
+		workflow, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
+			"status":         StatusFailed,
+			"failed_at":      now,
+			"failure_reason": failureReason,
+		})
+		if err != nil {
+			log.Printf("Error updating workflow: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
+			return
+		}
+		publishWorkflowEvent(WorkflowEventFailed, workflow, "")
+		log.Printf("Workflow %s failed: %s", workflowID, failureReason)
+		if req.Granted {
+			// 409 has the device service release the booking it granted.
+			c.JSON(http.StatusConflict, gin.H{"error": "Device already has an active workflow", "workflow": workflow})
+			return
+		}
+		c.JSON(http.StatusOK, workflow)
+		return
+	}
+
+	workflow, err = updateWorkflow(requestLab(c), workflowID, map[string]interface{}{
+		"status":     StatusRunning,
+		"started_at": now,
+	})
+	if err != nil {
+		releaseDeviceClaim(req.DeviceID, workflowID)
+		log.Printf("Error updating workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update workflow"})
+		return
+	}
+
+	publishWorkflowEvent(WorkflowEventStarted, workflow, workflow.StartedBy)
+	log.Printf("Workflow %s started on its queued booking of device %s", workflowID, req.DeviceID)
+	c.JSON(http.StatusOK, workflow)
+}
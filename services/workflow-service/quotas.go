@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Quotas cap how many workflows a lab, a project or an API key can have
+// running at once and create in a UTC day, so one team's bulk runs can't
+// take every instrument. They are kept in the hash workflows:quotas, by
+// <scope>:<subject>, and set by admins. A lab quota's subject is the lab,
+// "default" for the default lab; a project's is the project; an API key's
+// is the SHA-256 hex of the key, as the sample service lists it. A quota
+// for "*" applies to every subject of its scope without one of its own,
+// each counted on its own. Project and API key quotas are counted in the
+// lab the workflow is in. Workflows queued for their device or paused count
+// as running.
+const (
+	QUOTAS_KEY = "workflows:quotas"
+	// QUOTA_USAGE_KEY_FORMAT counts the workflows created by a scope's
+	// subject on a day, kept long enough to outlive the day.
+	QUOTA_USAGE_KEY_FORMAT = "workflows:quota-usage:%s:%s:%s"
+	quotaUsageTTL          = 48 * time.Hour
+
+	QuotaScopeLab     = "lab"
+	QuotaScopeProject = "project"
+	QuotaScopeAPIKey  = "api_key"
+
+	quotaAnySubject = "*"
+	defaultLabName  = "default"
+
+	// ErrorCodeQuotaExceeded is the code of a create or start refused by a
+	// quota.
+	ErrorCodeQuotaExceeded = "quota_exceeded"
+)
+
+var (
+	quotaScopes    = []string{QuotaScopeLab, QuotaScopeProject, QuotaScopeAPIKey}
+	projectPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	keyHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// Quota caps a subject's workflows; 0 leaves that count uncapped.
+type Quota struct {
+	Scope            string `json:"scope"`
+	Subject          string `json:"subject"`
+	MaxRunning       int    `json:"max_running,omitempty"`
+	MaxCreatedPerDay int    `json:"max_created_per_day,omitempty"`
+	UpdatedAt        string `json:"updated_at,omitempty"`
+	UpdatedBy        string `json:"updated_by,omitempty"`
+}
+
+// quotaSubject is who a workflow counts against in a scope.
+type quotaSubject struct {
+	scope, subject string
+}
+
+// hashAPIKey is how an API key is named in quotas and on workflows.
+func hashAPIKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func labName(lab string) string {
+	if lab == "" {
+		return defaultLabName
+	}
+	return lab
+}
+
+// validQuotaSubject reports whether subject can have a quota in scope.
+func validQuotaSubject(scope, subject string) bool {
+	if subject == quotaAnySubject {
+		return true
+	}
+	switch scope {
+	case QuotaScopeLab:
+		return subject == defaultLabName || labPattern.MatchString(subject)
+	case QuotaScopeProject:
+		return projectPattern.MatchString(subject)
+	case QuotaScopeAPIKey:
+		return keyHashPattern.MatchString(subject)
+	}
+	return false
+}
+
+// quotaSubjects are who the workflow counts against: its lab, its project
+// if it has one and the API key that created it if there was one.
+func (w Workflow) quotaSubjects() []quotaSubject {
+	subjects := []quotaSubject{{QuotaScopeLab, labName(w.Lab)}}
+	if w.Project != "" {
+		subjects = append(subjects, quotaSubject{QuotaScopeProject, w.Project})
+	}
+	if w.CreatedByKey != "" {
+		subjects = append(subjects, quotaSubject{QuotaScopeAPIKey, w.CreatedByKey})
+	}
+	return subjects
+}
+
+// counts reports whether the workflow counts against the subject.
+func (s quotaSubject) counts(w Workflow) bool {
+	switch s.scope {
+	case QuotaScopeProject:
+		return w.Project == s.subject
+	case QuotaScopeAPIKey:
+		return w.CreatedByKey == s.subject
+	}
+	return true
+}
+
+func getQuotas() (map[string]Quota, error) {
+	values, err := redisClient.HGetAll(ctx, QUOTAS_KEY).Result()
+	if err != nil {
+		return nil, err
+	}
+	quotas := make(map[string]Quota, len(values))
+	for field, data := range values {
+		var quota Quota
+		if err := json.Unmarshal([]byte(data), &quota); err != nil {
+			log.Printf("Invalid quota %s: %v", field, err)
+			continue
+		}
+		quotas[field] = quota
+	}
+	return quotas, nil
+}
+
+// applicableQuotas returns the quota each of the subjects has, its own or
+// its scope's "*" one, skipping those with none. Each comes with the
+// subject it is counted for.
+func applicableQuotas(quotas map[string]Quota, subjects []quotaSubject) ([]Quota, []quotaSubject) {
+	applied := []Quota{}
+	counted := []quotaSubject{}
+	for _, s := range subjects {
+		quota, ok := quotas[s.scope+":"+s.subject]
+		if !ok {
+			quota, ok = quotas[s.scope+":"+quotaAnySubject]
+		}
+		if ok {
+			applied = append(applied, quota)
+			counted = append(counted, s)
+		}
+	}
+	return applied, counted
+}
+
+// QuotaError refuses a create or start that would take a subject over its
+// quota.
+type QuotaError struct {
+	Quota   Quota
+	Subject string
+	Usage   int
+	Daily   bool
+}
+
+func (e *QuotaError) Error() string {
+	if e.Daily {
+		return fmt.Sprintf("Quota exceeded: %s %s has created %d of %d workflows today", e.Quota.Scope, e.Subject, e.Usage, e.Quota.MaxCreatedPerDay)
+	}
+	return fmt.Sprintf("Quota exceeded: %s %s has %d of %d workflows running", e.Quota.Scope, e.Subject, e.Usage, e.Quota.MaxRunning)
+}
+
+// respond answers with 429, saying when to try again for a daily quota.
+func (e *QuotaError) respond(c *gin.Context) {
+	if e.Daily {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		c.Header("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":   e.Error(),
+		"code":    ErrorCodeQuotaExceeded,
+		"quota":   e.Quota,
+		"subject": e.Subject,
+		"usage":   e.Usage,
+	})
+}
+
+// createQuotaScript counts a workflow created against each of KEYS, unless
+// one is already at its limit in ARGV, 0 being none. It returns the 1-based
+// index of the key at its limit, or 0 once every count is taken.
+var createQuotaScript = redis.NewScript(`
+local ttl = tonumber(ARGV[#ARGV])
+for i, key in ipairs(KEYS) do
+	local limit = tonumber(ARGV[i])
+	if limit > 0 and tonumber(redis.call("GET", key) or "0") >= limit then
+		return i
+	end
+end
+for _, key in ipairs(KEYS) do
+	redis.call("INCR", key)
+	redis.call("EXPIRE", key, ttl)
+end
+return 0
+`)
+
+func quotaUsageKey(lab string, s quotaSubject, day string) string {
+	return labKey(lab, fmt.Sprintf(QUOTA_USAGE_KEY_FORMAT, s.scope, s.subject, day))
+}
+
+// takeCreateQuota counts the workflow against its subjects' daily quotas,
+// returning a QuotaError if one is used up, and the keys to give back if
+// the workflow isn't created after all.
+func takeCreateQuota(w Workflow) ([]string, error) {
+	quotas, err := getQuotas()
+	if err != nil {
+		return nil, err
+	}
+	applied, counted := applicableQuotas(quotas, w.quotaSubjects())
+	day := time.Now().UTC().Format("2006-01-02")
+	keys := []string{}
+	args := []interface{}{}
+	for i, quota := range applied {
+		if quota.MaxCreatedPerDay > 0 {
+			keys = append(keys, quotaUsageKey(w.Lab, counted[i], day))
+			args = append(args, quota.MaxCreatedPerDay)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	args = append(args, int(quotaUsageTTL.Seconds()))
+
+	exceeded, err := createQuotaScript.Run(ctx, redisClient, keys, args...).Int()
+	if err != nil {
+		return nil, err
+	}
+	if exceeded == 0 {
+		return keys, nil
+	}
+	// The index counts only the quotas with a daily limit.
+	for i, quota := range applied {
+		if quota.MaxCreatedPerDay == 0 {
+			continue
+		}
+		if exceeded--; exceeded == 0 {
+			return nil, &QuotaError{Quota: quota, Subject: counted[i].subject, Usage: quota.MaxCreatedPerDay, Daily: true}
+		}
+	}
+	return nil, fmt.Errorf("quota script returned %d of %d keys", exceeded, len(keys))
+}
+
+// giveBackCreateQuota uncounts a workflow that wasn't created after all.
+func giveBackCreateQuota(keys []string) {
+	for _, key := range keys {
+		if err := redisClient.Decr(ctx, key).Err(); err != nil {
+			log.Printf("Error giving back quota %s: %v", key, err)
+		}
+	}
+}
+
+// checkRunningQuota returns a QuotaError if starting the workflow would
+// take one of its subjects over its running quota. Two workflows started at
+// once may both get the last place.
+func checkRunningQuota(w Workflow) error {
+	quotas, err := getQuotas()
+	if err != nil {
+		return err
+	}
+	applied, counted := applicableQuotas(quotas, w.quotaSubjects())
+	var workflows map[string]Workflow
+	for i, quota := range applied {
+		if quota.MaxRunning == 0 {
+			continue
+		}
+		if workflows == nil {
+			if workflows, err = getAllWorkflows(w.Lab); err != nil {
+				return err
+			}
+		}
+		running := 0
+		for _, other := range workflows {
+			active := other.Status == StatusRunning || other.Status == StatusPaused || other.Status == StatusQueued
+			if active && other.ID != w.ID && counted[i].counts(other) {
+				running++
+			}
+		}
+		if running >= quota.MaxRunning {
+			return &QuotaError{Quota: quota, Subject: counted[i].subject, Usage: running}
+		}
+	}
+	return nil
+}
+
+// quotaParams returns the scope and subject the request names, responding
+// with 400 if they can't have a quota.
+func quotaParams(c *gin.Context) (string, string, bool) {
+	scope, subject := c.Param("scope"), c.Param("subject")
+	for _, s := range quotaScopes {
+		if s == scope {
+			if !validQuotaSubject(scope, subject) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + scope + " " + subject})
+				return "", "", false
+			}
+			return scope, subject, true
+		}
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be one of lab, project or api_key"})
+	return "", "", false
+}
+
+// listQuotasHandler lists the quotas, by scope and subject.
+func listQuotasHandler(c *gin.Context) {
+	quotas, err := getQuotas()
+	if err != nil {
+		log.Printf("Error getting quotas: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve quotas"})
+		return
+	}
+	list := make([]Quota, 0, len(quotas))
+	for _, quota := range quotas {
+		list = append(list, quota)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Scope != list[j].Scope {
+			return list[i].Scope < list[j].Scope
+		}
+		return list[i].Subject < list[j].Subject
+	})
+	c.JSON(http.StatusOK, list)
+}
+
+// setQuotaHandler sets a subject's quota, replacing any it had.
+func setQuotaHandler(c *gin.Context) {
+	scope, subject, ok := quotaParams(c)
+	if !ok {
+		return
+	}
+	var quota Quota
+	if err := c.ShouldBindJSON(&quota); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quota"})
+		return
+	}
+	if quota.MaxRunning < 0 || quota.MaxCreatedPerDay < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_running and max_created_per_day must not be negative"})
+		return
+	}
+	if quota.MaxRunning == 0 && quota.MaxCreatedPerDay == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set max_running or max_created_per_day; delete the quota to lift it"})
+		return
+	}
+
+	quota.Scope, quota.Subject = scope, subject
+	quota.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	quota.UpdatedBy = requestActor(c)
+	data, _ := json.Marshal(quota)
+	if err := redisClient.HSet(ctx, QUOTAS_KEY, scope+":"+subject, data).Err(); err != nil {
+		log.Printf("Error saving quota %s:%s: %v", scope, subject, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save quota"})
+		return
+	}
+	log.Printf("Quota for %s %s set to %d running, %d a day", scope, subject, quota.MaxRunning, quota.MaxCreatedPerDay)
+	c.JSON(http.StatusOK, quota)
+}
+
+// deleteQuotaHandler lifts a subject's quota, leaving it to its scope's "*"
+// one if there is one, and returns the quota lifted.
+func deleteQuotaHandler(c *gin.Context) {
+	scope, subject, ok := quotaParams(c)
+	if !ok {
+		return
+	}
+	quotas, err := getQuotas()
+	if err != nil {
+		log.Printf("Error getting quotas: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quota"})
+		return
+	}
+	quota, ok := quotas[scope+":"+subject]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quota not found"})
+		return
+	}
+	if err := redisClient.HDel(ctx, QUOTAS_KEY, scope+":"+subject).Err(); err != nil {
+		log.Printf("Error deleting quota %s:%s: %v", scope, subject, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete quota"})
+		return
+	}
+	log.Printf("Quota for %s %s lifted", scope, subject)
+	c.JSON(http.StatusOK, quota)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"platform/redistest"
+)
+
+// startFakeRedis serves a fake Redis until the test ends and points
+// redisClient at it.
+func startFakeRedis(t *testing.T) *redistest.Server {
+	r := redistest.Start(t)
+	previous := redisClient
+	redisClient = r.Client()
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = previous
+	})
+	return r
+}
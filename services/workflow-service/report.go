@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"workflow-service/deviceapi"
+	"workflow-service/sampleapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /workflows/<id>/report is a finished workflow's run report, for its
+// batch record: what ran, when, on which device, by whom, on which samples,
+// what the device returned and where the run strayed from its plan. It is
+// HTML by default, or PDF with ?format=pdf or Accept: application/pdf.
+
+// RunReport is what a run report shows. Device and Samples are left out if
+// the device or sample service couldn't be reached, with why in
+// DeviceError or SamplesError.
+type RunReport struct {
+	GeneratedAt  string
+	Workflow     *Workflow
+	Duration     string
+	Device       *deviceapi.Device
+	DeviceError  string
+	Samples      []ReportSample
+	SamplesError string
+	Operators    []ReportOperator
+	Steps        []ReportStep
+	Deviations   []string
+}
+
+type ReportSample struct {
+	Barcode  string
+	Name     string
+	Type     string
+	Location string
+	VolumeUL string
+	Status   string
+}
+
+// ReportOperator is who did something to the workflow, and when.
+type ReportOperator struct {
+	Role  string
+	Actor string
+	At    string
+}
+
+// ReportStep is a planned step and how it ran; a step that didn't run has
+// no status.
+type ReportStep struct {
+	Index      int
+	Step       string
+	Params     string
+	Status     string
+	Start      string
+	End        string
+	Duration   string
+	ExecutedBy string
+	Result     string
+}
+
+// formatReportDuration rounds a duration to the second, or the millisecond
+// under a second.
+func formatReportDuration(d time.Duration) string {
+	if d < time.Second {
+		return d.Round(time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// compactJSON renders a value as one line of JSON with sorted keys, or ""
+// if it is empty.
+func compactJSON(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "{}" || string(data) == "null" {
+		return ""
+	}
+	return string(data)
+}
+
+// newRunReport puts together a workflow's report from the workflow and
+// what the device and sample services returned for it.
+func newRunReport(workflow *Workflow, device *deviceapi.Device, samples []sampleapi.ValidationResult, now time.Time) *RunReport {
+	report := &RunReport{GeneratedAt: now.UTC().Format(time.RFC3339), Workflow: workflow, Device: device}
+	timeline := workflow.timeline(now)
+	report.Duration = formatReportDuration(time.Duration(timeline.DurationMS) * time.Millisecond)
+
+	for _, operator := range []ReportOperator{
+		{"Created", workflow.CreatedBy, workflow.CreatedAt},
+		{"Started", workflow.StartedBy, workflow.StartedAt},
+		{"Completed", workflow.CompletedBy, workflow.CompletedAt},
+		{"Failed", workflow.FailedBy, workflow.FailedAt},
+	} {
+		if operator.At != "" {
+			if operator.Actor == "" {
+				operator.Actor = "unknown"
+			}
+			report.Operators = append(report.Operators, operator)
+		}
+	}
+
+	for _, result := range samples {
+		sample := ReportSample{Barcode: result.Barcode, Status: result.Status}
+		if result.Sample != nil {
+			sample.Name, sample.Type = result.Sample.Name, result.Sample.Type
+			sample.Location = strings.Trim(result.Sample.Location.Plate+" "+result.Sample.Location.Well, " ")
+			if result.Sample.VolumeUL != nil {
+				sample.VolumeUL = fmt.Sprintf("%g", *result.Sample.VolumeUL)
+			}
+		}
+		report.Samples = append(report.Samples, sample)
+	}
+	if samples == nil {
+		for _, barcode := range workflow.SampleBarcodes {
+			report.Samples = append(report.Samples, ReportSample{Barcode: barcode})
+		}
+	}
+
+	stepTimes := map[int]TimelineInterval{}
+	for _, interval := range timeline.Intervals {
+		if interval.Kind == IntervalStep && interval.StepIndex != nil {
+			stepTimes[*interval.StepIndex] = interval
+		}
+	}
+	for i, step := range workflow.Steps {
+		row := ReportStep{Index: i, Step: step, Params: compactJSON(workflow.stepParams(i))}
+		if result := workflow.stepResult(i); result != nil {
+			row.Status, row.ExecutedBy, row.Result = result.Status, result.ExecutedBy, compactJSON(result.Result)
+			if interval, ok := stepTimes[i]; ok {
+				row.Start, row.End = interval.Start, interval.End
+				row.Duration = formatReportDuration(time.Duration(interval.DurationMS) * time.Millisecond)
+				if interval.Approximate {
+					report.Deviations = append(report.Deviations, fmt.Sprintf("Step %d (%s): start not recorded; its timing is approximate", i, step))
+				}
+			}
+			if result.Status != "completed" {
+				report.Deviations = append(report.Deviations, fmt.Sprintf("Step %d (%s) was %s", i, step, result.Status))
+			}
+		} else if workflow.Status == StatusCompleted {
+			report.Deviations = append(report.Deviations, fmt.Sprintf("Step %d (%s) did not run", i, step))
+		}
+		report.Steps = append(report.Steps, row)
+	}
+
+	for _, pause := range workflow.Pauses {
+		deviation := fmt.Sprintf("Paused at %s", pause.PausedAt)
+		if pause.PausedBy != "" {
+			deviation += " by " + pause.PausedBy
+		}
+		if pause.Reason != "" {
+			deviation += ": " + pause.Reason
+		}
+		if pause.ResumedAt != "" {
+			deviation += fmt.Sprintf("; resumed at %s", pause.ResumedAt)
+			if pause.ResumedBy != "" {
+				deviation += " by " + pause.ResumedBy
+			}
+		}
+		report.Deviations = append(report.Deviations, deviation)
+	}
+	if workflow.Status == StatusFailed {
+		reason := workflow.FailureReason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		report.Deviations = append(report.Deviations, "Run failed: "+reason)
+	}
+	for _, result := range samples {
+		if !result.Available {
+			report.Deviations = append(report.Deviations, fmt.Sprintf("Sample %s is %s now", result.Barcode, result.Status))
+		}
+	}
+	sort.SliceStable(report.Operators, func(i, j int) bool { return report.Operators[i].At < report.Operators[j].At })
+	return report
+}
+
+var runReportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Run report: {{.Workflow.Name}}</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 13px; margin: 2em; color: #222; }
+h1 { font-size: 20px; margin-bottom: 0; }
+h2 { font-size: 15px; margin-top: 1.6em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border: 1px solid #ccc; padding: 4px 6px; text-align: left; vertical-align: top; }
+th { background: #f3f3f3; }
+dl { display: grid; grid-template-columns: max-content auto; gap: 2px 1em; }
+dt { font-weight: bold; }
+dd { margin: 0; }
+code { font-size: 11px; word-break: break-all; }
+.muted { color: #777; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>Run report: {{.Workflow.Name}}</h1>
+<p class="muted">Workflow {{.Workflow.ID}} &middot; generated {{.GeneratedAt}}</p>
+
+<h2>Run</h2>
+<dl>
+<dt>Status</dt><dd>{{.Workflow.Status}}</dd>
+{{if .Workflow.Project}}<dt>Project</dt><dd>{{.Workflow.Project}}</dd>{{end}}
+{{if .Workflow.Lab}}<dt>Lab</dt><dd>{{.Workflow.Lab}}</dd>{{end}}
+<dt>Created</dt><dd>{{.Workflow.CreatedAt}}</dd>
+{{if .Workflow.QueuedAt}}<dt>Queued</dt><dd>{{.Workflow.QueuedAt}}</dd>{{end}}
+{{if .Workflow.StartedAt}}<dt>Started</dt><dd>{{.Workflow.StartedAt}}</dd>{{end}}
+{{if .Workflow.CompletedAt}}<dt>Completed</dt><dd>{{.Workflow.CompletedAt}}</dd>{{end}}
+{{if .Workflow.FailedAt}}<dt>Failed</dt><dd>{{.Workflow.FailedAt}}</dd>{{end}}
+<dt>Duration</dt><dd>{{.Duration}}</dd>
+{{if .Workflow.Tags}}<dt>Tags</dt><dd>{{range $i, $t := .Workflow.Tags}}{{if $i}}, {{end}}{{$t}}{{end}}</dd>{{end}}
+</dl>
+
+<h2>Device</h2>
+{{if .Device}}<dl>
+<dt>ID</dt><dd>{{.Device.ID}}</dd>
+<dt>Name</dt><dd>{{.Device.Name}}</dd>
+<dt>Type</dt><dd>{{.Device.Type}}</dd>
+{{if .Device.Firmware}}<dt>Firmware</dt><dd>{{.Device.Firmware.FirmwareVersion}}</dd>{{end}}
+</dl>{{else}}<p>{{.Workflow.DeviceID}} <span class="muted">(details unavailable: {{.DeviceError}})</span></p>{{end}}
+
+<h2>Operators</h2>
+<table>
+<tr><th>Action</th><th>By</th><th>At</th></tr>
+{{range .Operators}}<tr><td>{{.Role}}</td><td>{{.Actor}}</td><td>{{.At}}</td></tr>
+{{end}}</table>
+
+<h2>Samples</h2>
+{{if .SamplesError}}<p class="muted">Sample details unavailable: {{.SamplesError}}</p>{{end}}
+{{if .Samples}}<table>
+<tr><th>Barcode</th><th>Name</th><th>Type</th><th>Location</th><th>Volume (uL)</th><th>Status</th></tr>
+{{range .Samples}}<tr><td>{{.Barcode}}</td><td>{{.Name}}</td><td>{{.Type}}</td><td>{{.Location}}</td><td>{{.VolumeUL}}</td><td>{{.Status}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+
+<h2>Steps</h2>
+<table>
+<tr><th>#</th><th>Step</th><th>Status</th><th>Start</th><th>End</th><th>Duration</th><th>By</th><th>Params</th><th>Result</th></tr>
+{{range .Steps}}<tr><td>{{.Index}}</td><td>{{.Step}}</td><td>{{if .Status}}{{.Status}}{{else}}<span class="muted">not run</span>{{end}}</td><td>{{.Start}}</td><td>{{.End}}</td><td>{{.Duration}}</td><td>{{.ExecutedBy}}</td><td><code>{{.Params}}</code></td><td><code>{{.Result}}</code></td></tr>
+{{end}}</table>
+
+<h2>Deviations and comments</h2>
+{{if .Deviations}}<ul>
+{{range .Deviations}}<li>{{.}}</li>
+{{end}}</ul>{{else}}<p>None</p>{{end}}
+</body>
+</html>
+`))
+
+func (r *RunReport) html() ([]byte, error) {
+	var out bytes.Buffer
+	if err := runReportTemplate.Execute(&out, r); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// pdf lays the report out as the HTML one, with each table row as a
+// paragraph.
+func (r *RunReport) pdf() []byte {
+	w := r.Workflow
+	doc := newPDFDocument("Run report: " + w.Name)
+	heading := func(text string) {
+		doc.gap(10)
+		doc.text(text, 13, 0, true)
+		doc.gap(2)
+	}
+	field := func(name, value string) {
+		if value != "" {
+			doc.text(name+": "+value, 10, 0, false)
+		}
+	}
+
+	doc.text("Run report: "+w.Name, 18, 0, true)
+	doc.text(fmt.Sprintf("Workflow %s - generated %s", w.ID, r.GeneratedAt), 9, 0, false)
+
+	heading("Run")
+	field("Status", string(w.Status))
+	field("Project", w.Project)
+	field("Lab", w.Lab)
+	field("Created", w.CreatedAt)
+	field("Queued", w.QueuedAt)
+	field("Started", w.StartedAt)
+	field("Completed", w.CompletedAt)
+	field("Failed", w.FailedAt)
+	field("Duration", r.Duration)
+	field("Tags", strings.Join(w.Tags, ", "))
+
+	heading("Device")
+	if r.Device != nil {
+		field("ID", r.Device.ID)
+		field("Name", r.Device.Name)
+		field("Type", r.Device.Type)
+		if r.Device.Firmware != nil {
+			field("Firmware", r.Device.Firmware.FirmwareVersion)
+		}
+	} else {
+		doc.text(fmt.Sprintf("%s (details unavailable: %s)", w.DeviceID, r.DeviceError), 10, 0, false)
+	}
+
+	heading("Operators")
+	for _, operator := range r.Operators {
+		doc.text(fmt.Sprintf("%s by %s at %s", operator.Role, operator.Actor, operator.At), 10, 0, false)
+	}
+
+	heading("Samples")
+	if r.SamplesError != "" {
+		doc.text("Sample details unavailable: "+r.SamplesError, 10, 0, false)
+	}
+	if len(r.Samples) == 0 {
+		doc.text("None", 10, 0, false)
+	}
+	for _, sample := range r.Samples {
+		line := sample.Barcode
+		for _, part := range []string{sample.Name, sample.Type, sample.Location, sample.Status} {
+			if part != "" {
+				line += " - " + part
+			}
+		}
+		if sample.VolumeUL != "" {
+			line += " - " + sample.VolumeUL + " uL"
+		}
+		doc.text(line, 10, 0, false)
+	}
+
+	heading("Steps")
+	for _, step := range r.Steps {
+		status := step.Status
+		if status == "" {
+			status = "not run"
+		}
+		doc.text(fmt.Sprintf("%d. %s - %s", step.Index, step.Step, status), 10, 0, true)
+		if step.Start != "" {
+			doc.text(fmt.Sprintf("%s to %s (%s)", step.Start, step.End, step.Duration), 9, 14, false)
+		}
+		if step.ExecutedBy != "" {
+			doc.text("By "+step.ExecutedBy, 9, 14, false)
+		}
+		if step.Params != "" {
+			doc.text("Params: "+step.Params, 9, 14, false)
+		}
+		if step.Result != "" {
+			doc.text("Result: "+step.Result, 9, 14, false)
+		}
+	}
+
+	heading("Deviations and comments")
+	if len(r.Deviations) == 0 {
+		doc.text("None", 10, 0, false)
+	}
+	for _, deviation := range r.Deviations {
+		doc.text("- "+deviation, 10, 0, false)
+	}
+	return doc.bytes()
+}
+
+// runReportHandler returns a completed or failed workflow's run report, as
+// HTML or PDF.
+func runReportHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	format := c.Query("format")
+	if format == "" {
+		format = "html"
+		if strings.Contains(c.GetHeader("Accept"), "application/pdf") {
+			format = "pdf"
+		}
+	}
+	if format != "html" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be html or pdf"})
+		return
+	}
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	if workflow.Status != StatusCompleted && workflow.Status != StatusFailed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only completed and failed workflows have a run report"})
+		return
+	}
+
+	var device *deviceapi.Device
+	deviceError := ""
+	data, err := fetchJSON(c, http.MethodGet, fmt.Sprintf("%s/v1/devices/%s", deviceAPIURL, workflow.DeviceID), nil)
+	if err == nil {
+		device = &deviceapi.Device{}
+		err = json.Unmarshal(data, device)
+	}
+	if err != nil {
+		log.Printf("Error getting device %s for the report of workflow %s: %v", workflow.DeviceID, workflowID, err)
+		device, deviceError = nil, err.Error()
+	}
+
+	var samples []sampleapi.ValidationResult
+	samplesError := ""
+	if len(workflow.SampleBarcodes) > 0 {
+		req := sampleapi.ValidateRequest{Barcodes: workflow.SampleBarcodes, WorkflowID: workflow.ID, IncludeSamples: true}
+		data, err := fetchJSON(c, http.MethodPost, fmt.Sprintf("%s/v1/samples/validate", sampleAPIURL), req)
+		if err == nil {
+			err = json.Unmarshal(data, &samples)
+		}
+		if err != nil {
+			log.Printf("Error getting samples for the report of workflow %s: %v", workflowID, err)
+			samples, samplesError = nil, err.Error()
+		}
+	}
+
+	report := newRunReport(workflow, device, samples, time.Now())
+	report.DeviceError, report.SamplesError = deviceError, samplesError
+
+	filename := fmt.Sprintf("run-report-%s.%s", workflow.ID, format)
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%q", filename))
+	if format == "pdf" {
+		c.Data(http.StatusOK, "application/pdf", report.pdf())
+		return
+	}
+	page, err := report.html()
+	if err != nil {
+		log.Printf("Error rendering the report of workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render report"})
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Completed and failed workflows are deleted WORKFLOW_RETENTION (a
+// duration such as 720h) after they finished, by a janitor running every
+// RETENTION_CHECK_INTERVAL. Workflows tagged RETENTION_EXEMPT_TAG are kept.
+// With RETENTION_DRY_RUN=true the janitor only logs what it would delete.
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionExemptTag = "retain"
+)
+
+var (
+	workflowRetention  time.Duration
+	retentionDryRun    bool
+	retentionExemptTag = defaultRetentionExemptTag
+)
+
+// RetentionReport lists the workflows a cleanup deleted, or with DryRun
+// would have.
+type RetentionReport struct {
+	DryRun    bool     `json:"dry_run"`
+	Retention string   `json:"retention"`
+	Cutoff    string   `json:"cutoff"`
+	Expired   []string `json:"expired"`
+	Exempt    []string `json:"exempt"`
+}
+
+func normalizeTags(tags []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// finishedAt returns when a completed or failed workflow finished.
+func (w Workflow) finishedAt() (time.Time, bool) {
+	var at string
+	switch w.Status {
+	case StatusCompleted:
+		at = w.CompletedAt
+	case StatusFailed:
+		at = w.FailedAt
+	default:
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, at)
+	return t, err == nil
+}
+
+func (w Workflow) exempt() bool {
+	for _, tag := range w.Tags {
+		if tag == retentionExemptTag {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanUpWorkflows deletes the workflows that finished before the cutoff,
+// unless dryRun is set. Each lab's workflows are watched while they are
+// rewritten, so changes made meanwhile aren't lost.
+func cleanUpWorkflows(cutoff time.Time, dryRun bool) (*RetentionReport, error) {
+	report := &RetentionReport{
+		DryRun:    dryRun,
+		Retention: workflowRetention.String(),
+		Cutoff:    cutoff.Format(time.RFC3339),
+		Expired:   []string{},
+		Exempt:    []string{},
+	}
+	labs, err := listLabs()
+	if err != nil {
+		return nil, err
+	}
+	for _, lab := range labs {
+		key := labKey(lab, WORKFLOWS_KEY)
+		var expired, exempt []string
+		err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			expired, exempt = nil, nil
+			data, err := tx.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			workflows, err := decodeWorkflows([]byte(data))
+			if err != nil {
+				return err
+			}
+			for id, workflow := range workflows {
+				finished, ok := workflow.finishedAt()
+				if !ok || !finished.Before(cutoff) {
+					continue
+				}
+				if workflow.exempt() {
+					exempt = append(exempt, id)
+					continue
+				}
+				expired = append(expired, id)
+				delete(workflows, id)
+			}
+			if dryRun || len(expired) == 0 {
+				return nil
+			}
+			updated, err := encodeWorkflows(workflows)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, updated, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err != nil {
+			return nil, err
+		}
+		if !dryRun {
+			forgetDeviceCalls(lab, expired)
+		}
+		report.Expired = append(report.Expired, expired...)
+		report.Exempt = append(report.Exempt, exempt...)
+	}
+	sort.Strings(report.Expired)
+	sort.Strings(report.Exempt)
+	return report, nil
+}
+
+// startRetentionJanitor cleans up finished workflows in the background if
+// WORKFLOW_RETENTION is set.
+func startRetentionJanitor() {
+	if tag := strings.ToLower(strings.TrimSpace(os.Getenv("RETENTION_EXEMPT_TAG"))); tag != "" {
+		retentionExemptTag = tag
+	}
+	retentionDryRun = os.Getenv("RETENTION_DRY_RUN") == "true"
+	value := os.Getenv("WORKFLOW_RETENTION")
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Fatalf("Invalid WORKFLOW_RETENTION %q", value)
+	}
+	workflowRetention = d
+	interval := defaultRetentionInterval
+	if value := os.Getenv("RETENTION_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RETENTION_CHECK_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			report, err := cleanUpWorkflows(time.Now().Add(-workflowRetention), retentionDryRun)
+			switch {
+			case err != nil:
+				log.Printf("Error cleaning up workflows: %v", err)
+			case report.DryRun && len(report.Expired) > 0:
+				log.Printf("Retention dry run: would delete %d workflow(s) finished before %s: %s", len(report.Expired), report.Cutoff, strings.Join(report.Expired, ", "))
+			case len(report.Expired) > 0:
+				log.Printf("Deleted %d workflow(s) finished before %s", len(report.Expired), report.Cutoff)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Deleting workflows %s after they finish, checking every %s (dry run: %t)", workflowRetention, interval, retentionDryRun)
+}
+
+// retentionReportHandler reports which workflows the retention policy
+// would delete now, deleting nothing. ?older_than=<duration> tries
+// another retention.
+func retentionReportHandler(c *gin.Context) {
+	retention := workflowRetention
+	if value := c.Query("older_than"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "older_than must be a positive duration such as 720h"})
+			return
+		}
+		retention = d
+	}
+	if retention == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "WORKFLOW_RETENTION is not set; give older_than"})
+		return
+	}
+
+	report, err := cleanUpWorkflows(time.Now().Add(-retention), true)
+	if err != nil {
+		log.Printf("Error checking workflow retention: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check workflow retention"})
+		return
+	}
+	report.Retention = retention.String()
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,84 @@
+package main
+
+// The device and sample services' clients in deviceapi and sampleapi are
+// generated from their OpenAPI specs in api/.
+//go:generate go -C ../../cmd/apigen run .
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"workflow-service/sampleapi"
+)
+
+// STEP_VOLUME_PARAM is the step parameter giving the microlitres drawn from
+// each of the workflow's samples when the step runs.
+const STEP_VOLUME_PARAM = "volume_ul"
+
+// stepParams returns the parameters of a step, or nil if it has none.
+func (w Workflow) stepParams(index int) map[string]interface{} {
+	if index < 0 || index >= len(w.StepParams) {
+		return nil
+	}
+	return w.StepParams[index]
+}
+
+// stepVolume returns the volume a step draws from each sample, or 0 if it
+// doesn't declare one.
+func stepVolume(params map[string]interface{}) (float64, error) {
+	value, ok := params[STEP_VOLUME_PARAM]
+	if !ok || value == nil {
+		return 0, nil
+	}
+	volume, ok := value.(float64)
+	if !ok || volume <= 0 {
+		return 0, errors.New("volume_ul must be a positive number")
+	}
+	return volume, nil
+}
+
+// validateStepParams checks that step parameters line up with the steps.
+func validateStepParams(steps []string, params []map[string]interface{}) error {
+	if len(params) > len(steps) {
+		return errors.New("step_params has more entries than steps")
+	}
+	for i, stepParams := range params {
+		if _, err := stepVolume(stepParams); err != nil {
+			return fmt.Errorf("step_params[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// consumeSampleVolume asks the sample service to draw volume from each of
+// the workflow's samples, or with dryRun only to check there is enough. It
+// returns the status code and decoded body of the response, with the
+// samples drawn from under samples. The draw is made on the caller's
+// behalf.
+func consumeSampleVolume(workflow *Workflow, stepIndex int, volume float64, dryRun bool, caller Caller) (int, map[string]interface{}, error) {
+	req := sampleapi.BulkConsumeRequest{
+		WorkflowID: workflow.ID,
+		StepIndex:  &stepIndex,
+		DryRun:     dryRun,
+	}
+	for _, barcode := range workflow.SampleBarcodes {
+		req.Consumptions = append(req.Consumptions, sampleapi.SampleConsumption{Barcode: barcode, VolumeUL: volume})
+	}
+
+	client := sampleapi.NewClient(sampleAPIURL+"/v"+API_VERSION, caller.setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	consumed, err := client.ConsumeSamples(context.Background(), req)
+	var respErr *sampleapi.ResponseError
+	if errors.As(err, &respErr) {
+		var result map[string]interface{}
+		json.Unmarshal(respErr.Body, &result)
+		return respErr.StatusCode, result, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, map[string]interface{}{"dry_run": consumed.DryRun, "samples": consumed.Samples}, nil
+}
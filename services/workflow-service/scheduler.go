@@ -0,0 +1,459 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"platform"
+	"workflow-service/deviceapi"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// The scheduler starts created workflows as their devices come free, in
+// labs with the auto_dispatch feature flag on. Every SCHEDULER_INTERVAL
+// (default 15s; 0 turns it off) it goes through each such lab's created
+// workflows, highest priority first, then oldest, and starts each one
+// whose device has a free slot, no bookings queued and no reservation by
+// another workflow coming up within its average booking. A workflow with a
+// reservation of its own waits for it to open. A workflow created with
+// pool set may instead run on any other device of its device's type that
+// offers its steps, and is moved there. Workflows created with
+// manual_start are left to be started by hand. Workflows are started
+// through the start endpoint, as the scheduler, so starts are checked and
+// recorded as any other; one that fails to start is tried again after
+// schedulerRetryAfter. Only one replica dispatches at a time, the one
+// holding workflows:scheduler:leader, and each pass is saved under
+// workflows:scheduler:last-pass.
+const (
+	AUTO_DISPATCH_FLAG       = "auto_dispatch"
+	SCHEDULER_LEADER_KEY     = "workflows:scheduler:leader"
+	SCHEDULER_LAST_PASS_KEY  = "workflows:scheduler:last-pass"
+	SCHEDULER_ACTOR          = "scheduler"
+	defaultSchedulerInterval = 15 * time.Second
+	schedulerRetryAfter      = 5 * time.Minute
+	// schedulerHorizon is how far ahead reservations are looked at.
+	schedulerHorizon = "720h"
+	// reservationOpensEarly matches the device service's early claim of a
+	// reservation.
+	reservationOpensEarly = 5 * time.Minute
+)
+
+var (
+	schedulerInterval time.Duration
+	schedulerID       string
+	// dispatchRetryAt is when workflows that failed to start, by lab and
+	// ID, are tried again.
+	dispatchRetryAt = map[string]time.Time{}
+)
+
+// leaderScript takes the scheduler lead for ARGV[1], or keeps it, for
+// ARGV[2] milliseconds. It returns 1 if ARGV[1] leads.
+var leaderScript = redis.NewScript(`
+local leader = redis.call("GET", KEYS[1])
+if not leader then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if leader == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// Dispatch is a workflow the scheduler started, or tried to. Status is the
+// start's response status; Moved is set if it was moved to another device
+// of its pool.
+type Dispatch struct {
+	Lab        string `json:"lab,omitempty"`
+	WorkflowID string `json:"workflow_id"`
+	DeviceID   string `json:"device_id"`
+	Moved      bool   `json:"moved,omitempty"`
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SchedulerPass is what one pass of the scheduler did: the labs it
+// dispatched in, how many workflows were waiting and which it started.
+type SchedulerPass struct {
+	StartedAt  string     `json:"started_at"`
+	FinishedAt string     `json:"finished_at"`
+	Labs       []string   `json:"labs,omitempty"`
+	Waiting    int        `json:"waiting,omitempty"`
+	Dispatched []Dispatch `json:"dispatched"`
+	Errors     []string   `json:"errors,omitempty"`
+}
+
+// SchedulerStatus is whether the scheduler dispatches the lab's workflows,
+// and its last pass, showing only the lab's dispatches.
+type SchedulerStatus struct {
+	Enabled  bool           `json:"enabled"`
+	Interval string         `json:"interval"`
+	LastPass *SchedulerPass `json:"last_pass,omitempty"`
+}
+
+// schedulerDevice is what a pass knows of a device.
+type schedulerDevice struct {
+	ID           string
+	Type         string
+	Capabilities []string
+	// Free is how many more workflows it can take.
+	Free int
+	// Queued is set while bookings wait for it; those go first.
+	Queued bool
+	// AvgBooking is how long its bookings take, zero if unknown.
+	AvgBooking   time.Duration
+	Reservations []heldWindow
+}
+
+func (d *schedulerDevice) offers(operation string) bool {
+	for _, capability := range d.Capabilities {
+		if capability == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// reservedFor returns the reservation of the workflow on the device that
+// hasn't ended, if there is one.
+func (d *schedulerDevice) reservedFor(workflowID string, now time.Time) *heldWindow {
+	for i, window := range d.Reservations {
+		if window.workflowID == workflowID && now.Before(window.end) {
+			return &d.Reservations[i]
+		}
+	}
+	return nil
+}
+
+// heldByOthers reports whether another workflow's reservation is open, or
+// opens within the device's average booking.
+func (d *schedulerDevice) heldByOthers(workflowID string, now time.Time) bool {
+	for _, window := range d.Reservations {
+		if window.workflowID != workflowID && now.Before(window.end) && window.start.Add(-reservationOpensEarly).Before(now.Add(d.AvgBooking)) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchTarget is a device the scheduler picked for a workflow.
+type dispatchTarget struct {
+	workflow Workflow
+	deviceID string
+}
+
+// planDispatch picks a device for each workflow that can start now, going
+// through them highest priority first, then oldest. Each takes its own
+// device if it is free, or, in a pool, the first free device of its type
+// offering every step its own device does.
+func planDispatch(workflows []Workflow, devices map[string]*schedulerDevice, now time.Time) []dispatchTarget {
+	workflows = append([]Workflow{}, workflows...)
+	sort.SliceStable(workflows, func(i, j int) bool {
+		if workflows[i].Priority != workflows[j].Priority {
+			return workflows[i].Priority > workflows[j].Priority
+		}
+		return workflows[i].CreatedAt < workflows[j].CreatedAt
+	})
+	ids := make([]string, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var targets []dispatchTarget
+	for _, workflow := range workflows {
+		own, ok := devices[workflow.DeviceID]
+		if !ok {
+			continue
+		}
+		candidates := []*schedulerDevice{own}
+		if reservation := own.reservedFor(workflow.ID, now); reservation != nil {
+			// It runs on its own device once its reservation opens.
+			if now.Before(reservation.start.Add(-reservationOpensEarly)) {
+				continue
+			}
+		} else if workflow.Pool {
+			for _, id := range ids {
+				device := devices[id]
+				if device == own || device.Type != own.Type {
+					continue
+				}
+				capable := true
+				for _, step := range workflow.Steps {
+					capable = capable && (!own.offers(step) || device.offers(step))
+				}
+				if capable {
+					candidates = append(candidates, device)
+				}
+			}
+		}
+
+		for _, device := range candidates {
+			if device.Free > 0 && !device.Queued && !device.heldByOthers(workflow.ID, now) {
+				device.Free--
+				targets = append(targets, dispatchTarget{workflow: workflow, deviceID: device.ID})
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// schedulerDevices reads the lab's devices and, for those the workflows
+// could run on, their schedules.
+func schedulerDevices(lab string, workflows []Workflow) (map[string]*schedulerDevice, error) {
+	caller := Caller{Actor: SCHEDULER_ACTOR, Lab: lab}
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, caller.setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	list, err := client.ListDevices(ctx, &deviceapi.ListDevicesParams{Limit: 1000})
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make(map[string]*schedulerDevice, len(list.Devices))
+	for _, device := range list.Devices {
+		d := &schedulerDevice{ID: device.ID, Type: device.Type, Capabilities: device.Capabilities}
+		switch {
+		case device.Status == "error" || device.Status == "maintenance" || device.Status == "offline":
+		case len(device.Slots) > 0:
+			for _, slot := range device.Slots {
+				if slot.Status == "available" {
+					d.Free++
+				}
+			}
+		case device.Status == "available":
+			d.Free = 1
+		}
+		devices[device.ID] = d
+	}
+
+	wanted := map[string]bool{}
+	for _, workflow := range workflows {
+		own, ok := devices[workflow.DeviceID]
+		if !ok {
+			continue
+		}
+		wanted[own.ID] = true
+		if workflow.Pool {
+			for _, device := range devices {
+				if device.Type == own.Type {
+					wanted[device.ID] = true
+				}
+			}
+		}
+	}
+	for id := range wanted {
+		schedule, err := client.GetDeviceSchedule(ctx, id, &deviceapi.GetDeviceScheduleParams{Horizon: schedulerHorizon})
+		if err != nil {
+			// Without its schedule, the device isn't dispatched to.
+			log.Printf("Scheduler: error getting schedule of device %s: %v", id, err)
+			devices[id].Free = 0
+			continue
+		}
+		device := devices[id]
+		device.AvgBooking = time.Duration(schedule.AvgBookingMs) * time.Millisecond
+		for _, entry := range schedule.Entries {
+			switch entry.Kind {
+			case "queued":
+				device.Queued = true
+			case "reservation":
+				start, err1 := time.Parse(time.RFC3339, entry.Start)
+				end, err2 := time.Parse(time.RFC3339, entry.End)
+				if err1 == nil && err2 == nil {
+					device.Reservations = append(device.Reservations, heldWindow{start: start, end: end, workflowID: entry.WorkflowID})
+				}
+			}
+		}
+	}
+	return devices, nil
+}
+
+// dispatch starts the workflow on the device through the start endpoint,
+// moving it to the device first if it is another of its pool.
+func dispatch(router http.Handler, lab string, target dispatchTarget) Dispatch {
+	workflow := target.workflow
+	result := Dispatch{Lab: lab, WorkflowID: workflow.ID, DeviceID: target.deviceID, Moved: target.deviceID != workflow.DeviceID}
+	if result.Moved {
+		if _, err := updateWorkflow(lab, workflow.ID, map[string]interface{}{"device_id": target.deviceID}); err != nil {
+			result.Error = fmt.Sprintf("Failed to move workflow to device %s: %v", target.deviceID, err)
+			return result
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "/v"+API_VERSION+"/workflows/"+workflow.ID+"/start", nil)
+	req.Header.Set(ACTOR_HEADER, SCHEDULER_ACTOR)
+	req.Header.Set(REQUEST_ID_HEADER, uuid.New().String())
+	if lab != "" {
+		req.Header.Set(LAB_HEADER, lab)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	result.Status = w.Code
+	if w.Code == http.StatusOK || w.Code == http.StatusAccepted {
+		return result
+	}
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	result.Error = body.Error
+	if result.Moved {
+		// Left on its own device, in case it can't run on this one.
+		if _, err := updateWorkflow(lab, workflow.ID, map[string]interface{}{"device_id": workflow.DeviceID}); err != nil {
+			log.Printf("Scheduler: error moving workflow %s back to device %s: %v", workflow.ID, workflow.DeviceID, err)
+		}
+	}
+	return result
+}
+
+// schedulerPass dispatches what can start now in every lab with
+// auto_dispatch on.
+func schedulerPass(router http.Handler) SchedulerPass {
+	now := time.Now().UTC()
+	pass := SchedulerPass{StartedAt: now.Format(time.RFC3339), Labs: []string{}, Dispatched: []Dispatch{}, Errors: []string{}}
+	labs, err := listLabs()
+	if err != nil {
+		pass.Errors = append(pass.Errors, fmt.Sprintf("Failed to list labs: %v", err))
+	}
+	for _, lab := range labs {
+		if !platform.FeatureEnabled(redisClient, AUTO_DISPATCH_FLAG, lab) {
+			continue
+		}
+		pass.Labs = append(pass.Labs, lab)
+		workflows, err := getAllWorkflows(lab)
+		if err != nil {
+			pass.Errors = append(pass.Errors, fmt.Sprintf("Failed to read workflows of lab %q: %v", lab, err))
+			continue
+		}
+		var waiting []Workflow
+		for _, workflow := range workflows {
+			if workflow.Status == StatusCreated && !workflow.ManualStart && !now.Before(dispatchRetryAt[lab+"/"+workflow.ID]) {
+				waiting = append(waiting, workflow)
+			}
+		}
+		pass.Waiting += len(waiting)
+		if len(waiting) == 0 {
+			continue
+		}
+
+		devices, err := schedulerDevices(lab, waiting)
+		if err != nil {
+			pass.Errors = append(pass.Errors, fmt.Sprintf("Failed to read devices of lab %q: %v", lab, err))
+			continue
+		}
+		for _, target := range planDispatch(waiting, devices, now) {
+			result := dispatch(router, lab, target)
+			pass.Dispatched = append(pass.Dispatched, result)
+			key := lab + "/" + result.WorkflowID
+			switch result.Status {
+			case http.StatusOK, http.StatusAccepted:
+				delete(dispatchRetryAt, key)
+				log.Printf("Scheduler: started workflow %s on device %s", result.WorkflowID, result.DeviceID)
+			case http.StatusConflict, http.StatusTooManyRequests:
+				// The device was taken or a quota is used up; tried again
+				// next pass.
+				log.Printf("Scheduler: workflow %s can't start yet: %s", result.WorkflowID, result.Error)
+			default:
+				dispatchRetryAt[key] = now.Add(schedulerRetryAfter)
+				log.Printf("Scheduler: failed to start workflow %s on device %s (%d): %s", result.WorkflowID, result.DeviceID, result.Status, result.Error)
+			}
+		}
+	}
+	for key, at := range dispatchRetryAt {
+		if now.After(at) {
+			delete(dispatchRetryAt, key)
+		}
+	}
+
+	pass.FinishedAt = time.Now().UTC().Format(time.RFC3339)
+	return pass
+}
+
+// startScheduler dispatches workflows in the background every
+// SCHEDULER_INTERVAL, while this replica leads.
+func startScheduler(router http.Handler) {
+	schedulerInterval = defaultSchedulerInterval
+	if value := os.Getenv("SCHEDULER_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid SCHEDULER_INTERVAL %q", value)
+		}
+		schedulerInterval = d
+	}
+	if schedulerInterval == 0 {
+		log.Printf("Scheduler off")
+		return
+	}
+	hostname, _ := os.Hostname()
+	schedulerID = fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), uuid.New().String()[:8])
+
+	go func() {
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			leads, err := leaderScript.Run(ctx, redisClient, []string{SCHEDULER_LEADER_KEY}, schedulerID, (3 * schedulerInterval).Milliseconds()).Int()
+			if err != nil {
+				log.Printf("Scheduler: error taking the lead: %v", err)
+				continue
+			}
+			if leads == 0 {
+				continue
+			}
+			pass := schedulerPass(router)
+			if len(pass.Errors) > 0 {
+				log.Printf("Scheduler: %s", strings.Join(pass.Errors, "; "))
+			}
+			data, _ := json.Marshal(pass)
+			if err := redisClient.Set(ctx, SCHEDULER_LAST_PASS_KEY, data, 0).Err(); err != nil {
+				log.Printf("Scheduler: error saving pass: %v", err)
+			}
+		}
+	}()
+	log.Printf("Scheduler dispatching every %s in labs with %s on (replica %s)", schedulerInterval, AUTO_DISPATCH_FLAG, schedulerID)
+}
+
+// schedulerStatusHandler reports whether the scheduler dispatches the lab's
+// workflows, and what its last pass started in the lab.
+func schedulerStatusHandler(c *gin.Context) {
+	lab := requestLab(c)
+	status := SchedulerStatus{
+		Enabled:  schedulerInterval > 0 && platform.FeatureEnabled(redisClient, AUTO_DISPATCH_FLAG, lab),
+		Interval: schedulerInterval.String(),
+	}
+	data, err := redisClient.Get(ctx, SCHEDULER_LAST_PASS_KEY).Bytes()
+	if err != nil && err != redis.Nil {
+		log.Printf("Error reading scheduler pass: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve scheduler status"})
+		return
+	}
+	if err == nil {
+		var pass SchedulerPass
+		if err := json.Unmarshal(data, &pass); err != nil {
+			log.Printf("Invalid scheduler pass: %v", err)
+		} else {
+			dispatched := []Dispatch{}
+			for _, d := range pass.Dispatched {
+				if d.Lab == lab {
+					dispatched = append(dispatched, d)
+				}
+			}
+			pass.Dispatched = dispatched
+			// Other labs and their errors are left out.
+			pass.Labs, pass.Errors, pass.Waiting = nil, nil, 0
+			status.LastPass = &pass
+		}
+	}
+	c.JSON(http.StatusOK, status)
+}
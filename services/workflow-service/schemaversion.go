@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Each workflow is stored marked with the schema_version it was written at;
+// those written before versioning have none and are at version 0. Older
+// workflows are upgraded by workflowRecordMigrations as they are read, so
+// the Workflow struct only decodes the current layout, and every save
+// stores the current version. POST /workflows/migrate rewrites the
+// workflows still stored at an older version.
+//
+// Add a migration to the end when changing how workflows are stored; never
+// edit one that has been released.
+var workflowRecordMigrations = []func(record map[string]interface{}) error{
+	// 1: workflows are marked with their schema version; the layout is
+	// unchanged.
+	func(record map[string]interface{}) error { return nil },
+}
+
+// workflowSchemaVersion is the schema version workflows are written at.
+var workflowSchemaVersion = len(workflowRecordMigrations)
+
+// upgradeRecord applies the migrations a stored JSON document needs and
+// returns it at the latest version, with the version it was stored at.
+func upgradeRecord(data []byte, migrations []func(record map[string]interface{}) error) ([]byte, int, error) {
+	var stored struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, 0, err
+	}
+	if stored.SchemaVersion == len(migrations) {
+		return data, stored.SchemaVersion, nil
+	}
+	if stored.SchemaVersion < 0 || stored.SchemaVersion > len(migrations) {
+		return nil, 0, fmt.Errorf("schema version %d is not supported; the latest is %d", stored.SchemaVersion, len(migrations))
+	}
+
+	// Numbers are kept as written, so step results' values survive.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var record map[string]interface{}
+	if err := decoder.Decode(&record); err != nil {
+		return nil, 0, err
+	}
+	for version := stored.SchemaVersion + 1; version <= len(migrations); version++ {
+		if err := migrations[version-1](record); err != nil {
+			return nil, 0, fmt.Errorf("schema migration %d: %w", version, err)
+		}
+	}
+	record["schema_version"] = len(migrations)
+	upgraded, err := json.Marshal(record)
+	if err != nil {
+		return nil, 0, err
+	}
+	return upgraded, stored.SchemaVersion, nil
+}
+
+// decodeWorkflows reads a lab's stored workflows, upgrading each to the
+// current schema. Their SchemaVersion is left at the version they were
+// stored at, so workflows still to be rewritten can be found.
+func decodeWorkflows(data []byte) (map[string]Workflow, error) {
+	var records map[string]json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	workflows := make(map[string]Workflow, len(records))
+	for id, record := range records {
+		upgraded, version, err := upgradeRecord(record, workflowRecordMigrations)
+		if err != nil {
+			return nil, fmt.Errorf("workflow %s: %w", id, err)
+		}
+		var workflow Workflow
+		if err := json.Unmarshal(upgraded, &workflow); err != nil {
+			return nil, fmt.Errorf("workflow %s: %w", id, err)
+		}
+		workflow.SchemaVersion = version
+		workflows[id] = workflow
+	}
+	return workflows, nil
+}
+
+// encodeWorkflows returns a lab's workflows as they are stored, marking
+// each at the current schema version.
+func encodeWorkflows(workflows map[string]Workflow) ([]byte, error) {
+	for id, workflow := range workflows {
+		workflow.SchemaVersion = workflowSchemaVersion
+		workflows[id] = workflow
+	}
+	return json.Marshal(workflows)
+}
+
+// MigrationReport lists the workflows stored at an older schema version
+// that a migration rewrote, or would rewrite on a dry run.
+type MigrationReport struct {
+	DryRun        bool     `json:"dry_run"`
+	SchemaVersion int      `json:"schema_version"`
+	Migrated      []string `json:"migrated"`
+}
+
+// migrateWorkflows rewrites every lab's workflows if any is stored at an
+// older schema version.
+func migrateWorkflows(dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{DryRun: dryRun, SchemaVersion: workflowSchemaVersion, Migrated: []string{}}
+	labs, err := listLabs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, lab := range labs {
+		key := labKey(lab, WORKFLOWS_KEY)
+		var migrated []string
+		err := redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			migrated = nil
+			data, err := tx.Get(ctx, key).Result()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			workflows, err := decodeWorkflows([]byte(data))
+			if err != nil {
+				return err
+			}
+			for id, workflow := range workflows {
+				if workflow.SchemaVersion < workflowSchemaVersion {
+					migrated = append(migrated, id)
+				}
+			}
+			if dryRun || len(migrated) == 0 {
+				return nil
+			}
+			updated, err := encodeWorkflows(workflows)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, updated, 0)
+				return nil
+			})
+			return err
+		}, key)
+		if err == redis.TxFailedErr {
+			// The lab's workflows were saved meanwhile, which stored them
+			// all at the current version.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Migrated = append(report.Migrated, migrated...)
+	}
+	sort.Strings(report.Migrated)
+	return report, nil
+}
+
+// migrateWorkflowsHandler rewrites the workflows stored at an older schema
+// version; ?dry_run=true only lists them.
+func migrateWorkflowsHandler(c *gin.Context) {
+	report, err := migrateWorkflows(c.Query("dry_run") == "true")
+	if err != nil {
+		log.Printf("Error migrating workflows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to migrate workflows"})
+		return
+	}
+	if !report.DryRun {
+		log.Printf("Migrated %d workflow(s) to schema version %d", len(report.Migrated), report.SchemaVersion)
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"workflow-service/deviceapi"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Starting a workflow with ?simulate=true runs its steps on a virtual copy
+// of its device instead, so a protocol can be tried out without booking or
+// occupying the instrument. The device service reports how long each step
+// would take and what it would use; the sample service checks the samples
+// hold the volume every step draws, without drawing it. The workflow is
+// left as it was, whatever its status.
+
+// WorkflowSimulation is a workflow's simulated run. SampleVolumeUL is what
+// the run would draw from each sample; Samples is the sample service's
+// check of it. OK is whether every step could run and the samples hold
+// enough.
+type WorkflowSimulation struct {
+	WorkflowID     string                  `json:"workflow_id"`
+	DeviceID       string                  `json:"device_id"`
+	Simulated      bool                    `json:"simulated"`
+	OK             bool                    `json:"ok"`
+	Run            *deviceapi.SimulatedRun `json:"run"`
+	SampleVolumeUL float64                 `json:"sample_volume_ul,omitempty"`
+	Samples        map[string]interface{}  `json:"samples,omitempty"`
+	Issues         []string                `json:"issues"`
+}
+
+// simulateWorkflow responds with the workflow's run simulated on a virtual
+// copy of its device.
+func simulateWorkflow(c *gin.Context, workflow *Workflow) {
+	caller := requestCaller(c)
+	req := deviceapi.SimulateRunRequest{Steps: make([]deviceapi.SimulateStep, len(workflow.Steps))}
+	volume := 0.0
+	firstDraw := -1
+	for i, step := range workflow.Steps {
+		params := workflow.stepParams(i)
+		req.Steps[i] = deviceapi.SimulateStep{Operation: step, Params: params}
+		if v, _ := stepVolume(params); v > 0 {
+			volume += v
+			if firstDraw < 0 {
+				firstDraw = i
+			}
+		}
+	}
+
+	client := deviceapi.NewClient(deviceAPIURL+"/v"+API_VERSION, caller.setHeaders)
+	client.HTTPClient = &http.Client{Transport: serviceTransport}
+	run, err := client.SimulateRun(c.Request.Context(), workflow.DeviceID, req)
+	var respErr *deviceapi.ResponseError
+	if errors.As(err, &respErr) {
+		var details map[string]interface{}
+		json.Unmarshal(respErr.Body, &details)
+		log.Printf("Failed to simulate workflow %s on device %s: %d - %s", workflow.ID, workflow.DeviceID, respErr.StatusCode, string(respErr.Body))
+		c.JSON(respErr.StatusCode, upstreamError("Failed to simulate workflow", deviceServiceName, respErr.StatusCode, details, caller))
+		return
+	}
+	if err != nil {
+		log.Printf("Error communicating with device service: %v", err)
+		c.JSON(http.StatusInternalServerError, unreachableError(fmt.Sprintf("Failed to communicate with device service: %v", err), deviceServiceName, caller))
+		return
+	}
+
+	simulation := WorkflowSimulation{
+		WorkflowID: workflow.ID,
+		DeviceID:   workflow.DeviceID,
+		Simulated:  true,
+		OK:         run.Ok,
+		Run:        run,
+		Issues:     []string{},
+	}
+	for _, step := range run.Steps {
+		if step.Error != "" {
+			simulation.Issues = append(simulation.Issues, fmt.Sprintf("Step %d (%s): %s", step.StepIndex, step.Operation, step.Error))
+		}
+	}
+
+	if volume > 0 && len(workflow.SampleBarcodes) > 0 {
+		simulation.SampleVolumeUL = volume
+		status, details, err := consumeSampleVolume(workflow, firstDraw, volume, true, caller)
+		if err != nil {
+			log.Printf("Error communicating with sample service: %v", err)
+			c.JSON(http.StatusInternalServerError, unreachableError(fmt.Sprintf("Failed to communicate with sample service: %v", err), sampleServiceName, caller))
+			return
+		}
+		simulation.Samples = details
+		if status != http.StatusOK {
+			simulation.OK = false
+			simulation.Issues = append(simulation.Issues, fmt.Sprintf("Samples don't hold the %g uL each the run draws", volume))
+		}
+	}
+
+	log.Printf("Simulated workflow %s on device %s: %d ms, ok %t", workflow.ID, workflow.DeviceID, run.TotalDurationMs, simulation.OK)
+	c.JSON(http.StatusOK, simulation)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A snapshot is every lab's workflows, archived and deleted ones included
+// (with archived_at or deleted_at set), in one versioned JSON document, to be
+// restored into a fresh environment after the device and sample services'
+// snapshots, as workflows refer to their devices and samples.
+const (
+	SNAPSHOT_SERVICE = "workflow-service"
+	SNAPSHOT_VERSION = 1
+)
+
+type WorkflowSnapshot struct {
+	Service   string     `json:"service"`
+	Version   int        `json:"version"`
+	CreatedAt string     `json:"created_at"`
+	Workflows []Workflow `json:"workflows"`
+}
+
+var workflowStatuses = []WorkflowStatus{StatusCreated, StatusRunning, StatusCompleted, StatusPaused, StatusFailed}
+
+// listLabs returns every lab with workflows, "" for the default lab
+// first.
+func listLabs() ([]string, error) {
+	labs := []string{""}
+	iter := redisClient.Scan(ctx, 0, labKey("*", WORKFLOWS_KEY), 100).Iterator()
+	for iter.Next(ctx) {
+		lab := strings.TrimSuffix(strings.TrimPrefix(iter.Val(), "lab:"), ":"+WORKFLOWS_KEY)
+		if labPattern.MatchString(lab) {
+			labs = append(labs, lab)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(labs[1:])
+	return labs, nil
+}
+
+func takeWorkflowSnapshot() (*WorkflowSnapshot, error) {
+	labs, err := listLabs()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &WorkflowSnapshot{
+		Service:   SNAPSHOT_SERVICE,
+		Version:   SNAPSHOT_VERSION,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Workflows: []Workflow{},
+	}
+	for _, lab := range labs {
+		workflows, err := getAllWorkflows(lab)
+		if err != nil {
+			return nil, err
+		}
+		archived, err := getArchivedWorkflows(lab)
+		if err != nil {
+			return nil, err
+		}
+		trashed, err := getStoredWorkflows(lab, TRASH_KEY)
+		if err != nil {
+			return nil, err
+		}
+		for _, stored := range []map[string]Workflow{workflows, archived, trashed} {
+			for _, workflow := range stored {
+				workflow.Lab = lab
+				snapshot.Workflows = append(snapshot.Workflows, workflow)
+			}
+		}
+	}
+	sort.Slice(snapshot.Workflows, func(i, j int) bool {
+		a, b := snapshot.Workflows[i], snapshot.Workflows[j]
+		if a.Lab != b.Lab {
+			return a.Lab < b.Lab
+		}
+		return a.ID < b.ID
+	})
+	return snapshot, nil
+}
+
+// validate checks a snapshot holds well-formed workflows of this service.
+func (snapshot WorkflowSnapshot) validate() error {
+	if snapshot.Service != SNAPSHOT_SERVICE {
+		return fmt.Errorf("snapshot is of %q, not %s", snapshot.Service, SNAPSHOT_SERVICE)
+	}
+	if snapshot.Version != SNAPSHOT_VERSION {
+		return fmt.Errorf("snapshot version %d is not supported; expected %d", snapshot.Version, SNAPSHOT_VERSION)
+	}
+	seen := map[string]bool{}
+	for _, workflow := range snapshot.Workflows {
+		if workflow.ID == "" || workflow.DeviceID == "" {
+			return fmt.Errorf("workflow %q has no ID or device", workflow.ID)
+		}
+		if workflow.Lab != "" && !labPattern.MatchString(workflow.Lab) {
+			return fmt.Errorf("workflow %s has invalid lab %q", workflow.ID, workflow.Lab)
+		}
+		key := workflow.Lab + "/" + workflow.ID
+		if seen[key] {
+			return fmt.Errorf("workflow %s appears twice", workflow.ID)
+		}
+		seen[key] = true
+
+		known := false
+		for _, status := range workflowStatuses {
+			known = known || workflow.Status == status
+		}
+		if !known {
+			return fmt.Errorf("workflow %s has unknown status %q", workflow.ID, workflow.Status)
+		}
+	}
+	return nil
+}
+
+// getSnapshotHandler returns every lab's workflows as a snapshot.
+func getSnapshotHandler(c *gin.Context) {
+	snapshot, err := takeWorkflowSnapshot()
+	if err != nil {
+		log.Printf("Error taking snapshot: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to take snapshot"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="workflows-%s.json"`, time.Now().UTC().Format("20060102T150405Z")))
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// restoreSnapshotHandler adds a snapshot's workflows to their labs,
+// replacing stored workflows with the same IDs. Nothing is restored unless
+// every workflow's device and samples exist in its lab.
+func restoreSnapshotHandler(c *gin.Context) {
+	var snapshot WorkflowSnapshot
+	if err := c.ShouldBindJSON(&snapshot); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot: " + err.Error()})
+		return
+	}
+	if err := snapshot.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	byLab := map[string]map[string]Workflow{}
+	archivedByLab := map[string]map[string]Workflow{}
+	trashedByLab := map[string]map[string]Workflow{}
+	for _, workflow := range snapshot.Workflows {
+		workflows, ok := byLab[workflow.Lab]
+		if !ok {
+			var err error
+			if workflows, err = getAllWorkflows(workflow.Lab); err != nil {
+				log.Printf("Error getting workflows: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflows"})
+				return
+			}
+			byLab[workflow.Lab] = workflows
+			if archivedByLab[workflow.Lab], err = getArchivedWorkflows(workflow.Lab); err != nil {
+				log.Printf("Error getting archived workflows: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflows"})
+				return
+			}
+			if trashedByLab[workflow.Lab], err = getStoredWorkflows(workflow.Lab, TRASH_KEY); err != nil {
+				log.Printf("Error getting deleted workflows: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflows"})
+				return
+			}
+		}
+
+		// References are checked as a user of the workflow's lab, so they
+		// must be in the same lab.
+		caller := requestCaller(c)
+		caller.Lab, caller.Role = workflow.Lab, ""
+		if status, err := checkReferences(c, caller, workflow.DeviceID, workflow.SampleBarcodes); err != nil {
+			c.JSON(status, gin.H{"error": fmt.Sprintf("Workflow %s: %v", workflow.ID, err)})
+			return
+		}
+		// Archived and deleted workflows go back to the archive and the
+		// trash
+		delete(workflows, workflow.ID)
+		delete(archivedByLab[workflow.Lab], workflow.ID)
+		delete(trashedByLab[workflow.Lab], workflow.ID)
+		switch {
+		case workflow.DeletedAt != "":
+			trashedByLab[workflow.Lab][workflow.ID] = workflow
+		case workflow.ArchivedAt != "":
+			archivedByLab[workflow.Lab][workflow.ID] = workflow
+		default:
+			workflows[workflow.ID] = workflow
+		}
+	}
+
+	for lab, workflows := range byLab {
+		if err := saveWorkflows(lab, workflows); err != nil {
+			log.Printf("Error saving workflows: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore snapshot"})
+			return
+		}
+		if err := saveArchivedWorkflows(lab, archivedByLab[lab]); err != nil {
+			log.Printf("Error saving archived workflows: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore snapshot"})
+			return
+		}
+		if err := saveStoredWorkflows(lab, TRASH_KEY, trashedByLab[lab]); err != nil {
+			log.Printf("Error saving deleted workflows: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore snapshot"})
+			return
+		}
+	}
+
+	log.Printf("Restored snapshot of %d workflows taken at %s", len(snapshot.Workflows), snapshot.CreatedAt)
+	c.JSON(http.StatusOK, gin.H{"restored": len(snapshot.Workflows)})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of timeline interval.
+const (
+	IntervalQueued = "queued"
+	IntervalStep   = "step"
+	IntervalIdle   = "idle"
+	IntervalPaused = "paused"
+)
+
+// TimelineInterval is a span of a workflow's run, as a bar of a Gantt
+// chart. Open intervals are still going on and end now.
+type TimelineInterval struct {
+	Kind       string `json:"kind"`
+	Label      string `json:"label"`
+	StepIndex  *int   `json:"step_index,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Start      string `json:"start"`
+	End        string `json:"end"`
+	DurationMS int64  `json:"duration_ms"`
+	Open       bool   `json:"open,omitempty"`
+	// Approximate is set on steps saved before their start was recorded,
+	// which are taken to start when the one before them ended.
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+// Timeline is a workflow's run as intervals, ordered by start.
+type Timeline struct {
+	WorkflowID string             `json:"workflow_id"`
+	Status     WorkflowStatus     `json:"status"`
+	Start      string             `json:"start,omitempty"`
+	End        string             `json:"end,omitempty"`
+	DurationMS int64              `json:"duration_ms"`
+	Intervals  []TimelineInterval `json:"intervals"`
+}
+
+// parseTime reads a stored timestamp, the zero time if it is empty or
+// invalid.
+func parseTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func newInterval(kind, label string, start, end time.Time, open bool) TimelineInterval {
+	return TimelineInterval{
+		Kind:       kind,
+		Label:      label,
+		Start:      start.UTC().Format(time.RFC3339),
+		End:        end.UTC().Format(time.RFC3339),
+		DurationMS: end.Sub(start).Milliseconds(),
+		Open:       open,
+	}
+}
+
+// timeline builds a workflow's timeline from its timestamps, step results
+// and pauses, as of now: the wait for its device while queued, each step
+// that ran, the times it was paused, and the idle gaps between steps while
+// it was running otherwise.
+func (w *Workflow) timeline(now time.Time) Timeline {
+	timeline := Timeline{WorkflowID: w.ID, Status: w.Status, Intervals: []TimelineInterval{}}
+	queuedAt, startedAt := parseTime(w.QueuedAt), parseTime(w.StartedAt)
+	finishedAt := parseTime(w.CompletedAt)
+	if finishedAt.IsZero() {
+		finishedAt = parseTime(w.FailedAt)
+	}
+
+	if !queuedAt.IsZero() {
+		end, open := startedAt, false
+		switch {
+		case end.IsZero() && !finishedAt.IsZero():
+			// Failed while queued
+			end = finishedAt
+		case end.IsZero():
+			end, open = now, true
+		}
+		timeline.Intervals = append(timeline.Intervals, newInterval(IntervalQueued, "Waiting for "+w.DeviceID, queuedAt, end, open))
+	}
+
+	// Pauses, which idle gaps leave out
+	var paused [][2]time.Time
+	for _, pause := range w.Pauses {
+		start, end, open := parseTime(pause.PausedAt), parseTime(pause.ResumedAt), false
+		if start.IsZero() {
+			continue
+		}
+		switch {
+		case end.IsZero() && !finishedAt.IsZero():
+			// Failed while paused
+			end = finishedAt
+		case end.IsZero():
+			end, open = now, true
+		}
+		label := "Paused"
+		if pause.Reason != "" {
+			label = pause.Reason
+		}
+		timeline.Intervals = append(timeline.Intervals, newInterval(IntervalPaused, label, start, end, open))
+		paused = append(paused, [2]time.Time{start, end})
+	}
+	addIdle := func(start, end time.Time, open bool) {
+		for _, window := range paused {
+			if !window[0].Before(end) || !window[1].After(start) {
+				continue
+			}
+			if window[0].After(start) {
+				timeline.Intervals = append(timeline.Intervals, newInterval(IntervalIdle, "Idle", start, window[0], false))
+			}
+			start = window[1]
+		}
+		if end.After(start) {
+			timeline.Intervals = append(timeline.Intervals, newInterval(IntervalIdle, "Idle", start, end, open))
+		}
+	}
+
+	if !startedAt.IsZero() {
+		previousEnd := startedAt
+		for _, result := range w.StepResults {
+			end := parseTime(result.ExecutedAt)
+			if end.IsZero() {
+				continue
+			}
+			start, approximate := parseTime(result.StartedAt), false
+			if start.IsZero() {
+				start, approximate = previousEnd, true
+			}
+			if start.After(end) {
+				start = end
+			}
+			if start.After(previousEnd) {
+				addIdle(previousEnd, start, false)
+			}
+			index := result.StepIndex
+			interval := newInterval(IntervalStep, result.Step, start, end, false)
+			interval.StepIndex = &index
+			interval.Status = result.Status
+			interval.Approximate = approximate
+			timeline.Intervals = append(timeline.Intervals, interval)
+			if end.After(previousEnd) {
+				previousEnd = end
+			}
+		}
+
+		// After the last step, until the workflow finished or now
+		end, open := finishedAt, false
+		if end.IsZero() && (w.Status == StatusRunning || w.Status == StatusPaused) {
+			end, open = now, true
+		}
+		if !end.IsZero() && end.After(previousEnd) {
+			addIdle(previousEnd, end, open)
+		}
+	}
+
+	sort.SliceStable(timeline.Intervals, func(i, j int) bool {
+		return timeline.Intervals[i].Start < timeline.Intervals[j].Start
+	})
+	if len(timeline.Intervals) > 0 {
+		first, last := timeline.Intervals[0], timeline.Intervals[len(timeline.Intervals)-1]
+		timeline.Start, timeline.End = first.Start, last.End
+		timeline.DurationMS = parseTime(last.End).Sub(parseTime(first.Start)).Milliseconds()
+	}
+	return timeline
+}
+
+func getWorkflowTimelineHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	workflow, err := getWorkflow(requestLab(c), workflowID)
+	if err != nil {
+		log.Printf("Error getting workflow: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve workflow"})
+		return
+	}
+
+	if workflow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, workflow.timeline(time.Now()))
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TRASH_KEY keeps each lab's deleted workflows. Deleting a workflow moves
+// it here, out of the active list and the archive, with deleted_at set;
+// it can be restored to where it was until it is purged TRASH_RETENTION (a
+// duration such as 720h, the default) after it was deleted, by a janitor
+// running every RETENTION_CHECK_INTERVAL. TRASH_RETENTION=0 keeps deleted
+// workflows until they are restored.
+const (
+	TRASH_KEY             = "workflows:trash"
+	defaultTrashRetention = 30 * 24 * time.Hour
+)
+
+var trashRetention = defaultTrashRetention
+
+// TrashedWorkflow is a deleted workflow with when it will be purged.
+type TrashedWorkflow struct {
+	Workflow
+	PurgeAfter string `json:"purge_after,omitempty"`
+}
+
+// deletable reports whether the workflow can be deleted: it mustn't hold
+// or wait for its device.
+func (w Workflow) deletable() bool {
+	return w.Status == StatusCreated || w.finished()
+}
+
+// purgeAfter returns when a deleted workflow will be purged, or "" if it
+// is kept.
+func (w Workflow) purgeAfter() string {
+	deleted, err := time.Parse(time.RFC3339, w.DeletedAt)
+	if err != nil || trashRetention == 0 {
+		return ""
+	}
+	return deleted.Add(trashRetention).Format(time.RFC3339)
+}
+
+// deleteWorkflowHandler moves a workflow, active or archived, to the
+// trash.
+func deleteWorkflowHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	var deleted *Workflow
+	deletable := true
+	err := rewriteWorkflows(requestLab(c), []string{WORKFLOWS_KEY, ARCHIVE_KEY, TRASH_KEY}, func(stored []map[string]Workflow) (bool, error) {
+		deleted, deletable = nil, true
+		for _, workflows := range stored[:2] {
+			workflow, ok := workflows[workflowID]
+			if !ok {
+				continue
+			}
+			if !workflow.deletable() {
+				deletable = false
+				return false, nil
+			}
+			delete(workflows, workflowID)
+			workflow.DeletedAt = time.Now().UTC().Format(time.RFC3339)
+			workflow.DeletedBy = requestActor(c)
+			stored[2][workflowID] = workflow
+			deleted = &workflow
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		log.Printf("Error deleting workflow %s: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete workflow"})
+		return
+	}
+	if !deletable {
+		c.JSON(http.StatusConflict, gin.H{"error": "Queued, running or paused workflows can't be deleted; fail them first"})
+		return
+	}
+	if deleted == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Workflow not found"})
+		return
+	}
+
+	log.Printf("Workflow %s moved to the trash", workflowID)
+	c.JSON(http.StatusOK, TrashedWorkflow{Workflow: *deleted, PurgeAfter: deleted.purgeAfter()})
+}
+
+// listTrashHandler lists the lab's deleted workflows, most recently
+// deleted first.
+func listTrashHandler(c *gin.Context) {
+	workflows, err := getStoredWorkflows(requestLab(c), TRASH_KEY)
+	if err != nil {
+		log.Printf("Error getting deleted workflows: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve deleted workflows"})
+		return
+	}
+
+	trashed := make([]TrashedWorkflow, 0, len(workflows))
+	for _, workflow := range workflows {
+		trashed = append(trashed, TrashedWorkflow{Workflow: workflow, PurgeAfter: workflow.purgeAfter()})
+	}
+	sort.Slice(trashed, func(i, j int) bool {
+		if trashed[i].DeletedAt != trashed[j].DeletedAt {
+			return trashed[i].DeletedAt > trashed[j].DeletedAt
+		}
+		return trashed[i].ID < trashed[j].ID
+	})
+	c.JSON(http.StatusOK, trashed)
+}
+
+// restoreFromTrashHandler puts a deleted workflow back where it was
+// deleted from: the archive if it was archived, else the active list.
+func restoreFromTrashHandler(c *gin.Context) {
+	workflowID := c.Param("workflow_id")
+
+	var restored *Workflow
+	err := rewriteWorkflows(requestLab(c), []string{TRASH_KEY, WORKFLOWS_KEY, ARCHIVE_KEY}, func(stored []map[string]Workflow) (bool, error) {
+		restored = nil
+		workflow, ok := stored[0][workflowID]
+		if !ok {
+			return false, nil
+		}
+		delete(stored[0], workflowID)
+		workflow.DeletedAt, workflow.DeletedBy = "", ""
+		if workflow.ArchivedAt != "" {
+			stored[2][workflowID] = workflow
+		} else {
+			stored[1][workflowID] = workflow
+		}
+		restored = &workflow
+		return true, nil
+	})
+	if err != nil {
+		log.Printf("Error restoring workflow %s from the trash: %v", workflowID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore workflow"})
+		return
+	}
+	if restored == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deleted workflow not found"})
+		return
+	}
+
+	log.Printf("Workflow %s restored from the trash", workflowID)
+	c.JSON(http.StatusOK, restored)
+}
+
+// purgeTrash permanently deletes the workflows deleted before the cutoff,
+// returning their IDs.
+func purgeTrash(cutoff time.Time) ([]string, error) {
+	labs, err := listLabs()
+	if err != nil {
+		return nil, err
+	}
+	purged := []string{}
+	for _, lab := range labs {
+		var expired []string
+		err := rewriteWorkflows(lab, []string{TRASH_KEY}, func(stored []map[string]Workflow) (bool, error) {
+			expired = nil
+			for id, workflow := range stored[0] {
+				deleted, err := time.Parse(time.RFC3339, workflow.DeletedAt)
+				if err == nil && deleted.Before(cutoff) {
+					delete(stored[0], id)
+					expired = append(expired, id)
+				}
+			}
+			return len(expired) > 0, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		forgetDeviceCalls(lab, expired)
+		purged = append(purged, expired...)
+	}
+	sort.Strings(purged)
+	return purged, nil
+}
+
+// startTrashJanitor purges deleted workflows in the background once
+// TRASH_RETENTION has passed.
+func startTrashJanitor() {
+	if value := os.Getenv("TRASH_RETENTION"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid TRASH_RETENTION %q", value)
+		}
+		trashRetention = d
+	}
+	if trashRetention == 0 {
+		return
+	}
+	interval := defaultRetentionInterval
+	if value := os.Getenv("RETENTION_CHECK_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid RETENTION_CHECK_INTERVAL %q", value)
+		}
+		interval = d
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			purged, err := purgeTrash(time.Now().Add(-trashRetention))
+			switch {
+			case err != nil:
+				log.Printf("Error purging deleted workflows: %v", err)
+			case len(purged) > 0:
+				log.Printf("Purged %d workflow(s) deleted more than %s ago", len(purged), trashRetention)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("Purging deleted workflows %s after they are deleted, checking every %s", trashRetention, interval)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A failed call to another service is answered in the shared error
+// envelope: error says what the workflow service failed to do, code is why
+// in words a client can switch on, and upstream holds the other service's
+// status, code, error and the request ID to find the call in its logs by.
+// details keeps the other service's body as it came. Other services give
+// their own code; one that doesn't gets one from its status.
+const (
+	deviceServiceName = "device-service"
+	sampleServiceName = "sample-service"
+
+	// ErrorCodeUpstreamUnreachable is the code of a call that got no
+	// response.
+	ErrorCodeUpstreamUnreachable = "upstream_unreachable"
+)
+
+// UpstreamError is the part of a failed call's error envelope describing
+// the other service's response. Status is 0 if none came back.
+type UpstreamError struct {
+	Service   string `json:"service"`
+	Status    int    `json:"status"`
+	Code      string `json:"code,omitempty"`
+	Error     string `json:"error,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// statusErrorCode is the code given to an error status from a service that
+// didn't give its own.
+func statusErrorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "invalid_request"
+	case http.StatusUnauthorized:
+		return "unauthorized"
+	case http.StatusForbidden:
+		return "forbidden"
+	case http.StatusNotFound:
+		return "not_found"
+	case http.StatusConflict:
+		return "conflict"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	}
+	return "upstream_error"
+}
+
+// upstreamError is the error envelope of a call to service that was
+// answered with status and the decoded body details, made by caller.
+func upstreamError(message, service string, status int, details map[string]interface{}, caller Caller) gin.H {
+	upstream := UpstreamError{Service: service, Status: status, RequestID: caller.RequestID}
+	upstream.Code, _ = details["code"].(string)
+	upstream.Error, _ = details["error"].(string)
+
+	code := upstream.Code
+	if code == "" {
+		code = statusErrorCode(status)
+	}
+	return gin.H{"error": message, "code": code, "details": details, "upstream": upstream}
+}
+
+// unreachableError is the error envelope of a call to service that got no
+// response.
+func unreachableError(message, service string, caller Caller) gin.H {
+	return gin.H{
+		"error":    message,
+		"code":     ErrorCodeUpstreamUnreachable,
+		"upstream": UpstreamError{Service: service, RequestID: caller.RequestID},
+	}
+}
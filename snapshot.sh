@@ -0,0 +1,57 @@
+#!/bin/bash
+
+# Backs up or restores the devices, samples and workflows through the
+# gateway, as an admin:
+#
+#   SESSION_TOKEN=<admin session token> ./snapshot.sh backup [dir]
+#   SESSION_TOKEN=<admin session token> ./snapshot.sh restore <dir>
+#
+# Restores go devices, samples, then workflows, as each service checks what
+# the snapshot refers to in those before it.
+
+API="${GATEWAY_URL:-http://localhost:8080}/api/v1"
+SNAPSHOTS=("devices:admin/snapshot" "samples:samples/snapshot" "workflows:workflows/snapshot")
+
+if [ -z "$SESSION_TOKEN" ]; then
+    echo "❌ Set SESSION_TOKEN to the session token of an admin (POST $API/auth/login)"
+    exit 1
+fi
+
+case "$1" in
+backup)
+    dir="${2:-snapshot-$(date -u +%Y%m%dT%H%M%SZ)}"
+    mkdir -p "$dir"
+    for snapshot in "${SNAPSHOTS[@]}"; do
+        name="${snapshot%%:*}"
+        status=$(curl -s -o "$dir/$name.json" -w "%{http_code}" \
+            -H "Authorization: Bearer $SESSION_TOKEN" "$API/${snapshot#*:}")
+        if [ "$status" != "200" ]; then
+            echo "❌ Backing up $name failed ($status): $(cat "$dir/$name.json")"
+            exit 1
+        fi
+        echo "✓ Backed up $name to $dir/$name.json"
+    done
+    ;;
+restore)
+    dir="$2"
+    if [ -z "$dir" ] || [ ! -d "$dir" ]; then
+        echo "❌ Usage: $0 restore <dir>"
+        exit 1
+    fi
+    for snapshot in "${SNAPSHOTS[@]}"; do
+        name="${snapshot%%:*}"
+        response=$(curl -s -w "\n%{http_code}" -X POST \
+            -H "Authorization: Bearer $SESSION_TOKEN" -H "Content-Type: application/json" \
+            --data-binary "@$dir/$name.json" "$API/${snapshot#*:}")
+        if [ "$(echo "$response" | tail -n 1)" != "200" ]; then
+            echo "❌ Restoring $name failed: $(echo "$response" | head -n -1)"
+            exit 1
+        fi
+        echo "✓ Restored $name: $(echo "$response" | head -n -1)"
+    done
+    ;;
+*)
+    echo "Usage: $0 backup [dir] | restore <dir>"
+    exit 1
+    ;;
+esac
@@ -13,7 +13,7 @@ echo ""
 echo "Starting test in 3 seconds..."
 sleep 3
 
-WORKFLOW_API="http://localhost:5003"
+WORKFLOW_API="http://localhost:8080/api/v1"
 DEVICE_ID="liquid-handler-1"
 
 echo ""
@@ -66,8 +66,8 @@ echo "2. Expected: You should see ONE 'successfully booked' message"
 echo "   Bug: You may see MULTIPLE 'successfully booked' messages"
 echo ""
 echo "3. Check device status:"
-echo "   curl http://localhost:5001/devices/liquid-handler-1"
+echo "   curl http://localhost:8080/api/v1/devices/liquid-handler-1"
 echo ""
 echo "4. List all workflows to see which ones are 'running':"
-echo "   curl http://localhost:5003/workflows | jq '.[] | select(.status==\"running\") | {name, id, status}'"
+echo "   curl http://localhost:8080/api/v1/workflows | jq '.[] | select(.status==\"running\") | {name, id, status}'"
 echo ""
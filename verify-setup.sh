@@ -80,7 +80,10 @@ echo "Next steps:"
 echo "1. Start the system: docker-compose up --build"
 echo "2. Verify services are running at:"
 echo "   - Frontend: http://localhost:3000"
+echo "   - API Gateway: http://localhost:8080/health"
 echo "   - Workflow API: http://localhost:5003/health"
 echo "   - Device API: http://localhost:5001/health"
 echo "   - Sample API: http://localhost:5002/health"
+echo "   - Notification API: http://localhost:5004/health"
+echo "   - User API: http://localhost:5005/health"
 echo ""